@@ -0,0 +1,91 @@
+package tracey
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+)
+
+// The states of `Span.ended` past 1, for the spans which were abandoned,
+// see "AbandonAfter"
+const (
+	endedAbandoned = 2
+
+	// Once the late exit of the span was noted
+	endedLate = 3
+)
+
+// Returns how long the spans of a function may stay open, 0 if forever
+func (t *Tracer) abandonDeadline(name string) time.Duration {
+	if d := t.abandonAfter.lookup(name, ""); d > 0 {
+		return d
+	}
+	return t.options.AbandonAfter
+}
+
+// Force-closes the spans open for longer than their deadline. Returns
+// false if there are no spans open at all.
+func (sc *scanner) scanAbandoned(t *Tracer, now time.Time) bool {
+	var due []*Span
+	open := false
+	t.goroutines.each(func(gid uint64, spans []*Span) {
+		open = true
+		for _, s := range spans {
+			if d := t.abandonDeadline(s.ev.Name); d > 0 && now.Sub(s.ev.Time) >= d {
+				due = append(due, s)
+			}
+		}
+	})
+	for _, s := range due {
+		t.abandon(s, false)
+	}
+	return open
+}
+
+// Ends the span on behalf of its goroutine, unless it ended or was
+// suspended meanwhile, in which case it returns false. "atClose" is set
+// for the spans `CloseGraceful(...)` force-closes.
+func (t *Tracer) abandon(s *Span, atClose bool) bool {
+	s.pause.Lock()
+	abandoned := !s.pause.suspended && atomic.CompareAndSwapUint32(&s.ended, 0, endedAbandoned)
+	if abandoned {
+		s.forcedAtClose = atClose
+	}
+	s.pause.Unlock()
+	if abandoned {
+		t.end(s)
+	}
+	return abandoned
+}
+
+// Fills in the exit of an abandoned span
+func (t *Tracer) exitAbandoned(span *Span, ev *Event) {
+	ev.Abandoned = true
+	if !span.forcedAtClose {
+		ev.abandonAfter = t.abandonDeadline(span.ev.Name)
+	}
+}
+
+// Notes that an abandoned span was ended after all, the first time it is
+func (t *Tracer) lateExit(s *Span) {
+	if !atomic.CompareAndSwapUint32(&s.ended, endedAbandoned, endedLate) || s.muted {
+		return
+	}
+	warning := "Warning: late exit for abandoned span " + s.ev.Name + ", ignored\n"
+	if t.admitOutput(len(warning)) {
+		t.note(warning)
+	}
+}
+
+// Renders the deadline an abandoned span missed, as in " (abandoned after
+// 10m0s — forced close)", or " (abandoned at close — forced close)" for
+// those `CloseGraceful(...)` force-closed
+func renderAbandoned(buf *bytes.Buffer, ev *Event) {
+	if ev.abandonAfter == 0 {
+		buf.WriteString(" (abandoned at close — forced close)")
+		return
+	}
+	buf.WriteString(" (abandoned after ")
+	writeDuration(buf, ev.abandonAfter)
+	buf.WriteString(" — forced close)")
+}
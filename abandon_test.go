@@ -0,0 +1,85 @@
+package tracey
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAbandonAfter(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Writer: &out}},
+		Clock:                 clock.Now,
+		EnableInstrumentation: true,
+		AbandonAfter:          10 * time.Minute,
+		AbandonAfterFuncs:     map[string]time.Duration{"^fetch$": time.Minute},
+	})
+	t.Close()
+
+	work := t.StartNamed("work", "%s", "$FN")
+	fetch := t.StartNamed("fetch", "%s", "$FN")
+	t.scanner.scan(t, clock.advance(2*time.Minute))
+	t.scanner.scan(t, clock.advance(9*time.Minute))
+
+	// The real exits come too late
+	fetch.End()
+	fetch.End()
+	work.End()
+	t.StartNamed("fetch", "%s", "$FN").End()
+
+	assert.Equal(test, "[ 0]ENTER: =>work\n"+
+		"[ 1]  ENTER: =>fetch\n"+
+		"[ 1]  EXIT:  =>fetch ... in 2m0s (abandoned after 1m0s — forced close)\n"+
+		"[ 0]EXIT:  =>work ... in 11m0s (abandoned after 10m0s — forced close)\n"+
+		"Warning: late exit for abandoned span fetch, ignored\n"+
+		"Warning: late exit for abandoned span work, ignored\n"+
+		"[ 0]ENTER: =>fetch\n"+
+		"[ 0]EXIT:  =>fetch ... in 0s\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+
+	// Apart from the calls which exited
+	for _, s := range t.Stats() {
+		if s.Name == "fetch" {
+			assert.Equal(test, uint64(1), s.Calls)
+			assert.Equal(test, uint64(1), s.Abandoned)
+			assert.Equal(test, 2*time.Minute, s.AbandonedTime)
+			assert.Equal(test, []time.Duration{0}, s.Samples)
+		}
+	}
+}
+
+func TestAbandonJSON(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out, Format: JSONFormat}}, Clock: clock.Now, AbandonAfter: time.Minute})
+	t.Close()
+
+	t.StartNamed("work")
+	t.scanner.scan(t, clock.advance(time.Minute))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(test, lines, 2)
+	ev, err := UnmarshalEvent([]byte(lines[1]))
+	assert.Nil(test, err)
+	assert.Equal(test, ExitEvent, ev.Kind)
+	assert.True(test, ev.Abandoned)
+}
+
+func TestAbandonSuspended(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, Clock: clock.Now, AbandonAfter: time.Minute})
+	t.Close()
+
+	span := t.StartNamed("iterate", "%s", "$FN")
+	token := span.Suspend()
+	t.scanner.scan(t, clock.advance(2*time.Minute))
+	assert.NotContains(test, out.String(), "abandoned")
+
+	assert.Nil(test, t.Resume(token))
+	span.End()
+	assert.NotContains(test, out.String(), "abandoned")
+	assert.Equal(test, uint64(0), t.Stats()[0].Abandoned)
+}
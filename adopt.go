@@ -0,0 +1,102 @@
+package tracey
+
+import "errors"
+
+// ErrAdoptCycle is returned by `Tracer.Adopt(...)` for a tracer which is
+// the adopting tracer itself, or adopted it directly or not.
+var ErrAdoptCycle = errors.New("tracey: tracer would adopt itself")
+
+// An AdoptMode is what becomes of the sinks of an adopted tracer, see
+// `Tracer.Adopt(...)`.
+type AdoptMode int
+
+const (
+	// The spans of the adopted tracer are only written to the sinks of
+	// the tracer which adopted it
+	MuteChildSinks AdoptMode = iota
+
+	// They are written to the adopted tracer's own sinks as well, rendered
+	// with its own options but at the depth they have in the adopting
+	// tracer
+	KeepChildSinks
+)
+
+// A tracer adopted by another, see `Tracer.Adopt(...)`
+type adoption struct {
+	parent, child *Tracer
+	mode          AdoptMode
+}
+
+// Adopt redirects the spans of "child", such as the tracer a library
+// brings along, into the tracer, so that the program logs one coherent
+// trace rather than two whose indentation conflicts. The spans the child
+// enters from then on are traced by the tracer: they nest within the span
+// open on the goroutine whichever tracer entered it, are rendered with
+// the tracer's options, and are counted in its `Stats()` under their names
+// prefixed with the child's "Prefix". The child keeps no depth of its own
+// for them. Its spans entered before stay the child's until they end, as
+// do those entered after `Detach(...)`. With "mode" set to
+// `KeepChildSinks` the child's sinks are still written to. Adopting a
+// tracer which another adopted takes it over from that other. Does
+// nothing if either tracer is disabled.
+func (t *Tracer) Adopt(child *Tracer, mode AdoptMode) error {
+	if t.start == nil || child.start == nil {
+		return nil
+	}
+	for p := t; p != nil; {
+		if p == child {
+			return ErrAdoptCycle
+		}
+		a := p.adopter.Load()
+		if a == nil {
+			break
+		}
+		p = a.parent
+	}
+	child.adopter.Store(&adoption{parent: t, child: child, mode: mode})
+	return nil
+}
+
+// Detach undoes `Adopt(...)`, the child tracing its spans itself again
+// from then on. The spans the tracer entered for it stay the tracer's
+// until they end. Does nothing if the tracer did not adopt "child".
+func (t *Tracer) Detach(child *Tracer) {
+	if a := child.adopter.Load(); a != nil && a.parent == t {
+		child.adopter.CompareAndSwap(a, nil)
+	}
+}
+
+// Enters a span of the child with the parent instead, named after the
+// child's callsite
+func (a *adoption) start(parent *Span, name string, site *callsite, s ...interface{}) *Span {
+	if name != "" {
+		name = a.child.options.Prefix + name
+		return a.parent.start(parent, name, &callsite{name: name, adoption: a}, s...)
+	}
+	if site == nil {
+		site = a.child.callerSite()
+	}
+	return a.parent.start(parent, "", a.site(site), s...)
+}
+
+// Returns the callsite standing for one of the child's in the parent,
+// kept along with it while the adoption lasts
+func (a *adoption) site(site *callsite) *callsite {
+	if adopted := site.adopted.Load(); adopted != nil && adopted.adoption == a {
+		return adopted
+	}
+	adopted := &callsite{name: a.child.options.Prefix + site.name, adoption: a}
+	site.adopted.Store(adopted)
+	return adopted
+}
+
+// Writes an event of the child's spans, which the parent emitted, to the
+// child's sinks if those are kept
+func (a *adoption) emit(ev *Event) {
+	if a.mode != KeepChildSinks {
+		return
+	}
+	own := *ev
+	own.Session, own.config, own.adopted, own.route = "", nil, nil, nil
+	a.child.emitTo(&own, (*sinkState).accepts)
+}
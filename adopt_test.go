@@ -0,0 +1,151 @@
+package tracey
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Stands for the code of a library, traced by its own tracer
+func libQuery(lib *Tracer, n int) {
+	defer lib.Enter("%s", "query")()
+	lib.Event("rows=%d", n)
+}
+
+func TestAdopt(test *testing.T) {
+	var appOut, libOut lockedBuffer
+	app := NewTracer(&Options{Sinks: []Sink{{Writer: &appOut, Format: JSONFormat}}, EnableInstrumentation: true})
+	lib := NewTracer(&Options{Sinks: []Sink{{Writer: &libOut}}, Prefix: "lib.", EnableInstrumentation: true})
+	assert.Nil(test, app.Adopt(lib, MuteChildSinks))
+
+	// The library and the application trace on many goroutines at once,
+	// within each other's spans
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer app.Enter("%s", "handle")()
+			libQuery(lib, i)
+			func() {
+				defer lib.Enter("%s", "commit")()
+				defer app.Enter("%s", "callback")()
+			}()
+		}(i)
+	}
+	wg.Wait()
+	assert.Empty(test, libOut.String())
+
+	// Every goroutine logs one nested tree, whichever tracer entered what
+	type line struct {
+		kind  EventKind
+		depth int
+		name  string
+	}
+	byTID := make(map[uint64][]line)
+	for _, out := range strings.Split(strings.TrimSpace(appOut.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(out))
+		assert.Nil(test, err)
+		byTID[ev.TID] = append(byTID[ev.TID], line{ev.Kind, ev.Depth, strings.TrimPrefix(ev.Name, "go-tracey.")})
+	}
+	assert.Len(test, byTID, 8)
+	for _, lines := range byTID {
+		assert.Equal(test, []line{
+			{EnterEvent, 0, "TestAdopt.func1"},
+			{EnterEvent, 1, "lib.go-tracey.libQuery"},
+			{PointEvent, 2, "lib.go-tracey.libQuery"},
+			{ExitEvent, 1, "lib.go-tracey.libQuery"},
+			{EnterEvent, 1, "lib.go-tracey.TestAdopt.func1.1"},
+			{EnterEvent, 2, "TestAdopt.func1.1"},
+			{ExitEvent, 2, "TestAdopt.func1.1"},
+			{ExitEvent, 1, "lib.go-tracey.TestAdopt.func1.1"},
+			{ExitEvent, 0, "TestAdopt.func1"},
+		}, lines)
+	}
+
+	calls := make(map[string]uint64)
+	for _, s := range app.Stats() {
+		calls[s.Name] = s.Calls
+	}
+	assert.Equal(test, uint64(8), calls["lib.go-tracey.libQuery"], "%v", calls)
+	assert.Empty(test, lib.Stats())
+	assert.Empty(test, app.Snapshot())
+	assert.Empty(test, lib.Snapshot())
+}
+
+func TestAdoptKeepChildSinks(test *testing.T) {
+	var appOut, libOut lockedBuffer
+	app := NewTracer(&Options{Sinks: []Sink{{Writer: &appOut}}})
+	lib := NewTracer(&Options{Sinks: []Sink{{Writer: &libOut}}, EnterMessage: "lib: "})
+	assert.Nil(test, app.Adopt(lib, KeepChildSinks))
+
+	func() {
+		defer app.Enter("%s", "handle")()
+		libQuery(lib, 3)
+	}()
+	assert.Equal(test, 5, strings.Count(appOut.String(), "\n"))
+	// Only the child's spans, rendered its own way
+	assert.Regexp(test, `^\[ 1\]  lib:   =>query\n\[ 2\]    · rows=3 .*\n\[ 1\]  EXIT:  =>query\n$`,
+		RE_tidMarker.ReplaceAllString(libOut.String(), "=>"))
+}
+
+func TestDetach(test *testing.T) {
+	var appOut, libOut lockedBuffer
+	app := NewTracer(&Options{Sinks: []Sink{{Writer: &appOut}}})
+	lib := NewTracer(&Options{Sinks: []Sink{{Writer: &libOut}}})
+
+	// Adopting and detaching while both trace leaves every span with the
+	// tracer it was entered with, at a consistent depth
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				func() {
+					defer app.Enter("%s", "handle")()
+					libQuery(lib, 1)
+				}()
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(test, app.Adopt(lib, MuteChildSinks))
+		app.Detach(lib)
+	}
+	close(stop)
+	wg.Wait()
+
+	for _, out := range []string{appOut.String(), libOut.String()} {
+		assert.NotContains(test, out, "depth became negative")
+	}
+	// Not adopted by then
+	lib.Enter("%s", "after")()
+	assert.Contains(test, RE_tidMarker.ReplaceAllString(libOut.String(), "=>"), "[ 0]ENTER: =>after\n")
+	assert.Empty(test, app.Snapshot())
+	assert.Empty(test, lib.Snapshot())
+}
+
+func TestAdoptCycle(test *testing.T) {
+	a, b, c := NewTracer(&Options{}), NewTracer(&Options{}), NewTracer(&Options{})
+	assert.Equal(test, ErrAdoptCycle, a.Adopt(a, MuteChildSinks))
+	assert.Nil(test, a.Adopt(b, MuteChildSinks))
+	assert.Nil(test, b.Adopt(c, MuteChildSinks))
+	assert.Equal(test, ErrAdoptCycle, c.Adopt(a, MuteChildSinks))
+
+	// Detaching by another tracer than the adopting one does nothing
+	c.Detach(b)
+	assert.NotNil(test, b.adopter.Load())
+	a.Detach(b)
+	assert.Nil(test, b.adopter.Load())
+	assert.Nil(test, NewTracer(&Options{DisableTracing: true}).Adopt(a, MuteChildSinks))
+	assert.Nil(test, a.adopter.Load())
+}
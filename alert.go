@@ -0,0 +1,344 @@
+package tracey
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAlertCooldown is how long a rule stays quiet once it fired,
+// unless its "Cooldown" says otherwise.
+const DefaultAlertCooldown = time.Minute
+
+// How many buckets the window of an `ErrorRate` rule is split into
+const alertBuckets = 10
+
+// An AlertKind is what an `AlertRule` watches for.
+type AlertKind int
+
+const (
+	// More than "Count" failed calls to a function within "Window"
+	ErrorRate AlertKind = iota
+
+	// A call which took longer than "Duration"
+	SlowSpan
+
+	// More than "Count" spans open at once
+	OpenSpans
+
+	// The output reaching "Percent" of "MaxLines" or "MaxBytes"
+	QuotaNearing
+)
+
+// An AlertRule is a threshold which raises an `Alert` when it is crossed,
+// see `Tracer.AddAlert(...)`.
+type AlertRule struct {
+	Kind AlertKind
+
+	// The functions an `ErrorRate` or `SlowSpan` rule watches, a regex
+	// matched against their name, every function if empty
+	Pattern string
+
+	// The thresholds, as "Kind" says
+	Count    int
+	Window   time.Duration
+	Duration time.Duration
+	Percent  float64
+
+	// How long the rule stays quiet once it fired, `DefaultAlertCooldown`
+	// if 0
+	Cooldown time.Duration
+}
+
+// An Alert is raised when a rule is crossed.
+type Alert struct {
+	Rule AlertRule
+	Time time.Time
+
+	// The measurement which crossed the threshold: how many calls failed
+	// within the window, how long the call took in nanoseconds, how many
+	// spans are open, or the percentage of the quota used
+	Value float64
+
+	// The event which crossed it, the exit of the call for `ErrorRate`
+	// and `SlowSpan`, the enter of the span for `OpenSpans`, and zero for
+	// `QuotaNearing`
+	Example Event
+
+	// What the alert says, as in "payment.Process error rate 12/min
+	// exceeds 10/min"
+	Message string
+}
+
+// An AlertID identifies a rule added with `AddAlert(...)`.
+type AlertID uint64
+
+// A rule which was added, along with the state of its evaluation
+type alertRule struct {
+	id      AlertID
+	rule    AlertRule
+	sink    func(Alert)
+	pattern *regexp.Regexp
+
+	// Whether the function names match the pattern, and the failed calls
+	// of each function, in their windows
+	matches sync.Map // name -> bool
+	rings   sync.Map // name -> *alertRing
+
+	// When the rule last fired, in unix nanoseconds
+	fired int64
+}
+
+// The rules of a tracer, replaced as a whole when they change
+type alertSet struct {
+	rules []*alertRule
+}
+
+// The state of the alerts of a tracer
+type alerts struct {
+	set atomic.Pointer[alertSet]
+	mu  sync.Mutex
+	ids AlertID
+
+	// How many spans are open, counted from the first rule added on, and
+	// set from then on
+	open     int64
+	counting uint32
+}
+
+// The failed calls to a function within the window of a rule, in as many
+// buckets, each with the number of the bucket it counts for since the
+// epoch
+type alertRing struct {
+	sync.Mutex
+	counts  [alertBuckets]int
+	buckets [alertBuckets]int64
+}
+
+// AddAlert has "sink" called with an `Alert` whenever the rule is crossed,
+// at most once per its "Cooldown", and returns the id to remove it with.
+// Rules are evaluated as the events are traced, at a cost which does not
+// grow with how many there were: an `ErrorRate` rule counts the failed
+// calls to each function in a ring of buckets spanning its window, a
+// `SlowSpan` rule looks at every exit, an `OpenSpans` rule at how many
+// spans were entered and not exited since the first rule was added, and
+// a `QuotaNearing` rule at every line written against the quota. The sink
+// is called from the goroutine which traced the event. Unless
+// "SilentAlerts" is set, the alert is logged as well, as in "*** ALERT:
+// payment.Process error rate 12/min exceeds 10/min ***". Returns an
+// error for a rule which misses its threshold or has a bad pattern.
+func (t *Tracer) AddAlert(rule AlertRule, sink func(Alert)) (AlertID, error) {
+	r := &alertRule{rule: rule, sink: sink}
+	switch {
+	case rule.Kind < ErrorRate || rule.Kind > QuotaNearing:
+		return 0, fmt.Errorf("bad alert kind %d", rule.Kind)
+	case rule.Kind == ErrorRate && (rule.Count <= 0 || rule.Window <= 0):
+		return 0, errors.New("ErrorRate alerts need a Count and a Window")
+	case rule.Kind == SlowSpan && rule.Duration <= 0:
+		return 0, errors.New("SlowSpan alerts need a Duration")
+	case rule.Kind == OpenSpans && rule.Count <= 0:
+		return 0, errors.New("OpenSpans alerts need a Count")
+	case rule.Kind == QuotaNearing && (rule.Percent <= 0 || rule.Percent > 100):
+		return 0, errors.New("QuotaNearing alerts need a Percent between 0 and 100")
+	}
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return 0, fmt.Errorf("bad pattern in alert: %v", err)
+		}
+		r.pattern = pattern
+	}
+	if r.rule.Cooldown <= 0 {
+		r.rule.Cooldown = DefaultAlertCooldown
+	}
+	a := &t.alerts
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ids++
+	r.id = a.ids
+	set := &alertSet{}
+	if old := a.set.Load(); old != nil {
+		set.rules = append(set.rules, old.rules...)
+	}
+	set.rules = append(set.rules, r)
+	atomic.StoreUint32(&a.counting, 1)
+	a.set.Store(set)
+	return r.id, nil
+}
+
+// RemoveAlert removes the rule, which raises no alert from then on.
+func (t *Tracer) RemoveAlert(id AlertID) {
+	a := &t.alerts
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old := a.set.Load()
+	if old == nil {
+		return
+	}
+	set := &alertSet{}
+	for _, r := range old.rules {
+		if r.id != id {
+			set.rules = append(set.rules, r)
+		}
+	}
+	if len(set.rules) == 0 {
+		set = nil
+	}
+	a.set.Store(set)
+}
+
+// Counts the span as open, and evaluates the `OpenSpans` rules
+func (t *Tracer) alertEnter(span *Span) {
+	span.countedOpen = true
+	open := atomic.AddInt64(&t.alerts.open, 1)
+	set := t.alerts.set.Load()
+	if set == nil {
+		return
+	}
+	for _, r := range set.rules {
+		if r.rule.Kind == OpenSpans && open > int64(r.rule.Count) {
+			t.fire(r, span.ev.Time, float64(open), &span.ev,
+				"open spans "+strconv.FormatInt(open, 10)+" exceeds "+strconv.Itoa(r.rule.Count))
+		}
+	}
+}
+
+// Evaluates the `ErrorRate` and `SlowSpan` rules on the exit of a span
+func (t *Tracer) alertExit(span *Span, ev *Event) {
+	if span.countedOpen {
+		atomic.AddInt64(&t.alerts.open, -1)
+	}
+	set := t.alerts.set.Load()
+	if set == nil {
+		return
+	}
+	for _, r := range set.rules {
+		switch r.rule.Kind {
+		case ErrorRate:
+			if ev.Err == nil || !r.watches(ev.Name) {
+				continue
+			}
+			if n := r.ring(ev.Name).add(ev.Time, r.rule.Window); n > r.rule.Count {
+				t.fire(r, ev.Time, float64(n), ev, fmt.Sprintf("%s error rate %d/%s exceeds %d/%s",
+					ev.Name, n, formatWindow(r.rule.Window), r.rule.Count, formatWindow(r.rule.Window)))
+			}
+		case SlowSpan:
+			if ev.Duration > r.rule.Duration && r.watches(ev.Name) {
+				t.fire(r, ev.Time, float64(ev.Duration), ev, ev.Name+" took "+formatDuration(ev.Duration)+
+					", exceeds "+formatDuration(r.rule.Duration))
+			}
+		}
+	}
+}
+
+// Evaluates the `QuotaNearing` rules once lines were admitted
+func (t *Tracer) alertQuota() {
+	set := t.alerts.set.Load()
+	if set == nil {
+		return
+	}
+	used := quotaUsed(atomic.LoadUint64(&t.quota.lines), t.options.MaxLines)
+	if b := quotaUsed(atomic.LoadUint64(&t.quota.bytes), t.options.MaxBytes); b > used {
+		used = b
+	}
+	for _, r := range set.rules {
+		if r.rule.Kind == QuotaNearing && used >= r.rule.Percent {
+			t.fire(r, t.options.Clock(), used, nil, "output quota "+formatFloat(used)+"% used exceeds "+
+				formatFloat(r.rule.Percent)+"%")
+		}
+	}
+}
+
+// Returns the percentage of the quota used, 0 if it is unlimited
+func quotaUsed(used, max uint64) float64 {
+	if max == 0 {
+		return 0
+	}
+	return float64(used * 100 / max)
+}
+
+// Raises the alert of the rule, unless it fired within its cooldown
+func (t *Tracer) fire(r *alertRule, now time.Time, value float64, example *Event, message string) {
+	last := atomic.LoadInt64(&r.fired)
+	if last != 0 && now.UnixNano()-last < int64(r.rule.Cooldown) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&r.fired, last, now.UnixNano()) {
+		return
+	}
+	alert := Alert{Rule: r.rule, Time: now, Value: value, Message: message}
+	if example != nil {
+		alert.Example = *example
+	}
+	if !t.options.SilentAlerts {
+		line := "*** ALERT: " + message + " ***\n"
+		if t.admitOutput(len(line)) {
+			t.note(line)
+		}
+	}
+	if r.sink != nil {
+		r.sink(alert)
+	}
+}
+
+// Returns true if the rule watches the function
+func (r *alertRule) watches(name string) bool {
+	if r.pattern == nil {
+		return true
+	}
+	if found, ok := r.matches.Load(name); ok {
+		return found.(bool)
+	}
+	matches := r.pattern.MatchString(name)
+	r.matches.Store(name, matches)
+	return matches
+}
+
+func (r *alertRule) ring(name string) *alertRing {
+	if found, ok := r.rings.Load(name); ok {
+		return found.(*alertRing)
+	}
+	found, _ := r.rings.LoadOrStore(name, &alertRing{})
+	return found.(*alertRing)
+}
+
+// Counts a failed call at "now", and returns how many there were within
+// the window up to it, give or take the bucket the window starts in
+func (ring *alertRing) add(now time.Time, window time.Duration) int {
+	width := int64(window) / alertBuckets
+	if width <= 0 {
+		width = 1
+	}
+	bucket := now.UnixNano() / width
+	ring.Lock()
+	defer ring.Unlock()
+	slot := bucket % alertBuckets
+	if ring.buckets[slot] != bucket {
+		ring.buckets[slot], ring.counts[slot] = bucket, 0
+	}
+	ring.counts[slot]++
+	n := 0
+	for i, b := range ring.buckets {
+		if b > bucket-alertBuckets {
+			n += ring.counts[i]
+		}
+	}
+	return n
+}
+
+// Describes the window of a rate, as in "min" for a minute
+func formatWindow(window time.Duration) string {
+	switch window {
+	case time.Second:
+		return "s"
+	case time.Minute:
+		return "min"
+	case time.Hour:
+		return "h"
+	}
+	return window.String()
+}
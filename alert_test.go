@@ -0,0 +1,131 @@
+package tracey
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertErrorRate(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, Clock: clock.Now})
+	var alerts []Alert
+	_, err := t.AddAlert(AlertRule{Kind: ErrorRate, Pattern: `^pay`, Count: 2, Window: time.Minute, Cooldown: 5 * time.Minute},
+		func(a Alert) { alerts = append(alerts, a) })
+	assert.Nil(test, err)
+
+	fail := func(name string) {
+		span := t.StartNamed(name, "%s", "$FN")
+		span.SetError(errors.New("declined"))
+		span.End()
+	}
+	fail("pay")
+	fail("audit")
+	clock.advance(40 * time.Second)
+	fail("pay")
+	// The first failure is out of the window by now
+	clock.advance(30 * time.Second)
+	fail("pay")
+	assert.Empty(test, alerts)
+
+	fail("pay")
+	assert.Len(test, alerts, 1)
+	assert.Equal(test, float64(3), alerts[0].Value)
+	assert.Equal(test, "pay", alerts[0].Example.Name)
+	assert.Equal(test, "pay error rate 3/min exceeds 2/min", alerts[0].Message)
+	assert.Contains(test, out.String(), "*** ALERT: pay error rate 3/min exceeds 2/min ***\n")
+
+	// Quiet within the cooldown, and raised again after it
+	fail("pay")
+	clock.advance(4*time.Minute + 30*time.Second)
+	fail("pay")
+	fail("pay")
+	fail("pay")
+	assert.Len(test, alerts, 1)
+	clock.advance(30 * time.Second)
+	fail("pay")
+	assert.Len(test, alerts, 2)
+	assert.Equal(test, 2, strings.Count(out.String(), "*** ALERT"))
+}
+
+func TestAlertSlowSpan(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, Clock: clock.Now, SilentAlerts: true})
+	var alerts []Alert
+	id, err := t.AddAlert(AlertRule{Kind: SlowSpan, Duration: time.Second}, func(a Alert) { alerts = append(alerts, a) })
+	assert.Nil(test, err)
+
+	call := func(took time.Duration) {
+		span := t.StartNamed("query", "%s", "$FN")
+		clock.advance(took)
+		span.End()
+	}
+	call(time.Second)
+	call(2 * time.Second)
+	assert.Len(test, alerts, 1)
+	assert.Equal(test, "query took 2.0s, exceeds 1.0s", alerts[0].Message)
+	assert.Equal(test, float64(2*time.Second), alerts[0].Value)
+	assert.Equal(test, DefaultAlertCooldown, alerts[0].Rule.Cooldown)
+	assert.NotContains(test, out.String(), "ALERT")
+
+	// Removed rules raise nothing
+	t.RemoveAlert(id)
+	clock.advance(time.Hour)
+	call(time.Minute)
+	assert.Len(test, alerts, 1)
+}
+
+func TestAlertOpenSpans(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, Clock: clock.Now})
+	var alerts []Alert
+	_, err := t.AddAlert(AlertRule{Kind: OpenSpans, Count: 2, Cooldown: time.Second}, func(a Alert) { alerts = append(alerts, a) })
+	assert.Nil(test, err)
+
+	a := t.StartNamed("a", "%s", "$FN")
+	b := t.StartNamed("b", "%s", "$FN")
+	b.End()
+	b = t.StartNamed("b", "%s", "$FN")
+	assert.Empty(test, alerts)
+	c := t.StartNamed("c", "%s", "$FN")
+	c.End()
+	b.End()
+	a.End()
+	assert.Len(test, alerts, 1)
+	assert.Equal(test, "open spans 3 exceeds 2", alerts[0].Message)
+	assert.Equal(test, "c", alerts[0].Example.Name)
+	assert.Equal(test, int64(0), t.alerts.open)
+}
+
+func TestAlertQuotaNearing(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, MaxLines: 10})
+	var alerts []Alert
+	_, err := t.AddAlert(AlertRule{Kind: QuotaNearing, Percent: 50}, func(a Alert) { alerts = append(alerts, a) })
+	assert.Nil(test, err)
+
+	t.StartNamed("a", "%s", "$FN").End()
+	t.StartNamed("b", "%s", "$FN").End()
+	assert.Empty(test, alerts)
+	t.StartNamed("c", "%s", "$FN").End()
+	assert.Len(test, alerts, 1)
+	assert.Equal(test, "output quota 50% used exceeds 50%", alerts[0].Message)
+	assert.Contains(test, out.String(), "*** ALERT: output quota 50% used exceeds 50% ***\n")
+}
+
+func TestAddAlertErrors(test *testing.T) {
+	t := NewTracer(&Options{})
+	_, err := t.AddAlert(AlertRule{Kind: ErrorRate, Count: 1}, nil)
+	assert.EqualError(test, err, "ErrorRate alerts need a Count and a Window")
+	_, err = t.AddAlert(AlertRule{Kind: QuotaNearing, Percent: 120}, nil)
+	assert.EqualError(test, err, "QuotaNearing alerts need a Percent between 0 and 100")
+	_, err = t.AddAlert(AlertRule{Kind: SlowSpan, Duration: time.Second, Pattern: "("}, nil)
+	assert.Contains(test, err.Error(), "bad pattern in alert")
+	assert.Nil(test, t.alerts.set.Load())
+}
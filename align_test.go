@@ -0,0 +1,53 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper functions - part of "TestAlignDurations"
+func alignShort(t *Tracer) {
+	defer t.Enter("%s", "$FN")()
+	alignWithAVeryLongNameIndeed(t)
+}
+func alignWithAVeryLongNameIndeed(t *Tracer) { defer t.Enter("%s", "$FN")() }
+
+func TestAlignDurations(test *testing.T) {
+	ResetTestBuffer()
+	var colored bytes.Buffer
+	var js lockedBuffer
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Logger: BufLogger}, {Writer: &colored, Colorize: true}, {Writer: &js, Format: JSONFormat}},
+		EnableInstrumentation: true,
+		AlignDurations:        50,
+		Clock:                 fakeClock(time.Millisecond),
+
+		// Leaves out the goroutine ids, whose width varies
+		MessageTemplates: map[string]string{`.`: "$MSG"},
+	})
+	alignShort(t)
+	t.Start("%s", "héllo wörld").End()
+
+	assert.Equal(test, `
+[ 0]ENTER: go-tracey.alignShort
+[ 1]  ENTER: go-tracey.alignWithAVeryLongNameIndeed
+[ 1]  EXIT:  go-tracey.alignWithAVeryLongNameIndeed ... in 1ms
+[ 0]EXIT:  go-tracey.alignShort ................. in 3ms
+[ 0]ENTER: héllo wörld
+[ 0]EXIT:  héllo wörld .......................... in 1ms
+`, GetTestBuffer())
+
+	// Escapes do not count, and JSON is left alone
+	uncolored := strings.NewReplacer(colorEnter, "", colorExit, "", colorReset, "").Replace(colored.String())
+	assert.Equal(test, GetTestBuffer(), "\n"+uncolored)
+	assert.NotContains(test, js.String(), "....")
+
+	ResetTestBuffer()
+	longName := "a name which is far too long for the column it should line up in"
+	t.Start("%s", longName).End()
+	assert.Equal(test, "\n[ 0]ENTER: "+longName+"\n[ 0]EXIT:  "+longName+" ... in 1ms\n", GetTestBuffer())
+}
@@ -0,0 +1,106 @@
+package tracey
+
+import (
+	"strings"
+)
+
+// DefaultErrorAncestryDepth is how many of the spans around a failed span
+// "PropagateContextOnError" lists, unless "ErrorAncestryDepth" says
+// otherwise.
+const DefaultErrorAncestryDepth = 3
+
+// How long the messages and tag values of ancestors may be, longer ones
+// are cut and end in "..."
+const ancestryValueLen = 40
+
+// A SpanSummary describes a span which was open around a failed span, see
+// "PropagateContextOnError".
+type SpanSummary struct {
+	Name    string
+	Message string
+
+	// The tags of the span at the time, with their values rendered
+	Tags []Tag
+}
+
+// Returns up to "n" of the spans open around the span on its goroutine,
+// innermost first. Only the pointers are copied under the lock.
+func (g *goroutines) ancestors(s *Span, n int) []*Span {
+	shard := g.shard(s.ev.TID)
+	shard.Lock()
+	defer shard.Unlock()
+	open := s.record.open
+	for i := len(open) - 1; i >= 0; i-- {
+		if open[i] != s {
+			continue
+		}
+		var ancestors []*Span
+		for j := i - 1; j >= 0 && len(ancestors) < n; j-- {
+			if !open[j].muted {
+				ancestors = append(ancestors, open[j])
+			}
+		}
+		return ancestors
+	}
+	return nil
+}
+
+// Summarizes the spans around a failed span, outermost first
+func (t *Tracer) ancestry(span *Span) []SpanSummary {
+	n := t.options.ErrorAncestryDepth
+	if n <= 0 {
+		n = DefaultErrorAncestryDepth
+	}
+	ancestors := t.goroutines.ancestors(span, n)
+	if len(ancestors) == 0 {
+		return nil
+	}
+	summaries := make([]SpanSummary, len(ancestors))
+	for i, s := range ancestors {
+		summary := &summaries[len(ancestors)-1-i]
+		summary.Name = s.ev.Name
+		summary.Message = capValue(s.ev.Message)
+		if len(s.ev.Tags) > 0 {
+			values := t.renderTags(s.ev.Tags)
+			summary.Tags = make([]Tag, len(s.ev.Tags))
+			for j, tag := range s.ev.Tags {
+				summary.Tags[j] = Tag{tag.Key, capValue(values[j])}
+			}
+		}
+	}
+	return summaries
+}
+
+func capValue(s string) string {
+	return TruncateMessage(s, ancestryValueLen)
+}
+
+// Renders the ancestry of a failed span, as in
+// "handleRequest{route=/orders} ← processOrder{id=9912}" where the spans
+// without tags are shown by their message
+func renderAncestry(ancestry []SpanSummary) string {
+	var b strings.Builder
+	for i, s := range ancestry {
+		if i > 0 {
+			b.WriteString(" ← ")
+		}
+		if len(s.Tags) == 0 && s.Message != "" {
+			b.WriteString(s.Message)
+			continue
+		}
+		b.WriteString(s.Name)
+		if len(s.Tags) > 0 {
+			b.WriteByte('{')
+			for j, tag := range s.Tags {
+				if j > 0 {
+					b.WriteByte(' ')
+				}
+				b.WriteString(tag.Key)
+				b.WriteByte('=')
+				b.WriteString(tag.Value.(string))
+			}
+			b.WriteByte('}')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func handleRequest(t *Tracer, route string, fail bool) {
+	span := t.Start()
+	defer span.End()
+	span.Tag("route", route)
+	processOrder(t, 9912, fail)
+}
+
+func processOrder(t *Tracer, id int, fail bool) {
+	span := t.Start("$FN(%d)", id)
+	defer span.End()
+	span.Tag("id", id)
+	chargeCard(t, fail)
+}
+
+func chargeCard(t *Tracer, fail bool) {
+	span := t.Start()
+	defer span.End()
+	if fail {
+		span.SetError(errors.New("declined"))
+	}
+}
+
+func TestErrorAncestry(test *testing.T) {
+	var text, js bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                   []Sink{{Logger: log.New(&text, "", 0)}, {Writer: &js, Format: JSONFormat}},
+		PropagateContextOnError: true,
+	})
+	func() {
+		defer t.Enter("%s", "serve")()
+		handleRequest(t, "/orders", true)
+		handleRequest(t, "/orders", false)
+	}()
+
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(text.String(), "$1=>")), "\n")
+	assert.Equal(test, "[ 3]      EXIT:  => (error: declined) within: serve ← go-tracey.handleRequest{route=/orders} ← go-tracey.processOrder{id=9912}", lines[4])
+	for _, line := range append(lines[:4:4], lines[5:]...) {
+		assert.NotContains(test, line, "within:")
+	}
+
+	var failed []Event
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		if ev.Kind == ExitEvent && ev.Err != nil {
+			failed = append(failed, ev)
+		} else {
+			assert.Empty(test, ev.Ancestry)
+		}
+	}
+	assert.Len(test, failed, 1)
+	assert.Equal(test, []SpanSummary{
+		{Name: "go-tracey.TestErrorAncestry.func1", Message: "serve"},
+		{Name: "go-tracey.handleRequest", Tags: []Tag{{"route", "/orders"}}},
+		{Name: "go-tracey.processOrder", Message: "go-tracey.processOrder(9912)", Tags: []Tag{{"id", "9912"}}},
+	}, failed[0].Ancestry)
+}
+
+func TestErrorAncestryDepth(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, PropagateContextOnError: true, ErrorAncestryDepth: 1})
+	handleRequest(t, "/orders/"+strings.Repeat("x", 50), true)
+	assert.Contains(test, GetTestBuffer(), "(error: declined) within: go-tracey.processOrder{id=9912}\n")
+
+	// Values are capped
+	ResetTestBuffer()
+	t = NewTracer(&Options{CustomLogger: BufLogger, PropagateContextOnError: true})
+	handleRequest(t, "/orders/"+strings.Repeat("x", 50), true)
+	assert.Contains(test, GetTestBuffer(), "{route=/orders/"+strings.Repeat("x", 13)+"…(+37B truncated)}")
+
+	// Without the option, there is no ancestry
+	ResetTestBuffer()
+	t = NewTracer(&Options{CustomLogger: BufLogger})
+	handleRequest(t, "/orders", true)
+	assert.NotContains(test, GetTestBuffer(), "within:")
+}
@@ -0,0 +1,114 @@
+package tracey
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+)
+
+// Writes what the lines the goroutine logs should start with to line up
+// within the trace, as the milestones of its innermost open span do, or
+// nothing if it has no span open
+func (t *Tracer) linePrefix(buf *bytes.Buffer, gid uint64) {
+	span := t.goroutines.innermost(gid)
+	if span == nil {
+		return
+	}
+	if t.options.SessionID != "" {
+		buf.WriteString("[s:")
+		buf.WriteString(shortSessionID(t.options.SessionID))
+		buf.WriteByte(']')
+	}
+	t.renderIndented(buf, span.ev.Depth+1, span.ev.Depth+1-span.ev.collapsed)
+}
+
+// WrapWriter returns a writer which writes to "w" with every line
+// prefixed the way the lines tracey logs within the span open on the
+// writing goroutine are, so that the application's own logs, such as
+// those of a `log.Logger` writing to it, show up nested within the trace
+// when they go to the same place. Lines written while no span is open
+// are left as they are. Since "w" may be shared by many goroutines, a
+// line written in several pieces cannot be put back together: only the
+// pieces which end a line are prefixed, and a piece which does not end
+// one is written as it is, so the lines should be written whole, as
+// loggers do.
+func (t *Tracer) WrapWriter(w io.Writer) io.Writer {
+	if t.start == nil {
+		return w
+	}
+	return &prefixWriter{t, w}
+}
+
+type prefixWriter struct {
+	t *Tracer
+	w io.Writer
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	prefix := getBuffer()
+	defer putBuffer(prefix)
+	w.t.linePrefix(prefix, getGID())
+	if prefix.Len() == 0 {
+		return w.w.Write(p)
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	rest := p
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			// A partial line, see `WrapWriter(...)`
+			buf.Write(rest)
+			break
+		}
+		buf.Write(prefix.Bytes())
+		buf.Write(rest[:i+1])
+		rest = rest[i+1:]
+	}
+	if _, err := w.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WrapSlogHandler returns a handler which passes the records to "h" with
+// their message prefixed the way `WrapWriter(...)` prefixes lines, for
+// the application's structured logs. With handlers which render the
+// message as a field, such as those of `slog.NewTextHandler(...)`, the
+// prefix ends up within the field: to nest the lines themselves, have
+// the handler write to `WrapWriter(...)` instead.
+func (t *Tracer) WrapSlogHandler(h slog.Handler) slog.Handler {
+	if t.start == nil {
+		return h
+	}
+	return &prefixHandler{t, h}
+}
+
+type prefixHandler struct {
+	t *Tracer
+	h slog.Handler
+}
+
+func (h *prefixHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.h.Enabled(ctx, level)
+}
+
+func (h *prefixHandler) Handle(ctx context.Context, r slog.Record) error {
+	prefix := getBuffer()
+	defer putBuffer(prefix)
+	h.t.linePrefix(prefix, getGID())
+	if prefix.Len() > 0 {
+		r.Message = prefix.String() + r.Message
+	}
+	return h.h.Handle(ctx, r)
+}
+
+func (h *prefixHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &prefixHandler{h.t, h.h.WithAttrs(attrs)}
+}
+
+func (h *prefixHandler) WithGroup(name string) slog.Handler {
+	return &prefixHandler{h.t, h.h.WithGroup(name)}
+}
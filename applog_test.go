@@ -0,0 +1,74 @@
+package tracey
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapWriter(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}})
+	app := log.New(t.WrapWriter(&out), "app: ", 0)
+
+	app.Printf("starting")
+	func() {
+		defer t.Enter("%s", "handle")()
+		app.Printf("handling")
+		func() {
+			defer t.Enter("%s", "query")()
+			app.Printf("two\nlines")
+		}()
+		app.Printf("handled")
+	}()
+
+	assert.Equal(test, "app: starting\n"+
+		"[ 0]ENTER: =>handle\n"+
+		"[ 1]  app: handling\n"+
+		"[ 1]  ENTER: =>query\n"+
+		"[ 2]    app: two\n"+
+		"[ 2]    lines\n"+
+		"[ 1]  EXIT:  =>query\n"+
+		"[ 1]  app: handled\n"+
+		"[ 0]EXIT:  =>handle\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+}
+
+func TestWrapWriterPartialLines(test *testing.T) {
+	var out bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, DisableDepthValue: true})
+	defer t.Enter("%s", "outer")()
+	out.Reset()
+
+	w := t.WrapWriter(&out)
+	n, err := w.Write([]byte("one\ntwo\nthr"))
+	assert.Nil(test, err)
+	assert.Equal(test, 11, n)
+	w.Write([]byte("ee\n"))
+	assert.Equal(test, "  one\n  two\nthr  ee\n", out.String())
+}
+
+func TestWrapSlogHandler(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}})
+	handler := slog.NewTextHandler(&out, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	logger := slog.New(t.WrapSlogHandler(handler)).With("component", "db")
+
+	func() {
+		defer t.Enter("%s", "handle")()
+		logger.Info("handling", "id", 7)
+	}()
+	assert.Equal(test, "[ 0]ENTER: =>handle\n"+
+		`level=INFO msg="[ 1]  handling" component=db id=7`+"\n"+
+		"[ 0]EXIT:  =>handle\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	assert.Equal(test, &out, NewTracer(&Options{DisableTracing: true}).WrapWriter(&out))
+}
@@ -0,0 +1,236 @@
+package tracey
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultAsyncBufferBytes is how many bytes of lines an "Async" sink
+// queues at most, unless its "AsyncBufferBytes" says otherwise.
+const DefaultAsyncBufferBytes = 1 << 20
+
+// The lines queued for an "Async" sink, one queue per goroutine. Its
+// drainer takes turns between the queues, so that a goroutine flooding
+// the sink only delays the others by its share.
+type asyncQueue struct {
+	sync.Mutex
+	sink     *sinkState
+	limit    int
+	priority func(Event) int
+
+	// The queues with lines in them, in the order they take their turns,
+	// and the queue whose turn is next
+	queues map[uint64]*lineQueue
+	active []*lineQueue
+	next   int
+
+	// The bytes queued in all, and whether the drainer is running
+	bytes   int
+	running bool
+
+	// The lines dropped per goroutine since the last `Flush()`, and in
+	// all for "MaxTraceLatency"
+	dropped   map[uint64]uint64
+	overflows *uint64
+}
+
+// The lines of a single goroutine, in order
+type lineQueue struct {
+	tid    uint64
+	lines  [][]byte
+	bytes  int
+	weight int
+}
+
+func newAsyncQueue(s *sinkState) *asyncQueue {
+	q := &asyncQueue{
+		sink:     s,
+		limit:    s.AsyncBufferBytes,
+		priority: s.PriorityFunc,
+		queues:   make(map[uint64]*lineQueue),
+		dropped:  make(map[uint64]uint64),
+	}
+	q.overflows = new(uint64)
+	if q.limit <= 0 {
+		q.limit = DefaultAsyncBufferBytes
+	}
+	return q
+}
+
+// Queues a line rendered on the goroutine, for the event (nil for notes).
+// Should the buffer be full, the line is dropped if the goroutine already
+// has its share of the buffer queued, otherwise the latest line of the
+// goroutine with the most queued is dropped to make room.
+func (q *asyncQueue) enqueue(tid uint64, ev *Event, p []byte) {
+	weight := 1
+	if q.priority != nil && ev != nil {
+		if w := q.priority(*ev); w > 1 {
+			weight = w
+		}
+	}
+	line := append([]byte(nil), p...)
+
+	q.Lock()
+	defer q.Unlock()
+	lq := q.queues[tid]
+	if lq == nil {
+		lq = &lineQueue{tid: tid, weight: 1}
+		q.queues[tid] = lq
+		q.active = append(q.active, lq)
+	}
+	if ev != nil {
+		lq.weight = weight
+	}
+	for q.bytes+len(line) > q.limit {
+		victim := q.largest()
+		if lq.bytes+len(line) > q.limit/len(q.active) || victim == lq {
+			q.dropped[tid]++
+			atomic.AddUint64(q.overflows, 1)
+			if len(lq.lines) == 0 {
+				q.retire(lq)
+			}
+			return
+		}
+		last := len(victim.lines) - 1
+		victim.bytes -= len(victim.lines[last])
+		q.bytes -= len(victim.lines[last])
+		victim.lines[last] = nil
+		victim.lines = victim.lines[:last]
+		q.dropped[victim.tid]++
+		atomic.AddUint64(q.overflows, 1)
+		if len(victim.lines) == 0 {
+			q.retire(victim)
+		}
+	}
+	lq.lines = append(lq.lines, line)
+	lq.bytes += len(line)
+	q.bytes += len(line)
+	if !q.running {
+		q.running = true
+		go q.drain()
+	}
+}
+
+// Returns the queue with the most bytes queued. Must be called with the
+// lock held.
+func (q *asyncQueue) largest() *lineQueue {
+	var largest *lineQueue
+	for _, lq := range q.active {
+		if largest == nil || lq.bytes > largest.bytes {
+			largest = lq
+		}
+	}
+	return largest
+}
+
+// Forgets an empty queue. Must be called with the lock held.
+func (q *asyncQueue) retire(lq *lineQueue) {
+	for i, active := range q.active {
+		if active == lq {
+			q.active = append(q.active[:i], q.active[i+1:]...)
+			if i < q.next {
+				q.next--
+			}
+			break
+		}
+	}
+	delete(q.queues, lq.tid)
+}
+
+// Writes out the queues in turn, each writing as many lines as its weight
+// per turn, until they are all empty
+func (q *asyncQueue) drain() {
+	for {
+		q.Lock()
+		if len(q.active) == 0 {
+			q.running = false
+			q.Unlock()
+			return
+		}
+		if q.next >= len(q.active) {
+			q.next = 0
+		}
+		lq := q.active[q.next]
+		n := lq.weight
+		if n > len(lq.lines) {
+			n = len(lq.lines)
+		}
+		batch := lq.lines[:n:n]
+		lq.lines = lq.lines[n:]
+		for _, line := range batch {
+			lq.bytes -= len(line)
+			q.bytes -= len(line)
+		}
+		if len(lq.lines) == 0 {
+			q.retire(lq)
+		} else {
+			q.next++
+		}
+		q.Unlock()
+
+		for _, line := range batch {
+			q.sink.write(0, line)
+		}
+	}
+}
+
+// Waits for the queues to drain, for at most "timeout" if it is positive,
+// then logs the lines dropped since the last flush. Returns false if it
+// timed out.
+func (q *asyncQueue) flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		q.Lock()
+		if !q.running {
+			break
+		}
+		q.Unlock()
+		if timeout > 0 && time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	dropped := q.dropped
+	q.dropped = make(map[uint64]uint64)
+	q.Unlock()
+
+	if len(dropped) > 0 {
+		q.sink.writeNote(describeDrops(dropped))
+	}
+	return true
+}
+
+// Describes the lines dropped per goroutine, as in
+// "TRACE ASYNC DROPPED — goroutine 7: 1200 lines, goroutine 9: 3 lines"
+func describeDrops(dropped map[uint64]uint64) string {
+	tids := make([]uint64, 0, len(dropped))
+	for tid := range dropped {
+		tids = append(tids, tid)
+	}
+	sort.Slice(tids, func(i, j int) bool { return tids[i] < tids[j] })
+	parts := make([]string, len(tids))
+	for i, tid := range tids {
+		lines := " lines"
+		if dropped[tid] == 1 {
+			lines = " line"
+		}
+		parts[i] = "goroutine " + strconv.FormatUint(tid, 10) + ": " + formatCount(dropped[tid]) + lines
+	}
+	return "TRACE ASYNC DROPPED — " + strings.Join(parts, ", ") + "\n"
+}
+
+// Waits for the "Async" sinks to drain. Returns false if any of them did
+// not within the timeout.
+func (t *Tracer) flushAsync(timeout time.Duration) bool {
+	flushed := true
+	for _, s := range t.sinks {
+		if s.async != nil && !s.async.flush(timeout) {
+			flushed = false
+		}
+	}
+	return flushed
+}
@@ -0,0 +1,217 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A writer which takes a while per write
+type slowWriter struct {
+	lockedBuffer
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.lockedBuffer.Write(p)
+}
+
+func TestAsyncFairness(test *testing.T) {
+	w := &slowWriter{delay: 20 * time.Microsecond}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: w, Async: true, AsyncBufferBytes: 8 << 10}}})
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	floodGID := make(chan uint64, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		floodGID <- getGID()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				t.Event("flood %d", i)
+			}
+		}
+	}()
+	var slow sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		slow.Add(1)
+		go func(g int) {
+			defer slow.Done()
+			for n := 0; n < 30; n++ {
+				t.Event("slow %d %d", g, n)
+				time.Sleep(time.Millisecond)
+			}
+		}(g)
+	}
+	slow.Wait()
+	close(stop)
+	wg.Wait()
+	t.Flush()
+
+	// Every line of the slow goroutines made it, and the lines of each
+	// goroutine are in order
+	out := w.String()
+	next := map[string]int{}
+	for _, m := range regexp.MustCompile(`· (flood|slow \d) (\d+)\n`).FindAllStringSubmatch(out, -1) {
+		n, _ := strconv.Atoi(m[2])
+		assert.True(test, n >= next[m[1]], "%s %d after %d", m[1], n, next[m[1]])
+		next[m[1]] = n + 1
+	}
+	for g := 0; g < 4; g++ {
+		assert.Equal(test, 30, strings.Count(out, fmt.Sprintf("· slow %d ", g)), "goroutine %d", g)
+	}
+	assert.Contains(test, out, "TRACE ASYNC DROPPED — goroutine "+strconv.FormatUint(<-floodGID, 10)+": ")
+}
+
+// Queues lines without starting the drainer, so that the test can drain
+// them when it wants to
+func pausedQueue(s *sinkState) *asyncQueue {
+	q := newAsyncQueue(s)
+	q.running = true
+	return q
+}
+
+func TestAsyncTurns(test *testing.T) {
+	var buf bytes.Buffer
+	s := &sinkState{Sink: Sink{Writer: &buf, PriorityFunc: func(ev Event) int {
+		if ev.Level == Info {
+			return 3
+		}
+		return 0
+	}}}
+	q := pausedQueue(s)
+	for i := 0; i < 5; i++ {
+		q.enqueue(1, &Event{Level: Info}, []byte(fmt.Sprintf("a%d\n", i)))
+		q.enqueue(2, &Event{}, []byte(fmt.Sprintf("b%d\n", i)))
+	}
+	q.enqueue(3, nil, []byte("note\n"))
+	q.drain()
+	assert.Equal(test, "a0\na1\na2\nb0\nnote\na3\na4\nb1\nb2\nb3\nb4\n", buf.String())
+	assert.False(test, q.running)
+	assert.Empty(test, q.queues)
+	assert.Equal(test, 0, q.bytes)
+}
+
+func TestAsyncDrops(test *testing.T) {
+	var buf bytes.Buffer
+	s := &sinkState{Sink: Sink{Writer: &buf, AsyncBufferBytes: 12}}
+	q := pausedQueue(s)
+
+	// A single goroutine may use the whole buffer
+	for i := 0; i < 5; i++ {
+		q.enqueue(1, &Event{}, []byte(fmt.Sprintf("a%d\n", i)))
+	}
+	// Another one gets its share at the expense of the first
+	q.enqueue(2, &Event{}, []byte("b0\n"))
+	q.enqueue(2, &Event{}, []byte("b1\n"))
+	// But not more
+	q.enqueue(2, &Event{}, []byte("b2\n"))
+	// Lines larger than the buffer never make it
+	q.enqueue(3, &Event{}, []byte("far too long a line\n"))
+	assert.Equal(test, map[uint64]uint64{1: 3, 2: 1, 3: 1}, q.dropped)
+	assert.NotContains(test, q.queues, uint64(3))
+
+	q.drain()
+	assert.Equal(test, "a0\nb0\na1\nb1\n", buf.String())
+
+	buf.Reset()
+	assert.True(test, q.flush(0))
+	assert.Equal(test, "TRACE ASYNC DROPPED — goroutine 1: 3 lines, goroutine 2: 1 line, goroutine 3: 1 line\n", buf.String())
+	buf.Reset()
+	assert.True(test, q.flush(0))
+	assert.Empty(test, buf.String())
+}
+
+func TestAsyncNotesAndJSON(test *testing.T) {
+	var js lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &js, Format: JSONFormat, Async: true}}, MaxLines: 2})
+	for i := 0; i < 3; i++ {
+		t.Enter("%s", "step")()
+	}
+	t.Flush()
+	lines := strings.Split(strings.TrimSpace(js.String()), "\n")
+	assert.Len(test, lines, 3)
+	assert.Contains(test, lines[2], `"kind":"note","msg":"TRACE QUOTA REACHED`)
+}
+
+// A sink which hands lines over to a single buffered channel, dropping
+// them when it is full, to compare the per-goroutine queues against
+type channelWriter struct {
+	lines   chan []byte
+	dropped uint64
+	mu      sync.Mutex
+}
+
+func newChannelWriter(w io.Writer) *channelWriter {
+	c := &channelWriter{lines: make(chan []byte, 1024)}
+	go func() {
+		for line := range c.lines {
+			w.Write(line)
+		}
+	}()
+	return c
+}
+
+func (c *channelWriter) Write(p []byte) (int, error) {
+	select {
+	case c.lines <- append([]byte(nil), p...):
+	default:
+		c.mu.Lock()
+		c.dropped++
+		c.mu.Unlock()
+	}
+	return len(p), nil
+}
+
+func BenchmarkAsyncSink(b *testing.B) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard, Async: true}}})
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			t.Enter("%s", "work")()
+		}
+	})
+	t.Flush()
+}
+
+func BenchmarkChannelSink(b *testing.B) {
+	w := newChannelWriter(io.Discard)
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: w}}})
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			t.Enter("%s", "work")()
+		}
+	})
+}
+
+func TestCloseDrainsAsyncSinks(test *testing.T) {
+	w := &slowWriter{delay: 50 * time.Microsecond}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: w, Async: true}}, ProgressInterval: time.Hour})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				t.Enter()()
+			}
+		}()
+	}
+	wg.Wait()
+	t.Close()
+	assert.Equal(test, 800, strings.Count(w.String(), "\n"))
+}
@@ -0,0 +1,170 @@
+package tracey
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxAttachedLines is how many lines are kept attached to a span,
+// when "MaxAttachedLines" is 0.
+const DefaultMaxAttachedLines = 100
+
+// DefaultMaxAttachedBytes is how many bytes of lines are kept attached to
+// a span, when "MaxAttachedBytes" is 0.
+const DefaultMaxAttachedBytes = 16 << 10
+
+// DefaultAttachPendingTimeout is how long the lines attached while no span
+// is open wait for one, when "AttachPendingTimeout" is 0.
+const DefaultAttachPendingTimeout = 10 * time.Second
+
+// The lines attached to a span, or waiting for the next span of their
+// goroutine, along with how many of them were dropped
+type attachments struct {
+	lines   []string
+	bytes   int
+	dropped int
+
+	// When the first line waiting for a span was attached
+	since time.Time
+}
+
+// Keeps the line, dropping the oldest lines for it to fit the bounds
+func (a *attachments) add(line string, maxLines, maxBytes int) {
+	if len(line) > maxBytes {
+		line = TruncateMessage(line, maxBytes)
+	}
+	a.lines = append(a.lines, line)
+	a.bytes += len(line)
+	for len(a.lines) > maxLines || a.bytes > maxBytes {
+		a.bytes -= len(a.lines[0])
+		a.lines[0] = ""
+		a.lines = a.lines[1:]
+		a.dropped++
+	}
+}
+
+// Returns the lines, preceded by a note of how many were dropped if any
+// were, as in "… 3 earlier lines dropped"
+func (a *attachments) list() []string {
+	if a.dropped == 0 {
+		return append([]string(nil), a.lines...)
+	}
+	note := "… " + strconv.Itoa(a.dropped) + " earlier lines dropped"
+	if a.dropped == 1 {
+		note = "… 1 earlier line dropped"
+	}
+	return append([]string{note}, a.lines...)
+}
+
+func (t *Tracer) attachBounds() (int, int) {
+	maxLines, maxBytes := t.options.MaxAttachedLines, t.options.MaxAttachedBytes
+	if maxLines <= 0 {
+		maxLines = DefaultMaxAttachedLines
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxAttachedBytes
+	}
+	return maxLines, maxBytes
+}
+
+func (t *Tracer) attachPendingTimeout() time.Duration {
+	if t.options.AttachPendingTimeout > 0 {
+		return t.options.AttachPendingTimeout
+	}
+	return DefaultAttachPendingTimeout
+}
+
+// AttachLog attaches a line, such as one the application logged with its
+// own logger, to the innermost span open on the calling goroutine. The
+// line is not written out when attached, but listed in "Attached" on the
+// exit event of the span, and rendered under its EXIT line if it failed,
+// see "MaxAttachedLines". A message of several lines attaches each of
+// them. Lines attached while no span is open wait for the next span the
+// goroutine enters, for up to "AttachPendingTimeout". Like the other
+// methods of spans, this is meant to be called from the goroutine the
+// span is open on, and the span ended from there or once that goroutine
+// is done attaching to it.
+func (t *Tracer) AttachLog(msg string) {
+	if t.start == nil {
+		return
+	}
+	if a := t.adopter.Load(); a != nil {
+		a.parent.AttachLog(msg)
+		return
+	}
+	msg = strings.TrimRight(msg, "\r\n")
+	if msg == "" {
+		return
+	}
+	target, waiting := t.goroutines.attachments(getGID(), t.options.Clock())
+	if target == nil {
+		return
+	}
+	if waiting {
+		t.scanner.start(t)
+	}
+	maxLines, maxBytes := t.attachBounds()
+	for _, line := range strings.Split(msg, "\n") {
+		target.add(strings.TrimSuffix(line, "\r"), maxLines, maxBytes)
+	}
+}
+
+// Returns the lines attached to the innermost span open on the goroutine,
+// or nil if it is muted, or else those waiting for its next span, started
+// afresh if they waited for too long, along with true
+func (g *goroutines) attachments(gid uint64, now time.Time) (*attachments, bool) {
+	shard := g.shard(gid)
+	shard.Lock()
+	defer shard.Unlock()
+	record := shard.g[gid]
+	if record != nil && len(record.open) > 0 {
+		span := record.open[len(record.open)-1]
+		if span.muted {
+			return nil, false
+		}
+		if span.attached == nil {
+			span.attached = &attachments{}
+		}
+		return span.attached, false
+	}
+	if record == nil {
+		record = &goroutineRecord{}
+		shard.g[gid] = record
+	}
+	if record.pending == nil || now.Sub(record.pending.since) >= g.pendingTTL {
+		record.pending = &attachments{since: now}
+	}
+	atomic.StoreUint32(&g.pendingUsed, 1)
+	return record.pending, true
+}
+
+// AttachmentWriter returns a writer which attaches what is written to it
+// with `AttachLog(...)`, line by line, such as for a `log.Logger` to
+// write to. Each write is taken as whole lines, as loggers write them.
+func (t *Tracer) AttachmentWriter() io.Writer {
+	return attachmentWriter{t}
+}
+
+type attachmentWriter struct {
+	t *Tracer
+}
+
+func (w attachmentWriter) Write(p []byte) (int, error) {
+	w.t.AttachLog(string(p))
+	return len(p), nil
+}
+
+// Writes the attached lines under the EXIT line, lined up under its
+// marker, as in "  | dialing db-2"
+func renderAttached(buf *bytes.Buffer, lines []string, indent int) {
+	for _, line := range lines {
+		writeRun(buf, spaceRun, indent)
+		buf.WriteString("  | ")
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+}
@@ -0,0 +1,174 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the exit events of the JSON lines, by message
+func exitsByMessage(test *testing.T, out string) map[string]Event {
+	exits := make(map[string]Event)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		if ev.Kind == ExitEvent {
+			exits[ev.Message] = ev
+		}
+	}
+	return exits
+}
+
+func TestAttachLog(test *testing.T) {
+	var out, js bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Writer: &out}, {Writer: &js, Format: JSONFormat}},
+		MessageTemplates: map[string]string{`.`: "$MSG"},
+		MaxAttachedLines: 3,
+	})
+	logger := log.New(t.AttachmentWriter(), "", 0)
+	func() {
+		defer t.Enter("%s", "ok")()
+		logger.Print("fine")
+	}()
+	func() {
+		span := t.Start("%s", "failed")
+		defer span.End()
+		func() {
+			defer t.Enter("%s", "inner")()
+			t.AttachLog("inner line")
+		}()
+		for i := 1; i <= 5; i++ {
+			logger.Printf("attempt %d", i)
+		}
+		span.SetError(errors.New("gave up"))
+	}()
+
+	// Only the failed span shows its lines, the newest of them
+	assert.Equal(test, "[ 0]ENTER: ok\n"+
+		"[ 0]EXIT:  ok\n"+
+		"[ 0]ENTER: failed\n"+
+		"[ 1]  ENTER: inner\n"+
+		"[ 1]  EXIT:  inner\n"+
+		"[ 0]EXIT:  failed (error: gave up)\n"+
+		"      | … 2 earlier lines dropped\n"+
+		"      | attempt 3\n"+
+		"      | attempt 4\n"+
+		"      | attempt 5\n", out.String())
+
+	exits := exitsByMessage(test, js.String())
+	assert.Equal(test, []string{"fine"}, exits["ok"].Attached)
+	assert.Equal(test, []string{"inner line"}, exits["inner"].Attached)
+	assert.Equal(test, []string{"… 2 earlier lines dropped", "attempt 3", "attempt 4", "attempt 5"}, exits["failed"].Attached)
+}
+
+func TestAttachBounds(test *testing.T) {
+	a := &attachments{}
+	for _, line := range []string{"aaaa", "bbbb", "cccc"} {
+		a.add(line, 10, 10)
+	}
+	assert.Equal(test, []string{"… 1 earlier line dropped", "bbbb", "cccc"}, a.list())
+	assert.Equal(test, 8, a.bytes)
+
+	// A line too long on its own is cut
+	a.add(strings.Repeat("x", 40), 10, 20)
+	assert.Equal(test, []string{"… 3 earlier lines dropped", "x…(+39B truncated)"}, a.list())
+}
+
+func TestAlwaysRenderAttachments(test *testing.T) {
+	var out, csv bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                   []Sink{{Writer: &out}},
+		CSVWriter:               &csv,
+		MessageTemplates:        map[string]string{`.`: "$MSG"},
+		AlwaysRenderAttachments: true,
+	})
+	func() {
+		defer t.Enter("%s", "outer")()
+		func() {
+			defer t.Enter("%s", "inner")()
+			t.AttachLog("first\nsecond\n")
+		}()
+	}()
+	assert.Equal(test, "[ 0]ENTER: outer\n"+
+		"[ 1]  ENTER: inner\n"+
+		"[ 1]  EXIT:  inner\n"+
+		"        | first\n"+
+		"        | second\n"+
+		"[ 0]EXIT:  outer\n", out.String())
+	assert.Contains(test, csv.String(), ",\"first\nsecond\",3\n")
+}
+
+func TestAttachPending(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var js bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                []Sink{{Writer: &js, Format: JSONFormat}},
+		Clock:                clock.Now,
+		AttachPendingTimeout: time.Minute,
+	})
+
+	// Waiting lines go to the next span, whatever they waited
+	t.AttachLog("before the span")
+	clock.advance(30 * time.Second)
+	t.AttachLog("still before")
+	t.Start("%s", "next").End()
+	t.Start("%s", "after").End()
+
+	// and are dropped once they waited for too long
+	t.AttachLog("too early")
+	clock.advance(2 * time.Minute)
+	t.Start("%s", "late").End()
+
+	exits := exitsByMessage(test, js.String())
+	assert.Equal(test, []string{"before the span", "still before"}, exits["next"].Attached)
+	assert.Nil(test, exits["after"].Attached)
+	assert.Nil(test, exits["late"].Attached)
+
+	// Those of goroutines which enter no span again are dropped as well
+	done := make(chan struct{})
+	go func() {
+		t.AttachLog("left behind")
+		close(done)
+	}()
+	<-done
+	clock.advance(2 * time.Minute)
+	t.AttachLog("now")
+	t.CompactNow()
+	assert.Equal(test, 1, t.GoroutineStateCount())
+}
+
+func TestAttachConcurrent(test *testing.T) {
+	js := &lockedBuffer{}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: js, Format: JSONFormat}}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			span := t.Start("worker %d", i)
+			defer span.End()
+			for j := 0; j < 20; j++ {
+				t.AttachLog(fmt.Sprintf("worker %d line %d", i, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	exits := exitsByMessage(test, js.String())
+	assert.Len(test, exits, 8)
+	for i := 0; i < 8; i++ {
+		attached := exits[fmt.Sprintf("worker %d", i)].Attached
+		assert.Len(test, attached, 20)
+		for _, line := range attached {
+			assert.True(test, strings.HasPrefix(line, fmt.Sprintf("worker %d ", i)), line)
+		}
+	}
+}
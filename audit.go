@@ -0,0 +1,310 @@
+package tracey
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many of the violations found on exit are kept for `Audit()`
+const maxAuditViolations = 100
+
+// How much longer than a span its children may take in all, per child,
+// unless "ClockResolutionFloor" says otherwise
+const auditTolerance = time.Microsecond
+
+// An AuditKind tells what invariant an `AuditViolation` breaks.
+type AuditKind int
+
+const (
+	// A span which was entered and never exited, nor suspended
+	UnclosedSpan AuditKind = iota
+
+	// A goroutine whose depth is not that of the spans open on it, or
+	// went negative on the exit of a span
+	DepthMismatch
+
+	// A function more goroutines are counted inside of than have spans
+	// open within it, see "ShowConcurrency"
+	InFlightLeak
+
+	// Lines still queued for an "Async" sink
+	AsyncBacklog
+
+	// A span whose children on its own goroutine took longer in all than
+	// it did
+	ChildrenExceedParent
+)
+
+func (k AuditKind) String() string {
+	switch k {
+	case DepthMismatch:
+		return "depth mismatch"
+	case InFlightLeak:
+		return "in-flight leak"
+	case AsyncBacklog:
+		return "async backlog"
+	case ChildrenExceedParent:
+		return "children exceed parent"
+	}
+	return "unclosed span"
+}
+
+// An AuditViolation is an invariant `Audit()` found broken.
+type AuditViolation struct {
+	Kind AuditKind
+
+	// The function, span and goroutine the violation is about, as far as
+	// they apply to its kind
+	Name   string
+	SpanID string
+	TID    uint64
+
+	// The message the span was entered with, and when it was entered and
+	// exited (zero if it did not)
+	Message         string
+	Entered, Exited time.Time
+
+	// What is wrong, as in "children took 12ms in all, the span 10ms"
+	Detail string
+}
+
+// Renders the violation as in "unclosed span main.load [span=3 tid=7]
+// entered 14:03:05.120000 "loading": still open".
+func (v AuditViolation) String() string {
+	var b strings.Builder
+	b.WriteString(v.Kind.String())
+	if v.Name != "" {
+		b.WriteByte(' ')
+		b.WriteString(v.Name)
+	}
+	var ids []string
+	if v.SpanID != "" {
+		ids = append(ids, "span="+v.SpanID)
+	}
+	if v.TID != 0 {
+		ids = append(ids, "tid="+strconv.FormatUint(v.TID, 10))
+	}
+	if len(ids) > 0 {
+		b.WriteString(" [" + strings.Join(ids, " ") + "]")
+	}
+	if !v.Entered.IsZero() {
+		b.WriteString(" entered " + v.Entered.Format("15:04:05.000000"))
+	}
+	if !v.Exited.IsZero() {
+		b.WriteString(" exited " + v.Exited.Format("15:04:05.000000"))
+	}
+	if v.Message != "" && v.Message != v.Name {
+		b.WriteString(" " + strconv.Quote(v.Message))
+	}
+	b.WriteString(": ")
+	b.WriteString(v.Detail)
+	return b.String()
+}
+
+// An AuditReport is what `Audit()` found.
+type AuditReport struct {
+	// The violations, by kind and then in the order their spans were
+	// entered, and how many more were found on exit than are listed
+	Violations []AuditViolation
+	Elided     int
+
+	// The spans which are suspended or handed off, and so open on
+	// purpose, see `Span.Suspend()` and `Span.Transfer()`
+	Suspended []OpenSpan
+}
+
+// OK returns true if no invariant was found broken.
+func (r AuditReport) OK() bool {
+	return len(r.Violations) == 0 && r.Elided == 0
+}
+
+// Err returns nil if the report is OK, or else an error listing the
+// violations, one per line.
+func (r AuditReport) Err() error {
+	if r.OK() {
+		return nil
+	}
+	return errors.New(r.String())
+}
+
+// Lists the violations, and the spans left suspended, as in "tracey: audit
+// found 2 violations" followed by a line for each.
+func (r AuditReport) String() string {
+	var b strings.Builder
+	b.WriteString("tracey: audit found ")
+	b.WriteString(strconv.Itoa(len(r.Violations) + r.Elided))
+	b.WriteString(" violations")
+	for _, v := range r.Violations {
+		b.WriteString("\n  ")
+		b.WriteString(v.String())
+	}
+	if r.Elided > 0 {
+		b.WriteString("\n  … and " + strconv.Itoa(r.Elided) + " more")
+	}
+	for _, s := range r.Suspended {
+		b.WriteString("\n  suspended " + s.Name + " [span=" + s.SpanID + "] (not a violation)")
+	}
+	return b.String()
+}
+
+// The violations found on exit, for `Audit()`
+type audit struct {
+	sync.Mutex
+	violations []AuditViolation
+	elided     int
+}
+
+func (a *audit) add(v AuditViolation) {
+	a.Lock()
+	defer a.Unlock()
+	if len(a.violations) >= maxAuditViolations {
+		a.elided++
+		return
+	}
+	a.violations = append(a.violations, v)
+}
+
+// Describes the span for a violation
+func spanViolation(kind AuditKind, s *Span, detail string) AuditViolation {
+	return AuditViolation{
+		Kind:    kind,
+		Name:    s.ev.Name,
+		SpanID:  s.ev.SpanID,
+		TID:     s.ev.TID,
+		Message: s.ev.Message,
+		Entered: s.ev.Time,
+		Detail:  detail,
+	}
+}
+
+// Counts the exited span in the children of the span it was entered
+// within on its goroutine, and checks that its own children did not take
+// longer than it did
+func (t *Tracer) exitAudit(span *Span, ev *Event) {
+	if outer := span.outer; outer != nil {
+		atomic.AddInt64(&outer.childTime, int64(ev.Duration))
+		atomic.AddInt32(&outer.childCount, 1)
+	}
+	children := time.Duration(atomic.LoadInt64(&span.childTime))
+	if children == 0 {
+		return
+	}
+	resolution := t.options.ClockResolutionFloor
+	if resolution <= 0 {
+		resolution = auditTolerance
+	}
+	if tolerance := resolution * time.Duration(atomic.LoadInt32(&span.childCount)+1); children > ev.Duration+tolerance {
+		v := spanViolation(ChildrenExceedParent, span,
+			"children took "+formatDuration(children)+" in all, the span "+formatDuration(ev.Duration))
+		v.Exited = ev.Time
+		t.audit.add(v)
+	}
+}
+
+// Audit checks the invariants of the tracer's bookkeeping, for tests to
+// run once all they traced is over: that every span entered was exited
+// (unless it is suspended or handed off, which the report lists apart),
+// that the depth of every goroutine is that of its open spans, that no
+// function is counted as in flight but by its open spans, that the queues
+// of "Async" sinks are drained, and that the children of no span took
+// longer in all than it did, within the clock's resolution (that of
+// "ClockResolutionFloor", or a microsecond) per child. The violations are
+// listed in a stable order, so that the report of a traced run under a
+// fake "Clock" is the same from one run to the next. See "StrictAudit".
+func (t *Tracer) Audit() AuditReport {
+	var report AuditReport
+	if t.start == nil {
+		return report
+	}
+	t.audit.Lock()
+	report.Violations = append(report.Violations, t.audit.violations...)
+	report.Elided = t.audit.elided
+	t.audit.Unlock()
+
+	// The spans which count in the gauges, by function
+	inside := make(map[string]int64)
+	nesting := !t.options.DisableNesting
+	for i := range t.goroutines.shards {
+		shard := &t.goroutines.shards[i]
+		shard.Lock()
+		for gid, record := range shard.g {
+			for _, s := range record.open {
+				report.Violations = append(report.Violations, spanViolation(UnclosedSpan, s, "still open"))
+				inside[s.ev.Name]++
+			}
+			expected := 0
+			if nesting {
+				expected = len(record.open)
+			}
+			if record.depth != expected {
+				report.Violations = append(report.Violations, AuditViolation{
+					Kind:   DepthMismatch,
+					TID:    gid,
+					Detail: "depth " + strconv.Itoa(record.depth) + " with " + strconv.Itoa(len(record.open)) + " spans open",
+				})
+			}
+		}
+		shard.Unlock()
+	}
+
+	var suspended []*Span
+	for _, p := range []*suspensions{&t.suspensions, &t.handoffs} {
+		p.Lock()
+		for s := range p.spans {
+			suspended = append(suspended, s)
+			inside[s.ev.Name]++
+		}
+		p.Unlock()
+	}
+	report.Suspended = t.describeSuspended(suspended)
+
+	t.stats.gauges.Range(func(key, value interface{}) bool {
+		name := key.(string)
+		if n := atomic.LoadInt64(&value.(*gauge).n); n > 0 && n != inside[name] {
+			report.Violations = append(report.Violations, AuditViolation{
+				Kind:   InFlightLeak,
+				Name:   name,
+				Detail: strconv.FormatInt(n, 10) + " in flight, " + strconv.FormatInt(inside[name], 10) + " spans open",
+			})
+		}
+		return true
+	})
+
+	for i, s := range t.sinks {
+		if s.async == nil {
+			continue
+		}
+		s.async.Lock()
+		queued := s.async.bytes
+		s.async.Unlock()
+		if queued > 0 {
+			report.Violations = append(report.Violations, AuditViolation{
+				Kind:   AsyncBacklog,
+				Detail: formatBytes(uint64(queued)) + " queued for sink " + strconv.Itoa(i),
+			})
+		}
+	}
+
+	sort.SliceStable(report.Violations, func(i, j int) bool {
+		a, b := &report.Violations[i], &report.Violations[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if !a.Entered.Equal(b.Entered) {
+			return a.Entered.Before(b.Entered)
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.TID != b.TID {
+			return a.TID < b.TID
+		}
+		return a.Detail < b.Detail
+	})
+	return report
+}
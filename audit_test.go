@@ -0,0 +1,174 @@
+package tracey
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A writer which blocks until released
+type blockedWriter struct {
+	release chan struct{}
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func auditTracer(clock *manualClock, sinks ...Sink) *Tracer {
+	if len(sinks) == 0 {
+		sinks = []Sink{{Writer: io.Discard}}
+	}
+	return NewTracer(&Options{Sinks: sinks, Clock: clock.Now, StrictAudit: true})
+}
+
+func TestAuditClean(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 14, 3, 5, 0, time.UTC)}
+	t := auditTracer(clock)
+	func() {
+		defer t.Enter("%s", "outer")()
+		clock.advance(time.Millisecond)
+		t.Start("%s", "inner").End()
+	}()
+	assert.True(test, t.Audit().OK())
+	assert.Nil(test, t.Close())
+}
+
+func TestAuditUnclosedSpan(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 14, 3, 5, 0, time.UTC)}
+	t := auditTracer(clock)
+	func() {
+		defer t.Enter("%s", "outer")()
+		t.StartNamed("load", "loading %s", "users")
+	}()
+
+	report := t.Audit()
+	assert.Len(test, report.Violations, 1)
+	v := report.Violations[0]
+	assert.Equal(test, UnclosedSpan, v.Kind)
+	assert.Equal(test, "load", v.Name)
+	assert.Equal(test, "loading users", v.Message)
+	assert.Equal(test, clock.now, v.Entered)
+	assert.Equal(test, getGID(), v.TID)
+	assert.Equal(test, `unclosed span load [span=`+v.SpanID+` tid=`+strconv.FormatUint(v.TID, 10)+`] entered 14:03:05.000000 "loading users": still open`, v.String())
+	assert.Equal(test, "tracey: audit found 1 violations\n  "+v.String(), t.Close().Error())
+}
+
+func TestAuditDepth(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 14, 3, 5, 0, time.UTC)}
+	t := auditTracer(clock)
+	span := t.Start("%s", "work")
+	// The goroutine lost track of the span
+	span.record.depth = 0
+	span.End()
+
+	report := t.Audit()
+	assert.Len(test, report.Violations, 1)
+	assert.Equal(test, DepthMismatch, report.Violations[0].Kind)
+	assert.Equal(test, "depth went negative on exit", report.Violations[0].Detail)
+	assert.Equal(test, span.ev.SpanID, report.Violations[0].SpanID)
+
+	// and the other way around
+	t = auditTracer(clock)
+	span = t.Start("%s", "work")
+	span.record.depth = 3
+	report = t.Audit()
+	assert.Len(test, report.Violations, 2)
+	assert.Equal(test, UnclosedSpan, report.Violations[0].Kind)
+	assert.Equal(test, AuditViolation{Kind: DepthMismatch, TID: span.ev.TID, Detail: "depth 3 with 1 spans open"}, report.Violations[1])
+	span.End()
+}
+
+func TestAuditInFlight(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 14, 3, 5, 0, time.UTC)}
+	t := auditTracer(clock)
+	t.StartNamed("leaky").End()
+	// Counted in flight without a span
+	t.enterGauge("leaky")
+
+	report := t.Audit()
+	assert.Equal(test, []AuditViolation{{Kind: InFlightLeak, Name: "leaky", Detail: "1 in flight, 0 spans open"}}, report.Violations)
+	assert.Equal(test, "in-flight leak leaky: 1 in flight, 0 spans open", report.Violations[0].String())
+}
+
+func TestAuditAsyncBacklog(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 14, 3, 5, 0, time.UTC)}
+	w := &blockedWriter{release: make(chan struct{})}
+	t := auditTracer(clock, Sink{Writer: io.Discard}, Sink{Writer: w, Async: true})
+	for i := 0; i < 3; i++ {
+		t.Start("%s", "queued").End()
+	}
+
+	report := t.Audit()
+	assert.Len(test, report.Violations, 1)
+	assert.Equal(test, AsyncBacklog, report.Violations[0].Kind)
+	assert.Regexp(test, `^[0-9]+B queued for sink 1$`, report.Violations[0].Detail)
+
+	close(w.release)
+	assert.Nil(test, t.Close())
+}
+
+func TestAuditChildrenExceedParent(test *testing.T) {
+	start := time.Date(2020, 1, 1, 14, 3, 5, 0, time.UTC)
+	clock := &manualClock{now: start}
+	t := auditTracer(clock)
+	parent := t.StartNamed("parent")
+	child := t.StartNamed("child")
+	clock.advance(50 * time.Millisecond)
+	child.End()
+	// The clock went back
+	clock.now = start.Add(20 * time.Millisecond)
+	parent.End()
+
+	// Within the tolerance of the clock's resolution
+	parent = t.StartNamed("close call")
+	clock.advance(time.Millisecond)
+	t.StartNamed("child").End()
+	clock.now = clock.now.Add(-time.Microsecond)
+	parent.End()
+
+	report := t.Audit()
+	assert.Len(test, report.Violations, 1)
+	v := report.Violations[0]
+	assert.Equal(test, ChildrenExceedParent, v.Kind)
+	assert.Equal(test, "parent", v.Name)
+	assert.Equal(test, start.Add(20*time.Millisecond), v.Exited)
+	assert.Equal(test, "children took 50.0ms in all, the span 20.0ms", v.Detail)
+	assert.Contains(test, v.String(), "entered 14:03:05.000000 exited 14:03:05.020000: children")
+}
+
+func TestAuditSuspended(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 14, 3, 5, 0, time.UTC)}
+	var out bytes.Buffer
+	t := auditTracer(clock, Sink{Writer: &out})
+	span := t.StartNamed("waiting")
+	span.Suspend()
+	clock.advance(time.Second)
+
+	// Open on purpose
+	report := t.Audit()
+	assert.True(test, report.OK())
+	assert.Len(test, report.Suspended, 1)
+	assert.Equal(test, "waiting", report.Suspended[0].Name)
+	assert.Equal(test, time.Second, report.Suspended[0].Age)
+	assert.Nil(test, t.Close())
+}
+
+func TestAuditElided(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 14, 3, 5, 0, time.UTC)}
+	t := auditTracer(clock)
+	for i := 0; i < maxAuditViolations+5; i++ {
+		span := t.Start("%s", "work")
+		span.record.depth = 0
+		span.End()
+	}
+	report := t.Audit()
+	assert.Len(test, report.Violations, maxAuditViolations)
+	assert.Equal(test, 5, report.Elided)
+	assert.False(test, report.OK())
+}
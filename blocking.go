@@ -0,0 +1,119 @@
+package tracey
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Samples the process' block and mutex profiles, to estimate how long
+// spans spent waiting, see "EnableBlockProfiling"
+type blockProfiler struct {
+	sync.Mutex
+	records []runtime.BlockProfileRecord
+
+	// How many of the profiles' cycles make a second, as measured when
+	// the profiler was started
+	cyclesPerSecond float64
+
+	// The mutex profile fraction in effect before the profiler was
+	// started, and whether it was restored since
+	prevMutexFraction int
+	closed            bool
+}
+
+// Turns on the runtime's block and mutex profiles, and works out the
+// length of their cycles
+func newBlockProfiler() *blockProfiler {
+	p := &blockProfiler{}
+	p.prevMutexFraction = runtime.SetMutexProfileFraction(1)
+	runtime.SetBlockProfileRate(1)
+	p.cyclesPerSecond = p.calibrate(5 * time.Millisecond)
+	return p
+}
+
+// Blocks for about "wait" on a timer, which the block profile records,
+// and returns the number of cycles per second it saw. Falls back to one
+// cycle per nanosecond, should it see nothing.
+func (p *blockProfiler) calibrate(wait time.Duration) float64 {
+	before := p.sample()
+	start := time.Now()
+	<-time.After(wait)
+	elapsed := time.Since(start)
+	if blocked := p.sample() - before; blocked > 0 && elapsed > 0 {
+		return float64(blocked) / elapsed.Seconds()
+	}
+	return float64(time.Second)
+}
+
+// Returns the total cycles the process spent blocked so far, as recorded
+// by whichever of the block and mutex profiles recorded more
+func (p *blockProfiler) sample() int64 {
+	p.Lock()
+	defer p.Unlock()
+	var blocked, contended int64
+	blocked, p.records = readProfile(runtime.BlockProfile, p.records)
+	contended, p.records = readProfile(runtime.MutexProfile, p.records)
+	if contended > blocked {
+		return contended
+	}
+	return blocked
+}
+
+// Reads a profile into "records", growing it as needed, and returns the
+// total cycles of its records along with the buffer for the next read.
+func readProfile(read func([]runtime.BlockProfileRecord) (int, bool), records []runtime.BlockProfileRecord) (int64, []runtime.BlockProfileRecord) {
+	n, ok := read(records)
+	for !ok {
+		records = make([]runtime.BlockProfileRecord, n+n/4+16)
+		n, ok = read(records)
+	}
+	return sumCycles(records[:n]), records
+}
+
+func sumCycles(records []runtime.BlockProfileRecord) int64 {
+	var total int64
+	for i := range records {
+		total += records[i].Cycles
+	}
+	return total
+}
+
+// Converts a number of profile cycles to a duration
+func (p *blockProfiler) duration(cycles int64) time.Duration {
+	if cycles <= 0 || p.cyclesPerSecond <= 0 {
+		return 0
+	}
+	return time.Duration(float64(cycles) / p.cyclesPerSecond * float64(time.Second))
+}
+
+// Restores the profile rates, only the first call has any effect
+func (p *blockProfiler) close() {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	runtime.SetMutexProfileFraction(p.prevMutexFraction)
+	runtime.SetBlockProfileRate(0)
+}
+
+// Samples the profiles when an instrumented span is entered
+func (t *Tracer) enterBlocking(span *Span) {
+	instrument := t.options.EnableInstrumentation
+	if o := span.ev.overrides; o != nil && o.EnableInstrumentation != nil {
+		instrument = *o.EnableInstrumentation
+	}
+	if instrument && !span.muted {
+		span.blockedAt, span.blockSampled = t.blocking.sample(), true
+	}
+}
+
+// Notes on the exit event how long the process spent blocked while the
+// span was open, if it took long enough
+func (t *Tracer) exitBlocking(span *Span, ev *Event) {
+	if span.blockSampled && ev.Duration >= t.options.BlockProfileMinDuration {
+		ev.BlockedApprox = t.blocking.duration(t.blocking.sample() - span.blockedAt)
+	}
+}
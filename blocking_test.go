@@ -0,0 +1,108 @@
+package tracey
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadProfile(test *testing.T) {
+	profile := []runtime.BlockProfileRecord{{Count: 1, Cycles: 100}, {Count: 3, Cycles: 250}, {Count: 2, Cycles: 50}}
+	reads := 0
+	read := func(records []runtime.BlockProfileRecord) (int, bool) {
+		reads++
+		if len(records) < len(profile) {
+			return len(profile), false
+		}
+		return copy(records, profile), true
+	}
+
+	total, records := readProfile(read, nil)
+	assert.Equal(test, int64(400), total)
+	assert.Equal(test, 2, reads)
+
+	// The buffer is reused, and extra room is ignored
+	profile = profile[:2]
+	total, again := readProfile(read, records)
+	assert.Equal(test, int64(350), total)
+	assert.Equal(test, 3, reads)
+	assert.Equal(test, &records[0], &again[0])
+
+	assert.Equal(test, int64(0), sumCycles(nil))
+}
+
+func TestBlockedDuration(test *testing.T) {
+	p := &blockProfiler{cyclesPerSecond: 2e9}
+	assert.Equal(test, 38*time.Millisecond, p.duration(76e6))
+	assert.Equal(test, time.Duration(0), p.duration(0))
+	assert.Equal(test, time.Duration(0), p.duration(-5))
+	assert.Equal(test, time.Duration(0), (&blockProfiler{}).duration(100))
+}
+
+func TestBlockProfiling(test *testing.T) {
+	prevFraction := runtime.SetMutexProfileFraction(-1)
+	var js, text bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Writer: &js, Format: JSONFormat}, {Writer: &text}},
+		EnableInstrumentation: true,
+		EnableBlockProfiling:  true,
+	})
+	defer t.Close()
+
+	var mu sync.Mutex
+	locked := make(chan struct{})
+	go func() {
+		mu.Lock()
+		close(locked)
+		time.Sleep(40 * time.Millisecond)
+		mu.Unlock()
+	}()
+	<-locked
+	span := t.Start("%s", "contended")
+	mu.Lock()
+	mu.Unlock()
+	span.End()
+	t.Enter("%s", "idle")()
+
+	var exits []Event
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		if ev.Kind == ExitEvent {
+			exits = append(exits, ev)
+		}
+	}
+	assert.Len(test, exits, 2)
+	assert.True(test, exits[0].BlockedApprox >= 20*time.Millisecond, "blocked %s", exits[0].BlockedApprox)
+	assert.True(test, exits[0].BlockedApprox <= 2*exits[0].Duration, "blocked %s of %s", exits[0].BlockedApprox, exits[0].Duration)
+	assert.Equal(test, time.Duration(0), exits[1].BlockedApprox)
+	assert.Contains(test, text.String(), " (~blocked ")
+
+	t.Close()
+	t.Close()
+	assert.Equal(test, prevFraction, runtime.SetMutexProfileFraction(-1))
+}
+
+func TestBlockProfilingThreshold(test *testing.T) {
+	var text bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                   []Sink{{Writer: &text}},
+		EnableInstrumentation:   true,
+		EnableBlockProfiling:    true,
+		BlockProfileMinDuration: time.Hour,
+	})
+	defer t.Close()
+
+	span := t.Start("%s", "short")
+	<-time.After(5 * time.Millisecond)
+	span.End()
+	assert.NotContains(test, text.String(), "blocked")
+
+	// Without the option, nothing is sampled
+	assert.Nil(test, NewTracer(nil).blocking)
+}
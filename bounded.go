@@ -0,0 +1,347 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// What values nested deeper than "MaxFormatDepth" are rendered as
+const depthElided = "{…}"
+
+// What a value which contains itself is rendered as, where it does
+const cycleMarker = "<cycle>"
+
+// Returns true if "MaxFormatDepth" or "MaxElements" is set, values being
+// left to fmt otherwise
+func (t *Tracer) boundsValues() bool {
+	return t.options.MaxFormatDepth > 0 || t.options.MaxElements > 0
+}
+
+// Returns the arguments of a message, along with how many of them were
+// omitted, the verbs of which render "…": past "MaxArgs", arguments are
+// dropped, and structs, maps, slices and the pointers to them are bounded
+// by "MaxFormatDepth" and "MaxElements"
+func (t *Tracer) limitArgs(args []interface{}) ([]interface{}, int) {
+	max := t.options.MaxArgs
+	omitted := 0
+	if max > 0 && len(args) > max {
+		omitted = len(args) - max
+	}
+	bounds := t.boundsValues()
+	if omitted == 0 && !bounds {
+		return args, 0
+	}
+	limited := append([]interface{}(nil), args...)
+	for i := range limited {
+		if omitted > 0 && i >= max {
+			limited[i] = renderedValue("…")
+		} else if bounds {
+			limited[i] = t.boundArg(limited[i])
+		}
+	}
+	return limited, omitted
+}
+
+// Returns the note which follows a message whose arguments were omitted,
+// as in " (+3 args omitted)"
+func argsOmitted(n int) string {
+	if n == 1 {
+		return " (+1 arg omitted)"
+	}
+	return " (+" + strconv.Itoa(n) + " args omitted)"
+}
+
+// Wraps the argument for it to be rendered within the bounds, unless it
+// is a scalar, or renders itself
+func (t *Tracer) boundArg(arg interface{}) interface{} {
+	v := arg
+	if lazy, ok := arg.(*LazyValue); ok {
+		if v = lazy.Value(); v == nil {
+			return arg
+		}
+	}
+	switch v.(type) {
+	case renderedValue, fmt.Formatter, fmt.Stringer, error, lazyPanic:
+		return arg
+	}
+	rv := reflect.ValueOf(v)
+	kind := rv.Kind()
+	if kind == reflect.Ptr {
+		kind = rv.Type().Elem().Kind()
+	}
+	switch kind {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		return boundedValue{v, t.options.MaxFormatDepth, t.options.MaxElements}
+	}
+	return arg
+}
+
+// A value rendered as with "%v" (or "%+v", for field names) whatever the
+// verb, but for byte slices under "%s", "%q", "%x" and "%X", within
+// "MaxFormatDepth" and "MaxElements"
+type boundedValue struct {
+	v               interface{}
+	depth, elements int
+}
+
+func (b boundedValue) Format(f fmt.State, verb rune) {
+	rv := reflect.ValueOf(b.v)
+	if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 {
+		switch verb {
+		case 's', 'q', 'x', 'X':
+			bytes := rv.Bytes()
+			if b.elements > 0 && len(bytes) > b.elements {
+				fmt.Fprintf(f, "%"+string(verb)+"…+%d", bytes[:b.elements], len(bytes)-b.elements)
+			} else {
+				fmt.Fprintf(f, "%"+string(verb), bytes)
+			}
+			return
+		}
+	}
+	r := boundedRenderer{depth: b.depth, elements: b.elements, fields: f.Flag('+'), active: make(map[visit]bool)}
+	r.render(rv, 0)
+	f.Write(r.buf.Bytes())
+}
+
+// A pointer, map or slice being rendered, by the type it is seen as
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// Renders values the way "%v" does within bounds, following pointers
+// all the way down rather than only at the top, and so marking the values
+// which contain themselves
+type boundedRenderer struct {
+	buf             bytes.Buffer
+	depth, elements int
+	fields          bool
+
+	// The values the one being rendered is within
+	active map[visit]bool
+}
+
+// Marks the value as being rendered, returning false if it already is
+func (r *boundedRenderer) enter(v reflect.Value) bool {
+	key := visit{v.Pointer(), v.Type()}
+	if key.ptr == 0 {
+		return true
+	}
+	if r.active[key] {
+		return false
+	}
+	r.active[key] = true
+	return true
+}
+
+func (r *boundedRenderer) leave(v reflect.Value) {
+	delete(r.active, visit{v.Pointer(), v.Type()})
+}
+
+// Returns true once "n" is past the elements shown, having noted how many
+// of "total" are left out
+func (r *boundedRenderer) capped(n, total int) bool {
+	if r.elements <= 0 || n < r.elements {
+		return false
+	}
+	r.buf.WriteString(" …+")
+	r.buf.WriteString(strconv.Itoa(total - n))
+	return true
+}
+
+func (r *boundedRenderer) render(v reflect.Value, depth int) {
+	if !v.IsValid() {
+		r.buf.WriteString("<nil>")
+		return
+	}
+	if depth > 0 && v.CanInterface() {
+		switch v.Interface().(type) {
+		case fmt.Formatter, fmt.Stringer, error:
+			if v.Kind() == reflect.Ptr && v.IsNil() {
+				r.buf.WriteString("<nil>")
+				return
+			}
+			r.renderMethod(v.Interface())
+			return
+		}
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		r.render(v.Elem(), depth)
+	case reflect.Ptr:
+		if v.IsNil() {
+			r.buf.WriteString("<nil>")
+			return
+		}
+		switch v.Elem().Kind() {
+		case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		default:
+			r.buf.WriteString("0x" + strconv.FormatUint(uint64(v.Pointer()), 16))
+			return
+		}
+		if !r.enter(v) {
+			r.buf.WriteString(cycleMarker)
+			return
+		}
+		r.buf.WriteByte('&')
+		r.render(v.Elem(), depth)
+		r.leave(v)
+	case reflect.Struct:
+		if r.elided(depth) {
+			return
+		}
+		r.buf.WriteByte('{')
+		for i := 0; i < v.NumField(); i++ {
+			if i > 0 {
+				r.buf.WriteByte(' ')
+			}
+			if r.fields {
+				r.buf.WriteString(v.Type().Field(i).Name)
+				r.buf.WriteByte(':')
+			}
+			r.render(v.Field(i), depth+1)
+		}
+		r.buf.WriteByte('}')
+	case reflect.Map:
+		if v.IsNil() {
+			r.buf.WriteString("map[]")
+			return
+		}
+		if r.elided(depth) {
+			return
+		}
+		if !r.enter(v) {
+			r.buf.WriteString(cycleMarker)
+			return
+		}
+		r.buf.WriteString("map[")
+		keys := v.MapKeys()
+		sortKeys(keys)
+		for i, key := range keys {
+			if r.capped(i, len(keys)) {
+				break
+			}
+			if i > 0 {
+				r.buf.WriteByte(' ')
+			}
+			r.render(key, depth+1)
+			r.buf.WriteByte(':')
+			r.render(v.MapIndex(key), depth+1)
+		}
+		r.buf.WriteByte(']')
+		r.leave(v)
+	case reflect.Slice, reflect.Array:
+		if r.elided(depth) {
+			return
+		}
+		slice := v.Kind() == reflect.Slice && v.Len() > 0
+		if slice && !r.enter(v) {
+			r.buf.WriteString(cycleMarker)
+			return
+		}
+		r.buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if r.capped(i, v.Len()) {
+				break
+			}
+			if i > 0 {
+				r.buf.WriteByte(' ')
+			}
+			r.render(v.Index(i), depth+1)
+		}
+		r.buf.WriteByte(']')
+		if slice {
+			r.leave(v)
+		}
+	default:
+		r.renderScalar(v)
+	}
+}
+
+// Writes the marker of a value nested too deep, returning false if it is
+// not
+func (r *boundedRenderer) elided(depth int) bool {
+	if r.depth <= 0 || depth < r.depth {
+		return false
+	}
+	r.buf.WriteString(depthElided)
+	return true
+}
+
+// Renders a value which renders itself, as fmt does
+func (r *boundedRenderer) renderMethod(v interface{}) {
+	defer func() {
+		if recover() != nil {
+			r.buf.WriteString(renderError)
+		}
+	}()
+	fmt.Fprint(&r.buf, v)
+}
+
+func (r *boundedRenderer) renderScalar(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		r.buf.WriteString(strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		r.buf.WriteString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		r.buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		r.buf.WriteString(strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()))
+	case reflect.String:
+		r.buf.WriteString(v.String())
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		if v.IsNil() {
+			r.buf.WriteString("<nil>")
+		} else {
+			r.buf.WriteString("0x" + strconv.FormatUint(uint64(v.Pointer()), 16))
+		}
+	default:
+		// Complex numbers, which fmt renders as well as any
+		fmt.Fprint(&r.buf, v.Complex())
+	}
+}
+
+// Sorts map keys the way fmt does for the common kinds of keys, and by
+// their rendering otherwise
+func sortKeys(keys []reflect.Value) {
+	if len(keys) == 0 {
+		return
+	}
+	var less func(a, b reflect.Value) bool
+	switch keys[0].Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		less = func(a, b reflect.Value) bool { return a.Int() < b.Int() }
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		less = func(a, b reflect.Value) bool { return a.Uint() < b.Uint() }
+	case reflect.Float32, reflect.Float64:
+		less = func(a, b reflect.Value) bool { return a.Float() < b.Float() }
+	case reflect.String:
+		less = func(a, b reflect.Value) bool { return a.String() < b.String() }
+	case reflect.Bool:
+		less = func(a, b reflect.Value) bool { return !a.Bool() && b.Bool() }
+	default:
+		rendered := make([]string, len(keys))
+		for i, key := range keys {
+			rendered[i] = fmt.Sprint(key)
+		}
+		sort.Sort(keysByRendering{keys, rendered})
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+}
+
+type keysByRendering struct {
+	keys     []reflect.Value
+	rendered []string
+}
+
+func (k keysByRendering) Len() int           { return len(k.keys) }
+func (k keysByRendering) Less(i, j int) bool { return k.rendered[i] < k.rendered[j] }
+func (k keysByRendering) Swap(i, j int) {
+	k.keys[i], k.keys[j] = k.keys[j], k.keys[i]
+	k.rendered[i], k.rendered[j] = k.rendered[j], k.rendered[i]
+}
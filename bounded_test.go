@@ -0,0 +1,124 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type boundedNode struct {
+	Name  string
+	Child *boundedNode
+}
+
+type boundedDoc struct {
+	ID      int
+	Title   string
+	Score   float64
+	Tags    []string
+	Meta    map[string]int
+	Timeout time.Duration
+	Err     error
+	Nested  struct{ A, B []int }
+	private uint8
+	Empty   *boundedNode
+	Nil     map[int]bool
+}
+
+// Returns the message the tracer logs for a span started with the args
+func boundedMessage(opts Options, format string, args ...interface{}) string {
+	var out bytes.Buffer
+	opts.Sinks = []Sink{{Writer: &out}}
+	opts.MessageTemplates = map[string]string{`.`: "$MSG"}
+	NewTracer(&opts).Start(append([]interface{}{format}, args...)...)
+	return strings.TrimSuffix(strings.TrimPrefix(out.String(), "[ 0]ENTER: "), "\n")
+}
+
+func TestMaxFormatDepth(test *testing.T) {
+	root := &boundedNode{"a", &boundedNode{"b", &boundedNode{"c", &boundedNode{"d", nil}}}}
+	assert.Equal(test, "&{Name:a Child:&{Name:b Child:&{…}}}", boundedMessage(Options{MaxFormatDepth: 2}, "%+v", root))
+	assert.Equal(test, "&{a &{b &{c &{d <nil>}}}}", boundedMessage(Options{MaxFormatDepth: 10}, "%v", root))
+	assert.Equal(test, "[[1 {…}] map[3:4]]", boundedMessage(Options{MaxFormatDepth: 2},
+		"%v", []interface{}{[]interface{}{1, []interface{}{[]int{2}}}, map[int]int{3: 4}}))
+}
+
+func TestMaxElements(test *testing.T) {
+	huge := make([]int, 10000)
+	huge[0], huge[1], huge[2] = 1, 2, 3
+	assert.Equal(test, "rows: [1 2 3 …+9997]", boundedMessage(Options{MaxElements: 3}, "rows: %v", huge))
+	assert.Equal(test, "map[a:1 b:2 …+2]", boundedMessage(Options{MaxElements: 2}, "%v", map[string]int{"d": 4, "b": 2, "a": 1, "c": 3}))
+	assert.Equal(test, "body: abc…+3 616263…+3", boundedMessage(Options{MaxElements: 3}, "body: %s %x", []byte("abcdef"), []byte("abcdef")))
+	assert.Equal(test, "[1 2]", boundedMessage(Options{MaxElements: 3}, "%v", [2]int{1, 2}))
+}
+
+func TestBoundedCycles(test *testing.T) {
+	loop := &boundedNode{Name: "a"}
+	loop.Child = &boundedNode{"b", loop}
+	assert.Equal(test, "&{Name:a Child:&{Name:b Child:<cycle>}}", boundedMessage(Options{MaxElements: 10}, "%+v", loop))
+
+	self := []interface{}{1, nil}
+	self[1] = self
+	assert.Equal(test, "[1 <cycle>]", boundedMessage(Options{MaxFormatDepth: 100}, "%v", self))
+
+	m := map[string]interface{}{"k": 1}
+	m["self"] = m
+	assert.Equal(test, "map[k:1 self:<cycle>]", boundedMessage(Options{MaxElements: 100}, "%v", m))
+
+	// A value seen twice is no cycle
+	shared := &boundedNode{Name: "s"}
+	assert.Equal(test, "[&{s <nil>} &{s <nil>}]", boundedMessage(Options{MaxElements: 100}, "%v", []*boundedNode{shared, shared}))
+}
+
+func TestMaxArgs(test *testing.T) {
+	assert.Equal(test, "1 2 … … … (+3 args omitted)", boundedMessage(Options{MaxArgs: 2}, "%d %d %d %d %d", 1, 2, 3, 4, 5))
+	assert.Equal(test, "1 2 … (+1 arg omitted)", boundedMessage(Options{MaxArgs: 2}, "%d %d %d", 1, 2, 3))
+	assert.Equal(test, "1 2", boundedMessage(Options{MaxArgs: 2}, "%d %d", 1, 2))
+}
+
+func boundedValues() []interface{} {
+	doc := boundedDoc{
+		ID: 7, Title: "report", Score: 0.1 + 0.2, Tags: []string{"x", "y"},
+		Meta: map[string]int{"b": 2, "a": 1}, Timeout: 3 * time.Second,
+		Err: errors.New("boom"), private: 9,
+	}
+	doc.Nested.A = []int{1, 2}
+	return []interface{}{doc, &doc, []boundedDoc{doc}, map[int][]string{2: {"b"}, 1: {"a"}},
+		[3]float32{1.5, 2, 1e21}, []interface{}{nil, true, "s", 3 + 4i}, struct{}{}, []int(nil), 42, "plain"}
+}
+
+func TestUnboundedFormatting(test *testing.T) {
+	for _, v := range boundedValues() {
+		for _, verb := range []string{"%v", "%+v", "%d", "%x", "%#v", "%s"} {
+			assert.Equal(test, fmt.Sprintf(verb, v), boundedMessage(Options{}, verb, v))
+		}
+	}
+	// Within the bounds, values without pointers inside render as fmt does
+	for _, v := range boundedValues() {
+		for _, verb := range []string{"%v", "%+v"} {
+			assert.Equal(test, fmt.Sprintf(verb, v), boundedMessage(Options{MaxFormatDepth: 10, MaxElements: 100}, verb, v))
+		}
+	}
+}
+
+func TestBoundedTags(test *testing.T) {
+	var out bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, MessageTemplates: map[string]string{`.`: "$MSG"}, MaxElements: 2})
+	span := t.Start("%s", "load")
+	span.Tag("ids", []int{1, 2, 3, 4})
+	span.Tag("n", 5)
+	span.End()
+	assert.Contains(test, out.String(), "EXIT:  load {ids=[1 2 …+2] n=5}")
+}
+
+func BenchmarkBoundedHugeArg(b *testing.B) {
+	huge := make([]boundedDoc, 100000)
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}, MaxElements: 10, MaxFormatDepth: 3})
+	for i := 0; i < b.N; i++ {
+		t.Start("doc: %+v", huge).End()
+	}
+}
@@ -0,0 +1,230 @@
+package tracey
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The capabilities of a TraceBridge, see `TraceBridge.Capabilities()`.
+// Bits which a side does not know of are ignored, so that hosts and
+// plugins built against different versions of tracey only use what both
+// support.
+const (
+	// The host logs the spans of "EmitEnter(...)" and "EmitExit(...)",
+	// without which the plugin traces nothing
+	BridgeSpans uint64 = 1 << iota
+
+	// The host tags spans through "Tag(...)", without which the plugin
+	// appends the tags to the message of the enter, as in "load rows=3"
+	BridgeTags
+
+	// The host fails spans with the "errMsg" of "EmitExit(...)", without
+	// which the plugin tags them "error" instead, or drops the error if
+	// the host cannot tag either
+	BridgeErrors
+)
+
+// A TraceBridge hands the spans of a plugin loaded with `plugin.Open(...)`,
+// which cannot share the host's tracer, over to it, see `Export()` and
+// `FromBridge(...)`. Its methods only take types of the standard library,
+// so that it stays the same from one version of tracey to the next, and
+// is versioned by its capabilities instead.
+type TraceBridge interface {
+	// Returns what the host supports, a mask of the Bridge* capabilities
+	Capabilities() uint64
+
+	// Logs the entry of a span named "name" with the message "msg", within
+	// the span open on the goroutine "tid" (0 being the calling one), and
+	// returns the token the span is exited and tagged with, 0 if the host
+	// does not trace it
+	EmitEnter(name, msg string, tid uint64) (spanToken uint64)
+
+	// Logs the exit of the span, which took "durNanos" (if not negative,
+	// else the host times it) and failed with "errMsg" (if not empty)
+	EmitExit(spanToken uint64, durNanos int64, errMsg string)
+
+	// Tags the span before it exits, see `Span.Tag(...)`
+	Tag(spanToken uint64, key, value string)
+}
+
+// The host side of a bridge, holding the spans open through it
+type hostBridge struct {
+	t    *Tracer
+	next uint64
+
+	sync.Mutex
+	spans map[uint64]*Span
+}
+
+// Export returns the bridge the spans of a plugin are handed over through,
+// for the plugin to trace with `FromBridge(...)`. The plugin's spans are
+// the tracer's own: they nest within the spans open on their goroutine,
+// are written to the tracer's sinks, counted in its `Stats()` and matched
+// against its "FilterRules" and "MessageTemplates" by their name. The
+// bridge of a disabled tracer has no capabilities.
+func (t *Tracer) Export() TraceBridge {
+	return &hostBridge{t: t, spans: make(map[uint64]*Span)}
+}
+
+func (b *hostBridge) Capabilities() uint64 {
+	if b.t.start == nil {
+		return 0
+	}
+	return BridgeSpans | BridgeTags | BridgeErrors
+}
+
+func (b *hostBridge) EmitEnter(name, msg string, tid uint64) uint64 {
+	t := b.t
+	if t.start == nil {
+		return 0
+	}
+	var parent *Span
+	if tid != 0 && tid != getGID() {
+		if within := t.goroutines.innermost(tid); within != nil {
+			parent = within.standIn()
+		}
+	}
+	var s []interface{}
+	if msg != "" {
+		s = []interface{}{msg}
+	}
+	span := t.start(parent, "", t.namedSite(name), s...)
+	if span == noopSpan {
+		return 0
+	}
+	span.bridged = true
+	token := atomic.AddUint64(&b.next, 1)
+	b.Lock()
+	b.spans[token] = span
+	b.Unlock()
+	return token
+}
+
+func (b *hostBridge) EmitExit(token uint64, durNanos int64, errMsg string) {
+	b.Lock()
+	span := b.spans[token]
+	delete(b.spans, token)
+	b.Unlock()
+	if span == nil {
+		return
+	}
+	if errMsg != "" {
+		span.SetError(errors.New(errMsg))
+	}
+	if durNanos >= 0 {
+		span.reported = time.Duration(durNanos)
+	} else {
+		span.bridged = false
+	}
+	span.End()
+}
+
+func (b *hostBridge) Tag(token uint64, key, value string) {
+	b.Lock()
+	span := b.spans[token]
+	b.Unlock()
+	if span != nil {
+		span.Tag(key, value)
+	}
+}
+
+// The plugin side of a bridge
+type bridged struct {
+	b       TraceBridge
+	caps    uint64
+	options Options
+}
+
+// FromBridge returns the enter function of a plugin, to be used as that of
+// `New(...)` is, which hands its spans over to the host's tracer through
+// the bridge the host exported (see `Export()`), so that they nest within
+// the host's spans and share its sinks, statistics and filters. The spans
+// are named after the calling function, run through "NameFormatter" and
+// prefixed with "Prefix", timed with "Clock", and those which panic fail
+// with the panic. The tags of `WithStructTags(...)` are tagged through the
+// bridge. Of the options, only "DisableTracing", "NameFormatter",
+// "Prefix" and "Clock" apply, the host's deciding everything else. What
+// the host cannot do degrades as the Bridge* capabilities tell, and a
+// host without `BridgeSpans` traces nothing of the plugin.
+func FromBridge(b TraceBridge, opts *Options) func(...interface{}) func() {
+	p := &bridged{b: b}
+	if opts != nil {
+		p.options = *opts
+	}
+	if p.options.Clock == nil {
+		p.options.Clock = time.Now
+	}
+	if b != nil && !p.options.DisableTracing {
+		p.caps = b.Capabilities()
+	}
+	if p.caps&BridgeSpans == 0 {
+		return func(...interface{}) func() { return endNothing }
+	}
+	return p.enter
+}
+
+// Enters the span of the calling function through the bridge
+func (p *bridged) enter(s ...interface{}) func() {
+	name := "<unknown>"
+	var pcs [1]uintptr
+	if runtime.Callers(2, pcs[:]) > 0 {
+		frame, _ := runtime.CallersFrames(pcs[:]).Next()
+		name = formatFnName(frame.Function, p.options.NameFormatter)
+	}
+	name = p.options.Prefix + name
+
+	tags, s := splitStructTags(s)
+	var msg string
+	if len(s) > 0 {
+		if format, ok := s[0].(string); ok && len(s) == 1 {
+			msg = format
+		} else if ok {
+			msg = RE_detectFN.ReplaceAllString(fmt.Sprintf(format, s[1:]...), name)
+		}
+	}
+	tagged := p.caps&BridgeTags != 0
+	if !tagged && len(tags) > 0 {
+		var b strings.Builder
+		b.WriteString(msg)
+		for _, tag := range tags {
+			if b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(tag.Key + "=" + fmt.Sprint(tag.Value))
+		}
+		msg = b.String()
+	}
+
+	began := p.options.Clock()
+	token := p.b.EmitEnter(name, msg, getGID())
+	if token == 0 {
+		return endNothing
+	}
+	if tagged {
+		for _, tag := range tags {
+			p.b.Tag(token, tag.Key, fmt.Sprint(tag.Value))
+		}
+	}
+	return func() {
+		r := recover()
+		var errMsg string
+		if r != nil {
+			errMsg = fmt.Sprintf("panicked: %v", r)
+			if p.caps&BridgeErrors == 0 {
+				if tagged {
+					p.b.Tag(token, "error", errMsg)
+				}
+				errMsg = ""
+			}
+		}
+		p.b.EmitExit(token, int64(p.options.Clock().Sub(began)), errMsg)
+		if r != nil {
+			panic(r)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package tracey
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A host which lacks some of the capabilities, as older hosts do
+type degradedBridge struct {
+	TraceBridge
+	missing uint64
+}
+
+func (b degradedBridge) Capabilities() uint64 {
+	return b.TraceBridge.Capabilities() &^ b.missing
+}
+
+type pluginRequest struct {
+	Rows int `tracey:"rows"`
+}
+
+// Stands for a function of the plugin
+func pluginLoad(trace func(...interface{}) func(), clock *manualClock, fail bool) {
+	defer trace("loading", WithStructTags(pluginRequest{Rows: 3}))()
+	clock.advance(7 * time.Millisecond)
+	if fail {
+		panic("no rows")
+	}
+}
+
+func hostHandler(t *Tracer, trace func(...interface{}) func(), clock *manualClock) {
+	defer t.Enter()()
+	pluginLoad(trace, clock, false)
+}
+
+func bridgeHost(opts Options) (*Tracer, *lockedBuffer) {
+	out := &lockedBuffer{}
+	opts.Sinks = []Sink{{Writer: out}}
+	opts.EnableInstrumentation = true
+	if opts.MessageTemplates == nil {
+		opts.MessageTemplates = map[string]string{`pluginLoad`: "$FN $MSG"}
+	}
+	return NewTracer(&opts), out
+}
+
+func TestBridge(test *testing.T) {
+	hostClock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t, out := bridgeHost(Options{Clock: hostClock.Now})
+	pluginClock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	trace := FromBridge(t.Export(), &Options{Clock: pluginClock.Now, Prefix: "plugin."})
+	hostHandler(t, trace, pluginClock)
+
+	// Nested within the host's span, timed by the plugin
+	assert.Equal(test, "[ 0]ENTER: =>\n"+
+		"[ 1]  ENTER: plugin.go-tracey.pluginLoad loading\n"+
+		"[ 1]  EXIT:  plugin.go-tracey.pluginLoad loading ... in 7ms {rows=3}\n"+
+		"[ 0]EXIT:  => ... in 0s\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	stats := make(map[string]FuncStats)
+	for _, s := range t.Stats() {
+		stats[s.Name] = s
+	}
+	assert.Equal(test, uint64(1), stats["plugin.go-tracey.pluginLoad"].Calls)
+	assert.Equal(test, 7*time.Millisecond, stats["plugin.go-tracey.pluginLoad"].Total)
+
+	// Panics fail the span
+	out.Reset()
+	assert.Panics(test, func() { pluginLoad(trace, pluginClock, true) })
+	assert.Equal(test, "[ 0]EXIT:  plugin.go-tracey.pluginLoad loading ... in 7ms {rows=3} (error: panicked: no rows)\n", strings.Split(out.String(), "\n")[1]+"\n")
+}
+
+func TestBridgeTID(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t, out := bridgeHost(Options{Clock: clock.Now, MessageTemplates: map[string]string{`.`: "$FN"}})
+	b := t.Export()
+	span := t.StartNamed("host")
+	tid := getGID()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Within the span open on the host's goroutine
+		token := b.EmitEnter("callback", "", tid)
+		b.EmitExit(token, 0, "")
+		b.EmitExit(token, 0, "")
+	}()
+	wg.Wait()
+	span.End()
+	assert.Equal(test, "[ 0]ENTER: host\n[ 1]  ENTER: callback\n[ 1]  EXIT:  callback ... in 0s\n[ 0]EXIT:  host ... in 0s\n", out.String())
+}
+
+func TestBridgeFilters(test *testing.T) {
+	t, out := bridgeHost(Options{FilterRules: []FilterRule{{Kind: MatchExact, Pattern: "go-tracey.pluginLoad", Action: Exclude}}})
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	pluginLoad(FromBridge(t.Export(), nil), clock, false)
+	assert.Equal(test, "", out.String())
+}
+
+func TestBridgeCapabilities(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	exit := func(missing uint64) string {
+		t, out := bridgeHost(Options{})
+		trace := FromBridge(degradedBridge{t.Export(), missing}, &Options{Clock: clock.Now})
+		assert.Panics(test, func() { pluginLoad(trace, clock, true) })
+		if out.Len() == 0 {
+			return ""
+		}
+		return strings.Split(out.String(), "\n")[1]
+	}
+	assert.Equal(test, "[ 0]EXIT:  go-tracey.pluginLoad loading ... in 7ms {rows=3} (error: panicked: no rows)", exit(0))
+	// Errors are tagged instead
+	assert.Equal(test, "[ 0]EXIT:  go-tracey.pluginLoad loading ... in 7ms {rows=3 error=panicked: no rows}", exit(BridgeErrors))
+	// Tags end up in the message
+	assert.Equal(test, "[ 0]EXIT:  go-tracey.pluginLoad loading rows=3 ... in 7ms", exit(BridgeTags|BridgeErrors))
+	assert.Equal(test, "", exit(BridgeSpans))
+
+	// Nothing to hand over to
+	assert.Equal(test, uint64(0), NewTracer(&Options{DisableTracing: true}).Export().Capabilities())
+}
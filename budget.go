@@ -0,0 +1,164 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Budget is what was left of the latency budget a span runs within when
+// it started, see `WithBudget(...)`. It is zero or negative if the budget
+// was already spent.
+type Budget struct {
+	Left time.Duration
+}
+
+// WithBudget gives the span it is passed to along with the message
+// arguments a latency budget, which the spans within it share, as in
+//
+//	defer tracer.Enter("%s", "checkout", tracey.WithBudget(50*time.Millisecond))()
+//
+// Every span within it shows what was left when it started, as in
+// "[budget left 38ms]", and on exit how much of it it used, as in
+// "[used 12ms of 38ms]", while those which start once it is spent show
+// "[OVER BUDGET at start]". The budget runs down with the time passing,
+// by the "Clock", whatever the spans do. A span within another's budget
+// keeps the tighter of the two. See "Budgets" to give the spans of given
+// functions a budget.
+func WithBudget(d time.Duration) interface{} {
+	return budgetArg{d}
+}
+
+type budgetArg struct {
+	d time.Duration
+}
+
+// When the budget a span runs within is spent
+type spanBudget struct {
+	deadline time.Time
+}
+
+// Splits the `WithBudget(...)` off of the arguments to an enter
+func splitBudget(s []interface{}) (time.Duration, []interface{}) {
+	for i, arg := range s {
+		if b, ok := arg.(budgetArg); ok {
+			rest := append(append(make([]interface{}, 0, len(s)-1), s[:i]...), s[i+1:]...)
+			return b.d, rest
+		}
+	}
+	return 0, s
+}
+
+// The "Budgets" of a tracer, compiled, along with the budget found for
+// every function name so far (0 if none). Patterns are tried in lexical
+// order, the first match wins, those starting with "op:" matching the
+// operation of the span rather than its name (see `WithOperation(...)`).
+// Also holds the durations of "AbandonAfterFuncs".
+type budgets struct {
+	patterns []*regexp.Regexp
+	budgets  []time.Duration
+	ops      []bool
+	anyOps   bool
+	byName   sync.Map
+}
+
+func compileBudgets(sources map[string]time.Duration) (*budgets, error) {
+	return compileDurations("Budgets", sources)
+}
+
+// Compiles a map of patterns to durations, the option named "option"
+func compileDurations(option string, sources map[string]time.Duration) (*budgets, error) {
+	b := &budgets{}
+	keys := make([]string, 0, len(sources))
+	for key := range sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		op := strings.HasPrefix(key, operationPrefix)
+		pattern, err := regexp.Compile(strings.TrimPrefix(key, operationPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern in %s: %v", option, err)
+		}
+		b.patterns = append(b.patterns, pattern)
+		b.budgets = append(b.budgets, sources[key])
+		b.ops = append(b.ops, op)
+		b.anyOps = b.anyOps || op
+	}
+	return b, nil
+}
+
+// Returns the duration of the first pattern which matches the function
+// name, or the operation if it is not empty
+func (b *budgets) lookup(name, operation string) time.Duration {
+	key := name
+	if operation != "" && b.anyOps {
+		key = name + "\x00" + operation
+	}
+	if found, ok := b.byName.Load(key); ok {
+		return found.(time.Duration)
+	}
+	var found time.Duration
+	for i, pattern := range b.patterns {
+		subject := name
+		if b.ops[i] {
+			subject = operation
+		}
+		if (subject != "" || !b.ops[i]) && pattern.MatchString(subject) {
+			found = b.budgets[i]
+			break
+		}
+	}
+	b.byName.Store(key, found)
+	return found
+}
+
+// Gives the span the budget it runs within, that of the span it is within
+// or one of its own, whichever is spent first
+func (t *Tracer) enterBudget(span *Span, gid uint64, parent *Span, own time.Duration) {
+	ev := &span.ev
+	if own <= 0 && t.budgets != nil {
+		own = t.budgets.lookup(ev.Name, ev.Operation)
+	}
+	if within := t.enclosing(gid, parent); within != nil {
+		span.budget = within.budget
+	}
+	if own > 0 {
+		if deadline := ev.Time.Add(own); span.budget == nil || deadline.Before(span.budget.deadline) {
+			span.budget = &spanBudget{deadline}
+			atomic.StoreUint32(&t.budgeted, 1)
+		}
+	}
+	if span.budget != nil {
+		ev.Budget = &Budget{span.budget.deadline.Sub(ev.Time)}
+	}
+}
+
+// Writes what was left of the budget of the span when it started, or on
+// exit how much of it the span used
+func renderBudget(buf *bytes.Buffer, ev *Event) {
+	if ev.Kind == ExitEvent {
+		buf.WriteString(" [used ")
+		writeDuration(buf, ev.Duration)
+		if ev.Budget.Left > 0 {
+			buf.WriteString(" of ")
+			writeDuration(buf, ev.Budget.Left)
+			buf.WriteByte(']')
+		} else {
+			buf.WriteString(", OVER BUDGET at start]")
+		}
+		return
+	}
+	if ev.Budget.Left > 0 {
+		buf.WriteString(" [budget left ")
+		writeDuration(buf, ev.Budget.Left)
+		buf.WriteByte(']')
+	} else {
+		buf.WriteString(" [OVER BUDGET at start]")
+	}
+}
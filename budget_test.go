@@ -0,0 +1,91 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudget(test *testing.T) {
+	var text, js bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &text}, {Writer: &js, Format: JSONFormat}}, Clock: clock.Now})
+
+	func() {
+		defer t.Enter("%s", "checkout", WithBudget(50*time.Millisecond))()
+		clock.advance(10 * time.Millisecond)
+		func() {
+			defer t.Enter("%s", "price")()
+			clock.advance(12 * time.Millisecond)
+			func() {
+				defer t.Enter("%s", "tax")()
+				clock.advance(30 * time.Millisecond)
+			}()
+		}()
+		// The budget is spent by now
+		func() {
+			defer t.Enter("%s", "charge")()
+			clock.advance(5 * time.Millisecond)
+		}()
+	}()
+	t.Enter("%s", "unbudgeted")()
+
+	assert.Equal(test, "[ 0]ENTER: =>checkout [budget left 50ms]\n"+
+		"[ 1]  ENTER: =>price [budget left 40ms]\n"+
+		"[ 2]    ENTER: =>tax [budget left 28ms]\n"+
+		"[ 2]    EXIT:  =>tax [used 30ms of 28ms]\n"+
+		"[ 1]  EXIT:  =>price [used 42ms of 40ms]\n"+
+		"[ 1]  ENTER: =>charge [OVER BUDGET at start]\n"+
+		"[ 1]  EXIT:  =>charge [used 5ms, OVER BUDGET at start]\n"+
+		"[ 0]EXIT:  =>checkout [used 57ms of 50ms]\n"+
+		"[ 0]ENTER: =>unbudgeted\n"+
+		"[ 0]EXIT:  =>unbudgeted\n", RE_tidMarker.ReplaceAllString(text.String(), "=>"))
+
+	var left []time.Duration
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		if ev.Kind == EnterEvent && ev.Budget != nil {
+			left = append(left, ev.Budget.Left)
+		}
+	}
+	assert.Equal(test, []time.Duration{50 * time.Millisecond, 40 * time.Millisecond, 28 * time.Millisecond, -2 * time.Millisecond}, left)
+}
+
+func budgetedLookup(t *Tracer, clock *manualClock) {
+	defer t.Enter()()
+	clock.advance(time.Millisecond)
+}
+
+func TestBudgets(test *testing.T) {
+	var out bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:   []Sink{{Writer: &out}},
+		Clock:   clock.Now,
+		Budgets: map[string]time.Duration{`\.budgetedLookup$`: 5 * time.Millisecond},
+	})
+	budgetedLookup(t, clock)
+	func() {
+		// A span keeps the tighter of the budgets
+		defer t.Enter("%s", "loose", WithBudget(time.Second))()
+		budgetedLookup(t, clock)
+	}()
+	func() {
+		defer t.Enter("%s", "tight", WithBudget(2*time.Millisecond))()
+		budgetedLookup(t, clock)
+	}()
+
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(out.String(), "=>")), "\n")
+	assert.Equal(test, []string{
+		"[ 0]ENTER: => [budget left 5ms]",
+		"[ 0]EXIT:  => [used 1ms of 5ms]",
+		"[ 1]  ENTER: => [budget left 5ms]",
+		"[ 1]  ENTER: => [budget left 2ms]",
+	}, []string{lines[0], lines[1], lines[3], lines[7]})
+	assert.Panics(test, func() { NewTracer(&Options{Budgets: map[string]time.Duration{"(": time.Second}}) })
+	assert.NotNil(test, (&Options{Budgets: map[string]time.Duration{"(": time.Second}}).Validate())
+}
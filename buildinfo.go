@@ -0,0 +1,160 @@
+package tracey
+
+import (
+	"bytes"
+	"path"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// What session headers start with in text output
+const sessionHeaderPrefix = "TRACEY SESSION s:"
+
+// Reads the build information of the binary, replaced by tests
+var readBuildInfo = debug.ReadBuildInfo
+
+// BuildInfo describes the build of the binary a trace comes from, as read
+// from `debug.ReadBuildInfo()` when the tracer was created.
+type BuildInfo struct {
+	// The main package, and the version of its module, "(devel)" for
+	// binaries built from a checkout
+	Path    string
+	Version string
+
+	// The commit the binary was built from, when it was made, and whether
+	// the checkout had uncommitted changes, when the build recorded them
+	Revision string
+	Time     time.Time
+	Dirty    bool
+
+	// The Go version the binary was built with, as in "go1.22.1"
+	GoVersion string
+
+	// The JSON object of the "bi" field, rendered once
+	json []byte
+}
+
+// Returns the build information of the binary, or nil if it has none,
+// such as when it was built without module support
+func currentBuildInfo() *BuildInfo {
+	info, ok := readBuildInfo()
+	if !ok || info == nil {
+		return nil
+	}
+	b := &BuildInfo{Path: info.Path, Version: info.Main.Version, GoVersion: info.GoVersion}
+	if b.Path == "" {
+		b.Path = info.Main.Path
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Revision = s.Value
+		case "vcs.time":
+			b.Time, _ = time.Parse(time.RFC3339Nano, s.Value)
+		case "vcs.modified":
+			b.Dirty = s.Value == "true"
+		}
+	}
+	return b.rendered()
+}
+
+// Renders the JSON object of the build, as in {"path":"example.com/myapp",
+// "ver":"v1.4.2","rev":"9f3ac1e…","vcs_time":"...","dirty":true,"go":"go1.22.1"},
+// leaving out the fields which are not known
+func (b *BuildInfo) rendered() *BuildInfo {
+	var buf bytes.Buffer
+	buf.WriteString(`{"path":`)
+	appendJSONString(&buf, b.Path)
+	for _, field := range [...]struct{ key, value string }{{"ver", b.Version}, {"rev", b.Revision}, {"go", b.GoVersion}} {
+		if field.value != "" {
+			buf.WriteString(`,"` + field.key + `":`)
+			appendJSONString(&buf, field.value)
+		}
+	}
+	if !b.Time.IsZero() {
+		buf.WriteString(`,"vcs_time":"`)
+		buf.WriteString(b.Time.UTC().Format(time.RFC3339))
+		buf.WriteByte('"')
+	}
+	if b.Dirty {
+		buf.WriteString(`,"dirty":true`)
+	}
+	buf.WriteByte('}')
+	b.json = buf.Bytes()
+	return b
+}
+
+// The "bi" field, as decoded by `UnmarshalEvent(...)`
+type buildInfoJSON struct {
+	Path      string    `json:"path"`
+	Version   string    `json:"ver"`
+	Revision  string    `json:"rev"`
+	Time      time.Time `json:"vcs_time"`
+	Dirty     bool      `json:"dirty"`
+	GoVersion string    `json:"go"`
+}
+
+func (j *buildInfoJSON) buildInfo() *BuildInfo {
+	if j == nil {
+		return nil
+	}
+	return (&BuildInfo{Path: j.Path, Version: j.Version, Revision: j.Revision, Time: j.Time, Dirty: j.Dirty, GoVersion: j.GoVersion}).rendered()
+}
+
+// Describes the build, as in "myapp v1.4.2 (rev 9f3ac1e, dirty)
+// go1.22.1", or "build info unavailable" for a nil build.
+func (b *BuildInfo) String() string {
+	if b == nil {
+		return "build info unavailable"
+	}
+	parts := []string{path.Base(b.Path)}
+	if b.Version != "" {
+		parts = append(parts, b.Version)
+	}
+	if b.Revision != "" {
+		vcs := "(rev " + shortRevision(b.Revision)
+		if b.Dirty {
+			vcs += ", dirty"
+		}
+		parts = append(parts, vcs+")")
+	} else if b.Dirty {
+		parts = append(parts, "(dirty)")
+	}
+	if b.GoVersion != "" {
+		parts = append(parts, b.GoVersion)
+	}
+	return strings.Join(parts, " ")
+}
+
+// The part of a commit hash shown in text, as git shows it
+func shortRevision(rev string) string {
+	if len(rev) > 7 {
+		return rev[:7]
+	}
+	return rev
+}
+
+// BuildInfo returns the build of the binary, as read when the tracer was
+// created, or nil if the binary has no build information (nor does a
+// tracer whose tracing is disabled read it). See "BuildInfoPerEvent".
+func (t *Tracer) BuildInfo() *BuildInfo {
+	return t.build
+}
+
+// Writes the session header to every sink, as in "TRACEY SESSION s:ab12 —
+// myapp v1.4.2 (rev 9f3ac1e, dirty) go1.22.1" in text
+func (t *Tracer) emitSessionHeader() {
+	ev := &Event{Kind: SessionEvent, Time: t.options.Clock(), Build: t.build}
+	t.sequence(ev)
+	t.emitTo(ev, func(*sinkState, *Event) bool { return true })
+}
+
+// Renders the session header of text output
+func renderSessionHeader(buf *bytes.Buffer, ev *Event) {
+	buf.WriteString(sessionHeaderPrefix)
+	buf.WriteString(shortSessionID(ev.Session))
+	buf.WriteString(" — ")
+	buf.WriteString(ev.Build.String())
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,151 @@
+package tracey
+
+import (
+	"bytes"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Makes the tracers of the test read "info" as the build of the binary,
+// or none if it is nil
+func stubBuildInfo(test *testing.T, info *debug.BuildInfo) {
+	prev := readBuildInfo
+	readBuildInfo = func() (*debug.BuildInfo, bool) { return info, info != nil }
+	test.Cleanup(func() { readBuildInfo = prev })
+}
+
+func testBuildInfo() *debug.BuildInfo {
+	return &debug.BuildInfo{
+		GoVersion: "go1.22.1",
+		Path:      "example.com/myapp",
+		Main:      debug.Module{Path: "example.com/myapp", Version: "v1.4.2"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "9f3ac1e0b2d4c6a8e0f1a2b3c4d5e6f7a8b9c0d1"},
+			{Key: "vcs.time", Value: "2024-03-01T10:20:30Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+}
+
+func TestBuildInfo(test *testing.T) {
+	stubBuildInfo(test, testBuildInfo())
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}})
+	b := t.BuildInfo()
+	assert.Equal(test, "example.com/myapp", b.Path)
+	assert.Equal(test, "v1.4.2", b.Version)
+	assert.Equal(test, "9f3ac1e0b2d4c6a8e0f1a2b3c4d5e6f7a8b9c0d1", b.Revision)
+	assert.Equal(test, time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC), b.Time)
+	assert.True(test, b.Dirty)
+	assert.Equal(test, "myapp v1.4.2 (rev 9f3ac1e, dirty) go1.22.1", b.String())
+
+	assert.Equal(test, "myapp (devel) go1.22.1", (&BuildInfo{Path: "example.com/myapp", Version: "(devel)", GoVersion: "go1.22.1"}).String())
+	assert.Equal(test, "build info unavailable", (*BuildInfo)(nil).String())
+}
+
+func TestSessionHeader(test *testing.T) {
+	stubBuildInfo(test, testBuildInfo())
+	var out bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, SessionID: "ab12cd34", MessageTemplates: map[string]string{`.`: "$MSG"}})
+	t.Start("%s", "work").End()
+	assert.Equal(test, "TRACEY SESSION s:ab12 — myapp v1.4.2 (rev 9f3ac1e, dirty) go1.22.1\n"+
+		"[s:ab12][ 0]ENTER: work\n"+
+		"[s:ab12][ 0]EXIT:  work\n", out.String())
+
+	// which reads back
+	header := strings.SplitAfter(out.String(), "\n")[0]
+	opts := &Options{SessionID: "ab12cd34"}
+	l, err := ParseLine(header, opts)
+	assert.Nil(test, err)
+	assert.Equal(test, Line{Kind: SessionEvent, Message: "myapp v1.4.2 (rev 9f3ac1e, dirty) go1.22.1"}, l)
+	var buf bytes.Buffer
+	assert.Nil(test, RenderLine(&buf, l, opts))
+	assert.Equal(test, header, buf.String())
+
+	// Without a session there is no header
+	out.Reset()
+	NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, MessageTemplates: map[string]string{`.`: "$MSG"}}).Start("%s", "work").End()
+	assert.Equal(test, "[ 0]ENTER: work\n[ 0]EXIT:  work\n", out.String())
+}
+
+func TestSessionHeaderJSON(test *testing.T) {
+	stubBuildInfo(test, testBuildInfo())
+	for _, perEvent := range []bool{false, true} {
+		var js bytes.Buffer
+		t := NewTracer(&Options{Sinks: []Sink{{Writer: &js, Format: JSONFormat}}, SessionID: "ab12cd34", BuildInfoPerEvent: perEvent})
+		t.Start("%s", "work").End()
+
+		lines := strings.Split(strings.TrimSpace(js.String()), "\n")
+		assert.Len(test, lines, 3)
+		assert.Contains(test, lines[0], `"kind":"session"`)
+		assert.Contains(test, lines[0], `,"bi":{"path":"example.com/myapp","ver":"v1.4.2","rev":"9f3ac1e0b2d4c6a8e0f1a2b3c4d5e6f7a8b9c0d1","go":"go1.22.1","vcs_time":"2024-03-01T10:20:30Z","dirty":true}`)
+		for i, line := range lines {
+			ev, err := UnmarshalEvent([]byte(line))
+			assert.Nil(test, err)
+			if i == 0 || perEvent {
+				assert.Equal(test, t.BuildInfo(), ev.Build)
+			} else {
+				assert.Nil(test, ev.Build)
+				assert.NotContains(test, line, `"bi"`)
+			}
+		}
+		header, _ := UnmarshalEvent([]byte(lines[0]))
+		assert.Equal(test, SessionEvent, header.Kind)
+		assert.Equal(test, "ab12cd34", header.Session)
+	}
+}
+
+func TestSessionHeaderBinary(test *testing.T) {
+	stubBuildInfo(test, testBuildInfo())
+	var bin bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &bin, Format: BinaryFormat}}, SessionID: "ab12cd34"})
+	t.Start("%s", "work").End()
+
+	events, err := readSession(&bin, "p0")
+	assert.Nil(test, err)
+	assert.Len(test, events, 3)
+	assert.Equal(test, SessionEvent, events[0].Kind)
+	assert.Equal(test, "ab12cd34", events[0].Session)
+	assert.Equal(test, t.BuildInfo(), events[0].Build)
+	assert.Equal(test, "work", events[2].Message)
+}
+
+func TestSessionHeaderUnavailable(test *testing.T) {
+	stubBuildInfo(test, nil)
+	var out, js, bin bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:     []Sink{{Writer: &out}, {Writer: &js, Format: JSONFormat}, {Writer: &bin, Format: BinaryFormat}},
+		SessionID: "ab12cd34",
+	})
+	assert.Nil(test, t.BuildInfo())
+	assert.Equal(test, "TRACEY SESSION s:ab12 — build info unavailable\n", out.String())
+
+	ev, err := UnmarshalEvent(js.Bytes())
+	assert.Nil(test, err)
+	assert.Equal(test, SessionEvent, ev.Kind)
+	assert.Nil(test, ev.Build)
+	assert.NotContains(test, js.String(), `"bi"`)
+
+	events := decodeRecords(bin.Bytes())
+	assert.Len(test, events, 1)
+	assert.Equal(test, SessionEvent, events[0].Kind)
+	assert.Nil(test, events[0].Build)
+}
+
+func TestSessionDiffBuilds(test *testing.T) {
+	a := append([]Event{{Kind: SessionEvent, Build: &BuildInfo{Path: "example.com/myapp", Version: "v1.4.1", GoVersion: "go1.22.1"}}},
+		sessionCalls("app.work", 2, time.Millisecond)...)
+	b := append([]Event{{Kind: SessionEvent}}, sessionCalls("app.work", 2, 2*time.Millisecond)...)
+	diff := CompareSessions(a, b)
+	assert.Equal(test, "v1.4.1", diff.BuildA.Version)
+	assert.Nil(test, diff.BuildB)
+	assert.Len(test, diff.Funcs, 1)
+	assert.Equal(test, uint64(2), diff.Funcs[0].CallsA)
+
+	var buf bytes.Buffer
+	assert.Nil(test, WriteSessionDiff(&buf, diff, DiffOptions{}))
+	assert.True(test, strings.HasPrefix(buf.String(), "A: myapp v1.4.1 go1.22.1\nB: build info unavailable\n\nFUNCTION"), buf.String())
+}
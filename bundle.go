@@ -0,0 +1,389 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// DefaultBundleMaxPerHour is how many bundles "BundleOnError" writes
+	// per hour at most, unless "MaxPerHour" is set.
+	DefaultBundleMaxPerHour = 10
+
+	// DefaultBundleMaxBytes is how large a bundle of "BundleOnError" is at
+	// most, unless "MaxBytes" is set.
+	DefaultBundleMaxBytes = 16 << 20
+
+	// DefaultBundleMaxEvents is how many events a tree buffers at most for
+	// "BundleOnError", unless "MaxEvents" is set.
+	DefaultBundleMaxEvents = 4096
+)
+
+// ErrNoOpenTree is returned by `Tracer.BundleNow(...)` when no call tree
+// is open on the calling goroutine.
+var ErrNoOpenTree = errors.New("tracey: no call tree open on the goroutine")
+
+// ErrBundleRateLimited is returned by `Tracer.BundleNow(...)` when
+// "MaxPerHour" bundles were written within the last hour already.
+var ErrBundleRateLimited = errors.New("tracey: too many bundles within the last hour")
+
+// A BundleConfig tells where and how much "BundleOnError" writes.
+type BundleConfig struct {
+	// The directory the bundles are written in, created if need be
+	Dir string
+
+	// How many bundles are written per hour at most
+	// (`DefaultBundleMaxPerHour` if 0, unlimited if negative), the others
+	// being left out
+	MaxPerHour int
+
+	// How large a bundle is at most (`DefaultBundleMaxBytes` if 0), the
+	// events past it being left out of "trace.txt" and "events.json"
+	MaxBytes int64
+
+	// How many events each tree buffers at most (`DefaultBundleMaxEvents`
+	// if 0), the later ones being left out
+	MaxEvents int
+}
+
+// The events of a top-level call tree, buffered in case it fails, see
+// "BundleOnError". The spans of a tree share it, down to those of the
+// goroutines of a `Group()` started within it.
+type bundleTree struct {
+	sync.Mutex
+	events  []Event
+	dropped int
+	failed  int
+
+	// The spans open when the first span of the tree failed
+	snapshot map[uint64][]OpenSpan
+
+	// Set once the top-level span has exited
+	done bool
+}
+
+// The bundles being written, and those written within the last hour
+type bundles struct {
+	sync.Mutex
+	written []time.Time
+
+	pending sync.WaitGroup
+
+	// Serializes the writes
+	writing sync.Mutex
+}
+
+// A bundle to be written
+type bundleJob struct {
+	reason   string
+	traceID  string
+	time     time.Time
+	events   []Event
+	dropped  int
+	snapshot map[uint64][]OpenSpan
+}
+
+// Gives the span the tree it is buffered in, a new one if it is a
+// top-level span
+func (t *Tracer) joinBundle(span *Span, parent *Span) {
+	if within := t.enclosing(span.ev.TID, parent); within != nil && within.ev.bundle != nil {
+		span.ev.bundle = within.ev.bundle
+	} else {
+		span.ev.bundle = &bundleTree{}
+		span.bundleRoot = true
+	}
+}
+
+// Buffers the event of a tree
+func (t *Tracer) holdBundle(ev *Event) {
+	limit := t.options.BundleOnError.MaxEvents
+	if limit <= 0 {
+		limit = DefaultBundleMaxEvents
+	}
+	tree := ev.bundle
+	tree.Lock()
+	defer tree.Unlock()
+	if tree.done {
+		return
+	}
+	if len(tree.events) >= limit {
+		tree.dropped++
+		return
+	}
+	held := *ev
+	if held.Session == "" {
+		held.Session = t.options.SessionID
+	}
+	held.route, held.tail, held.bundle, held.adopted = nil, nil, nil, nil
+	tree.events = append(tree.events, held)
+}
+
+// Counts the exit of a span of a tree, taking the snapshot of the open
+// spans if it is the first to fail. Returns true if it completes the
+// tree, which `endBundle(...)` then writes out if anything failed.
+func (t *Tracer) exitBundle(span *Span, ev *Event) bool {
+	tree := ev.bundle
+	if ev.Err != nil {
+		tree.Lock()
+		first := tree.failed == 0
+		tree.failed++
+		tree.Unlock()
+		if first {
+			snapshot := t.Snapshot()
+			tree.Lock()
+			tree.snapshot = snapshot
+			tree.Unlock()
+		}
+	}
+	return span.bundleRoot
+}
+
+// Writes out the bundle of a completed tree if any of its spans failed,
+// or if it was pinned and "BundlePinned" is set
+func (t *Tracer) endBundle(ev *Event) {
+	tree := ev.bundle
+	tree.Lock()
+	job := &bundleJob{reason: "error", traceID: ev.TraceID, time: ev.Time, events: tree.events, dropped: tree.dropped, snapshot: tree.snapshot}
+	failed := tree.failed
+	tree.events, tree.snapshot, tree.done = nil, nil, true
+	tree.Unlock()
+	pinned := failed == 0 && ev.Pinned && t.options.BundlePinned
+	if pinned {
+		job.reason = "pinned"
+	}
+	if (failed > 0 || pinned) && t.admitBundle(job.time) {
+		t.bundles.pending.Add(1)
+		go t.writeBundle(job)
+	}
+}
+
+// BundleNow writes the bundle of the call tree open on the calling
+// goroutine, as "BundleOnError" does once a tree fails, with what the
+// tree logged so far, the spans open right now and "reason". Returns
+// `ErrNoOpenTree` if "BundleOnError" is not set or no span is open, and
+// `ErrBundleRateLimited` if it would write more than "MaxPerHour" bundles.
+// The bundle is written in the background, see `Flush()`.
+func (t *Tracer) BundleNow(reason string) error {
+	if t.start == nil || t.options.BundleOnError.Dir == "" {
+		return ErrNoOpenTree
+	}
+	span := t.goroutines.innermost(getGID())
+	if span == nil || span.ev.bundle == nil {
+		return ErrNoOpenTree
+	}
+	tree := span.ev.bundle
+	now := t.options.Clock()
+	tree.Lock()
+	job := &bundleJob{reason: reason, traceID: span.ev.TraceID, time: now, events: append([]Event(nil), tree.events...), dropped: tree.dropped}
+	tree.Unlock()
+	if !t.admitBundle(now) {
+		return ErrBundleRateLimited
+	}
+	job.snapshot = t.Snapshot()
+	t.bundles.pending.Add(1)
+	go t.writeBundle(job)
+	return nil
+}
+
+// Returns true if a bundle may be written now, counting it if so
+func (t *Tracer) admitBundle(now time.Time) bool {
+	max := t.options.BundleOnError.MaxPerHour
+	if max == 0 {
+		max = DefaultBundleMaxPerHour
+	}
+	b := &t.bundles
+	b.Lock()
+	defer b.Unlock()
+	recent := b.written[:0]
+	for _, at := range b.written {
+		if now.Sub(at) < time.Hour {
+			recent = append(recent, at)
+		}
+	}
+	b.written = recent
+	if max > 0 && len(recent) >= max {
+		return false
+	}
+	b.written = append(b.written, now)
+	return true
+}
+
+// Writes the bundle into a directory of its own, passing what went wrong
+// to "SinkErrorHandler"
+func (t *Tracer) writeBundle(job *bundleJob) {
+	defer t.bundles.pending.Done()
+	t.bundles.writing.Lock()
+	defer t.bundles.writing.Unlock()
+	if err := t.writeBundleFiles(job); err != nil {
+		err = fmt.Errorf("tracey: writing the bundle of trace %s: %v", job.traceID, err)
+		if handle := t.options.SinkErrorHandler; handle != nil {
+			handle(err)
+			return
+		}
+		warning := "Warning: " + err.Error() + "\n"
+		if t.admitOutput(len(warning)) {
+			t.note(warning)
+		}
+	}
+}
+
+func (t *Tracer) writeBundleFiles(job *bundleJob) error {
+	config := t.options.BundleOnError
+	maxBytes := config.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultBundleMaxBytes
+	}
+
+	tree := renderBundleTree(job.events)
+	var text, events bytes.Buffer
+	events.WriteString("[\n")
+	budget := maxBytes - int64(len(tree))
+	kept := 0
+	buf := getBuffer()
+	defer putBuffer(buf)
+	for i := range job.events {
+		ev := &job.events[i]
+		buf.Reset()
+		t.renderText(buf, ev, false)
+		line := buf.Len()
+		renderJSON(buf, ev)
+		jsonLine := bytes.TrimSuffix(buf.Bytes()[line:], []byte("\n"))
+		if budget -= int64(buf.Len() + 2); budget < 0 {
+			break
+		}
+		text.Write(buf.Bytes()[:line])
+		if kept > 0 {
+			events.WriteString(",\n")
+		}
+		events.Write(jsonLine)
+		kept++
+	}
+	events.WriteString("\n]\n")
+
+	meta := map[string]interface{}{
+		"reason":     job.reason,
+		"trace_id":   job.traceID,
+		"time":       job.time.UTC().Format(time.RFC3339Nano),
+		"session":    t.options.SessionID,
+		"events":     kept,
+		"omitted":    len(job.events) - kept + job.dropped,
+		"open_spans": job.snapshot,
+		"options":    optionSnapshot(&t.options),
+	}
+	if t.build != nil {
+		meta["build"] = json.RawMessage(t.build.json)
+	}
+	metaJSON, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return err
+	}
+	dir := filepath.Join(config.Dir, job.time.UTC().Format("20060102T150405.000Z")+"-"+job.traceID)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return err
+	}
+	for _, file := range [...]struct {
+		name string
+		data []byte
+	}{
+		{"trace.txt", text.Bytes()},
+		{"tree.txt", []byte(tree)},
+		{"events.json", events.Bytes()},
+		{"meta.json", append(metaJSON, '\n')},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file.name), file.data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Renders the spans of a tree, in the order they were entered and
+// indented by depth, with their durations and the share of the top-level
+// span they took, as in "  price  10ms  29%", and "open" for the spans
+// which had not exited
+func renderBundleTree(events []Event) string {
+	exits := make([]Event, 0, len(events))
+	for i := range events {
+		if events[i].Kind == ExitEvent {
+			exits = append(exits, events[i])
+		}
+	}
+	byID := make(map[string]*Event, len(exits))
+	for i := range exits {
+		byID[exits[i].SpanID] = &exits[i]
+	}
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	first := true
+	for i := range events {
+		enter := &events[i]
+		if enter.Kind != EnterEvent {
+			continue
+		}
+		if first {
+			// The shares are of the top-level span, once it has exited
+			if root := byID[enter.SpanID]; root != nil {
+				percentOfRoot(exits, root)
+			}
+			first = false
+		}
+		fmt.Fprintf(tw, "%s%s", strings.Repeat("  ", enter.Depth), enter.Name)
+		exit := byID[enter.SpanID]
+		if exit == nil {
+			fmt.Fprint(tw, "\topen\n")
+			continue
+		}
+		share := ""
+		if exit.HasPercent {
+			share = fmt.Sprintf("%d%%", exit.Percent)
+		}
+		fmt.Fprintf(tw, "\t%s\t%s", formatDuration(exit.Duration), share)
+		if exit.Err != nil {
+			fmt.Fprintf(tw, "\terror: %v", exit.Err)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	lines := strings.SplitAfter(b.String(), "\n")
+	for i, line := range lines {
+		if trimmed := strings.TrimRight(line, " \n"); trimmed != "" {
+			lines[i] = trimmed + "\n"
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// Returns the options which are set to something other than their zero
+// value and which can be written out as JSON, by name
+func optionSnapshot(options *Options) map[string]interface{} {
+	snapshot := make(map[string]interface{})
+	v := reflect.ValueOf(options).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		if !field.IsExported() || value.IsZero() {
+			continue
+		}
+		switch value.Kind() {
+		case reflect.Bool, reflect.String, reflect.Int, reflect.Int64, reflect.Uint64, reflect.Float64:
+			if d, ok := value.Interface().(time.Duration); ok {
+				snapshot[field.Name] = d.String()
+			} else {
+				snapshot[field.Name] = value.Interface()
+			}
+		}
+	}
+	return snapshot
+}
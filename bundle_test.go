@@ -0,0 +1,166 @@
+package tracey
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Reads the files of the bundles written in "dir", by bundle
+func readBundles(test *testing.T, dir string) []map[string]string {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	assert.Nil(test, err)
+	var bundles []map[string]string
+	for _, entry := range entries {
+		files := make(map[string]string)
+		for _, name := range []string{"trace.txt", "tree.txt", "events.json", "meta.json"} {
+			data, err := os.ReadFile(filepath.Join(dir, entry.Name(), name))
+			assert.Nil(test, err)
+			files[name] = string(data)
+		}
+		files["dir"] = entry.Name()
+		bundles = append(bundles, files)
+	}
+	return bundles
+}
+
+func bundleWorkload(t *Tracer, clock *manualClock, fail bool) {
+	checkout := t.StartNamed("checkout")
+	for i := 0; i < 2; i++ {
+		price := t.StartNamed("price")
+		clock.advance(10 * time.Millisecond)
+		if fail && i == 1 {
+			price.SetError(errors.New("declined"))
+		}
+		price.End()
+	}
+	clock.advance(5 * time.Millisecond)
+	checkout.End()
+}
+
+func TestBundleOnError(test *testing.T) {
+	dir := filepath.Join(test.TempDir(), "bundles")
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Writer: &out}},
+		Clock:                 clock.Now,
+		EnableInstrumentation: true,
+		MessageTemplates:      map[string]string{`.`: "$FN"},
+		SessionID:             "2f1c9a7e-session",
+		BundleOnError:         BundleConfig{Dir: dir, MaxPerHour: 1},
+	})
+	// Nothing failed
+	bundleWorkload(t, clock, false)
+	t.Flush()
+	assert.Empty(test, readBundles(test, dir))
+
+	out.Reset()
+	bundleWorkload(t, clock, true)
+	t.Flush()
+	bundles := readBundles(test, dir)
+	assert.Len(test, bundles, 1)
+	b := bundles[0]
+	assert.True(test, strings.HasPrefix(b["dir"], "20200101T000000.050Z-"), b["dir"])
+	// The lines the sinks got
+	assert.Equal(test, out.String(), b["trace.txt"])
+	assert.Equal(test, "checkout  25.0ms  100%\n"+
+		"  price   10.0ms  40%\n"+
+		"  price   10.0ms  40%  error: declined\n", b["tree.txt"])
+
+	var raw []json.RawMessage
+	assert.Nil(test, json.Unmarshal([]byte(b["events.json"]), &raw))
+	assert.Len(test, raw, 6)
+	last, err := UnmarshalEvent(raw[5])
+	assert.Nil(test, err)
+	assert.Equal(test, "checkout", last.Name)
+	assert.Equal(test, 25*time.Millisecond, last.Duration)
+
+	var meta struct {
+		Reason    string                 `json:"reason"`
+		TraceID   string                 `json:"trace_id"`
+		Session   string                 `json:"session"`
+		Events    int                    `json:"events"`
+		Options   map[string]interface{} `json:"options"`
+		OpenSpans map[string][]OpenSpan  `json:"open_spans"`
+	}
+	assert.Nil(test, json.Unmarshal([]byte(b["meta.json"]), &meta))
+	assert.Equal(test, "error", meta.Reason)
+	assert.Equal(test, last.TraceID, meta.TraceID)
+	assert.True(test, strings.HasSuffix(b["dir"], meta.TraceID))
+	assert.Equal(test, "2f1c9a7e-session", meta.Session)
+	assert.Equal(test, 6, meta.Events)
+	assert.Equal(test, true, meta.Options["EnableInstrumentation"])
+	// The top-level span was open when "price" failed
+	for _, open := range meta.OpenSpans {
+		assert.Equal(test, "checkout", open[0].Name)
+	}
+	assert.Len(test, meta.OpenSpans, 1)
+
+	// Rate limited
+	bundleWorkload(t, clock, true)
+	t.Flush()
+	assert.Len(test, readBundles(test, dir), 1)
+	clock.advance(time.Hour)
+	bundleWorkload(t, clock, true)
+	t.Flush()
+	assert.Len(test, readBundles(test, dir), 2)
+}
+
+func TestBundleNow(test *testing.T) {
+	dir := test.TempDir()
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &lockedBuffer{}}}, Clock: clock.Now, BundleOnError: BundleConfig{Dir: dir, MaxPerHour: 1}})
+	assert.Equal(test, ErrNoOpenTree, t.BundleNow("stuck"))
+
+	span := t.StartNamed("checkout")
+	t.StartNamed("price").End()
+	assert.Nil(test, t.BundleNow("stuck"))
+	assert.Equal(test, ErrBundleRateLimited, t.BundleNow("stuck"))
+	span.End()
+	t.Flush()
+
+	bundles := readBundles(test, dir)
+	assert.Len(test, bundles, 1)
+	assert.Contains(test, bundles[0]["meta.json"], `"reason": "stuck"`)
+	assert.Equal(test, "checkout  open\n  price   0s\n", bundles[0]["tree.txt"])
+
+	assert.Equal(test, ErrNoOpenTree, NewTracer(&Options{Sinks: []Sink{{Writer: &lockedBuffer{}}}}).BundleNow("stuck"))
+}
+
+func TestBundleLimits(test *testing.T) {
+	var errs []error
+	blocked := filepath.Join(test.TempDir(), "file")
+	assert.Nil(test, os.WriteFile(blocked, nil, 0o644))
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Writer: &lockedBuffer{}}},
+		Clock:            clock.Now,
+		BundleOnError:    BundleConfig{Dir: filepath.Join(blocked, "bundles"), MaxPerHour: -1},
+		SinkErrorHandler: func(err error) { errs = append(errs, err) },
+	})
+	bundleWorkload(t, clock, true)
+	t.Flush()
+	assert.Len(test, errs, 1)
+
+	// Past "MaxBytes", the later events are left out
+	dir := test.TempDir()
+	t = NewTracer(&Options{Sinks: []Sink{{Writer: &lockedBuffer{}}}, Clock: clock.Now, BundleOnError: BundleConfig{Dir: dir, MaxBytes: 400, MaxEvents: 5}})
+	bundleWorkload(t, clock, true)
+	t.Flush()
+	bundles := readBundles(test, dir)
+	assert.Len(test, bundles, 1)
+	var meta map[string]interface{}
+	assert.Nil(test, json.Unmarshal([]byte(bundles[0]["meta.json"]), &meta))
+	assert.Less(test, meta["events"], 5.0)
+	assert.Equal(test, 6.0, meta["events"].(float64)+meta["omitted"].(float64))
+}
@@ -0,0 +1,99 @@
+package tracey
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCacheSpeedupFactor is how many times faster than the first call
+// the later calls to a function must be for "DetectCaching" to report it,
+// unless "CacheSpeedupFactor" says otherwise.
+const DefaultCacheSpeedupFactor = 10
+
+// How many later calls a function needs before "DetectCaching" looks at it
+const minCachedCalls = 3
+
+// A CacheReport describes a function whose calls look like they are
+// cached, see "DetectCaching".
+type CacheReport struct {
+	Name string
+
+	// How long the first call took, and the median of the later calls
+	// which are sampled
+	First      time.Duration
+	Subsequent time.Duration
+
+	// The calls after the first
+	Calls uint64
+}
+
+// Describes the report, as in "likely cached (first 120.0ms, subsequent
+// ~2.0ms ×340)"
+func (r CacheReport) String() string {
+	return "likely cached (first " + formatDuration(r.First) + ", subsequent ~" + formatDuration(r.Subsequent) + " ×" + strconv.FormatUint(r.Calls, 10) + ")"
+}
+
+// CachingCandidates returns the functions whose calls look like they are
+// cached, sorted by name: those whose later calls took, in the median, at
+// most the first call's duration divided by "CacheSpeedupFactor", with
+// three quarters of them taking at most twice the median, so that a few
+// slow calls among them do not matter. The later calls are those sampled
+// for the percentiles, and there must be at least 3 of them. It returns
+// nil unless "DetectCaching" is set.
+func (t *Tracer) CachingCandidates() []CacheReport {
+	if !t.options.DetectCaching {
+		return nil
+	}
+	factor := t.options.CacheSpeedupFactor
+	if factor <= 0 {
+		factor = DefaultCacheSpeedupFactor
+	}
+	var reports []CacheReport
+	t.stats.funcs.Range(func(name, value interface{}) bool {
+		fs := value.(*funcStats)
+		fs.mu.Lock()
+		first := fs.first
+		later := make([]time.Duration, 0, len(fs.samples))
+		for _, sample := range fs.samples {
+			if sample.seq != first.seq {
+				later = append(later, sample.duration)
+			}
+		}
+		fs.mu.Unlock()
+		if first.seq == 0 || len(later) < minCachedCalls {
+			return true
+		}
+		sort.Slice(later, func(i, j int) bool { return later[i] < later[j] })
+		median := later[(len(later)-1)/2]
+		upper := later[(len(later)*3-1)/4]
+		if float64(median)*factor <= float64(first.duration) && upper <= 2*median {
+			reports = append(reports, CacheReport{name.(string), first.duration, median, atomic.LoadUint64(&fs.calls) - 1})
+		}
+		return true
+	})
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports
+}
+
+// Writes the functions which look cached, as in
+//
+//	main.lookup: likely cached (first 120.0ms, subsequent ~2.0ms ×340)
+func (t *Tracer) dumpCaching(w io.Writer) error {
+	reports := t.CachingCandidates()
+	if len(reports) == 0 {
+		return nil
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return err
+	}
+	for _, r := range reports {
+		if _, err := fmt.Fprintf(w, "%s: %s\n", r.Name, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
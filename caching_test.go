@@ -0,0 +1,83 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Calls the function once for each of the durations
+func callsTaking(t *Tracer, clock *manualClock, name string, durations ...time.Duration) {
+	for _, d := range durations {
+		span := t.StartNamed(name)
+		clock.advance(d)
+		span.End()
+	}
+}
+
+func repeated(d time.Duration, n int) []time.Duration {
+	durations := make([]time.Duration, n)
+	for i := range durations {
+		durations[i] = d
+	}
+	return durations
+}
+
+func TestDetectCaching(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}, Clock: clock.Now, DetectCaching: true})
+	ms := time.Millisecond
+
+	callsTaking(t, clock, "cached", append([]time.Duration{120 * ms}, repeated(2*ms, 340)...)...)
+	// A few slow calls among the fast ones, which a mean would not survive
+	callsTaking(t, clock, "outliers", append([]time.Duration{100 * ms}, 3*ms, 200*ms, 2*ms, 2*ms, 150*ms, 3*ms, 2*ms, 2*ms)...)
+	// Fast, but not ten times as fast
+	callsTaking(t, clock, "warmup", append([]time.Duration{15 * ms}, repeated(2*ms, 10)...)...)
+	// Fast in the median, but all over the place
+	callsTaking(t, clock, "noisy", 100*ms, 1*ms, 2*ms, 9*ms, 1*ms, 8*ms, 9*ms, 2*ms, 7*ms)
+	callsTaking(t, clock, "few", 100*ms, ms, ms)
+	callsTaking(t, clock, "steady", repeated(5*ms, 20)...)
+
+	assert.Equal(test, []CacheReport{
+		{"cached", 120 * ms, 2 * ms, 340},
+		{"outliers", 100 * ms, 2 * ms, 8},
+	}, t.CachingCandidates())
+
+	var dump bytes.Buffer
+	assert.Nil(test, t.DumpStats(&dump))
+	assert.True(test, strings.HasSuffix(dump.String(), "\n\n"+
+		"cached: likely cached (first 120.0ms, subsequent ~2.0ms ×340)\n"+
+		"outliers: likely cached (first 100.0ms, subsequent ~2.0ms ×8)\n"), dump.String())
+
+	t.ResetStats()
+	assert.Empty(test, t.CachingCandidates())
+	assert.Empty(test, t.Stats())
+	// The first call after the reset is the first call
+	callsTaking(t, clock, "cached", repeated(2*ms, 10)...)
+	assert.Empty(test, t.CachingCandidates())
+
+	off := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}, Clock: clock.Now})
+	callsTaking(off, clock, "cached", append([]time.Duration{120 * ms}, repeated(2*ms, 10)...)...)
+	assert.Nil(test, off.CachingCandidates())
+}
+
+func TestResetStats(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}, Clock: clock.Now})
+	callsTaking(t, clock, "work", time.Millisecond, time.Millisecond)
+	mark := t.Mark()
+	callsTaking(t, clock, "work", time.Millisecond)
+	t.ResetStats()
+	callsTaking(t, clock, "work", 2*time.Millisecond)
+
+	stats := t.Stats()
+	assert.Equal(test, uint64(1), stats[0].Calls)
+	assert.Equal(test, 2*time.Millisecond, stats[0].Total)
+	// Of the calls since the mark, only those since the reset are left
+	since := t.StatsSince(mark)
+	assert.Equal(test, uint64(1), since[0].Calls)
+	assert.Equal(test, []time.Duration{2 * time.Millisecond}, since[0].Samples)
+}
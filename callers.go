@@ -0,0 +1,59 @@
+package tracey
+
+import (
+	"path"
+	"runtime"
+	"strings"
+)
+
+// The directory holding tracey's own source files. Frames from the
+// (non-test) files in here are never reported as callers.
+var traceyDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return path.Dir(file)
+}()
+
+// Returns true if the frame belongs to tracey itself, or to the go
+// runtime (runtime.main, runtime.goexit...) which only adds noise.
+func isInternalFrame(frame runtime.Frame) bool {
+	if strings.HasPrefix(frame.Function, "runtime.") {
+		return true
+	}
+	return path.Dir(frame.File) == traceyDir && !strings.HasSuffix(frame.File, "_test.go")
+}
+
+// captureCallers walks the stack of the calling goroutine, skipping over
+// tracey's own frames and the traced function itself, and returns the
+// names of up to "max" callers of the traced function, innermost first.
+func captureCallers(max int, formatter func(string) string) []string {
+	// The traced function itself is also on the stack, leave room for it
+	pcs := make([]uintptr, max+16)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	callers := make([]string, 0, max)
+	foundTraced := false
+	for len(callers) < max {
+		frame, more := frames.Next()
+		if !isInternalFrame(frame) {
+			if foundTraced {
+				callers = append(callers, formatFnName(frame.Function, formatter))
+			}
+			foundTraced = true
+		}
+		if !more {
+			break
+		}
+	}
+	return callers
+}
+
+// formatFnName strips the package path from a fully qualified function
+// name, and runs the result through the "NameFormatter" (if any).
+func formatFnName(name string, formatter func(string) string) string {
+	name = RE_stripFnPreamble.ReplaceAllString(name, "$1")
+	if formatter != nil {
+		name = formatter(name)
+	}
+	return name
+}
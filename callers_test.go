@@ -0,0 +1,70 @@
+package tracey
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper functions - part of "TestCaptureCallers*", the chain of
+// untraced callers is outerCaller -> innerCaller -> tracedCallee
+func outerCaller(trace func(...interface{}) func()) { innerCaller(trace) }
+func innerCaller(trace func(...interface{}) func()) { tracedCallee(trace) }
+func tracedCallee(trace func(...interface{}) func()) {
+	defer trace("callee")()
+}
+
+func TestCaptureCallers(test *testing.T) {
+	ResetTestBuffer()
+	outerCaller(New(&Options{CustomLogger: BufLogger, CaptureCallers: 2}))
+
+	lines := strings.Split(GetTestBuffer(), "\n")
+	assert.True(test, strings.HasSuffix(lines[1], " via go-tracey.innerCaller ← go-tracey.outerCaller"), lines[1])
+	assert.NotContains(test, lines[2], " via ", "callers are only logged on enter")
+}
+
+func TestCaptureCallersSkipsTraceyFrames(test *testing.T) {
+	ResetTestBuffer()
+	outerCaller(New(&Options{CustomLogger: BufLogger, CaptureCallers: 10}))
+
+	lines := strings.Split(GetTestBuffer(), "\n")
+	assert.NotContains(test, lines[1], "go-tracey.New")
+	assert.NotContains(test, lines[1], "runtime.")
+	assert.Contains(test, lines[1], " via go-tracey.innerCaller ← go-tracey.outerCaller ← go-tracey.TestCaptureCallersSkipsTraceyFrames")
+}
+
+func TestCaptureCallersOnlyAtDepthZero(test *testing.T) {
+	ResetTestBuffer()
+	trace := New(&Options{CustomLogger: BufLogger, CaptureCallers: 1})
+	func() {
+		defer trace("outer")()
+		outerCaller(trace)
+	}()
+
+	lines := strings.Split(GetTestBuffer(), "\n")
+	assert.Contains(test, lines[1], " via go-tracey.TestCaptureCallersOnlyAtDepthZero")
+	assert.NotContains(test, lines[2], " via ")
+
+	ResetTestBuffer()
+	trace = New(&Options{CustomLogger: BufLogger, CaptureCallers: 1, CaptureCallersAll: true})
+	func() {
+		defer trace("outer")()
+		outerCaller(trace)
+	}()
+
+	lines = strings.Split(GetTestBuffer(), "\n")
+	assert.Contains(test, lines[2], " via go-tracey.innerCaller")
+}
+
+func TestCaptureCallersNameFormatter(test *testing.T) {
+	ResetTestBuffer()
+	outerCaller(New(&Options{
+		CustomLogger:   BufLogger,
+		CaptureCallers: 2,
+		NameFormatter:  func(name string) string { return strings.TrimPrefix(name, "go-tracey.") },
+	}))
+
+	lines := strings.Split(GetTestBuffer(), "\n")
+	assert.True(test, strings.HasSuffix(lines[1], " via innerCaller ← outerCaller"), lines[1])
+}
@@ -0,0 +1,97 @@
+package tracey
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+)
+
+// Call1 traces a call to "fn" as a span named "name", or after "fn" itself
+// if "name" is empty, and returns its result, as in
+//
+//	n := tracey.Call1(tracer, "countRows", func() int { return db.Count() })
+//
+// Should "fn" panic, the span ends failed with the panic, which then
+// carries on unchanged. Its exit event tells what the panic was and where
+// it started (see "PanicStack"), and the call is counted in the "panic"
+// error class.
+func Call1[T any](t *Tracer, name string, fn func() T) T {
+	span := t.startCall(nil, name, fn)
+	defer span.endCall()
+	return fn()
+}
+
+// Call2 works like `Call1(...)`, for functions with two results.
+func Call2[T, U any](t *Tracer, name string, fn func() (T, U)) (T, U) {
+	span := t.startCall(nil, name, fn)
+	defer span.endCall()
+	return fn()
+}
+
+// CallErr works like `Call1(...)`, for functions which may fail, the span
+// failing along with them, as in
+//
+//	rows, err := tracey.CallErr(tracer, "loadRows", func() ([]Row, error) { return db.Load(ctx) })
+func CallErr[T any](t *Tracer, name string, fn func() (T, error)) (T, error) {
+	span := t.startCall(nil, name, fn)
+	defer span.endCall()
+	result, err := fn()
+	span.SetError(err)
+	return result, err
+}
+
+// Call1Context works like `Call1(...)` for an operation running under
+// "ctx", which "fn" is given, see `StartContext(...)`.
+func Call1Context[T any](ctx context.Context, t *Tracer, name string, fn func(context.Context) T) T {
+	span := t.startCall(ctx, name, fn)
+	defer span.endCall()
+	return fn(ctx)
+}
+
+// Call2Context works like `Call2(...)` for an operation running under
+// "ctx", which "fn" is given, see `StartContext(...)`.
+func Call2Context[T, U any](ctx context.Context, t *Tracer, name string, fn func(context.Context) (T, U)) (T, U) {
+	span := t.startCall(ctx, name, fn)
+	defer span.endCall()
+	return fn(ctx)
+}
+
+// CallErrContext works like `CallErr(...)` for an operation running under
+// "ctx", which "fn" is given, see `StartContext(...)`.
+func CallErrContext[T any](ctx context.Context, t *Tracer, name string, fn func(context.Context) (T, error)) (T, error) {
+	span := t.startCall(ctx, name, fn)
+	defer span.endCall()
+	result, err := fn(ctx)
+	span.SetError(err)
+	return result, err
+}
+
+// Starts the span of a call to "fn", under "ctx" if it is not nil
+func (t *Tracer) startCall(ctx context.Context, name string, fn interface{}) *Span {
+	if t.options.DisableTracing {
+		return noopSpan
+	}
+	if name == "" {
+		name = "<unknown>"
+		if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil {
+			name = t.displayName(f.Name())
+		}
+	}
+	span := t.start(nil, name, nil)
+	if ctx != nil {
+		t.underContext(span, ctx)
+	}
+	return span
+}
+
+// Ends the span of a call, failing it with the panic the call is
+// unwinding from, if any, before letting the panic carry on. Must be
+// deferred.
+func (s *Span) endCall() {
+	if r := recover(); r != nil {
+		s.recordPanic(r)
+		s.End()
+		panic(r)
+	}
+	s.End()
+}
@@ -0,0 +1,63 @@
+package tracey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func countRows() int { return 42 }
+
+func TestCallHelpers(test *testing.T) {
+	var buf bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Logger: log.New(&buf, "", 0)}}})
+
+	assert.Equal(test, 42, Call1(t, "", countRows))
+	name, n := Call2(t, "lookup", func() (string, int) { return "rows", 7 })
+	assert.Equal(test, "rows", name)
+	assert.Equal(test, 7, n)
+	rows, err := CallErr(t, "loadRows", func() ([]string, error) { return nil, errors.New("no rows") })
+	assert.Nil(test, rows)
+	assert.EqualError(test, err, "no rows")
+	rows, err = CallErrContext(context.Background(), t, "", func(ctx context.Context) ([]string, error) {
+		return []string{"a"}, ctx.Err()
+	})
+	assert.Equal(test, []string{"a"}, rows)
+	assert.Nil(test, err)
+
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(buf.String(), "=>")), "\n")
+	assert.Equal(test, 8, len(lines))
+	assert.Equal(test, "[ 0]ENTER: =>go-tracey.countRows", lines[0])
+	assert.Equal(test, "[ 0]ENTER: =>lookup", lines[2])
+	assert.Equal(test, "[ 0]EXIT:  =>loadRows (error: no rows)", lines[5])
+	assert.Equal(test, "[ 0]ENTER: =>go-tracey.TestCallHelpers.func3", lines[6])
+}
+
+func TestCallPanics(test *testing.T) {
+	var buf bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Logger: log.New(&buf, "", 0)}}})
+
+	func() {
+		defer t.Enter("%s", "outer")()
+		assert.PanicsWithValue(test, "corrupt page", func() {
+			Call1Context(context.Background(), t, "readPage", func(context.Context) int { panic("corrupt page") })
+		})
+		t.Start("%s", "after").End()
+	}()
+
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(buf.String(), "=>")), "\n")
+	assert.Equal(test, []string{
+		"[ 0]ENTER: =>outer",
+		"[ 1]  ENTER: =>readPage",
+		"[ 1]  EXIT:  =>readPage (error: panicked: corrupt page) panic at calls_test.go:48 (TestCallPanics.func1.1.1)",
+		"[ 1]  ENTER: =>after",
+		"[ 1]  EXIT:  =>after",
+		"[ 0]EXIT:  =>outer",
+	}, lines)
+	assert.Equal(test, 0, t.goroutineCount())
+}
@@ -0,0 +1,125 @@
+package tracey
+
+import (
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+// What a span entered from a given program counter needs to know of its
+// function, resolved the first time around. Names never change for the
+// life of the tracer, and the decisions made from them only when the
+// options are updated, so that further spans from the same callsite take
+// a couple of loads rather than symbolizing the stack and running the
+// name through regexes.
+type callsite struct {
+	// Set if the program counter belongs to tracey itself or to the
+	// runtime, in which case the rest is unset
+	internal bool
+
+	name    string
+	decided atomic.Pointer[siteDecisions]
+
+	// Where the function is traced from, and its signature once it was
+	// read, see "CaptureSource"
+	file      string
+	line      int
+	signature atomic.Pointer[string]
+
+	// The callsite standing for this one in the tracer which adopted the
+	// tracer, and for those, the adoption, see `Adopt(...)`
+	adopted  atomic.Pointer[callsite]
+	adoption *adoption
+}
+
+// The decisions made from the name of a callsite, under a given set of
+// mutable options
+type siteDecisions struct {
+	config     *mutableConfig
+	template   *messageTemplate
+	suppresses bool
+	function   *functionOverride
+	excluded   bool
+}
+
+// Returns the callsite of the traced function, that of the first frame on
+// the calling goroutine's stack which is not tracey's own
+func (t *Tracer) callerSite() *callsite {
+	var pcs [16]uintptr
+	n := runtime.Callers(2, pcs[:])
+	for _, pc := range pcs[:n] {
+		if site := t.callsite(pc); !site.internal {
+			return site
+		}
+	}
+	return t.namedSite("<unknown>")
+}
+
+// The callsites are cached per tracer, since "NameFormatter", "NameMap"
+// and the names matched by the options differ between tracers
+func (t *Tracer) callsite(pc uintptr) *callsite {
+	if found, ok := t.callsites.Load(pc); ok {
+		return found.(*callsite)
+	}
+	site := &callsite{internal: true}
+	// Inlined calls expand into several frames, the innermost first
+	frames := runtime.CallersFrames([]uintptr{pc})
+	for {
+		frame, more := frames.Next()
+		if !isInternalFrame(frame) {
+			name := t.displayName(frame.Function)
+			if name == "" {
+				name = frame.File + strconv.Itoa(frame.Line)
+			}
+			site = t.namedSite(name)
+			site.file, site.line = frame.File, frame.Line
+			break
+		}
+		if !more {
+			break
+		}
+	}
+	found, loaded := t.callsites.LoadOrStore(pc, site)
+	if !loaded && t.sources != nil && site.file != "" {
+		t.sources.resolve(site)
+	}
+	return found.(*callsite)
+}
+
+func (t *Tracer) namedSite(name string) *callsite {
+	return &callsite{name: name}
+}
+
+// Returns the message template and whether spans of the function suppress
+// those within them
+func (t *Tracer) matchName(config *mutableConfig, site *callsite, name string) (*messageTemplate, bool) {
+	d := t.decide(config, site, name)
+	return d.template, d.suppresses
+}
+
+// Returns the decisions made from the name of the function, from the
+// callsite if there is one and it was decided under the same options
+func (t *Tracer) decide(config *mutableConfig, site *callsite, name string) siteDecisions {
+	if site != nil {
+		if d := site.decided.Load(); d != nil && d.config == config {
+			return *d
+		}
+	}
+	d := siteDecisions{config: config}
+	if config.templates != nil {
+		d.template = config.templates.lookup(name)
+	}
+	d.suppresses = config.suppress != nil && config.suppress.matches(name)
+	if config.functions != nil {
+		d.function = config.functions.lookup(name)
+	}
+	if t.filters != nil {
+		rule := t.filters.lookup(name)
+		d.excluded = rule >= 0 && t.filters.actions[rule] == Exclude
+	}
+	if site != nil {
+		decided := d
+		site.decided.Store(&decided)
+	}
+	return d
+}
@@ -0,0 +1,92 @@
+package tracey
+
+import (
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fetchInvoice(t *Tracer) *Span {
+	span := t.Start()
+	span.End()
+	return span
+}
+
+func TestCallsitesPerTracer(test *testing.T) {
+	plain := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}})
+	upper := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}, NameFormatter: strings.ToUpper})
+	for i := 0; i < 3; i++ {
+		assert.Equal(test, "go-tracey.fetchInvoice", fetchInvoice(plain).ev.Name)
+		assert.Equal(test, "GO-TRACEY.FETCHINVOICE", fetchInvoice(upper).ev.Name)
+	}
+
+	sites := 0
+	plain.callsites.Range(func(_, site interface{}) bool {
+		if !site.(*callsite).internal {
+			sites++
+			assert.Equal(test, "go-tracey.fetchInvoice", site.(*callsite).name)
+		}
+		return true
+	})
+	assert.Equal(test, 1, sites)
+}
+
+func levelledCall(t *Tracer) { defer t.Enter(Debug, "%s", "$FN")() }
+
+func TestCallsitesAfterFilterChange(test *testing.T) {
+	var buf lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &buf}}, MinLevel: Info})
+	levelledCall(t)
+	assert.Empty(test, buf.String())
+
+	// A callsite filtered out once is not filtered out for good
+	t.SetMinLevel(Debug)
+	levelledCall(t)
+	assert.Equal(test, "[ 0]ENTER: DBG =>go-tracey.levelledCall\n"+
+		"[ 0]EXIT:  DBG =>go-tracey.levelledCall\n", RE_tidMarker.ReplaceAllString(buf.String(), "=>"))
+
+	// The decisions cached for the callsite are made again once the
+	// options they were made under are updated
+	buf.Reset()
+	assert.Nil(test, t.Update(func(o *MutableOptions) {
+		o.MessageTemplates = map[string]string{`levelledCall$`: "$FN (templated)"}
+	}))
+	levelledCall(t)
+	assert.Equal(test, "[ 0]ENTER: DBG go-tracey.levelledCall (templated)\n"+
+		"[ 0]EXIT:  DBG go-tracey.levelledCall (templated)\n", RE_tidMarker.ReplaceAllString(buf.String(), "=>"))
+	assert.Nil(test, t.Update(func(o *MutableOptions) { o.MessageTemplates = nil }))
+	buf.Reset()
+	levelledCall(t)
+	assert.Contains(test, buf.String(), "=>go-tracey.levelledCall\n")
+}
+
+func BenchmarkCallerName(b *testing.B) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard, MinDuration: time.Hour}}})
+	b.Run("symbolized", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pcs := make([]uintptr, 16)
+			frames := runtime.CallersFrames(pcs[:runtime.Callers(1, pcs)])
+			for {
+				frame, more := frames.Next()
+				if !isInternalFrame(frame) {
+					formatFnName(frame.Function, nil)
+					break
+				}
+				if !more {
+					break
+				}
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			t.callerSite()
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package tracey
+
+import "sync/atomic"
+
+// What the enter line of a span written at the indentation of its parent
+// starts with, and what the enter line of the second span within a parent
+// ends with, see "CompressLinearChains"
+const (
+	chainMarker   = "└→"
+	chainExpanded = " (chain expanded)"
+)
+
+// Places the span within the chain of its parent, for
+// "CompressLinearChains": the first span within a parent is written at the
+// parent's indentation, the others one level deeper than it
+func (t *Tracer) enterChain(span *Span, gid uint64, parent *Span) {
+	within := t.enclosing(gid, parent)
+	if within == nil {
+		return
+	}
+	ev := &span.ev
+	ev.collapsed = within.ev.collapsed
+	switch atomic.AddInt32(&within.children, 1) {
+	case 1:
+		ev.collapsed++
+		ev.chained = true
+	case 2:
+		ev.expanded = true
+	}
+}
@@ -0,0 +1,108 @@
+package tracey
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Traces a chain of calls "depth" deep, whose call at "branch" makes two
+// more calls after the chain
+func traceChain(t *Tracer, level, depth, branch int) {
+	defer t.Enter("f%d", level)()
+	if level+1 < depth {
+		traceChain(t, level+1, depth, branch)
+	}
+	if level == branch {
+		t.Enter("%s", "g1")()
+		t.Enter("%s", "g2")()
+	}
+}
+
+func TestCompressLinearChains(test *testing.T) {
+	var out bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                []Sink{{Writer: &out}},
+		CompressLinearChains: true,
+		MessageTemplates:     map[string]string{`.`: "$MSG"},
+	})
+	traceChain(t, 0, 10, -1)
+	assert.Equal(test, "[ 0]ENTER: f0\n"+
+		"[ 1]└→ENTER: f1\n"+
+		"[ 2]└→ENTER: f2\n"+
+		"[ 3]└→ENTER: f3\n"+
+		"[ 4]└→ENTER: f4\n"+
+		"[ 5]└→ENTER: f5\n"+
+		"[ 6]└→ENTER: f6\n"+
+		"[ 7]└→ENTER: f7\n"+
+		"[ 8]└→ENTER: f8\n"+
+		"[ 9]└→ENTER: f9\n"+
+		"[ 9]EXIT:  f9\n"+
+		"[ 8]EXIT:  f8\n"+
+		"[ 7]EXIT:  f7\n"+
+		"[ 6]EXIT:  f6\n"+
+		"[ 5]EXIT:  f5\n"+
+		"[ 4]EXIT:  f4\n"+
+		"[ 3]EXIT:  f3\n"+
+		"[ 2]EXIT:  f2\n"+
+		"[ 1]EXIT:  f1\n"+
+		"[ 0]EXIT:  f0\n", out.String())
+
+	out.Reset()
+	traceChain(t, 0, 8, 6)
+	assert.Equal(test, "[ 0]ENTER: f0\n"+
+		"[ 1]└→ENTER: f1\n"+
+		"[ 2]└→ENTER: f2\n"+
+		"[ 3]└→ENTER: f3\n"+
+		"[ 4]└→ENTER: f4\n"+
+		"[ 5]└→ENTER: f5\n"+
+		"[ 6]└→ENTER: f6\n"+
+		"[ 7]└→ENTER: f7\n"+
+		"[ 7]EXIT:  f7\n"+
+		"[ 7]  ENTER: g1 (chain expanded)\n"+
+		"[ 7]  EXIT:  g1\n"+
+		"[ 7]  ENTER: g2\n"+
+		"[ 7]  EXIT:  g2\n"+
+		"[ 6]EXIT:  f6\n"+
+		"[ 5]EXIT:  f5\n"+
+		"[ 4]EXIT:  f4\n"+
+		"[ 3]EXIT:  f3\n"+
+		"[ 2]EXIT:  f2\n"+
+		"[ 1]EXIT:  f1\n"+
+		"[ 0]EXIT:  f0\n", out.String())
+
+	// The rest of tracey goes by the true depth
+	for line, want := range map[string]Line{
+		"[ 7]└→ENTER: [tid:1]=>f7":                  {Kind: EnterEvent, Depth: 7, TID: 1, Message: "f7"},
+		"[ 7]  ENTER: [tid:1]=>g1 (chain expanded)": {Kind: EnterEvent, Depth: 7, TID: 1, Message: "g1"},
+		"[ 6]EXIT:  [tid:1]=>f6":                    {Kind: ExitEvent, Depth: 6, TID: 1, Message: "f6"},
+	} {
+		l, err := ParseLine(line, &Options{CompressLinearChains: true})
+		assert.Nil(test, err)
+		assert.Equal(test, want, l)
+	}
+}
+
+func TestCompressLinearChainsEvents(test *testing.T) {
+	var out bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                []Sink{{Writer: &out}},
+		CompressLinearChains: true,
+		MessageTemplates:     map[string]string{`.`: "$MSG"},
+		Clock:                fakeClock(time.Millisecond),
+	})
+	func() {
+		defer t.Enter("%s", "outer")()
+		func() {
+			defer t.Enter("%s", "inner")()
+			t.Event("milestone")
+		}()
+	}()
+	assert.Equal(test, "[ 0]ENTER: outer\n"+
+		"[ 1]└→ENTER: inner\n"+
+		"[ 2]  · milestone (at +1.0ms)\n"+
+		"[ 1]EXIT:  inner\n"+
+		"[ 0]EXIT:  outer\n", out.String())
+}
@@ -0,0 +1,212 @@
+package tracey
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+)
+
+// DefaultChangeMemorySize is how many functions "HighlightChanges"
+// remembers the last call of, unless "ChangeMemorySize" says otherwise.
+const DefaultChangeMemorySize = 256
+
+// How many calls "SkipUnchanged" skips in a row before logging a summary
+const unchangedSummaryEvery = 100
+
+// How the tags of an exit changed since the last call to its function
+type tagChanges struct {
+	// For each tag of the exit, whether it changed or was added, and the
+	// value it changed from
+	marks  []tagMark
+	before []string
+
+	// The keys the last call had which this one has not
+	removed []string
+}
+
+type tagMark byte
+
+const (
+	tagSame tagMark = iota
+	tagChanged
+	tagAdded
+)
+
+// The last call to a function, as remembered by "HighlightChanges"
+type lastCall struct {
+	name    string
+	message string
+	keys    []string
+	values  []string
+
+	// The calls skipped in a row since, see "SkipUnchanged", and the depth
+	// of the last of them
+	unchanged int
+	depth     int
+}
+
+// The last calls to the most recently called functions, along with the
+// enters withheld by "SkipUnchanged" on each goroutine
+type changeMemory struct {
+	sync.Mutex
+	size   int
+	recent *list.List
+	byName map[string]*list.Element
+
+	held map[uint64]*Event
+}
+
+func newChangeMemory(size int) *changeMemory {
+	if size <= 0 {
+		size = DefaultChangeMemorySize
+	}
+	return &changeMemory{
+		size:   size,
+		recent: list.New(),
+		byName: make(map[string]*list.Element),
+		held:   make(map[uint64]*Event),
+	}
+}
+
+// Compares the exit with the last call to its function, noting on it how
+// its tags changed, and remembers it in its place
+func (t *Tracer) compareCall(ev *Event) {
+	keys := make([]string, len(ev.Tags))
+	values := make([]string, len(ev.Tags))
+	for i, tag := range ev.Tags {
+		keys[i], values[i] = tag.Key, ev.tagValue(i)
+	}
+
+	m := t.changes
+	m.Lock()
+	defer m.Unlock()
+	elem := m.byName[ev.Name]
+	if elem == nil {
+		elem = m.recent.PushFront(&lastCall{name: ev.Name})
+		m.byName[ev.Name] = elem
+		if m.recent.Len() > m.size {
+			oldest := m.recent.Back()
+			m.recent.Remove(oldest)
+			delete(m.byName, oldest.Value.(*lastCall).name)
+		}
+		last := elem.Value.(*lastCall)
+		last.message, last.keys, last.values = ev.Message, keys, values
+		return
+	}
+	m.recent.MoveToFront(elem)
+	last := elem.Value.(*lastCall)
+
+	changes := &tagChanges{marks: make([]tagMark, len(keys)), before: make([]string, len(keys))}
+	unchanged := ev.Message == last.message
+	for i, key := range keys {
+		j := indexOf(last.keys, key)
+		switch {
+		case j < 0:
+			changes.marks[i] = tagAdded
+			unchanged = false
+		case last.values[j] != values[i]:
+			changes.marks[i], changes.before[i] = tagChanged, last.values[j]
+			unchanged = false
+		}
+	}
+	for _, key := range last.keys {
+		if indexOf(keys, key) < 0 {
+			changes.removed = append(changes.removed, key)
+			unchanged = false
+		}
+	}
+	ev.changes, ev.unchanged = changes, unchanged
+	last.message, last.keys, last.values = ev.Message, keys, values
+}
+
+func indexOf(keys []string, key string) int {
+	for i, k := range keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Called with every event before it is emitted when "SkipUnchanged" is
+// set, returns true if the event was withheld or skipped. The enters of
+// functions which were called before are withheld until the next event
+// on their goroutine: if it is their exit, and the call was unchanged,
+// both are skipped.
+func (t *Tracer) holdUnchanged(ev *Event) bool {
+	m := t.changes
+	m.Lock()
+	held := m.held[ev.TID]
+	var released *lastCall
+	if held != nil {
+		delete(m.held, ev.TID)
+		if elem := m.byName[held.Name]; elem != nil {
+			last := elem.Value.(*lastCall)
+			if ev.Kind == ExitEvent && ev.SpanID == held.SpanID && ev.unchanged {
+				last.unchanged++
+				last.depth = ev.Depth
+				var summary lastCall
+				if last.unchanged >= unchangedSummaryEvery {
+					summary = *last
+					last.unchanged = 0
+				}
+				m.Unlock()
+				t.summarizeUnchanged(summary)
+				return true
+			}
+			if last.unchanged > 0 {
+				summary := *last
+				released = &summary
+				last.unchanged = 0
+			}
+		}
+	}
+	_, known := m.byName[ev.Name]
+	hold := ev.Kind == EnterEvent && known
+	if hold {
+		withheld := *ev
+		withheld.emitter = 0
+		m.held[ev.TID] = &withheld
+	}
+	m.Unlock()
+
+	if held != nil {
+		if released != nil {
+			t.summarizeUnchanged(*released)
+		}
+		t.emitCollapsed(held)
+	}
+	return hold
+}
+
+// Logs how many calls in a row were skipped, if any, as in
+// "(unchanged ×42) main.poll"
+func (t *Tracer) summarizeUnchanged(last lastCall) {
+	if last.unchanged == 0 {
+		return
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	t.renderIndent(buf, last.depth)
+	buf.WriteString("(unchanged ×")
+	buf.WriteString(strconv.Itoa(last.unchanged))
+	buf.WriteString(") ")
+	buf.WriteString(last.name)
+	buf.WriteByte('\n')
+	if t.admitOutput(buf.Len()) {
+		t.note(buf.String())
+	}
+}
+
+// Takes the runs of skipped calls of every function, most recently called
+// first. Must be called with the lock held.
+func (m *changeMemory) takeStreaks() []lastCall {
+	var streaks []lastCall
+	for elem := m.recent.Front(); elem != nil; elem = elem.Next() {
+		if last := elem.Value.(*lastCall); last.unchanged > 0 {
+			streaks = append(streaks, *last)
+			last.unchanged = 0
+		}
+	}
+	return streaks
+}
@@ -0,0 +1,127 @@
+package tracey
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func reconcile(t *Tracer, tags ...Tag) {
+	span := t.Start("%s", "reconcile")
+	for _, tag := range tags {
+		span.Tag(tag.Key, tag.Value)
+	}
+	span.End()
+}
+
+func TestHighlightChanges(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, HighlightChanges: true})
+
+	reconcile(t, Tag{"rows", 120}, Tag{"retry", true})
+	reconcile(t, Tag{"rows", 135}, Tag{"cached", true})
+	reconcile(t, Tag{"rows", 135}, Tag{"cached", true})
+	reconcile(t)
+	assert.Equal(test, `
+[ 0]ENTER: =>reconcile
+[ 0]EXIT:  =>reconcile {rows=120 retry=true}
+[ 0]ENTER: =>reconcile
+[ 0]EXIT:  =>reconcile {rows=120→135 +cached=true -retry}
+[ 0]ENTER: =>reconcile
+[ 0]EXIT:  =>reconcile {rows=135 cached=true}
+[ 0]ENTER: =>reconcile
+[ 0]EXIT:  =>reconcile {-rows -cached}
+`, maskedTestBuffer())
+}
+
+// Rendered the same whatever the pointer
+type replicaSet struct{ ready int }
+
+func TestHighlightChangesWithValueRenderer(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{
+		CustomLogger:     BufLogger,
+		HighlightChanges: true,
+		ValueRenderer: func(v interface{}) (string, bool) {
+			if rs, ok := v.(*replicaSet); ok {
+				return "ready:" + string(rune('0'+rs.ready)), true
+			}
+			return "", false
+		},
+	})
+	reconcile(t, Tag{"rs", &replicaSet{1}})
+	reconcile(t, Tag{"rs", &replicaSet{1}})
+	reconcile(t, Tag{"rs", &replicaSet{2}})
+	assert.Equal(test, `
+[ 0]ENTER: =>reconcile
+[ 0]EXIT:  =>reconcile {rs=ready:1}
+[ 0]ENTER: =>reconcile
+[ 0]EXIT:  =>reconcile {rs=ready:1}
+[ 0]ENTER: =>reconcile
+[ 0]EXIT:  =>reconcile {rs=ready:1→ready:2}
+`, maskedTestBuffer())
+}
+
+func fetchRows(t *Tracer) {
+	defer t.Enter("%s", "fetch")()
+}
+
+func TestSkipUnchanged(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, HighlightChanges: true, SkipUnchanged: true})
+
+	poll := func(rows int, nested bool) {
+		span := t.Start("%s", "poll")
+		if nested {
+			fetchRows(t)
+		}
+		span.Tag("rows", rows)
+		span.End()
+	}
+	poll(1, false)
+	poll(1, false)
+	poll(1, false)
+	poll(1, false)
+	poll(2, false)
+	// Calls with something traced inside them are logged regardless
+	poll(2, true)
+	poll(2, false)
+	t.Flush()
+	assert.Equal(test, `
+[ 0]ENTER: =>poll
+[ 0]EXIT:  =>poll {rows=1}
+[ 0](unchanged ×3) go-tracey.TestSkipUnchanged.func1
+[ 0]ENTER: =>poll
+[ 0]EXIT:  =>poll {rows=1→2}
+[ 0]ENTER: =>poll
+[ 1]  ENTER: =>fetch
+[ 1]  EXIT:  =>fetch
+[ 0]EXIT:  =>poll {rows=2}
+[ 0](unchanged ×1) go-tracey.TestSkipUnchanged.func1
+`, maskedTestBuffer())
+}
+
+func TestSkipUnchangedSummaryEvery(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, HighlightChanges: true, SkipUnchanged: true, DisableDepthValue: true})
+	for i := 0; i < 1+unchangedSummaryEvery+5; i++ {
+		t.Enter("%s", "tick")()
+	}
+	assert.Equal(test, "\nENTER: =>tick\nEXIT:  =>tick\n(unchanged ×100) go-tracey.TestSkipUnchangedSummaryEvery\n", maskedTestBuffer())
+	t.Flush()
+	assert.Contains(test, maskedTestBuffer(), "(unchanged ×5)")
+}
+
+func TestChangeMemoryIsBounded(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, HighlightChanges: true, ChangeMemorySize: 1})
+	a := func(v int) { span := t.Start(); span.Tag("v", v); span.End() }
+	b := func(v int) { span := t.Start(); span.Tag("v", v); span.End() }
+	a(1)
+	b(1)
+	a(2)
+	assert.NotContains(test, GetTestBuffer(), "→")
+	a(3)
+	assert.Contains(test, GetTestBuffer(), "{v=2→3}")
+	assert.Equal(test, 1, t.changes.recent.Len())
+}
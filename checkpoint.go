@@ -0,0 +1,56 @@
+package tracey
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// A Checkpoint marks the end of a phase of a span, as recorded by
+// `Span.Checkpoint(...)`.
+type Checkpoint struct {
+	Name string
+
+	// The time since the span was entered, and since the previous
+	// checkpoint (or since the span was entered, for the first one)
+	Offset time.Duration
+	Delta  time.Duration
+}
+
+// Checkpoint marks the end of a phase of the span, such as "parse", so
+// that its exit lists how long each phase took. See "ShowCheckpoints" and
+// "CheckpointSummary". Checkpoints after the span has ended are ignored.
+func (s *Span) Checkpoint(name string) {
+	if s.t == nil {
+		return
+	}
+	s.t.checkpoint(s, name)
+}
+
+func (t *Tracer) checkpoint(s *Span, name string) {
+	if atomic.LoadUint32(&s.ended) != 0 {
+		if t.options.WarnLateCheckpoints && !s.muted {
+			warning := "Warning: checkpoint " + strconv.Quote(name) + " of " + s.ev.Name + " after the span ended in tracey.\n"
+			if t.admitOutput(len(warning)) {
+				t.note(warning)
+			}
+		}
+		return
+	}
+	if s.muted {
+		return
+	}
+	now := t.options.Clock()
+	cp := Checkpoint{Name: name, Offset: now.Sub(s.ev.Time) + s.carried}
+	cp.Delta = cp.Offset
+	if n := len(s.ev.Checkpoints); n > 0 {
+		cp.Delta -= s.ev.Checkpoints[n-1].Offset
+	}
+	s.ev.Checkpoints = append(s.ev.Checkpoints, cp)
+	if t.options.ShowCheckpoints {
+		printed := cp
+		ev := Event{Kind: PointEvent, Time: now, TID: s.ev.TID, Message: name, checkpoint: &printed}
+		t.within(&ev, s)
+		t.emitPoint(&ev)
+	}
+}
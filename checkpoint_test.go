@@ -0,0 +1,95 @@
+package tracey
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoints(test *testing.T) {
+	var text, js bytes.Buffer
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var exits []Event
+	t := NewTracer(&Options{
+		Sinks: []Sink{
+			{Logger: log.New(&text, "", 0)},
+			{Writer: &js, Format: JSONFormat},
+		},
+		Clock:             func() time.Time { return now },
+		ShowCheckpoints:   true,
+		CheckpointSummary: true,
+	})
+
+	span := t.Start("%s", "load")
+	now = now.Add(12 * time.Millisecond)
+	span.Checkpoint("parse")
+	now = now.Add(3 * time.Millisecond)
+	span.Checkpoint("validate")
+	now = now.Add(40 * time.Millisecond)
+	span.Checkpoint("write")
+	now = now.Add(time.Millisecond)
+	span.End()
+	t.Enter("%s", "none")()
+
+	assert.Equal(test, []string{
+		"[ 0]ENTER: =>load",
+		"[ 1]  ✓ parse done (+12.0ms)",
+		"[ 1]  ✓ validate done (+3.0ms)",
+		"[ 1]  ✓ write done (+40.0ms)",
+		"[ 0]EXIT:  =>load [parse 12.0ms | validate 3.0ms | write 40.0ms]",
+		"[ 0]ENTER: =>none",
+		"[ 0]EXIT:  =>none",
+	}, strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(text.String(), "$1=>")), "\n"))
+
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		if ev.Kind == ExitEvent {
+			exits = append(exits, ev)
+		}
+	}
+	assert.Len(test, exits, 2)
+	assert.Equal(test, []Checkpoint{
+		{"parse", 12 * time.Millisecond, 12 * time.Millisecond},
+		{"validate", 15 * time.Millisecond, 3 * time.Millisecond},
+		{"write", 55 * time.Millisecond, 40 * time.Millisecond},
+	}, exits[0].Checkpoints)
+	assert.Equal(test, 56*time.Millisecond, exits[0].Duration)
+	assert.Empty(test, exits[1].Checkpoints)
+}
+
+func TestLateCheckpoints(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, CheckpointSummary: true})
+	span := t.Start("%s", "done")
+	span.End()
+	span.Checkpoint("late")
+	assert.Equal(test, "\n[ 0]ENTER: =>done\n[ 0]EXIT:  =>done\n", maskedTestBuffer())
+
+	ResetTestBuffer()
+	t = NewTracer(&Options{CustomLogger: BufLogger, WarnLateCheckpoints: true})
+	span = t.Start("%s", "done")
+	span.End()
+	span.Checkpoint("late")
+	assert.Contains(test, GetTestBuffer(), "Warning: checkpoint \"late\" of "+span.ev.Name+" after the span ended in tracey.\n")
+
+	// No-op spans take checkpoints too
+	NewTracer(&Options{DisableTracing: true}).Start().Checkpoint("nothing")
+}
+
+func BenchmarkCheckpoint(b *testing.B) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		span := t.Start("%s", "phases")
+		span.Checkpoint("one")
+		span.Checkpoint("two")
+		span.Checkpoint("three")
+		span.End()
+	}
+}
@@ -0,0 +1,30 @@
+package tracey
+
+import "time"
+
+// Setting "ClockResolutionFloor" to `DetectClockResolution` has
+// `NewTracer(...)` measure the resolution of the tracer's clock.
+const DetectClockResolution time.Duration = -1
+
+// How many times the clock is read at most while waiting for it to tick
+const clockSamples = 1 << 20
+
+// Measures the resolution of a clock, as the size of its next tick.
+// Returns 0 if the clock did not tick at all, as frozen fake clocks do.
+func detectClockResolution(clock func() time.Time) time.Duration {
+	start := clock()
+	for i := 0; i < clockSamples; i++ {
+		if d := clock().Sub(start); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// Raises a duration below the clock's resolution to it, marking it as
+// approximate
+func (t *Tracer) floorDuration(ev *Event) {
+	if floor := t.options.ClockResolutionFloor; floor > 0 && ev.Duration < floor {
+		ev.Duration, ev.Approximate = floor, true
+	}
+}
@@ -0,0 +1,96 @@
+package tracey
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockResolutionFloor(test *testing.T) {
+	var buf, slow bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks: []Sink{
+			{Logger: log.New(&buf, "", 0)},
+			{Writer: &slow, MinDuration: 10 * time.Millisecond},
+		},
+		EnableInstrumentation: true,
+		Clock:                 clock.Now,
+		ClockResolutionFloor:  15600 * time.Microsecond,
+	})
+
+	t.Start("%s", "tick").End()
+	span := t.Start("%s", "slow")
+	clock.advance(31200 * time.Microsecond)
+	span.End()
+
+	assert.Equal(test, "[ 0]ENTER: =>tick\n"+
+		"[ 0]EXIT:  =>tick ... in <15.6ms\n"+
+		"[ 0]ENTER: =>slow\n"+
+		"[ 0]EXIT:  =>slow ... in 31.2ms\n", RE_tidMarker.ReplaceAllString(buf.String(), "=>"))
+	// A floor above the threshold passes it, as the call may have been
+	// that long
+	assert.Contains(test, slow.String(), "tick ... in <15.6ms")
+
+	stats := t.Stats()
+	assert.Equal(test, 1, len(stats))
+	assert.Equal(test, uint64(2), stats[0].Calls)
+	assert.Equal(test, uint64(1), stats[0].Approximate)
+	assert.Equal(test, 46800*time.Microsecond, stats[0].Total)
+}
+
+func TestExcludeApproximateStats(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:                   []Sink{{Writer: &bytes.Buffer{}}},
+		Clock:                   clock.Now,
+		ClockResolutionFloor:    time.Millisecond,
+		ExcludeApproximateStats: true,
+	})
+	work := func(d time.Duration) {
+		defer t.Enter("%s", "work")()
+		clock.advance(d)
+	}
+	mark := t.Mark()
+	for i := 0; i < 3; i++ {
+		work(0)
+	}
+	work(4 * time.Millisecond)
+
+	stats := t.StatsSince(mark)
+	assert.Equal(test, 1, len(stats))
+	assert.Equal(test, uint64(4), stats[0].Calls)
+	assert.Equal(test, uint64(3), stats[0].Approximate)
+	assert.Equal(test, 4*time.Millisecond, stats[0].Total)
+	assert.Equal(test, 4*time.Millisecond, stats[0].Mean())
+	assert.Equal(test, []time.Duration{4 * time.Millisecond}, stats[0].Samples)
+}
+
+func TestApproximateEncodings(test *testing.T) {
+	ev := Event{Kind: ExitEvent, Time: time.Unix(0, 1), Name: "f", Duration: time.Millisecond, Approximate: true}
+	var buf bytes.Buffer
+	renderJSON(&buf, &ev)
+	assert.Contains(test, buf.String(), `"approx":true`)
+	decoded, err := UnmarshalEvent(buf.Bytes())
+	assert.Nil(test, err)
+	assert.True(test, decoded.Approximate)
+
+	buf.Reset()
+	renderBinary(&buf, &ev)
+	decoded, ok := decodeBinary(buf.Bytes())
+	assert.True(test, ok)
+	assert.True(test, decoded.Approximate)
+}
+
+func TestDetectClockResolution(test *testing.T) {
+	assert.Equal(test, 15*time.Millisecond, detectClockResolution(fakeClock(15*time.Millisecond)))
+
+	frozen := time.Now()
+	assert.Equal(test, time.Duration(0), detectClockResolution(func() time.Time { return frozen }))
+
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}, Clock: fakeClock(time.Second), ClockResolutionFloor: DetectClockResolution})
+	assert.Equal(test, time.Second, t.options.ClockResolutionFloor)
+}
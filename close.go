@@ -0,0 +1,143 @@
+package tracey
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often `CloseGraceful(...)` checks whether the open trees finished
+const drainPoll = 10 * time.Millisecond
+
+// The draining of the open trees on close, see "CloseTimeout"
+type closer struct {
+	// Held while draining, so that concurrent calls to `Close()` wait
+	sync.Mutex
+	drained bool
+
+	// Set from the start of the drain on, and the top-level spans refused
+	// since
+	draining uint32
+	rejected uint64
+}
+
+// CloseGraceful closes the tracer the way `Close()` does, once the trees
+// of spans open at the time have finished. It stops accepting new
+// top-level spans first: from then on, spans entered with no span open
+// around them are no-ops (counted as rejected), while the spans entered
+// within the open trees, from any goroutine, are traced as usual. It then
+// waits for the top-level spans which were open to end, for at most
+// "CloseTimeout" if it is set, and until "ctx" is done. The spans still
+// open by then are force-closed the way "AbandonAfter" closes them, with
+// an EXIT line as in "EXIT:  [tid:7]=>main.serve ... in 30s (abandoned at
+// close — forced close)". The tracer logs how the drain went, as in
+// "TRACE CLOSED — 3 trees completed, 1 span force-closed, 2 spans
+// rejected", before everything is flushed. Concurrent calls wait for the
+// first one to drain, and later calls do not drain again. The error is
+// that of "ctx" if it was done before the trees finished, joined with
+// that of `Close()`.
+func (t *Tracer) CloseGraceful(ctx context.Context) error {
+	drained := t.drain(ctx, true)
+	if err := t.Close(); err != nil {
+		return errors.Join(drained, err)
+	}
+	return drained
+}
+
+// Drains the open trees if "drain" is set or "CloseTimeout" is, unless
+// they were drained already. Returns the error of "ctx" if the trees had
+// to be force-closed for it.
+func (t *Tracer) drain(ctx context.Context, drain bool) error {
+	c := &t.closer
+	c.Lock()
+	defer c.Unlock()
+	drain = drain || t.options.CloseTimeout > 0
+	if !drain || c.drained || t.start == nil {
+		return nil
+	}
+	c.drained = true
+	atomic.StoreUint32(&c.draining, 1)
+
+	var trees []*Span
+	t.goroutines.each(func(gid uint64, spans []*Span) {
+		for _, s := range spans {
+			if s.outer == nil && s.ev.Depth == 0 {
+				trees = append(trees, s)
+			}
+		}
+	})
+	sleep := t.options.Sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	var deadline time.Time
+	if t.options.CloseTimeout > 0 {
+		deadline = t.options.Clock().Add(t.options.CloseTimeout)
+	}
+	var err error
+	for !allEnded(trees) {
+		if err = ctx.Err(); err != nil || (!deadline.IsZero() && !t.options.Clock().Before(deadline)) {
+			break
+		}
+		sleep(drainPoll)
+	}
+	if allEnded(trees) {
+		err = nil
+	}
+	forced := t.forceCloseAll()
+	completed := 0
+	for _, s := range trees {
+		if atomic.LoadUint32(&s.ended) == 1 {
+			completed++
+		}
+	}
+
+	report := "TRACE CLOSED — " + countOf(completed, "tree") + " completed, " + countOf(forced, "span") +
+		" force-closed, " + countOf(int(atomic.LoadUint64(&c.rejected)), "span") + " rejected\n"
+	if t.admitOutput(len(report)) {
+		t.note(report)
+	}
+	return err
+}
+
+func allEnded(spans []*Span) bool {
+	for _, s := range spans {
+		if atomic.LoadUint32(&s.ended) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Force-closes every span still open, the innermost ones of each
+// goroutine first, and returns how many it closed
+func (t *Tracer) forceCloseAll() int {
+	var open [][]*Span
+	t.goroutines.each(func(gid uint64, spans []*Span) {
+		open = append(open, append([]*Span(nil), spans...))
+	})
+	forced := 0
+	for _, spans := range open {
+		for i := len(spans) - 1; i >= 0; i-- {
+			if t.abandon(spans[i], true) {
+				forced++
+			}
+		}
+	}
+	return forced
+}
+
+// Returns true if new top-level spans are refused, which a span entered
+// with nothing open around it is, see `CloseGraceful(...)`
+func (t *Tracer) rejects(gid uint64, parent *Span) bool {
+	if atomic.LoadUint32(&t.closer.draining) == 0 {
+		return false
+	}
+	if within := t.enclosing(gid, parent); within != nil && within.ev.Depth >= 0 {
+		return false
+	}
+	atomic.AddUint64(&t.closer.rejected, 1)
+	return true
+}
@@ -0,0 +1,124 @@
+package tracey
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseDrain(test *testing.T) {
+	var out lockedBuffer
+	var t *Tracer
+	var once sync.Once
+	proceed, done := make(chan struct{}), make(chan struct{})
+	t = NewTracer(&Options{
+		Sinks:        []Sink{{Writer: &out}},
+		Clock:        (&manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}).Now,
+		CloseTimeout: time.Minute,
+		Sleep: func(time.Duration) {
+			once.Do(func() {
+				// New work is refused while draining
+				t.StartNamed("late", "%s", "$FN").End()
+				close(proceed)
+			})
+			time.Sleep(time.Millisecond)
+		},
+	})
+
+	started := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve := t.StartNamed("serve", "%s", "$FN")
+		close(started)
+		<-proceed
+		// Work within the open tree carries on
+		t.StartNamed("cleanup", "%s", "$FN").End()
+		serve.End()
+	}()
+	<-started
+	assert.Nil(test, t.Close())
+	<-done
+	t.StartNamed("after", "%s", "$FN").End()
+
+	assert.Equal(test, "[ 0]ENTER: =>serve\n"+
+		"[ 1]  ENTER: =>cleanup\n"+
+		"[ 1]  EXIT:  =>cleanup\n"+
+		"[ 0]EXIT:  =>serve\n"+
+		"TRACE CLOSED — 1 tree completed, 0 spans force-closed, 1 span rejected\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+}
+
+func TestCloseTimeout(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Writer: &out}},
+		Clock:                 clock.Now,
+		Sleep:                 func(d time.Duration) { clock.advance(d) },
+		EnableInstrumentation: true,
+		CloseTimeout:          30 * time.Second,
+	})
+
+	serve := t.StartNamed("serve", "%s", "$FN")
+	t.StartNamed("wait", "%s", "$FN")
+	assert.Nil(test, t.Close())
+	serve.End()
+
+	assert.Equal(test, "[ 0]ENTER: =>serve\n"+
+		"[ 1]  ENTER: =>wait\n"+
+		"[ 1]  EXIT:  =>wait ... in 30s (abandoned at close — forced close)\n"+
+		"[ 0]EXIT:  =>serve ... in 30s (abandoned at close — forced close)\n"+
+		"TRACE CLOSED — 0 trees completed, 2 spans force-closed, 0 spans rejected\n"+
+		"Warning: late exit for abandoned span serve, ignored\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	assert.Equal(test, uint64(1), t.Stats()[0].Abandoned)
+}
+
+func TestCloseAtDeadline(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var serve *Span
+	t := NewTracer(&Options{
+		Sinks: []Sink{{Writer: &out}},
+		Clock: clock.Now,
+		Sleep: func(d time.Duration) {
+			// The tree ends exactly as the time is up
+			if clock.advance(d).Sub(serve.ev.Time) >= time.Second {
+				serve.End()
+			}
+		},
+		CloseTimeout: time.Second,
+	})
+
+	serve = t.StartNamed("serve", "%s", "$FN")
+	assert.Nil(test, t.Close())
+	assert.Contains(test, out.String(), "TRACE CLOSED — 1 tree completed, 0 spans force-closed, 0 spans rejected\n")
+	assert.NotContains(test, out.String(), "abandoned")
+}
+
+func TestCloseGraceful(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}})
+	span := t.StartNamed("serve", "%s", "$FN")
+
+	// Concurrent calls drain once
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = t.CloseGraceful(ctx)
+		}(i)
+	}
+	wg.Wait()
+	span.End()
+
+	assert.ElementsMatch(test, []error{context.DeadlineExceeded, nil, nil}, errs)
+	assert.Equal(test, 1, strings.Count(out.String(), "TRACE CLOSED"))
+	assert.Contains(test, out.String(), "(abandoned at close — forced close)")
+}
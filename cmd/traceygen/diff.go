@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Renders the changes from "a" to "b" as a unified diff without context.
+// Since traceygen only inserts lines into gofmt'ed files, lines of "a" are
+// matched greedily against the next equal line of "b", anything else is
+// shown as removed and added.
+func diff(name string, a, b []byte) string {
+	old := strings.SplitAfter(string(a), "\n")
+	new := strings.SplitAfter(string(b), "\n")
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", name, name)
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		if i < len(old) && j < len(new) && old[i] == new[j] {
+			i, j = i+1, j+1
+			continue
+		}
+		// Look for the current old line further down, as if the lines in
+		// between had been inserted
+		next := -1
+		if i < len(old) {
+			for k := j; k < len(new); k++ {
+				if new[k] == old[i] {
+					next = k
+					break
+				}
+			}
+		}
+		removed, added := 0, 0
+		if next >= 0 {
+			added = next - j
+		} else if i < len(old) {
+			removed = 1
+			if j < len(new) {
+				added = 1
+			}
+		} else {
+			added = len(new) - j
+		}
+		// Empty ranges start at the line before, as in "-3,0"
+		oldStart, newStart := i+1, j+1
+		if removed == 0 {
+			oldStart--
+		}
+		if added == 0 {
+			newStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", oldStart, removed, newStart, added)
+		for _, line := range old[i : i+removed] {
+			out.WriteString("-" + withNewline(line))
+		}
+		for _, line := range new[j : j+added] {
+			out.WriteString("+" + withNewline(line))
+		}
+		i, j = i+removed, j+added
+	}
+	return out.String()
+}
+
+func withNewline(line string) string {
+	if strings.HasSuffix(line, "\n") {
+		return line
+	}
+	return line + "\n"
+}
@@ -0,0 +1,101 @@
+// Command traceygen adds a tracey call to the start of every function of
+// a package, so that it does not have to be written by hand:
+//
+//	var trace = tracey.New(nil)
+//
+//	//go:generate go run github.com/sujitvp/go-tracey/cmd/traceygen -var trace .
+//
+// inserts `defer trace("$FN")()` as the first statement of every exported
+// function and method which does not already call `trace(...)` that way.
+// Running it again changes nothing. Generated files and tests are skipped.
+//
+// Usage:
+//
+//	traceygen [flags] [dir]
+//
+// where dir is the directory of the package, "." if omitted. The flags are
+//
+//	-var name      the trace function to call, "trace" by default; a
+//	               qualified name such as "obs.Trace" is called from the
+//	               package imported with -import, which is added if missing
+//	-import path   the import path of the package of a qualified -var
+//	-all           also trace unexported functions and methods
+//	-exclude list  comma-separated regexes of the functions to leave as they
+//	               are, matched against "Func" or "Type.Method"
+//	-dry-run       print a diff of the changes instead of writing them
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+func main() {
+	var cfg config
+	var exclude string
+	flag.StringVar(&cfg.traceVar, "var", "trace", "the trace function to call")
+	flag.StringVar(&cfg.importPath, "import", "", "the import path of the package of a qualified -var")
+	flag.BoolVar(&cfg.all, "all", false, "also trace unexported functions and methods")
+	flag.StringVar(&exclude, "exclude", "", "comma-separated regexes of the functions to skip")
+	dryRun := flag.Bool("dry-run", false, "print a diff instead of writing the files")
+	flag.Parse()
+
+	for _, pattern := range strings.Split(exclude, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			fatalf("bad -exclude pattern %q: %v", pattern, err)
+		}
+		cfg.exclude = append(cfg.exclude, re)
+	}
+	if err := cfg.check(); err != nil {
+		fatalf("%v", err)
+	}
+
+	dir := "."
+	if flag.NArg() > 1 {
+		fatalf("expected a single package directory, got %d", flag.NArg())
+	} else if flag.NArg() == 1 {
+		dir = flag.Arg(0)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		fatalf("%v", err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		src, err := os.ReadFile(file)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		out, changed, err := rewrite(file, src, cfg)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if !changed {
+			continue
+		}
+		if *dryRun {
+			os.Stdout.WriteString(diff(file, src, out))
+			continue
+		}
+		if err := os.WriteFile(file, out, 0644); err != nil {
+			fatalf("%v", err)
+		}
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "traceygen: "+format+"\n", args...)
+	os.Exit(1)
+}
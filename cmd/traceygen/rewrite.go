@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What to insert, and where
+type config struct {
+	// The trace function, possibly qualified by the name of the package
+	// imported from "importPath"
+	traceVar   string
+	importPath string
+
+	all     bool
+	exclude []*regexp.Regexp
+}
+
+func (c config) check() error {
+	if c.traceVar == "" {
+		return errors.New("-var must not be empty")
+	}
+	if strings.Contains(c.traceVar, ".") && c.importPath == "" {
+		return errors.New("a qualified -var needs an -import path")
+	}
+	if c.importPath != "" && !strings.Contains(c.traceVar, ".") {
+		return errors.New("-import needs a qualified -var, as in \"pkg.Trace\"")
+	}
+	return nil
+}
+
+// Text to insert at an offset of the source
+type insertion struct {
+	offset int
+	text   string
+}
+
+// Returns the source of the file with the trace call inserted into the
+// functions which need it, and whether there were any. The edits are made
+// to the text rather than to the syntax tree, so that comments stay where
+// they were, and the result is then gofmt'ed.
+func rewrite(filename string, src []byte, cfg config) ([]byte, bool, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, false, err
+	}
+	if ast.IsGenerated(file) {
+		return src, false, nil
+	}
+
+	var insertions []insertion
+	call := "defer " + cfg.traceVar + "(\"$FN\")()"
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil || !cfg.wants(fn) || traced(fn, cfg.traceVar) {
+			continue
+		}
+		insertions = append(insertions, lineAfter(src, fset.Position(fn.Body.Lbrace).Offset+1, call))
+	}
+	if len(insertions) == 0 {
+		return src, false, nil
+	}
+	if cfg.importPath != "" && !imports(file, cfg.importPath) {
+		insertions = append(insertions, importInsertion(src, fset, file, cfg))
+	}
+
+	sort.SliceStable(insertions, func(i, j int) bool { return insertions[i].offset < insertions[j].offset })
+	var buf bytes.Buffer
+	at := 0
+	for _, ins := range insertions {
+		buf.Write(src[at:ins.offset])
+		buf.WriteString(ins.text)
+		at = ins.offset
+	}
+	buf.Write(src[at:])
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// Inserts a line of its own at the offset, which is at the end of a line
+// or in the middle of one
+func lineAfter(src []byte, offset int, line string) insertion {
+	if offset < len(src) && src[offset] == '\n' {
+		return insertion{offset, "\n" + line}
+	}
+	return insertion{offset, "\n" + line + "\n"}
+}
+
+// Returns true if the function should be traced
+func (c config) wants(fn *ast.FuncDecl) bool {
+	if !c.all && !fn.Name.IsExported() {
+		return false
+	}
+	name := funcName(fn)
+	for _, re := range c.exclude {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Names a function as in "Func", or "Type.Method" for methods
+func funcName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return fn.Name.Name
+	}
+	recv := fn.Recv.List[0].Type
+	for {
+		switch t := recv.(type) {
+		case *ast.StarExpr:
+			recv = t.X
+			continue
+		case *ast.IndexExpr:
+			recv = t.X
+			continue
+		case *ast.IndexListExpr:
+			recv = t.X
+			continue
+		}
+		break
+	}
+	return types.ExprString(recv) + "." + fn.Name.Name
+}
+
+// Returns true if the function already has a `defer trace(...)()` statement
+// at its top level
+func traced(fn *ast.FuncDecl, traceVar string) bool {
+	for _, stmt := range fn.Body.List {
+		d, ok := stmt.(*ast.DeferStmt)
+		if !ok {
+			continue
+		}
+		if inner, ok := d.Call.Fun.(*ast.CallExpr); ok && types.ExprString(inner.Fun) == traceVar {
+			return true
+		}
+	}
+	return false
+}
+
+func imports(file *ast.File, path string) bool {
+	for _, spec := range file.Imports {
+		if p, err := strconv.Unquote(spec.Path.Value); err == nil && p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the import to the file's first import block, or after its package
+// clause if it has none. The import is named if the package name the
+// trace function is qualified with is not the last element of its path.
+func importInsertion(src []byte, fset *token.FileSet, file *ast.File, cfg config) insertion {
+	spec := strconv.Quote(cfg.importPath)
+	qualifier := cfg.traceVar[:strings.IndexByte(cfg.traceVar, '.')]
+	if qualifier != cfg.importPath[strings.LastIndexByte(cfg.importPath, '/')+1:] {
+		spec = qualifier + " " + spec
+	}
+	for _, decl := range file.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT && gen.Lparen.IsValid() {
+			return lineAfter(src, fset.Position(gen.Lparen).Offset+1, spec)
+		}
+	}
+	return insertion{fset.Position(file.Name.End()).Offset, "\n\nimport " + spec + "\n"}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func TestRewrite(test *testing.T) {
+	qualified := config{traceVar: "obs.Trace", importPath: "example.com/observability"}
+	cases := map[string]config{
+		"methods":             {traceVar: "trace"},
+		"methods_all":         {traceVar: "trace", all: true, exclude: []*regexp.Regexp{regexp.MustCompile(`^Box\.`)}},
+		"existing":            {traceVar: "trace"},
+		"named":               {traceVar: "trace"},
+		"buildtags":           {traceVar: "trace"},
+		"generated":           {traceVar: "trace"},
+		"qualified":           qualified,
+		"qualified_noimports": qualified,
+	}
+	for name, cfg := range cases {
+		input := filepath.Join("testdata", name+".input")
+		if _, err := os.Stat(input); err != nil {
+			input = filepath.Join("testdata", name[:len(name)-len("_all")]+".input")
+		}
+		src, err := os.ReadFile(input)
+		assert.Nil(test, err)
+
+		out, changed, err := rewrite(input, src, cfg)
+		assert.Nil(test, err, name)
+		golden := filepath.Join("testdata", name+".golden")
+		if *update {
+			assert.Nil(test, os.WriteFile(golden, out, 0644))
+		}
+		want, err := os.ReadFile(golden)
+		assert.Nil(test, err)
+		assert.Equal(test, string(want), string(out), name)
+		assert.Equal(test, string(want) != string(src), changed, name)
+
+		// Running it again changes nothing
+		again, changed, err := rewrite(golden, out, cfg)
+		assert.Nil(test, err, name)
+		assert.False(test, changed, name)
+		assert.Equal(test, string(out), string(again), name)
+	}
+}
+
+func TestConfigCheck(test *testing.T) {
+	assert.Nil(test, config{traceVar: "trace"}.check())
+	assert.Nil(test, config{traceVar: "obs.Trace", importPath: "example.com/obs"}.check())
+	assert.NotNil(test, config{}.check())
+	assert.NotNil(test, config{traceVar: "obs.Trace"}.check())
+	assert.NotNil(test, config{traceVar: "trace", importPath: "example.com/obs"}.check())
+}
+
+func TestDiff(test *testing.T) {
+	a := "package p\n\nfunc F() {\n}\n"
+	b := "package p\n\nfunc F() {\n\tdefer trace(\"$FN\")()\n}\n"
+	assert.Equal(test, "--- p.go\n+++ p.go\n@@ -3,0 +4,1 @@\n+\tdefer trace(\"$FN\")()\n", diff("p.go", []byte(a), []byte(b)))
+	assert.Equal(test, "--- p.go\n+++ p.go\n@@ -1,1 +1,1 @@\n-a\n+b\n", diff("p.go", []byte("a\n"), []byte("b\n")))
+}
@@ -0,0 +1,152 @@
+package tracey
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// StartContext starts a span the way `Start(...)` does, for an operation
+// running under "ctx". Should the context be cancelled or past its
+// deadline by the time the span ends, its exit says so, as in
+// "(deadline exceeded, limit 5s)", telling calls which took long apart
+// from calls which were cut short. See also "WatchCancellation".
+func (t *Tracer) StartContext(ctx context.Context, s ...interface{}) *Span {
+	if t.options.DisableTracing {
+		return noopSpan
+	}
+	span := t.start(nil, "", nil, s...)
+	t.underContext(span, ctx)
+	return span
+}
+
+// Has the span watch its context
+func (t *Tracer) underContext(span *Span, ctx context.Context) {
+	span.ctx = ctx
+	if t.options.WatchCancellation && !span.muted && ctx.Done() != nil {
+		t.watcher.add(t, span)
+	}
+}
+
+// Notes on the exit event whether the span's context is done
+func (t *Tracer) exitContext(span *Span, ev *Event) {
+	if t.options.WatchCancellation {
+		t.watcher.remove(span)
+	}
+	err := span.ctx.Err()
+	if err == nil {
+		return
+	}
+	ev.Cancelled, ev.CtxErr = true, err.Error()
+	if deadline, ok := span.ctx.Deadline(); ok && errors.Is(err, context.DeadlineExceeded) {
+		ev.ctxLimit = deadline.Sub(span.ev.Time)
+	}
+}
+
+// Describes why a context is done, as in "context cancelled"
+func describeCtxErr(ctxErr string, limit time.Duration) string {
+	switch ctxErr {
+	case context.Canceled.Error():
+		return "context cancelled"
+	case context.DeadlineExceeded.Error():
+		if limit > 0 {
+			return "deadline exceeded, limit " + limit.String()
+		}
+		return "deadline exceeded"
+	}
+	return ctxErr
+}
+
+// Watches the contexts of the open spans which were started with one, and
+// logs a milestone within those whose context is done. A single goroutine
+// selects over all of them, and exits whenever there are none left.
+type cancelWatcher struct {
+	mu      sync.Mutex
+	spans   map[*Span]struct{}
+	running bool
+
+	// Tells the goroutine the spans changed
+	wake chan struct{}
+}
+
+func (w *cancelWatcher) add(t *Tracer, s *Span) {
+	w.mu.Lock()
+	if w.spans == nil {
+		w.spans = make(map[*Span]struct{})
+		w.wake = make(chan struct{}, 1)
+	}
+	w.spans[s] = struct{}{}
+	if !w.running {
+		w.running = true
+		go w.run(t)
+	}
+	w.mu.Unlock()
+	w.poke()
+}
+
+func (w *cancelWatcher) remove(s *Span) {
+	w.mu.Lock()
+	_, ok := w.spans[s]
+	delete(w.spans, s)
+	w.mu.Unlock()
+	if ok {
+		w.poke()
+	}
+}
+
+func (w *cancelWatcher) poke() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *cancelWatcher) run(t *Tracer) {
+	var cases []reflect.SelectCase
+	var spans []*Span
+	for {
+		w.mu.Lock()
+		if len(w.spans) == 0 {
+			w.running = false
+			w.mu.Unlock()
+			return
+		}
+		cases = append(cases[:0], reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(w.wake)})
+		spans = spans[:0]
+		for s := range w.spans {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.ctx.Done())})
+			spans = append(spans, s)
+		}
+		w.mu.Unlock()
+
+		chosen, _, _ := reflect.Select(cases)
+		if chosen == 0 {
+			continue
+		}
+		s := spans[chosen-1]
+		w.mu.Lock()
+		_, open := w.spans[s]
+		delete(w.spans, s)
+		w.mu.Unlock()
+		if open {
+			t.cancelNotice(s)
+		}
+	}
+}
+
+// Logs the milestone of a span whose context is done. Unlike those of
+// `Span.Event(...)`, it is not listed in the span's exit event since it is
+// logged from the watcher's goroutine.
+func (t *Tracer) cancelNotice(s *Span) {
+	ev := Event{Kind: PointEvent, Time: t.options.Clock(), TID: s.ev.TID}
+	t.within(&ev, s)
+	var limit time.Duration
+	err := s.ctx.Err()
+	if deadline, ok := s.ctx.Deadline(); ok && errors.Is(err, context.DeadlineExceeded) {
+		limit = deadline.Sub(s.ev.Time)
+	}
+	ev.Message = describeCtxErr(err.Error(), limit)
+	t.emitPoint(&ev)
+}
@@ -0,0 +1,88 @@
+package tracey
+
+import (
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartContext(test *testing.T) {
+	ResetTestBuffer()
+	js := &lockedBuffer{}
+	t := NewTracer(&Options{
+		Sinks:             []Sink{{Logger: BufLogger}, {Writer: js, Format: JSONFormat}},
+		DisableDepthValue: true,
+		Clock:             fakeClock(time.Millisecond),
+	})
+	start := time.Date(2020, 1, 1, 0, 0, 0, int(time.Millisecond), time.UTC)
+
+	t.StartContext(context.Background(), "%s", "fine").End()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	t.StartContext(ctx, "%s", "cancelled").End()
+	// Long gone by the real clock, 5s after the span started by the fake one
+	ctx, cancel = context.WithDeadline(context.Background(), start.Add(4*time.Millisecond+5*time.Second))
+	defer cancel()
+	t.StartContext(ctx, "%s", "too slow").End()
+
+	assert.Equal(test, `
+ENTER: =>fine
+EXIT:  =>fine
+ENTER: =>cancelled
+EXIT:  =>cancelled (context cancelled)
+ENTER: =>too slow
+EXIT:  =>too slow (deadline exceeded, limit 5s)
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+
+	exits := jsonExits(test, js)
+	if assert.Equal(test, 3, len(exits)) {
+		assert.Nil(test, exits[0]["ctx_err"])
+		assert.Equal(test, "context canceled", exits[1]["ctx_err"])
+	}
+	ev, err := UnmarshalEvent([]byte(strings.Split(strings.TrimSpace(js.String()), "\n")[5]))
+	assert.Nil(test, err)
+	assert.True(test, ev.Cancelled)
+	assert.Equal(test, "context deadline exceeded", ev.CtxErr)
+
+	total := uint64(0)
+	for _, s := range t.Stats() {
+		total += s.Cancelled
+	}
+	assert.Equal(test, uint64(2), total)
+}
+
+func TestWatchCancellation(test *testing.T) {
+	out := &lockedBuffer{}
+	t := NewTracer(&Options{
+		CustomLogger:      log.New(out, "", 0),
+		DisableDepthValue: true,
+		WatchCancellation: true,
+		Clock:             fakeClock(time.Millisecond),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	span := t.StartContext(ctx, "%s", "work")
+	other := t.StartContext(context.Background(), "%s", "unaffected")
+	cancel()
+	assert.Eventually(test, func() bool { return strings.Contains(out.String(), "·") }, time.Second, time.Millisecond)
+	other.End()
+	span.End()
+
+	assert.Equal(test, `ENTER: =>work
+  ENTER: =>unaffected
+  · context cancelled (at +2.0ms)
+  EXIT:  =>unaffected
+EXIT:  =>work (context cancelled)
+`, RE_tidMarker.ReplaceAllString(out.String(), "$1=>"))
+
+	// The watcher is gone once there is nothing left to watch
+	assert.Eventually(test, func() bool {
+		t.watcher.mu.Lock()
+		defer t.watcher.mu.Unlock()
+		return !t.watcher.running
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,348 @@
+package tracey
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A FunctionOverride changes some of the options for the spans of the
+// functions whose names match "Pattern", wherever they are entered, see
+// "FunctionOverrides" in `MutableOptions` and `WatchControlFile(...)`.
+// Fields left nil keep the setting in effect around the span, as with
+// `WithOverrides(...)`, on top of which they apply.
+type FunctionOverride struct {
+	Pattern string
+	OptionOverrides
+
+	// Logs the spans whatever "MinLevel", the "MinDuration" of the sinks
+	// and "SuppressSubtrees" would decide, and keeps the trees they are in
+	// under "TailSampling"
+	ForceSample bool
+}
+
+// Describes the override in the line format of control files, as in
+// "^main\.load debug instrument 5ms force"
+func (f FunctionOverride) String() string {
+	fields := []string{f.Pattern}
+	if f.MinLevel != nil {
+		fields = append(fields, f.MinLevel.String())
+	} else {
+		fields = append(fields, "-")
+	}
+	if f.EnableInstrumentation != nil {
+		if *f.EnableInstrumentation {
+			fields = append(fields, "instrument")
+		} else {
+			fields = append(fields, "noinstrument")
+		}
+	}
+	if f.MinDuration != nil {
+		fields = append(fields, f.MinDuration.String())
+	}
+	if f.ForceSample {
+		fields = append(fields, "force")
+	}
+	return strings.Join(fields, " ")
+}
+
+// The override of a function, compiled
+type functionOverride struct {
+	overrides OptionOverrides
+	force     bool
+}
+
+// The "FunctionOverrides" of a tracer, compiled, along with the override
+// found for every function name so far (nil if none)
+type functionOverrides struct {
+	patterns []*regexp.Regexp
+	compiled []*functionOverride
+	byName   sync.Map
+}
+
+func compileFunctionOverrides(sources []FunctionOverride) (*functionOverrides, error) {
+	f := &functionOverrides{}
+	for _, source := range sources {
+		pattern, err := regexp.Compile(source.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern in FunctionOverrides: %v", err)
+		}
+		compiled := &functionOverride{source.OptionOverrides, source.ForceSample}
+		if source.ForceSample {
+			level, minDuration := Trace, time.Duration(0)
+			compiled.overrides.MinLevel, compiled.overrides.MinDuration = &level, &minDuration
+		}
+		f.patterns = append(f.patterns, pattern)
+		f.compiled = append(f.compiled, compiled)
+	}
+	return f, nil
+}
+
+// Returns the override of the function, that of the first pattern which
+// matches its name
+func (f *functionOverrides) lookup(name string) *functionOverride {
+	if found, ok := f.byName.Load(name); ok {
+		return found.(*functionOverride)
+	}
+	var found *functionOverride
+	for i, pattern := range f.patterns {
+		if pattern.MatchString(name) {
+			found = f.compiled[i]
+			break
+		}
+	}
+	f.byName.Store(name, found)
+	return found
+}
+
+// Returns the overrides of a span of the function on top of "outer", and
+// whether the function is to be logged whatever else decides
+func (t *Tracer) overrideFunction(config *mutableConfig, site *callsite, name string, outer *OptionOverrides) (*OptionOverrides, bool) {
+	if site != nil && name == "" {
+		name = site.name
+	}
+	f := t.decide(config, site, name).function
+	if f == nil {
+		return outer, false
+	}
+	return f.overrides.over(outer), f.force
+}
+
+// Checks the overrides for values `Update(...)` should refuse
+func checkFunctionOverrides(overrides []FunctionOverride) error {
+	for _, f := range overrides {
+		if f.MinLevel != nil && (*f.MinLevel < Trace || *f.MinLevel > Info) {
+			return fmt.Errorf("bad MinLevel %d for %q", *f.MinLevel, f.Pattern)
+		}
+		if f.MinDuration != nil && *f.MinDuration < 0 {
+			return fmt.Errorf("negative MinDuration %s for %q", *f.MinDuration, f.Pattern)
+		}
+	}
+	return nil
+}
+
+// The overrides of a control file in JSON, see `WatchControlFile(...)`
+type controlEntry struct {
+	Pattern     string `json:"pattern"`
+	Level       string `json:"level"`
+	Instrument  *bool  `json:"instrument"`
+	MinDuration string `json:"min_duration"`
+	ForceSample bool   `json:"force_sample"`
+}
+
+// Parses a level of a control file, where "-" (or nothing) keeps the
+// level in effect
+func parseControlLevel(s string) (*Level, error) {
+	var level Level
+	switch s {
+	case "", "-":
+		return nil, nil
+	case "trace":
+		level = Trace
+	case "debug":
+		level = Debug
+	case "info":
+		level = Info
+	default:
+		return nil, fmt.Errorf("bad level %q", s)
+	}
+	return &level, nil
+}
+
+// Parses the overrides of a control file, in either of the formats of
+// `WatchControlFile(...)`
+func parseControlFile(data []byte) ([]FunctionOverride, error) {
+	var overrides []FunctionOverride
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var entries []controlEntry
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, err
+		}
+		for i, entry := range entries {
+			f := FunctionOverride{Pattern: entry.Pattern, ForceSample: entry.ForceSample}
+			f.EnableInstrumentation = entry.Instrument
+			var err error
+			if f.MinLevel, err = parseControlLevel(entry.Level); err != nil {
+				return nil, fmt.Errorf("entry %d: %v", i+1, err)
+			}
+			if entry.MinDuration != "" {
+				d, err := time.ParseDuration(entry.MinDuration)
+				if err != nil {
+					return nil, fmt.Errorf("entry %d: bad min_duration %q", i+1, entry.MinDuration)
+				}
+				f.MinDuration = &d
+			}
+			if f.Pattern == "" {
+				return nil, fmt.Errorf("entry %d: no pattern", i+1)
+			}
+			overrides = append(overrides, f)
+		}
+		return overrides, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: no level", n)
+		}
+		f := FunctionOverride{Pattern: fields[0]}
+		var err error
+		if f.MinLevel, err = parseControlLevel(fields[1]); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		for _, field := range fields[2:] {
+			instrument := field == "instrument"
+			switch field {
+			case "instrument", "noinstrument":
+				f.EnableInstrumentation = &instrument
+			case "force":
+				f.ForceSample = true
+			default:
+				d, err := time.ParseDuration(field)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: bad field %q", n, field)
+				}
+				f.MinDuration = &d
+			}
+		}
+		overrides = append(overrides, f)
+	}
+	return overrides, scanner.Err()
+}
+
+// WatchControlFile has the "FunctionOverrides" of the tracer follow the
+// file at "path", which is checked for changes every "interval", so that
+// the tracing of a function may be turned up while the program runs by
+// editing a file. The file holds an override per line, as in
+//
+//	# pattern level [instrument|noinstrument] [minDuration] [force]
+//	^main\.importRecords$ debug instrument 0s
+//	^db\.           -    50ms
+//
+// where a level of "-" keeps the one in effect, and "force" stands for
+// "ForceSample", or else is a JSON array of objects with the fields
+// "pattern", "level", "instrument", "min_duration" and "force_sample".
+// The overrides are applied as a whole through `Update(...)`, replacing
+// any others, and removing the file clears them. Rename a new file over
+// it to change it: a file caught half written is read again on the next
+// check, and one emptied is taken for being written rather than for
+// clearing the overrides. A file which cannot be read or parsed, or
+// whose overrides `Update(...)` refuses, leaves the overrides as they
+// were, and the error is passed to "SinkErrorHandler", or else logged
+// as a warning; an error of the first read is returned instead, and
+// nothing is watched. Call the returned function to stop watching.
+func (t *Tracer) WatchControlFile(path string, interval time.Duration) (stop func(), err error) {
+	if t.start == nil {
+		return func() {}, nil
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("tracey: bad control file interval %s", interval)
+	}
+	w := &controlWatch{t: t, path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := w.check(); err != nil {
+		return nil, err
+	}
+	go w.run(interval)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(w.stop)
+			<-w.done
+		})
+	}, nil
+}
+
+// The state of a control file being watched
+type controlWatch struct {
+	t    *Tracer
+	path string
+
+	// What the file was when last read, unset if there was none
+	exists  bool
+	modTime time.Time
+	size    int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (w *controlWatch) run(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			if err := w.check(); err != nil {
+				w.report(err)
+			}
+		}
+	}
+}
+
+// Applies the overrides of the file, should it have changed since it was
+// last read
+func (w *controlWatch) check() error {
+	info, err := os.Stat(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if !w.exists {
+			return nil
+		}
+		w.exists = false
+		return w.t.Update(func(o *MutableOptions) { o.FunctionOverrides = nil })
+	}
+	if err != nil {
+		return fmt.Errorf("tracey: control file: %v", err)
+	}
+	if w.exists && info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return nil
+	}
+	data, err := os.ReadFile(w.path)
+	if err == nil && !w.settled(info, data) {
+		return nil
+	}
+	// Not read again until it changes, even if it is bad
+	w.exists, w.modTime, w.size = true, info.ModTime(), info.Size()
+	if err != nil {
+		return fmt.Errorf("tracey: control file: %v", err)
+	}
+	overrides, err := parseControlFile(data)
+	if err != nil {
+		return fmt.Errorf("tracey: control file %s: %v", w.path, err)
+	}
+	return w.t.Update(func(o *MutableOptions) { o.FunctionOverrides = overrides })
+}
+
+// Returns false if the file changed while it was read, or was emptied
+// since it was last read, as when caught being written in place
+func (w *controlWatch) settled(before os.FileInfo, data []byte) bool {
+	after, err := os.Stat(w.path)
+	if err != nil || !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() || int64(len(data)) != after.Size() {
+		return false
+	}
+	return len(data) > 0 || !w.exists || w.size == 0
+}
+
+func (w *controlWatch) report(err error) {
+	if handle := w.t.options.SinkErrorHandler; handle != nil {
+		handle(err)
+		return
+	}
+	warning := "Warning: " + err.Error() + "\n"
+	if w.t.admitOutput(len(warning)) {
+		w.t.note(warning)
+	}
+}
@@ -0,0 +1,156 @@
+package tracey
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A function the control files of the tests turn the tracing of up
+func controlledWork(t *Tracer) {
+	defer t.Enter(Debug, "%s", "work")()
+}
+
+// Replaces the control file at "path" as `WatchControlFile(...)` expects,
+// by renaming a new file over it
+func writeControlFile(test *testing.T, path, content string) {
+	temp := path + ".tmp"
+	assert.Nil(test, os.WriteFile(temp, []byte(content), 0o644))
+	assert.Nil(test, os.Rename(temp, path))
+}
+
+func TestWatchControlFile(test *testing.T) {
+	var out lockedBuffer
+	var mu sync.Mutex
+	var errs []error
+	t := NewTracer(&Options{
+		Sinks:    []Sink{{Writer: &out}},
+		MinLevel: Info,
+		SinkErrorHandler: func(err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		},
+	})
+	path := filepath.Join(test.TempDir(), "tracey.ctl")
+	stop, err := t.WatchControlFile(path, time.Millisecond)
+	assert.Nil(test, err)
+	defer stop()
+
+	// Runs the function, telling whether it logged what is expected
+	logs := func(want string) func() bool {
+		return func() bool {
+			out.Reset()
+			controlledWork(t)
+			return strings.Contains(RE_tidMarker.ReplaceAllString(out.String(), "=>"), want)
+		}
+	}
+	controlledWork(t)
+	assert.Empty(test, out.String())
+
+	writeControlFile(test, path, "# turned up\ncontrolledWork$ debug\n")
+	assert.Eventually(test, logs("[ 0]EXIT:  DBG =>work\n"), time.Second, time.Millisecond)
+
+	writeControlFile(test, path, `[{"pattern": "controlledWork$", "level": "debug", "instrument": true}]`)
+	assert.Eventually(test, logs("[ 0]EXIT:  DBG =>work ... in "), time.Second, time.Millisecond)
+
+	// A bad file leaves the overrides as they were
+	writeControlFile(test, path, "controlledWork$ loud\n")
+	assert.Eventually(test, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(errs) > 0
+	}, time.Second, time.Millisecond)
+	mu.Lock()
+	assert.Equal(test, "tracey: control file "+path+`: line 1: bad level "loud"`, errs[0].Error())
+	mu.Unlock()
+	assert.True(test, logs("[ 0]EXIT:  DBG =>work ... in ")())
+
+	assert.Nil(test, os.Remove(path))
+	assert.Eventually(test, func() bool {
+		out.Reset()
+		controlledWork(t)
+		return out.Len() == 0
+	}, time.Second, time.Millisecond)
+	assert.Empty(test, t.CurrentOptions().FunctionOverrides)
+	mu.Lock()
+	assert.Len(test, errs, 1)
+	mu.Unlock()
+}
+
+func TestWatchControlFileEmptied(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &lockedBuffer{}}}})
+	path := filepath.Join(test.TempDir(), "tracey.ctl")
+	w := &controlWatch{t: t, path: path}
+	writeControlFile(test, path, "controlledWork$ debug\n")
+	assert.Nil(test, w.check())
+	assert.Len(test, t.CurrentOptions().FunctionOverrides, 1)
+
+	// As caught right after being truncated by a write in place
+	assert.Nil(test, os.WriteFile(path, nil, 0o644))
+	assert.Nil(test, w.check())
+	assert.Len(test, t.CurrentOptions().FunctionOverrides, 1)
+
+	writeControlFile(test, path, "# none\n")
+	assert.Nil(test, w.check())
+	assert.Empty(test, t.CurrentOptions().FunctionOverrides)
+}
+
+func TestWatchControlFileErrors(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &lockedBuffer{}}}})
+	path := filepath.Join(test.TempDir(), "tracey.ctl")
+	_, err := t.WatchControlFile(path, 0)
+	assert.Equal(test, "tracey: bad control file interval 0s", err.Error())
+
+	assert.Nil(test, os.WriteFile(path, []byte("(unclosed debug\n"), 0o644))
+	_, err = t.WatchControlFile(path, time.Second)
+	assert.Contains(test, err.Error(), "tracey: bad pattern in FunctionOverrides")
+	assert.Empty(test, t.CurrentOptions().FunctionOverrides)
+}
+
+func TestParseControlFile(test *testing.T) {
+	overrides, err := parseControlFile([]byte("^main\\.load$ debug instrument 5ms\n\n  # comment\n^db\\. - noinstrument force\n"))
+	assert.Nil(test, err)
+	assert.Equal(test, []string{`^main\.load$ debug instrument 5ms`, `^db\. - noinstrument force`},
+		[]string{overrides[0].String(), overrides[1].String()})
+
+	overrides, err = parseControlFile([]byte(`[{"pattern": "^db\\.", "min_duration": "1s", "force_sample": true}, {"pattern": "x", "level": "info"}]`))
+	assert.Nil(test, err)
+	assert.Equal(test, []string{`^db\. - 1s force`, `x info`}, []string{overrides[0].String(), overrides[1].String()})
+
+	for data, message := range map[string]string{
+		"main":                                       "line 1: no level",
+		"main debug sometimes":                       `line 1: bad field "sometimes"`,
+		`[{"level": "debug"}]`:                       "entry 1: no pattern",
+		`[{"pattern": "x", "level": "loud"}]`:        `entry 1: bad level "loud"`,
+		`[{"pattern": "x", "min_duration": "soon"}]`: `entry 1: bad min_duration "soon"`,
+	} {
+		_, err := parseControlFile([]byte(data))
+		assert.Equal(test, message, err.Error())
+	}
+}
+
+func TestForceSample(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{
+		Sinks:        []Sink{{Writer: &out, MinDuration: time.Hour}},
+		MinLevel:     Info,
+		TailSampling: true,
+	})
+	assert.Nil(test, t.Update(func(o *MutableOptions) {
+		o.FunctionOverrides = []FunctionOverride{{Pattern: "controlledWork$", ForceSample: true}}
+	}))
+	func() {
+		defer t.Enter(Info, "%s", "request")()
+		controlledWork(t)
+	}()
+	t.Enter(Info, "%s", "unforced")()
+
+	assert.Equal(test, "[ 1]  ENTER: DBG =>work\n"+
+		"[ 1]  EXIT:  DBG =>work\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+}
@@ -0,0 +1,57 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+)
+
+// Returned by "threadCPU()" on platforms without a CPU clock per thread
+var errCPUTimeUnsupported = errors.New("tracey: thread CPU time not supported on this platform")
+
+// Samples the CPU clock of the span's thread when it is entered, having
+// locked the goroutine to the thread first if "LockThread" is set
+func (t *Tracer) enterCPUTime(span *Span) {
+	if span.muted {
+		return
+	}
+	if t.options.LockThread {
+		runtime.LockOSThread()
+		span.lockedBy = getGID()
+	}
+	thread, cpu, err := threadCPU()
+	if err != nil {
+		t.exitCPUTime(span, nil)
+		return
+	}
+	span.cpuThread, span.cpuAt, span.cpuSampled = thread, cpu, true
+}
+
+// Notes on the exit event the CPU time the span's thread spent since the
+// span was entered, unless the goroutine moved to another thread meanwhile,
+// and unlocks the goroutine from the thread if it was locked to it
+func (t *Tracer) exitCPUTime(span *Span, ev *Event) {
+	if span.cpuSampled && ev != nil {
+		if thread, cpu, err := threadCPU(); err == nil && thread == span.cpuThread && cpu >= span.cpuAt {
+			ev.CPUTime = cpu - span.cpuAt
+			ev.CPUApprox = span.lockedBy == 0
+		}
+	}
+	// Only the goroutine which locked the thread can unlock it
+	if span.lockedBy != 0 && span.lockedBy == getGID() {
+		span.lockedBy = 0
+		runtime.UnlockOSThread()
+	}
+}
+
+// Renders the CPU time, as in "(cpu 8.1ms)", or "(~cpu 8.1ms)" when the
+// thread may have run other goroutines meanwhile
+func renderCPUTime(buf *bytes.Buffer, ev *Event) {
+	buf.WriteString(" (")
+	if ev.CPUApprox {
+		buf.WriteByte('~')
+	}
+	buf.WriteString("cpu ")
+	writeDuration(buf, ev.CPUTime)
+	buf.WriteByte(')')
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package tracey
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// CLOCK_THREAD_CPUTIME_ID, which the syscall package does not define
+const clockThreadCPUTimeID = 3
+
+// Returns the calling thread, and the CPU time it has spent so far
+func threadCPU() (int, time.Duration, error) {
+	var ts syscall.Timespec
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CLOCK_GETTIME, clockThreadCPUTimeID, uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+		return 0, 0, errno
+	}
+	return syscall.Gettid(), time.Duration(ts.Nano()), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package tracey
+
+import "time"
+
+// Thread CPU time is only read on Linux
+func threadCPU() (int, time.Duration, error) {
+	return 0, 0, errCPUTimeUnsupported
+}
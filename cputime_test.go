@@ -0,0 +1,97 @@
+package tracey
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Keeps the thread busy for about "d"
+func busyLoop(d time.Duration) int {
+	n := 0
+	for start := time.Now(); time.Since(start) < d; {
+		n++
+	}
+	return n
+}
+
+func TestCPUTime(test *testing.T) {
+	var out, js bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Writer: &out}, {Writer: &js, Format: JSONFormat}},
+		MessageTemplates:      map[string]string{`.`: "$MSG"},
+		EnableInstrumentation: true,
+		EnableCPUTime:         true,
+		LockThread:            true,
+	})
+	t.StartNamed("busy", "busy").End()
+	func() {
+		defer t.StartNamed("busy", "busy").End()
+		busyLoop(50 * time.Millisecond)
+	}()
+	func() {
+		defer t.StartNamed("sleep", "sleep").End()
+		time.Sleep(50 * time.Millisecond)
+	}()
+
+	if runtime.GOOS != "linux" {
+		// Nothing is measured, nor rendered
+		assert.False(test, t.cpuTime)
+		assert.NotContains(test, out.String(), "cpu")
+		assert.NotContains(test, js.String(), `"`+FieldCPU+`"`)
+		return
+	}
+	exits := exitsByMessage(test, js.String())
+	busy, sleep := exits["busy"], exits["sleep"]
+	assert.False(test, busy.CPUApprox)
+	assert.InDelta(test, float64(busy.Duration), float64(busy.CPUTime), float64(busy.Duration)/2)
+	assert.True(test, sleep.CPUTime < sleep.Duration/5, "%v of %v", sleep.CPUTime, sleep.Duration)
+	assert.Regexp(test, `\[ 0\]EXIT:  busy \.\.\. in [0-9.]+ms \(cpu [0-9.]+ms\)\n`, out.String())
+
+	var total time.Duration
+	for _, s := range t.Stats() {
+		if s.Name == "busy" {
+			total = s.CPUTime
+		}
+	}
+	assert.True(test, total >= busy.CPUTime)
+}
+
+func TestCPUTimeApprox(test *testing.T) {
+	var out, js bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Writer: &out}, {Writer: &js, Format: JSONFormat}},
+		MessageTemplates: map[string]string{`.`: "$MSG"},
+		EnableCPUTime:    true,
+	})
+	func() {
+		defer t.Start("%s", "work").End()
+		busyLoop(time.Millisecond)
+	}()
+	ev := exitsByMessage(test, js.String())["work"]
+	if ev.CPUTime == 0 {
+		// Not on Linux, or the goroutine changed threads
+		assert.NotContains(test, out.String(), "cpu")
+		return
+	}
+	assert.True(test, ev.CPUApprox)
+	assert.Contains(test, out.String(), "EXIT:  work (~cpu ")
+	assert.True(test, strings.Contains(js.String(), `"`+FieldCPUApprox+`":true`))
+}
+
+func TestCPUTimeUnsupported(test *testing.T) {
+	// Every platform renders what it has, and nothing without it
+	var buf bytes.Buffer
+	renderCPUTime(&buf, &Event{CPUTime: 8100 * time.Microsecond})
+	assert.Equal(test, " (cpu 8.1ms)", buf.String())
+
+	if _, _, err := threadCPU(); runtime.GOOS != "linux" {
+		assert.Equal(test, errCPUTimeUnsupported, err)
+	} else {
+		assert.Nil(test, err)
+	}
+}
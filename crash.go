@@ -0,0 +1,155 @@
+package tracey
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long the flush path waits for a lock before giving up on it, in case
+// it is held by the goroutine which panicked
+const flushLockTimeout = 100 * time.Millisecond
+
+// Tries to take the lock until the timeout, returns false if it could not
+func tryLock(mu *sync.Mutex, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !mu.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// FlushAll writes out everything the tracer is holding back, that is what
+// `Flush()` writes out (the pending runs of "CollapseRepeats", the streaks
+// of "SkipUnchanged" and the queues of "Async" sinks), for use before
+// `os.Exit(...)`. Unlike `Flush()` it never blocks for long: if the state
+// it needs is locked (as it may be by a goroutine which panicked) or the
+// queues do not drain in time, it skips it, and logs that the flush was
+// partial.
+func (t *Tracer) FlushAll() {
+	if t.options.CollapseRepeats {
+		if tryLock(&t.repeats.Mutex, flushLockTimeout) {
+			t.flushRuns()
+			t.repeats.Unlock()
+		} else {
+			t.note("TRACE FLUSH PARTIAL — pending repeats were locked\n")
+		}
+	}
+	if t.changes != nil {
+		if tryLock(&t.changes.Mutex, flushLockTimeout) {
+			streaks := t.changes.takeStreaks()
+			t.changes.Unlock()
+			for _, streak := range streaks {
+				t.summarizeUnchanged(streak)
+			}
+		} else {
+			t.note("TRACE FLUSH PARTIAL — pending unchanged streaks were locked\n")
+		}
+	}
+	if !t.flushAsync(flushLockTimeout) {
+		for _, s := range t.sinks {
+			s.writeNote("TRACE FLUSH PARTIAL — async queues did not drain\n")
+		}
+	}
+}
+
+// RecoverAndFlush is meant to be deferred at the top of main and of
+// goroutine entry points when "FlushOnPanic" is set. On a panic it flushes
+// the tracer, writes the panic value, its stack and the spans still open
+// to the "CrashWriter", and then panics again with the same value. It does
+// nothing when "FlushOnPanic" is not set.
+func (t *Tracer) RecoverAndFlush() {
+	if !t.options.FlushOnPanic {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+	t.FlushAll()
+
+	w := t.options.CrashWriter
+	fmt.Fprintf(w, "PANIC: %v\n\n%s\n", r, stack)
+	snapshot, complete := t.trySnapshot(flushLockTimeout)
+	gids := make([]uint64, 0, len(snapshot))
+	for gid := range snapshot {
+		gids = append(gids, gid)
+	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+	for _, gid := range gids {
+		fmt.Fprintf(w, "open spans on goroutine %d:\n", gid)
+		for _, span := range snapshot[gid] {
+			fmt.Fprintf(w, "\t%s %s (open for %s)\n", span.Name, span.Message, formatDuration(span.Age))
+		}
+	}
+	suspended, ok := t.trySuspended(flushLockTimeout)
+	if len(suspended) > 0 {
+		fmt.Fprintf(w, "suspended spans:\n")
+		for _, span := range suspended {
+			fmt.Fprintf(w, "\t%s %s (open for %s)\n", span.Name, span.Message, formatDuration(span.Age))
+		}
+	}
+	if !complete || !ok {
+		fmt.Fprintf(w, "(some spans were locked, and are not listed)\n")
+	}
+	for i, s := range t.sinks {
+		if h := s.health(); h.Failed > 0 {
+			fmt.Fprintf(w, "sink %d: %s\n", i, h)
+		}
+	}
+	panic(r)
+}
+
+// Like `Snapshot()`, but skipping the goroutines whose records stay locked
+// past the timeout (which is for all of them together), as they may be by
+// the goroutine which panicked. Returns false if any were skipped.
+func (t *Tracer) trySnapshot(timeout time.Duration) (map[uint64][]OpenSpan, bool) {
+	snapshot := make(map[uint64][]OpenSpan)
+	if t.start == nil {
+		return snapshot, true
+	}
+	now, complete := t.options.Clock(), true
+	deadline := time.Now().Add(timeout)
+	for i := range t.goroutines.shards {
+		shard := &t.goroutines.shards[i]
+		if !tryLock(&shard.Mutex, time.Until(deadline)) {
+			complete = false
+			continue
+		}
+		for gid, record := range shard.g {
+			if len(record.open) == 0 {
+				continue
+			}
+			spans := make([]OpenSpan, len(record.open))
+			for i, s := range record.open {
+				spans[i] = OpenSpan{s.ev.TraceID, s.ev.SpanID, s.ev.Name, s.ev.Message, now.Sub(s.ev.Time)}
+			}
+			snapshot[gid] = spans
+		}
+		shard.Unlock()
+	}
+	return snapshot, complete
+}
+
+// Like `Suspended()`, but returning false rather than waiting for longer
+// than the timeout on the lock
+func (t *Tracer) trySuspended(timeout time.Duration) ([]OpenSpan, bool) {
+	if t.start == nil {
+		return nil, true
+	}
+	if !tryLock(&t.suspensions.Mutex, timeout) {
+		return nil, false
+	}
+	spans := make([]*Span, 0, len(t.suspensions.spans))
+	for s := range t.suspensions.spans {
+		spans = append(spans, s)
+	}
+	t.suspensions.Unlock()
+	return t.describeSuspended(spans), true
+}
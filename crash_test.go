@@ -0,0 +1,100 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper functions - part of "TestRecoverAndFlush"
+func crashLeaf(t *Tracer) { defer t.Enter("%s", "leaf")() }
+
+func crashTree(t *Tracer) {
+	defer t.Enter("%s", "tree")()
+	for i := 0; i < 3; i++ {
+		crashLeaf(t)
+	}
+	panic("boom")
+}
+
+func TestRecoverAndFlush(test *testing.T) {
+	ResetTestBuffer()
+	var crash bytes.Buffer
+	t := NewTracer(&Options{CustomLogger: BufLogger, CollapseRepeats: true, FlushOnPanic: true, CrashWriter: &crash})
+
+	// A span open on another goroutine shows up in the report
+	other := make(chan *Span)
+	go func() { other <- t.Start("%s", "background") }()
+	defer (<-other).End()
+
+	assert.PanicsWithValue(test, "boom", func() {
+		defer t.RecoverAndFlush()
+		crashTree(t)
+	})
+
+	assert.Contains(test, maskedTestBuffer(), "(×3) go-tracey.crashLeaf")
+	report := crash.String()
+	assert.True(test, strings.HasPrefix(report, "PANIC: boom\n"), report)
+	assert.Contains(test, report, "go-tracey.crashTree")
+	assert.Regexp(test, `open spans on goroutine \d+:\n\tgo-tracey.TestRecoverAndFlush.func1 background \(open for .+\)\n$`, report)
+}
+
+func TestRecoverAndFlushDisabled(test *testing.T) {
+	var crash bytes.Buffer
+	t := NewTracer(&Options{CustomLogger: BufLogger, CrashWriter: &crash})
+	func() {
+		defer func() { recover() }()
+		defer t.RecoverAndFlush()
+		panic("boom")
+	}()
+	assert.Empty(test, crash.String())
+}
+
+func TestFlushAllGivesUpOnHeldLock(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, CollapseRepeats: true})
+	t.repeats.Lock()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	start := time.Now()
+	go func() {
+		defer wg.Done()
+		t.FlushAll()
+	}()
+	wg.Wait()
+	t.repeats.Unlock()
+
+	assert.True(test, time.Since(start) >= flushLockTimeout)
+	assert.Equal(test, "\nTRACE FLUSH PARTIAL — pending repeats were locked\n", GetTestBuffer())
+}
+
+func TestFlushAllSkipUnchanged(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, HighlightChanges: true, SkipUnchanged: true, DisableDepthValue: true})
+	for i := 0; i < 3; i++ {
+		t.Enter("%s", "tick")()
+	}
+	t.FlushAll()
+	assert.Equal(test, "\nENTER: =>tick\nEXIT:  =>tick\n(unchanged ×2) go-tracey.TestFlushAllSkipUnchanged\n", maskedTestBuffer())
+}
+
+func TestRecoverAndFlushGivesUpOnHeldLocks(test *testing.T) {
+	var crash bytes.Buffer
+	t := NewTracer(&Options{CustomLogger: BufLogger, FlushOnPanic: true, CrashWriter: &crash})
+	t.suspensions.Lock()
+	defer t.suspensions.Unlock()
+	for i := range t.goroutines.shards {
+		t.goroutines.shards[i].Lock()
+		defer t.goroutines.shards[i].Unlock()
+	}
+
+	assert.PanicsWithValue(test, "boom", func() {
+		defer t.RecoverAndFlush()
+		panic("boom")
+	})
+	assert.True(test, strings.HasSuffix(crash.String(), "(some spans were locked, and are not listed)\n"), crash.String())
+}
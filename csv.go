@@ -0,0 +1,103 @@
+package tracey
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The columns of the rows written to the "CSVWriter"
+var csvHeader = []string{
+	"timestamp", "goroutine", "span", "parent", "depth", "function", "message", "duration_us", "error", "tags", "attached", "seq",
+}
+
+// The columns of the rows written by `ExportCSV(...)`
+var statsCSVHeader = []string{
+	"function", "calls", "total_us", "mean_us", "in_flight", "max_concurrent",
+}
+
+// Writes completed spans to the "CSVWriter"
+type csvExport struct {
+	sync.Mutex
+	w      *csv.Writer
+	header bool
+}
+
+func newCSVWriter(w io.Writer, tsv bool) *csv.Writer {
+	cw := csv.NewWriter(w)
+	if tsv {
+		cw.Comma = '\t'
+	}
+	return cw
+}
+
+func newCSVExport(w io.Writer, tsv bool) *csvExport {
+	return &csvExport{w: newCSVWriter(w, tsv)}
+}
+
+// Writes the row of an exit event, and the header row before the first one.
+// Rows are flushed right away so that nothing is lost if the process dies.
+func (c *csvExport) write(ev *Event) {
+	var tags []string
+	for i, tag := range ev.Tags {
+		tags = append(tags, tag.Key+"="+ev.tagValue(i))
+	}
+	var err string
+	if ev.Err != nil {
+		err = ev.Err.Error()
+	}
+	row := []string{
+		ev.Time.Add(-ev.Duration).Format(time.RFC3339Nano),
+		strconv.FormatUint(ev.TID, 10),
+		ev.SpanID,
+		ev.ParentID,
+		strconv.Itoa(ev.Depth),
+		ev.Name,
+		ev.Message,
+		formatMicros(ev.Duration),
+		err,
+		strings.Join(tags, ";"),
+		strings.Join(ev.Attached, "\n"),
+		strconv.FormatUint(ev.Seq, 10),
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if !c.header {
+		c.w.Write(csvHeader)
+		c.header = true
+	}
+	c.w.Write(row)
+	c.w.Flush()
+}
+
+// Formats a duration as a number of microseconds, as in "1500.250"
+func formatMicros(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Microsecond), 'f', 3, 64)
+}
+
+// ExportCSV writes the statistics returned by `Stats()` as CSV, or as tab
+// separated values if the "TSV" option is set.
+func (t *Tracer) ExportCSV(w io.Writer) error {
+	cw := newCSVWriter(w, t.options.TSV)
+	cw.Write(statsCSVHeader)
+	for _, s := range t.Stats() {
+		var mean time.Duration
+		if s.Calls > 0 {
+			mean = s.Total / time.Duration(s.Calls)
+		}
+		cw.Write([]string{
+			s.Name,
+			strconv.FormatUint(s.Calls, 10),
+			formatMicros(s.Total),
+			formatMicros(mean),
+			strconv.FormatInt(s.InFlight, 10),
+			strconv.FormatInt(s.MaxConcurrent, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,84 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper functions - part of "TestCSVExport"
+func csvChild(t *Tracer, i int) {
+	span := t.Start("$FN, item %d\nsecond line", i)
+	defer span.End()
+	span.Tag("i", i)
+	span.Tag("odd", i%2 == 1)
+	if i == 1 {
+		span.SetError(errors.New(`bad "item"`))
+	}
+}
+
+func csvParent(t *Tracer) {
+	defer t.Enter("%s", "parent")()
+	csvChild(t, 0)
+	csvChild(t, 1)
+}
+
+// Reads back the rows written by the tracer, with the columns which vary
+// from run to run masked
+func readCSV(test *testing.T, r io.Reader, tsv bool) [][]string {
+	reader := csv.NewReader(r)
+	if tsv {
+		reader.Comma = '\t'
+	}
+	rows, err := reader.ReadAll()
+	assert.Nil(test, err)
+	for _, row := range rows[1:] {
+		_, err := time.Parse(time.RFC3339Nano, row[0])
+		assert.Nil(test, err)
+		_, err = strconv.ParseUint(row[1], 10, 64)
+		assert.Nil(test, err)
+		_, err = strconv.ParseFloat(row[7], 64)
+		assert.Nil(test, err)
+		_, err = strconv.ParseUint(row[11], 10, 64)
+		assert.Nil(test, err)
+		row[0], row[1], row[7], row[11] = "T", "G", "D", "S"
+	}
+	return rows
+}
+
+func TestCSVExport(test *testing.T) {
+	for _, tsv := range []bool{false, true} {
+		var buf bytes.Buffer
+		t := NewTracer(&Options{CustomLogger: log.New(io.Discard, "", 0), CSVWriter: &buf, TSV: tsv})
+		csvParent(t)
+
+		assert.Equal(test, [][]string{
+			csvHeader,
+			{"T", "G", "2", "1", "1", "go-tracey.csvChild", "go-tracey.csvChild, item 0\nsecond line", "D", "", "i=0;odd=false", "", "S"},
+			{"T", "G", "3", "1", "1", "go-tracey.csvChild", "go-tracey.csvChild, item 1\nsecond line", "D", `bad "item"`, "i=1;odd=true", "", "S"},
+			{"T", "G", "1", "", "0", "go-tracey.csvParent", "parent", "D", "", "", "", "S"},
+		}, readCSV(test, &buf, tsv))
+	}
+}
+
+func TestExportCSVStats(test *testing.T) {
+	t := NewTracer(&Options{CustomLogger: log.New(io.Discard, "", 0)})
+	csvParent(t)
+
+	var buf bytes.Buffer
+	assert.Nil(test, t.ExportCSV(&buf))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	assert.Nil(test, err)
+	assert.Equal(test, 3, len(rows))
+	assert.Equal(test, statsCSVHeader, rows[0])
+	assert.Equal(test, []string{"go-tracey.csvChild", "2"}, rows[1][:2])
+	assert.Equal(test, []string{"0", "1"}, rows[1][4:])
+	assert.Equal(test, []string{"go-tracey.csvParent", "1"}, rows[2][:2])
+}
@@ -0,0 +1,128 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDeltaThresholdPct is by how many percents a span must deviate
+// from its baseline to be logged under "DeltaMode", when neither
+// "DeltaThresholdPct" nor "DeltaThresholdAbs" is set.
+const DefaultDeltaThresholdPct = 10
+
+// The mean durations of the functions of a baseline session
+type baseline struct {
+	means map[string]time.Duration
+
+	// Set if the session was text, whose lines do not name their
+	// function, in which case they are keyed by their message
+	byMessage bool
+}
+
+// LoadBaseline reads a session recorded before, as the output of a
+// JSONFormat or BinaryFormat sink, of `MMapSink(...)`, or as text lines
+// written with the options of the tracer (see `ParseLine(...)`), into the
+// mean duration of each function, which "DeltaMode" compares spans to.
+// Text lines do not tell which function
+// they are of, so that spans are then matched by their message. Lines of
+// text which cannot be read back, such as warnings, are left out. The
+// baseline replaces the one loaded before, if any.
+func (t *Tracer) LoadBaseline(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("tracey: reading the baseline: %v", err)
+	}
+	b := &baseline{means: make(map[string]time.Duration)}
+	var events []Event
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] != '{' && trimmed[0] != binaryMarker && !bytes.HasPrefix(data, []byte(mmapMagic)) {
+		// Read as written by this tracer, with their durations
+		opts := t.options
+		opts.EnableInstrumentation = true
+		b.byMessage = true
+		for _, line := range strings.Split(string(data), "\n") {
+			if l, err := ParseLine(line, &opts); err == nil && l.Kind == ExitEvent {
+				events = append(events, Event{Kind: ExitEvent, Name: l.Message, Duration: l.Duration})
+			}
+		}
+	} else if events, err = readSession(bytes.NewReader(data), "the baseline"); err != nil {
+		return err
+	}
+
+	totals := make(map[string]time.Duration)
+	calls := make(map[string]int64)
+	for i := range events {
+		ev := &events[i]
+		if ev.Kind != ExitEvent || ev.Duration <= 0 || ev.Name == "" {
+			continue
+		}
+		totals[ev.Name] += ev.Duration
+		calls[ev.Name]++
+	}
+	if len(calls) == 0 {
+		return errors.New("tracey: the baseline has no timed exits")
+	}
+	for name, total := range totals {
+		b.means[name] = total / time.Duration(calls[name])
+	}
+	t.baseline.Store(b)
+	return nil
+}
+
+// Returns true if the event is to be logged under "DeltaMode", which is
+// only the case of the exits of spans which deviate from the baseline, or
+// whose function it does not have, which are tagged "new"
+func (t *Tracer) deltaChanged(ev *Event) bool {
+	if ev.Kind != ExitEvent {
+		return false
+	}
+	b := t.baseline.Load()
+	var mean time.Duration
+	known := false
+	if b != nil {
+		key := ev.Name
+		if b.byMessage {
+			key = ev.Message
+		}
+		mean, known = b.means[key]
+	}
+	if !known {
+		ev.Tags = append(ev.Tags[:len(ev.Tags):len(ev.Tags)], Tag{"new", true})
+		if len(ev.tagValues) == len(ev.Tags)-1 {
+			ev.tagValues = append(ev.tagValues[:len(ev.tagValues):len(ev.tagValues)], "true")
+		}
+		return true
+	}
+	deviation := ev.Duration - mean
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	pct, abs := t.options.DeltaThresholdPct, t.options.DeltaThresholdAbs
+	if pct <= 0 && abs <= 0 {
+		pct = DefaultDeltaThresholdPct
+	}
+	changed := (abs > 0 && deviation > abs) || (pct > 0 && 100*float64(deviation) > pct*float64(mean))
+	if changed {
+		ev.Baseline = mean
+	}
+	return changed
+}
+
+// Renders how the span compares to its baseline, as in " (baseline
+// 12.0ms, +300%)"
+func renderBaseline(buf *bytes.Buffer, ev *Event) {
+	buf.WriteString(" (baseline ")
+	writeDuration(buf, ev.Baseline)
+	buf.WriteString(", ")
+	change := math.Round(100 * float64(ev.Duration-ev.Baseline) / float64(ev.Baseline))
+	if change >= 0 {
+		buf.WriteByte('+')
+	}
+	buf.WriteString(strconv.FormatFloat(change, 'f', 0, 64))
+	buf.WriteString("%)")
+}
@@ -0,0 +1,124 @@
+package tracey
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Writes the exits of a session, each function taking the durations given
+func baselineSession(calls map[string][]time.Duration) string {
+	var lines []string
+	for name, durations := range calls {
+		for _, d := range durations {
+			lines = append(lines, `{"v":1,"kind":"exit","time":"2020-01-01T00:00:00Z","tid":1,"depth":0,"name":"`+name+`","msg":"`+name+`","dur":`+strconv.FormatInt(int64(d), 10)+`}`)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func deltaWorkload(t *Tracer, clock *manualClock) {
+	for _, call := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"regressed", 40 * time.Millisecond},
+		{"improved", 10 * time.Millisecond},
+		{"unchanged", 21 * time.Millisecond},
+		{"added", 3 * time.Millisecond},
+	} {
+		func() {
+			defer t.StartNamed(call.name).End()
+			clock.advance(call.d)
+		}()
+	}
+}
+
+func TestDeltaMode(test *testing.T) {
+	var out, js lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Writer: &out}, {Writer: &js, Format: JSONFormat}},
+		Clock:                 clock.Now,
+		EnableInstrumentation: true,
+		MessageTemplates:      map[string]string{`.`: "$FN"},
+		DeltaMode:             true,
+	})
+	assert.Nil(test, t.LoadBaseline(strings.NewReader(baselineSession(map[string][]time.Duration{
+		"regressed": {8 * time.Millisecond, 12 * time.Millisecond},
+		"improved":  {40 * time.Millisecond},
+		"unchanged": {20 * time.Millisecond},
+	}))))
+	deltaWorkload(t, clock)
+
+	assert.Equal(test, "[ 0]EXIT:  regressed ... in 40ms (baseline 10ms, +300%)\n"+
+		"[ 0]EXIT:  improved ... in 10ms (baseline 40ms, -75%)\n"+
+		"[ 0]EXIT:  added ... in 3ms {new=true}\n", out.String())
+	exits := make(map[string]Event)
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		exits[ev.Name] = ev
+	}
+	assert.Len(test, exits, 3)
+	assert.Equal(test, 10*time.Millisecond, exits["regressed"].Baseline)
+	assert.Equal(test, []Tag{{"new", "true"}}, exits["added"].Tags)
+
+	// Every span is counted
+	assert.Len(test, t.Stats(), 4)
+}
+
+func TestDeltaThresholds(test *testing.T) {
+	baseline := baselineSession(map[string][]time.Duration{
+		"regressed": {10 * time.Millisecond},
+		"improved":  {40 * time.Millisecond},
+		"unchanged": {20 * time.Millisecond},
+	})
+	logged := func(opts Options) []string {
+		var out lockedBuffer
+		clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+		opts.Sinks, opts.Clock, opts.DeltaMode = []Sink{{Writer: &out}}, clock.Now, true
+		opts.MessageTemplates = map[string]string{`.`: "$FN"}
+		t := NewTracer(&opts)
+		assert.Nil(test, t.LoadBaseline(strings.NewReader(baseline)))
+		deltaWorkload(t, clock)
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			names = append(names, strings.Fields(line)[2])
+		}
+		return names
+	}
+	assert.Equal(test, []string{"regressed", "improved", "added"}, logged(Options{}))
+	// Within 5% is unchanged
+	assert.Equal(test, []string{"regressed", "improved", "added"}, logged(Options{DeltaThresholdPct: 5}))
+	assert.Equal(test, []string{"regressed", "improved", "unchanged", "added"}, logged(Options{DeltaThresholdPct: 4}))
+	// Both deviate by 30ms
+	assert.Equal(test, []string{"added"}, logged(Options{DeltaThresholdAbs: 30 * time.Millisecond}))
+	assert.Equal(test, []string{"regressed", "improved", "added"}, logged(Options{DeltaThresholdAbs: 30*time.Millisecond - 1}))
+}
+
+func TestLoadBaselineText(test *testing.T) {
+	var text lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	recorded := NewTracer(&Options{Sinks: []Sink{{Writer: &text}}, Clock: clock.Now, EnableInstrumentation: true})
+	for _, d := range []time.Duration{10 * time.Millisecond, 50 * time.Millisecond} {
+		span := recorded.Start("loading %s", "users")
+		clock.advance(d)
+		span.End()
+	}
+
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, Clock: clock.Now, EnableInstrumentation: true, DeltaMode: true})
+	assert.Nil(test, t.LoadBaseline(strings.NewReader(text.String())))
+	for _, d := range []time.Duration{31 * time.Millisecond, 90 * time.Millisecond} {
+		span := t.Start("loading %s", "users")
+		clock.advance(d)
+		span.End()
+	}
+	assert.Equal(test, "[ 0]EXIT:  =>loading users ... in 90ms (baseline 30ms, +200%)\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+
+	assert.EqualError(test, t.LoadBaseline(strings.NewReader("nothing to read\n")), "tracey: the baseline has no timed exits")
+}
@@ -0,0 +1,340 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// An OptionsSnapshot is every option a tracer runs under, as resolved
+// once the defaults were filled in and the mutable options updated, see
+// `Tracer.EffectiveOptions()`. Its options are listed in the order of
+// the fields of "Options", followed by the mutable options which have no
+// field of their own, "MinDurations", "MinLevels" and "FunctionOverrides".
+type OptionsSnapshot struct {
+	// The "SchemaVersion" of the tracer, the rendering of the values
+	// changing along with it
+	Version int
+
+	Options []OptionValue
+}
+
+// An OptionValue is an option of an `OptionsSnapshot`, its value
+// rendered as text. Functions, writers and such are "set" or "unset",
+// and the patterns of "Budgets", "FilterRules" and such are counted, as
+// in "3 patterns", rather than listed.
+type OptionValue struct {
+	Name  string
+	Value string
+}
+
+// An OptionDiff is an option which differs between two snapshots, see
+// `DiffSnapshots(...)`. "Before" or "After" is empty if the option is
+// missing from that snapshot.
+type OptionDiff struct {
+	Name          string
+	Before, After string
+}
+
+func (d OptionDiff) String() string {
+	return d.Name + " " + d.Before + " → " + d.After
+}
+
+// Value returns the value of the named option, and false if the snapshot
+// has none by that name.
+func (s OptionsSnapshot) Value(name string) (string, bool) {
+	for _, o := range s.Options {
+		if o.Name == name {
+			return o.Value, true
+		}
+	}
+	return "", false
+}
+
+// EffectiveOptions returns the options the tracer runs under, the
+// defaults filled in and the mutable options as they are now (see
+// `Update(...)`), such as to tell why a tracer behaves the way it does.
+func (t *Tracer) EffectiveOptions() OptionsSnapshot {
+	config := t.config.Load()
+	if config == nil {
+		config = &mutableConfig{MutableOptions: MutableOptions{MinLevel: t.options.MinLevel}}
+	}
+	return t.snapshot(config)
+}
+
+// WriteOptions writes `EffectiveOptions()` as aligned text, one option per
+// line as in "MinLevel        debug", or as a JSON object if "format" is
+// JSONFormat, as in {"v":1,"options":{"MinLevel":"debug",...}}.
+func (t *Tracer) WriteOptions(w io.Writer, format Format) error {
+	snapshot := t.EffectiveOptions()
+	if format == JSONFormat {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		renderOptionsJSON(buf, snapshot)
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	return writeOptionsText(w, snapshot)
+}
+
+func writeOptionsText(w io.Writer, snapshot OptionsSnapshot) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, o := range snapshot.Options {
+		fmt.Fprintf(tw, "%s\t%s\n", o.Name, o.Value)
+	}
+	return tw.Flush()
+}
+
+func renderOptionsJSON(buf *bytes.Buffer, snapshot OptionsSnapshot) {
+	buf.WriteString(`{"` + FieldVersion + `":`)
+	buf.WriteString(strconv.Itoa(snapshot.Version))
+	buf.WriteString(`,"options":{`)
+	for i, o := range snapshot.Options {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		appendJSONString(buf, o.Name)
+		buf.WriteByte(':')
+		appendJSONString(buf, o.Value)
+	}
+	buf.WriteString("}}\n")
+}
+
+// DiffSnapshots returns the options whose value differs between the two
+// snapshots, in the order of "b", followed by those only "a" has.
+func DiffSnapshots(a, b OptionsSnapshot) []OptionDiff {
+	before := make(map[string]string, len(a.Options))
+	for _, o := range a.Options {
+		before[o.Name] = o.Value
+	}
+	var diffs []OptionDiff
+	for _, o := range b.Options {
+		if was, ok := before[o.Name]; !ok || was != o.Value {
+			diffs = append(diffs, OptionDiff{o.Name, was, o.Value})
+		}
+		delete(before, o.Name)
+	}
+	for _, o := range a.Options {
+		if was, ok := before[o.Name]; ok {
+			diffs = append(diffs, OptionDiff{o.Name, was, ""})
+		}
+	}
+	return diffs
+}
+
+// Logs the options the tracer runs under, see "LogOptionsAtStartup"
+func (t *Tracer) logOptions() {
+	var b strings.Builder
+	b.WriteString("TRACEY OPTIONS v" + schemaVersionString + "\n")
+	writeOptionsText(&b, t.EffectiveOptions())
+	t.note(b.String())
+}
+
+// Lists the options, every field of "Options" by name. Fields added to
+// "Options" must be added here too, as `TestSnapshotComplete` checks.
+func (t *Tracer) snapshot(config *mutableConfig) OptionsSnapshot {
+	o := &t.options
+	nameMap := o.NameMap
+	if nm := t.nameMap.Load(); nm != nil {
+		nameMap = *nm
+	}
+	var options []OptionValue
+	add := func(name, value string) {
+		options = append(options, OptionValue{name, value})
+	}
+	add("DisableTracing", strconv.FormatBool(o.DisableTracing))
+	add("CustomLogger", isSet(o.CustomLogger != nil))
+	add("DisableDepthValue", strconv.FormatBool(o.DisableDepthValue))
+	add("DisableNesting", strconv.FormatBool(o.DisableNesting))
+	add("SpacesPerIndent", strconv.Itoa(o.SpacesPerIndent))
+	add("MaxIndentWidth", strconv.Itoa(o.MaxIndentWidth))
+	add("CompressLinearChains", strconv.FormatBool(o.CompressLinearChains))
+	add("EnterMessage", strconv.Quote(o.EnterMessage))
+	add("ExitMessage", strconv.Quote(o.ExitMessage))
+	add("WideCharAware", strconv.FormatBool(o.WideCharAware))
+	add("MaxMessageLen", strconv.Itoa(o.MaxMessageLen))
+	add("MaxArgs", strconv.Itoa(o.MaxArgs))
+	add("MaxFormatDepth", strconv.Itoa(o.MaxFormatDepth))
+	add("MaxElements", strconv.Itoa(o.MaxElements))
+	add("EnableInstrumentation", strconv.FormatBool(o.EnableInstrumentation))
+	add("AlignDurations", strconv.Itoa(o.AlignDurations))
+	add("NameFormatter", isSet(o.NameFormatter != nil))
+	add("NameMap", countOf(nameMap.size(), "rule"))
+	add("CaptureCallers", strconv.Itoa(o.CaptureCallers))
+	add("CaptureCallersAll", strconv.FormatBool(o.CaptureCallersAll))
+	add("MaxLines", strconv.FormatUint(o.MaxLines, 10))
+	add("MaxBytes", strconv.FormatUint(o.MaxBytes, 10))
+	add("Sinks", describeSinks(t.sinks))
+	add("SinkErrorHandler", isSet(o.SinkErrorHandler != nil))
+	add("SinkFailureThreshold", strconv.Itoa(o.SinkFailureThreshold))
+	add("FallbackWriter", isSet(o.FallbackWriter != nil))
+	add("SinkRetryInterval", o.SinkRetryInterval.String())
+	add("StreamBufferBytes", strconv.Itoa(o.StreamBufferBytes))
+	add("StreamDropReportInterval", o.StreamDropReportInterval.String())
+	add("CollapseRepeats", strconv.FormatBool(o.CollapseRepeats))
+	add("Clock", isSet(o.Clock != nil))
+	add("Sleep", isSet(o.Sleep != nil))
+	add("ClockResolutionFloor", o.ClockResolutionFloor.String())
+	add("ExcludeApproximateStats", strconv.FormatBool(o.ExcludeApproximateStats))
+	add("DetectCaching", strconv.FormatBool(o.DetectCaching))
+	add("CacheSpeedupFactor", formatFloat(o.CacheSpeedupFactor))
+	add("ShowConcurrency", strconv.FormatBool(o.ShowConcurrency))
+	add("InFlightIdleTimeout", o.InFlightIdleTimeout.String())
+	add("CSVWriter", isSet(o.CSVWriter != nil))
+	add("TSV", strconv.FormatBool(o.TSV))
+	add("MinLevel", config.MinLevel.String())
+	add("MessageTemplates", fmt.Sprint(sortedTemplates(config.MessageTemplates)))
+	add("FlushOnPanic", strconv.FormatBool(o.FlushOnPanic))
+	add("CrashWriter", isSet(o.CrashWriter != nil))
+	add("IDGenerator", fmt.Sprintf("%T", o.IDGenerator))
+	add("ShowIDs", strconv.FormatBool(o.ShowIDs))
+	add("PropagateTaskPanics", strconv.FormatBool(o.PropagateTaskPanics))
+	add("ValueRenderer", isSet(o.ValueRenderer != nil))
+	add("WatchCancellation", strconv.FormatBool(o.WatchCancellation))
+	add("ShowCheckpoints", strconv.FormatBool(o.ShowCheckpoints))
+	add("CheckpointSummary", strconv.FormatBool(o.CheckpointSummary))
+	add("WarnLateCheckpoints", strconv.FormatBool(o.WarnLateCheckpoints))
+	add("SuppressSubtrees", fmt.Sprint(config.SuppressSubtrees))
+	add("FilterRules", countOf(len(o.FilterRules), "rule"))
+	add("EnableBlockProfiling", strconv.FormatBool(o.EnableBlockProfiling))
+	add("BlockProfileMinDuration", o.BlockProfileMinDuration.String())
+	add("EnableRuntimeMetrics", strconv.FormatBool(o.EnableRuntimeMetrics))
+	add("RuntimeMetricsTopLevelOnly", strconv.FormatBool(o.RuntimeMetricsTopLevelOnly))
+	add("EnableCPUTime", strconv.FormatBool(o.EnableCPUTime))
+	add("LockThread", strconv.FormatBool(o.LockThread))
+	add("TrackOutputVolume", strconv.FormatBool(o.TrackOutputVolume))
+	add("OutputVolumeMinLines", strconv.Itoa(o.OutputVolumeMinLines))
+	add("AttributeMetricsToSpans", strconv.FormatBool(o.AttributeMetricsToSpans))
+	add("HighlightChanges", strconv.FormatBool(o.HighlightChanges))
+	add("ChangeMemorySize", strconv.Itoa(o.ChangeMemorySize))
+	add("SkipUnchanged", strconv.FormatBool(o.SkipUnchanged))
+	add("DeltaMode", strconv.FormatBool(o.DeltaMode))
+	add("DeltaThresholdPct", formatFloat(o.DeltaThresholdPct))
+	add("DeltaThresholdAbs", o.DeltaThresholdAbs.String())
+	add("ErrorClassifier", isSet(o.ErrorClassifier != nil))
+	add("RedactError", isSet(o.RedactError != nil))
+	add("TopErrorClasses", strconv.Itoa(o.TopErrorClasses))
+	add("MaxAttemptDetail", strconv.Itoa(o.MaxAttemptDetail))
+	add("PropagateContextOnError", strconv.FormatBool(o.PropagateContextOnError))
+	add("ErrorAncestryDepth", strconv.Itoa(o.ErrorAncestryDepth))
+	add("ProgressInterval", o.ProgressInterval.String())
+	add("SessionID", strconv.Quote(o.SessionID))
+	add("BuildInfoPerEvent", strconv.FormatBool(o.BuildInfoPerEvent))
+	add("Prefix", strconv.Quote(o.Prefix))
+	add("EscalateOnError", strconv.FormatBool(o.EscalateOnError))
+	add("EscalationBufferLines", strconv.Itoa(o.EscalationBufferLines))
+	add("TailSampling", strconv.FormatBool(o.TailSampling))
+	add("TailBufferLines", strconv.Itoa(o.TailBufferLines))
+	add("TailMinDuration", o.TailMinDuration.String())
+	add("TailKeepRate", formatFloat(o.TailKeepRate))
+	add("TailDecision", isSet(o.TailDecision != nil))
+	add("PercentOfRoot", strconv.FormatBool(o.PercentOfRoot))
+	add("BundleOnError", describeBundles(o.BundleOnError))
+	add("ShowSuspensions", strconv.FormatBool(o.ShowSuspensions))
+	add("WarnAfter", o.WarnAfter.String())
+	add("WarnWithStack", strconv.FormatBool(o.WarnWithStack))
+	add("WarnStackFrames", strconv.Itoa(o.WarnStackFrames))
+	add("WarnStackInterval", o.WarnStackInterval.String())
+	add("HandoffTimeout", o.HandoffTimeout.String())
+	add("Middleware", countOf(len(o.Middleware), "middleware"))
+	add("MaxTraceLatency", o.MaxTraceLatency.String())
+	add("Router", isSet(o.Router != nil))
+	add("DefaultRoute", fmt.Sprint(o.DefaultRoute))
+	add("AuditConfigChanges", strconv.FormatBool(o.AuditConfigChanges))
+	add("Budgets", countOf(len(o.Budgets), "pattern"))
+	add("LatencyInjection", countOf(len(o.LatencyInjection), "pattern"))
+	add("InjectionRand", isSet(o.InjectionRand != nil))
+	add("TimelineBuffer", strconv.Itoa(o.TimelineBuffer))
+	add("TimelineBufferBytes", strconv.Itoa(o.TimelineBufferBytes))
+	add("MaxAttachedLines", strconv.Itoa(o.MaxAttachedLines))
+	add("MaxAttachedBytes", strconv.Itoa(o.MaxAttachedBytes))
+	add("AlwaysRenderAttachments", strconv.FormatBool(o.AlwaysRenderAttachments))
+	add("AttachPendingTimeout", o.AttachPendingTimeout.String())
+	add("GoroutineStateTTL", o.GoroutineStateTTL.String())
+	add("StrictAudit", strconv.FormatBool(o.StrictAudit))
+	add("EventHandler", isSet(o.EventHandler != nil))
+	add("HandlerOrdering", o.HandlerOrdering.String())
+	add("WarnLateRename", strconv.FormatBool(o.WarnLateRename))
+	add("AbandonAfter", o.AbandonAfter.String())
+	add("AbandonAfterFuncs", countOf(len(o.AbandonAfterFuncs), "pattern"))
+	add("LogOptionsAtStartup", strconv.FormatBool(o.LogOptionsAtStartup))
+	add("PoolClose", o.PoolClose.String())
+	add("PoolErrorHandler", isSet(o.PoolErrorHandler != nil))
+	add("CloseTimeout", o.CloseTimeout.String())
+	add("OperationMap", countOf(len(o.OperationMap), "pattern"))
+	add("SilentAlerts", strconv.FormatBool(o.SilentAlerts))
+	add("CaptureSource", strconv.FormatBool(o.CaptureSource))
+	add("SourceRoot", o.SourceRoot)
+	add("MaxPins", strconv.Itoa(o.MaxPins))
+	add("BundlePinned", strconv.FormatBool(o.BundlePinned))
+	add("ObservationBuckets", countOf(len(o.ObservationBuckets), "metric"))
+
+	add("MinDurations", fmt.Sprint(config.MinDurations))
+	add("MinLevels", fmt.Sprint(config.MinLevels))
+	add("FunctionOverrides", fmt.Sprint(config.FunctionOverrides))
+	return OptionsSnapshot{SchemaVersion, options}
+}
+
+func isSet(set bool) string {
+	if set {
+		return "set"
+	}
+	return "unset"
+}
+
+// Counts the entries of an option, as in "3 patterns"
+func countOf(n int, noun string) string {
+	if n != 1 && !strings.HasSuffix(noun, "ware") {
+		noun += "s"
+	}
+	return strconv.Itoa(n) + " " + noun
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Describes the sinks, as in "[text colorized, json async]", their
+// "MinDuration" and "MinLevel" being listed under "MinDurations" and
+// "MinLevels"
+func describeSinks(sinks []*sinkState) string {
+	parts := make([]string, len(sinks))
+	for i, s := range sinks {
+		part := s.Format.String()
+		if s.Async {
+			part += " async"
+		}
+		if s.Audit {
+			part += " audit"
+		}
+		if s.Colorize {
+			part += " colorized"
+		}
+		parts[i] = part
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+func describeBundles(c BundleConfig) string {
+	if c.Dir == "" {
+		return "unset"
+	}
+	return fmt.Sprintf("%q, %d per hour, %d bytes, %d events", c.Dir, c.MaxPerHour, c.MaxBytes, c.MaxEvents)
+}
+
+func (h HandlerOrdering) String() string {
+	if h == Delivery {
+		return "delivery"
+	}
+	return "emission"
+}
+
+func (c PoolClose) String() string {
+	if c == CancelPending {
+		return "cancel"
+	}
+	return "drain"
+}
@@ -0,0 +1,86 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotComplete(test *testing.T) {
+	snapshot := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}}).EffectiveOptions()
+	names := make(map[string]bool)
+	for _, o := range snapshot.Options {
+		assert.False(test, names[o.Name], "%s is listed twice", o.Name)
+		names[o.Name] = true
+	}
+	fields := reflect.TypeOf(Options{})
+	for i := 0; i < fields.NumField(); i++ {
+		if field := fields.Field(i); field.IsExported() {
+			assert.True(test, names[field.Name], "%s is missing from the snapshot", field.Name)
+		}
+	}
+	assert.Equal(test, fields.NumField()+3, len(snapshot.Options))
+	assert.Equal(test, SchemaVersion, snapshot.Version)
+}
+
+func TestEffectiveOptions(test *testing.T) {
+	t := NewTracer(&Options{
+		Sinks:   []Sink{{Writer: &bytes.Buffer{}}, {Writer: &bytes.Buffer{}, Format: JSONFormat, Async: true}},
+		Budgets: map[string]time.Duration{"^secret": time.Second, "^other": time.Second},
+	})
+	before := t.EffectiveOptions()
+	value := func(s OptionsSnapshot, name string) string {
+		v, ok := s.Value(name)
+		assert.True(test, ok, name)
+		return v
+	}
+	// Filled in from the struct tags
+	assert.Equal(test, `"ENTER: "`, value(before, "EnterMessage"))
+	assert.Equal(test, "[text, json async]", value(before, "Sinks"))
+	assert.Equal(test, "2 patterns", value(before, "Budgets"))
+	assert.Equal(test, "unset", value(before, "Router"))
+
+	assert.Nil(test, t.Update(func(o *MutableOptions) {
+		o.MinLevel = Debug
+		o.MinDurations[1] = time.Millisecond
+	}))
+	after := t.EffectiveOptions()
+	assert.Equal(test, []OptionDiff{
+		{"MinLevel", "trace", "debug"},
+		{"MinDurations", "[0s 0s]", "[0s 1ms]"},
+	}, DiffSnapshots(before, after))
+	assert.Equal(test, []OptionDiff{{"Extra", "", "1"}, {"Gone", "2", ""}}, DiffSnapshots(
+		OptionsSnapshot{Options: []OptionValue{{"Gone", "2"}, {"Same", "3"}}},
+		OptionsSnapshot{Options: []OptionValue{{"Same", "3"}, {"Extra", "1"}}}))
+}
+
+func TestWriteOptions(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}, MinLevel: Info})
+	var text, js bytes.Buffer
+	assert.Nil(test, t.WriteOptions(&text, TextFormat))
+	assert.Regexp(test, "(?m)^MinLevel +info$", text.String())
+	assert.Equal(test, len(t.EffectiveOptions().Options), strings.Count(text.String(), "\n"))
+
+	assert.Nil(test, t.WriteOptions(&js, JSONFormat))
+	var decoded struct {
+		V       int               `json:"v"`
+		Options map[string]string `json:"options"`
+	}
+	assert.Nil(test, json.Unmarshal(js.Bytes(), &decoded))
+	assert.Equal(test, SchemaVersion, decoded.V)
+	assert.Equal(test, "info", decoded.Options["MinLevel"])
+}
+
+func TestLogOptionsAtStartup(test *testing.T) {
+	var out bytes.Buffer
+	NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, SessionID: "session1", LogOptionsAtStartup: true})
+	lines := strings.Split(out.String(), "\n")
+	assert.True(test, strings.HasPrefix(lines[0], sessionHeaderPrefix))
+	assert.Equal(test, "TRACEY OPTIONS v1", lines[1])
+	assert.Regexp(test, `^DisableTracing +false$`, lines[2])
+}
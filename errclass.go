@@ -0,0 +1,207 @@
+package tracey
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// How long the example messages of error classes may be, longer ones are
+// cut and end in "..."
+const errorExampleLen = 120
+
+// DefaultTopErrorClasses is how many error classes `DumpStats(...)` lists
+// per function, unless "TopErrorClasses" says otherwise.
+const DefaultTopErrorClasses = 3
+
+// ErrorClassStats counts the failed calls to a function whose error fell
+// into a single class, see `Tracer.ErrorBreakdown(...)`.
+type ErrorClassStats struct {
+	Count uint64
+
+	// The message of the first error of the class, redacted (see
+	// "RedactError") and cut to 120 bytes
+	Example string
+}
+
+// A class registered with `RegisterErrorClass(...)`
+type errorClass struct {
+	name string
+
+	// Either the sentinel error matched with `errors.Is(...)`, or the type
+	// matched with `errors.As(...)`
+	sentinel error
+	target   reflect.Type
+}
+
+var errorClasses struct {
+	sync.RWMutex
+	classes []errorClass
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// RegisterErrorClass names a class of errors for the statistics of failed
+// spans (see `Tracer.ErrorBreakdown(...)`). The matcher is either a
+// sentinel error, matched with `errors.Is(...)`, or a nil pointer of an
+// error type, matched with `errors.As(...)`, as in
+//
+//	tracey.RegisterErrorClass("not found", sql.ErrNoRows)
+//	tracey.RegisterErrorClass("path", (*fs.PathError)(nil))
+//
+// so that wrapped errors are classified by what they wrap. Classes are
+// tried in the order they were registered, the first match wins. It
+// panics on any other kind of matcher.
+func RegisterErrorClass(name string, matcher interface{}) {
+	class := errorClass{name: name}
+	v := reflect.ValueOf(matcher)
+	switch {
+	case matcher == nil:
+		panic("tracey: RegisterErrorClass needs a sentinel error or a nil pointer of an error type")
+	case v.Kind() == reflect.Ptr && v.IsNil() && v.Type().Implements(errorType):
+		class.target = v.Type()
+	case v.Type().Implements(errorType):
+		class.sentinel = matcher.(error)
+	default:
+		panic(fmt.Sprintf("tracey: RegisterErrorClass needs a sentinel error or a nil pointer of an error type, not %T", matcher))
+	}
+	errorClasses.Lock()
+	errorClasses.classes = append(errorClasses.classes, class)
+	errorClasses.Unlock()
+}
+
+// Derives the class of an error: from the "ErrorClassifier" if it names
+// one, else from the registered classes, else from the type of the error
+func (t *Tracer) classifyError(err error) string {
+	if t.options.ErrorClassifier != nil {
+		if class := t.options.ErrorClassifier(err); class != "" {
+			return class
+		}
+	}
+	errorClasses.RLock()
+	defer errorClasses.RUnlock()
+	for _, class := range errorClasses.classes {
+		if class.sentinel != nil {
+			if errors.Is(err, class.sentinel) {
+				return class.name
+			}
+			continue
+		}
+		if errors.As(err, reflect.New(class.target).Interface()) {
+			return class.name
+		}
+	}
+	return reflect.TypeOf(err).String()
+}
+
+// Define the regexes used by the default redaction of error messages
+var (
+	RE_quotedText = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`)
+	RE_number     = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+)
+
+// RedactErrorMessage is the default "RedactError" function, it replaces
+// quoted text and numbers in the message with "?".
+func RedactErrorMessage(msg string) string {
+	msg = RE_quotedText.ReplaceAllString(msg, "?")
+	return RE_number.ReplaceAllString(msg, "?")
+}
+
+// Renders the example message of an error class
+func (t *Tracer) errorExample(err error) string {
+	redact := t.options.RedactError
+	if redact == nil {
+		redact = RedactErrorMessage
+	}
+	return TruncateMessage(redact(err.Error()), errorExampleLen)
+}
+
+// Counts a failed call in its error class. Must be called with the lock
+// of the function's statistics held.
+func (t *Tracer) recordError(fs *funcStats, class string, err error) {
+	if fs.errors == nil {
+		fs.errors = make(map[string]*ErrorClassStats)
+	}
+	cs := fs.errors[class]
+	if cs == nil {
+		cs = &ErrorClassStats{Example: t.errorExample(err)}
+		fs.errors[class] = cs
+	}
+	cs.Count++
+}
+
+// ErrorBreakdown returns the failed calls to the function named "fn" so
+// far, by error class (see `RegisterErrorClass(...)`). It returns nil if
+// none of the calls failed.
+func (t *Tracer) ErrorBreakdown(fn string) map[string]ErrorClassStats {
+	value, ok := t.stats.funcs.Load(fn)
+	if !ok {
+		return nil
+	}
+	fs := value.(*funcStats)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if len(fs.errors) == 0 {
+		return nil
+	}
+	breakdown := make(map[string]ErrorClassStats, len(fs.errors))
+	for class, cs := range fs.errors {
+		breakdown[class] = *cs
+	}
+	return breakdown
+}
+
+// Writes the most frequent error classes of each function which had any
+// failed calls, as in
+//
+//	main.fetch: 5 failed
+//		3 × not found: "user ? not found"
+func (t *Tracer) dumpErrors(w io.Writer, all []FuncStats) error {
+	top := t.options.TopErrorClasses
+	if top <= 0 {
+		top = DefaultTopErrorClasses
+	}
+	wrote := false
+	for _, s := range all {
+		if s.Failed == 0 {
+			continue
+		}
+		breakdown := t.ErrorBreakdown(s.Name)
+		classes := make([]string, 0, len(breakdown))
+		for class := range breakdown {
+			classes = append(classes, class)
+		}
+		sort.Slice(classes, func(i, j int) bool {
+			a, b := breakdown[classes[i]], breakdown[classes[j]]
+			if a.Count != b.Count {
+				return a.Count > b.Count
+			}
+			return classes[i] < classes[j]
+		})
+		if !wrote {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+			wrote = true
+		}
+		if _, err := fmt.Fprintf(w, "%s: %d failed\n", s.Name, s.Failed); err != nil {
+			return err
+		}
+		for i, class := range classes {
+			if i == top {
+				if _, err := fmt.Fprintf(w, "\t(%d more classes)\n", len(classes)-top); err != nil {
+					return err
+				}
+				break
+			}
+			if _, err := fmt.Fprintf(w, "\t%d × %s: %q\n", breakdown[class].Count, class, breakdown[class].Example); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
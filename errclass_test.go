@@ -0,0 +1,125 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errTestNotFound = errors.New("not found")
+
+type quotaError struct{ limit int }
+
+func (e *quotaError) Error() string { return fmt.Sprintf("over quota of %d", e.limit) }
+
+func init() {
+	RegisterErrorClass("not found", errTestNotFound)
+	RegisterErrorClass("quota", (*quotaError)(nil))
+}
+
+type plainError struct{}
+
+func (plainError) Error() string { return "plain" }
+
+func failing(t *Tracer, err error) {
+	span := t.Start()
+	span.SetError(err)
+	span.End()
+}
+
+func TestErrorBreakdown(test *testing.T) {
+	t := NewTracer(&Options{CustomLogger: log.New(io.Discard, "", 0)})
+	failing(t, fmt.Errorf("user %q: %w", "alice", errTestNotFound))
+	failing(t, fmt.Errorf("lookup: %w", fmt.Errorf("user 42: %w", errTestNotFound)))
+	failing(t, fmt.Errorf("upload: %w", &quotaError{100}))
+	failing(t, errors.New("disk on fire"))
+	failing(t, plainError{})
+	failing(t, nil)
+
+	assert.Equal(test, map[string]ErrorClassStats{
+		"not found":           {2, "user ?: not found"},
+		"quota":               {1, "upload: over quota of ?"},
+		"*errors.errorString": {1, "disk on fire"},
+		"tracey.plainError":   {1, "plain"},
+	}, t.ErrorBreakdown("go-tracey.failing"))
+	assert.Nil(test, t.ErrorBreakdown("go-tracey.nothing"))
+
+	stats := statsOf(t, "go-tracey.failing")
+	assert.Equal(test, uint64(6), stats.Calls)
+	assert.Equal(test, uint64(5), stats.Failed)
+}
+
+func TestErrorClassifier(test *testing.T) {
+	t := NewTracer(&Options{
+		CustomLogger: log.New(io.Discard, "", 0),
+		ErrorClassifier: func(err error) string {
+			if strings.HasPrefix(err.Error(), "http ") {
+				return "http " + err.Error()[5:8]
+			}
+			return ""
+		},
+		RedactError: strings.ToUpper,
+	})
+	failing(t, errors.New("http 503 from upstream"))
+	failing(t, errors.New("http 503 again"))
+	failing(t, fmt.Errorf("wrapped: %w", errTestNotFound))
+	failing(t, errors.New(strings.Repeat("long ", 40)))
+
+	breakdown := t.ErrorBreakdown("go-tracey.failing")
+	assert.Equal(test, ErrorClassStats{2, "HTTP 503 FROM UPSTREAM"}, breakdown["http 503"])
+	assert.Equal(test, ErrorClassStats{1, "WRAPPED: NOT FOUND"}, breakdown["not found"])
+	assert.Equal(test, strings.Repeat("LONG ", 20)+"L…(+99B truncated)", breakdown["*errors.errorString"].Example)
+}
+
+func TestConcurrentFailures(test *testing.T) {
+	t := NewTracer(&Options{CustomLogger: log.New(io.Discard, "", 0)})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				if n%2 == 0 {
+					failing(t, fmt.Errorf("worker %d: %w", i, errTestNotFound))
+				} else {
+					failing(t, &quotaError{n})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	breakdown := t.ErrorBreakdown("go-tracey.failing")
+	assert.Equal(test, uint64(200), breakdown["not found"].Count)
+	assert.Equal(test, uint64(200), breakdown["quota"].Count)
+	assert.Equal(test, "over quota of ?", breakdown["quota"].Example)
+}
+
+func TestDumpStatsErrors(test *testing.T) {
+	t := NewTracer(&Options{CustomLogger: log.New(io.Discard, "", 0), TopErrorClasses: 2})
+	failing(t, errTestNotFound)
+	failing(t, errTestNotFound)
+	failing(t, &quotaError{1})
+	failing(t, plainError{})
+	t.Enter()()
+
+	var buf bytes.Buffer
+	assert.Nil(test, t.DumpStats(&buf))
+	assert.True(test, strings.HasSuffix(buf.String(), `
+go-tracey.failing: 4 failed
+	2 × not found: "not found"
+	1 × quota: "over quota of ?"
+	(1 more classes)
+`), buf.String())
+}
+
+func TestRegisterErrorClassPanics(test *testing.T) {
+	assert.Panics(test, func() { RegisterErrorClass("nil", nil) })
+	assert.Panics(test, func() { RegisterErrorClass("string", "not an error") })
+}
@@ -0,0 +1,112 @@
+package tracey
+
+import "sync"
+
+// DefaultEscalationBufferLines is how many filtered out lines a call tree
+// retains for "EscalateOnError", unless "EscalationBufferLines" is set.
+const DefaultEscalationBufferLines = 512
+
+// The lines of a top-level call tree which the filters kept from some of
+// the sinks, retained in case a span of the tree fails, see
+// "EscalateOnError". The spans of a tree share it, down to those of the
+// goroutines of a `Group()` started within it.
+type escalation struct {
+	sync.Mutex
+	lines []retainedEvent
+
+	// The oldest lines are dropped past the limit, and counted
+	dropped uint64
+
+	// Set once the top-level span has exited
+	done bool
+}
+
+type retainedEvent struct {
+	ev Event
+
+	// Set if the span was below "MinLevel", and so logged by none of the
+	// sinks
+	muted bool
+}
+
+// Gives the span the call tree it belongs to, a new one if it is a
+// top-level span
+func (t *Tracer) joinTree(span *Span, parent *Span) {
+	if within := t.enclosing(span.ev.TID, parent); within != nil && within.tree != nil {
+		span.tree = within.tree
+	} else {
+		span.tree = &escalation{}
+		span.treeRoot = true
+	}
+}
+
+// Returns true if some sink filtered out the event of the span
+func (t *Tracer) filteredOut(span *Span, ev *Event) bool {
+	if span.muted {
+		return true
+	}
+	for _, s := range t.sinks {
+		if !s.accepts(ev) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retains the event of the span if some sink filtered it out. Spans
+// hidden by "SuppressSubtrees" are left out, those are meant not to be
+// seen.
+func (t *Tracer) retain(span *Span, ev *Event) {
+	if span.muted && !span.belowLevel || !t.filteredOut(span, ev) {
+		return
+	}
+	tree := span.tree
+	limit := t.options.EscalationBufferLines
+	if limit <= 0 {
+		limit = DefaultEscalationBufferLines
+	}
+	tree.Lock()
+	defer tree.Unlock()
+	if tree.done {
+		return
+	}
+	if len(tree.lines) >= limit {
+		n := len(tree.lines) - limit + 1
+		tree.dropped += uint64(n)
+		tree.lines = append(tree.lines[:0], tree.lines[n:]...)
+	}
+	t.sequence(ev)
+	tree.lines = append(tree.lines, retainedEvent{*ev, span.muted})
+}
+
+// Handles the exit of a span of a tree: retains it, replays the tree's
+// retained lines if the span failed, and lets go of them once the
+// top-level span is done
+func (t *Tracer) escalateExit(span *Span, ev *Event) {
+	t.retain(span, ev)
+	tree := span.tree
+	tree.Lock()
+	var replay []retainedEvent
+	var dropped uint64
+	if ev.Err != nil && !tree.done {
+		replay, dropped = tree.lines, tree.dropped
+		tree.lines, tree.dropped = nil, 0
+	}
+	if span.treeRoot {
+		tree.done = true
+		tree.lines = nil
+	}
+	tree.Unlock()
+
+	if dropped > 0 {
+		warning := "TRACE REPLAY — " + formatCount(dropped) + " earlier lines of the failed call tree dropped\n"
+		if t.admitOutput(len(warning)) {
+			t.note(warning)
+		}
+	}
+	for i := range replay {
+		r := &replay[i]
+		r.ev.Replayed = true
+		t.emitTo(&r.ev, func(s *sinkState, ev *Event) bool { return r.muted || !s.accepts(ev) })
+	}
+}
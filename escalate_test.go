@@ -0,0 +1,105 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serveOrder(t *Tracer, fail bool, queries int) {
+	span := t.Start(Info, "%s", "serve")
+	defer span.End()
+	loadOrder(t, fail, queries)
+}
+
+func loadOrder(t *Tracer, fail bool, queries int) {
+	span := t.Start("%s", "load")
+	defer span.End()
+	for i := 0; i < queries; i++ {
+		t.Start("query(%d)", i).End()
+	}
+	query := t.Start("%s", "final query")
+	if fail {
+		query.SetError(errors.New("connection reset"))
+	}
+	query.End()
+}
+
+func TestEscalateOnError(test *testing.T) {
+	var text, slow bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:           []Sink{{Logger: log.New(&text, "", 0)}, {Writer: &slow, Format: JSONFormat, MinDuration: time.Hour}},
+		MinLevel:        Info,
+		EscalateOnError: true,
+	})
+	serveOrder(t, true, 1)
+
+	assert.Equal(test, []string{
+		"[ 0]ENTER: INF =>serve",
+		"[ 1]  «replayed» ENTER: =>load",
+		"[ 2]    «replayed» ENTER: =>query(0)",
+		"[ 2]    «replayed» EXIT:  =>query(0)",
+		"[ 2]    «replayed» ENTER: =>final query",
+		"[ 2]    «replayed» EXIT:  =>final query (error: connection reset)",
+		"[ 0]EXIT:  INF =>serve",
+	}, strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(text.String(), "=>")), "\n"))
+
+	// The slow sink gets the serve span replayed as well, with its
+	// original time
+	var events []Event
+	for _, line := range strings.Split(strings.TrimSpace(slow.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		assert.True(test, ev.Replayed)
+		events = append(events, ev)
+	}
+	assert.Equal(test, 6, len(events))
+	assert.Equal(test, "serve", events[0].Message)
+	assert.Equal(test, EnterEvent, events[0].Kind)
+	assert.False(test, events[0].Time.After(events[1].Time))
+}
+
+func TestEscalateOnSuccess(test *testing.T) {
+	var text bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Logger: log.New(&text, "", 0)}}, MinLevel: Info, EscalateOnError: true})
+	serveOrder(t, false, 3)
+	assert.Equal(test, 2, strings.Count(text.String(), "serve"))
+	assert.NotContains(test, text.String(), "replayed")
+
+	// The tree let go of its lines, a later failure replays its own only
+	var span *Span
+	func() {
+		defer t.Enter(Info, "%s", "serve")()
+		span = t.Start("%s", "lone")
+		span.SetError(errors.New("boom"))
+		span.End()
+	}()
+	assert.Equal(test, 1, strings.Count(text.String(), "«replayed» ENTER"))
+	assert.Nil(test, span.tree.lines)
+}
+
+func TestEscalationBufferOverflow(test *testing.T) {
+	var text bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Logger: log.New(&text, "", 0)}},
+		MinLevel:              Info,
+		EscalateOnError:       true,
+		EscalationBufferLines: 4,
+	})
+	serveOrder(t, true, 5)
+
+	assert.Equal(test, []string{
+		"[ 0]ENTER: INF =>serve",
+		"TRACE REPLAY — 9 earlier lines of the failed call tree dropped",
+		"[ 2]    «replayed» ENTER: =>query(4)",
+		"[ 2]    «replayed» EXIT:  =>query(4)",
+		"[ 2]    «replayed» ENTER: =>final query",
+		"[ 2]    «replayed» EXIT:  =>final query (error: connection reset)",
+		"[ 0]EXIT:  INF =>serve",
+	}, strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(text.String(), "=>")), "\n"))
+}
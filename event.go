@@ -0,0 +1,955 @@
+package tracey
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// EventKind tells enter events apart from exit events.
+type EventKind int
+
+const (
+	EnterEvent EventKind = iota
+	ExitEvent
+
+	// A milestone within a span, see `Span.Event(...)`
+	PointEvent
+
+	// The header written once at the start of a session, see "SessionID"
+	SessionEvent
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case ExitEvent:
+		return "exit"
+	case PointEvent:
+		return "event"
+	case SessionEvent:
+		return "session"
+	}
+	return "enter"
+}
+
+// An Event describes a single enter or exit. Each event is built once by
+// the tracer, and then rendered by every sink it is written to.
+type Event struct {
+	Kind  EventKind
+	Time  time.Time
+	TID   uint64
+	Depth int
+
+	// Numbers the events of a tracer in the order they were traced, from
+	// 1 up, whatever order the sinks get them in (0 for the events read
+	// back from output which has none)
+	Seq uint64
+
+	// Identifies the trace and the span, and the span it was started
+	// within on the same goroutine (empty if none), see "IDGenerator"
+	TraceID  string
+	SpanID   string
+	ParentID string
+
+	// The session the process belongs to, see "SessionID"
+	Session string
+
+	// The build of the binary, only set on session headers unless
+	// "BuildInfoPerEvent" is set, and nil if the binary has none
+	Build *BuildInfo
+
+	// Set on the events logged late, once a span of their call tree
+	// failed, see "EscalateOnError"
+	Replayed bool
+
+	// Set on the enter and exit events of spans restored from a snapshot,
+	// see `Tracer.Restore(...)`
+	Restored bool
+
+	// The level the call was traced at
+	Level Level
+
+	// The name of the traced function, and the message it was traced
+	// with (if any) with "$FN" already replaced
+	Name    string
+	Message string
+
+	// The name the span was entered with, only set on the exit events of
+	// spans renamed since, see `Span.Rename(...)`
+	OriginalName string
+
+	// The logical operation the call was part of, if any, see
+	// `WithOperation(...)`
+	Operation string
+
+	// Set on the events of pinned call trees, see `Tracer.Pin(...)`
+	Pinned bool
+
+	// The time spent in the traced function on exit events, and the time
+	// since the span was entered on point events
+	Duration time.Duration
+
+	// Set on exit events whose duration was below "ClockResolutionFloor",
+	// "Duration" being the floor
+	Approximate bool
+
+	// Set on the exit events of spans which were force-closed for being
+	// open too long, see "AbandonAfter"
+	Abandoned bool
+
+	// The callers of a depth-0 function, see "CaptureCallers"
+	Callers []string
+
+	// What the goroutine of the span was doing, only set on STILL RUNNING
+	// warnings, see "WarnWithStack"
+	Stack string
+
+	// The number of goroutines inside the function, only set on enter
+	// events when "ShowConcurrency" is
+	InFlight int64
+
+	// What the span was tagged with, and failed with (if anything)
+	Tags []Tag
+	Err  error
+
+	// What the span panicked with, its type, and the frames from the
+	// line which panicked up to the traced function, innermost first,
+	// only set on the exit events of calls which panicked, see
+	// `Call1(...)`
+	PanicValue string
+	PanicType  string
+	PanicStack []Frame
+
+	// The spans open around a failed span, outermost first, only set on
+	// exit events, see "PropagateContextOnError"
+	Ancestry []SpanSummary
+
+	// The milestones logged within the span, only set on exit events
+	Events []SpanEvent
+
+	// The phases of the span, only set on exit events, see
+	// `Span.Checkpoint(...)`
+	Checkpoints []Checkpoint
+
+	// The last progress the span reported, only set on exit events, see
+	// `Span.SetProgress(...)`
+	Progress *Progress
+
+	// The time the span was running for, and the segments it ran in, only
+	// set on the exit events of spans which were suspended, whose
+	// "Duration" is the time since they were entered, see
+	// `Span.Suspend()`
+	Active   time.Duration
+	Segments []Segment
+
+	// What was left of the budget the span runs within when it started,
+	// if it runs within one, see `WithBudget(...)`
+	Budget *Budget
+
+	// The latency injected into the call, which its "Duration" leaves
+	// out, see "LatencyInjection"
+	Injected time.Duration
+
+	// The goroutines which owned the span in turn, only set on the exit
+	// events of spans which were handed off, see `Span.Transfer()`
+	Owners []uint64
+
+	// The number of calls hidden within the span, see "SuppressSubtrees"
+	HiddenCalls uint64
+
+	// Roughly how long the process spent blocked while the span was open,
+	// only set on exit events, see "EnableBlockProfiling"
+	BlockedApprox time.Duration
+
+	// How the runtime changed while the span was open, only set on exit
+	// events, see "EnableRuntimeMetrics"
+	Runtime *RuntimeDelta
+
+	// The CPU time the span's thread spent while the span was open, only
+	// set on exit events, see "EnableCPUTime", along with whether the
+	// thread may have run other goroutines meanwhile
+	CPUTime   time.Duration
+	CPUApprox bool
+
+	// The share of the top-level span of its tree the span took, in
+	// percents, only set on exit events, see "PercentOfRoot", or whether
+	// the tree had too many events to tell, on its top-level exit
+	Percent        int
+	HasPercent     bool
+	PercentOmitted bool
+
+	// The mean duration of the function in the baseline, only set on the
+	// exit events "DeltaMode" logs for deviating from it
+	Baseline time.Duration
+
+	// The lines, and their bytes, written while the span was open, only
+	// set on exit events of spans which logged enough, see
+	// "TrackOutputVolume"
+	LoggedLines, LoggedBytes uint64
+
+	// The lines attached to the span, oldest first, only set on exit
+	// events, see `AttachLog(...)`
+	Attached []string
+
+	// Whether the context of the span was done by the time it exited, and
+	// why, see `StartContext(...)`
+	Cancelled bool
+	CtxErr    string
+
+	// Data attached by integrations, rendered in JSON under its own "x"
+	// key so that it never collides with the fields above
+	ExtraFields map[string]interface{}
+
+	// The function and message, the way they are rendered in text output
+	// unless the function matched one of the "MessageTemplates"
+	text     string
+	template *messageTemplate
+
+	// The name the ENTER line of a renamed span was written with, which
+	// its EXIT line notes, see `Span.Rename(...)`
+	enteredAs string
+
+	// The option overrides in effect when the span was entered, if any
+	overrides *OptionOverrides
+
+	// The mutable options the event was traced under, see `Update(...)`
+	config *mutableConfig
+
+	// Set on the events of the spans an adopted tracer entered, see
+	// `Adopt(...)`
+	adopted *adoption
+
+	// The goroutine the event is being emitted on, while it is known, see
+	// `sinkState.write(...)`
+	emitter uint64
+
+	// How long the span had until its context's deadline, if it had one
+	ctxLimit time.Duration
+
+	// The values of the tags, as rendered by "ValueRenderer" and such
+	tagValues []string
+
+	// How many of the tags, the first ones, are the fields of an
+	// `EnterF(...)`, which text lines show in the message instead
+	fields int
+
+	// Set on the point events which log a checkpoint as it happens, and
+	// on heartbeats
+	checkpoint *Checkpoint
+	progress   *Progress
+	pause      *pauseMark
+
+	// Set on the warnings of "WarnAfter"
+	stillRunning bool
+
+	// The deadline an abandoned span missed
+	abandonAfter time.Duration
+
+	// The signature of the function, see "CaptureSource"
+	signature string
+
+	// The sinks the event goes to, set on the events of routed trees, see
+	// "Router", and the trees it is buffered in, see "TailSampling" and
+	// "BundleOnError"
+	route  *route
+	tail   *tailTree
+	bundle *bundleTree
+
+	// How the tags changed since the last call, and whether nothing did,
+	// see "HighlightChanges"
+	changes   *tagChanges
+	unchanged bool
+
+	// How many levels the span's indentation is short of its depth, and
+	// whether it is the first or the second span within its parent, see
+	// "CompressLinearChains"
+	collapsed         int
+	chained, expanded bool
+}
+
+// Buffers used to render events, reused to keep the per-sink cost down
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	bufferPool.Put(buf)
+}
+
+// ANSI colors used by sinks with "Colorize" set
+const (
+	colorEnter = "\x1b[32m"
+	colorExit  = "\x1b[36m"
+	colorReset = "\x1b[0m"
+)
+
+// Renders the depth value and indentation which start every text line
+func (t *Tracer) renderIndent(buf *bytes.Buffer, depth int) {
+	t.renderIndented(buf, depth, depth)
+}
+
+// Writes the depth value and the indentation of "levels" levels, which
+// are fewer than the depth for the spans of "CompressLinearChains"
+func (t *Tracer) renderIndented(buf *bytes.Buffer, depth, levels int) {
+	if !t.options.DisableNesting {
+		if !t.options.DisableDepthValue {
+			buf.WriteByte('[')
+			if depth < 10 {
+				buf.WriteByte(' ')
+			}
+			writeInt(buf, int64(depth))
+			buf.WriteByte(']')
+		}
+		width := levels * t.options.SpacesPerIndent
+		if max := t.options.MaxIndentWidth; max > 0 && width > max {
+			writeRun(buf, spaceRun, max-1)
+			buf.WriteString(indentCut)
+			return
+		}
+		writeRun(buf, spaceRun, width)
+	}
+}
+
+// Renders an event the way tracey always has, as in
+// "[ 1]  ENTER: [tid:1]=>main.foo(1)".
+func (t *Tracer) renderText(buf *bytes.Buffer, ev *Event, colorize bool) {
+	options := &t.options
+	if ev.Kind == SessionEvent {
+		renderSessionHeader(buf, ev)
+		return
+	}
+	lineStart := buf.Len()
+	if ev.Session != "" {
+		buf.WriteString("[s:")
+		buf.WriteString(shortSessionID(ev.Session))
+		buf.WriteByte(']')
+	}
+	t.renderIndented(buf, ev.Depth, ev.Depth-ev.collapsed)
+	indentEnd := buf.Len()
+	if ev.chained && ev.Kind == EnterEvent {
+		buf.WriteString(chainMarker)
+	}
+	if ev.Replayed {
+		buf.WriteString("«replayed» ")
+	}
+	if ev.Restored {
+		buf.WriteString("«restored» ")
+	}
+	if ev.Kind == PointEvent {
+		if ev.progress != nil {
+			buf.WriteString("⏳ ")
+			buf.WriteString(ev.Name)
+			buf.WriteByte(' ')
+			buf.WriteString(ev.Message)
+			buf.WriteString(" — running ")
+			buf.WriteString(ev.Duration.Round(time.Second).String())
+			buf.WriteString(" [tid:")
+			buf.WriteString(strconv.FormatUint(ev.TID, 10))
+			buf.WriteString("]\n")
+			return
+		}
+		if ev.stillRunning {
+			// The stack lines up under the warning
+			indent := strings.Repeat(" ", displayWidth(buf.Bytes()[lineStart:], options.WideCharAware)+4)
+			buf.WriteString("⚠ STILL RUNNING ")
+			buf.WriteString(ev.Name)
+			buf.WriteString(" — running ")
+			buf.WriteString(ev.Duration.Round(time.Second).String())
+			buf.WriteString(" [tid:")
+			buf.WriteString(strconv.FormatUint(ev.TID, 10))
+			buf.WriteString("]\n")
+			if ev.Stack != "" {
+				for _, line := range strings.Split(ev.Stack, "\n") {
+					buf.WriteString(indent)
+					buf.WriteString(line)
+					buf.WriteByte('\n')
+				}
+			}
+			return
+		}
+		if ev.pause != nil {
+			if ev.pause.resumed {
+				buf.WriteString("▶ ")
+				buf.WriteString(ev.Name)
+				buf.WriteString(" resumed (idle ")
+			} else {
+				buf.WriteString("⏸ ")
+				buf.WriteString(ev.Name)
+				buf.WriteString(" suspended (active ")
+			}
+			buf.WriteString(formatDuration(ev.pause.d))
+			buf.WriteString(")\n")
+			return
+		}
+		if ev.checkpoint != nil {
+			buf.WriteString("✓ ")
+			buf.WriteString(ev.Message)
+			buf.WriteString(" done (+")
+			buf.WriteString(formatDuration(ev.checkpoint.Delta))
+			buf.WriteString(")\n")
+			return
+		}
+		// Point events which do not belong to a span have no name
+		buf.WriteString("· ")
+		buf.WriteString(ev.Message)
+		if ev.Name != "" {
+			buf.WriteString(" (at +")
+			buf.WriteString(formatDuration(ev.Duration))
+			buf.WriteByte(')')
+		}
+		buf.WriteByte('\n')
+		return
+	}
+
+	marker, color := options.EnterMessage, colorEnter
+	if ev.Kind == ExitEvent {
+		marker, color = options.ExitMessage, colorExit
+	}
+	if colorize {
+		buf.WriteString(color)
+		buf.WriteString(marker)
+		buf.WriteString(colorReset)
+	} else {
+		buf.WriteString(marker)
+	}
+	if ev.Level != Trace {
+		buf.WriteString(ev.Level.tag())
+		buf.WriteByte(' ')
+	}
+
+	if ev.template != nil {
+		ev.template.render(buf, ev)
+	} else {
+		buf.WriteString(ev.text)
+	}
+	if ev.enteredAs != "" && ev.Kind == ExitEvent {
+		renderRenamed(buf, ev)
+	}
+	if ev.expanded && ev.Kind == EnterEvent {
+		buf.WriteString(chainExpanded)
+	}
+	if ev.Operation != "" {
+		renderOperation(buf, ev)
+	}
+	if ev.Pinned {
+		buf.WriteString(" [pinned]")
+	}
+	if len(ev.Callers) > 0 {
+		buf.WriteString(" via ")
+		buf.WriteString(strings.Join(ev.Callers, " ← "))
+	}
+	if options.ShowIDs && ev.SpanID != "" {
+		buf.WriteString(" [trace=")
+		buf.WriteString(ev.TraceID)
+		buf.WriteString(" span=")
+		buf.WriteString(ev.SpanID)
+		buf.WriteByte(']')
+	}
+	if ev.InFlight > 0 {
+		buf.WriteString(" [inflight=")
+		buf.WriteString(strconv.FormatInt(ev.InFlight, 10))
+		buf.WriteByte(']')
+	}
+	if ev.Budget != nil && ev.Kind == EnterEvent {
+		renderBudget(buf, ev)
+	}
+	if ev.Injected > 0 && ev.Kind == EnterEvent {
+		renderInjected(buf, ev)
+	}
+	if ev.Kind == ExitEvent {
+		instrument := options.EnableInstrumentation
+		if ev.overrides != nil && ev.overrides.EnableInstrumentation != nil {
+			instrument = *ev.overrides.EnableInstrumentation
+		}
+		if instrument && (ev.template == nil || !ev.template.hasDur) {
+			dots := 3
+			if options.AlignDurations > 0 {
+				width := displayWidth(buf.Bytes()[lineStart:], options.WideCharAware)
+				if colorize {
+					width -= len(colorExit) + len(colorReset)
+				}
+				if fill := options.AlignDurations - width - 2; fill > dots {
+					dots = fill
+				}
+			}
+			buf.WriteByte(' ')
+			writeRun(buf, dotRun, dots)
+			buf.WriteString(" in ")
+			if ev.Approximate {
+				buf.WriteByte('<')
+			}
+			writeDuration(buf, ev.Duration)
+			if len(ev.Segments) > 0 {
+				buf.WriteString(" (active ")
+				writeDuration(buf, ev.Active)
+				buf.WriteString(" in ")
+				writeInt(buf, int64(len(ev.Segments)))
+				buf.WriteString(" segments)")
+			}
+		}
+		if ev.Abandoned {
+			renderAbandoned(buf, ev)
+		}
+		if ev.CPUTime > 0 {
+			renderCPUTime(buf, ev)
+		}
+		if ev.Baseline > 0 {
+			renderBaseline(buf, ev)
+		}
+		if ev.HasPercent || ev.PercentOmitted {
+			renderPercent(buf, ev)
+		}
+		changes := ev.changes
+		if len(ev.Tags) > ev.fields || (changes != nil && len(changes.removed) > 0) {
+			buf.WriteString(" {")
+			for i, tag := range ev.Tags {
+				if i < ev.fields {
+					continue
+				}
+				if i > ev.fields {
+					buf.WriteByte(' ')
+				}
+				if changes != nil && changes.marks[i] == tagAdded {
+					buf.WriteByte('+')
+				}
+				buf.WriteString(tag.Key)
+				buf.WriteByte('=')
+				if changes != nil && changes.marks[i] == tagChanged {
+					buf.WriteString(changes.before[i])
+					buf.WriteString("→")
+				}
+				buf.WriteString(ev.tagValue(i))
+			}
+			if changes != nil {
+				for i, key := range changes.removed {
+					if i > 0 || len(ev.Tags) > ev.fields {
+						buf.WriteByte(' ')
+					}
+					buf.WriteByte('-')
+					buf.WriteString(key)
+				}
+			}
+			buf.WriteByte('}')
+		}
+		if ev.Budget != nil {
+			renderBudget(buf, ev)
+		}
+		if ev.Injected > 0 {
+			renderInjected(buf, ev)
+		}
+		if len(ev.Owners) > 0 {
+			buf.WriteString(" [owners ")
+			buf.WriteString(renderOwners(ev.Owners))
+			buf.WriteByte(']')
+		}
+		if ev.Progress != nil {
+			buf.WriteString(" [progress ")
+			buf.WriteString(ev.Progress.String())
+			buf.WriteByte(']')
+		}
+		if options.CheckpointSummary && len(ev.Checkpoints) > 0 {
+			buf.WriteString(" [")
+			for i, cp := range ev.Checkpoints {
+				if i > 0 {
+					buf.WriteString(" | ")
+				}
+				buf.WriteString(cp.Name)
+				buf.WriteByte(' ')
+				buf.WriteString(formatDuration(cp.Delta))
+			}
+			buf.WriteByte(']')
+		}
+		if ev.Err != nil {
+			buf.WriteString(" (error: ")
+			buf.WriteString(ev.Err.Error())
+			buf.WriteByte(')')
+		}
+		if len(ev.PanicStack) > 0 {
+			buf.WriteByte(' ')
+			renderPanicOrigin(buf, ev.PanicStack)
+		}
+		if len(ev.Ancestry) > 0 {
+			buf.WriteString(" within: ")
+			buf.WriteString(renderAncestry(ev.Ancestry))
+		}
+		if ev.Cancelled {
+			buf.WriteString(" (")
+			buf.WriteString(describeCtxErr(ev.CtxErr, ev.ctxLimit))
+			buf.WriteByte(')')
+		}
+		if ev.BlockedApprox > 0 {
+			buf.WriteString(" (~blocked ")
+			buf.WriteString(formatDuration(ev.BlockedApprox))
+			buf.WriteByte(')')
+		}
+		if ev.Runtime != nil {
+			buf.WriteString(" (")
+			buf.WriteString(ev.Runtime.String())
+			buf.WriteByte(')')
+		}
+		if ev.LoggedLines > 0 {
+			buf.WriteByte(' ')
+			buf.WriteString(formatOutputVolume(ev.LoggedLines, ev.LoggedBytes))
+		}
+		if ev.HiddenCalls > 0 {
+			buf.WriteString(" (+")
+			buf.WriteString(strconv.FormatUint(ev.HiddenCalls, 10))
+			buf.WriteString(" nested calls hidden)")
+		}
+	}
+	buf.WriteByte('\n')
+	if len(ev.Attached) > 0 && ev.Kind == ExitEvent && (ev.Err != nil || options.AlwaysRenderAttachments) {
+		renderAttached(buf, ev.Attached, displayWidth(buf.Bytes()[lineStart:indentEnd], options.WideCharAware))
+	}
+}
+
+// Renders an event as a single line of JSON, as in
+// {"v":1,"kind":"exit","time":"...","tid":1,"depth":1,"trace":"1","span":"2","parent":"1","name":"main.foo","msg":"main.foo(1)","dur":1250}
+// where "dur" is in nanoseconds, as is the "at" offset of point events.
+// See `SchemaVersion` for the fields.
+func renderJSON(buf *bytes.Buffer, ev *Event) {
+	buf.WriteString(`{"` + FieldVersion + `":` + schemaVersionString + `,"` + FieldKind + `":"`)
+	buf.WriteString(ev.Kind.String())
+	buf.WriteString(`","` + FieldTime + `":"`)
+	var ts [40]byte
+	buf.Write(ev.Time.AppendFormat(ts[:0], time.RFC3339Nano))
+	buf.WriteString(`","` + FieldTID + `":`)
+	buf.WriteString(strconv.FormatUint(ev.TID, 10))
+	buf.WriteString(`,"` + FieldDepth + `":`)
+	buf.WriteString(strconv.Itoa(ev.Depth))
+	if ev.Seq != 0 {
+		buf.WriteString(`,"` + FieldSeq + `":`)
+		buf.WriteString(strconv.FormatUint(ev.Seq, 10))
+	}
+	if ev.Session != "" {
+		buf.WriteString(`,"` + FieldSession + `":`)
+		appendJSONString(buf, ev.Session)
+	}
+	if ev.Build != nil {
+		buf.WriteString(`,"` + FieldBuildInfo + `":`)
+		buf.Write(ev.Build.json)
+	}
+	if ev.Replayed {
+		buf.WriteString(`,"` + FieldReplayed + `":true`)
+	}
+	if ev.Restored {
+		buf.WriteString(`,"` + FieldRestored + `":true`)
+	}
+	if ev.SpanID != "" {
+		buf.WriteString(`,"` + FieldTrace + `":`)
+		appendJSONString(buf, ev.TraceID)
+		buf.WriteString(`,"` + FieldSpan + `":`)
+		appendJSONString(buf, ev.SpanID)
+		if ev.ParentID != "" {
+			buf.WriteString(`,"` + FieldParent + `":`)
+			appendJSONString(buf, ev.ParentID)
+		}
+	}
+	if ev.Level != Trace {
+		buf.WriteString(`,"` + FieldLevel + `":"`)
+		buf.WriteString(ev.Level.String())
+		buf.WriteByte('"')
+	}
+	buf.WriteString(`,"` + FieldName + `":`)
+	appendJSONString(buf, ev.Name)
+	buf.WriteString(`,"` + FieldMsg + `":`)
+	appendJSONString(buf, ev.Message)
+	if ev.OriginalName != "" {
+		buf.WriteString(`,"` + FieldOrigName + `":`)
+		appendJSONString(buf, ev.OriginalName)
+	}
+	if ev.Operation != "" {
+		buf.WriteString(`,"` + FieldOperation + `":`)
+		appendJSONString(buf, ev.Operation)
+	}
+	if ev.Pinned {
+		buf.WriteString(`,"` + FieldPinned + `":true`)
+	}
+	if ev.Kind == ExitEvent {
+		buf.WriteString(`,"` + FieldDur + `":`)
+		buf.WriteString(strconv.FormatInt(int64(ev.Duration), 10))
+		if len(ev.Tags) > 0 {
+			buf.WriteString(`,"` + FieldTags + `":{`)
+			for i, tag := range ev.Tags {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				appendJSONString(buf, tag.Key)
+				buf.WriteByte(':')
+				appendJSONString(buf, ev.tagValue(i))
+			}
+			buf.WriteByte('}')
+		}
+		if ev.Err != nil {
+			buf.WriteString(`,"` + FieldErr + `":`)
+			appendJSONString(buf, ev.Err.Error())
+		}
+		if ev.PanicType != "" {
+			buf.WriteString(`,"` + FieldPanic + `":{"value":`)
+			appendJSONString(buf, ev.PanicValue)
+			buf.WriteString(`,"type":`)
+			appendJSONString(buf, ev.PanicType)
+			buf.WriteString(`,"stack":[`)
+			for i, f := range ev.PanicStack {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(`{"fn":`)
+				appendJSONString(buf, f.Function)
+				buf.WriteString(`,"file":`)
+				appendJSONString(buf, f.File)
+				buf.WriteString(`,"line":`)
+				writeInt(buf, int64(f.Line))
+				buf.WriteByte('}')
+			}
+			buf.WriteString(`]}`)
+		}
+		if len(ev.Ancestry) > 0 {
+			buf.WriteString(`,"` + FieldAncestry + `":[`)
+			for i, s := range ev.Ancestry {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(`{"` + FieldName + `":`)
+				appendJSONString(buf, s.Name)
+				buf.WriteString(`,"` + FieldMsg + `":`)
+				appendJSONString(buf, s.Message)
+				if len(s.Tags) > 0 {
+					buf.WriteString(`,"` + FieldTags + `":{`)
+					for j, tag := range s.Tags {
+						if j > 0 {
+							buf.WriteByte(',')
+						}
+						appendJSONString(buf, tag.Key)
+						buf.WriteByte(':')
+						appendJSONString(buf, tag.Value.(string))
+					}
+					buf.WriteByte('}')
+				}
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(']')
+		}
+		if ev.Cancelled {
+			buf.WriteString(`,"` + FieldCtxErr + `":`)
+			appendJSONString(buf, ev.CtxErr)
+		}
+		if len(ev.Events) > 0 {
+			buf.WriteString(`,"` + FieldEvents + `":[`)
+			for i, e := range ev.Events {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(`{"` + FieldAt + `":`)
+				buf.WriteString(strconv.FormatInt(int64(e.Offset), 10))
+				buf.WriteString(`,"` + FieldMsg + `":`)
+				appendJSONString(buf, e.Message)
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(']')
+		}
+		if ev.Progress != nil {
+			buf.WriteString(`,"` + FieldProgress + `":{"done":`)
+			buf.WriteString(strconv.FormatInt(ev.Progress.Done, 10))
+			buf.WriteString(`,"total":`)
+			buf.WriteString(strconv.FormatInt(ev.Progress.Total, 10))
+			buf.WriteByte('}')
+		}
+		if ev.BlockedApprox > 0 {
+			buf.WriteString(`,"` + FieldBlocked + `":`)
+			buf.WriteString(strconv.FormatInt(int64(ev.BlockedApprox), 10))
+		}
+		if ev.CPUTime > 0 {
+			buf.WriteString(`,"` + FieldCPU + `":`)
+			buf.WriteString(strconv.FormatInt(int64(ev.CPUTime), 10))
+			if ev.CPUApprox {
+				buf.WriteString(`,"` + FieldCPUApprox + `":true`)
+			}
+		}
+		if ev.Baseline > 0 {
+			buf.WriteString(`,"` + FieldBaseline + `":`)
+			buf.WriteString(strconv.FormatInt(int64(ev.Baseline), 10))
+		}
+		if ev.HasPercent {
+			buf.WriteString(`,"` + FieldPercent + `":`)
+			buf.WriteString(strconv.Itoa(ev.Percent))
+		} else if ev.PercentOmitted {
+			buf.WriteString(`,"` + FieldPercent + `":null`)
+		}
+		if len(ev.Attached) > 0 {
+			buf.WriteString(`,"` + FieldAttached + `":[`)
+			for i, line := range ev.Attached {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				appendJSONString(buf, line)
+			}
+			buf.WriteByte(']')
+		}
+		if ev.LoggedLines > 0 {
+			buf.WriteString(`,"` + FieldLogged + `":{"lines":`)
+			buf.WriteString(strconv.FormatUint(ev.LoggedLines, 10))
+			buf.WriteString(`,"bytes":`)
+			buf.WriteString(strconv.FormatUint(ev.LoggedBytes, 10))
+			buf.WriteByte('}')
+		}
+		if r := ev.Runtime; r != nil {
+			buf.WriteString(`,"` + FieldRuntime + `":{"gc":`)
+			buf.WriteString(strconv.FormatUint(r.GCCycles, 10))
+			buf.WriteString(`,"pause":`)
+			buf.WriteString(strconv.FormatInt(int64(r.GCPause), 10))
+			buf.WriteString(`,"goroutines":[`)
+			buf.WriteString(strconv.FormatUint(r.GoroutinesEnter, 10))
+			buf.WriteByte(',')
+			buf.WriteString(strconv.FormatUint(r.GoroutinesExit, 10))
+			buf.WriteString(`]}`)
+		}
+		if ev.Approximate {
+			buf.WriteString(`,"` + FieldApprox + `":true`)
+		}
+		if ev.Abandoned {
+			buf.WriteString(`,"` + FieldAbandoned + `":true`)
+		}
+		if len(ev.Segments) > 0 {
+			buf.WriteString(`,"` + FieldActive + `":`)
+			buf.WriteString(strconv.FormatInt(int64(ev.Active), 10))
+			buf.WriteString(`,"` + FieldSegments + `":[`)
+			for i, seg := range ev.Segments {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(`{"` + FieldAt + `":`)
+				buf.WriteString(strconv.FormatInt(int64(seg.Offset), 10))
+				buf.WriteString(`,"` + FieldDur + `":`)
+				buf.WriteString(strconv.FormatInt(int64(seg.Duration), 10))
+				buf.WriteString(`,"` + FieldTID + `":`)
+				buf.WriteString(strconv.FormatUint(seg.TID, 10))
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(']')
+		}
+		if len(ev.Owners) > 0 {
+			buf.WriteString(`,"` + FieldOwners + `":[`)
+			for i, tid := range ev.Owners {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(strconv.FormatUint(tid, 10))
+			}
+			buf.WriteByte(']')
+		}
+		if len(ev.Checkpoints) > 0 {
+			buf.WriteString(`,"` + FieldCheckpoints + `":[`)
+			for i, cp := range ev.Checkpoints {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				buf.WriteString(`{"` + FieldName + `":`)
+				appendJSONString(buf, cp.Name)
+				buf.WriteString(`,"` + FieldAt + `":`)
+				buf.WriteString(strconv.FormatInt(int64(cp.Offset), 10))
+				buf.WriteString(`,"` + FieldDur + `":`)
+				buf.WriteString(strconv.FormatInt(int64(cp.Delta), 10))
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(']')
+		}
+	}
+	if ev.InFlight > 0 {
+		buf.WriteString(`,"` + FieldInFlight + `":`)
+		buf.WriteString(strconv.FormatInt(ev.InFlight, 10))
+	}
+	if ev.Budget != nil {
+		buf.WriteString(`,"` + FieldBudget + `":`)
+		buf.WriteString(strconv.FormatInt(int64(ev.Budget.Left), 10))
+	}
+	if ev.Injected > 0 {
+		buf.WriteString(`,"` + FieldInjected + `":`)
+		buf.WriteString(strconv.FormatInt(int64(ev.Injected), 10))
+	}
+	if ev.Kind == PointEvent && ev.Name != "" {
+		buf.WriteString(`,"` + FieldAt + `":`)
+		buf.WriteString(strconv.FormatInt(int64(ev.Duration), 10))
+	}
+	if len(ev.Callers) > 0 {
+		buf.WriteString(`,"` + FieldCallers + `":[`)
+		for i, caller := range ev.Callers {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			appendJSONString(buf, caller)
+		}
+		buf.WriteByte(']')
+	}
+	if ev.Stack != "" {
+		buf.WriteString(`,"` + FieldStack + `":`)
+		appendJSONString(buf, ev.Stack)
+	}
+	if ev.HiddenCalls > 0 {
+		buf.WriteString(`,"` + FieldHidden + `":`)
+		buf.WriteString(strconv.FormatUint(ev.HiddenCalls, 10))
+	}
+	if len(ev.ExtraFields) > 0 {
+		buf.WriteString(`,"` + FieldExtra + `":`)
+		appendJSONValue(buf, ev.ExtraFields)
+	}
+	buf.WriteString("}\n")
+}
+
+// Renders a line which is not an event (warnings and such) as JSON
+func renderJSONNote(buf *bytes.Buffer, note string) {
+	buf.WriteString(`{"` + FieldVersion + `":` + schemaVersionString + `,"` + FieldKind + `":"note","` + FieldMsg + `":`)
+	appendJSONString(buf, strings.TrimSuffix(note, "\n"))
+	buf.WriteString("}\n")
+}
+
+// Writes "s" as a quoted JSON string
+func appendJSONString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= 0x20 && c != '"' && c != '\\' && c < utf8.RuneSelf {
+			buf.WriteByte(c)
+			i++
+			continue
+		}
+		switch c {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if c < 0x20 {
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hex[c>>4])
+				buf.WriteByte(hex[c&0xf])
+				break
+			}
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				buf.WriteString(`�`)
+			} else {
+				buf.WriteString(s[i : i+size])
+			}
+			i += size
+			continue
+		}
+		i++
+	}
+	buf.WriteByte('"')
+}
@@ -0,0 +1,39 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendJSONString(test *testing.T) {
+	for _, s := range []string{"plain", `"quoted" \ back`, "new\nline\ttab", "\x01ctl", "ünïcode ← ok", "bad \xff byte"} {
+		var buf bytes.Buffer
+		appendJSONString(&buf, s)
+
+		var decoded string
+		assert.Nil(test, json.Unmarshal(buf.Bytes(), &decoded), buf.String())
+		if s == "bad \xff byte" {
+			assert.Equal(test, "bad � byte", decoded)
+		} else {
+			assert.Equal(test, s, decoded)
+		}
+	}
+}
+
+func TestRenderJSON(test *testing.T) {
+	var buf bytes.Buffer
+	renderJSON(&buf, &Event{
+		Kind:     ExitEvent,
+		Time:     time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		TID:      7,
+		Depth:    1,
+		Name:     "main.foo",
+		Message:  "main.foo(1)",
+		Duration: 1250,
+	})
+	assert.Equal(test, `{"v":1,"kind":"exit","time":"2020-01-02T03:04:05.000000006Z","tid":7,"depth":1,"name":"main.foo","msg":"main.foo(1)","dur":1250}`+"\n", buf.String())
+}
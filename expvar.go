@@ -0,0 +1,203 @@
+package tracey
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// How many functions "top_functions" publishes at most, see
+// `PublishExpvar(...)`
+const expvarTopFunctions = 10
+
+// Serializes the publications, so that two of them cannot both find a
+// name free
+var expvarPublishing sync.Mutex
+
+// The bookkeeping of `PublishExpvar(...)`: whether the tracer published
+// any variables, and what they were frozen at by `Close()`
+type expvars struct {
+	published uint32
+	frozen    atomic.Pointer[map[string]interface{}]
+}
+
+// PublishExpvar publishes the health and statistics of the tracer as
+// expvar variables, named after "prefix" as in "tracey.open_spans":
+//
+//	open_spans     the spans open right now
+//	goroutines     the goroutines the tracer keeps the depth of
+//	async          for each "Async" sink, the bytes queued, the most it
+//	               queues and the lines it dropped
+//	sink_errors    for each sink, its failed writes and the lines which
+//	               fell back and were dropped, see `SinkHealth()`
+//	quota          the lines and bytes left before "MaxLines" and
+//	               "MaxBytes" (null if unlimited)
+//	calls          the calls traced, in all
+//	traced_ns      the time spent in them, in all
+//	top_functions  the calls and time of the 10 functions with the most
+//	               time spent in them, by name
+//	instruments    the value of every counter and gauge, by name, see
+//	               `Counter(...)`
+//	observations   the count, mean, p50, p95 and max of the values of
+//	               each metric, by function and metric, see
+//	               `Span.Observe(...)`
+//
+// The values are computed whenever the variables are read, say by the
+// handler of the "expvar" package, and once the tracer is closed they
+// stay at what they were then. It returns an error, publishing nothing,
+// if any of the names is taken already, as they are by the previous call
+// with the same prefix.
+func (t *Tracer) PublishExpvar(prefix string) error {
+	values := t.expvarValues()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	expvarPublishing.Lock()
+	defer expvarPublishing.Unlock()
+	for _, name := range names {
+		if expvar.Get(prefix+"."+name) != nil {
+			return fmt.Errorf("tracey: expvar %q is already published", prefix+"."+name)
+		}
+	}
+	for _, name := range names {
+		name, value := name, values[name]
+		expvar.Publish(prefix+"."+name, expvar.Func(func() interface{} {
+			if frozen := t.expvars.frozen.Load(); frozen != nil {
+				return (*frozen)[name]
+			}
+			return value()
+		}))
+	}
+	atomic.StoreUint32(&t.expvars.published, 1)
+	return nil
+}
+
+// Returns what computes the value of each variable of
+// `PublishExpvar(...)`, by name
+func (t *Tracer) expvarValues() map[string]func() interface{} {
+	return map[string]func() interface{}{
+		"open_spans": func() interface{} {
+			_, open := t.goroutines.counts()
+			return open
+		},
+		"goroutines": func() interface{} {
+			records, _ := t.goroutines.counts()
+			return records
+		},
+		"async":         t.expvarAsync,
+		"sink_errors":   t.expvarSinkErrors,
+		"quota":         t.expvarQuota,
+		"calls":         func() interface{} { return t.expvarTotals().calls },
+		"traced_ns":     func() interface{} { return t.expvarTotals().total },
+		"top_functions": t.expvarTopFunctions,
+		"instruments":   t.expvarInstruments,
+		"observations":  t.expvarObservations,
+	}
+}
+
+// Freezes the published variables at their current values, see `Close()`
+func (t *Tracer) freezeExpvars() {
+	if atomic.LoadUint32(&t.expvars.published) == 0 {
+		return
+	}
+	values := t.expvarValues()
+	frozen := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		frozen[name] = value()
+	}
+	t.expvars.frozen.CompareAndSwap(nil, &frozen)
+}
+
+// Returns how many goroutines have a record, and how many spans are open
+// on them. The shards are locked one at a time.
+func (g *goroutines) counts() (records, open int) {
+	for i := range g.shards {
+		shard := &g.shards[i]
+		shard.Lock()
+		records += len(shard.g)
+		for _, record := range shard.g {
+			open += len(record.open)
+		}
+		shard.Unlock()
+	}
+	return records, open
+}
+
+func (t *Tracer) expvarAsync() interface{} {
+	queues := []map[string]interface{}{}
+	for _, s := range t.sinks {
+		if s.async == nil {
+			continue
+		}
+		q := s.async
+		q.Lock()
+		queued := q.bytes
+		q.Unlock()
+		queues = append(queues, map[string]interface{}{
+			"queued_bytes": queued,
+			"limit_bytes":  q.limit,
+			"dropped":      atomic.LoadUint64(q.overflows),
+		})
+	}
+	return queues
+}
+
+func (t *Tracer) expvarSinkErrors() interface{} {
+	errs := make([]map[string]interface{}, len(t.sinks))
+	for i, s := range t.sinks {
+		health := s.health()
+		errs[i] = map[string]interface{}{
+			"failed":    health.Failed,
+			"fell_back": health.FellBack,
+			"dropped":   health.Dropped,
+		}
+	}
+	return errs
+}
+
+func (t *Tracer) expvarQuota() interface{} {
+	lines, bytes := t.QuotaRemaining()
+	quota := map[string]interface{}{"lines": nil, "bytes": nil}
+	if t.options.MaxLines != 0 {
+		quota["lines"] = lines
+	}
+	if t.options.MaxBytes != 0 {
+		quota["bytes"] = bytes
+	}
+	return quota
+}
+
+type expvarTotals struct {
+	calls uint64
+	total int64
+}
+
+func (t *Tracer) expvarTotals() expvarTotals {
+	var totals expvarTotals
+	t.stats.funcs.Range(func(_, value interface{}) bool {
+		fs := value.(*funcStats)
+		totals.calls += atomic.LoadUint64(&fs.calls)
+		totals.total += atomic.LoadInt64(&fs.total)
+		return true
+	})
+	return totals
+}
+
+func (t *Tracer) expvarTopFunctions() interface{} {
+	stats := t.Stats()
+	// Stable, so that ties stay in the order of the names
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].Total > stats[j].Total })
+	if len(stats) > expvarTopFunctions {
+		stats = stats[:expvarTopFunctions]
+	}
+	top := make(map[string]interface{}, len(stats))
+	for _, s := range stats {
+		top[s.Name] = map[string]interface{}{"calls": s.Calls, "total_ns": int64(s.Total)}
+	}
+	return top
+}
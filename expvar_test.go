@@ -0,0 +1,93 @@
+package tracey
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Numbers the prefixes of `expvarPrefix(...)`
+var expvarPrefixes uint64
+
+// Returns a prefix to publish the variables of the test under, which no
+// other run of it used, as the variables of the "expvar" package are
+// there for good
+func expvarPrefix(test *testing.T) string {
+	return test.Name() + strconv.FormatUint(atomic.AddUint64(&expvarPrefixes, 1), 10)
+}
+
+// Reads the variables published under the prefix through the handler of
+// the "expvar" package
+func readExpvars(test *testing.T, prefix string) map[string]interface{} {
+	recorder := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/vars", nil))
+	var all map[string]json.RawMessage
+	assert.Nil(test, json.Unmarshal(recorder.Body.Bytes(), &all))
+	vars := make(map[string]interface{})
+	for _, name := range []string{"open_spans", "goroutines", "async", "sink_errors", "quota", "calls", "traced_ns", "top_functions", "instruments", "observations"} {
+		var value interface{}
+		assert.Nil(test, json.Unmarshal(all[prefix+"."+name], &value), name)
+		vars[name] = value
+	}
+	return vars
+}
+
+func TestPublishExpvar(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:    []Sink{{Writer: &out, Async: true}, {Writer: failingWriter{}}},
+		Clock:    clock.Now,
+		MaxLines: 100,
+
+		SinkErrorHandler: func(error) {},
+	})
+	prefix := expvarPrefix(test)
+	assert.Nil(test, t.PublishExpvar(prefix))
+	err := t.PublishExpvar(prefix)
+	assert.Equal(test, `tracey: expvar "`+prefix+`.async" is already published`, err.Error())
+
+	checkout := t.StartNamed("checkout")
+	for i := 0; i < 3; i++ {
+		price := t.StartNamed("price")
+		clock.advance(10 * time.Millisecond)
+		price.End()
+	}
+	t.Flush()
+
+	vars := readExpvars(test, prefix)
+	assert.Equal(test, 1.0, vars["open_spans"])
+	assert.Equal(test, 1.0, vars["goroutines"])
+	assert.Equal(test, []interface{}{map[string]interface{}{
+		"queued_bytes": 0.0, "limit_bytes": float64(DefaultAsyncBufferBytes), "dropped": 0.0,
+	}}, vars["async"])
+	assert.Equal(test, []interface{}{
+		map[string]interface{}{"failed": 0.0, "fell_back": 0.0, "dropped": 0.0},
+		map[string]interface{}{"failed": 7.0, "fell_back": 0.0, "dropped": 7.0},
+	}, vars["sink_errors"])
+	// Each of the 7 lines is charged for both sinks
+	assert.Equal(test, map[string]interface{}{"lines": 86.0, "bytes": nil}, vars["quota"])
+	assert.Equal(test, 3.0, vars["calls"])
+	assert.Equal(test, float64(30*time.Millisecond), vars["traced_ns"])
+
+	clock.advance(5 * time.Millisecond)
+	checkout.End()
+	t.Close()
+	final := readExpvars(test, prefix)
+	assert.Equal(test, 0.0, final["open_spans"])
+	assert.Equal(test, 4.0, final["calls"])
+	assert.Equal(test, map[string]interface{}{
+		"checkout": map[string]interface{}{"calls": 1.0, "total_ns": float64(35 * time.Millisecond)},
+		"price":    map[string]interface{}{"calls": 3.0, "total_ns": float64(30 * time.Millisecond)},
+	}, final["top_functions"])
+
+	// The variables stay as they were on close
+	t.StartNamed("refund").End()
+	assert.Equal(test, final, readExpvars(test, prefix))
+}
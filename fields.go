@@ -0,0 +1,172 @@
+package tracey
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// A Field is a typed key / value pair which `EnterF(...)` tags its span
+// with, built by `Int(...)`, `Str(...)`, `Dur(...)` or `Err(...)`. Unlike
+// the arguments of `Enter(...)`, fields are only boxed into tags once the
+// span is entered, and not at all for the spans which are filtered out.
+type Field struct {
+	Key string
+
+	kind fieldKind
+	num  int64
+	str  string
+	err  error
+}
+
+type fieldKind uint8
+
+const (
+	intField fieldKind = iota
+	strField
+	durField
+	errField
+)
+
+// Int returns a field tagging "key" with an integer.
+func Int(key string, n int) Field {
+	return Field{Key: key, kind: intField, num: int64(n)}
+}
+
+// Str returns a field tagging "key" with a string.
+func Str(key, s string) Field {
+	return Field{Key: key, kind: strField, str: s}
+}
+
+// Dur returns a field tagging "key" with a duration, as in "timeout=1.5s".
+func Dur(key string, d time.Duration) Field {
+	return Field{Key: key, kind: durField, num: int64(d)}
+}
+
+// Err returns a field tagging "error" with the error, as in
+// "error=declined", or "error=<nil>" for a nil error.
+func Err(err error) Field {
+	return Field{Key: "error", kind: errField, err: err}
+}
+
+// The value of the field as the tags of the map-based API hold it
+func (f Field) value() interface{} {
+	switch f.kind {
+	case intField:
+		return int(f.num)
+	case strField:
+		return f.str
+	case durField:
+		return time.Duration(f.num)
+	}
+	return f.err
+}
+
+// Renders the field the way text lines show it
+func (f Field) appendTo(b []byte) []byte {
+	b = append(b, f.Key...)
+	b = append(b, '=')
+	switch f.kind {
+	case intField:
+		return strconv.AppendInt(b, f.num, 10)
+	case strField:
+		return append(b, f.str...)
+	case durField:
+		return append(b, time.Duration(f.num).String()...)
+	}
+	if f.err == nil {
+		return append(b, "<nil>"...)
+	}
+	return append(b, f.err.Error()...)
+}
+
+// The fields of an `EnterF(...)`, passed along with the arguments of the
+// enter
+type enterFields []Field
+
+// Splits the fields of an `EnterF(...)` off of the arguments to an enter,
+// which it is the first of if anything
+func splitFields(s []interface{}) (enterFields, []interface{}) {
+	if len(s) > 0 {
+		if fields, ok := s[0].(enterFields); ok {
+			return fields, s[1:]
+		}
+	}
+	return nil, s
+}
+
+// Returns the tags of the fields
+func (fields enterFields) tags() []Tag {
+	tags := make([]Tag, len(fields))
+	for i, f := range fields {
+		tags[i] = Tag{f.Key, f.value()}
+	}
+	return tags
+}
+
+// Renders the text of the enter of an `EnterF(...)`, as in
+// "[tid:3]=>load rows=42 user=abc", in a single allocation unless the
+// message is capped by "MaxMessageLen" or longer than the scratch buffer
+func (fields enterFields) text(t *Tracer, gid uint64, name string) string {
+	var scratch [256]byte
+	b := append(scratch[:0], "[tid:"...)
+	b = strconv.AppendUint(b, gid, 10)
+	b = append(b, "]=>"...)
+	start := len(b)
+	b = append(b, name...)
+	for _, f := range fields {
+		b = append(b, ' ')
+		b = f.appendTo(b)
+	}
+	if t.options.MaxMessageLen > 0 {
+		return lineText(gid, t.capMessage(string(b[start:])))
+	}
+	return string(b)
+}
+
+// Ends nothing, for the spans which are not entered at all
+var endNothing = func() {}
+
+// EnterF logs the entry of a span named "name" the way `StartNamed(...)`
+// does, tagged with the fields, and returns the function which logs its
+// exit, as in
+//
+//	defer tracer.EnterF("load", tracey.Int("rows", n), tracey.Str("user", id))()
+//
+// Text lines show the fields after the name, as in "load rows=42
+// user=abc", rather than among the tags of the exit line, while JSON
+// output has them under "tags", the name being the message. The fields
+// are tags as those of `Span.Tag(...)` are for everything else, such as
+// "Router" and "HighlightChanges". The span is entered whether or not it
+// is logged, so that it counts in `Stats()` and for the depth of the
+// spans within it, but the fields of the spans which are not logged
+// (those "FilterRules" exclude or below "MinLevel", their level being
+// `Trace`) are neither boxed into tags nor rendered.
+func (t *Tracer) EnterF(name string, fields ...Field) func() {
+	if t.start == nil {
+		return endNothing
+	}
+	site := t.namedSite(name)
+	if t.hidesFields(name) {
+		// Entered all the same, for its depth and statistics
+		return t.start(nil, "", site).End
+	}
+	return t.start(nil, "", site, enterFields(append([]Field(nil), fields...))).End
+}
+
+// Returns true if the fields of an `EnterF(...)` would not be shown
+// whatever happens, so that they are not even copied
+func (t *Tracer) hidesFields(name string) bool {
+	config := t.config.Load()
+	if config.functions != nil || t.options.EscalateOnError || atomic.LoadUint32(&t.overridden) != 0 || atomic.LoadInt64(&t.pins.active) != 0 {
+		return false
+	}
+	if config.MinLevel > Trace {
+		return true
+	}
+	if t.filters == nil || t.filters.ops != nil {
+		return false
+	}
+	rule := t.filters.lookup(name)
+	return rule >= 0 && t.filters.actions[rule] == Exclude
+}
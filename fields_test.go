@@ -0,0 +1,170 @@
+package tracey
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnterF(test *testing.T) {
+	var out, js lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}, {Writer: &js, Format: JSONFormat}}})
+	func() {
+		defer t.EnterF("load", Int("rows", 42), Str("user", "abc"), Dur("timeout", 1500*time.Millisecond), Err(errors.New("declined")))()
+		defer t.EnterF("check", Err(nil), Int("n", -3))()
+	}()
+
+	assert.Equal(test, "[ 0]ENTER: =>load rows=42 user=abc timeout=1.5s error=declined\n"+
+		"[ 1]  ENTER: =>check error=<nil> n=-3\n"+
+		"[ 1]  EXIT:  =>check error=<nil> n=-3\n"+
+		"[ 0]EXIT:  =>load rows=42 user=abc timeout=1.5s error=declined\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+
+	exits := exitsByMessage(test, js.String())
+	assert.Equal(test, "load", exits["load"].Name)
+	assert.Equal(test, []Tag{{"rows", "42"}, {"user", "abc"}, {"timeout", "1.5s"}, {"error", "declined"}}, exits["load"].Tags)
+	assert.Equal(test, []Tag{{"error", "<nil>"}, {"n", "-3"}}, exits["check"].Tags)
+	assert.Equal(test, uint64(1), t.Stats()[0].Calls)
+}
+
+func TestEnterFTags(test *testing.T) {
+	var out lockedBuffer
+	var routed []Tag
+	t := NewTracer(&Options{
+		Sinks: []Sink{{Writer: &out}},
+		Router: func(ev Event) []SinkID {
+			routed = ev.Tags
+			return []SinkID{0}
+		},
+	})
+	t.EnterF("load", Int("rows", 42))()
+	// The same tags as those of the map-based API
+	assert.Equal(test, []Tag{{"rows", 42}}, routed)
+
+	// Tags added to the span show among the tags of the exit line
+	span := t.start(nil, "", t.namedSite("save"), enterFields{Str("user", "abc")})
+	span.Tag("bytes", 512)
+	span.End()
+	assert.Contains(test, RE_tidMarker.ReplaceAllString(out.String(), "=>"), "EXIT:  =>save user=abc {bytes=512}\n")
+}
+
+func TestEnterFMuted(test *testing.T) {
+	// Spans which are not logged are entered all the same, as with
+	// `StartNamed(...)`
+	for _, enter := range []func(t *Tracer, name string) func(){
+		func(t *Tracer, name string) func() { return t.EnterF(name, Int("rows", 42)) },
+		func(t *Tracer, name string) func() { return t.StartNamed(name, Trace, "%s rows=%d", "$FN", 42).End },
+	} {
+		var out lockedBuffer
+		t := NewTracer(&Options{
+			Sinks:       []Sink{{Writer: &out}},
+			MinLevel:    Debug,
+			FilterRules: []FilterRule{{Kind: MatchExact, Pattern: "save", Action: Exclude}},
+		})
+		func() {
+			defer enter(t, "load")()
+			t.StartNamed("parse", Debug, "%s", "$FN").End()
+		}()
+		enter(t, "save")()
+		assert.Equal(test, "[ 1]  ENTER: DBG =>parse\n"+
+			"[ 1]  EXIT:  DBG =>parse\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+
+		stats := map[string]uint64{}
+		for _, s := range t.Stats() {
+			stats[s.Name] = s.Calls
+		}
+		assert.Equal(test, map[string]uint64{"load": 1, "parse": 1, "save": 1}, stats)
+
+		// Shown within the trees of pinned trace ids
+		out.Reset()
+		t.Pin(pinnedParent.TraceID, 0)
+		handle := t.StartRemoteNamed(pinnedParent, "handle", "%s", "$FN")
+		enter(t, "load")()
+		enter(t, "save")()
+		handle.End()
+		assert.Equal(test, "[ 0]ENTER: =>handle [pinned]\n"+
+			"[ 1]  ENTER: =>load rows=42 [pinned]\n"+
+			"[ 1]  EXIT:  =>load rows=42 [pinned]\n"+
+			"[ 1]  ENTER: =>save rows=42 [pinned]\n"+
+			"[ 1]  EXIT:  =>save rows=42 [pinned]\n"+
+			"[ 0]EXIT:  =>handle [pinned]\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	}
+}
+
+func TestEnterFAllocs(test *testing.T) {
+	n, user := 1000, "abc"
+	for _, opts := range []*Options{
+		suppressedOptions(),
+		{Sinks: []Sink{{Writer: io.Discard}}, MinLevel: Debug},
+	} {
+		// Not logged, the fields cost nothing over the span itself
+		t := NewTracer(opts)
+		for i := 0; i < 200; i++ {
+			// Past the ids which are formatted without allocating
+			t.EnterF("load")()
+		}
+		bare := testing.AllocsPerRun(100, func() { t.EnterF("load")() })
+		typed := testing.AllocsPerRun(100, func() {
+			t.EnterF("load", Int("rows", n), Str("user", user), Dur("timeout", time.Second))()
+		})
+		assert.Equal(test, bare, typed)
+	}
+
+	// Logged, the enter line is rendered in a single allocation
+	t := NewTracer(renderedOptions())
+	fields := enterFields{Int("rows", n), Str("user", user), Err(nil)}
+	allocs := testing.AllocsPerRun(100, func() { fields.text(t, 1, "load") })
+	assert.Equal(test, 1.0, allocs)
+}
+
+func benchmarkEnterF(b *testing.B, opts *Options) {
+	t := NewTracer(opts)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t.EnterF("load", Int("rows", i), Str("user", "abc"))()
+	}
+}
+
+func benchmarkEnterArgs(b *testing.B, opts *Options) {
+	t := NewTracer(opts)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		span := t.StartNamed("load", "rows=%d user=%s", i, "abc")
+		span.Tag("rows", i)
+		span.Tag("user", "abc")
+		span.End()
+	}
+}
+
+func renderedOptions() *Options {
+	return &Options{Sinks: []Sink{{Writer: io.Discard}}}
+}
+
+func suppressedOptions() *Options {
+	return &Options{Sinks: []Sink{{Writer: io.Discard}}, FilterRules: []FilterRule{{Kind: MatchExact, Pattern: "load", Action: Exclude}}}
+}
+
+func BenchmarkEnterFRendered(b *testing.B)      { benchmarkEnterF(b, renderedOptions()) }
+func BenchmarkEnterArgsRendered(b *testing.B)   { benchmarkEnterArgs(b, renderedOptions()) }
+func BenchmarkEnterFSuppressed(b *testing.B)    { benchmarkEnterF(b, suppressedOptions()) }
+func BenchmarkEnterArgsSuppressed(b *testing.B) { benchmarkEnterArgs(b, suppressedOptions()) }
+
+func TestFieldRendering(test *testing.T) {
+	for _, f := range []struct {
+		field Field
+		text  string
+	}{
+		{Int("rows", 0), "rows=0"},
+		{Str("user", ""), "user="},
+		{Dur("timeout", 0), "timeout=0s"},
+		{Err(errors.New("x")), "error=x"},
+	} {
+		assert.Equal(test, f.text, string(f.field.appendTo(nil)))
+		assert.Equal(test, f.text, strings.Join([]string{f.field.Key, NewTracer(&Options{}).renderTags([]Tag{{f.field.Key, f.field.value()}})[0]}, "="))
+	}
+}
@@ -0,0 +1,231 @@
+package tracey
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// A MatchKind tells how the pattern of a `FilterRule` is matched against
+// function names.
+type MatchKind int
+
+const (
+	// Names starting with the pattern, as in "pkg/payments."
+	MatchPrefix MatchKind = iota
+
+	// Names ending with the pattern, as in ".Validate"
+	MatchSuffix
+
+	// The name which is the pattern
+	MatchExact
+
+	// Names the pattern, a regex, matches
+	MatchRegex
+)
+
+// An Action tells what a `FilterRule` does to the spans of the functions
+// it matches.
+type Action int
+
+const (
+	// The spans are traced
+	Include Action = iota
+
+	// The spans are not logged, as if below "MinLevel"
+	Exclude
+)
+
+func (a Action) String() string {
+	if a == Exclude {
+		return "exclude"
+	}
+	return "include"
+}
+
+// A FilterRule includes or excludes the spans of the functions whose name
+// matches its pattern, see "FilterRules".
+type FilterRule struct {
+	Kind    MatchKind
+	Pattern string
+	Action  Action
+}
+
+// A node of the tries of prefixes and suffixes, with the first rule which
+// ends there (-1 if none)
+type filterNode struct {
+	children map[byte]*filterNode
+	rule     int
+}
+
+func newFilterNode() *filterNode {
+	return &filterNode{rule: -1}
+}
+
+// Adds the rule for the pattern, read backwards if "reversed" is set,
+// unless an earlier rule has the same pattern
+func (n *filterNode) insert(pattern string, reversed bool, rule int) {
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if reversed {
+			c = pattern[len(pattern)-1-i]
+		}
+		child := n.children[c]
+		if child == nil {
+			if n.children == nil {
+				n.children = make(map[byte]*filterNode)
+			}
+			child = newFilterNode()
+			n.children[c] = child
+		}
+		n = child
+	}
+	if n.rule < 0 {
+		n.rule = rule
+	}
+}
+
+// Returns the first of the rules whose pattern the name starts with (or
+// ends with, if "reversed" is set), or "best" if it comes first
+func (n *filterNode) first(name string, reversed bool, best int) int {
+	for i := 0; n != nil; i++ {
+		if n.rule >= 0 && (best < 0 || n.rule < best) {
+			best = n.rule
+		}
+		if i == len(name) {
+			break
+		}
+		c := name[i]
+		if reversed {
+			c = name[len(name)-1-i]
+		}
+		n = n.children[c]
+	}
+	return best
+}
+
+// The "FilterRules" of a tracer, compiled by kind, each compiled rule
+// knowing its position among them so that the first match wins whatever
+// its kind, along with the rule found for every function name so far
+type filterRules struct {
+	actions  []Action
+	prefixes *filterNode
+	suffixes *filterNode
+	exact    map[string]int
+
+	// The regexes, in order, along with their positions
+	patterns []*regexp.Regexp
+	indices  []int
+
+	byName sync.Map // name -> int, -1 if no rule matched
+
+	// The rules whose pattern starts with "op:", which match operations
+	// rather than function names, see `WithOperation(...)`
+	ops *filterRules
+}
+
+func newFilterRules() *filterRules {
+	return &filterRules{
+		prefixes: newFilterNode(),
+		suffixes: newFilterNode(),
+		exact:    make(map[string]int),
+	}
+}
+
+func compileFilterRules(rules []FilterRule) (*filterRules, error) {
+	f := newFilterRules()
+	for i, rule := range rules {
+		if rule.Action != Include && rule.Action != Exclude {
+			return nil, fmt.Errorf("bad action %d in FilterRules", rule.Action)
+		}
+		f.actions = append(f.actions, rule.Action)
+		target, pattern := f, rule.Pattern
+		if strings.HasPrefix(pattern, operationPrefix) {
+			if f.ops == nil {
+				f.ops = newFilterRules()
+			}
+			target, pattern = f.ops, pattern[len(operationPrefix):]
+		}
+		switch rule.Kind {
+		case MatchPrefix:
+			target.prefixes.insert(pattern, false, i)
+		case MatchSuffix:
+			target.suffixes.insert(pattern, true, i)
+		case MatchExact:
+			if _, ok := target.exact[pattern]; !ok {
+				target.exact[pattern] = i
+			}
+		case MatchRegex:
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("bad pattern in FilterRules: %v", err)
+			}
+			target.patterns = append(target.patterns, compiled)
+			target.indices = append(target.indices, i)
+		default:
+			return nil, fmt.Errorf("bad match kind %d in FilterRules", rule.Kind)
+		}
+	}
+	return f, nil
+}
+
+// Returns the position of the first rule which matches the name, or -1 if
+// none does. The regexes are only tried as long as they come before the
+// first match of the other kinds.
+func (f *filterRules) match(name string) int {
+	best := f.prefixes.first(name, false, -1)
+	best = f.suffixes.first(name, true, best)
+	if i, ok := f.exact[name]; ok && (best < 0 || i < best) {
+		best = i
+	}
+	for j, pattern := range f.patterns {
+		if best >= 0 && f.indices[j] > best {
+			break
+		}
+		if pattern.MatchString(name) {
+			best = f.indices[j]
+			break
+		}
+	}
+	return best
+}
+
+func (f *filterRules) lookup(name string) int {
+	if found, ok := f.byName.Load(name); ok {
+		return found.(int)
+	}
+	found := f.match(name)
+	f.byName.Store(name, found)
+	return found
+}
+
+// Returns true if the spans of the function are excluded by the
+// "FilterRules", from the callsite if there is one, or by those of the
+// operation the span is part of, whichever rule comes first
+func (t *Tracer) excludedByRules(config *mutableConfig, site *callsite, name, operation string) bool {
+	if site != nil && name == "" {
+		name = site.name
+	}
+	if operation == "" || t.filters.ops == nil {
+		return t.decide(config, site, name).excluded
+	}
+	rule := t.filters.lookup(name)
+	if op := t.filters.ops.lookup(operation); op >= 0 && (rule < 0 || op < rule) {
+		rule = op
+	}
+	return rule >= 0 && t.filters.actions[rule] == Exclude
+}
+
+// ExplainFilter returns which of the "FilterRules" decides whether the
+// spans of the function are traced, by its position among them, along
+// with what it decides, or -1 and `Include` if no rule matches the name.
+func (t *Tracer) ExplainFilter(fnName string) (matchedRule int, action Action) {
+	if t.filters == nil {
+		return -1, Include
+	}
+	if matchedRule = t.filters.lookup(fnName); matchedRule < 0 {
+		return -1, Include
+	}
+	return matchedRule, t.filters.actions[matchedRule]
+}
@@ -0,0 +1,186 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplainFilter(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}, FilterRules: []FilterRule{
+		{MatchExact, "pkg/payments.Charge", Include},
+		{MatchPrefix, "pkg/payments.", Exclude},
+		{MatchSuffix, ".Validate", Include},
+		{MatchRegex, `Validate$`, Exclude},
+		{MatchSuffix, "Helper", Exclude},
+		{MatchRegex, `^pkg/`, Include},
+		{MatchPrefix, "pkg/", Exclude},
+		{MatchPrefix, "pkg/payments.", Include},
+	}})
+	for name, want := range map[string]struct {
+		rule   int
+		action Action
+	}{
+		"pkg/payments.Charge":   {0, Include},
+		"pkg/payments.Refund":   {1, Exclude},
+		"pkg/payments.Validate": {1, Exclude},
+		"pkg/orders.Validate":   {2, Include},
+		"main.Validate":         {2, Include},
+		"pkg/orders.Helper":     {4, Exclude},
+		"pkg/orders.Load":       {5, Include},
+		"main.main":             {-1, Include},
+		"":                      {-1, Include},
+	} {
+		rule, action := t.ExplainFilter(name)
+		assert.Equal(test, want.rule, rule, name)
+		assert.Equal(test, want.action, action, name)
+	}
+
+	// A regex first wins over the tries
+	t = NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}, FilterRules: []FilterRule{
+		{MatchRegex, `\.Charge$`, Exclude},
+		{MatchPrefix, "", Include},
+		{MatchExact, "pkg/payments.Charge", Include},
+	}})
+	rule, action := t.ExplainFilter("pkg/payments.Charge")
+	assert.Equal(test, 0, rule)
+	assert.Equal(test, Exclude, action)
+	rule, _ = t.ExplainFilter("anything")
+	assert.Equal(test, 1, rule)
+
+	rule, action = NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}}).ExplainFilter("main.main")
+	assert.Equal(test, -1, rule)
+	assert.Equal(test, Include, action)
+}
+
+func TestFilterRules(test *testing.T) {
+	var out bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Writer: &out}},
+		MessageTemplates: map[string]string{`.`: "$FN"},
+		FilterRules: []FilterRule{
+			{MatchExact, "db.Ping", Include},
+			{MatchPrefix, "db.", Exclude},
+			{MatchSuffix, ".String", Exclude},
+		},
+	})
+	func() {
+		defer t.StartNamed("api.Handle").End()
+		func() {
+			// Left out, but not what it calls
+			defer t.StartNamed("db.Query").End()
+			t.StartNamed("cache.Get").End()
+			t.StartNamed("user.String").End()
+		}()
+		t.StartNamed("db.Ping").End()
+	}()
+	assert.Equal(test, "[ 0]ENTER: api.Handle\n"+
+		"[ 2]    ENTER: cache.Get\n"+
+		"[ 2]    EXIT:  cache.Get\n"+
+		"[ 1]  ENTER: db.Ping\n"+
+		"[ 1]  EXIT:  db.Ping\n"+
+		"[ 0]EXIT:  api.Handle\n", out.String())
+
+	// Excluded calls are still counted
+	for _, s := range t.Stats() {
+		if s.Name == "db.Query" {
+			assert.Equal(test, uint64(1), s.Calls)
+		}
+	}
+}
+
+func TestFilterRulesValidate(test *testing.T) {
+	assert.EqualError(test, (&Options{FilterRules: []FilterRule{{MatchRegex, "(", Exclude}}}).Validate(),
+		"bad pattern in FilterRules: error parsing regexp: missing closing ): `(`")
+	assert.EqualError(test, (&Options{FilterRules: []FilterRule{{MatchKind(7), "x", Exclude}}}).Validate(),
+		"bad match kind 7 in FilterRules")
+	assert.EqualError(test, (&Options{FilterRules: []FilterRule{{MatchPrefix, "x", Action(3)}}}).Validate(),
+		"bad action 3 in FilterRules")
+	assert.PanicsWithValue(test, "tracey: bad match kind 7 in FilterRules", func() {
+		NewTracer(&Options{FilterRules: []FilterRule{{MatchKind(7), "x", Exclude}}})
+	})
+}
+
+// 500 rules, most of them literal prefixes and suffixes as generated
+// configurations have, and the names of the functions they are tried on
+func benchmarkFilters() ([]FilterRule, []string) {
+	var rules []FilterRule
+	for i := 0; i < 500; i++ {
+		switch i % 10 {
+		case 0:
+			rules = append(rules, FilterRule{MatchRegex, fmt.Sprintf(`^svc%d/.*\.Get`, i), Exclude})
+		case 1, 2, 3:
+			rules = append(rules, FilterRule{MatchSuffix, fmt.Sprintf(".Validate%d", i), Include})
+		case 4:
+			rules = append(rules, FilterRule{MatchExact, fmt.Sprintf("pkg%d.main", i), Exclude})
+		default:
+			rules = append(rules, FilterRule{MatchPrefix, fmt.Sprintf("pkg/mod%d.", i), Exclude})
+		}
+	}
+	var names []string
+	for i := 0; i < 1000; i++ {
+		names = append(names, fmt.Sprintf("pkg/mod%d.Handler%d", i%700, i))
+	}
+	return rules, names
+}
+
+// The rules as the regexes they would be without "FilterRules"
+func regexFilters(rules []FilterRule) []*regexp.Regexp {
+	var patterns []*regexp.Regexp
+	for _, rule := range rules {
+		source := rule.Pattern
+		switch rule.Kind {
+		case MatchPrefix:
+			source = "^" + regexp.QuoteMeta(source)
+		case MatchSuffix:
+			source = regexp.QuoteMeta(source) + "$"
+		case MatchExact:
+			source = "^" + regexp.QuoteMeta(source) + "$"
+		}
+		patterns = append(patterns, regexp.MustCompile(source))
+	}
+	return patterns
+}
+
+func BenchmarkFilterRules(b *testing.B) {
+	rules, names := benchmarkFilters()
+	f, _ := compileFilterRules(rules)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.match(names[i%len(names)])
+	}
+}
+
+func BenchmarkFilterRegexes(b *testing.B) {
+	rules, names := benchmarkFilters()
+	patterns := regexFilters(rules)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := names[i%len(names)]
+		for _, pattern := range patterns {
+			if pattern.MatchString(name) {
+				break
+			}
+		}
+	}
+}
+
+func TestFilterRulesMatchRegexes(test *testing.T) {
+	rules, names := benchmarkFilters()
+	f, err := compileFilterRules(rules)
+	assert.Nil(test, err)
+	patterns := regexFilters(rules)
+	for _, name := range append(names, "pkg12.main", "svc30/x.Get", "a.Validate1", "pkg/mod5.") {
+		want := -1
+		for i, pattern := range patterns {
+			if pattern.MatchString(name) {
+				want = i
+				break
+			}
+		}
+		assert.Equal(test, want, f.match(name), name)
+	}
+}
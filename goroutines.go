@@ -0,0 +1,287 @@
+package tracey
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The number of shards the goroutine records are spread over, a power of
+// two so that picking one is a mask
+const goroutineShards = 64
+
+// What a tracer knows about a goroutine which traced something. It is
+// looked up once per enter and kept on the span, so exits need no lookup.
+type goroutineRecord struct {
+	depth int
+
+	// The depth the goroutine started at, when its first span was started
+	// within a span of another goroutine
+	base int
+
+	// The spans open on the goroutine, innermost last
+	open []*Span
+
+	// The override frames pushed on the goroutine, innermost last, and
+	// those in effect within the span the goroutine's first span was
+	// started within, see `WithOverrides(...)`
+	frames    []*overrideFrame
+	inherited *OptionOverrides
+
+	// How many writes of tracey's output the goroutine is in, during
+	// which it traces nothing, see `Tracer.ReentrantCallsSuppressed()`
+	output int
+
+	// Set while the rest of the goroutine's tree is shed, and the events
+	// shed meanwhile, see "MaxTraceLatency"
+	shedding uint32
+	shed     uint64
+
+	// The lines attached while the goroutine had no span open, see
+	// `AttachLog(...)`
+	pending *attachments
+
+	// When the record was left with nothing in it, if idle records are
+	// kept, see "GoroutineStateTTL"
+	idleSince time.Time
+}
+
+type goroutineShard struct {
+	sync.Mutex
+	g map[uint64]*goroutineRecord
+
+	// Keeps the shards on their own cache lines
+	_ [40]byte
+}
+
+// The records of every goroutine with anything open, sharded by goroutine
+// id so that goroutines rarely contend for the same lock. Records are
+// dropped once they are idle, right away or after "GoroutineStateTTL",
+// see `release(...)` and `compact(...)`.
+type goroutines struct {
+	shards [goroutineShards]goroutineShard
+
+	// How long idle records and the lines waiting for a span are kept,
+	// and the clock they are timed by
+	ttl, pendingTTL time.Duration
+	clock           func() time.Time
+
+	// Set once any line was left waiting for a span, see `AttachLog(...)`
+	pendingUsed uint32
+
+	// The writes of tracey's output in progress, and the spans entered
+	// from within them, see `beginOutput(...)`
+	outputs   int64
+	reentrant uint64
+}
+
+func (g *goroutines) init(ttl, pendingTTL time.Duration, clock func() time.Time) {
+	g.ttl, g.pendingTTL, g.clock = ttl, pendingTTL, clock
+	for i := range g.shards {
+		g.shards[i].g = make(map[uint64]*goroutineRecord)
+	}
+}
+
+func (g *goroutines) shard(gid uint64) *goroutineShard {
+	return &g.shards[gid&(goroutineShards-1)]
+}
+
+// Records the span as the innermost one open on its goroutine, and fills
+// in its depth and ids. The parent of the span is the previous innermost
+// one, or else "parent" (which may be nil) in which case the span carries
+// on from the parent's depth. A logical parent (see `EnterUnder(...)`) is
+// the parent whatever is open. Spans without a parent start a new trace.
+// The depth only goes up when "nesting" is set. Spans within a suppressed
+// subtree (see "SuppressSubtrees") are muted and counted by the span which
+// suppresses them, otherwise "suppresses" makes the span suppress its own
+// subtree.
+func (g *goroutines) enter(s *Span, parent *Span, nesting, suppresses bool, ids IDGenerator) {
+	shard := g.shard(s.ev.TID)
+	shard.Lock()
+	defer shard.Unlock()
+	record := shard.g[s.ev.TID]
+	if record == nil {
+		record = &goroutineRecord{}
+		shard.g[s.ev.TID] = record
+	}
+	s.record = record
+	if record.pending != nil {
+		pending := record.pending
+		record.pending = nil
+		if s.ev.Time.Sub(pending.since) < g.pendingTTL {
+			s.attached = pending
+		}
+	}
+
+	if parent != nil && parent.logical {
+		// Carries on from the logical parent's depth until it exits
+		s.shift = parent.ev.Depth + 1 - (record.base + record.depth)
+		record.base += s.shift
+	} else if len(record.open) > 0 {
+		parent = record.open[len(record.open)-1]
+		s.outer = parent
+	} else if record.depth == 0 {
+		record.base, record.inherited = 0, nil
+		if parent != nil {
+			record.inherited = parent.ev.overrides
+			if nesting {
+				record.base = parent.ev.Depth + 1
+			}
+		}
+	}
+	s.ev.Depth = record.base + record.depth
+	if parent != nil && parent.ev.TraceID != "" {
+		s.ev.TraceID, s.ev.ParentID = parent.ev.TraceID, parent.ev.SpanID
+		s.remote = parent.remote
+	} else {
+		s.ev.TraceID = ids.NewTraceID()
+	}
+	if parent != nil && parent.suppressor != nil {
+		s.suppressor, s.muted = parent.suppressor, true
+		atomic.AddUint64(&s.suppressor.hidden, 1)
+	} else if suppresses {
+		s.suppressor = s
+	}
+	if nesting {
+		record.depth++
+	}
+	record.open = append(record.open, s)
+}
+
+// Forgets about the span, which is usually (but not necessarily) the
+// innermost one open on its goroutine, and returns the depth of the
+// goroutine once it is gone. Returns false as well if the depth would have
+// become negative, in which case it is reset to 0. Records are released
+// as soon as their goroutine is back to depth 0 with nothing open
+// (including override frames), see `release(...)`.
+func (g *goroutines) exit(s *Span, nesting bool) (int, bool) {
+	shard := g.shard(s.ev.TID)
+	shard.Lock()
+	defer shard.Unlock()
+	record := s.record
+
+	ok := true
+	if nesting {
+		record.depth--
+		if record.depth < 0 {
+			record.depth, ok = 0, false
+		}
+	}
+	open := record.open
+	for i := len(open) - 1; i >= 0; i-- {
+		if open[i] == s {
+			copy(open[i:], open[i+1:])
+			open[len(open)-1] = nil
+			record.open = open[:len(open)-1]
+			break
+		}
+	}
+	depth := record.base + record.depth
+	record.base -= s.shift
+	g.release(shard, s.ev.TID, record)
+	return depth, ok
+}
+
+// Returns true if the record can be forgotten
+func (r *goroutineRecord) idle() bool {
+	return r.depth == 0 && len(r.open) == 0 && len(r.frames) == 0 && r.output == 0 && r.pending == nil
+}
+
+// Drops the record if it is idle, or notes since when it is if idle
+// records are kept, for `compact(...)` to drop. Must be called with the
+// lock of its shard held.
+func (g *goroutines) release(shard *goroutineShard, gid uint64, record *goroutineRecord) {
+	if !record.idle() || shard.g[gid] != record {
+		return
+	}
+	if g.ttl <= 0 {
+		delete(shard.g, gid)
+		return
+	}
+	record.idleSince = g.clock()
+}
+
+// Returns true if `compact(...)` has anything to do, that is if idle
+// records are kept or lines were left waiting for a span
+func (g *goroutines) compacting() bool {
+	return g.ttl > 0 || atomic.LoadUint32(&g.pendingUsed) != 0
+}
+
+// Drops the lines which waited for a span for too long, and the records
+// which were idle for longer than "GoroutineStateTTL". The shards are
+// locked one at a time. Returns true if any record may be left to drop
+// later.
+func (g *goroutines) compact(now time.Time) bool {
+	left := false
+	for i := range g.shards {
+		shard := &g.shards[i]
+		shard.Lock()
+		for gid, record := range shard.g {
+			if record.pending != nil && now.Sub(record.pending.since) >= g.pendingTTL {
+				record.pending = nil
+				if record.idle() {
+					record.idleSince = now
+				}
+			}
+			if !record.idle() {
+				// Kept records are dropped once they are idle
+				left = left || record.pending != nil || g.ttl > 0
+				continue
+			}
+			if g.ttl <= 0 || now.Sub(record.idleSince) >= g.ttl {
+				delete(shard.g, gid)
+			} else {
+				left = true
+			}
+		}
+		shard.Unlock()
+	}
+	return left
+}
+
+// GoroutineStateCount returns how many goroutines the tracer keeps a
+// record of: those with spans or option overrides open, or lines waiting
+// for a span (see `AttachLog(...)`), and the idle ones "GoroutineStateTTL"
+// keeps.
+func (t *Tracer) GoroutineStateCount() int {
+	if t.start == nil {
+		return 0
+	}
+	records, _ := t.goroutines.counts()
+	return records
+}
+
+// CompactNow drops the records of the goroutines which were idle for
+// longer than "GoroutineStateTTL", and the lines which waited for a span
+// for longer than "AttachPendingTimeout", as the tracer's scanning
+// goroutine does every so often, see `GoroutineStateCount()`.
+func (t *Tracer) CompactNow() {
+	if t.start != nil {
+		t.goroutines.compact(t.options.Clock())
+	}
+}
+
+// Returns the innermost span open on the goroutine, or nil if there is none
+func (g *goroutines) innermost(gid uint64) *Span {
+	shard := g.shard(gid)
+	shard.Lock()
+	defer shard.Unlock()
+	if record := shard.g[gid]; record != nil && len(record.open) > 0 {
+		return record.open[len(record.open)-1]
+	}
+	return nil
+}
+
+// Calls "f" with the spans open on every goroutine which has any
+func (g *goroutines) each(f func(gid uint64, open []*Span)) {
+	for i := range g.shards {
+		shard := &g.shards[i]
+		shard.Lock()
+		for gid, record := range shard.g {
+			if len(record.open) > 0 {
+				f(gid, record.open)
+			}
+		}
+		shard.Unlock()
+	}
+}
@@ -0,0 +1,178 @@
+package tracey
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Traces nested calls from many goroutines at once, without writing
+// anything out so that only the bookkeeping is measured
+func BenchmarkParallelTrace(b *testing.B) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard, MinDuration: time.Hour}}})
+	b.ReportAllocs()
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			outer := t.Start()
+			t.Start().End()
+			outer.End()
+		}
+	})
+}
+
+// Traces a burst of nested calls, with overrides pushed around the inner
+// ones
+func traceBurst(t *Tracer, i int) {
+	defer t.Enter("burst %d", i)()
+	restore := t.Verbose()
+	defer restore()
+	t.Start("%s", "inner").End()
+	t.Event("done")
+}
+
+func TestGoroutineStateTTL(test *testing.T) {
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}, Clock: clock.Now, GoroutineStateTTL: ttl})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			traceBurst(t, 0)
+		}()
+		<-done
+		if ttl == 0 {
+			assert.Equal(test, 0, t.GoroutineStateCount())
+			continue
+		}
+		// Idle records are kept until they expire
+		assert.Equal(test, 1, t.GoroutineStateCount())
+		clock.advance(30 * time.Second)
+		t.CompactNow()
+		assert.Equal(test, 1, t.GoroutineStateCount())
+		clock.advance(time.Minute)
+		t.CompactNow()
+		assert.Equal(test, 0, t.GoroutineStateCount())
+		t.Close()
+	}
+
+	// The scanning goroutine drops them by itself
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}, GoroutineStateTTL: 5 * time.Millisecond})
+	defer t.Close()
+	for i := 0; i < 3; i++ {
+		traceBurst(t, i)
+	}
+	assert.Equal(test, 1, t.GoroutineStateCount())
+	assert.Eventually(test, func() bool { return t.GoroutineStateCount() == 0 }, 5*time.Second, time.Millisecond)
+}
+
+func TestGoroutineStateOutput(test *testing.T) {
+	var outputs []string
+	for _, ttl := range []time.Duration{0, time.Hour} {
+		var out bytes.Buffer
+		t := NewTracer(&Options{
+			Sinks:             []Sink{{Writer: &out}},
+			MessageTemplates:  map[string]string{`.`: "$MSG"},
+			Clock:             fakeClock(time.Millisecond),
+			GoroutineStateTTL: ttl,
+		})
+		for i := 0; i < 2; i++ {
+			traceBurst(t, i)
+		}
+		func() {
+			defer t.Enter("%s", "outer")()
+			traceBurst(t, 2)
+		}()
+		t.Close()
+		outputs = append(outputs, out.String())
+	}
+	// Keeping the records changes nothing of what is traced
+	assert.Equal(test, outputs[0], outputs[1])
+	assert.Equal(test, "[ 0]ENTER: burst 0\n"+
+		"[ 1]  ENTER: inner\n"+
+		"[ 1]  EXIT:  inner ... in 1ms\n"+
+		"[ 1]  · done (at +3.0ms)\n"+
+		"[ 0]EXIT:  burst 0\n"+
+		"[ 0]ENTER: burst 1\n"+
+		"[ 1]  ENTER: inner\n"+
+		"[ 1]  EXIT:  inner ... in 1ms\n"+
+		"[ 1]  · done (at +3.0ms)\n"+
+		"[ 0]EXIT:  burst 1\n"+
+		"[ 0]ENTER: outer\n"+
+		"[ 1]  ENTER: burst 2\n"+
+		"[ 2]    ENTER: inner\n"+
+		"[ 2]    EXIT:  inner ... in 1ms\n"+
+		"[ 2]    · done (at +3.0ms)\n"+
+		"[ 1]  EXIT:  burst 2\n"+
+		"[ 0]EXIT:  outer\n", outputs[0])
+}
+
+func TestGoroutineStateRace(test *testing.T) {
+	out := &lockedBuffer{}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: out}}, GoroutineStateTTL: time.Millisecond, AttachPendingTimeout: time.Millisecond})
+	defer t.Close()
+	stop := make(chan struct{})
+	compacted := make(chan struct{})
+	go func() {
+		defer close(compacted)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				t.CompactNow()
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				traceBurst(t, i)
+				t.AttachLog("between bursts")
+				time.Sleep(time.Duration(j%3) * time.Millisecond)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	<-compacted
+
+	// Every burst started over at depth 0
+	assert.Equal(test, 32*20, strings.Count(out.String(), "[ 0]ENTER: "))
+	assert.Equal(test, 32*20, strings.Count(out.String(), "[ 1]  ENTER: "))
+	assert.Eventually(test, func() bool { return t.GoroutineStateCount() == 0 }, 15*time.Second, time.Millisecond)
+}
+
+func TestGoroutineStateLeak(test *testing.T) {
+	n := 1000000
+	if testing.Short() {
+		n = 10000
+	}
+	const batch = 1000
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard, MinDuration: time.Hour}}})
+	max := 0
+	for i := 0; i < n; i += batch {
+		var wg sync.WaitGroup
+		for j := 0; j < batch; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.Start().End()
+			}()
+		}
+		wg.Wait()
+		if count := t.GoroutineStateCount(); count > max {
+			max = count
+		}
+	}
+	assert.Equal(test, 0, max)
+}
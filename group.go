@@ -0,0 +1,78 @@
+package tracey
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A TraceGroup runs tasks on their own goroutines like an errgroup, with
+// every task traced as a span within the group's own span, see
+// `Tracer.Group()`.
+type TraceGroup struct {
+	t    *Tracer
+	span *Span
+
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	errs []error
+}
+
+// Group starts a span for the calling function, and returns a group of
+// tasks running within it. The span ends when `Wait()` is called.
+//
+//	g := tracer.Group()
+//	g.Go("fetch users", fetchUsers)
+//	g.Go("fetch orders", fetchOrders)
+//	err := g.Wait()
+func (t *Tracer) Group() *TraceGroup {
+	return &TraceGroup{t: t, span: t.Start("%s", "$FN")}
+}
+
+// Go runs the task on a new goroutine, traced as a span with the given
+// name whose parent is the group's span. A task which returns an error
+// or panics fails its span, panics are turned into errors unless the
+// "PropagateTaskPanics" option is set.
+func (g *TraceGroup) Go(name string, fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		span := noopSpan
+		if g.t.start != nil {
+			span = g.t.start(g.span, name, nil)
+		}
+		err := g.run(name, fn)
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			g.mu.Lock()
+			g.errs = append(g.errs, err)
+			g.mu.Unlock()
+		}
+	}()
+}
+
+// Runs the task, turning a panic into an error if so configured
+func (g *TraceGroup) run(name string, fn func() error) (err error) {
+	if !g.t.options.PropagateTaskPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("task %q panicked: %v", name, r)
+			}
+		}()
+	}
+	return fn()
+}
+
+// Wait blocks until every task is over, ends the group's span and returns
+// the errors of the failed tasks joined together (nil if none failed). The
+// group's span is failed with the same error.
+func (g *TraceGroup) Wait() error {
+	g.wg.Wait()
+	g.mu.Lock()
+	err := errors.Join(g.errs...)
+	g.mu.Unlock()
+	g.span.SetError(err)
+	g.span.End()
+	return err
+}
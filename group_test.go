@@ -0,0 +1,118 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A writer safe for concurrent use
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+// Decodes the exit events written by a JSON sink
+func jsonExits(test *testing.T, js *lockedBuffer) []map[string]interface{} {
+	var exits []map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(js.String()))
+	for decoder.More() {
+		var ev map[string]interface{}
+		assert.Nil(test, decoder.Decode(&ev))
+		if ev["kind"] == "exit" {
+			exits = append(exits, ev)
+		}
+	}
+	return exits
+}
+
+func TestTraceGroup(test *testing.T) {
+	js := &lockedBuffer{}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: js, Format: JSONFormat}}})
+
+	var err error
+	func() {
+		defer t.Enter("%s", "outer")()
+		g := t.Group()
+		for i := 0; i < 5; i++ {
+			i := i
+			g.Go(fmt.Sprintf("task %d", i), func() error {
+				defer t.Enter("%s", "nested")()
+				switch i {
+				case 1:
+					return errors.New("no luck")
+				case 3:
+					panic("boom")
+				}
+				return nil
+			})
+		}
+		err = g.Wait()
+		// Every task span is closed by the time Wait returns
+		assert.Equal(test, 1, len(t.Snapshot()))
+	}()
+	assert.ElementsMatch(test, []string{"no luck", `task "task 3" panicked: boom`}, strings.Split(err.Error(), "\n"))
+
+	// The group's span is within "outer", the tasks within the group's span
+	// and the nested spans within their task
+	byID := make(map[interface{}]map[string]interface{})
+	for _, ev := range jsonExits(test, js) {
+		byID[ev["span"]] = ev
+	}
+	assert.Equal(test, 12, len(byID))
+	var group map[string]interface{}
+	for _, ev := range byID {
+		if ev["depth"] == 1.0 {
+			group = ev
+		}
+	}
+	assert.Equal(test, "go-tracey.TestTraceGroup.func1", group["name"])
+	assert.Equal(test, err.Error(), group["err"])
+
+	tasks := 0
+	for _, ev := range byID {
+		switch ev["depth"] {
+		case 2.0:
+			tasks++
+			assert.Equal(test, group["span"], ev["parent"])
+			assert.Equal(test, group["trace"], ev["trace"])
+			switch ev["name"] {
+			case "task 1":
+				assert.Equal(test, "no luck", ev["err"])
+			case "task 3":
+				assert.Equal(test, `task "task 3" panicked: boom`, ev["err"])
+			default:
+				assert.NotContains(test, ev, "err")
+			}
+		case 3.0:
+			assert.Equal(test, "nested", ev["msg"])
+			assert.Equal(test, 2.0, byID[ev["parent"]]["depth"])
+		}
+	}
+	assert.Equal(test, 5, tasks)
+}
+
+func TestTraceGroupPropagatePanics(test *testing.T) {
+	t := NewTracer(&Options{DisableTracing: true, PropagateTaskPanics: true})
+	g := t.Group()
+	assert.Panics(test, func() { g.run("task", func() error { panic("boom") }) })
+	assert.Nil(test, g.Wait())
+}
@@ -0,0 +1,99 @@
+package tracey
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A HandlerOrdering is when the "EventHandler" is called, and so in which
+// order it sees the events, see `Options.HandlerOrdering`.
+type HandlerOrdering int
+
+const (
+	// The handler is called by the traced goroutine as the event is
+	// numbered, one call at a time, so that it sees the events in the
+	// order of their "Seq", which goes up strictly from one call to the
+	// next. The traced code waits for the handler, and for the calls of
+	// the other goroutines.
+	Emission HandlerOrdering = iota
+
+	// The handler is called from a goroutine of its own, so that the
+	// traced code only waits to queue the event. The events of each
+	// goroutine come in the order they were traced in, but those of
+	// different goroutines may not, their "Seq" telling the order they
+	// were traced in. `Flush()` waits for the queue to drain.
+	Delivery
+)
+
+// The events queued for the "EventHandler" in `Delivery` order
+type handlerQueue struct {
+	sync.Mutex
+	handle  func(Event)
+	events  []Event
+	running bool
+}
+
+// Numbers the event, unless it was already, and hands it to the
+// "EventHandler" if there is one
+func (t *Tracer) sequence(ev *Event) {
+	if ev.Seq != 0 {
+		return
+	}
+	handle := t.options.EventHandler
+	if handle == nil {
+		ev.Seq = atomic.AddUint64(&t.seq, 1)
+		return
+	}
+	if t.handlers != nil {
+		ev.Seq = atomic.AddUint64(&t.seq, 1)
+		t.handlers.enqueue(*ev)
+		return
+	}
+	t.handling.Lock()
+	defer t.handling.Unlock()
+	ev.Seq = atomic.AddUint64(&t.seq, 1)
+	handle(*ev)
+}
+
+func (q *handlerQueue) enqueue(ev Event) {
+	q.Lock()
+	defer q.Unlock()
+	q.events = append(q.events, ev)
+	if !q.running {
+		q.running = true
+		go q.drain()
+	}
+}
+
+// Hands the queued events to the handler, until there are none left
+func (q *handlerQueue) drain() {
+	for {
+		q.Lock()
+		batch := q.events
+		q.events = nil
+		if len(batch) == 0 {
+			q.running = false
+			q.Unlock()
+			return
+		}
+		q.Unlock()
+
+		for _, ev := range batch {
+			q.handle(ev)
+		}
+	}
+}
+
+// Waits for the queue to drain
+func (q *handlerQueue) flush() {
+	for {
+		q.Lock()
+		running := q.running
+		q.Unlock()
+		if !running {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,153 @@
+package tracey
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHandoffTokenUsed is returned by `Tracer.Accept(...)` for a token which
+// was already accepted, or which no handoff returned.
+var ErrHandoffTokenUsed = errors.New("tracey: handoff token already used")
+
+// A HandoffToken hands a span over to another goroutine, see
+// `Span.Transfer()`.
+type HandoffToken struct {
+	span *Span
+
+	// Which of the span's handoffs the token is for
+	n uint32
+}
+
+// The handoffs of a span, see `Span.Transfer()`. Guarded by the lock of
+// its suspensions, as both move the span between goroutines.
+type handoff struct {
+	// Set while the span is handed off, along with how many times it was,
+	// when and from which goroutine
+	pending bool
+	n       uint32
+	since   time.Time
+	from    uint64
+
+	// The goroutines which owned the span in turn, once it was handed off
+	owners []uint64
+}
+
+// Transfer detaches the span from the calling goroutine, for pipelines
+// which pass a work item from stage to stage, so that a single span covers
+// its whole journey. Until the goroutine of the next stage takes it over
+// with `Tracer.Accept(...)`, the span is on no goroutine: spans entered on
+// the calling goroutine from then on are not within it, and the span's
+// clock keeps running. The spans within it should have ended by then.
+// The exit of the span lists the goroutines which owned it in turn. Spans
+// which are not accepted within "HandoffTimeout" are ended. Returns a
+// zero token, which does not hand anything over, for spans which are
+// handed off or suspended already, or have ended.
+func (s *Span) Transfer() HandoffToken {
+	t := s.t
+	if t == nil {
+		return HandoffToken{}
+	}
+	s.pause.Lock()
+	defer s.pause.Unlock()
+	h := &s.handoff
+	if h.pending || s.pause.suspended || atomic.LoadUint32(&s.ended) != 0 {
+		return HandoffToken{}
+	}
+	t.goroutines.exit(s, !t.options.DisableNesting)
+	if len(h.owners) == 0 {
+		h.owners = []uint64{s.ev.TID}
+	}
+	h.pending, h.since, h.from = true, t.options.Clock(), s.ev.TID
+	h.n++
+	t.handoffs.add(s)
+	if t.options.HandoffTimeout > 0 {
+		t.scanner.start(t)
+	}
+	return HandoffToken{s, h.n}
+}
+
+// Accept attaches a span which was handed off (see `Span.Transfer()`) to
+// the calling goroutine, as the innermost span open on it, at its current
+// depth, and logs the handoff within the span, as in
+// "↷ handed off tid 4 → tid 9". Each token hands the span over once,
+// using it again returns `ErrHandoffTokenUsed`. A span which ended while
+// handed off is left as is, with a warning.
+func (t *Tracer) Accept(token HandoffToken) error {
+	s := token.span
+	if s == nil || s.t != t {
+		return ErrHandoffTokenUsed
+	}
+	s.pause.Lock()
+	defer s.pause.Unlock()
+	h := &s.handoff
+	if atomic.LoadUint32(&s.ended) != 0 {
+		warning := "Warning: accepting a span which has ended in tracey.\n"
+		if t.admitOutput(len(warning)) {
+			t.note(warning)
+		}
+		return nil
+	}
+	if !h.pending || token.n != h.n {
+		return ErrHandoffTokenUsed
+	}
+	gid := getGID()
+	s.ev.TID = gid
+	t.goroutines.attach(s, !t.options.DisableNesting)
+	h.pending = false
+	h.owners = append(h.owners, gid)
+	t.handoffs.remove(s)
+	t.spanEvent(s, gid, "↷ handed off tid "+strconv.FormatUint(h.from, 10)+" → tid "+strconv.FormatUint(gid, 10))
+	return nil
+}
+
+// Fills in the owners of the exit event of a span which was handed off.
+// Must be called with the lock of its suspensions held.
+func (t *Tracer) exitHandoffs(s *Span, ev *Event) {
+	h := &s.handoff
+	if h.n == 0 {
+		return
+	}
+	if h.pending {
+		t.handoffs.remove(s)
+	}
+	ev.Owners = h.owners
+}
+
+// Ends the spans which were handed off longer than "HandoffTimeout" ago
+// and not accepted since, noting it within them. Returns false if there
+// are no spans handed off.
+func (sc *scanner) scanHandoffs(t *Tracer, now time.Time) bool {
+	t.handoffs.Lock()
+	pending := len(t.handoffs.spans) > 0
+	var due []*Span
+	for s := range t.handoffs.spans {
+		due = append(due, s)
+	}
+	t.handoffs.Unlock()
+	for _, s := range due {
+		s.pause.Lock()
+		h := &s.handoff
+		expired := h.pending && now.Sub(h.since) >= t.options.HandoffTimeout
+		if expired {
+			t.spanEvent(s, h.from, "↷ handoff from tid "+strconv.FormatUint(h.from, 10)+" never accepted, ended")
+		}
+		s.pause.Unlock()
+		if expired {
+			s.End()
+		}
+	}
+	return pending
+}
+
+// Renders the owners of a span which was handed off, as in
+// "tid 4 → tid 9"
+func renderOwners(owners []uint64) string {
+	parts := make([]string, len(owners))
+	for i, tid := range owners {
+		parts[i] = "tid " + strconv.FormatUint(tid, 10)
+	}
+	return strings.Join(parts, " → ")
+}
@@ -0,0 +1,145 @@
+package tracey
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns how many goroutines the tracer keeps a record of
+func goroutineRecords(t *Tracer) int {
+	n := 0
+	for i := range t.goroutines.shards {
+		shard := &t.goroutines.shards[i]
+		shard.Lock()
+		n += len(shard.g)
+		shard.Unlock()
+	}
+	return n
+}
+
+func TestTransferAccept(test *testing.T) {
+	var text, js lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Writer: &text}, {Writer: &js, Format: JSONFormat}},
+		Clock:                 clock.Now,
+		EnableInstrumentation: true,
+	})
+
+	tids := []uint64{getGID()}
+	item := t.Start("%s", "item")
+	clock.advance(10 * time.Millisecond)
+	token := item.Transfer()
+	t.Enter("%s", "unrelated")()
+	for _, d := range []time.Duration{12 * time.Millisecond, 5 * time.Millisecond} {
+		onGoroutine(func() {
+			tids = append(tids, getGID())
+			defer t.Enter("%s", "stage")()
+			clock.advance(time.Millisecond)
+			assert.Nil(test, t.Accept(token))
+			t.Enter("%s", "work")()
+			clock.advance(d)
+			token = item.Transfer()
+		})
+	}
+	onGoroutine(func() {
+		tids = append(tids, getGID())
+		assert.Nil(test, t.Accept(token))
+		clock.advance(2 * time.Millisecond)
+		item.End()
+	})
+	assert.Equal(test, 0, goroutineRecords(t))
+	assert.Empty(test, t.Snapshot())
+
+	tid := func(i int) string { return "tid " + strconv.FormatUint(tids[i], 10) }
+	assert.Equal(test, []string{
+		"[ 0]ENTER: =>item",
+		"[ 0]ENTER: =>unrelated",
+		"[ 0]EXIT:  =>unrelated ... in 0s",
+		"[ 0]ENTER: =>stage",
+		"[ 2]    · ↷ handed off " + tid(0) + " → " + tid(1) + " (at +11.0ms)",
+		"[ 2]    ENTER: =>work",
+		"[ 2]    EXIT:  =>work ... in 0s",
+		"[ 0]EXIT:  =>stage ... in 13ms",
+		"[ 0]ENTER: =>stage",
+		"[ 2]    · ↷ handed off " + tid(1) + " → " + tid(2) + " (at +24.0ms)",
+		"[ 2]    ENTER: =>work",
+		"[ 2]    EXIT:  =>work ... in 0s",
+		"[ 0]EXIT:  =>stage ... in 6ms",
+		"[ 1]  · ↷ handed off " + tid(2) + " → " + tid(3) + " (at +29.0ms)",
+		"[ 0]EXIT:  =>item ... in 31ms [owners " + tid(0) + " → " + tid(1) + " → " + tid(2) + " → " + tid(3) + "]",
+	}, strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(text.String(), "=>")), "\n"))
+
+	lines := strings.Split(strings.TrimSpace(js.String()), "\n")
+	exit, err := UnmarshalEvent([]byte(lines[len(lines)-1]))
+	assert.Nil(test, err)
+	assert.Equal(test, tids, exit.Owners)
+	assert.Equal(test, 31*time.Millisecond, exit.Duration)
+	assert.Len(test, exit.Events, 3)
+}
+
+func TestHandoffMisuse(test *testing.T) {
+	var out bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}})
+
+	item := t.Start("%s", "item")
+	token := item.Transfer()
+	assert.Equal(test, HandoffToken{}, item.Transfer())
+	assert.Equal(test, ErrHandoffTokenUsed, t.Accept(HandoffToken{}))
+	assert.Equal(test, ErrHandoffTokenUsed, NewTracer(nil).Accept(token))
+	onGoroutine(func() {
+		assert.Nil(test, t.Accept(token))
+		assert.Equal(test, ErrHandoffTokenUsed, t.Accept(token))
+		token = item.Transfer()
+	})
+
+	// A span ended while handed off is on no goroutine, and stays ended
+	item.End()
+	assert.Equal(test, HandoffToken{}, item.Transfer())
+	out.Reset()
+	onGoroutine(func() {
+		assert.Nil(test, t.Accept(token))
+		assert.Nil(test, t.Accept(token))
+		t.Enter("%s", "next")()
+	})
+	assert.Equal(test, "Warning: accepting a span which has ended in tracey.\n"+
+		"Warning: accepting a span which has ended in tracey.\n"+
+		"[ 0]ENTER: =>next\n"+
+		"[ 0]EXIT:  =>next\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	assert.Equal(test, 0, goroutineRecords(t))
+
+	// Suspended spans are not handed off
+	rows := t.Start("%s", "rows")
+	resume := rows.Suspend()
+	assert.Equal(test, HandoffToken{}, rows.Transfer())
+	assert.Nil(test, t.Resume(resume))
+	rows.End()
+	assert.Equal(test, 0, goroutineRecords(t))
+}
+
+func TestHandoffTimeout(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, Clock: clock.Now, HandoffTimeout: 50 * time.Millisecond})
+	defer t.Close()
+
+	gid := getGID()
+	item := t.Start("%s", "item")
+	token := item.Transfer()
+	clock.advance(time.Second)
+	assert.Eventually(test, func() bool {
+		return strings.Contains(out.String(), "EXIT:")
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(test, "[ 0]ENTER: =>item\n"+
+		"[ 1]  · ↷ handoff from tid "+strconv.FormatUint(gid, 10)+" never accepted, ended (at +1.0s)\n"+
+		"[ 0]EXIT:  =>item [owners tid "+strconv.FormatUint(gid, 10)+"]\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+
+	assert.Nil(test, t.Accept(token))
+	assert.Contains(test, out.String(), "Warning: accepting a span which has ended in tracey.")
+	assert.Equal(test, 0, goroutineRecords(t))
+}
@@ -0,0 +1,57 @@
+package tracey
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// An IDGenerator mints the ids of traces and spans. Ids are opaque
+// strings, tracey never looks into them. A trace is a tree of spans
+// started within each other, and takes its id from its root span.
+type IDGenerator interface {
+	NewTraceID() string
+	NewSpanID() string
+}
+
+// The default IDGenerator, which counts traces and spans from 1. Its ids
+// are short and readable, but start over with every tracer.
+type counterIDs struct {
+	traces uint64
+	spans  uint64
+}
+
+func (c *counterIDs) NewTraceID() string {
+	return strconv.FormatUint(atomic.AddUint64(&c.traces, 1), 10)
+}
+
+func (c *counterIDs) NewSpanID() string {
+	return strconv.FormatUint(atomic.AddUint64(&c.spans, 1), 10)
+}
+
+// RandomHexIDs is an IDGenerator of random ids, 16 bytes long for traces
+// and 8 bytes long for spans, hex encoded as in W3C trace contexts. They
+// come from crypto/rand, or from math/rand should that ever fail.
+type RandomHexIDs struct{}
+
+// Scratch space for the random bytes and their encoding
+var idBufferPool = sync.Pool{
+	New: func() interface{} { return new([48]byte) },
+}
+
+func randomHex(n int) string {
+	buf := idBufferPool.Get().(*[48]byte)
+	defer idBufferPool.Put(buf)
+	raw, encoded := buf[:n], buf[16:16+2*n]
+	if _, err := cryptorand.Read(raw); err != nil {
+		rand.Read(raw)
+	}
+	hex.Encode(encoded, raw)
+	return string(encoded)
+}
+
+func (RandomHexIDs) NewTraceID() string { return randomHex(16) }
+func (RandomHexIDs) NewSpanID() string  { return randomHex(8) }
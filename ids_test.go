@@ -0,0 +1,59 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// An IDGenerator of predictable ids, which do not look like numbers
+type fakeIDs struct{ traces, spans int }
+
+func (f *fakeIDs) NewTraceID() string { f.traces++; return fmt.Sprintf("trace-%c", 'a'+f.traces-1) }
+func (f *fakeIDs) NewSpanID() string  { f.spans++; return fmt.Sprintf("span-%c", 'a'+f.spans-1) }
+
+func TestIDGenerator(test *testing.T) {
+	ResetTestBuffer()
+	var js, rows bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:       []Sink{{Logger: BufLogger}, {Writer: &js, Format: JSONFormat}},
+		CSVWriter:   &rows,
+		IDGenerator: &fakeIDs{},
+		ShowIDs:     true,
+	})
+
+	func() {
+		defer t.Enter("%s", "root")()
+		t.Start("%s", "child").End()
+	}()
+	t.Start("%s", "second").End()
+
+	assert.Equal(test, `
+[ 0]ENTER: =>root [trace=trace-a span=span-a]
+[ 1]  ENTER: =>child [trace=trace-a span=span-b]
+[ 1]  EXIT:  =>child [trace=trace-a span=span-b]
+[ 0]EXIT:  =>root [trace=trace-a span=span-a]
+[ 0]ENTER: =>second [trace=trace-b span=span-c]
+[ 0]EXIT:  =>second [trace=trace-b span=span-c]
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+	assert.Contains(test, js.String(), `"trace":"trace-a","span":"span-b","parent":"span-a"`)
+	assert.Contains(test, js.String(), `"trace":"trace-b","span":"span-c","name"`)
+	assert.Contains(test, rows.String(), ",span-b,span-a,1,")
+}
+
+func TestRandomHexIDs(test *testing.T) {
+	var ids RandomHexIDs
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		trace, span := ids.NewTraceID(), ids.NewSpanID()
+		assert.Equal(test, 32, len(trace))
+		assert.Equal(test, 16, len(span))
+		_, err := hex.DecodeString(trace + span)
+		assert.Nil(test, err)
+		assert.False(test, seen[trace] || seen[span])
+		seen[trace], seen[span] = true, true
+	}
+}
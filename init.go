@@ -0,0 +1,155 @@
+package tracey
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultInitTraceLimit is how many events `TraceInit(...)` buffers until
+// a tracer adopts them, unless changed with `SetInitTraceLimit(...)`.
+const DefaultInitTraceLimit = 1024
+
+// The events recorded by `TraceInit(...)` before any tracer is configured
+type initBuffer struct {
+	sync.Mutex
+	events  []Event
+	depth   int
+	limit   int
+	dropped uint64
+
+	// Where the buffer is dumped the first time it overflows
+	overflow io.Writer
+	dumped   bool
+
+	// The tracer which took over, see `AdoptInitTrace()`
+	adopted *Tracer
+}
+
+var initTrace = initBuffer{limit: DefaultInitTraceLimit, overflow: os.Stderr}
+
+// TraceInit traces a package's initialization, as in
+//
+//	func init() {
+//		defer tracey.TraceInit("mypkg")()
+//		...
+//	}
+//
+// Since init functions run before main gets to configure a tracer, the
+// events are buffered in memory until a tracer takes them over with
+// `AdoptInitTrace()`, after which they are traced by that tracer directly.
+func TraceInit(name string) func() {
+	b := &initTrace
+	b.Lock()
+	defer b.Unlock()
+	if t := b.adopted; t != nil {
+		if t.options.DisableTracing {
+			return func() {}
+		}
+		return t.start(nil, name, nil).End
+	}
+
+	gid := getGID()
+	enter := Event{Kind: EnterEvent, Time: time.Now(), TID: gid, Depth: b.depth, Name: name, Message: name}
+	enter.text = lineText(gid, name)
+	b.depth++
+	b.add(enter)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.Lock()
+			defer b.Unlock()
+			if b.depth > 0 {
+				b.depth--
+			}
+			exit := enter
+			now := time.Now()
+			exit.Kind = ExitEvent
+			exit.Duration = now.Sub(enter.Time)
+			exit.Time = now
+			exit.Depth = b.depth
+			if t := b.adopted; t != nil {
+				if !t.options.DisableTracing {
+					t.replay([]Event{exit}, 0)
+				}
+				return
+			}
+			b.add(exit)
+		})
+	}
+}
+
+// Buffers an event, dumping the buffer the first time it is full and
+// dropping any further events. Must be called with the lock held.
+func (b *initBuffer) add(ev Event) {
+	if len(b.events) < b.limit {
+		b.events = append(b.events, ev)
+		return
+	}
+	b.dropped++
+	if !b.dumped {
+		b.dumped = true
+		dumpInitEvents(b.overflow, b.events, 0)
+		io.WriteString(b.overflow, "TRACE INIT BUFFER FULL ("+formatCount(uint64(b.limit))+" events) — further init events dropped\n")
+	}
+}
+
+// SetInitTraceLimit changes how many events `TraceInit(...)` buffers,
+// where 0 restores `DefaultInitTraceLimit`. Events already buffered are
+// kept.
+func SetInitTraceLimit(n int) {
+	if n <= 0 {
+		n = DefaultInitTraceLimit
+	}
+	initTrace.Lock()
+	initTrace.limit = n
+	initTrace.Unlock()
+}
+
+// DumpInitTrace writes the events buffered by `TraceInit(...)` to "w" as
+// text, with their durations. The buffer is left as is.
+func DumpInitTrace(w io.Writer) {
+	initTrace.Lock()
+	defer initTrace.Unlock()
+	dumpInitEvents(w, initTrace.events, initTrace.dropped)
+}
+
+func dumpInitEvents(w io.Writer, events []Event, dropped uint64) {
+	NewTracer(&Options{Sinks: []Sink{{Writer: w}}, EnableInstrumentation: true}).replay(events, dropped)
+}
+
+// AdoptInitTrace replays the events buffered by `TraceInit(...)` through
+// the tracer's sinks, with the times and durations they were recorded
+// with, and has `TraceInit(...)` use the tracer from then on.
+func (t *Tracer) AdoptInitTrace() {
+	b := &initTrace
+	b.Lock()
+	defer b.Unlock()
+	events, dropped := b.events, b.dropped
+	b.events, b.dropped, b.adopted = nil, 0, t
+	if !t.options.DisableTracing {
+		t.replay(events, dropped)
+	}
+}
+
+// Writes out events which were recorded before the tracer existed
+func (t *Tracer) replay(events []Event, dropped uint64) {
+	for i := range events {
+		ev := events[i]
+		if templates := t.config.Load().templates; templates != nil {
+			ev.template = templates.lookup(ev.Name)
+		}
+		t.emit(&ev)
+		if t.csv != nil {
+			t.csv.write(&ev)
+		}
+	}
+	if dropped > 0 {
+		warning := "TRACE INIT BUFFER FULL — " + formatCount(dropped) + " init events dropped\n"
+		if t.admitOutput(len(warning)) {
+			t.note(warning)
+		}
+	}
+}
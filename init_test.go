@@ -0,0 +1,88 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Empties the init trace buffer, with its dumps going to "overflow"
+func resetInitTrace(overflow *bytes.Buffer) {
+	initTrace.Lock()
+	initTrace.events, initTrace.depth, initTrace.dropped = nil, 0, 0
+	initTrace.limit, initTrace.overflow, initTrace.dumped = DefaultInitTraceLimit, overflow, false
+	initTrace.adopted = nil
+	initTrace.Unlock()
+}
+
+// Stand-ins for the init functions of two packages, where "pkgb" is
+// imported by "pkga" and so initialized first
+func initPkgB() {
+	defer TraceInit("pkgb")()
+	time.Sleep(2 * time.Millisecond)
+}
+func initPkgA() {
+	defer TraceInit("pkga")()
+	func() {
+		defer TraceInit("pkga.loadConfig")()
+	}()
+}
+
+func TestAdoptInitTrace(test *testing.T) {
+	resetInitTrace(nil)
+	initPkgB()
+	initPkgA()
+
+	js := &lockedBuffer{}
+	t := NewTracer(&Options{Sinks: []Sink{{Logger: BufLogger}, {Writer: js, Format: JSONFormat}}})
+	ResetTestBuffer()
+	t.AdoptInitTrace()
+	assert.Equal(test, `
+[ 0]ENTER: =>pkgb
+[ 0]EXIT:  =>pkgb
+[ 0]ENTER: =>pkga
+[ 1]  ENTER: =>pkga.loadConfig
+[ 1]  EXIT:  =>pkga.loadConfig
+[ 0]EXIT:  =>pkga
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+
+	// The recorded durations and times are kept
+	exits := jsonExits(test, js)
+	if assert.Equal(test, 3, len(exits)) {
+		assert.True(test, exits[0]["dur"].(float64) >= float64(2*time.Millisecond))
+		assert.True(test, exits[0]["time"].(string) <= exits[2]["time"].(string))
+	}
+
+	// Once adopted, init tracing goes to the tracer directly
+	ResetTestBuffer()
+	initPkgA()
+	assert.Equal(test, `
+[ 0]ENTER: =>pkga
+[ 1]  ENTER: =>pkga.loadConfig
+[ 1]  EXIT:  =>pkga.loadConfig
+[ 0]EXIT:  =>pkga
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+	resetInitTrace(nil)
+}
+
+func TestInitTraceOverflow(test *testing.T) {
+	var overflow bytes.Buffer
+	resetInitTrace(&overflow)
+	SetInitTraceLimit(4)
+	initPkgB()
+	initPkgA()
+	initPkgB()
+
+	assert.Equal(test, 4, strings.Count(overflow.String(), "\n")-1)
+	assert.True(test, strings.HasSuffix(overflow.String(), "TRACE INIT BUFFER FULL (4 events) — further init events dropped\n"))
+	assert.Contains(test, overflow.String(), "EXIT:  ")
+
+	var dump bytes.Buffer
+	DumpInitTrace(&dump)
+	assert.Equal(test, 5, strings.Count(dump.String(), "\n"))
+	assert.True(test, strings.HasSuffix(dump.String(), "TRACE INIT BUFFER FULL — 4 init events dropped\n"))
+	resetInitTrace(nil)
+}
@@ -0,0 +1,111 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An InjectionSpec is the latency injected into the calls of the functions
+// matching a pattern of "LatencyInjection". A call is delayed by
+// "FixedDelay" plus up to "JitterMax" more, at random.
+type InjectionSpec struct {
+	FixedDelay time.Duration
+	JitterMax  time.Duration
+
+	// The chance, from 0 to 1, that a call is delayed at all. The default
+	// value of 0 delays every call.
+	Probability float64
+}
+
+// Set once `DisableInjection()` has been called
+var injectionDisabled uint32
+
+// DisableInjection stops every tracer from injecting latency into the
+// calls entered from then on, whatever their "LatencyInjection" says.
+// There is no turning it back on.
+func DisableInjection() {
+	atomic.StoreUint32(&injectionDisabled, 1)
+}
+
+// The "LatencyInjection" of a tracer, compiled, along with the spec found
+// for every function name so far (nil if none). Patterns are tried in
+// lexical order, the first match wins.
+type injections struct {
+	patterns []*regexp.Regexp
+	specs    []InjectionSpec
+	byName   sync.Map
+
+	// Serializes the draws from "InjectionRand"
+	mu   sync.Mutex
+	rand func() float64
+}
+
+func compileInjections(sources map[string]InjectionSpec) (*injections, error) {
+	in := &injections{}
+	keys := make([]string, 0, len(sources))
+	for key := range sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pattern, err := regexp.Compile(key)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern in LatencyInjection: %v", err)
+		}
+		in.patterns = append(in.patterns, pattern)
+		in.specs = append(in.specs, sources[key])
+	}
+	return in, nil
+}
+
+func (in *injections) lookup(name string) *InjectionSpec {
+	if found, ok := in.byName.Load(name); ok {
+		return found.(*InjectionSpec)
+	}
+	var found *InjectionSpec
+	for i, pattern := range in.patterns {
+		if pattern.MatchString(name) {
+			found = &in.specs[i]
+			break
+		}
+	}
+	in.byName.Store(name, found)
+	return found
+}
+
+// Returns how long a call of the spec is delayed, if at all
+func (in *injections) draw(spec *InjectionSpec) time.Duration {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if spec.Probability > 0 && in.rand() >= spec.Probability {
+		return 0
+	}
+	delay := spec.FixedDelay
+	if spec.JitterMax > 0 {
+		delay += time.Duration(in.rand() * float64(spec.JitterMax))
+	}
+	return delay
+}
+
+// Picks how long the span's call is delayed by, which its enter waits for
+// once logged
+func (t *Tracer) enterInjection(span *Span) {
+	if atomic.LoadUint32(&injectionDisabled) != 0 {
+		return
+	}
+	if spec := t.injections.lookup(span.ev.Name); spec != nil {
+		span.ev.Injected = t.injections.draw(spec)
+	}
+}
+
+// Writes the latency injected into the call, as in "[injected +25ms]"
+func renderInjected(buf *bytes.Buffer, ev *Event) {
+	buf.WriteString(" [injected +")
+	writeDuration(buf, ev.Injected)
+	buf.WriteByte(']')
+}
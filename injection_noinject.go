@@ -0,0 +1,7 @@
+//go:build tracey_noinject
+
+package tracey
+
+// Whether "LatencyInjection" is built in, which the "tracey_noinject"
+// build tag leaves it out of
+const injectionBuilt = false
@@ -0,0 +1,25 @@
+//go:build tracey_noinject
+
+package tracey
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyInjectionLeftOut(test *testing.T) {
+	var out bytes.Buffer
+	slept := false
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Writer: &out}},
+		Sleep:            func(time.Duration) { slept = true },
+		LatencyInjection: map[string]InjectionSpec{".": {FixedDelay: time.Second}},
+	})
+	t.Enter()()
+
+	assert.False(test, slept)
+	assert.NotContains(test, out.String(), "injected")
+}
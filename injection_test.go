@@ -0,0 +1,110 @@
+//go:build !tracey_noinject
+
+package tracey
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func injectedFetch(t *Tracer, clock *manualClock) {
+	defer t.Enter()()
+	clock.advance(2 * time.Millisecond)
+}
+
+func injectedTracer(out *bytes.Buffer, clock *manualClock, spec InjectionSpec, seed int64) *Tracer {
+	return NewTracer(&Options{
+		Sinks:            []Sink{{Writer: out}},
+		Clock:            clock.Now,
+		Sleep:            func(d time.Duration) { clock.advance(d) },
+		LatencyInjection: map[string]InjectionSpec{`\.injectedFetch$`: spec},
+		InjectionRand:    rand.New(rand.NewSource(seed)).Float64,
+	})
+}
+
+func TestLatencyInjection(test *testing.T) {
+	var out, js bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Writer: &out}, {Writer: &js, Format: JSONFormat}},
+		Clock:                 clock.Now,
+		Sleep:                 func(d time.Duration) { clock.advance(d) },
+		EnableInstrumentation: true,
+		LatencyInjection:      map[string]InjectionSpec{`\.injectedFetch$`: {FixedDelay: 25 * time.Millisecond}},
+	})
+	func() {
+		defer t.Enter("%s", "request")()
+		injectedFetch(t, clock)
+	}()
+
+	assert.Equal(test, "[ 0]ENTER: =>request\n"+
+		"[ 1]  ENTER: => [injected +25ms]\n"+
+		"[ 1]  EXIT:  => ... in 2ms [injected +25ms]\n"+
+		"[ 0]EXIT:  =>request ... in 27ms\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n")[1:3] {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		assert.Equal(test, 25*time.Millisecond, ev.Injected)
+	}
+
+	for _, s := range t.Stats() {
+		if strings.HasSuffix(s.Name, ".injectedFetch") {
+			assert.Equal(test, 2*time.Millisecond, s.Total)
+			assert.Equal(test, 25*time.Millisecond, s.InjectedTime)
+		} else {
+			assert.Equal(test, 27*time.Millisecond, s.Total)
+			assert.Equal(test, time.Duration(0), s.InjectedTime)
+		}
+	}
+	assert.Panics(test, func() { NewTracer(&Options{LatencyInjection: map[string]InjectionSpec{"(": {}}}) })
+	assert.NotNil(test, (&Options{LatencyInjection: map[string]InjectionSpec{"(": {}}}).Validate())
+}
+
+func TestLatencyInjectionJitter(test *testing.T) {
+	var out bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	spec := InjectionSpec{FixedDelay: 10 * time.Millisecond, JitterMax: 20 * time.Millisecond, Probability: 0.3}
+	t := injectedTracer(&out, clock, spec, 7)
+	for i := 0; i < 100; i++ {
+		injectedFetch(t, clock)
+	}
+
+	// The same draws, from the same seed: the chance of each call, then
+	// the jitter of the delayed ones
+	draws := rand.New(rand.NewSource(7))
+	var delayed int
+	var injected time.Duration
+	for i := 0; i < 100; i++ {
+		if draws.Float64() < spec.Probability {
+			delayed++
+			injected += spec.FixedDelay + time.Duration(draws.Float64()*float64(spec.JitterMax))
+		}
+	}
+	assert.True(test, delayed > 10 && delayed < 60)
+	assert.Equal(test, delayed*2, strings.Count(out.String(), "[injected +"))
+	stats := t.Stats()
+	assert.Equal(test, 200*time.Millisecond, stats[0].Total)
+	assert.Equal(test, injected, stats[0].InjectedTime)
+	assert.True(test, injected >= time.Duration(delayed)*spec.FixedDelay)
+	assert.True(test, injected < time.Duration(delayed)*(spec.FixedDelay+spec.JitterMax))
+}
+
+func TestDisableInjection(test *testing.T) {
+	defer atomic.StoreUint32(&injectionDisabled, 0)
+	var out bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := injectedTracer(&out, clock, InjectionSpec{FixedDelay: time.Second}, 1)
+	injectedFetch(t, clock)
+	DisableInjection()
+	injectedFetch(t, clock)
+
+	assert.Equal(test, 2, strings.Count(out.String(), "[injected +1s]"))
+	assert.Equal(test, time.Second, t.Stats()[0].InjectedTime)
+	assert.Equal(test, time.Date(2020, 1, 1, 0, 0, 1, int(4*time.Millisecond), time.UTC), clock.Now())
+}
@@ -0,0 +1,263 @@
+package tracey
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+// The names instruments may have, those Prometheus accepts for metrics
+var RE_instrumentName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// A Counter counts something which only goes up, such as cache hits or
+// bytes processed, see `Tracer.Counter(...)`. It saturates rather than
+// wrapping around. Its methods are safe for concurrent use.
+type Counter struct {
+	t    *Tracer
+	name string
+	n    uint64
+}
+
+// A Gauge holds a value which goes up and down, such as the entries of a
+// cache, see `Tracer.Gauge(...)`. It saturates rather than wrapping
+// around. Its methods are safe for concurrent use.
+type Gauge struct {
+	t    *Tracer
+	name string
+	n    int64
+}
+
+// Counter returns the counter named "name", creating it on first use. Its
+// value is listed by `Instruments()`, `DumpStats(...)` and
+// `PublishExpvar(...)`. The name must be that of a Prometheus metric, as
+// in "cache_hits": a counter with another name, or with the name of a
+// gauge, still counts but is listed nowhere, which is warned about.
+func (t *Tracer) Counter(name string) *Counter {
+	if found, ok := t.instruments.Load(name); ok {
+		if c, ok := found.(*Counter); ok {
+			return c
+		}
+		t.invalidInstrument(name, "is a gauge")
+		return &Counter{t: t, name: name}
+	}
+	if !RE_instrumentName.MatchString(name) {
+		t.invalidInstrument(name, "is not a valid metric name")
+		return &Counter{t: t, name: name}
+	}
+	found, _ := t.instruments.LoadOrStore(name, &Counter{t: t, name: name})
+	if c, ok := found.(*Counter); ok {
+		return c
+	}
+	return t.Counter(name)
+}
+
+// Gauge returns the gauge named "name", creating it on first use, see
+// `Counter(...)`.
+func (t *Tracer) Gauge(name string) *Gauge {
+	if found, ok := t.instruments.Load(name); ok {
+		if g, ok := found.(*Gauge); ok {
+			return g
+		}
+		t.invalidInstrument(name, "is a counter")
+		return &Gauge{t: t, name: name}
+	}
+	if !RE_instrumentName.MatchString(name) {
+		t.invalidInstrument(name, "is not a valid metric name")
+		return &Gauge{t: t, name: name}
+	}
+	found, _ := t.instruments.LoadOrStore(name, &Gauge{t: t, name: name})
+	if g, ok := found.(*Gauge); ok {
+		return g
+	}
+	return t.Gauge(name)
+}
+
+func (t *Tracer) invalidInstrument(name, why string) {
+	if t.start == nil {
+		return
+	}
+	warning := "Warning: instrument " + strconv.Quote(name) + " " + why + " in tracey, it is not listed.\n"
+	if t.admitOutput(len(warning)) {
+		t.note(warning)
+	}
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds "n" to the counter.
+func (c *Counter) Add(n uint64) {
+	for {
+		old := atomic.LoadUint64(&c.n)
+		sum := old + n
+		if sum < old {
+			sum = math.MaxUint64
+		}
+		if atomic.CompareAndSwapUint64(&c.n, old, sum) {
+			delta := sum - old
+			if delta > math.MaxInt64 {
+				delta = math.MaxInt64
+			}
+			c.t.attributeMetric(c.name, int64(delta))
+			return
+		}
+	}
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// Set sets the gauge to "v".
+func (g *Gauge) Set(v int64) {
+	old := atomic.SwapInt64(&g.n, v)
+	g.t.attributeMetric(g.name, saturatingAdd(v, -old))
+}
+
+// Add adds "n" to the gauge, which may be negative.
+func (g *Gauge) Add(n int64) {
+	for {
+		old := atomic.LoadInt64(&g.n)
+		sum := saturatingAdd(old, n)
+		if atomic.CompareAndSwapInt64(&g.n, old, sum) {
+			g.t.attributeMetric(g.name, sum-old)
+			return
+		}
+	}
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.n)
+}
+
+func saturatingAdd(a, b int64) int64 {
+	sum := a + b
+	switch {
+	case b > 0 && sum < a:
+		return math.MaxInt64
+	case b < 0 && sum > a:
+		return math.MinInt64
+	}
+	return sum
+}
+
+// Instruments returns the current value of every counter and gauge, by
+// name.
+func (t *Tracer) Instruments() map[string]float64 {
+	values := make(map[string]float64)
+	t.instruments.Range(func(name, value interface{}) bool {
+		switch i := value.(type) {
+		case *Counter:
+			values[name.(string)] = float64(i.Value())
+		case *Gauge:
+			values[name.(string)] = float64(i.Value())
+		}
+		return true
+	})
+	return values
+}
+
+// The changes of the instruments while a span was the innermost open on
+// its goroutine, in the order they were first changed, see
+// "AttributeMetricsToSpans"
+type spanMetrics struct {
+	sync.Mutex
+	names  []string
+	deltas []int64
+}
+
+// Adds the change of an instrument to the innermost span open on the
+// calling goroutine, if any
+func (t *Tracer) attributeMetric(name string, delta int64) {
+	if t == nil || !t.options.AttributeMetricsToSpans || t.start == nil || delta == 0 {
+		return
+	}
+	span := t.goroutines.innermost(getGID())
+	if span == nil {
+		return
+	}
+	m := span.metrics.Load()
+	if m == nil {
+		span.metrics.CompareAndSwap(nil, &spanMetrics{})
+		m = span.metrics.Load()
+	}
+	m.Lock()
+	defer m.Unlock()
+	for i, n := range m.names {
+		if n == name {
+			m.deltas[i] = saturatingAdd(m.deltas[i], delta)
+			return
+		}
+	}
+	m.names = append(m.names, name)
+	m.deltas = append(m.deltas, delta)
+}
+
+// Tags the exit event of a span with the changes of the instruments while
+// it was open, as in "cache_hits=3"
+func (t *Tracer) exitMetrics(span *Span, ev *Event) {
+	m := span.metrics.Load()
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	ev.Tags = ev.Tags[:len(ev.Tags):len(ev.Tags)]
+	for i, name := range m.names {
+		ev.Tags = append(ev.Tags, Tag{name, m.deltas[i]})
+	}
+}
+
+// Writes the value of every counter and gauge as a table, see
+// `DumpStats(...)`
+func (t *Tracer) dumpInstruments(w io.Writer) error {
+	var names []string
+	t.instruments.Range(func(name, _ interface{}) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTRUMENT\tKIND\tVALUE")
+	for _, name := range names {
+		found, _ := t.instruments.Load(name)
+		switch i := found.(type) {
+		case *Counter:
+			fmt.Fprintf(tw, "%s\tcounter\t%d\n", name, i.Value())
+		case *Gauge:
+			fmt.Fprintf(tw, "%s\tgauge\t%d\n", name, i.Value())
+		}
+	}
+	return tw.Flush()
+}
+
+// The value of every counter and gauge for `PublishExpvar(...)`
+func (t *Tracer) expvarInstruments() interface{} {
+	values := make(map[string]interface{})
+	t.instruments.Range(func(name, value interface{}) bool {
+		switch i := value.(type) {
+		case *Counter:
+			values[name.(string)] = i.Value()
+		case *Gauge:
+			values[name.(string)] = i.Value()
+		}
+		return true
+	})
+	return values
+}
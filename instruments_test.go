@@ -0,0 +1,108 @@
+package tracey
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstruments(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &lockedBuffer{}}}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				t.Counter("cache_hits").Inc()
+				t.Gauge("queue_len").Add(1)
+				t.Gauge("queue_len").Add(-1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(test, uint64(8000), t.Counter("cache_hits").Value())
+	assert.Same(test, t.Counter("cache_hits"), t.Counter("cache_hits"))
+	t.Gauge("queue_len").Set(-4)
+	assert.Equal(test, map[string]float64{"cache_hits": 8000, "queue_len": -4}, t.Instruments())
+
+	// Saturated rather than wrapped around
+	c := t.Counter("bytes_total")
+	c.Add(math.MaxUint64 - 1)
+	c.Add(5)
+	assert.Equal(test, uint64(math.MaxUint64), c.Value())
+	g := t.Gauge("depth")
+	g.Set(math.MinInt64 + 1)
+	g.Add(-5)
+	assert.Equal(test, int64(math.MinInt64), g.Value())
+}
+
+func TestInstrumentNames(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}})
+	bad := t.Counter("cache hits")
+	bad.Inc()
+	assert.Equal(test, uint64(1), bad.Value())
+	t.Counter("hits")
+	t.Gauge("hits").Set(3)
+	assert.Equal(test, map[string]float64{"hits": 0}, t.Instruments())
+	assert.Equal(test, "Warning: instrument \"cache hits\" is not a valid metric name in tracey, it is not listed.\n"+
+		"Warning: instrument \"hits\" is a counter in tracey, it is not listed.\n", out.String())
+}
+
+func TestAttributeMetricsToSpans(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{
+		Sinks:                   []Sink{{Writer: &out}},
+		MessageTemplates:        map[string]string{`.`: "$FN"},
+		AttributeMetricsToSpans: true,
+	})
+	hits, entries := t.Counter("cache_hits"), t.Gauge("entries")
+	hits.Inc()
+	func() {
+		defer t.StartNamed("outer").End()
+		hits.Add(2)
+		entries.Set(10)
+		func() {
+			defer t.StartNamed("inner").End()
+			hits.Inc()
+			entries.Add(-3)
+		}()
+		entries.Add(1)
+		// Each goroutine counts for its own spans
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hits.Add(100)
+		}()
+		wg.Wait()
+	}()
+	assert.Equal(test, "[ 0]ENTER: outer\n"+
+		"[ 1]  ENTER: inner\n"+
+		"[ 1]  EXIT:  inner {cache_hits=1 entries=-3}\n"+
+		"[ 0]EXIT:  outer {cache_hits=2 entries=11}\n", out.String())
+	assert.Equal(test, uint64(104), hits.Value())
+}
+
+func TestDumpInstruments(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &lockedBuffer{}}}})
+	t.StartNamed("load").End()
+	t.Counter("cache_hits").Add(12)
+	t.Gauge("entries").Set(-2)
+	var buf bytes.Buffer
+	assert.Nil(test, t.DumpStats(&buf))
+	dump := buf.String()
+	assert.Contains(test, dump, "\nINSTRUMENT  KIND     VALUE\n"+
+		"cache_hits  counter  12\n"+
+		"entries     gauge    -2\n")
+	assert.True(test, strings.Index(dump, "load") < strings.Index(dump, "INSTRUMENT"))
+
+	prefix := expvarPrefix(test)
+	assert.Nil(test, t.PublishExpvar(prefix))
+	assert.Equal(test, map[string]interface{}{"cache_hits": 12.0, "entries": -2.0}, readExpvars(test, prefix)["instruments"])
+}
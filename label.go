@@ -0,0 +1,59 @@
+package tracey
+
+import "sort"
+
+// A TraceFunc logs the entry of a function and returns the function which
+// logs its exit, like the one returned by `New(...)`.
+type TraceFunc func(...interface{}) func()
+
+// Label returns an enter function whose spans are named "name" rather
+// than after the function calling it, for thin wrappers and generated
+// code whose names mean little, as in
+//
+//	var traceFetch = tracer.Label("orders.fetch")
+//
+//	func fetch(id int) {
+//		defer traceFetch("fetching %d", id)()
+//		...
+//	}
+//
+// Unlike the name passed to `Group().Go(...)`, the label stands for the
+// function everywhere: "MessageTemplates" and "SuppressSubtrees" match it,
+// "$FN" is replaced by it, and `Stats()` counts its calls under it, the
+// enter functions of the same label sharing them. Since the stack is not
+// looked at, entering a span through a label is cheaper than through
+// `Enter(...)`. See `Labels()`.
+func (t *Tracer) Label(name string) TraceFunc {
+	if t.start == nil {
+		return func(...interface{}) func() { return noopSpan.End }
+	}
+	found, _ := t.labels.LoadOrStore(name, t.namedSite(name))
+	site := found.(*callsite)
+	return func(s ...interface{}) func() {
+		return t.start(nil, "", site, s...).End
+	}
+}
+
+// StartNamed starts a span the way `Start(...)` does, but named "name"
+// rather than after the calling function, for spans whose name is only
+// known at run time (such as the method of an RPC). The name stands for
+// the function as a label's does, but unlike `Label(...)` it is matched
+// against "MessageTemplates" and "SuppressSubtrees" on every call.
+func (t *Tracer) StartNamed(name string, s ...interface{}) *Span {
+	if t.start == nil {
+		return noopSpan
+	}
+	return t.start(nil, "", t.namedSite(name), s...)
+}
+
+// Labels returns the names of the labels created with `Label(...)` so
+// far, sorted.
+func (t *Tracer) Labels() []string {
+	var labels []string
+	t.labels.Range(func(name, _ interface{}) bool {
+		labels = append(labels, name.(string))
+		return true
+	})
+	sort.Strings(labels)
+	return labels
+}
@@ -0,0 +1,87 @@
+package tracey
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabel(test *testing.T) {
+	var buf bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Logger: log.New(&buf, "", 0)}},
+		MessageTemplates: map[string]string{`^orders\.fetch$`: "$FN of $MSG"},
+		SuppressSubtrees: []string{`^orders\.sync$`},
+	})
+	fetch := t.Label("orders.fetch")
+	func() {
+		defer fetch("order %d", 7)()
+	}()
+	func() {
+		defer t.Label("orders.sync")("%s", "$FN")()
+		defer t.Enter()()
+	}()
+	// Another enter function of the same label
+	t.Label("orders.fetch")("order 8")()
+
+	assert.Equal(test, "[ 0]ENTER: orders.fetch of order 7\n"+
+		"[ 0]EXIT:  orders.fetch of order 7\n"+
+		"[ 0]ENTER: =>orders.sync\n"+
+		"[ 0]EXIT:  =>orders.sync (+1 nested calls hidden)\n"+
+		"[ 0]ENTER: orders.fetch of order 8\n"+
+		"[ 0]EXIT:  orders.fetch of order 8\n", RE_tidMarker.ReplaceAllString(buf.String(), "=>"))
+
+	assert.Equal(test, []string{"orders.fetch", "orders.sync"}, t.Labels())
+	var fetches uint64
+	for _, s := range t.Stats() {
+		if s.Name == "orders.fetch" {
+			fetches = s.Calls
+		}
+	}
+	assert.Equal(test, uint64(2), fetches)
+}
+
+func TestStartNamed(test *testing.T) {
+	var buf bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Logger: log.New(&buf, "", 0)}},
+		MessageTemplates: map[string]string{`^/orders\.`: "rpc $FN"},
+	})
+	t.StartNamed("/orders.Get").End()
+	remote, _ := ParseTraceParent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "")
+	span := t.StartRemoteNamed(remote, "/orders.Put")
+	assert.Equal(test, "0af7651916cd43dd8448eb211c80319c", span.TraceParent().TraceID)
+	span.End()
+
+	assert.Equal(test, "[ 0]ENTER: rpc /orders.Get\n"+
+		"[ 0]EXIT:  rpc /orders.Get\n"+
+		"[ 0]ENTER: rpc /orders.Put\n"+
+		"[ 0]EXIT:  rpc /orders.Put\n", RE_tidMarker.ReplaceAllString(buf.String(), "=>"))
+}
+
+func TestLabelDisabled(test *testing.T) {
+	t := NewTracer(&Options{DisableTracing: true})
+	t.Label("x")("message")()
+	assert.Empty(test, t.Labels())
+}
+
+func BenchmarkLabel(b *testing.B) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard, MinDuration: time.Hour}}})
+	b.Run("enter", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			t.Enter()()
+		}
+	})
+	b.Run("label", func(b *testing.B) {
+		b.ReportAllocs()
+		enter := t.Label("bench")
+		for i := 0; i < b.N; i++ {
+			enter()()
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package tracey
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A LazyValue is a trace argument which is only evaluated if the line it
+// is traced with is logged, see `Lazy(...)`.
+type LazyValue struct {
+	fn   func() interface{}
+	once sync.Once
+	v    interface{}
+}
+
+// Lazy wraps an argument which is expensive to compute, as in
+//
+//	defer trace("state: %s", tracey.Lazy(func() interface{} { return dumpState() }))()
+//
+// so that "fn" is only called if the line is logged, not when tracing is
+// disabled or the span is muted (see "MinLevel" and "SuppressSubtrees").
+// It is called at most once, the enter and exit lines share its value. A
+// panic within "fn" is logged as "<lazy panic: ...>", and a nil "fn" as
+// "<nil>".
+func Lazy(fn func() interface{}) *LazyValue {
+	return &LazyValue{fn: fn}
+}
+
+// LazyString is `Lazy(...)` for functions returning a string.
+func LazyString(fn func() string) *LazyValue {
+	if fn == nil {
+		return Lazy(nil)
+	}
+	return Lazy(func() interface{} { return fn() })
+}
+
+// Value calls the wrapped function the first time it is called, and
+// returns what it returned.
+func (l *LazyValue) Value() interface{} {
+	l.once.Do(func() {
+		if l.fn == nil {
+			return
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				l.v = lazyPanic{r}
+			}
+		}()
+		l.v = l.fn()
+	})
+	return l.v
+}
+
+// Format implements fmt.Formatter, formatting the value as if it had been
+// passed in directly.
+func (l *LazyValue) Format(f fmt.State, verb rune) {
+	switch v := l.Value().(type) {
+	case nil:
+		fmt.Fprint(f, "<nil>")
+	case lazyPanic:
+		fmt.Fprintf(f, "<lazy panic: %v>", v.r)
+	default:
+		fmt.Fprintf(f, fmt.FormatString(f, verb), v)
+	}
+}
+
+// What a lazy function which panicked evaluates to
+type lazyPanic struct{ r interface{} }
@@ -0,0 +1,41 @@
+package tracey
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLazyArguments(test *testing.T) {
+	calls := 0
+	state := func() string { calls++; return "ready" }
+
+	// Not logged, and so never evaluated
+	NewTracer(&Options{DisableTracing: true}).Enter("state: %s", LazyString(state))()
+	t := NewTracer(&Options{CustomLogger: BufLogger, MinLevel: Info, DisableDepthValue: true})
+	t.Debugf("state: %s", LazyString(state))()
+	t.SetMinLevel(Trace)
+	ResetTestBuffer()
+	assert.Equal(test, 0, calls)
+
+	t.Enter("state: %6.3s", LazyString(state))()
+	assert.Equal(test, 1, calls)
+	lines := strings.Split(strings.TrimSpace(GetTestBuffer()), "\n")
+	assert.Equal(test, 2, len(lines))
+	assert.True(test, strings.HasSuffix(lines[0], "]=>state:    rea"), lines[0])
+	assert.True(test, strings.HasSuffix(lines[1], "]=>state:    rea"), lines[1])
+}
+
+func TestLazyEdgeCases(test *testing.T) {
+	s := func(args ...interface{}) string {
+		ResetTestBuffer()
+		t := NewTracer(&Options{CustomLogger: BufLogger, DisableDepthValue: true})
+		t.Start(args...).End()
+		return strings.SplitN(strings.TrimSpace(GetTestBuffer()), "]=>", 2)[1]
+	}
+	assert.True(test, strings.HasPrefix(s("v=%v", Lazy(nil)), "v=<nil>\n"))
+	assert.True(test, strings.HasPrefix(s("v=%d", LazyString(nil)), "v=<nil>\n"))
+	assert.True(test, strings.HasPrefix(s("v=%v", Lazy(func() interface{} { panic("boom") })), "v=<lazy panic: boom>\n"))
+	assert.True(test, strings.HasPrefix(s("v=%03d", Lazy(func() interface{} { return 7 })), "v=007\n"))
+}
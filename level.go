@@ -0,0 +1,69 @@
+package tracey
+
+// A Level tells how important a traced call is. Calls below the tracer's
+// "MinLevel" are not logged, see `Tracer.SetMinLevel(...)`.
+type Level int32
+
+const (
+	// The level of calls which do not select one
+	Trace Level = iota
+	Debug
+	Info
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	}
+	return "trace"
+}
+
+// The short tag of the level in text output
+func (l Level) tag() string {
+	switch l {
+	case Debug:
+		return "DBG"
+	case Info:
+		return "INF"
+	}
+	return "TRC"
+}
+
+// Splits the level off of the arguments to an enter, if they start with one
+func splitLevel(s []interface{}) (Level, []interface{}) {
+	if len(s) > 0 {
+		if level, ok := s[0].(Level); ok {
+			return level, s[1:]
+		}
+	}
+	return Trace, s
+}
+
+// MinLevel returns the level below which calls are not logged.
+func (t *Tracer) MinLevel() Level {
+	if t.start == nil {
+		return t.options.MinLevel
+	}
+	return t.config.Load().MinLevel
+}
+
+// SetMinLevel changes the level below which calls are not logged. It
+// applies to calls entered from then on, spans which are already open
+// keep their fate so that no exit is ever logged without its enter. See
+// `Update(...)` to change it along with other options.
+func (t *Tracer) SetMinLevel(level Level) {
+	t.Update(func(o *MutableOptions) { o.MinLevel = level })
+}
+
+// Debugf works like `Enter(...)`, at the Debug level.
+func (t *Tracer) Debugf(s ...interface{}) func() {
+	return t.Start(append([]interface{}{Debug}, s...)...).End
+}
+
+// Infof works like `Enter(...)`, at the Info level.
+func (t *Tracer) Infof(s ...interface{}) func() {
+	return t.Start(append([]interface{}{Info}, s...)...).End
+}
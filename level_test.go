@@ -0,0 +1,57 @@
+package tracey
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper functions - part of "TestMinLevel"
+func levelOuter(t *Tracer) {
+	defer t.Enter(Debug, "%s", "outer")()
+	levelInner(t)
+}
+
+func levelInner(t *Tracer) {
+	defer t.Infof("%s", "inner")()
+	defer t.Enter("%s", "innermost")()
+}
+
+func TestMinLevel(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, MinLevel: Info})
+
+	levelOuter(t)
+	t.SetMinLevel(Trace)
+	levelOuter(t)
+	assert.Equal(test, Trace, t.MinLevel())
+
+	assert.Equal(test, `
+[ 1]  ENTER: INF =>inner
+[ 1]  EXIT:  INF =>inner
+[ 0]ENTER: DBG =>outer
+[ 1]  ENTER: INF =>inner
+[ 2]    ENTER: =>innermost
+[ 2]    EXIT:  =>innermost
+[ 1]  EXIT:  INF =>inner
+[ 0]EXIT:  DBG =>outer
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+}
+
+func TestMinLevelAppliesOnEnter(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger})
+
+	shown := t.Start(Debug, "%s", "shown")
+	t.SetMinLevel(Info)
+	hidden := t.Start(Debug, "%s", "hidden")
+	hidden.Event("never logged")
+	t.SetMinLevel(Trace)
+	hidden.End()
+	shown.End()
+
+	assert.Equal(test, `
+[ 0]ENTER: DBG =>shown
+[ 0]EXIT:  DBG =>shown
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+}
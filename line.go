@@ -0,0 +1,263 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Line is a line of tracey's text output, as in
+// "[ 1]  EXIT:  [tid:7]=>loading ... in 12ms {rows=3}", for tools which
+// write lines of their own amongst those of tracey, or read them back, see
+// `RenderLine(...)` and `ParseLine(...)`.
+type Line struct {
+	// Enter and exit lines are those of spans, point events their
+	// milestones, see `Span.Event(...)`
+	Kind  EventKind
+	Depth int
+	TID   uint64
+	Level Level
+
+	// The function the line is of, which only shows through the
+	// "MessageTemplates", and the message which follows the thread id
+	Name    string
+	Message string
+
+	// How long the span took, for exit lines, or how far into its span
+	// the event was, for point events which have a "Name"
+	Duration time.Duration
+
+	// When it happened, which text lines do not show
+	Timestamp time.Time
+
+	// The tags of exit lines, see `Span.Tag(...)`
+	Tags []Tag
+}
+
+// Matches the duration which ends the exit lines of instrumented spans
+var RE_lineDuration = regexp.MustCompile(` \.{3,} in ([0-9][^ ]*)$`)
+
+// The text which follows the enter or exit marker of a span which has no
+// message template
+func lineText(tid uint64, message string) string {
+	return "[tid:" + strconv.FormatUint(tid, 10) + "]=>" + message
+}
+
+// Returns a tracer which does nothing but render lines under the options
+func newRenderer(opts *Options) (*Tracer, error) {
+	t := &Tracer{}
+	if opts != nil {
+		t.options = *opts
+	}
+	textDefaults(&t.options)
+	config, err := compileConfig(MutableOptions{MessageTemplates: t.options.MessageTemplates})
+	if err != nil {
+		return nil, fmt.Errorf("tracey: %v", err)
+	}
+	t.config.Store(config)
+	return t, nil
+}
+
+// Renders the line as the event it stands for
+func (t *Tracer) renderLine(buf *bytes.Buffer, l *Line) error {
+	if l.Kind == SessionEvent {
+		buf.WriteString(sessionHeaderPrefix + shortSessionID(t.options.SessionID) + " — " + l.Message + "\n")
+		return nil
+	}
+	if l.Kind < EnterEvent || l.Kind > PointEvent {
+		return fmt.Errorf("tracey: no line for events of kind %d", l.Kind)
+	}
+	ev := Event{
+		Kind:     l.Kind,
+		Time:     l.Timestamp,
+		TID:      l.TID,
+		Depth:    l.Depth,
+		Session:  t.options.SessionID,
+		Level:    l.Level,
+		Name:     l.Name,
+		Message:  l.Message,
+		Duration: l.Duration,
+		Tags:     l.Tags,
+	}
+	ev.text = lineText(l.TID, l.Message)
+	if templates := t.config.Load().templates; templates != nil {
+		ev.template = templates.lookup(l.Name)
+	}
+	t.renderText(buf, &ev, false)
+	return nil
+}
+
+// RenderLine writes the line to "buf" exactly as a tracer with the given
+// options writes the text line of such an event, through the same code,
+// so that lines of other components may be interleaved with tracey's.
+// The options which tracey's text lines depend on are those of the
+// markers, nesting and depth values, "EnableInstrumentation",
+// "AlignDurations", "SessionID" and "MessageTemplates". Bad templates, or
+// a kind of event which has no line, are reported as an error.
+func RenderLine(buf *bytes.Buffer, l Line, opts *Options) error {
+	t, err := newRenderer(opts)
+	if err != nil {
+		return err
+	}
+	return t.renderLine(buf, &l)
+}
+
+// AppendLine works like `RenderLine(...)`, but appends the line to "dst"
+// and returns the extended slice.
+func AppendLine(dst []byte, l Line, opts *Options) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	if err := RenderLine(buf, l, opts); err != nil {
+		return dst, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ParseLine reads a text line written under the given options back, the
+// inverse of `RenderLine(...)`: rendering what it returns under the same
+// options gives the line back. Enter and exit lines rendered through a
+// message template cannot be read back, and neither can the lines of the
+// warnings and notes of the tracer, while exit lines which carry more
+// than a duration and tags, such as those of failed spans, are not read
+// back whole. Text lines do not say which function they are of, so "Name"
+// is left empty, but for point events which show how far into their span
+// they were, which are named "?" to render so. Tag values are read back
+// as strings, and the messages of spans entered with a message alone,
+// which the tracer writes as in "[tid:3 - loading]=>", as any other. The
+// lines of "CompressLinearChains" read back without their chain markers,
+// so they render back indented by their depth. Session headers read back
+// as lines of kind SessionEvent, the build they show as their message.
+func ParseLine(line string, opts *Options) (Line, error) {
+	var options Options
+	if opts != nil {
+		options = *opts
+	}
+	textDefaults(&options)
+	bad := func(why string) (Line, error) {
+		return Line{}, fmt.Errorf("tracey: bad line %q: %s", line, why)
+	}
+
+	var l Line
+	rest := strings.TrimSuffix(line, "\n")
+	if strings.HasPrefix(rest, sessionHeaderPrefix) {
+		i := strings.Index(rest, " — ")
+		if i < 0 {
+			return bad("no build in the session header")
+		}
+		l.Kind, l.Message = SessionEvent, rest[i+len(" — "):]
+		return l, nil
+	}
+	if options.SessionID != "" {
+		rest = strings.TrimPrefix(rest, "[s:"+shortSessionID(options.SessionID)+"]")
+	}
+	if !options.DisableNesting {
+		if options.DisableDepthValue {
+			indented := rest
+			rest = strings.TrimLeft(rest, " ")
+			l.Depth = (len(indented) - len(rest)) / options.SpacesPerIndent
+			if options.MaxIndentWidth > 0 && strings.HasPrefix(rest, indentCut) {
+				// As deep as it takes to be cut short
+				l.Depth = options.MaxIndentWidth/options.SpacesPerIndent + 1
+				rest = rest[len(indentCut):]
+			}
+		} else {
+			end := strings.IndexByte(rest, ']')
+			if !strings.HasPrefix(rest, "[") || end < 0 {
+				return bad("no depth")
+			}
+			depth, err := strconv.Atoi(strings.TrimLeft(rest[1:end], " "))
+			if err != nil || depth < 0 {
+				return bad("bad depth")
+			}
+			l.Depth = depth
+			rest = rest[end+1:]
+			indent, cut := depth*options.SpacesPerIndent, ""
+			if options.CompressLinearChains {
+				// Indented by as many levels as the chain says
+				if spaces := len(rest) - len(strings.TrimLeft(rest, " ")); spaces < indent {
+					indent = spaces - spaces%options.SpacesPerIndent
+				}
+			}
+			if max := options.MaxIndentWidth; max > 0 && indent > max {
+				indent, cut = max-1, indentCut
+			}
+			if len(rest) < indent || strings.TrimLeft(rest[:indent], " ") != "" || !strings.HasPrefix(rest[indent:], cut) {
+				return bad("indentation does not match the depth")
+			}
+			rest = rest[indent+len(cut):]
+		}
+	}
+	if options.CompressLinearChains {
+		rest = strings.TrimPrefix(rest, chainMarker)
+	}
+
+	switch {
+	case strings.HasPrefix(rest, "· "):
+		l.Kind = PointEvent
+		l.Message = rest[len("· "):]
+		if i := strings.LastIndex(l.Message, " (at +"); i >= 0 && strings.HasSuffix(l.Message, ")") {
+			if d, err := time.ParseDuration(l.Message[i+len(" (at +") : len(l.Message)-1]); err == nil {
+				l.Name, l.Message, l.Duration = "?", l.Message[:i], d
+			}
+		}
+		return l, nil
+	case strings.HasPrefix(rest, options.EnterMessage):
+		l.Kind = EnterEvent
+		rest = rest[len(options.EnterMessage):]
+		if options.CompressLinearChains {
+			rest = strings.Replace(rest, chainExpanded, "", 1)
+		}
+	case strings.HasPrefix(rest, options.ExitMessage):
+		l.Kind = ExitEvent
+		rest = rest[len(options.ExitMessage):]
+	default:
+		return bad("not the line of an event")
+	}
+	for _, level := range []Level{Debug, Info} {
+		if strings.HasPrefix(rest, level.tag()+" ") {
+			l.Level = level
+			rest = rest[len(level.tag())+1:]
+		}
+	}
+
+	if l.Kind == ExitEvent {
+		if i := strings.LastIndex(rest, " {"); i >= 0 && strings.HasSuffix(rest, "}") {
+			for _, tag := range strings.Fields(rest[i+len(" {") : len(rest)-1]) {
+				key, value, ok := strings.Cut(tag, "=")
+				if !ok {
+					return bad("bad tag " + strconv.Quote(tag))
+				}
+				l.Tags = append(l.Tags, Tag{key, value})
+			}
+			rest = rest[:i]
+		}
+		if options.EnableInstrumentation {
+			if m := RE_lineDuration.FindStringSubmatchIndex(rest); m != nil {
+				d, err := time.ParseDuration(rest[m[2]:m[3]])
+				if err != nil {
+					return bad("bad duration")
+				}
+				l.Duration = d
+				rest = rest[:m[0]]
+			}
+		}
+	}
+
+	end := strings.Index(rest, "]=>")
+	if !strings.HasPrefix(rest, "[tid:") || end < 0 {
+		return bad("no thread id")
+	}
+	// Spans entered with a message alone have it within the brackets
+	id, message, _ := strings.Cut(rest[len("[tid:"):end], " - ")
+	tid, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return bad("bad thread id")
+	}
+	l.TID, l.Message = tid, rest[end+len("]=>"):]
+	if l.Message == "" {
+		l.Message = message
+	}
+	return l, nil
+}
@@ -0,0 +1,102 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Traces spans of every level, with tags and milestones, on a fixed clock
+func traceLines(opts Options) string {
+	var out bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	opts.Sinks = []Sink{{Writer: &out}}
+	opts.Clock = clock.Now
+	t := NewTracer(&opts)
+	t.Event("starting")
+	outer := t.Start("%s", "outer")
+	outer.Tag("rows", 3)
+	outer.Tag("table", "users")
+	func() {
+		defer t.Enter(Debug, "inner %d", 1)()
+		clock.advance(1500 * time.Microsecond)
+		t.Event("halfway")
+		t.Enter(Info, "%s", "leaf")()
+	}()
+	clock.advance(2 * time.Second)
+	outer.End()
+	return out.String()
+}
+
+func TestRenderLineMatchesTracer(test *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{DisableDepthValue: true},
+		{DisableNesting: true},
+		{SpacesPerIndent: 4},
+		{EnableInstrumentation: true},
+		{EnableInstrumentation: true, AlignDurations: 60},
+		{EnableInstrumentation: true, DisableDepthValue: true, SpacesPerIndent: 3},
+		{EnterMessage: "> ", ExitMessage: "< ", EnableInstrumentation: true},
+		{SessionID: "4bf92f35"},
+		{SpacesPerIndent: 4, MaxIndentWidth: 6},
+		{DisableDepthValue: true, MaxIndentWidth: 3},
+	} {
+		traced := traceLines(opts)
+		var rendered bytes.Buffer
+		for _, line := range strings.SplitAfter(traced, "\n") {
+			if line == "" {
+				continue
+			}
+			l, err := ParseLine(line, &opts)
+			assert.Nil(test, err)
+			assert.Nil(test, RenderLine(&rendered, l, &opts))
+		}
+		assert.Equal(test, traced, rendered.String(), "%+v", opts)
+	}
+}
+
+func TestRenderLine(test *testing.T) {
+	var buf bytes.Buffer
+	opts := &Options{EnableInstrumentation: true}
+	exit := Line{Kind: ExitEvent, Depth: 1, TID: 7, Name: "sidecar.load", Message: "loading", Duration: 12 * time.Millisecond, Tags: []Tag{{"rows", 3}}}
+	assert.Nil(test, RenderLine(&buf, Line{Kind: EnterEvent, Depth: 1, TID: 7, Message: "loading"}, opts))
+	assert.Nil(test, RenderLine(&buf, Line{Kind: PointEvent, Depth: 2, Name: "sidecar.load", Message: "cached", Duration: time.Millisecond}, opts))
+	assert.Nil(test, RenderLine(&buf, exit, opts))
+	assert.Equal(test, "[ 1]  ENTER: [tid:7]=>loading\n"+
+		"[ 2]    · cached (at +1.0ms)\n"+
+		"[ 1]  EXIT:  [tid:7]=>loading ... in 12ms {rows=3}\n", buf.String())
+
+	templated := &Options{MessageTemplates: map[string]string{`^sidecar\.`: "$FN: $MSG in $DUR"}}
+	line, err := AppendLine([]byte("py "), exit, templated)
+	assert.Nil(test, err)
+	assert.Equal(test, "py [ 1]  EXIT:  sidecar.load: loading in 12ms {rows=3}\n", string(line))
+
+	_, err = AppendLine(nil, exit, &Options{MessageTemplates: map[string]string{`(`: "$MSG"}})
+	assert.NotNil(test, err)
+	assert.Equal(test, "tracey: no line for events of kind 5", RenderLine(&buf, Line{Kind: 5}, nil).Error())
+}
+
+func TestParseLine(test *testing.T) {
+	l, err := ParseLine("[ 2]    EXIT:  DBG [tid:7]=>loading ... in 1.5ms {rows=3 +cached=true}\n", &Options{EnableInstrumentation: true})
+	assert.Nil(test, err)
+	assert.Equal(test, Line{Kind: ExitEvent, Depth: 2, TID: 7, Level: Debug, Message: "loading", Duration: 1500 * time.Microsecond, Tags: []Tag{{"rows", "3"}, {"+cached", "true"}}}, l)
+
+	l, err = ParseLine("[ 0]ENTER: [tid:3 - loading]=>", nil)
+	assert.Nil(test, err)
+	assert.Equal(test, Line{Kind: EnterEvent, TID: 3, Message: "loading"}, l)
+
+	for line, why := range map[string]string{
+		"hello":                        "no depth",
+		"[ 1]ENTER: [tid:3]=>loading":  "indentation does not match the depth",
+		"[ 0]Warning: something":       "not the line of an event",
+		"[ 0]ENTER: loading":           "no thread id",
+		"[ 0]EXIT:  [tid:3]=>x {rows}": `bad tag "rows"`,
+	} {
+		_, err := ParseLine(line, nil)
+		assert.Equal(test, "tracey: bad line "+`"`+strings.ReplaceAll(line, `"`, `\"`)+`": `+why, err.Error())
+	}
+}
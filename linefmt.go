@@ -0,0 +1,119 @@
+package tracey
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// Runs of the characters lines are padded with, written in pieces rather
+// than built with `strings.Repeat(...)` for every line
+const (
+	spaceRun = "                                                                "
+	dotRun   = "................................................................"
+)
+
+// Ends the indentation of lines deeper than "MaxIndentWidth"
+const indentCut = "»"
+
+// Writes "n" times the character "run" is made of
+func writeRun(buf *bytes.Buffer, run string, n int) {
+	for n > 0 {
+		k := n
+		if k > len(run) {
+			k = len(run)
+		}
+		buf.WriteString(run[:k])
+		n -= k
+	}
+}
+
+// Writes an integer in base 10, without allocating
+func writeInt(buf *bytes.Buffer, n int64) {
+	var b [20]byte
+	buf.Write(strconv.AppendInt(b[:0], n, 10))
+}
+
+// Writes a duration exactly as `time.Duration.String()` formats it, as in
+// "1.5ms" or "2h0m3s", without allocating
+func writeDuration(buf *bytes.Buffer, d time.Duration) {
+	// Formatted backwards from the end, as the largest is
+	// "-2562047h47m16.854775808s"
+	var b [32]byte
+	w := len(b)
+	u := uint64(d)
+	if d < 0 {
+		u = -u
+	}
+	switch {
+	case u == 0:
+		buf.WriteString("0s")
+		return
+	case u < uint64(time.Second):
+		// Below a second, in the largest unit which keeps it at 1 or more
+		prec, unit := 0, "ns"
+		if u >= uint64(time.Millisecond) {
+			prec, unit = 6, "ms"
+		} else if u >= uint64(time.Microsecond) {
+			prec, unit = 3, "µs"
+		}
+		w -= len(unit)
+		copy(b[w:], unit)
+		w, u = formatFraction(b[:w], u, prec)
+		w = formatUint(b[:w], u)
+	default:
+		w--
+		b[w] = 's'
+		w, u = formatFraction(b[:w], u, 9)
+		w = formatUint(b[:w], u%60)
+		if u /= 60; u > 0 {
+			w--
+			b[w] = 'm'
+			w = formatUint(b[:w], u%60)
+			if u /= 60; u > 0 {
+				w--
+				b[w] = 'h'
+				w = formatUint(b[:w], u)
+			}
+		}
+	}
+	if d < 0 {
+		w--
+		b[w] = '-'
+	}
+	buf.Write(b[w:])
+}
+
+// Formats the "prec" lowest digits of "v" as a fraction, as in ".125",
+// at the end of "b", leaving out its trailing zeros (and the point, should
+// they all be). Returns where it starts, and the digits left of it.
+func formatFraction(b []byte, v uint64, prec int) (int, uint64) {
+	w := len(b)
+	digits := false
+	for i := 0; i < prec; i++ {
+		digit := v % 10
+		digits = digits || digit != 0
+		if digits {
+			w--
+			b[w] = byte(digit) + '0'
+		}
+		v /= 10
+	}
+	if digits {
+		w--
+		b[w] = '.'
+	}
+	return w, v
+}
+
+// Formats "v" at the end of "b", returns where it starts
+func formatUint(b []byte, v uint64) int {
+	w := len(b)
+	for {
+		w--
+		b[w] = byte(v%10) + '0'
+		if v /= 10; v == 0 {
+			return w
+		}
+	}
+}
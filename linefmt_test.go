@@ -0,0 +1,133 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteDuration(test *testing.T) {
+	durations := []time.Duration{0, 1, 999, time.Microsecond, 1500, time.Millisecond, 1234567, 999999999,
+		time.Second, 1500 * time.Millisecond, time.Minute, 61*time.Second + 1, time.Hour, 100*time.Hour + 3*time.Second,
+		math.MaxInt64, math.MinInt64}
+	for i, n := 0, len(durations); i < n; i++ {
+		durations = append(durations, -durations[i])
+	}
+	var buf bytes.Buffer
+	for _, d := range durations {
+		buf.Reset()
+		writeDuration(&buf, d)
+		assert.Equal(test, d.String(), buf.String())
+	}
+}
+
+// Renders a line the way tracey did before it wrote the pieces itself
+func referenceLine(options *Options, depth int, marker, text string, instrument bool, d time.Duration, approx bool) string {
+	var line string
+	if !options.DisableNesting {
+		if !options.DisableDepthValue {
+			line = fmt.Sprintf("[%2d]", depth)
+		}
+		line += strings.Repeat(" ", depth*options.SpacesPerIndent)
+	}
+	line += marker + text
+	if instrument {
+		dots := 3
+		if options.AlignDurations > 0 {
+			if fill := options.AlignDurations - len([]rune(line)) - 2; fill > dots {
+				dots = fill
+			}
+		}
+		line += " " + strings.Repeat(".", dots) + " in "
+		if approx {
+			line += "<"
+		}
+		line += d.String()
+	}
+	return line + "\n"
+}
+
+func TestRenderTextUnchanged(test *testing.T) {
+	for _, nesting := range []bool{true, false} {
+		for _, depthValue := range []bool{true, false} {
+			for _, spaces := range []int{0, 1, 2, 40} {
+				for _, align := range []int{0, 30, 200} {
+					for _, instrument := range []bool{true, false} {
+						t := NewTracer(&Options{
+							Sinks:                 []Sink{{Writer: io.Discard}},
+							DisableNesting:        !nesting,
+							DisableDepthValue:     !depthValue,
+							SpacesPerIndent:       spaces,
+							AlignDurations:        align,
+							EnableInstrumentation: instrument,
+						})
+						for _, depth := range []int{0, 1, 9, 10, 99, 100} {
+							for _, d := range []time.Duration{0, 1500, 12 * time.Millisecond, 90 * time.Minute} {
+								for _, approx := range []bool{false, true} {
+									enter := Event{Kind: EnterEvent, Depth: depth, text: "[tid:7]=>main.foo(1)"}
+									exit := enter
+									exit.Kind, exit.Duration, exit.Approximate = ExitEvent, d, approx
+									var buf bytes.Buffer
+									t.renderText(&buf, &enter, false)
+									t.renderText(&buf, &exit, false)
+									options := &t.options
+									assert.Equal(test, referenceLine(options, depth, options.EnterMessage, enter.text, false, 0, false)+
+										referenceLine(options, depth, options.ExitMessage, exit.text, instrument, d, approx), buf.String())
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func benchmarkDefaultLine(b *testing.B, instrument bool) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}, EnableInstrumentation: instrument})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t.Enter("loading")()
+	}
+}
+
+func BenchmarkDefaultLine(b *testing.B)             { benchmarkDefaultLine(b, false) }
+func BenchmarkDefaultLineInstrumented(b *testing.B) { benchmarkDefaultLine(b, true) }
+
+func TestMaxIndentWidth(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, SpacesPerIndent: 4, MaxIndentWidth: 20})
+	var recurse func(depth int)
+	recurse = func(depth int) {
+		defer t.Enter("%s", "level")()
+		if depth < 60 {
+			recurse(depth + 1)
+		} else {
+			t.Event("bottom")
+		}
+	}
+	recurse(0)
+
+	lines := strings.Split(RE_tidMarker.ReplaceAllString(out.String(), "=>"), "\n")
+	assert.Equal(test, "[ 3]            ENTER: =>level", lines[3])
+	assert.Equal(test, "[ 5]                    ENTER: =>level", lines[5])
+	assert.Equal(test, "[ 6]                   »ENTER: =>level", lines[6])
+	assert.Equal(test, "[60]                   »ENTER: =>level", lines[60])
+	assert.True(test, strings.HasPrefix(lines[61], "[61]                   »· bottom (at +"))
+	assert.Equal(test, "[60]                   »EXIT:  =>level", lines[62])
+
+	var buf bytes.Buffer
+	allocs := testing.AllocsPerRun(100, func() {
+		buf.Reset()
+		t.renderIndent(&buf, 60)
+		t.renderIndent(&buf, 3)
+	})
+	assert.Equal(test, 0.0, allocs)
+}
@@ -0,0 +1,212 @@
+package tracey
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewSessionID returns a random id for the processes of a session to
+// share, see "SessionID".
+func NewSessionID() string {
+	return randomHex(8)
+}
+
+// The part of a session id shown at the start of text lines
+func shortSessionID(id string) string {
+	return truncateUTF8(id, 4)
+}
+
+// MergeOptions change how `MergeSessionsWith(...)` merges traces.
+type MergeOptions struct {
+	// The labels of the processes, in the order of the readers, which
+	// prefix their lines and namespace their span ids. Processes without
+	// one are labelled "p0", "p1" and so on.
+	Labels []string
+
+	// How far apart the clocks of the processes may be. Events of the same
+	// process are kept together as long as they are within that bound of
+	// the earliest event of the others, rather than interleaved by their
+	// timestamps. The default value of 0 orders events by timestamp only,
+	// ties going to the process which was last written.
+	MaxClockSkew time.Duration
+
+	// The map the functions of the traces are renamed with, as they would
+	// have been under "NameMap"
+	NameMap NameMap
+}
+
+// MergeSessions is `MergeSessionsWith(...)` with the default options.
+func MergeSessions(readers []io.Reader, w io.Writer) error {
+	return MergeSessionsWith(readers, w, MergeOptions{})
+}
+
+// MergeSessionsWith reads the traces of several processes, one per reader,
+// and writes them to "w" as a single text timeline, with times in UTC, as
+// in
+//
+//	p1 12:00:00.104211 [ 1]  ENTER: [tid:7]=>main.work(3) [trace=4bf9… span=p1/00f0…]
+//
+// Each reader holds the output of a JSONFormat sink, of a BinaryFormat
+// sink, or of `MMapSink(...)`; text output has no timestamps, and cannot
+// be merged. The events of each process keep their order, see
+// "MaxClockSkew". Span ids are prefixed with the label of their process,
+// and so are parent ids, with that of the process which opened the parent
+// span should it be another one. Traces stamped with different session
+// ids are not merged. The session header of each process shows the build
+// it comes from, as in
+//
+//	p1 12:00:00.100002 TRACEY SESSION s:ab12 — fetcher v1.4.2 (rev 9f3ac1e) go1.22.1
+func MergeSessionsWith(readers []io.Reader, w io.Writer, opts MergeOptions) error {
+	type process struct {
+		label  string
+		events []Event
+		next   int
+	}
+	processes := make([]*process, len(readers))
+	owners := make(map[string][]int)
+	session := ""
+	for i, r := range readers {
+		p := &process{label: "p" + strconv.Itoa(i)}
+		if i < len(opts.Labels) && opts.Labels[i] != "" {
+			p.label = opts.Labels[i]
+		}
+		events, err := readSession(r, p.label)
+		if err != nil {
+			return err
+		}
+		opts.NameMap.Apply(events)
+		for j := range events {
+			ev := &events[j]
+			if ev.Session != "" {
+				if session == "" {
+					session = ev.Session
+				} else if ev.Session != session {
+					return fmt.Errorf("tracey: %s is from session %s, not %s", p.label, ev.Session, session)
+				}
+			}
+			if ev.SpanID != "" && ev.Kind == EnterEvent {
+				owners[ev.SpanID] = append(owners[ev.SpanID], i)
+			}
+		}
+		p.events = events
+		processes[i] = p
+	}
+
+	// Namespaces the span ids, a parent being looked for in the process
+	// itself first
+	namespace := func(i int, id string) string {
+		if id == "" {
+			return ""
+		}
+		owner := i
+		if found := owners[id]; len(found) > 0 {
+			owner = found[0]
+			for _, o := range found {
+				if o == i {
+					owner = i
+				}
+			}
+		}
+		return processes[owner].label + "/" + id
+	}
+
+	width := 0
+	for _, p := range processes {
+		if w := displayWidth([]byte(p.label), false); w > width {
+			width = w
+		}
+	}
+	renderer, _ := newRenderer(&Options{EnableInstrumentation: true, ShowIDs: true})
+	out := bufio.NewWriter(w)
+	var buf bytes.Buffer
+	last := -1
+	for {
+		// The process with the earliest event, unless the last one is
+		// close enough to carry on with
+		pick := -1
+		for i, p := range processes {
+			if p.next < len(p.events) && (pick < 0 || p.events[p.next].Time.Before(processes[pick].events[processes[pick].next].Time)) {
+				pick = i
+			}
+		}
+		if pick < 0 {
+			break
+		}
+		if last >= 0 && last != pick {
+			p := processes[last]
+			earliest := processes[pick].events[processes[pick].next].Time
+			if p.next < len(p.events) && !p.events[p.next].Time.After(earliest.Add(opts.MaxClockSkew)) {
+				pick = last
+			}
+		}
+		last = pick
+
+		p := processes[pick]
+		ev := p.events[p.next]
+		p.next++
+		if ev.Kind != SessionEvent {
+			ev.Session = ""
+			ev.SpanID, ev.ParentID = namespace(pick, ev.SpanID), namespace(pick, ev.ParentID)
+			ev.text = lineText(ev.TID, ev.Message)
+		}
+
+		buf.Reset()
+		buf.WriteString(p.label)
+		buf.WriteString(strings.Repeat(" ", width-displayWidth([]byte(p.label), false)+1))
+		buf.WriteString(ev.Time.UTC().Format("15:04:05.000000"))
+		buf.WriteByte(' ')
+		renderer.renderText(&buf, &ev, false)
+		if _, err := out.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// Reads the events of a trace, in any format but text
+func readSession(r io.Reader, label string) ([]Event, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("tracey: reading %s: %v", label, err)
+	}
+	var events []Event
+	switch {
+	case bytes.HasPrefix(data, []byte(mmapMagic)):
+		if events, err = decodeMMapTrace(data, label); err != nil {
+			return nil, err
+		}
+	case len(data) > 0 && data[0] == binaryMarker && len(data)%binaryRecordSize == 0:
+		events = decodeRecords(data)
+	default:
+		for n, line := range bytes.Split(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			ev, err := UnmarshalEvent(line)
+			if err != nil {
+				return nil, fmt.Errorf("tracey: %s line %d is neither JSON nor binary output: %v", label, n+1, err)
+			}
+			events = append(events, ev)
+		}
+	}
+	sortBySeq(events)
+	return events, nil
+}
+
+// Puts the events in the order they were numbered in, that of the
+// sinks being unreliable across goroutines, unless some are unnumbered as
+// those of older sessions are
+func sortBySeq(events []Event) {
+	for i := range events {
+		if events[i].Seq == 0 {
+			return
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+}
@@ -0,0 +1,94 @@
+package tracey
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Traces a process of the session, the steps moving its clock
+func traceProcess(sink Sink, session string, start time.Time, steps func(t *Tracer, clock *manualClock)) {
+	clock := &manualClock{now: start}
+	t := NewTracer(&Options{Sinks: []Sink{sink}, Clock: clock.Now, EnableInstrumentation: true, SessionID: session})
+	steps(t, clock)
+}
+
+func mergeTestSessions(test *testing.T, skew time.Duration) []string {
+	stubBuildInfo(test, testBuildInfo())
+	session := "ab12cd34ef56ab78"
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	var coordinator, fetcher, storer bytes.Buffer
+	traceProcess(Sink{Writer: &coordinator, Format: JSONFormat}, session, start, func(t *Tracer, clock *manualClock) {
+		span := t.Start("%s", "coordinate")
+		clock.advance(10 * time.Millisecond)
+		span.End()
+	})
+	traceProcess(Sink{Writer: &fetcher, Format: JSONFormat}, session, start.Add(time.Millisecond), func(t *Tracer, clock *manualClock) {
+		fetch := t.Start("%s", "fetch")
+		clock.advance(4 * time.Millisecond)
+		parse := t.Start("%s", "parse")
+		clock.advance(500 * time.Microsecond)
+		parse.End()
+		clock.advance(500 * time.Microsecond)
+		fetch.End()
+	})
+	traceProcess(Sink{Writer: &storer, Format: BinaryFormat}, session, start.Add(2*time.Millisecond), func(t *Tracer, clock *manualClock) {
+		span := t.Start("%s", "store")
+		clock.advance(3200 * time.Microsecond)
+		span.End()
+	})
+
+	var merged bytes.Buffer
+	err := MergeSessionsWith([]io.Reader{&coordinator, &fetcher, &storer}, &merged,
+		MergeOptions{Labels: []string{"coord"}, MaxClockSkew: skew})
+	assert.Nil(test, err)
+	return strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(merged.String(), "=>")), "\n")
+}
+
+func TestMergeSessions(test *testing.T) {
+	assert.Equal(test, []string{
+		"coord 12:00:00.000000 TRACEY SESSION s:ab12 — myapp v1.4.2 (rev 9f3ac1e, dirty) go1.22.1",
+		"coord 12:00:00.000000 [ 0]ENTER: =>coordinate [trace=1 span=coord/1]",
+		"p1    12:00:00.001000 TRACEY SESSION s:ab12 — myapp v1.4.2 (rev 9f3ac1e, dirty) go1.22.1",
+		"p1    12:00:00.001000 [ 0]ENTER: =>fetch [trace=1 span=p1/1]",
+		"p2    12:00:00.002000 TRACEY SESSION s:ab12 — myapp v1.4.2 (rev 9f3ac1e, dirty) go1.22.1",
+		"p2    12:00:00.002000 [ 0]ENTER: =>store [trace=1 span=p2/1]",
+		"p1    12:00:00.005000 [ 1]  ENTER: =>parse [trace=1 span=p1/2]",
+		"p2    12:00:00.005200 [ 0]EXIT:  =>store [trace=1 span=p2/1] ... in 3.2ms",
+		"p1    12:00:00.005500 [ 1]  EXIT:  =>parse [trace=1 span=p1/2] ... in 500µs",
+		"p1    12:00:00.006000 [ 0]EXIT:  =>fetch [trace=1 span=p1/1] ... in 5ms",
+		"coord 12:00:00.010000 [ 0]EXIT:  =>coordinate [trace=1 span=coord/1] ... in 10ms",
+	}, mergeTestSessions(test, 0))
+
+	// The storer's exit is within a millisecond of the fetcher's next
+	// event, and follows its enter
+	var lines []string
+	for _, line := range mergeTestSessions(test, time.Millisecond) {
+		if !strings.Contains(line, sessionHeaderPrefix) {
+			lines = append(lines, line)
+		}
+	}
+	assert.Contains(test, lines[3], "EXIT:  =>store")
+	assert.Contains(test, lines[4], "ENTER: =>parse")
+	assert.Contains(test, lines[6], "EXIT:  =>fetch")
+}
+
+func TestMergeSessionsErrors(test *testing.T) {
+	var a, b bytes.Buffer
+	traceProcess(Sink{Writer: &a, Format: JSONFormat}, "aaaa", time.Now(), func(t *Tracer, _ *manualClock) { t.Start().End() })
+	traceProcess(Sink{Writer: &b, Format: JSONFormat}, "bbbb", time.Now(), func(t *Tracer, _ *manualClock) { t.Start().End() })
+	err := MergeSessions([]io.Reader{&a, &b}, io.Discard)
+	assert.EqualError(test, err, "tracey: p1 is from session bbbb, not aaaa")
+
+	var text bytes.Buffer
+	traceProcess(Sink{Logger: log.New(&text, "", 0)}, "aaaa1234", time.Now(), func(t *Tracer, _ *manualClock) { t.Start("%s", "x").End() })
+	assert.True(test, strings.HasPrefix(text.String(), "TRACEY SESSION s:aaaa — "), text.String())
+	assert.Contains(test, text.String(), "\n[s:aaaa][ 0]")
+	err = MergeSessions([]io.Reader{&text}, io.Discard)
+	assert.Contains(test, err.Error(), "tracey: p0 line 1 is neither JSON nor binary output")
+}
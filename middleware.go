@@ -0,0 +1,101 @@
+package tracey
+
+import (
+	"fmt"
+)
+
+// A SpanMiddleware sees every span the tracer enters and exits, and may
+// change or suppress their events before they are counted and written
+// out, see "Middleware". A middleware must be safe for concurrent use, as
+// spans are entered and exited on many goroutines at once.
+//
+// The built-in stages of the pipeline are not middlewares themselves, and
+// run in a fixed order around them. On enter, the span is first filtered
+// (see "MinLevel", "FilterRules" and "SuppressSubtrees"), the fields of
+// its struct tags marked "redact" are redacted and its message is cut to
+// "MaxMessageLen", and only then do the "OnEnter" run, in order. Spans
+// which are filtered out go through them as well, and stay filtered out
+// whatever they do. On
+// exit the "OnExit" run first, in reverse order and with the error of the
+// span whole, then the span is counted in `Stats()`, its tree is kept or
+// dropped by "TailSampling" and its error is cut to "MaxMessageLen". Only
+// the lines of the spans they leave unsuppressed count towards "MaxLines"
+// and "MaxBytes", as they are written out. Names and messages the
+// middlewares change are not cut again.
+type SpanMiddleware interface {
+	OnEnter(*SpanContext)
+	OnExit(*SpanContext)
+}
+
+// A SpanContext is what a `SpanMiddleware` is given of a span being
+// entered or exited.
+type SpanContext struct {
+	// The event of the enter or exit. Its "Name", "Message", "Tags" and,
+	// on exits, "Duration" may be changed, the text output showing the
+	// message as changed. On enters the "TraceID", "ParentID" and "Depth"
+	// are not known yet.
+	Event *Event
+
+	// Setting "Suppress" to "true" keeps the event from being logged:
+	// suppressing an enter suppresses the whole span (its exit included,
+	// but not the spans nested within it), while suppressing an exit only
+	// suppresses the exit. The span is counted in `Stats()` regardless.
+	Suppress bool
+
+	span *Span
+}
+
+// Span returns the span being entered or exited, to tag it say.
+func (c *SpanContext) Span() *Span {
+	return c.span
+}
+
+// Runs the "OnEnter" of the middlewares, returns true if they renamed the
+// span
+func (t *Tracer) enterMiddleware(span *Span) bool {
+	ev := &span.ev
+	name, message := ev.Name, ev.Message
+	c := SpanContext{Event: ev, span: span}
+	for _, m := range t.options.Middleware {
+		t.runMiddleware(m, &c, false)
+	}
+	if c.Suppress {
+		span.muted = true
+	}
+	if ev.Message != message {
+		ev.text = lineText(ev.TID, ev.Message)
+	}
+	return ev.Name != name
+}
+
+// Runs the "OnExit" of the middlewares, the last one first, returns true
+// if they suppressed the exit
+func (t *Tracer) exitMiddleware(span *Span, ev *Event) bool {
+	message := ev.Message
+	c := SpanContext{Event: ev, span: span}
+	for i := len(t.options.Middleware) - 1; i >= 0; i-- {
+		t.runMiddleware(t.options.Middleware[i], &c, true)
+	}
+	if ev.Message != message {
+		ev.text = lineText(ev.TID, ev.Message)
+	}
+	return c.Suppress
+}
+
+// Runs a hook of the middleware, logging rather than propagating its
+// panics so that a faulty middleware does not take the traced code down
+func (t *Tracer) runMiddleware(m SpanMiddleware, c *SpanContext, exit bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			warning := fmt.Sprintf("Warning: tracey middleware %T panicked: %v\n", m, r)
+			if t.admitOutput(len(warning)) {
+				t.note(warning)
+			}
+		}
+	}()
+	if exit {
+		m.OnExit(c)
+	} else {
+		m.OnEnter(c)
+	}
+}
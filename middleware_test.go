@@ -0,0 +1,210 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs hooks given as functions, recording the order they ran in
+type funcMiddleware struct {
+	enter, exit func(*SpanContext)
+}
+
+func (m funcMiddleware) OnEnter(c *SpanContext) {
+	if m.enter != nil {
+		m.enter(c)
+	}
+}
+
+func (m funcMiddleware) OnExit(c *SpanContext) {
+	if m.exit != nil {
+		m.exit(c)
+	}
+}
+
+// Traces a few nested, tagged and failed spans on a fixed clock, to every
+// format
+func traceGolden(middleware []SpanMiddleware) string {
+	var text, js bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Writer: &text}, {Writer: &js, Format: JSONFormat}},
+		Clock:                 clock.Now,
+		EnableInstrumentation: true,
+		Middleware:            middleware,
+	})
+	outer := t.Start("%s", "outer")
+	outer.Tag("rows", 3)
+	func() {
+		defer t.Enter("inner %d", 1)()
+		clock.advance(time.Millisecond)
+		t.Event("halfway")
+	}()
+	failed := t.Start()
+	failed.SetError(errors.New("declined"))
+	failed.End()
+	outer.End()
+	return text.String() + js.String()
+}
+
+func TestMiddlewareLeavesOutputAlone(test *testing.T) {
+	golden := traceGolden(nil)
+	assert.Contains(test, golden, "inner 1")
+	assert.Equal(test, golden, traceGolden([]SpanMiddleware{funcMiddleware{}, funcMiddleware{}}))
+}
+
+func TestMiddlewareRenames(test *testing.T) {
+	var buf lockedBuffer
+	rename := funcMiddleware{enter: func(c *SpanContext) {
+		c.Event.Name = "svc." + strings.TrimPrefix(c.Event.Name, "go-tracey.")
+		c.Event.Message = strings.ToUpper(c.Event.Message)
+	}}
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Writer: &buf}},
+		Middleware:       []SpanMiddleware{rename},
+		MessageTemplates: map[string]string{`^svc\.`: "$FN: $MSG"},
+	})
+	func() {
+		defer t.Enter("%s", "loading")()
+	}()
+
+	assert.Equal(test, "[ 0]ENTER: svc.TestMiddlewareRenames.func2: LOADING\n"+
+		"[ 0]EXIT:  svc.TestMiddlewareRenames.func2: LOADING\n", buf.String())
+	assert.Equal(test, "svc.TestMiddlewareRenames.func2", t.Stats()[0].Name)
+}
+
+func TestMiddlewareSuppresses(test *testing.T) {
+	var buf lockedBuffer
+	var mu sync.Mutex
+	var order []string
+	record := func(s string) {
+		mu.Lock()
+		order = append(order, s)
+		mu.Unlock()
+	}
+	veto := funcMiddleware{
+		enter: func(c *SpanContext) {
+			record("veto enter")
+			c.Suppress = c.Event.Message == "hidden"
+		},
+		exit: func(c *SpanContext) {
+			record("veto exit")
+			c.Suppress = c.Event.Message == "quiet"
+		},
+	}
+	last := funcMiddleware{
+		enter: func(*SpanContext) { record("last enter") },
+		exit:  func(*SpanContext) { record("last exit") },
+	}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &buf}}, Middleware: []SpanMiddleware{veto, last}})
+	t.Enter("%s", "quiet")()
+	func() {
+		defer t.Enter("%s", "hidden")()
+		t.Enter("%s", "nested")()
+	}()
+
+	assert.Equal(test, "[ 0]ENTER: =>quiet\n"+
+		"[ 1]  ENTER: =>nested\n"+
+		"[ 1]  EXIT:  =>nested\n", RE_tidMarker.ReplaceAllString(buf.String(), "=>"))
+	assert.Equal(test, []string{"veto enter", "last enter", "last exit", "veto exit"}, order[:4])
+	calls := 0
+	for _, s := range t.Stats() {
+		calls += int(s.Calls)
+	}
+	assert.Equal(test, 3, calls)
+}
+
+func TestMiddlewarePanics(test *testing.T) {
+	var buf lockedBuffer
+	faulty := funcMiddleware{enter: func(*SpanContext) { panic("boom") }}
+	tag := funcMiddleware{exit: func(c *SpanContext) { c.Span().Tag("seen", true) }}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &buf}}, Middleware: []SpanMiddleware{faulty, tag}})
+	assert.NotPanics(test, func() {
+		t.Enter("%s", "work")()
+	})
+	lines := strings.Split(RE_tidMarker.ReplaceAllString(buf.String(), "=>"), "\n")
+	assert.Equal(test, "Warning: tracey middleware tracey.funcMiddleware panicked: boom", lines[0])
+	assert.Equal(test, "[ 0]ENTER: =>work", lines[1])
+}
+
+func TestMiddlewareOrder(test *testing.T) {
+	var buf lockedBuffer
+	var entered, exited []string
+	var tags []Tag
+	record := funcMiddleware{
+		enter: func(c *SpanContext) {
+			entered = append(entered, c.Event.Message)
+			tags = append(tags, c.Event.Tags...)
+		},
+		exit: func(c *SpanContext) {
+			if c.Event.Err != nil {
+				exited = append(exited, c.Event.Err.Error())
+			}
+			c.Suppress = c.Event.Message == "quiet"
+		},
+	}
+	t := NewTracer(&Options{
+		Sinks:         []Sink{{Writer: &buf}},
+		MinLevel:      Debug,
+		FilterRules:   []FilterRule{{Kind: MatchExact, Pattern: "excluded", Action: Exclude}},
+		MaxMessageLen: 12,
+		MaxLines:      10,
+		Middleware:    []SpanMiddleware{record},
+	})
+	credentials := struct {
+		Token string `tracey:"token,redact"`
+	}{"secret"}
+	span := t.Start(Debug, WithStructTags(credentials), "%s", "a rather long message")
+	span.SetError(errors.New("a rather long error"))
+	span.End()
+	t.Enter(Trace, "%s", "filtered")()
+	t.StartNamed("excluded", Debug, "%s", "$FN").End()
+	t.Enter(Debug, "%s", "quiet")()
+
+	// Filtered, redacted and cut before the enter, whole before the exit
+	assert.Equal(test, []string{TruncateMessage("a rather long message", 12), "", "", "quiet"}, entered)
+	assert.Equal(test, []Tag{{"token", RedactedTagValue}}, tags)
+	assert.Equal(test, []string{"a rather long error"}, exited)
+	assert.Contains(test, buf.String(), "(error: "+TruncateMessage("a rather long error", 12)+")")
+	assert.NotContains(test, buf.String(), "filtered")
+	assert.NotContains(test, buf.String(), "excluded")
+
+	calls := 0
+	for _, s := range t.Stats() {
+		calls += int(s.Calls)
+	}
+	assert.Equal(test, 4, calls)
+
+	// Suppressed exits cost none of the quota
+	assert.Equal(test, 3, strings.Count(buf.String(), "\n"))
+	lines, _ := t.QuotaRemaining()
+	assert.Equal(test, uint64(7), lines)
+}
+
+func TestMiddlewareTailSampling(test *testing.T) {
+	var buf lockedBuffer
+	var exited []string
+	record := funcMiddleware{exit: func(c *SpanContext) { exited = append(exited, c.Event.Message) }}
+	t := NewTracer(&Options{
+		Sinks:        []Sink{{Writer: &buf}},
+		TailSampling: true,
+		TailDecision: func(tree TreeSummary) bool { return tree.Message == "kept" },
+		Middleware:   []SpanMiddleware{record},
+	})
+	for _, name := range []string{"kept", "dropped"} {
+		func() {
+			defer t.Enter("%s", name)()
+			t.Enter("%s", "child")()
+		}()
+	}
+
+	// The spans of the trees which are dropped go through them all the same
+	assert.Equal(test, []string{"child", "kept", "child", "dropped"}, exited)
+	assert.NotContains(test, buf.String(), "dropped")
+}
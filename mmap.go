@@ -0,0 +1,303 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// The layout of the files written by `MMapSink(...)`: a header, followed
+// by fixed-size records. Records which were never written are all zeros,
+// records torn by a crash fail their checksum.
+const (
+	mmapMagic      = "TRACEYMM"
+	mmapVersion    = 1
+	mmapHeaderSize = 64
+
+	// The record format, in little endian:
+	//
+	//	0      marker, always binaryMarker
+	//	1      kind
+	//	2      level
+	//	3      flags, binaryTruncated if any string was truncated,
+	//	       binaryReplayed for replayed events, binaryApproximate
+	//	       for durations below the clock's resolution and
+	//	       binaryRestored for the events of restored spans,
+	//	       binaryDirty for session headers of dirty builds, and
+	//	       binarySeq for records which end with the event's number
+	//	4:8    depth
+	//	8:16   time, in unix nanoseconds
+	//	16:24  goroutine id
+	//	24:32  duration
+	//	32:39  the lengths of the strings below
+	//	40:252 trace id, span id, parent id, name, error, message and
+	//	       session id, the latter being empty in older records
+	//	244:252 with binarySeq set, the number of the event (see
+	//	       `Event.Seq`), the strings ending before it
+	//	252:   CRC-32 of all of the above
+	//
+	// Session headers hold the build of the binary instead, the Go
+	// version, revision, version and main package taking the places of
+	// the ids and name, and the time of the revision that of the duration.
+	binaryRecordSize  = 256
+	binaryMarker      = 0xa5
+	binaryTruncated   = 1
+	binaryReplayed    = 2
+	binaryApproximate = 4
+	binaryRestored    = 8
+	binaryDirty       = 16
+	binarySeq         = 32
+	binarySeqAt       = 244
+	binaryStrings     = 40
+	binaryChecksum    = 252
+)
+
+// Renders an event as a single record of an mmap log
+func renderBinary(buf *bytes.Buffer, ev *Event) {
+	var rec [binaryRecordSize]byte
+	rec[0] = binaryMarker
+	rec[1] = byte(ev.Kind)
+	rec[2] = byte(ev.Level)
+	binary.LittleEndian.PutUint32(rec[4:], uint32(int32(ev.Depth)))
+	binary.LittleEndian.PutUint64(rec[8:], uint64(ev.Time.UnixNano()))
+	binary.LittleEndian.PutUint64(rec[16:], ev.TID)
+	binary.LittleEndian.PutUint64(rec[24:], uint64(ev.Duration))
+	if ev.Replayed {
+		rec[3] |= binaryReplayed
+	}
+	if ev.Approximate {
+		rec[3] |= binaryApproximate
+	}
+	if ev.Restored {
+		rec[3] |= binaryRestored
+	}
+	end := binaryChecksum
+	if ev.Seq != 0 {
+		rec[3] |= binarySeq
+		binary.LittleEndian.PutUint64(rec[binarySeqAt:], ev.Seq)
+		end = binarySeqAt
+	}
+
+	var errMsg string
+	if ev.Err != nil {
+		errMsg = ev.Err.Error()
+	}
+	// The session id is short, and kept whole
+	session := ev.Session
+	if len(session) > 32 {
+		session = truncateUTF8(session, 32)
+		rec[3] |= binaryTruncated
+	}
+	strs := [...]string{ev.TraceID, ev.SpanID, ev.ParentID, ev.Name, errMsg, ev.Message, session}
+	if b := ev.Build; ev.Kind == SessionEvent && b != nil {
+		strs = [...]string{b.GoVersion, b.Revision, b.Version, b.Path, "", "", session}
+		if !b.Time.IsZero() {
+			binary.LittleEndian.PutUint64(rec[24:], uint64(b.Time.UnixNano()))
+		}
+		if b.Dirty {
+			rec[3] |= binaryDirty
+		}
+	}
+	at := binaryStrings
+	for i, s := range strs {
+		room := end - at
+		if i < 6 {
+			room -= len(session)
+		}
+		if room > 255 {
+			room = 255
+		}
+		if len(s) > room {
+			s = truncateUTF8(s, room)
+			rec[3] |= binaryTruncated
+		}
+		rec[32+i] = byte(len(s))
+		at += copy(rec[at:], s)
+	}
+	binary.LittleEndian.PutUint32(rec[binaryChecksum:], crc32.ChecksumIEEE(rec[:binaryChecksum]))
+	buf.Write(rec[:])
+}
+
+// Cuts "s" down to at most "n" bytes without splitting a rune
+func truncateUTF8(s string, n int) string {
+	for n > 0 && n < len(s) && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Decodes a record, returning false if it was never written or was torn
+func decodeBinary(rec []byte) (Event, bool) {
+	if rec[0] != binaryMarker || binary.LittleEndian.Uint32(rec[binaryChecksum:]) != crc32.ChecksumIEEE(rec[:binaryChecksum]) {
+		return Event{}, false
+	}
+	ev := Event{
+		Kind:     EventKind(rec[1]),
+		Level:    Level(rec[2]),
+		Depth:    int(int32(binary.LittleEndian.Uint32(rec[4:]))),
+		Time:     time.Unix(0, int64(binary.LittleEndian.Uint64(rec[8:]))),
+		TID:      binary.LittleEndian.Uint64(rec[16:]),
+		Duration: time.Duration(binary.LittleEndian.Uint64(rec[24:])),
+		Replayed: rec[3]&binaryReplayed != 0,
+	}
+	ev.Approximate = rec[3]&binaryApproximate != 0
+	ev.Restored = rec[3]&binaryRestored != 0
+	end := binaryChecksum
+	if rec[3]&binarySeq != 0 {
+		ev.Seq = binary.LittleEndian.Uint64(rec[binarySeqAt:])
+		end = binarySeqAt
+	}
+	var s [7]string
+	at := binaryStrings
+	for i := range s {
+		n := int(rec[32+i])
+		if at+n > end {
+			return Event{}, false
+		}
+		s[i] = string(rec[at : at+n])
+		at += n
+	}
+	if ev.Kind == SessionEvent {
+		ev.Duration, ev.Session = 0, s[6]
+		if s[0] != "" || s[3] != "" {
+			ev.Build = &BuildInfo{Path: s[3], Version: s[2], Revision: s[1], GoVersion: s[0], Dirty: rec[3]&binaryDirty != 0}
+			if at := int64(binary.LittleEndian.Uint64(rec[24:])); at != 0 {
+				ev.Build.Time = time.Unix(0, at).UTC()
+			}
+			ev.Build.rendered()
+		}
+		return ev, true
+	}
+	ev.TraceID, ev.SpanID, ev.ParentID, ev.Name, ev.Message, ev.Session = s[0], s[1], s[2], s[3], s[5], s[6]
+	if s[4] != "" {
+		ev.Err = errors.New(s[4])
+	}
+	return ev, true
+}
+
+// An MMapLog is a pre-allocated file which events are appended to as
+// fixed-size binary records, see `MMapSink(...)`.
+type MMapLog struct {
+	backend mmapBackend
+	slots   int64
+
+	// The next record to write, the records dropped so far, and the
+	// writes in progress
+	next    int64
+	dropped uint64
+	writers int64
+	closed  uint32
+}
+
+// MMapSink creates (or truncates) the file at "path", of "sizeBytes", and
+// returns a log which appends events to it. It is meant for services in
+// which even a buffered write per event is too much: where the platform
+// allows it the file is memory-mapped, and each event costs a single
+// atomic increment and a copy, elsewhere it is a buffered file written
+// under a mutex. Events are dropped (and counted) once the file is full.
+//
+//	log, err := tracey.MMapSink("/var/tmp/trace.bin", 64<<20)
+//	...
+//	tracer := tracey.NewTracer(&tracey.Options{Sinks: []tracey.Sink{log.Sink()}})
+//	defer log.Close()
+//
+// Strings (names, messages, ids and errors) share about 200 bytes per
+// record, and are truncated to fit. Decode the file with `ReadMMapTrace(...)`.
+func MMapSink(path string, sizeBytes int64) (*MMapLog, error) {
+	if sizeBytes < mmapHeaderSize+binaryRecordSize {
+		return nil, fmt.Errorf("tracey: mmap log of %d bytes cannot hold any event", sizeBytes)
+	}
+	l := &MMapLog{slots: (sizeBytes - mmapHeaderSize) / binaryRecordSize}
+	var header [mmapHeaderSize]byte
+	copy(header[:], mmapMagic)
+	binary.LittleEndian.PutUint32(header[8:], mmapVersion)
+	binary.LittleEndian.PutUint32(header[12:], binaryRecordSize)
+	if err := l.backend.open(path, mmapHeaderSize+l.slots*binaryRecordSize, header[:]); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Sink returns the sink to add to a tracer's options.
+func (l *MMapLog) Sink() Sink {
+	return Sink{Writer: l, Format: BinaryFormat}
+}
+
+// Write appends a single record, as rendered by BinaryFormat sinks.
+func (l *MMapLog) Write(p []byte) (int, error) {
+	if len(p) != binaryRecordSize {
+		return 0, errors.New("tracey: mmap logs only take BinaryFormat records")
+	}
+	atomic.AddInt64(&l.writers, 1)
+	defer atomic.AddInt64(&l.writers, -1)
+	slot := atomic.AddInt64(&l.next, 1) - 1
+	if atomic.LoadUint32(&l.closed) != 0 || slot >= l.slots {
+		atomic.AddUint64(&l.dropped, 1)
+		return len(p), nil
+	}
+	l.backend.write(mmapHeaderSize+slot*binaryRecordSize, p)
+	return len(p), nil
+}
+
+func (l *MMapLog) lockFree() {}
+
+// Dropped returns the number of events which did not fit in the file.
+func (l *MMapLog) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+// Close waits for the writes in progress, and closes the file. Events
+// written after that are dropped.
+func (l *MMapLog) Close() error {
+	if !atomic.CompareAndSwapUint32(&l.closed, 0, 1) {
+		return nil
+	}
+	for atomic.LoadInt64(&l.writers) > 0 {
+		runtime.Gosched()
+	}
+	return l.backend.close()
+}
+
+// ReadMMapTrace decodes the events of a file written by `MMapSink(...)`,
+// in the order they were appended. Records which were never written, or
+// torn by a crash, are skipped.
+func ReadMMapTrace(path string) ([]Event, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMMapTrace(data, path)
+}
+
+// Decodes the contents of an mmap log, described as "name" in errors
+func decodeMMapTrace(data []byte, name string) ([]Event, error) {
+	if len(data) < mmapHeaderSize || string(data[:len(mmapMagic)]) != mmapMagic {
+		return nil, fmt.Errorf("tracey: %s is not an mmap log", name)
+	}
+	if version := binary.LittleEndian.Uint32(data[8:]); version > mmapVersion {
+		return nil, fmt.Errorf("tracey: %s has version %d, newer than %d", name, version, mmapVersion)
+	}
+	if size := binary.LittleEndian.Uint32(data[12:]); size != binaryRecordSize {
+		return nil, fmt.Errorf("tracey: %s has records of %d bytes", name, size)
+	}
+	return decodeRecords(data[mmapHeaderSize:]), nil
+}
+
+// Decodes consecutive binary records, skipping those which were never
+// written or were torn
+func decodeRecords(data []byte) []Event {
+	var events []Event
+	for at := 0; at+binaryRecordSize <= len(data); at += binaryRecordSize {
+		if ev, ok := decodeBinary(data[at : at+binaryRecordSize]); ok {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
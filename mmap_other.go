@@ -0,0 +1,44 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package tracey
+
+import (
+	"bufio"
+	"os"
+	"sync"
+)
+
+// The file of an mmap log, on platforms where it cannot be mapped into
+// memory: records are appended to a buffered file instead, in the order
+// they are written rather than that of their slots
+type mmapBackend struct {
+	sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+func (b *mmapBackend) open(path string, size int64, header []byte) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	b.file, b.w = f, bufio.NewWriterSize(f, 64<<10)
+	b.w.Write(header)
+	return nil
+}
+
+func (b *mmapBackend) write(at int64, p []byte) {
+	b.Lock()
+	b.w.Write(p)
+	b.Unlock()
+}
+
+func (b *mmapBackend) close() error {
+	b.Lock()
+	defer b.Unlock()
+	err := b.w.Flush()
+	if closeErr := b.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
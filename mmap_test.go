@@ -0,0 +1,132 @@
+package tracey
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMMapSink(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "trace.bin")
+	log, err := MMapSink(path, mmapHeaderSize+3*binaryRecordSize+100)
+	assert.Nil(test, err)
+	t := NewTracer(&Options{Sinks: []Sink{log.Sink()}, Clock: fakeClock(time.Millisecond)})
+
+	func() {
+		span := t.Start("%s", "outer")
+		defer span.End()
+		inner := t.Start("%s", strings.Repeat("é", 150))
+		inner.SetError(errors.New("failed"))
+		inner.End()
+	}()
+	// The exit of "outer" did not fit
+	assert.Equal(test, uint64(1), log.Dropped())
+	assert.Nil(test, log.Close())
+	assert.Nil(test, log.Close())
+
+	events, err := ReadMMapTrace(path)
+	assert.Nil(test, err)
+	if assert.Equal(test, 3, len(events)) {
+		assert.Equal(test, EnterEvent, events[0].Kind)
+		assert.Equal(test, "outer", events[0].Message)
+		assert.Equal(test, "1", events[0].SpanID)
+		assert.Equal(test, 1, events[1].Depth)
+		assert.Equal(test, "1", events[1].ParentID)
+		assert.Equal(test, ExitEvent, events[2].Kind)
+		assert.Equal(test, time.Millisecond, events[2].Duration)
+		assert.Equal(test, "failed", events[2].Err.Error())
+	}
+
+	// Truncated strings stay valid UTF-8
+	msg := events[1].Message
+	assert.True(test, strings.HasPrefix(strings.Repeat("é", 150), msg))
+	assert.True(test, len(msg) < 200)
+}
+
+func TestMMapSinkErrorsAndFull(test *testing.T) {
+	dir := test.TempDir()
+	_, err := MMapSink(filepath.Join(dir, "tiny.bin"), 100)
+	assert.Error(test, err)
+
+	log, err := MMapSink(filepath.Join(dir, "full.bin"), mmapHeaderSize+2*binaryRecordSize)
+	assert.Nil(test, err)
+	t := NewTracer(&Options{Sinks: []Sink{log.Sink()}})
+	for i := 0; i < 5; i++ {
+		t.Start("%d", i).End()
+	}
+	assert.Equal(test, uint64(8), log.Dropped())
+	assert.Nil(test, log.Close())
+	t.Start("%s", "after close").End()
+	assert.Equal(test, uint64(10), log.Dropped())
+
+	_, err = log.Write([]byte("not a record"))
+	assert.Error(test, err)
+	_, err = ReadMMapTrace(filepath.Join(dir, "missing.bin"))
+	assert.Error(test, err)
+}
+
+func TestReadMMapTraceTornRecord(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "torn.bin")
+	log, err := MMapSink(path, mmapHeaderSize+4*binaryRecordSize)
+	assert.Nil(test, err)
+	t := NewTracer(&Options{Sinks: []Sink{log.Sink()}})
+	t.Start("%s", "a").End()
+	assert.Nil(test, log.Close())
+
+	// A crash half way through the copy of the exit record
+	data, _ := os.ReadFile(path)
+	exit := data[mmapHeaderSize+binaryRecordSize:]
+	for i := binaryRecordSize / 2; i < binaryRecordSize; i++ {
+		exit[i] = 0
+	}
+	assert.Nil(test, os.WriteFile(path, data[:len(data)-binaryRecordSize/2], 0o644))
+
+	events, err := ReadMMapTrace(path)
+	assert.Nil(test, err)
+	if assert.Equal(test, 1, len(events)) {
+		assert.Equal(test, "a", events[0].Message)
+	}
+
+	assert.Nil(test, os.WriteFile(path, []byte("not a trace"), 0o644))
+	_, err = ReadMMapTrace(path)
+	assert.Error(test, err)
+}
+
+func benchmarkSink(b *testing.B, sink Sink) {
+	t := NewTracer(&Options{Sinks: []Sink{sink}})
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			t.Start("%s", "work").End()
+		}
+	})
+}
+
+func BenchmarkMMapSink(b *testing.B) {
+	log, err := MMapSink(filepath.Join(b.TempDir(), "bench.bin"), 256<<20)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer log.Close()
+	benchmarkSink(b, log.Sink())
+}
+
+func BenchmarkTextSinkToFile(b *testing.B) {
+	f, err := os.Create(filepath.Join(b.TempDir(), "bench.txt"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	benchmarkSink(b, Sink{Writer: f})
+}
+
+func BenchmarkJSONSinkToDiscard(b *testing.B) {
+	benchmarkSink(b, Sink{Writer: io.Discard, Format: JSONFormat})
+}
@@ -0,0 +1,46 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package tracey
+
+import (
+	"os"
+	"syscall"
+)
+
+// The file of an mmap log, mapped into memory
+type mmapBackend struct {
+	file *os.File
+	data []byte
+}
+
+func (b *mmapBackend) open(path string, size int64, header []byte) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	copy(data, header)
+	b.file, b.data = f, data
+	return nil
+}
+
+// Every record has a slot of its own, so writes need no locking
+func (b *mmapBackend) write(at int64, p []byte) {
+	copy(b.data[at:], p)
+}
+
+func (b *mmapBackend) close() error {
+	err := syscall.Munmap(b.data)
+	if closeErr := b.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,209 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// A NameRule renames the functions whose name is "Pattern", or which the
+// regex "Pattern" matches when "Regex" is set, to "Name", in which the
+// regex's captures expand as in `regexp.Regexp.Expand(...)`, such as "$1".
+type NameRule struct {
+	Pattern string
+	Name    string
+	Regex   bool
+}
+
+// A NameMap renames functions in the output, see "NameMap". The zero
+// value renames nothing.
+type NameMap struct {
+	m *nameMapping
+}
+
+// The compiled rules of a NameMap, along with the name found for every
+// function name so far
+type nameMapping struct {
+	exact    map[string]string
+	patterns []*regexp.Regexp
+	names    []string
+
+	byName sync.Map // name -> string
+}
+
+// CompileNameMap builds a NameMap from its rules. Exact names take
+// precedence over regexes, of which the first to match wins.
+func CompileNameMap(rules []NameRule) (NameMap, error) {
+	m := &nameMapping{exact: make(map[string]string)}
+	for _, rule := range rules {
+		if !rule.Regex {
+			if _, ok := m.exact[rule.Pattern]; !ok {
+				m.exact[rule.Pattern] = rule.Name
+			}
+			continue
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return NameMap{}, fmt.Errorf("tracey: bad pattern in name map: %v", err)
+		}
+		m.patterns = append(m.patterns, pattern)
+		m.names = append(m.names, rule.Name)
+	}
+	return NameMap{m}, nil
+}
+
+// LoadNameMap reads the rules of a NameMap, either as a JSON array of
+// objects with an "exact" or "regex" key and a "name", as in
+//
+//	[{"exact": "main.xyz_wrap3", "name": "login"},
+//	 {"regex": "^.*_generated_(.*)Handler$", "name": "$1 handler"}]
+//
+// or as CSV, each record being "exact" or "regex", the pattern, and the
+// name, as in
+//
+//	exact,main.xyz_wrap3,login
+//	regex,^.*_generated_(.*)Handler$,$1 handler
+//
+// the header "kind,pattern,name" being optional. See `CompileNameMap(...)`
+// for which rule wins.
+func LoadNameMap(r io.Reader) (NameMap, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return NameMap{}, fmt.Errorf("tracey: reading the name map: %v", err)
+	}
+	var rules []NameRule
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		rules, err = nameRulesFromJSON(trimmed)
+	} else {
+		rules, err = nameRulesFromCSV(data)
+	}
+	if err != nil {
+		return NameMap{}, err
+	}
+	return CompileNameMap(rules)
+}
+
+func nameRulesFromJSON(data []byte) ([]NameRule, error) {
+	var entries []struct {
+		Exact *string `json:"exact"`
+		Regex *string `json:"regex"`
+		Name  string  `json:"name"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("tracey: bad name map: %v", err)
+	}
+	rules := make([]NameRule, len(entries))
+	for i, entry := range entries {
+		switch {
+		case entry.Exact != nil && entry.Regex == nil:
+			rules[i] = NameRule{Pattern: *entry.Exact, Name: entry.Name}
+		case entry.Regex != nil && entry.Exact == nil:
+			rules[i] = NameRule{Pattern: *entry.Regex, Name: entry.Name, Regex: true}
+		default:
+			return nil, fmt.Errorf("tracey: bad name map: entry %d needs either \"exact\" or \"regex\"", i+1)
+		}
+	}
+	return rules, nil
+}
+
+func nameRulesFromCSV(data []byte) ([]NameRule, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("tracey: bad name map: %v", err)
+	}
+	var rules []NameRule
+	for i, record := range records {
+		switch strings.ToLower(record[0]) {
+		case "exact":
+			rules = append(rules, NameRule{Pattern: record[1], Name: record[2]})
+		case "regex":
+			rules = append(rules, NameRule{Pattern: record[1], Name: record[2], Regex: true})
+		case "kind":
+			if i == 0 {
+				continue
+			}
+			fallthrough
+		default:
+			return nil, fmt.Errorf("tracey: bad name map: line %d is neither \"exact\" nor \"regex\"", i+1)
+		}
+	}
+	return rules, nil
+}
+
+// Name returns the name the function is renamed to, or the name itself if
+// no rule matches it.
+func (nm NameMap) Name(fnName string) string {
+	m := nm.m
+	if m == nil {
+		return fnName
+	}
+	if found, ok := m.byName.Load(fnName); ok {
+		return found.(string)
+	}
+	found := m.rename(fnName)
+	m.byName.Store(fnName, found)
+	return found
+}
+
+func (m *nameMapping) rename(name string) string {
+	if renamed, ok := m.exact[name]; ok {
+		return renamed
+	}
+	for i, pattern := range m.patterns {
+		if match := pattern.FindStringSubmatchIndex(name); match != nil {
+			return string(pattern.ExpandString(nil, m.names[i], name, match))
+		}
+	}
+	return name
+}
+
+// The number of rules, exact and regex
+func (nm NameMap) size() int {
+	if nm.m == nil {
+		return 0
+	}
+	return len(nm.m.exact) + len(nm.m.patterns)
+}
+
+// Apply renames the functions of recorded events, such as those of a
+// session read back with `UnmarshalEvent(...)`, in place. Their messages
+// are left as they were recorded.
+func (nm NameMap) Apply(events []Event) {
+	if nm.m == nil {
+		return
+	}
+	for i := range events {
+		if events[i].Name != "" {
+			events[i].Name = nm.Name(events[i].Name)
+		}
+	}
+}
+
+// Returns the name of a function as the output shows it, see "NameMap"
+func (t *Tracer) displayName(runtimeName string) string {
+	name := formatFnName(runtimeName, t.options.NameFormatter)
+	if nm := t.nameMap.Load(); nm != nil {
+		name = nm.Name(name)
+	}
+	return name
+}
+
+// ReloadNameMap replaces the "NameMap" the tracer renames functions with.
+// The spans entered from then on are named by the new map, the names of
+// the functions being looked up again. Spans entered meanwhile on other
+// goroutines may be named by either map.
+func (t *Tracer) ReloadNameMap(nm NameMap) {
+	t.nameMap.Store(&nm)
+	t.callsites.Range(func(pc, _ interface{}) bool {
+		t.callsites.Delete(pc)
+		return true
+	})
+}
@@ -0,0 +1,114 @@
+package tracey
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func xyz_generated_LoginHandler(t *Tracer) {
+	defer t.Enter()()
+}
+
+func xyz_generated_LogoutHandler(t *Tracer) {
+	defer t.Enter()()
+}
+
+func TestLoadNameMap(test *testing.T) {
+	fromJSON, err := LoadNameMap(strings.NewReader(`[
+		{"regex": "^pkg\\.(.*)_wrap[0-9]+$", "name": "wrapped $1"},
+		{"regex": "^pkg\\.", "name": "anything in pkg"},
+		{"exact": "pkg.login_wrap3", "name": "login"}
+	]`))
+	assert.Nil(test, err)
+	fromCSV, err := LoadNameMap(strings.NewReader("kind,pattern,name\n" +
+		`regex,^pkg\.(.*)_wrap[0-9]+$,wrapped $1` + "\n" +
+		`regex,^pkg\.,anything in pkg` + "\n" +
+		"exact,pkg.login_wrap3,login\n"))
+	assert.Nil(test, err)
+
+	for _, nm := range []NameMap{fromJSON, fromCSV} {
+		// Exact names come first, then the first regex to match
+		assert.Equal(test, "login", nm.Name("pkg.login_wrap3"))
+		assert.Equal(test, "wrapped logout", nm.Name("pkg.logout_wrap12"))
+		assert.Equal(test, "anything in pkg", nm.Name("pkg.Other"))
+		assert.Equal(test, "main.unmapped", nm.Name("main.unmapped"))
+	}
+	assert.Equal(test, "main.unmapped", NameMap{}.Name("main.unmapped"))
+
+	_, err = LoadNameMap(strings.NewReader(`[{"name": "nothing to match"}]`))
+	assert.EqualError(test, err, `tracey: bad name map: entry 1 needs either "exact" or "regex"`)
+	_, err = LoadNameMap(strings.NewReader("prefix,pkg.,pkg\n"))
+	assert.EqualError(test, err, `tracey: bad name map: line 1 is neither "exact" nor "regex"`)
+	_, err = LoadNameMap(strings.NewReader("regex,(,bad\n"))
+	assert.Error(test, err)
+}
+
+func TestNameMap(test *testing.T) {
+	nm, err := CompileNameMap([]NameRule{{Pattern: `^.*_generated_(.*)Handler$`, Name: "$1 handler", Regex: true}})
+	assert.Nil(test, err)
+	var out, text lockedBuffer
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Writer: &out, Format: JSONFormat}, {Writer: &text}},
+		NameMap:          nm,
+		FilterRules:      []FilterRule{{Kind: MatchExact, Pattern: "Logout handler", Action: Exclude}},
+		MessageTemplates: map[string]string{`^Login handler$`: "$FN called"},
+	})
+	xyz_generated_LoginHandler(t)
+	xyz_generated_LogoutHandler(t)
+	names := func() []string {
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			ev, err := UnmarshalEvent([]byte(line))
+			assert.Nil(test, err)
+			if ev.Kind == EnterEvent {
+				names = append(names, ev.Name)
+			}
+		}
+		return names
+	}
+	// The filters and templates match the new names
+	assert.Equal(test, []string{"Login handler"}, names())
+	assert.Contains(test, text.String(), "ENTER: Login handler called\n")
+
+	// Visible to the spans entered from then on
+	nm, err = CompileNameMap([]NameRule{{Pattern: "go-tracey.xyz_generated_LoginHandler", Name: "sign in"}})
+	assert.Nil(test, err)
+	t.ReloadNameMap(nm)
+	xyz_generated_LoginHandler(t)
+	assert.Equal(test, []string{"Login handler", "sign in"}, names())
+
+	// Unmapped again
+	out.Reset()
+	t.ReloadNameMap(NameMap{})
+	xyz_generated_LoginHandler(t)
+	assert.Equal(test, []string{"go-tracey.xyz_generated_LoginHandler"}, names())
+}
+
+func TestNameMapApply(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out, Format: JSONFormat}}})
+	xyz_generated_LoginHandler(t)
+	xyz_generated_LogoutHandler(t)
+	var session []Event
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		session = append(session, ev)
+	}
+
+	nm, err := LoadNameMap(strings.NewReader(`regex,^.*_generated_(.*)Handler$,$1 handler`))
+	assert.Nil(test, err)
+	nm.Apply(session)
+	var names []string
+	for _, ev := range session {
+		names = append(names, ev.Name)
+	}
+	assert.Equal(test, []string{"Login handler", "Login handler", "Logout handler", "Logout handler"}, names)
+
+	// Sessions recorded under different names compare by the new ones
+	diff := CompareSessions(session, session)
+	assert.Len(test, diff.Funcs, 2)
+	assert.Equal(test, "Login handler", diff.Funcs[0].Name)
+}
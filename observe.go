@@ -0,0 +1,325 @@
+package tracey
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+// The buckets of the metrics "ObservationBuckets" has none for: powers of
+// 2 from 1 to 2^30, which suits counts and sizes alike
+var defaultObservationBuckets = func() []float64 {
+	bounds := make([]float64, 31)
+	for i := range bounds {
+		bounds[i] = math.Ldexp(1, i)
+	}
+	return bounds
+}()
+
+// A metric observed so far, validated and interned the first time, see
+// `Span.Observe(...)`
+type observedMetric struct {
+	name   string
+	bounds []float64
+	valid  bool
+}
+
+// The values of a metric observed by a function, in buckets whose counts
+// are bumped atomically, and their sum and maximum, as float bits
+type histogram struct {
+	metric *observedMetric
+	counts []uint64
+	sum    uint64
+	max    uint64
+}
+
+// The histogram a span observed into last, see `Span.Observe(...)`
+type spanObservation struct {
+	function, metric string
+	h                *histogram
+}
+
+// ObservationStats summarizes the values of a metric observed by the
+// calls to a single function so far, see `Span.Observe(...)`.
+type ObservationStats struct {
+	Function string
+	Metric   string
+	Count    uint64
+	Sum      float64
+	Max      float64
+
+	// The upper bounds of the buckets, and how many of the values fell
+	// in each, those above the last bound being counted last, one past
+	// the bounds
+	Bounds []float64
+	Counts []uint64
+}
+
+// Mean returns the average of the values, or 0 if there are none.
+func (s ObservationStats) Mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / float64(s.Count)
+}
+
+// Percentile estimates the value which "p" percent (between 0 and 100) of
+// the values were at most, as the upper bound of the bucket it falls in,
+// or the maximum if that is lower. Returns 0 if there are no values.
+func (s ObservationStats) Percentile(p float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(s.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range s.Counts {
+		if seen += n; seen < rank {
+			continue
+		}
+		if i < len(s.Bounds) && s.Bounds[i] < s.Max {
+			return s.Bounds[i]
+		}
+		break
+	}
+	return s.Max
+}
+
+// Observe records "value" as a measurement of "metric" for the span's
+// function, such as the rows a query returned or the bytes of a payload,
+// into a histogram of the values of the metric for the function, with the
+// buckets "ObservationBuckets" gives the metric. The histograms are
+// listed by `Observations()`, `DumpStats(...)`, `WritePrometheus(...)`
+// and `PublishExpvar(...)`. The metric must have a valid Prometheus
+// metric name, as in "rows": the values of others are not recorded, which
+// is warned about once. Values observed once the span ended are not
+// recorded either, only counted, see `ObservationsDropped()`. Repeated
+// observations of a metric by the same span take a few atomic
+// operations.
+func (s *Span) Observe(metric string, value float64) {
+	t := s.t
+	if t == nil || math.IsNaN(value) {
+		return
+	}
+	if atomic.LoadUint32(&s.ended) != 0 {
+		atomic.AddUint64(&t.stats.droppedObservations, 1)
+		return
+	}
+	if last := s.observed.Load(); last != nil && last.metric == metric && last.function == s.ev.Name {
+		last.h.observe(value)
+		return
+	}
+	m := t.observedMetric(metric)
+	if !m.valid {
+		return
+	}
+	h := t.histogram(s.ev.Name, m)
+	s.observed.Store(&spanObservation{s.ev.Name, m.name, h})
+	h.observe(value)
+}
+
+// Returns the metric, validating it the first time around
+func (t *Tracer) observedMetric(name string) *observedMetric {
+	if found, ok := t.stats.metrics.Load(name); ok {
+		return found.(*observedMetric)
+	}
+	m := &observedMetric{name: name, bounds: t.observationBuckets[name], valid: RE_instrumentName.MatchString(name)}
+	if m.bounds == nil {
+		m.bounds = defaultObservationBuckets
+	}
+	found, loaded := t.stats.metrics.LoadOrStore(name, m)
+	if !loaded && !m.valid && t.start != nil {
+		warning := "Warning: metric " + strconv.Quote(name) + " is not a valid metric name in tracey, its values are not recorded.\n"
+		if t.admitOutput(len(warning)) {
+			t.note(warning)
+		}
+	}
+	return found.(*observedMetric)
+}
+
+// Returns the histogram of the metric for the function, by function and
+// then by metric
+func (t *Tracer) histogram(function string, m *observedMetric) *histogram {
+	metrics, ok := t.stats.observed.Load(function)
+	if !ok {
+		metrics, _ = t.stats.observed.LoadOrStore(function, &sync.Map{})
+	}
+	h, ok := metrics.(*sync.Map).Load(m.name)
+	if !ok {
+		h, _ = metrics.(*sync.Map).LoadOrStore(m.name, &histogram{
+			metric: m,
+			counts: make([]uint64, len(m.bounds)+1),
+			max:    math.Float64bits(math.Inf(-1)),
+		})
+	}
+	return h.(*histogram)
+}
+
+func (h *histogram) observe(value float64) {
+	atomic.AddUint64(&h.counts[sort.SearchFloat64s(h.metric.bounds, value)], 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+value)) {
+			break
+		}
+	}
+	for {
+		old := atomic.LoadUint64(&h.max)
+		if value <= math.Float64frombits(old) || atomic.CompareAndSwapUint64(&h.max, old, math.Float64bits(value)) {
+			break
+		}
+	}
+}
+
+// Observations returns the histograms of the values observed so far, see
+// `Span.Observe(...)`, sorted by function and then by metric.
+func (t *Tracer) Observations() []ObservationStats {
+	var all []ObservationStats
+	t.stats.observed.Range(func(function, metrics interface{}) bool {
+		metrics.(*sync.Map).Range(func(metric, value interface{}) bool {
+			h := value.(*histogram)
+			s := ObservationStats{
+				Function: function.(string),
+				Metric:   metric.(string),
+				Sum:      math.Float64frombits(atomic.LoadUint64(&h.sum)),
+				Max:      math.Float64frombits(atomic.LoadUint64(&h.max)),
+				Bounds:   h.metric.bounds,
+				Counts:   make([]uint64, len(h.counts)),
+			}
+			for i := range h.counts {
+				s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+				s.Count += s.Counts[i]
+			}
+			if s.Count > 0 {
+				all = append(all, s)
+			}
+			return true
+		})
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Function != all[j].Function {
+			return all[i].Function < all[j].Function
+		}
+		return all[i].Metric < all[j].Metric
+	})
+	return all
+}
+
+// ObservationsDropped returns how many values were observed by spans
+// which had ended, and were not recorded, see `Span.Observe(...)`.
+func (t *Tracer) ObservationsDropped() uint64 {
+	return atomic.LoadUint64(&t.stats.droppedObservations)
+}
+
+// Writes the table of the observations for `DumpStats(...)`, if there
+// are any
+func (t *Tracer) dumpObservations(w io.Writer) error {
+	all := t.Observations()
+	if len(all) == 0 {
+		return nil
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FUNCTION\tMETRIC\tCOUNT\tMEAN\tP50\tP95\tMAX")
+	for _, s := range all {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", s.Function, s.Metric, s.Count, formatFloat(s.Mean()),
+			formatFloat(s.Percentile(50)), formatFloat(s.Percentile(95)), formatFloat(s.Max))
+	}
+	return tw.Flush()
+}
+
+// The observations for `PublishExpvar(...)`, by function and metric
+func (t *Tracer) expvarObservations() interface{} {
+	values := make(map[string]interface{})
+	for _, s := range t.Observations() {
+		metrics, _ := values[s.Function].(map[string]interface{})
+		if metrics == nil {
+			metrics = make(map[string]interface{})
+			values[s.Function] = metrics
+		}
+		metrics[s.Metric] = map[string]interface{}{
+			"count": s.Count, "mean": s.Mean(), "p50": s.Percentile(50), "p95": s.Percentile(95), "max": s.Max,
+		}
+	}
+	return values
+}
+
+// WritePrometheus writes the counters and gauges (see `Counter(...)`)
+// and the histograms of the observations (see `Span.Observe(...)`) in the
+// Prometheus text exposition format, as a "/metrics" handler would serve
+// them. The histograms are those of the "tracey_observations" family,
+// labeled by "function" and "metric".
+func (t *Tracer) WritePrometheus(w io.Writer) error {
+	var b strings.Builder
+	values := t.Instruments()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		kind := "gauge"
+		if found, _ := t.instruments.Load(name); found != nil {
+			if _, ok := found.(*Counter); ok {
+				kind = "counter"
+			}
+		}
+		b.WriteString("# TYPE " + name + " " + kind + "\n")
+		b.WriteString(name + " " + formatFloat(values[name]) + "\n")
+	}
+
+	if all := t.Observations(); len(all) > 0 {
+		b.WriteString("# HELP tracey_observations Values observed by traced functions.\n")
+		b.WriteString("# TYPE tracey_observations histogram\n")
+		for _, s := range all {
+			labels := `function="` + escapeLabel(s.Function) + `",metric="` + escapeLabel(s.Metric) + `"`
+			var cumulative uint64
+			for i, n := range s.Counts {
+				cumulative += n
+				le := "+Inf"
+				if i < len(s.Bounds) {
+					le = formatFloat(s.Bounds[i])
+				}
+				b.WriteString("tracey_observations_bucket{" + labels + `,le="` + le + `"} ` + strconv.FormatUint(cumulative, 10) + "\n")
+			}
+			b.WriteString("tracey_observations_sum{" + labels + "} " + formatFloat(s.Sum) + "\n")
+			b.WriteString("tracey_observations_count{" + labels + "} " + strconv.FormatUint(s.Count, 10) + "\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Escapes a label value of the Prometheus text format
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// Checks the buckets of "ObservationBuckets", which must go up
+func checkObservationBuckets(buckets map[string][]float64) error {
+	for metric, bounds := range buckets {
+		if !RE_instrumentName.MatchString(metric) {
+			return fmt.Errorf("bad metric name %q in ObservationBuckets", metric)
+		}
+		if len(bounds) == 0 {
+			return fmt.Errorf("no buckets for %q in ObservationBuckets", metric)
+		}
+		for i, bound := range bounds {
+			if math.IsNaN(bound) || (i > 0 && bound <= bounds[i-1]) {
+				return fmt.Errorf("buckets for %q in ObservationBuckets do not go up", metric)
+			}
+		}
+	}
+	return nil
+}
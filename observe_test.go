@@ -0,0 +1,163 @@
+package tracey
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserve(test *testing.T) {
+	t := NewTracer(&Options{
+		Sinks:              []Sink{{Writer: io.Discard}},
+		ObservationBuckets: map[string][]float64{"rows": {10, 100}},
+	})
+	s := t.StartNamed("batch")
+	for v := 1; v <= 10; v++ {
+		s.Observe("size", float64(v))
+	}
+	for _, v := range []float64{5, 50, 500, 10} {
+		s.Observe("rows", v)
+	}
+	s.End()
+
+	all := t.Observations()
+	assert.Len(test, all, 2)
+	rows, size := all[0], all[1]
+	assert.Equal(test, "rows", rows.Metric)
+	assert.Equal(test, []float64{10, 100}, rows.Bounds)
+	assert.Equal(test, []uint64{2, 1, 1}, rows.Counts)
+	assert.Equal(test, uint64(4), rows.Count)
+	assert.Equal(test, 565.0, rows.Sum)
+	assert.Equal(test, 500.0, rows.Max)
+
+	assert.Equal(test, "batch", size.Function)
+	assert.Equal(test, []uint64{1, 1, 2, 4, 2}, size.Counts[:5])
+	assert.Equal(test, 5.5, size.Mean())
+	assert.Equal(test, 8.0, size.Percentile(50))
+	assert.Equal(test, 10.0, size.Percentile(95))
+	assert.Equal(test, 1.0, size.Percentile(0))
+
+	// Above the last bound, the estimate is the maximum
+	assert.Equal(test, 100.0, rows.Percentile(75))
+	assert.Equal(test, 500.0, rows.Percentile(95))
+	assert.Equal(test, 0.0, ObservationStats{}.Percentile(50))
+}
+
+func TestObserveConcurrent(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := t.StartNamed("worker")
+			for j := 0; j < 1000; j++ {
+				s.Observe("bytes", 3)
+				s.Observe("items", 1)
+			}
+			s.End()
+		}()
+	}
+	wg.Wait()
+	for _, s := range t.Observations() {
+		assert.Equal(test, uint64(8000), s.Count, s.Metric)
+	}
+	assert.Equal(test, 24000.0, t.Observations()[0].Sum)
+}
+
+func TestObserveDropped(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}})
+	s := t.StartNamed("query")
+	s.Observe("rows", 3)
+	s.Observe("rows per page", 3)
+	s.Observe("rows per page", 4)
+	s.End()
+	s.Observe("rows", 5)
+	s.Observe("rows", 6)
+
+	all := t.Observations()
+	assert.Len(test, all, 1)
+	assert.Equal(test, uint64(1), all[0].Count)
+	assert.Equal(test, uint64(2), t.ObservationsDropped())
+	assert.Equal(test, 1, strings.Count(out.String(), "Warning: metric \"rows per page\" is not a valid metric name in tracey, its values are not recorded.\n"))
+
+	// Observing without a tracer is a no-op
+	(&Span{}).Observe("rows", 1)
+}
+
+func TestObservationBucketsValidate(test *testing.T) {
+	for _, buckets := range []map[string][]float64{
+		{"rows": {10, 10}},
+		{"rows": {}},
+		{"row count": {1}},
+	} {
+		assert.NotNil(test, (&Options{ObservationBuckets: buckets}).Validate(), buckets)
+		assert.Panics(test, func() { NewTracer(&Options{ObservationBuckets: buckets}) })
+	}
+	assert.Nil(test, (&Options{ObservationBuckets: map[string][]float64{"rows": {0.5, 1, 2}}}).Validate())
+}
+
+func TestDumpObservations(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}})
+	s := t.StartNamed("load")
+	for v := 1; v <= 10; v++ {
+		s.Observe("size", float64(v))
+	}
+	s.End()
+	var buf bytes.Buffer
+	assert.Nil(test, t.DumpStats(&buf))
+	dump := buf.String()
+	assert.Contains(test, dump, "\nFUNCTION  METRIC  COUNT  MEAN  P50  P95  MAX\n"+
+		"load      size    10     5.5   8    10   10\n")
+
+	prefix := expvarPrefix(test)
+	assert.Nil(test, t.PublishExpvar(prefix))
+	assert.Equal(test, map[string]interface{}{"load": map[string]interface{}{
+		"size": map[string]interface{}{"count": 10.0, "mean": 5.5, "p50": 8.0, "p95": 10.0, "max": 10.0},
+	}}, readExpvars(test, prefix)["observations"])
+
+	t.ResetStats()
+	assert.Empty(test, t.Observations())
+}
+
+func TestWritePrometheus(test *testing.T) {
+	t := NewTracer(&Options{
+		Sinks:              []Sink{{Writer: io.Discard}},
+		ObservationBuckets: map[string][]float64{"rows": {10, 100}},
+	})
+	t.Counter("cache_hits").Add(3)
+	t.Gauge("queue_len").Set(-2)
+	s := t.StartNamed(`db."query"`)
+	for _, v := range []float64{5, 50, 500} {
+		s.Observe("rows", v)
+	}
+	s.End()
+
+	var buf bytes.Buffer
+	assert.Nil(test, t.WritePrometheus(&buf))
+	assert.Equal(test, "# TYPE cache_hits counter\n"+
+		"cache_hits 3\n"+
+		"# TYPE queue_len gauge\n"+
+		"queue_len -2\n"+
+		"# HELP tracey_observations Values observed by traced functions.\n"+
+		"# TYPE tracey_observations histogram\n"+
+		`tracey_observations_bucket{function="db.\"query\"",metric="rows",le="10"} 1`+"\n"+
+		`tracey_observations_bucket{function="db.\"query\"",metric="rows",le="100"} 2`+"\n"+
+		`tracey_observations_bucket{function="db.\"query\"",metric="rows",le="+Inf"} 3`+"\n"+
+		`tracey_observations_sum{function="db.\"query\"",metric="rows"} 555`+"\n"+
+		`tracey_observations_count{function="db.\"query\"",metric="rows"} 3`+"\n", buf.String())
+}
+
+func TestObserveAllocs(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}})
+	s := t.StartNamed("batch")
+	s.Observe("rows", 1)
+	allocs := testing.AllocsPerRun(100, func() { s.Observe("rows", 2) })
+	assert.Equal(test, 0.0, allocs)
+	s.End()
+}
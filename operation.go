@@ -0,0 +1,190 @@
+package tracey
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxAttemptDetail is how many attempts of an operation its summary
+// lists the durations of, unless "MaxAttemptDetail" says otherwise.
+const DefaultMaxAttemptDetail = 8
+
+// An Operation groups the attempts at a single logical operation, such as
+// the tries of a retry loop, see `Tracer.Operation(...)`. It is safe for
+// concurrent use.
+type Operation struct {
+	t    *Tracer
+	id   string
+	site *callsite
+
+	mu       sync.Mutex
+	started  int
+	finished int
+	elapsed  time.Duration
+
+	// The durations of the first attempts and, in a ring, of the last
+	// ones, which the summary lists
+	head []attemptDetail
+	tail []attemptDetail
+
+	// The outcome of the last attempt which finished
+	last    int
+	lastErr error
+
+	done uint32
+}
+
+type attemptDetail struct {
+	n        int
+	duration time.Duration
+}
+
+// Operation returns a new operation named "name", whose attempts are each
+// traced as a span named after it, as in
+//
+//	op := tracer.Operation("charge")
+//	defer op.Done()
+//	for {
+//		finish := op.Attempt("charging %s", card)
+//		err := charge(card)
+//		finish(err)
+//		...
+//	}
+//
+// The spans of the attempts are tagged with the number of the attempt, as
+// in "attempt=2", and with the id the operation is given, as in "op_id=7".
+// See `Operation.Done()` for the summary of the operation.
+func (t *Tracer) Operation(name string) *Operation {
+	if t.start == nil {
+		return &Operation{}
+	}
+	return &Operation{t: t, id: t.options.IDGenerator.NewSpanID(), site: t.namedSite(name)}
+}
+
+// ID returns the id of the operation, which its spans are tagged with.
+func (op *Operation) ID() string {
+	return op.id
+}
+
+// Attempt starts the span of a new attempt at the operation, within the
+// span open on the calling goroutine, and returns the function which ends
+// it with the attempt's error (nil if it succeeded). The message is the
+// operation's name unless the arguments say otherwise. The attempts are
+// numbered from 1 in the order they start, and may run on any goroutine.
+func (op *Operation) Attempt(s ...interface{}) func(error) {
+	if op.t == nil {
+		return func(error) {}
+	}
+	op.mu.Lock()
+	op.started++
+	n := op.started
+	op.mu.Unlock()
+
+	if len(s) == 0 {
+		s = []interface{}{"%s", "$FN"}
+	}
+	span := op.t.start(nil, "", op.site, s...)
+	span.Tag("attempt", n)
+	span.Tag("op_id", op.id)
+	began := op.t.options.Clock()
+	return func(err error) {
+		d := op.t.options.Clock().Sub(began)
+		span.SetError(err)
+		span.End()
+		op.finish(n, d, err)
+	}
+}
+
+// Records how the attempt went
+func (op *Operation) finish(n int, d time.Duration, err error) {
+	limit := op.t.options.MaxAttemptDetail
+	if limit <= 0 {
+		limit = DefaultMaxAttemptDetail
+	}
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.finished++
+	op.elapsed += d
+	if n > op.last {
+		op.last, op.lastErr = n, err
+	}
+	heads := (limit + 1) / 2
+	if n <= heads {
+		if op.head == nil {
+			op.head = make([]attemptDetail, heads)
+		}
+		op.head[n-1] = attemptDetail{n, d}
+		return
+	}
+	tails := limit - heads
+	if tails == 0 {
+		return
+	}
+	if op.tail == nil {
+		op.tail = make([]attemptDetail, tails)
+	}
+	// The ring keeps the attempts with the highest numbers, whichever
+	// order they finish in
+	slot := &op.tail[(n-heads-1)%tails]
+	if n > slot.n {
+		*slot = attemptDetail{n, d}
+	}
+}
+
+// Done ends the operation, logging its summary as a span named after the
+// operation with " summary" appended, tagged with its id, the attempts
+// which finished, the time they took in all, whether the last of them
+// succeeded ("ok") or failed ("failed", the summary failing with its
+// error, and "none" if no attempt finished) and how long each took, as in
+//
+//	{op_id=7 attempts=4 elapsed=45ms status=ok durations=[10ms 12ms 8ms 15ms]}
+//
+// Past "MaxAttemptDetail" attempts, the durations are those of the first
+// and of the last attempts, the tags "elided" and "elided_time" counting
+// those in between. Attempts which finish after it are left out. Only the
+// first call has any effect.
+func (op *Operation) Done() {
+	if op.t == nil || !atomic.CompareAndSwapUint32(&op.done, 0, 1) {
+		return
+	}
+	op.mu.Lock()
+	var details []attemptDetail
+	for _, detail := range append(append([]attemptDetail(nil), op.head...), op.tail...) {
+		if detail.n > 0 {
+			details = append(details, detail)
+		}
+	}
+	attempts, elapsed, err := op.finished, op.elapsed, op.lastErr
+	op.mu.Unlock()
+
+	// The ring of the last attempts starts anywhere
+	sort.Slice(details, func(i, j int) bool { return details[i].n < details[j].n })
+	durations := make([]time.Duration, len(details))
+	var kept time.Duration
+	for i, detail := range details {
+		durations[i] = detail.duration
+		kept += detail.duration
+	}
+
+	span := op.t.start(nil, "", op.t.namedSite(op.site.name+" summary"), "%s", "$FN")
+	span.Tag("op_id", op.id)
+	span.Tag("attempts", attempts)
+	span.Tag("elapsed", elapsed)
+	switch {
+	case attempts == 0:
+		span.Tag("status", "none")
+	case err != nil:
+		span.Tag("status", "failed")
+		span.SetError(err)
+	default:
+		span.Tag("status", "ok")
+	}
+	span.Tag("durations", durations)
+	if elided := attempts - len(durations); elided > 0 {
+		span.Tag("elided", elided)
+		span.Tag("elided_time", elapsed-kept)
+	}
+	span.End()
+}
@@ -0,0 +1,102 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperation(test *testing.T) {
+	var text, js bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &text}, {Writer: &js, Format: JSONFormat}}, Clock: clock.Now})
+	op := t.Operation("charge")
+	errDeclined := errors.New("declined")
+	for i, d := range []time.Duration{10 * time.Millisecond, 12 * time.Millisecond, 8 * time.Millisecond} {
+		finish := op.Attempt("charging %s", "card")
+		clock.advance(d)
+		if i < 2 {
+			finish(errDeclined)
+		} else {
+			finish(nil)
+		}
+		clock.advance(100 * time.Millisecond)
+	}
+	// Never finishes
+	op.Attempt("charging %s", "card")
+	op.Done()
+	op.Done()
+
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(text.String(), "=>")), "\n")
+	assert.Equal(test, []string{
+		"[ 0]ENTER: =>charging card",
+		"[ 0]EXIT:  =>charging card {attempt=1 op_id=1} (error: declined)",
+		"[ 0]ENTER: =>charging card",
+		"[ 0]EXIT:  =>charging card {attempt=2 op_id=1} (error: declined)",
+		"[ 0]ENTER: =>charging card",
+		"[ 0]EXIT:  =>charging card {attempt=3 op_id=1}",
+		"[ 0]ENTER: =>charging card",
+		"[ 1]  ENTER: =>charge summary",
+		"[ 1]  EXIT:  =>charge summary {op_id=1 attempts=3 elapsed=30ms status=ok durations=[10ms 12ms 8ms]}",
+	}, lines)
+
+	// Every span of the operation is linked to it by its id
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		if ev.Kind == ExitEvent {
+			for _, tag := range ev.Tags {
+				if tag.Key == "op_id" {
+					ids = append(ids, tag.Value.(string))
+				}
+			}
+		}
+	}
+	assert.Equal(test, []string{"1", "1", "1", "1"}, ids)
+}
+
+func TestOperationDetail(test *testing.T) {
+	var out bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, Clock: clock.Now, MaxAttemptDetail: 4})
+	op := t.Operation("fetch")
+	for i := 1; i <= 7; i++ {
+		finish := op.Attempt()
+		clock.advance(time.Duration(i) * time.Millisecond)
+		finish(errors.New("timeout"))
+	}
+	op.Done()
+
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(out.String(), "=>")), "\n")
+	assert.Equal(test, "[ 0]EXIT:  =>fetch summary {op_id=1 attempts=7 elapsed=28ms status=failed durations=[1ms 2ms 6ms 7ms] elided=3 elided_time=12ms} (error: timeout)", lines[len(lines)-1])
+}
+
+func TestOperationConcurrentAttempts(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}})
+	op := t.Operation("fan out")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			op.Attempt()(nil)
+		}()
+	}
+	wg.Wait()
+	op.Done()
+
+	text := out.String()
+	for _, n := range []string{"1", "10", "20"} {
+		assert.Contains(test, text, "{attempt="+n+" op_id=1}")
+	}
+	assert.Contains(test, text, "attempts=20 ")
+	assert.Equal(test, 1, strings.Count(text, "status=ok"))
+	assert.Contains(test, text, " elided=12 ")
+}
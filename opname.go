@@ -0,0 +1,133 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// The prefix of the patterns of "Budgets" and "FilterRules" which match
+// operations rather than function names
+const operationPrefix = "op:"
+
+// WithOperation makes the span it is passed to along with the message
+// arguments part of a logical operation, such as "send-email" for each of
+// the functions which send one, whichever "OperationMap" says, as in
+//
+//	defer tracer.Enter("%s", "$FN", tracey.WithOperation("send-email"))()
+//
+// The lines of the span end in "{op:send-email}", its events have
+// "Operation" set, and its calls are counted by operation as well as by
+// function, see `OperationStats(...)`. The patterns of "Budgets" and
+// "FilterRules" which start with "op:" match the operation.
+func WithOperation(name string) interface{} {
+	return operationArg{name}
+}
+
+type operationArg struct {
+	name string
+}
+
+// Splits the `WithOperation(...)` off of the arguments to an enter
+func splitOperation(s []interface{}) (string, []interface{}) {
+	for i, arg := range s {
+		if op, ok := arg.(operationArg); ok {
+			rest := append(append(make([]interface{}, 0, len(s)-1), s[:i]...), s[i+1:]...)
+			return op.name, rest
+		}
+	}
+	return "", s
+}
+
+// The "OperationMap" of a tracer, compiled, along with the operation found
+// for every function name so far ("" if none). Patterns are tried in
+// lexical order, the first match wins.
+type operationMap struct {
+	patterns []*regexp.Regexp
+	names    []string
+	byName   sync.Map
+}
+
+func compileOperationMap(sources map[string]string) (*operationMap, error) {
+	m := &operationMap{}
+	keys := make([]string, 0, len(sources))
+	for key := range sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pattern, err := regexp.Compile(key)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern in OperationMap: %v", err)
+		}
+		m.patterns = append(m.patterns, pattern)
+		m.names = append(m.names, sources[key])
+	}
+	return m, nil
+}
+
+func (m *operationMap) lookup(name string) string {
+	if found, ok := m.byName.Load(name); ok {
+		return found.(string)
+	}
+	var found string
+	for i, pattern := range m.patterns {
+		if pattern.MatchString(name) {
+			found = m.names[i]
+			break
+		}
+	}
+	m.byName.Store(name, found)
+	return found
+}
+
+// Returns the operation of a span of the function, the one it was given
+// if any, or else the one "OperationMap" gives the function
+func (t *Tracer) operationOf(given, name string) string {
+	if given != "" || t.operations == nil {
+		return given
+	}
+	return t.operations.lookup(name)
+}
+
+// Writes the operation of a span, as in " {op:send-email}"
+func renderOperation(buf *bytes.Buffer, ev *Event) {
+	buf.WriteString(" {op:")
+	buf.WriteString(ev.Operation)
+	buf.WriteByte('}')
+}
+
+// OperationStats returns the statistics of the calls which were part of
+// the operation, whichever function they were to, the way `Stats()` has
+// them for each function, and false if none was yet. "InFlight" and
+// "MaxConcurrent" are left at 0.
+func (t *Tracer) OperationStats(name string) (FuncStats, bool) {
+	for _, s := range t.collect(&t.stats.ops, nil) {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return FuncStats{}, false
+}
+
+// Writes the table of the operations for `DumpStats(...)`, if there are
+// any
+func (t *Tracer) dumpOperations(w io.Writer) error {
+	all := t.collect(&t.stats.ops, nil)
+	if len(all) == 0 {
+		return nil
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPERATION\tCALLS\tTOTAL\tMEAN\tFAILED")
+	for _, s := range all {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\n", s.Name, s.Calls, formatDuration(s.Total), formatDuration(s.Mean()), s.Failed)
+	}
+	return tw.Flush()
+}
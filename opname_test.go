@@ -0,0 +1,96 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperationStats(test *testing.T) {
+	var out, js lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:        []Sink{{Writer: &out}, {Writer: &js, Format: JSONFormat}},
+		Clock:        clock.Now,
+		OperationMap: map[string]string{`^mail\.(smtp|ses)$`: "send-email"},
+	})
+
+	call := func(name string, took time.Duration, s ...interface{}) {
+		span := t.StartNamed(name, append([]interface{}{"%s", "$FN"}, s...)...)
+		clock.advance(took)
+		span.End()
+	}
+	call("mail.smtp", time.Millisecond)
+	call("mail.ses", 2*time.Millisecond)
+	call("notify", 3*time.Millisecond, WithOperation("send-email"))
+	// The operation it is given wins over the map
+	call("mail.smtp", time.Millisecond, WithOperation("bulk-email"))
+	call("audit", time.Millisecond)
+
+	lines := strings.Split(RE_tidMarker.ReplaceAllString(out.String(), "=>"), "\n")
+	assert.Equal(test, "[ 0]ENTER: =>mail.smtp {op:send-email}", lines[0])
+	assert.Equal(test, "[ 0]EXIT:  =>notify {op:send-email}", lines[5])
+	assert.Equal(test, "[ 0]EXIT:  =>mail.smtp {op:bulk-email}", lines[7])
+	assert.Equal(test, "[ 0]EXIT:  =>audit", lines[9])
+
+	exits := exitsByName(test, &js)
+	assert.Equal(test, "send-email", exits["notify"].Operation)
+	assert.Equal(test, "", exits["audit"].Operation)
+
+	s, ok := t.OperationStats("send-email")
+	assert.True(test, ok)
+	assert.Equal(test, uint64(3), s.Calls)
+	assert.Equal(test, 6*time.Millisecond, s.Total)
+	assert.Equal(test, []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond}, s.Samples)
+	s, _ = t.OperationStats("bulk-email")
+	assert.Equal(test, uint64(1), s.Calls)
+	_, ok = t.OperationStats("audit")
+	assert.False(test, ok)
+
+	var dump bytes.Buffer
+	assert.Nil(test, t.DumpStats(&dump))
+	assert.Regexp(test, `(?m)^send-email +3 +6\.0ms +2\.0ms +0$`, dump.String())
+}
+
+func TestOperationBudgets(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{
+		Sinks:        []Sink{{Writer: &out}},
+		Clock:        (&manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}).Now,
+		OperationMap: map[string]string{`^mail\.`: "send-email"},
+		Budgets:      map[string]time.Duration{"op:^send-email$": 50 * time.Millisecond},
+	})
+	t.StartNamed("mail.smtp", "%s", "$FN").End()
+	t.StartNamed("notify", "%s", "$FN", WithOperation("send-email")).End()
+	t.StartNamed("audit", "%s", "$FN").End()
+
+	lines := strings.Split(RE_tidMarker.ReplaceAllString(out.String(), "=>"), "\n")
+	assert.Equal(test, "[ 0]ENTER: =>mail.smtp {op:send-email} [budget left 50ms]", lines[0])
+	assert.Equal(test, "[ 0]ENTER: =>notify {op:send-email} [budget left 50ms]", lines[2])
+	assert.Equal(test, "[ 0]ENTER: =>audit", lines[4])
+}
+
+func TestOperationFilterRules(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{
+		Sinks:        []Sink{{Writer: &out}},
+		OperationMap: map[string]string{`^mail\.`: "send-email"},
+		FilterRules: []FilterRule{
+			{Kind: MatchExact, Pattern: "mail.urgent", Action: Include},
+			{Kind: MatchExact, Pattern: "op:send-email", Action: Exclude},
+		},
+	})
+	t.StartNamed("mail.smtp", "%s", "$FN").End()
+	t.StartNamed("mail.urgent", "%s", "$FN").End()
+	t.StartNamed("notify", "%s", "$FN", WithOperation("send-email")).End()
+	t.StartNamed("notify", "%s", "$FN", WithOperation("page")).End()
+
+	// The first rule which matches wins, by name or by operation
+	assert.Equal(test, "[ 0]ENTER: =>mail.urgent {op:send-email}\n"+
+		"[ 0]EXIT:  =>mail.urgent {op:send-email}\n"+
+		"[ 0]ENTER: =>notify {op:page}\n"+
+		"[ 0]EXIT:  =>notify {op:page}\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+}
@@ -0,0 +1,40 @@
+package tracey
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// DefaultOutputVolumeMinLines is how many lines a span must have logged
+// for its EXIT line to show them, when "OutputVolumeMinLines" is 0.
+const DefaultOutputVolumeMinLines = 100
+
+// Charges the lines written for an event on the goroutine to every span
+// open on it, see "TrackOutputVolume"
+func (t *Tracer) countOutput(gid uint64, lines, bytes int) {
+	shard := t.goroutines.shard(gid)
+	shard.Lock()
+	defer shard.Unlock()
+	if record := shard.g[gid]; record != nil {
+		for _, s := range record.open {
+			atomic.AddUint64(&s.loggedLines, uint64(lines))
+			atomic.AddUint64(&s.loggedBytes, uint64(bytes))
+		}
+	}
+}
+
+// Notes on the exit event what the span logged, if it logged enough
+func (t *Tracer) exitOutputVolume(span *Span, ev *Event) {
+	min := t.options.OutputVolumeMinLines
+	if min <= 0 {
+		min = DefaultOutputVolumeMinLines
+	}
+	if lines := atomic.LoadUint64(&span.loggedLines); lines >= uint64(min) {
+		ev.LoggedLines, ev.LoggedBytes = lines, atomic.LoadUint64(&span.loggedBytes)
+	}
+}
+
+// Renders what a span logged, as in "[logged 214 lines / 18.0KB]"
+func formatOutputVolume(lines, bytes uint64) string {
+	return "[logged " + strconv.FormatUint(lines, 10) + " lines / " + formatBytes(bytes) + "]"
+}
@@ -0,0 +1,83 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper functions - part of "TestTrackOutputVolume"
+func volumeLeaf(t *Tracer) {
+	defer t.Enter("%s", "leaf")()
+	t.Event("chatty")
+}
+
+func volumeTree(t *Tracer) {
+	defer t.Enter("%s", "tree")()
+	volumeLeaf(t)
+	volumeLeaf(t)
+}
+
+func TestTrackOutputVolume(test *testing.T) {
+	var a, b bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                []Sink{{Writer: &a}, {Writer: &b, Format: JSONFormat}},
+		TrackOutputVolume:    true,
+		OutputVolumeMinLines: 4,
+		DisableDepthValue:    true,
+	})
+	volumeTree(t)
+
+	// Each leaf logs its ENTER and event lines, on both sinks
+	lines := strings.SplitAfter(a.String(), "\n")
+	jsLines := strings.SplitAfter(b.String(), "\n")
+	leafBytes := len(lines[1]) + len(lines[2]) + len(jsLines[1]) + len(jsLines[2])
+	assert.Contains(test, lines[3], "EXIT:  ")
+	assert.Contains(test, lines[3], " [logged 4 lines / "+formatBytes(uint64(leafBytes))+"]")
+
+	// The tree's count has both leaves in it, EXIT lines included, along
+	// with its own ENTER line
+	treeLines, treeBytes := 0, 0
+	for i := 0; i < 7; i++ {
+		treeLines += 2
+		treeBytes += len(lines[i]) + len(jsLines[i])
+	}
+	exit := lines[7]
+	assert.Contains(test, exit, "]=>tree")
+	assert.Contains(test, exit, " [logged 14 lines / "+formatBytes(uint64(treeBytes))+"]")
+
+	ev, err := UnmarshalEvent([]byte(jsLines[7]))
+	assert.Nil(test, err)
+	assert.Equal(test, uint64(treeLines), ev.LoggedLines)
+	assert.Equal(test, uint64(treeBytes), ev.LoggedBytes)
+
+	for _, s := range t.Stats() {
+		if strings.HasSuffix(s.Name, "volumeLeaf") {
+			assert.Equal(test, uint64(8), s.LoggedLines)
+			second := len(lines[4]) + len(lines[5]) + len(jsLines[4]) + len(jsLines[5])
+			assert.Equal(test, uint64(leafBytes+second), s.LoggedBytes)
+		}
+	}
+	var dump bytes.Buffer
+	assert.Nil(test, t.DumpStats(&dump))
+	assert.Contains(test, dump.String(), "LOGGED")
+	assert.Contains(test, dump.String(), "14 lines / ")
+}
+
+func TestTrackOutputVolumeFiltered(test *testing.T) {
+	var buf bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                []Sink{{Writer: &buf}},
+		TrackOutputVolume:    true,
+		OutputVolumeMinLines: 1,
+		MinLevel:             Info,
+	})
+	func() {
+		defer t.Infof("%s", "outer")()
+		// Below the level, so neither logged nor counted
+		t.Enter(Debug, "%s", "quiet")()
+	}()
+	assert.Contains(test, buf.String(), " [logged 1 lines / ")
+}
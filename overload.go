@@ -0,0 +1,138 @@
+package tracey
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// OverloadStats summarizes the shedding of "MaxTraceLatency".
+type OverloadStats struct {
+	// The events which were counted but not written out, and the trees
+	// they were shed from
+	Shed  uint64
+	Trees uint64
+
+	// The longest a single enter or exit took
+	Worst time.Duration
+}
+
+// The bookkeeping of "MaxTraceLatency"
+type overload struct {
+	// The lines the "Async" sinks dropped as their queues were full
+	overflows uint64
+
+	shed  uint64
+	trees uint64
+	worst int64
+}
+
+// OverloadStats returns how much "MaxTraceLatency" shed so far, and the
+// worst latency it observed. It is all zeros unless the option is set.
+func (t *Tracer) OverloadStats() OverloadStats {
+	return OverloadStats{
+		Shed:  atomic.LoadUint64(&t.overload.shed),
+		Trees: atomic.LoadUint64(&t.overload.trees),
+		Worst: time.Duration(atomic.LoadInt64(&t.overload.worst)),
+	}
+}
+
+// Builds ahead of time what the first spans would otherwise build, so
+// that they do not take longer than "MaxTraceLatency" allows
+func (t *Tracer) prewarm() {
+	bufs := make([]*bytes.Buffer, runtime.GOMAXPROCS(0))
+	for i := range bufs {
+		bufs[i] = getBuffer()
+		bufs[i].Grow(512)
+	}
+	for _, buf := range bufs {
+		putBuffer(buf)
+	}
+	// Regexes build their matching machines on first use
+	config := t.config.Load()
+	if config.templates != nil {
+		for _, pattern := range config.templates.patterns {
+			pattern.MatchString("")
+		}
+	}
+	if config.suppress != nil {
+		for _, pattern := range config.suppress.patterns {
+			pattern.MatchString("")
+		}
+	}
+	RE_detectFN.ReplaceAllString("", "")
+	RE_stripFnPreamble.MatchString("")
+	getGID()
+}
+
+// Returns when an enter or exit started, and how many lines the "Async"
+// sinks had dropped by then
+func (t *Tracer) overloadStart() (time.Time, uint64) {
+	return time.Now(), atomic.LoadUint64(&t.overload.overflows)
+}
+
+// Measures an enter or exit of the span against "MaxTraceLatency", and
+// sheds the rest of the span's tree should it have taken longer or should
+// an "Async" sink have dropped lines meanwhile. The exit of the outermost
+// span of a tree ends the shedding, and logs how much was shed.
+func (t *Tracer) overloadEnd(s *Span, began time.Time, overflows uint64, exiting bool) {
+	elapsed := time.Since(began)
+	for {
+		worst := atomic.LoadInt64(&t.overload.worst)
+		if int64(elapsed) <= worst || atomic.CompareAndSwapInt64(&t.overload.worst, worst, int64(elapsed)) {
+			break
+		}
+	}
+	record := s.record
+	if record == nil {
+		return
+	}
+	if elapsed > t.options.MaxTraceLatency || atomic.LoadUint64(&t.overload.overflows) != overflows {
+		atomic.StoreUint32(&record.shedding, 1)
+	}
+	if exiting {
+		t.endShedding(s)
+	}
+}
+
+// Returns true if the span's tree is being shed, counting the event which
+// is not written out
+func (t *Tracer) shedding(s *Span) bool {
+	if t.options.MaxTraceLatency <= 0 || s.record == nil || atomic.LoadUint32(&s.record.shedding) == 0 {
+		return false
+	}
+	atomic.AddUint64(&s.record.shed, 1)
+	return true
+}
+
+// Stops shedding once the outermost span of the tree has exited, and logs
+// how many events were shed, as in "[ 0](shed 12 events due to overload)"
+func (t *Tracer) endShedding(s *Span) {
+	record := s.record
+	shard := t.goroutines.shard(s.ev.TID)
+	shard.Lock()
+	if len(record.open) > 0 || atomic.LoadUint32(&record.shedding) == 0 {
+		shard.Unlock()
+		return
+	}
+	atomic.StoreUint32(&record.shedding, 0)
+	shed := atomic.SwapUint64(&record.shed, 0)
+	shard.Unlock()
+
+	if shed == 0 {
+		return
+	}
+	atomic.AddUint64(&t.overload.shed, shed)
+	atomic.AddUint64(&t.overload.trees, 1)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	t.renderIndent(buf, s.ev.Depth)
+	events := " events"
+	if shed == 1 {
+		events = " event"
+	}
+	buf.WriteString("(shed " + strconv.FormatUint(shed, 10) + events + " due to overload)\n")
+	t.note(buf.String())
+}
@@ -0,0 +1,73 @@
+package tracey
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxTraceLatency(test *testing.T) {
+	out := &slowWriter{}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: out}}, MaxTraceLatency: 5 * time.Millisecond})
+
+	// Within bounds, nothing is shed
+	t.Enter("%s", "fast")()
+	assert.Zero(test, t.OverloadStats().Shed)
+
+	// The slow sink delays the first enter, after which the rest of the
+	// tree takes no time
+	var shedding time.Duration
+	func() {
+		out.delay = 20 * time.Millisecond
+		defer t.Enter("%s", "root")()
+		began := time.Now()
+		for i := 0; i < 50; i++ {
+			func() {
+				defer t.Enter("%s", "child")()
+				t.Event("halfway")
+			}()
+		}
+		shedding = time.Since(began)
+	}()
+	out.delay = 0
+	assert.Less(test, int64(shedding), int64(50*20*time.Millisecond/10))
+
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(out.String(), "=>")), "\n")
+	assert.Equal(test, []string{
+		"[ 0]ENTER: =>fast",
+		"[ 0]EXIT:  =>fast",
+		"[ 0]ENTER: =>root",
+		"[ 0](shed 151 events due to overload)",
+	}, lines)
+	stats := t.OverloadStats()
+	assert.Equal(test, uint64(151), stats.Shed)
+	assert.Equal(test, uint64(1), stats.Trees)
+	assert.GreaterOrEqual(test, int64(stats.Worst), int64(20*time.Millisecond))
+	calls := uint64(0)
+	for _, s := range t.Stats() {
+		calls += s.Calls
+	}
+	assert.Equal(test, uint64(52), calls)
+
+	// The next tree is written out again
+	t.Enter("%s", "after")()
+	assert.Contains(test, RE_tidMarker.ReplaceAllString(out.String(), "=>"), "EXIT:  =>after")
+}
+
+func TestMaxTraceLatencyAsyncOverflow(test *testing.T) {
+	var out, async lockedBuffer
+	t := NewTracer(&Options{
+		Sinks:           []Sink{{Writer: &out}, {Writer: &async, Async: true, AsyncBufferBytes: 1}},
+		MaxTraceLatency: time.Hour,
+	})
+	func() {
+		defer t.Enter("%s", "root")()
+		t.Enter("%s", "child")()
+	}()
+	t.Flush()
+	assert.Equal(test, "[ 0]ENTER: =>root\n"+
+		"[ 0](shed 3 events due to overload)\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	assert.Equal(test, uint64(3), t.OverloadStats().Shed)
+}
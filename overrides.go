@@ -0,0 +1,163 @@
+package tracey
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// OptionOverrides change some of a tracer's options for the spans opened
+// within a region of code, see `Tracer.WithOverrides(...)`. Fields left
+// nil keep the setting in effect around the region.
+type OptionOverrides struct {
+	// Replaces the tracer's "MinLevel"
+	MinLevel *Level
+
+	// Replaces the "MinDuration" of every sink
+	MinDuration *time.Duration
+
+	// Replaces "EnableInstrumentation"
+	EnableInstrumentation *bool
+
+	// Replaces "CaptureCallers", for spans at any depth
+	CaptureCallers *int
+}
+
+// Returns the overrides of "o" on top of those of "outer" (which may be
+// nil)
+func (o OptionOverrides) over(outer *OptionOverrides) *OptionOverrides {
+	if outer != nil {
+		if o.MinLevel == nil {
+			o.MinLevel = outer.MinLevel
+		}
+		if o.MinDuration == nil {
+			o.MinDuration = outer.MinDuration
+		}
+		if o.EnableInstrumentation == nil {
+			o.EnableInstrumentation = outer.EnableInstrumentation
+		}
+		if o.CaptureCallers == nil {
+			o.CaptureCallers = outer.CaptureCallers
+		}
+	}
+	return &o
+}
+
+// A set of overrides pushed on a goroutine, along with those of the
+// frames below it
+type overrideFrame struct {
+	effective *OptionOverrides
+}
+
+// WithOverrides changes some of the tracer's options for the spans opened
+// on the calling goroutine, until the returned function is called, as in
+//
+//	defer tracer.WithOverrides(tracey.OptionOverrides{MinLevel: &level})()
+//
+// Overrides nest, and carry over to the goroutines of a `Group()` started
+// within them. Popping them out of order logs a warning, and pops the
+// frames pushed since as well. Other goroutines are not affected.
+func (t *Tracer) WithOverrides(o OptionOverrides) func() {
+	if t.options.DisableTracing {
+		return func() {}
+	}
+	atomic.StoreUint32(&t.overridden, 1)
+	gid := getGID()
+	frame := t.goroutines.push(gid, o)
+	if t.options.GoroutineStateTTL > 0 {
+		t.scanner.start(t)
+	}
+	return func() {
+		if !t.goroutines.pop(gid, frame) {
+			warning := "Warning: option overrides popped out of order in tracey.\n"
+			if t.admitOutput(len(warning)) {
+				t.note(warning)
+			}
+		}
+	}
+}
+
+// Verbose logs everything about the spans opened on the calling goroutine
+// until the returned function is called, regardless of "MinLevel" and of
+// the sinks' "MinDuration", and with their durations. See
+// `WithOverrides(...)`.
+func (t *Tracer) Verbose() func() {
+	level, minDuration, instrument := Trace, time.Duration(0), true
+	return t.WithOverrides(OptionOverrides{
+		MinLevel:              &level,
+		MinDuration:           &minDuration,
+		EnableInstrumentation: &instrument,
+	})
+}
+
+// Returns the overrides in effect for a span about to be opened on the
+// goroutine, "parent" being the span of another goroutine it is started
+// within
+func (t *Tracer) overridesFor(gid uint64, parent *Span) *OptionOverrides {
+	if atomic.LoadUint32(&t.overridden) == 0 {
+		return nil
+	}
+	return t.goroutines.overrides(gid, parent)
+}
+
+func (g *goroutines) push(gid uint64, o OptionOverrides) *overrideFrame {
+	shard := g.shard(gid)
+	shard.Lock()
+	defer shard.Unlock()
+	record := shard.g[gid]
+	if record == nil {
+		record = &goroutineRecord{}
+		shard.g[gid] = record
+	}
+	frame := &overrideFrame{o.over(record.current())}
+	record.frames = append(record.frames, frame)
+	return frame
+}
+
+// Pops the frame, and those pushed after it. Returns false if there were
+// any of those.
+func (g *goroutines) pop(gid uint64, frame *overrideFrame) bool {
+	shard := g.shard(gid)
+	shard.Lock()
+	defer shard.Unlock()
+	record := shard.g[gid]
+	if record == nil {
+		return true
+	}
+	for i := len(record.frames) - 1; i >= 0; i-- {
+		if record.frames[i] == frame {
+			inOrder := i == len(record.frames)-1
+			for j := i; j < len(record.frames); j++ {
+				record.frames[j] = nil
+			}
+			record.frames = record.frames[:i]
+			g.release(shard, gid, record)
+			return inOrder
+		}
+	}
+	return true
+}
+
+func (g *goroutines) overrides(gid uint64, parent *Span) *OptionOverrides {
+	if parent != nil && parent.logical {
+		return parent.ev.overrides
+	}
+	shard := g.shard(gid)
+	shard.Lock()
+	defer shard.Unlock()
+	if record := shard.g[gid]; record != nil && (len(record.frames) > 0 || len(record.open) > 0 || record.depth > 0) {
+		return record.current()
+	}
+	if parent != nil {
+		return parent.ev.overrides
+	}
+	return nil
+}
+
+// The overrides in effect on the goroutine. Must be called with the lock
+// held.
+func (r *goroutineRecord) current() *OptionOverrides {
+	if len(r.frames) > 0 {
+		return r.frames[len(r.frames)-1].effective
+	}
+	return r.inherited
+}
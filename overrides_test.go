@@ -0,0 +1,99 @@
+package tracey
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerboseRegion(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{
+		Sinks:             []Sink{{Logger: BufLogger, MinDuration: time.Hour}},
+		DisableDepthValue: true,
+		MinLevel:          Info,
+		Clock:             fakeClock(time.Millisecond),
+	})
+	t.Start("%s", "hidden").End()
+	func() {
+		defer t.Verbose()()
+		t.Start("%s", "fast").End()
+		t.Debugf("%s", "debug")()
+	}()
+	t.Start("%s", "hidden again").End()
+
+	assert.Equal(test, `
+ENTER: =>fast
+EXIT:  =>fast ... in 1ms
+ENTER: DBG =>debug
+EXIT:  DBG =>debug ... in 1ms
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+	assert.Equal(test, 0, t.goroutineCount())
+}
+
+func TestOverridesNest(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, DisableDepthValue: true, MinLevel: Info})
+	debug, trace := Debug, Trace
+	popOuter := t.WithOverrides(OptionOverrides{MinLevel: &debug})
+	popInner := t.WithOverrides(OptionOverrides{MinLevel: &trace})
+	t.Start("%s", "inner").End()
+	popInner()
+	t.Start("%s", "outer").End()
+	t.Debugf("%s", "outer debug")()
+
+	// Out of order pops take the inner frames along
+	popInner = t.WithOverrides(OptionOverrides{MinLevel: &trace})
+	popOuter()
+	popInner()
+	t.Debugf("%s", "none")()
+
+	assert.Equal(test, `
+ENTER: =>inner
+EXIT:  =>inner
+ENTER: DBG =>outer debug
+EXIT:  DBG =>outer debug
+Warning: option overrides popped out of order in tracey.
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+	assert.Equal(test, 0, t.goroutineCount())
+}
+
+func TestOverridesInGroups(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Logger: BufLogger, MinDuration: time.Hour}}})
+	ResetTestBuffer()
+	func() {
+		defer t.Verbose()()
+		g := t.Group()
+		g.Go("task", func() error {
+			t.Start("%s", "in task").End()
+			return nil
+		})
+		g.Wait()
+	}()
+	assert.Equal(test, 2, strings.Count(GetTestBuffer(), "]=>in task"))
+
+	// Other goroutines are not affected
+	ResetTestBuffer()
+	defer t.Verbose()()
+	done := make(chan struct{})
+	go func() {
+		t.Start("%s", "elsewhere").End()
+		close(done)
+	}()
+	<-done
+	assert.Equal(test, "\n", GetTestBuffer())
+}
+
+// The number of goroutines the tracer keeps a record of
+func (t *Tracer) goroutineCount() int {
+	n := 0
+	for i := range t.goroutines.shards {
+		shard := &t.goroutines.shards[i]
+		shard.Lock()
+		n += len(shard.g)
+		shard.Unlock()
+	}
+	return n
+}
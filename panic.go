@@ -0,0 +1,91 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// PanicErrorClass is the error class the calls which panicked are counted
+// in, see `Tracer.ErrorBreakdown(...)`. It is reserved: panics are counted
+// in it whatever "ErrorClassifier" and the registered classes say.
+const PanicErrorClass = "panic"
+
+// How many frames of the stack of a panic are kept at most
+const panicStackFrames = 32
+
+// A Frame is a frame of the stack of a panic, see "PanicStack".
+type Frame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+// Describes the frame in short, as in "cache.go:88 (evict)"
+func (f Frame) String() string {
+	function := f.Function[strings.LastIndexByte(f.Function, '/')+1:]
+	if i := strings.IndexByte(function, '.'); i >= 0 {
+		function = function[i+1:]
+	}
+	return path.Base(f.File) + ":" + strconv.Itoa(f.Line) + " (" + function + ")"
+}
+
+// Records the panic the call is unwinding from on its span, which fails
+// with it. Must be called from the function deferred by the call.
+func (s *Span) recordPanic(r interface{}) {
+	s.SetError(fmt.Errorf("panicked: %v", r))
+	if s.t == nil {
+		return
+	}
+	value := fmt.Sprint(r)
+	if err, ok := r.(error); ok {
+		value = err.Error()
+	}
+	s.ev.PanicValue = s.t.capMessage(value)
+	s.ev.PanicType = fmt.Sprintf("%T", r)
+	s.ev.PanicStack = panicStack(3)
+}
+
+// Returns the frames between the line which panicked and the traced
+// function, innermost first. A panic raised again on the way by the
+// deferred functions of other calls is traced back to where it started,
+// on the stack further down, and the frames of tracey and of the runtime
+// are left out.
+func panicStack(skip int) []Frame {
+	var pcs [64]uintptr
+	n := runtime.Callers(skip, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	var stack []Frame
+	for {
+		frame, more := frames.Next()
+		switch {
+		case frame.Function == "runtime.gopanic":
+			// Where a panic (or a panic raised again) was raised from
+			stack = stack[:0]
+		case isInternalFrame(frame):
+			if !strings.HasPrefix(frame.Function, "runtime.") && len(stack) > 0 {
+				// Reached the traced function's own call
+				return stack
+			}
+		case len(stack) < panicStackFrames:
+			stack = append(stack, Frame{frame.Function, frame.File, frame.Line})
+		}
+		if !more {
+			return stack
+		}
+	}
+}
+
+// Writes where a panic started, from the two innermost frames of its
+// stack, as in "panic at cache.go:88 (evict) ← cache.go:40 (Get)"
+func renderPanicOrigin(buf *bytes.Buffer, stack []Frame) {
+	buf.WriteString("panic at ")
+	buf.WriteString(stack[0].String())
+	if len(stack) > 1 {
+		buf.WriteString(" ← ")
+		buf.WriteString(stack[1].String())
+	}
+}
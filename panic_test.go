@@ -0,0 +1,103 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type evictionPanic struct {
+	Key  string
+	Size int
+}
+
+// Panics a couple of frames below the traced function
+func evict(v interface{}) { panic(v) }
+func makeRoom(v interface{}) {
+	evict(v)
+}
+
+func TestPanicCapture(test *testing.T) {
+	var text, js bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &text}, {Writer: &js, Format: JSONFormat}}})
+	errFull := errors.New("cache full")
+	for _, v := range []interface{}{errFull, "no room", evictionPanic{"users/7", 3}} {
+		assert.PanicsWithValue(test, v, func() {
+			Call1(t, "store", func() int {
+				makeRoom(v)
+				return 0
+			})
+		})
+	}
+
+	var exits []string
+	for _, line := range strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(text.String(), "=>")), "\n") {
+		if strings.Contains(line, "EXIT") {
+			exits = append(exits, line)
+		}
+	}
+	origin := " panic at panic_test.go:18 (evict) ← panic_test.go:20 (makeRoom)"
+	assert.Equal(test, []string{
+		"[ 0]EXIT:  =>store (error: panicked: cache full)" + origin,
+		"[ 0]EXIT:  =>store (error: panicked: no room)" + origin,
+		"[ 0]EXIT:  =>store (error: panicked: {users/7 3})" + origin,
+	}, exits)
+
+	var events []Event
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		if ev.Kind == ExitEvent {
+			events = append(events, ev)
+		}
+	}
+	assert.Equal(test, []string{"*errors.errorString", "string", "tracey.evictionPanic"},
+		[]string{events[0].PanicType, events[1].PanicType, events[2].PanicType})
+	assert.Equal(test, []string{"cache full", "no room", "{users/7 3}"},
+		[]string{events[0].PanicValue, events[1].PanicValue, events[2].PanicValue})
+
+	// From the line which panicked up to the traced function, with
+	// neither the runtime's frames nor tracey's
+	stack := events[2].PanicStack
+	assert.Len(test, stack, 3)
+	assert.Equal(test, Frame{"github.com/sujitvp/go-tracey.evict", stack[0].File, 18}, stack[0])
+	assert.True(test, strings.HasSuffix(stack[0].File, "/panic_test.go"))
+	assert.Equal(test, "github.com/sujitvp/go-tracey.makeRoom", stack[1].Function)
+	assert.Equal(test, "github.com/sujitvp/go-tracey.TestPanicCapture.func1.1", stack[2].Function)
+
+	stats := t.Stats()
+	assert.Equal(test, uint64(3), stats[0].Failed)
+	assert.Equal(test, uint64(3), stats[0].Panics)
+	assert.Equal(test, map[string]ErrorClassStats{PanicErrorClass: {3, "panicked: cache full"}}, t.ErrorBreakdown("store"))
+}
+
+func TestPanicCaptureNested(test *testing.T) {
+	var out bytes.Buffer
+	RegisterErrorClass("full", (*fullError)(nil))
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}})
+	value := &fullError{}
+	assert.PanicsWithValue(test, value, func() {
+		Call1(t, "outer", func() int {
+			return Call1(t, "inner", func() int {
+				evict(value)
+				return 0
+			})
+		})
+	})
+
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(out.String(), "=>")), "\n")
+	// Both trace the panic back to where it started
+	assert.Equal(test, "[ 1]  EXIT:  =>inner (error: panicked: full) panic at panic_test.go:18 (evict) ← panic_test.go:85 (TestPanicCaptureNested.func1.1.1)", lines[2])
+	assert.Equal(test, "[ 0]EXIT:  =>outer (error: panicked: full) panic at panic_test.go:18 (evict) ← panic_test.go:85 (TestPanicCaptureNested.func1.1.1)", lines[3])
+	for _, s := range t.Stats() {
+		assert.Equal(test, uint64(1), s.Panics)
+	}
+	assert.Equal(test, map[string]ErrorClassStats{PanicErrorClass: {1, "panicked: full"}}, t.ErrorBreakdown("inner"))
+}
+
+type fullError struct{}
+
+func (*fullError) Error() string { return "full" }
@@ -0,0 +1,129 @@
+package tracey
+
+import (
+	"bytes"
+	"sort"
+)
+
+// A span whose share of the top-level span is being worked out, see
+// "PercentOfRoot"
+type percentNode struct {
+	exit     *Event
+	children []*percentNode
+}
+
+// Sets the share of the top-level span on the exit events of a completed
+// tree, "root" being the top-level exit. The shares of the children of a
+// span are rounded by largest remainder, to add up to what their exact
+// shares do, and never to more than the share of the span itself, so that
+// the lines of a tree never add up to more than 100%.
+func percentOfRoot(events []Event, root *Event) {
+	nodes := make(map[string]*percentNode)
+	for i := range events {
+		if ev := &events[i]; ev.Kind == ExitEvent {
+			nodes[ev.SpanID] = &percentNode{exit: ev}
+		}
+	}
+	top := nodes[root.SpanID]
+	if top == nil {
+		return
+	}
+	var orphans []*percentNode
+	for i := range events {
+		ev := &events[i]
+		if ev.Kind != ExitEvent || ev == top.exit {
+			continue
+		}
+		node := nodes[ev.SpanID]
+		if parent := nodes[ev.ParentID]; parent != nil {
+			parent.children = append(parent.children, node)
+		} else {
+			orphans = append(orphans, node)
+		}
+	}
+
+	duration := float64(top.exit.Duration)
+	share := func(node *percentNode) float64 {
+		if duration <= 0 {
+			return 0
+		}
+		return 100 * float64(node.exit.Duration) / duration
+	}
+	var assign func(node *percentNode, percent int)
+	assign = func(node *percentNode, percent int) {
+		node.exit.Percent, node.exit.HasPercent = percent, true
+		if len(node.children) == 0 {
+			return
+		}
+		exact := make([]float64, len(node.children))
+		shown := make([]int, len(node.children))
+		sum, floors := 0.0, 0
+		for i, child := range node.children {
+			exact[i] = share(child)
+			shown[i] = int(exact[i])
+			sum += exact[i]
+			floors += shown[i]
+		}
+		target := int(sum + 0.5)
+		if target > percent {
+			target = percent
+		}
+		order := make([]int, len(node.children))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return exact[order[a]]-float64(shown[order[a]]) > exact[order[b]]-float64(shown[order[b]])
+		})
+		for i := 0; floors < target && i < len(order); i++ {
+			shown[order[i]]++
+			floors++
+		}
+		// Children which took longer than the span, the clock having gone
+		// back, give up the difference starting from the smallest
+		// remainders
+		for i := len(order) - 1; floors > target; i-- {
+			if i < 0 {
+				i = len(order) - 1
+			}
+			if shown[order[i]] > 0 {
+				shown[order[i]]--
+				floors--
+			}
+		}
+		for i, child := range node.children {
+			assign(child, shown[i])
+		}
+	}
+	assign(top, 100)
+
+	// Spans whose parent was not logged, such as for being below
+	// "MinLevel", are rounded on their own
+	for _, node := range orphans {
+		percent := int(share(node) + 0.5)
+		if percent > 100 {
+			percent = 100
+		}
+		assign(node, percent)
+	}
+}
+
+// Notes on the top-level exit of a tree that it overflowed its buffer and
+// so has no shares, see "PercentOfRoot"
+func (t *Tracer) omitPercents(span *Span, ev *Event) {
+	tree := ev.tail
+	if span.tailRoot && (tree.streaming || len(tree.events) >= t.tailLimit()) {
+		ev.PercentOmitted = true
+	}
+}
+
+// Renders the share of the top-level span, as in " (34% of root)"
+func renderPercent(buf *bytes.Buffer, ev *Event) {
+	if ev.PercentOmitted {
+		buf.WriteString(" (no % of root, tree over its buffer)")
+		return
+	}
+	buf.WriteString(" (")
+	writeInt(buf, int64(ev.Percent))
+	buf.WriteString("% of root)")
+}
@@ -0,0 +1,122 @@
+package tracey
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentOfRoot(test *testing.T) {
+	var out, js lockedBuffer
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &manualClock{now: start}
+	t := NewTracer(&Options{
+		Sinks:          []Sink{{Writer: &out}, {Writer: &js, Format: JSONFormat}},
+		Clock:          clock.Now,
+		PercentOfRoot:  true,
+		TimelineBuffer: 100,
+	})
+	call := func(name string, d time.Duration, inner func()) {
+		defer t.Enter("%s", name)()
+		if inner != nil {
+			inner()
+		}
+		clock.advance(d)
+	}
+	call("root", 0, func() {
+		// Thirds of the root, and sixths within the first of them
+		call("a", 0, func() {
+			call("a1", 50*time.Millisecond, nil)
+			call("a2", 50*time.Millisecond, nil)
+		})
+		call("b", 100*time.Millisecond, nil)
+		call("c", 100*time.Millisecond, nil)
+		assert.Equal(test, "", out.String(), "written before the tree completed")
+	})
+
+	assert.Equal(test, "[ 0]ENTER: =>root\n"+
+		"[ 1]  ENTER: =>a\n"+
+		"[ 2]    ENTER: =>a1\n"+
+		"[ 2]    EXIT:  =>a1 (17% of root)\n"+
+		"[ 2]    ENTER: =>a2\n"+
+		"[ 2]    EXIT:  =>a2 (16% of root)\n"+
+		"[ 1]  EXIT:  =>a (34% of root)\n"+
+		"[ 1]  ENTER: =>b\n"+
+		"[ 1]  EXIT:  =>b (33% of root)\n"+
+		"[ 1]  ENTER: =>c\n"+
+		"[ 1]  EXIT:  =>c (33% of root)\n"+
+		"[ 0]EXIT:  =>root (100% of root)\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+
+	exits := exitsByMessage(test, js.String())
+	assert.Equal(test, 34, exits["a"].Percent)
+	assert.True(test, exits["a"].HasPercent)
+	assert.Equal(test, 100, exits["root"].Percent)
+
+	trees, _ := t.TreesBetween(start, clock.now)
+	assert.Len(test, trees, 1)
+	assert.Equal(test, 100, trees[0].Exit.Percent)
+	assert.Equal(test, 17, trees[0].Children[0].Children[0].Exit.Percent)
+}
+
+func TestPercentOfRootRounding(test *testing.T) {
+	root := Event{Kind: ExitEvent, SpanID: "r", Duration: 1000}
+	events := []Event{root}
+	// Each 14.5% of the root, which rounding each up would take to 101%
+	for _, id := range []string{"1", "2", "3", "4", "5", "6"} {
+		events = append(events, Event{Kind: ExitEvent, SpanID: id, ParentID: "r", Duration: 145})
+	}
+	events = append(events, Event{Kind: ExitEvent, SpanID: "7", ParentID: "r", Duration: 130})
+	percentOfRoot(events, &root)
+	sum := 0
+	var shown []int
+	for _, ev := range events[1:] {
+		assert.True(test, ev.HasPercent)
+		shown = append(shown, ev.Percent)
+		sum += ev.Percent
+	}
+	assert.Equal(test, []int{15, 15, 15, 14, 14, 14, 13}, shown)
+	assert.Equal(test, 100, sum)
+
+	// Children which took longer than their parent are capped at its share
+	events = []Event{
+		{Kind: ExitEvent, SpanID: "r", Duration: 100},
+		{Kind: ExitEvent, SpanID: "p", ParentID: "r", Duration: 10},
+		{Kind: ExitEvent, SpanID: "c1", ParentID: "p", Duration: 8},
+		{Kind: ExitEvent, SpanID: "c2", ParentID: "p", Duration: 8},
+	}
+	percentOfRoot(events, &events[0])
+	assert.Equal(test, 10, events[1].Percent)
+	assert.Equal(test, 10, events[2].Percent+events[3].Percent)
+}
+
+func TestPercentOfRootOverflow(test *testing.T) {
+	var out, js lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:           []Sink{{Writer: &out}, {Writer: &js, Format: JSONFormat}},
+		Clock:           clock.Now,
+		PercentOfRoot:   true,
+		TailBufferLines: 3,
+	})
+	func() {
+		defer t.Enter("%s", "root")()
+		for i := 0; i < 2; i++ {
+			t.Start("%s", "child").End()
+		}
+	}()
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(out.String(), "=>")), "\n")
+	assert.Equal(test, "[ 0]EXIT:  =>root (no % of root, tree over its buffer)", lines[len(lines)-1])
+	assert.NotContains(test, out.String(), "% of root)")
+	// Leaving out the overflow's note
+	var events []string
+	for _, line := range strings.Split(js.String(), "\n") {
+		if !strings.Contains(line, `"kind":"note"`) {
+			events = append(events, line)
+		}
+	}
+	exits := exitsByMessage(test, strings.Join(events, "\n"))
+	assert.True(test, exits["root"].PercentOmitted)
+	assert.False(test, exits["child"].HasPercent)
+}
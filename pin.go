@@ -0,0 +1,179 @@
+package tracey
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxPins is how many trace ids are pinned at most, unless
+// "MaxPins" says otherwise.
+const DefaultMaxPins = 32
+
+// A PinInfo describes a pinned trace id, see `Tracer.Pin(...)`.
+type PinInfo struct {
+	TraceID string
+	Pinned  time.Time
+
+	// When the pin expires, zero if it does not
+	Expires time.Time
+
+	// How many top-level call trees it pinned so far
+	Trees uint64
+}
+
+// The trace ids pinned, see `Pin(...)`
+type pins struct {
+	mu   sync.Mutex
+	byID map[string]*pin
+	seq  uint64
+
+	// How many trace ids are pinned plus how many pinned trees are open,
+	// so that enters only look any further while it is not 0
+	active int64
+}
+
+type pin struct {
+	PinInfo
+	seq uint64
+}
+
+// The overrides of the spans of pinned trees, which are logged whatever
+// "MinLevel" and the "MinDuration" of the sinks would decide
+var pinnedOverrides = func() OptionOverrides {
+	level, minDuration := Trace, time.Duration(0)
+	return OptionOverrides{MinLevel: &level, MinDuration: &minDuration}
+}()
+
+// Pin has the next top-level call trees of the trace fully traced, for
+// "ttl" (until `Unpin(...)` if 0), as when a request which misbehaves is
+// reported by its trace id. A pinned tree is logged whatever "MinLevel",
+// "FilterRules", "SuppressSubtrees", the "MinDuration" of the sinks or
+// "TailSampling" would decide, its lines marked "[pinned]", and with
+// "BundlePinned" set, is bundled as if it failed. Only top-level spans
+// carrying the trace id from elsewhere are looked up, those entered under
+// a remote parent (see `StartRemote(...)`) or a restored one (see
+// `Restore(...)`). Pinning the trace id again renews the pin. At most
+// "MaxPins" trace ids are pinned at once (`DefaultMaxPins` if 0), the
+// oldest being unpinned for new ones. Pins last for the life of the
+// tracer, `Update(...)` included.
+func (t *Tracer) Pin(traceID string, ttl time.Duration) {
+	if traceID == "" {
+		return
+	}
+	now := t.options.Clock()
+	p := &t.pins
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(now)
+	found := p.byID[traceID]
+	if found == nil {
+		max := t.options.MaxPins
+		if max <= 0 {
+			max = DefaultMaxPins
+		}
+		for len(p.byID) >= max {
+			p.evictOldest()
+		}
+		if p.byID == nil {
+			p.byID = make(map[string]*pin)
+		}
+		found = &pin{PinInfo: PinInfo{TraceID: traceID}}
+		p.byID[traceID] = found
+		atomic.AddInt64(&p.active, 1)
+	}
+	p.seq++
+	found.seq, found.Pinned, found.Expires = p.seq, now, time.Time{}
+	if ttl > 0 {
+		found.Expires = now.Add(ttl)
+	}
+}
+
+// Unpin unpins the trace id, whose trees open at the time stay pinned.
+func (t *Tracer) Unpin(traceID string) {
+	p := &t.pins
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remove(traceID)
+}
+
+// Pins returns the trace ids pinned, the oldest first.
+func (t *Tracer) Pins() []PinInfo {
+	p := &t.pins
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(t.options.Clock())
+	all := make([]*pin, 0, len(p.byID))
+	for _, found := range p.byID {
+		all = append(all, found)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].seq < all[j].seq })
+	infos := make([]PinInfo, len(all))
+	for i, found := range all {
+		infos[i] = found.PinInfo
+	}
+	return infos
+}
+
+func (p *pins) remove(traceID string) {
+	if _, ok := p.byID[traceID]; ok {
+		delete(p.byID, traceID)
+		atomic.AddInt64(&p.active, -1)
+	}
+}
+
+func (p *pins) evictOldest() {
+	var oldest *pin
+	for _, found := range p.byID {
+		if oldest == nil || found.seq < oldest.seq {
+			oldest = found
+		}
+	}
+	p.remove(oldest.TraceID)
+}
+
+// Unpins the trace ids which expired
+func (p *pins) sweep(now time.Time) {
+	for id, found := range p.byID {
+		if !found.Expires.IsZero() && !now.Before(found.Expires) {
+			p.remove(id)
+		}
+	}
+}
+
+// Returns true if a tree of the trace is to be pinned, counting it
+func (p *pins) hit(traceID string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep(now)
+	found := p.byID[traceID]
+	if found == nil {
+		return false
+	}
+	found.Trees++
+	return true
+}
+
+// Returns whether a span entered within "parent" (if any) on the
+// goroutine is part of a pinned tree, and whether it is the top-level
+// span of one. Costs a single load unless any trace id is pinned or any
+// pinned tree is open.
+func (t *Tracer) pinnedEnter(gid uint64, parent *Span) (bool, bool) {
+	if atomic.LoadInt64(&t.pins.active) == 0 {
+		return false, false
+	}
+	within := t.enclosing(gid, parent)
+	if within == nil {
+		return false, false
+	}
+	if within.ev.Depth >= 0 {
+		return within.ev.Pinned, false
+	}
+	// A top-level span carrying a trace id from elsewhere
+	if within.ev.TraceID == "" || !t.pins.hit(within.ev.TraceID, t.options.Clock()) {
+		return false, false
+	}
+	atomic.AddInt64(&t.pins.active, 1)
+	return true, true
+}
@@ -0,0 +1,156 @@
+package tracey
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	pinnedParent = TraceParent{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", ParentID: "00f067aa0ba902b7"}
+	otherParent  = TraceParent{TraceID: "0af7651916cd43dd8448eb211c80319c", ParentID: "b7ad6b7169203331"}
+)
+
+func pinWorkload(t *Tracer, parent TraceParent) {
+	handle := t.StartRemoteNamed(parent, "handle", "%s", "$FN")
+	t.StartNamed("cache.get", Debug, "%s", "$FN").End()
+	t.StartNamed("db.query", "%s", "$FN").End()
+	handle.End()
+}
+
+func TestPinBypass(test *testing.T) {
+	var out, js lockedBuffer
+	t := NewTracer(&Options{
+		Sinks:        []Sink{{Writer: &out, MinDuration: time.Second}, {Writer: &js, Format: JSONFormat}},
+		MinLevel:     Info,
+		FilterRules:  []FilterRule{{Kind: MatchExact, Pattern: "db.query", Action: Exclude}},
+		TailSampling: true,
+	})
+	t.Pin(pinnedParent.TraceID, 0)
+
+	pinWorkload(t, otherParent)
+	assert.Empty(test, out.String())
+	assert.Empty(test, js.String())
+
+	pinWorkload(t, pinnedParent)
+	assert.Equal(test, "[ 0]ENTER: =>handle [pinned]\n"+
+		"[ 1]  ENTER: DBG =>cache.get [pinned]\n"+
+		"[ 1]  EXIT:  DBG =>cache.get [pinned]\n"+
+		"[ 1]  ENTER: =>db.query [pinned]\n"+
+		"[ 1]  EXIT:  =>db.query [pinned]\n"+
+		"[ 0]EXIT:  =>handle [pinned]\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	exits := exitsByName(test, &js)
+	assert.True(test, exits["db.query"].Pinned)
+	assert.Equal(test, pinnedParent.TraceID, exits["db.query"].TraceID)
+
+	// Pins outlive updates of the options
+	assert.Nil(test, t.Update(func(o *MutableOptions) { o.MinLevel = Info }))
+	out.Reset()
+	pinWorkload(t, pinnedParent)
+	assert.Equal(test, 6, strings.Count(out.String(), "[pinned]"))
+	assert.Equal(test, []PinInfo{{TraceID: pinnedParent.TraceID, Pinned: t.Pins()[0].Pinned, Trees: 2}}, t.Pins())
+
+	// Trees open when the trace id is unpinned stay pinned
+	out.Reset()
+	handle := t.StartRemoteNamed(pinnedParent, "handle", "%s", "$FN")
+	t.Unpin(pinnedParent.TraceID)
+	t.StartNamed("cache.get", Debug, "%s", "$FN").End()
+	handle.End()
+	assert.Equal(test, 4, strings.Count(out.String(), "[pinned]"))
+	assert.Empty(test, t.Pins())
+	assert.Equal(test, int64(0), t.pins.active)
+
+	out.Reset()
+	pinWorkload(t, pinnedParent)
+	assert.Empty(test, out.String())
+}
+
+func TestPinExpiry(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, Clock: clock.Now, MinLevel: Info})
+	t.Pin(pinnedParent.TraceID, time.Minute)
+	assert.Equal(test, []PinInfo{{TraceID: pinnedParent.TraceID, Pinned: clock.now, Expires: clock.now.Add(time.Minute)}}, t.Pins())
+
+	clock.advance(59 * time.Second)
+	pinWorkload(t, pinnedParent)
+	assert.Contains(test, out.String(), "cache.get [pinned]")
+
+	out.Reset()
+	clock.advance(time.Second)
+	pinWorkload(t, pinnedParent)
+	assert.Equal(test, "", out.String())
+	assert.Empty(test, t.Pins())
+	assert.Equal(test, int64(0), t.pins.active)
+}
+
+func TestPinEviction(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}, MaxPins: 2})
+	ids := func() []string {
+		var ids []string
+		for _, p := range t.Pins() {
+			ids = append(ids, p.TraceID)
+		}
+		return ids
+	}
+	t.Pin("a", 0)
+	t.Pin("b", 0)
+	t.Pin("c", 0)
+	assert.Equal(test, []string{"b", "c"}, ids())
+
+	// Pinning again renews the pin
+	t.Pin("b", 0)
+	t.Pin("d", 0)
+	assert.Equal(test, []string{"b", "d"}, ids())
+	assert.Equal(test, int64(2), t.pins.active)
+}
+
+func TestPinnedEnterAllocs(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}})
+	remote := &Span{ev: Event{TraceID: pinnedParent.TraceID, Depth: -1}, remote: &pinnedParent}
+	allocs := testing.AllocsPerRun(100, func() {
+		if pinned, _ := t.pinnedEnter(1, remote); pinned {
+			test.Fatal("pinned")
+		}
+	})
+	assert.Equal(test, 0.0, allocs)
+}
+
+func BenchmarkPinnedEnterEmpty(b *testing.B) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: io.Discard}}})
+	remote := &Span{ev: Event{TraceID: pinnedParent.TraceID, Depth: -1}, remote: &pinnedParent}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		t.pinnedEnter(1, remote)
+	}
+}
+
+func TestBundlePinned(test *testing.T) {
+	dir := filepath.Join(test.TempDir(), "bundles")
+	t := NewTracer(&Options{
+		Sinks:         []Sink{{Writer: io.Discard}},
+		BundleOnError: BundleConfig{Dir: dir},
+		BundlePinned:  true,
+	})
+	t.Pin(pinnedParent.TraceID, 0)
+	pinWorkload(t, otherParent)
+	t.Flush()
+	assert.Empty(test, readBundles(test, dir))
+
+	pinWorkload(t, pinnedParent)
+	t.Flush()
+	bundles := readBundles(test, dir)
+	assert.Len(test, bundles, 1)
+	var meta struct {
+		Reason  string `json:"reason"`
+		TraceID string `json:"trace_id"`
+	}
+	assert.Nil(test, json.Unmarshal([]byte(bundles[0]["meta.json"]), &meta))
+	assert.Equal(test, "pinned", meta.Reason)
+	assert.Equal(test, pinnedParent.TraceID, meta.TraceID)
+}
@@ -0,0 +1,328 @@
+package tracey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ErrPoolClosed is what the tasks of a `TracePool` which never ran fail
+// with, for having been submitted after `Close()` or dropped by it.
+var ErrPoolClosed = errors.New("tracey: pool closed")
+
+// A PoolClose is what `TracePool.Close()` does with the tasks still
+// queued, see `Options.PoolClose`.
+type PoolClose int
+
+const (
+	// The tasks still queued are run before the workers stop
+	DrainPending PoolClose = iota
+
+	// The tasks still queued are dropped, their queued spans failing
+	// with `ErrPoolClosed`
+	CancelPending
+)
+
+// A TracePool runs tasks on a fixed number of workers, tracing the time
+// each task waits in the queue as well as the task itself, see
+// `Tracer.NewPool(...)`.
+type TracePool struct {
+	t     *Tracer
+	name  string
+	stats *poolStats
+
+	mu      sync.Mutex
+	ready   *sync.Cond
+	queue   []*poolTask
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// A task waiting for a worker
+type poolTask struct {
+	name string
+	ctx  context.Context
+	fn   func(context.Context) error
+
+	// The span open on the submitting goroutine, which the task's span is
+	// within, and the pseudo-span of its wait
+	parent *Span
+	queued *Span
+	token  HandoffToken
+	since  time.Time
+}
+
+// The running totals of the pools of a name
+type poolStats struct {
+	sync.Mutex
+	tasks, failed, panics, cancelled uint64
+	queued, maxQueued                int
+	totalWait, maxWait               time.Duration
+}
+
+// PoolStats summarizes the tasks of the pools of a name so far.
+type PoolStats struct {
+	Name string
+
+	// How many tasks ran, and how many of them failed, counting those
+	// which panicked
+	Tasks  uint64
+	Failed uint64
+	Panics uint64
+
+	// How many tasks never ran, for their context being done by the time
+	// a worker was free, or for the pool being closed
+	Cancelled uint64
+
+	// How many tasks are queued right now, and the most there ever were
+	Queued    int
+	MaxQueued int
+
+	// How long the tasks which ran waited for a worker, in all and at most
+	TotalWait time.Duration
+	MaxWait   time.Duration
+}
+
+// MeanWait returns how long the tasks which ran waited for a worker on
+// average.
+func (s PoolStats) MeanWait() time.Duration {
+	if s.Tasks == 0 {
+		return 0
+	}
+	return s.TotalWait / time.Duration(s.Tasks)
+}
+
+// NewPool starts a pool of "workers" goroutines named after the calling
+// function, see `NewNamedPool(...)`.
+func (t *Tracer) NewPool(workers int) *TracePool {
+	return t.NewNamedPool(t.callerSite().name, workers)
+}
+
+// NewNamedPool starts a pool of "workers" goroutines (at least one),
+// which run the tasks submitted to it in turn. Each task is traced as a
+// pseudo-span named after it, as in "queued fetch", from its submission
+// until a worker picks it up, which is handed off from the submitting
+// goroutine to the worker (see `Span.Transfer()`), and then as a span of
+// its own on the worker, within the span which was open on the
+// submitting goroutine the way `EnterUnder(...)` enters it. A task which
+// panics fails its span instead of taking its worker down. The tasks
+// which fail are reported to the "PoolErrorHandler". Pools of the same
+// name share their statistics, see `PoolStats()`.
+func (t *Tracer) NewNamedPool(name string, workers int) *TracePool {
+	p := &TracePool{t: t, name: name}
+	found, _ := t.stats.pools.LoadOrStore(name, &poolStats{})
+	p.stats = found.(*poolStats)
+	p.ready = sync.NewCond(&p.mu)
+	if workers < 1 {
+		workers = 1
+	}
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues the task for the next worker which is free.
+func (p *TracePool) Submit(name string, fn func()) {
+	p.submit(nil, name, func(context.Context) error {
+		fn()
+		return nil
+	})
+}
+
+// SubmitContext queues the task the way `Submit(...)` does, its span
+// watching "ctx" the way `StartContext(...)` does, and failing with the
+// error it returns. A task whose context is done by the time a worker is
+// free is not run, its queued span failing with the context's error.
+func (p *TracePool) SubmitContext(ctx context.Context, name string, fn func(context.Context) error) {
+	p.submit(ctx, name, fn)
+}
+
+func (p *TracePool) submit(ctx context.Context, name string, fn func(context.Context) error) {
+	t := p.t
+	task := &poolTask{name: name, ctx: ctx, fn: fn, queued: noopSpan, since: t.options.Clock()}
+	if t.start != nil {
+		task.parent = t.goroutines.innermost(getGID())
+		task.queued = t.start(nil, "queued "+name, nil)
+		task.token = task.queued.Transfer()
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.cancel(task, ErrPoolClosed)
+		return
+	}
+	p.queue = append(p.queue, task)
+	p.stats.enqueue()
+	p.mu.Unlock()
+	p.ready.Signal()
+}
+
+// Close stops the pool once its workers are done, after running the tasks
+// still queued or dropping them, as "PoolClose" says. Tasks submitted
+// from then on are dropped as well.
+func (p *TracePool) Close() {
+	p.mu.Lock()
+	var dropped []*poolTask
+	if !p.closed && p.t.options.PoolClose == CancelPending {
+		dropped = p.queue
+		p.queue = nil
+		p.stats.dequeue(len(dropped))
+	}
+	p.closed = true
+	p.mu.Unlock()
+	p.ready.Broadcast()
+	for _, task := range dropped {
+		p.cancel(task, ErrPoolClosed)
+	}
+	p.workers.Wait()
+}
+
+// Runs the queued tasks until the pool is closed and none are left
+func (p *TracePool) work() {
+	defer p.workers.Done()
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.ready.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		task := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.stats.dequeue(1)
+		p.mu.Unlock()
+		p.run(task)
+	}
+}
+
+// Ends the task's wait, and runs it within a span of its own
+func (p *TracePool) run(task *poolTask) {
+	t := p.t
+	if task.ctx != nil && task.ctx.Err() != nil {
+		p.cancel(task, task.ctx.Err())
+		return
+	}
+	wait := t.options.Clock().Sub(task.since)
+	if task.token.span != nil {
+		t.Accept(task.token)
+	}
+	task.queued.End()
+
+	span := noopSpan
+	if t.start != nil {
+		span = t.startUnder(task.parent, task.name)
+		if task.ctx != nil {
+			t.underContext(span, task.ctx)
+		}
+	}
+	panicked, err := p.call(span, task)
+	if !panicked {
+		span.SetError(err)
+	}
+	span.End()
+	p.stats.ran(wait, err != nil, panicked)
+	if err != nil {
+		p.report(task.name, err)
+	}
+}
+
+// Calls the task, turning a panic into the failure of its span
+func (p *TracePool) call(span *Span, task *poolTask) (panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			span.recordPanic(r)
+			panicked, err = true, fmt.Errorf("panicked: %v", r)
+		}
+	}()
+	return false, task.fn(task.ctx)
+}
+
+// Drops a task which never ran, failing its queued span
+func (p *TracePool) cancel(task *poolTask, err error) {
+	task.queued.SetError(err)
+	task.queued.End()
+	p.stats.Lock()
+	p.stats.cancelled++
+	p.stats.Unlock()
+	p.report(task.name, err)
+}
+
+func (p *TracePool) report(task string, err error) {
+	if handle := p.t.options.PoolErrorHandler; handle != nil {
+		handle(p.name, task, err)
+	}
+}
+
+func (s *poolStats) enqueue() {
+	s.Lock()
+	defer s.Unlock()
+	s.queued++
+	if s.queued > s.maxQueued {
+		s.maxQueued = s.queued
+	}
+}
+
+func (s *poolStats) dequeue(n int) {
+	s.Lock()
+	s.queued -= n
+	s.Unlock()
+}
+
+func (s *poolStats) ran(wait time.Duration, failed, panicked bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.tasks++
+	if failed {
+		s.failed++
+	}
+	if panicked {
+		s.panics++
+	}
+	s.totalWait += wait
+	if wait > s.maxWait {
+		s.maxWait = wait
+	}
+}
+
+// PoolStats returns the statistics of every pool started so far, sorted
+// by name, see `NewPool(...)`.
+func (t *Tracer) PoolStats() []PoolStats {
+	var all []PoolStats
+	t.stats.pools.Range(func(name, value interface{}) bool {
+		s := value.(*poolStats)
+		s.Lock()
+		all = append(all, PoolStats{name.(string), s.tasks, s.failed, s.panics, s.cancelled, s.queued, s.maxQueued, s.totalWait, s.maxWait})
+		s.Unlock()
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// Writes the table of the pools for `DumpStats(...)`, if there are any
+func (t *Tracer) dumpPools(w io.Writer) error {
+	all := t.PoolStats()
+	if len(all) == 0 {
+		return nil
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tTASKS\tFAILED\tCANCELLED\tMAX QUEUED\tMEAN WAIT\tMAX WAIT")
+	for _, s := range all {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", s.Name, s.Tasks, s.Failed, s.Cancelled, s.MaxQueued,
+			formatDuration(s.MeanWait()), formatDuration(s.MaxWait))
+	}
+	return tw.Flush()
+}
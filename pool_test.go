@@ -0,0 +1,153 @@
+package tracey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Decodes the exit events written by a JSON sink, by name
+func exitsByName(test *testing.T, js *lockedBuffer) map[string]Event {
+	exits := make(map[string]Event)
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		if ev.Kind == ExitEvent {
+			exits[ev.Name] = ev
+		}
+	}
+	return exits
+}
+
+func TestPoolWait(test *testing.T) {
+	var js lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &js, Format: JSONFormat}}, Clock: clock.Now})
+	pool := t.NewPool(1)
+
+	submitter := t.StartNamed("submit")
+	started, release := make(chan struct{}), make(chan struct{})
+	pool.Submit("first", func() {
+		close(started)
+		<-release
+	})
+	<-started
+	pool.Submit("second", func() {})
+	clock.advance(5 * time.Second)
+	close(release)
+	pool.Close()
+	submitter.End()
+
+	exits := exitsByName(test, &js)
+	assert.Equal(test, time.Duration(0), exits["queued first"].Duration)
+	assert.Equal(test, 5*time.Second, exits["queued second"].Duration)
+	for _, name := range []string{"queued second", "first", "second"} {
+		assert.Equal(test, exits["submit"].TraceID, exits[name].TraceID, name)
+		assert.Equal(test, exits["submit"].SpanID, exits[name].ParentID, name)
+	}
+	// The worker took the queued span over
+	assert.Equal(test, 2, len(exits["queued second"].Owners))
+
+	assert.Equal(test, []PoolStats{{Name: "go-tracey.TestPoolWait", Tasks: 2, MaxQueued: 1, TotalWait: 5 * time.Second, MaxWait: 5 * time.Second}}, t.PoolStats())
+	assert.Equal(test, 2500*time.Millisecond, t.PoolStats()[0].MeanWait())
+
+	var dump bytes.Buffer
+	assert.Nil(test, t.DumpStats(&dump))
+	assert.Regexp(test, `(?m)^go-tracey.TestPoolWait +2 +0 +0 +1 +2\.5s +5\.0s$`, dump.String())
+}
+
+// Reports the failed tasks of pools
+type poolErrors struct {
+	sync.Mutex
+	errs map[string]error
+}
+
+func (p *poolErrors) handle(pool, task string, err error) {
+	p.Lock()
+	defer p.Unlock()
+	p.errs[pool+"/"+task] = err
+}
+
+func TestPoolClose(test *testing.T) {
+	for _, policy := range []PoolClose{DrainPending, CancelPending} {
+		var js lockedBuffer
+		failed := &poolErrors{errs: make(map[string]error)}
+		t := NewTracer(&Options{Sinks: []Sink{{Writer: &js, Format: JSONFormat}}, PoolClose: policy, PoolErrorHandler: failed.handle})
+		pool := t.NewNamedPool("work", 1)
+
+		var ran []string
+		started, release := make(chan struct{}), make(chan struct{})
+		pool.Submit("block", func() {
+			close(started)
+			<-release
+		})
+		<-started
+		for _, name := range []string{"a", "b"} {
+			name := name
+			pool.Submit(name, func() { ran = append(ran, name) })
+		}
+		closed := make(chan struct{})
+		go func() {
+			pool.Close()
+			close(closed)
+		}()
+		if policy == CancelPending {
+			assert.Eventually(test, func() bool { return t.PoolStats()[0].Cancelled == 2 }, time.Second, time.Millisecond)
+		}
+		close(release)
+		<-closed
+		pool.Submit("late", func() { ran = append(ran, "late") })
+
+		exits := exitsByName(test, &js)
+		stats := t.PoolStats()[0]
+		if policy == DrainPending {
+			assert.Equal(test, []string{"a", "b"}, ran)
+			assert.Equal(test, uint64(3), stats.Tasks)
+			assert.Equal(test, uint64(1), stats.Cancelled)
+			assert.Equal(test, map[string]error{"work/late": ErrPoolClosed}, failed.errs)
+			assert.Nil(test, exits["queued a"].Err)
+		} else {
+			assert.Empty(test, ran)
+			assert.Equal(test, uint64(1), stats.Tasks)
+			assert.Equal(test, uint64(3), stats.Cancelled)
+			assert.Equal(test, map[string]error{"work/a": ErrPoolClosed, "work/b": ErrPoolClosed, "work/late": ErrPoolClosed}, failed.errs)
+			assert.Equal(test, ErrPoolClosed.Error(), exits["queued a"].Err.Error())
+			assert.NotContains(test, exits, "a")
+		}
+		assert.Equal(test, 0, stats.Queued)
+	}
+}
+
+func TestPoolPanic(test *testing.T) {
+	var js lockedBuffer
+	failed := &poolErrors{errs: make(map[string]error)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &js, Format: JSONFormat}}, PoolErrorHandler: failed.handle})
+	pool := t.NewNamedPool("work", 1)
+
+	pool.Submit("explode", func() { panic("boom") })
+	ctx, cancel := context.WithCancel(context.Background())
+	pool.SubmitContext(context.Background(), "fail", func(context.Context) error { return errors.New("no luck") })
+	pool.Submit("after", func() { cancel() })
+	pool.SubmitContext(ctx, "late", func(context.Context) error { return nil })
+	pool.Close()
+
+	// The worker carried on after the panic
+	assert.Equal(test, "panicked: boom", failed.errs["work/explode"].Error())
+	assert.Equal(test, "no luck", failed.errs["work/fail"].Error())
+	assert.Equal(test, context.Canceled, failed.errs["work/late"])
+	assert.Len(test, failed.errs, 3)
+
+	exits := exitsByName(test, &js)
+	assert.Equal(test, "string", exits["explode"].PanicType)
+	assert.Equal(test, "boom", exits["explode"].PanicValue)
+	assert.Contains(test, exits, "after")
+	assert.NotContains(test, exits, "late")
+	stats := t.PoolStats()[0]
+	assert.Equal(test, []uint64{3, 2, 1, 1}, []uint64{stats.Tasks, stats.Failed, stats.Panics, stats.Cancelled})
+}
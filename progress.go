@@ -0,0 +1,127 @@
+package tracey
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How far along a span is, as reported with `Span.SetProgress(...)`.
+type Progress struct {
+	Done, Total int64
+}
+
+// Renders the progress, as in "34% (3.4M/10M)", or just "3.4M" if the
+// total is not known
+func (p Progress) String() string {
+	if p.Total <= 0 {
+		return formatCompact(p.Done)
+	}
+	percent := 100 * float64(p.Done) / float64(p.Total)
+	return strconv.Itoa(int(percent)) + "% (" + formatCompact(p.Done) + "/" + formatCompact(p.Total) + ")"
+}
+
+// Formats a count with a decimal suffix, as in "3.4M" or "10M"
+func formatCompact(n int64) string {
+	units := []struct {
+		size   float64
+		suffix string
+	}{{1e12, "T"}, {1e9, "G"}, {1e6, "M"}, {1e3, "K"}}
+	abs := float64(n)
+	if abs < 0 {
+		abs = -abs
+	}
+	for _, u := range units {
+		if abs >= u.size {
+			s := strconv.FormatFloat(float64(n)/u.size, 'f', 1, 64)
+			return strings.TrimSuffix(s, ".0") + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// SetProgress reports how far along the span is, "total" being 0 if it is
+// not known. With "ProgressInterval" set, a heartbeat line shows the
+// latest progress of the span every so often while it runs, and its EXIT
+// line shows the last progress it reported either way. It only takes a
+// couple of atomic stores, and may be called from any goroutine.
+func (s *Span) SetProgress(done, total int64) {
+	if s.t == nil {
+		return
+	}
+	atomic.StoreInt64(&s.progressDone, done)
+	atomic.StoreInt64(&s.progressTotal, total)
+	if atomic.LoadUint32(&s.progressSet) == 0 && atomic.CompareAndSwapUint32(&s.progressSet, 0, 1) {
+		if s.t.options.ProgressInterval > 0 && !s.muted {
+			s.t.scanner.addProgress(s.t, s)
+		}
+	}
+}
+
+// The last progress the span reported, if any
+func (s *Span) lastProgress() *Progress {
+	if atomic.LoadUint32(&s.progressSet) == 0 {
+		return nil
+	}
+	return &Progress{atomic.LoadInt64(&s.progressDone), atomic.LoadInt64(&s.progressTotal)}
+}
+
+// Has the span's heartbeats logged, unless the tracer is closed
+func (sc *scanner) addProgress(t *Tracer, s *Span) {
+	sc.mu.Lock()
+	if sc.closed || atomic.LoadUint32(&s.ended) != 0 {
+		sc.mu.Unlock()
+		return
+	}
+	if sc.progress == nil {
+		sc.progress = make(map[*Span]time.Time)
+	}
+	sc.progress[s] = s.ev.Time
+	sc.mu.Unlock()
+	sc.start(t)
+}
+
+func (sc *scanner) removeProgress(s *Span) {
+	sc.mu.Lock()
+	delete(sc.progress, s)
+	sc.mu.Unlock()
+}
+
+// Logs the heartbeats which are due. Returns false if there are no spans
+// which reported progress.
+func (sc *scanner) scanProgress(t *Tracer, now time.Time) bool {
+	interval := t.options.ProgressInterval
+	var due []*Span
+	sc.mu.Lock()
+	if len(sc.progress) == 0 {
+		sc.mu.Unlock()
+		return false
+	}
+	for s, last := range sc.progress {
+		if now.Sub(last) >= interval {
+			due = append(due, s)
+			sc.progress[s] = now
+		}
+	}
+	sc.mu.Unlock()
+
+	for _, s := range due {
+		t.heartbeat(s, now)
+	}
+	return true
+}
+
+// Logs the progress of a span, as in
+// "⏳ main.importRecords 34% (3.4M/10M) — running 2m10s [tid:6]"
+func (t *Tracer) heartbeat(s *Span, now time.Time) {
+	progress := s.lastProgress()
+	if progress == nil || atomic.LoadUint32(&s.ended) != 0 {
+		return
+	}
+	ev := Event{Kind: PointEvent, Time: now, TID: s.ev.TID, Message: progress.String(), progress: progress}
+	ev.Duration = now.Sub(s.ev.Time)
+	t.within(&ev, s)
+	ev.Depth = s.ev.Depth
+	t.emitPoint(&ev)
+}
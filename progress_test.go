@@ -0,0 +1,103 @@
+package tracey
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A clock which only moves when told to
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+func importRecords(t *Tracer, during func(*Span)) {
+	span := t.Start()
+	defer span.End()
+	during(span)
+}
+
+func TestProgressHeartbeats(test *testing.T) {
+	var buf bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Logger: log.New(&buf, "", 0)}}, Clock: clock.Now, ProgressInterval: time.Hour})
+	defer t.Close()
+
+	importRecords(t, func(span *Span) {
+		span.SetProgress(3_400_000, 10_000_000)
+		t.scanner.scan(t, clock.advance(30*time.Minute))
+		t.scanner.scan(t, clock.advance(40*time.Minute+10*time.Second))
+		span.SetProgress(5_000_000, 10_000_000)
+		t.scanner.scan(t, clock.advance(30*time.Minute))
+		t.scanner.scan(t, clock.advance(30*time.Minute))
+		span.SetProgress(1500, 0)
+		clock.advance(time.Minute)
+	})
+
+	text := RE_tidMarker.ReplaceAllString(buf.String(), "$1=>")
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	assert.Equal(test, 4, len(lines), text)
+	assert.Regexp(test, `^\[ 0\]⏳ go-tracey.importRecords 34% \(3.4M/10M\) — running 1h10m10s \[tid:\d+\]$`, lines[1])
+	assert.Regexp(test, `^\[ 0\]⏳ go-tracey.importRecords 50% \(5M/10M\) — running 2h10m10s \[tid:\d+\]$`, lines[2])
+	assert.Contains(test, lines[3], "EXIT:  => [progress 1.5K]")
+}
+
+func TestProgressWithoutHeartbeats(test *testing.T) {
+	var buf bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Logger: log.New(&buf, "", 0)}}})
+	importRecords(t, func(span *Span) {
+		span.SetProgress(7, 10)
+	})
+	assert.Equal(test, 0, len(t.scanner.progress))
+	assert.NotContains(test, buf.String(), "⏳")
+	assert.Contains(test, buf.String(), "[progress 70% (7/10)]")
+
+	buf.Reset()
+	importRecords(t, func(*Span) {})
+	assert.NotContains(test, buf.String(), "progress")
+}
+
+func TestProgressScannerShutdown(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}, ProgressInterval: 10 * time.Millisecond})
+	importRecords(t, func(span *Span) {
+		span.SetProgress(1, 2)
+		time.Sleep(30 * time.Millisecond)
+	})
+	assert.Eventually(test, func() bool {
+		return atomic.LoadUint32(&t.scanner.running) == 0
+	}, time.Second, time.Millisecond)
+
+	importRecords(t, func(span *Span) {
+		span.SetProgress(1, 2)
+		t.Close()
+		assert.Equal(test, uint32(0), atomic.LoadUint32(&t.scanner.running))
+		span.SetProgress(2, 2)
+	})
+	assert.Nil(test, t.scanner.progress)
+}
+
+func TestFormatCompact(test *testing.T) {
+	for n, want := range map[int64]string{0: "0", 999: "999", 1000: "1K", 1500: "1.5K", 3_400_000: "3.4M", 2e9: "2G", -1200: "-1.2K"} {
+		assert.Equal(test, want, formatCompact(n))
+	}
+}
@@ -0,0 +1,131 @@
+package tracey
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Keeps track of how much output a tracer has written so far, so that
+// "MaxLines" and "MaxBytes" can be enforced.
+type quota struct {
+	lines   uint64
+	bytes   uint64
+	reached uint32
+}
+
+// Reserves room for a note of "n" bytes against the tracer's quota, and
+// returns false if the note should not be written. Like every line, the
+// note is charged once for each sink it goes to.
+func (t *Tracer) admitOutput(n int) bool {
+	if t.options.MaxLines == 0 && t.options.MaxBytes == 0 {
+		return true
+	}
+	sinks := 0
+	for _, s := range t.sinks {
+		if s.Format != BinaryFormat {
+			sinks++
+		}
+	}
+	return t.admitLines(sinks, sinks*n)
+}
+
+// Reserves room for "lines" lines of "n" bytes in all against the
+// tracer's quota, and returns false if they should not be written. The
+// first lines which do not fit are replaced with the final "TRACE QUOTA
+// REACHED" line.
+func (t *Tracer) admitLines(lines, n int) bool {
+	maxLines, maxBytes := t.options.MaxLines, t.options.MaxBytes
+	if maxLines == 0 && maxBytes == 0 {
+		return true
+	}
+	if atomic.LoadUint32(&t.quota.reached) != 0 {
+		return false
+	}
+	if reserve(&t.quota.lines, uint64(lines), maxLines) {
+		if reserve(&t.quota.bytes, uint64(n), maxBytes) {
+			if t.alerts.set.Load() != nil {
+				t.alertQuota()
+			}
+			return true
+		}
+		atomic.AddUint64(&t.quota.lines, -uint64(lines))
+	}
+	if atomic.CompareAndSwapUint32(&t.quota.reached, 0, 1) {
+		t.note(quotaReachedLine(maxLines, maxBytes))
+	}
+	return false
+}
+
+// Atomically adds "n" to the counter unless that would take it past
+// "max", where a "max" of 0 means unlimited.
+func reserve(counter *uint64, n, max uint64) bool {
+	for {
+		used := atomic.LoadUint64(counter)
+		if max != 0 && used+n > max {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(counter, used, used+n) {
+			return true
+		}
+	}
+}
+
+func quotaReachedLine(maxLines, maxBytes uint64) string {
+	var limits []string
+	if maxLines != 0 {
+		limits = append(limits, formatCount(maxLines)+" lines")
+	}
+	if maxBytes != 0 {
+		limits = append(limits, formatBytes(maxBytes))
+	}
+	return "TRACE QUOTA REACHED (" + strings.Join(limits, " / ") + ") — further output suppressed\n"
+}
+
+// Formats a count with thousands separators, as in "10,000".
+func formatCount(n uint64) string {
+	s := strconv.FormatUint(n, 10)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// Formats a byte count with a binary unit, as in "512B" or "4.0MB".
+func formatBytes(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return strconv.FormatUint(n, 10) + "B"
+	}
+	div, exp := uint64(1024), 0
+	for m := n / 1024; m >= 1024 && exp < len(units)-1; m /= 1024 {
+		div *= 1024
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), units[exp])
+}
+
+// ResetQuota forgets all output written so far, re-arming "MaxLines" and
+// "MaxBytes" if the quota had been reached.
+func (t *Tracer) ResetQuota() {
+	atomic.StoreUint64(&t.quota.lines, 0)
+	atomic.StoreUint64(&t.quota.bytes, 0)
+	atomic.StoreUint32(&t.quota.reached, 0)
+}
+
+// QuotaRemaining returns how many more lines and bytes the tracer may write
+// before reaching its quota. Unlimited quotas are reported as math.MaxUint64.
+func (t *Tracer) QuotaRemaining() (lines, bytes uint64) {
+	remaining := func(used *uint64, max uint64) uint64 {
+		if max == 0 {
+			return math.MaxUint64
+		}
+		if atomic.LoadUint32(&t.quota.reached) != 0 {
+			return 0
+		}
+		return max - atomic.LoadUint64(used)
+	}
+	return remaining(&t.quota.lines, t.options.MaxLines), remaining(&t.quota.bytes, t.options.MaxBytes)
+}
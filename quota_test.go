@@ -0,0 +1,153 @@
+package tracey
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxLines(test *testing.T) {
+	ResetTestBuffer()
+	tracer := NewTracer(&Options{CustomLogger: BufLogger, MaxLines: 3, DisableDepthValue: true})
+
+	second := func() {
+		defer tracer.Enter("SECOND")()
+	}
+	first := func() {
+		defer tracer.Enter("FIRST")()
+		second()
+	}
+	first()
+	first()
+
+	lines := strings.Split(strings.TrimPrefix(GetTestBuffer(), "\n"), "\n")
+	assert.Equal(test, 5, len(lines))
+	assert.Contains(test, lines[0], "ENTER: ")
+	assert.Contains(test, lines[1], "ENTER: ")
+	assert.Contains(test, lines[2], "EXIT:  ")
+	assert.Equal(test, "TRACE QUOTA REACHED (3 lines) — further output suppressed", lines[3])
+
+	remainingLines, remainingBytes := tracer.QuotaRemaining()
+	assert.Equal(test, uint64(0), remainingLines)
+	assert.Equal(test, uint64(math.MaxUint64), remainingBytes)
+}
+
+func TestMaxBytes(test *testing.T) {
+	// Enter and exit lines, as in "ENTER: [tid:N]=>\n", have the same
+	// length so find it out and allow exactly three of them
+	ResetTestBuffer()
+	func() {
+		defer New(&Options{CustomLogger: BufLogger, DisableNesting: true})()()
+	}()
+	lineLen := len(strings.SplitAfter(strings.TrimPrefix(GetTestBuffer(), "\n"), "\n")[0])
+
+	ResetTestBuffer()
+	tracer := NewTracer(&Options{CustomLogger: BufLogger, MaxBytes: uint64(3 * lineLen), DisableNesting: true})
+	func() {
+		defer tracer.Enter()()
+	}()
+	_, remaining := tracer.QuotaRemaining()
+	assert.Equal(test, uint64(lineLen), remaining)
+
+	func() {
+		defer tracer.Enter()()
+	}()
+	lines := strings.Split(strings.TrimPrefix(GetTestBuffer(), "\n"), "\n")
+	assert.Equal(test, 5, len(lines))
+	assert.True(test, strings.HasPrefix(lines[2], "ENTER: "))
+	assert.Equal(test, "TRACE QUOTA REACHED ("+formatBytes(uint64(3*lineLen))+") — further output suppressed", lines[3])
+}
+
+func TestQuotaCountsEverySink(test *testing.T) {
+	var a, b bytes.Buffer
+	sinks := []Sink{{Writer: &a}, {Writer: &b}}
+	func() {
+		defer NewTracer(&Options{Sinks: sinks, DisableNesting: true}).Enter()()
+	}()
+	lineLen := len(strings.SplitAfter(a.String(), "\n")[0])
+
+	// Four lines and four lines' worth of bytes: the enter and exit of one
+	// span, on both sinks
+	a.Reset()
+	b.Reset()
+	byLines := NewTracer(&Options{Sinks: sinks, MaxLines: 4, DisableNesting: true})
+	func() {
+		defer byLines.Enter()()
+	}()
+	lines, _ := byLines.QuotaRemaining()
+	assert.Equal(test, uint64(0), lines)
+
+	byBytes := NewTracer(&Options{Sinks: sinks, MaxBytes: uint64(4 * lineLen), DisableNesting: true})
+	func() {
+		defer byBytes.Enter()()
+	}()
+	_, remaining := byBytes.QuotaRemaining()
+	assert.Equal(test, uint64(0), remaining)
+
+	func() {
+		defer byLines.Enter()()
+	}()
+	func() {
+		defer byBytes.Enter()()
+	}()
+	for _, out := range []string{a.String(), b.String()} {
+		assert.Equal(test, 2, strings.Count(out, "ENTER: "))
+		assert.Equal(test, 2, strings.Count(out, "TRACE QUOTA REACHED"))
+	}
+}
+
+func TestResetQuota(test *testing.T) {
+	ResetTestBuffer()
+	tracer := NewTracer(&Options{CustomLogger: BufLogger, MaxLines: 1})
+
+	func() {
+		defer tracer.Enter("FIRST")()
+	}()
+	tracer.ResetQuota()
+	remaining, _ := tracer.QuotaRemaining()
+	assert.Equal(test, uint64(1), remaining)
+
+	func() {
+		defer tracer.Enter("SECOND")()
+	}()
+
+	out := GetTestBuffer()
+	assert.Equal(test, 2, strings.Count(out, "TRACE QUOTA REACHED"))
+	assert.Contains(test, out, "ENTER: [tid:")
+	assert.Contains(test, out, "SECOND")
+}
+
+func TestQuotaReachedOnceUnderConcurrency(test *testing.T) {
+	ResetTestBuffer()
+	tracer := NewTracer(&Options{CustomLogger: BufLogger, MaxLines: 100})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				func() {
+					defer tracer.Enter("worker")()
+				}()
+			}
+		}()
+	}
+	wg.Wait()
+
+	out := strings.TrimPrefix(GetTestBuffer(), "\n")
+	assert.Equal(test, 1, strings.Count(out, "TRACE QUOTA REACHED"))
+	assert.Equal(test, 101, strings.Count(out, "\n"))
+}
+
+func TestFormatBytes(test *testing.T) {
+	assert.Equal(test, "512B", formatBytes(512))
+	assert.Equal(test, "1.5KB", formatBytes(1536))
+	assert.Equal(test, "4.0MB", formatBytes(4<<20))
+	assert.Equal(test, "10,000", formatCount(10000))
+	assert.Equal(test, "100", formatCount(100))
+}
@@ -0,0 +1,79 @@
+package tracey
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Returns true if the writer is known to never call back into tracey,
+// in which case writing to it needs no guarding
+func tracesNothing(w io.Writer) bool {
+	switch w.(type) {
+	case *os.File, *bytes.Buffer, *strings.Builder, *MMapLog:
+		return true
+	}
+	return w == io.Discard
+}
+
+// Returns true if writes to the sink must be guarded, see `write(...)`
+func (s *sinkState) mayReenter() bool {
+	if s.Logger != nil {
+		return !tracesNothing(s.Logger.Writer())
+	}
+	return !s.safeWriter
+}
+
+// Marks the goroutine as writing tracey's output, during which the spans
+// it enters are not traced, see `ReentrantCallsSuppressed()`
+func (g *goroutines) beginOutput(gid uint64) *goroutineRecord {
+	atomic.AddInt64(&g.outputs, 1)
+	shard := g.shard(gid)
+	shard.Lock()
+	defer shard.Unlock()
+	record := shard.g[gid]
+	if record == nil {
+		record = &goroutineRecord{}
+		shard.g[gid] = record
+	}
+	record.output++
+	return record
+}
+
+func (g *goroutines) endOutput(gid uint64, record *goroutineRecord) {
+	shard := g.shard(gid)
+	shard.Lock()
+	record.output--
+	g.release(shard, gid, record)
+	shard.Unlock()
+	atomic.AddInt64(&g.outputs, -1)
+}
+
+// Returns true, and counts the call, if the goroutine is writing tracey's
+// output. Takes a single atomic load while no goroutine is.
+func (g *goroutines) reentered(gid uint64) bool {
+	if atomic.LoadInt64(&g.outputs) == 0 {
+		return false
+	}
+	shard := g.shard(gid)
+	shard.Lock()
+	record := shard.g[gid]
+	inside := record != nil && record.output > 0
+	shard.Unlock()
+	if inside {
+		atomic.AddUint64(&g.reentrant, 1)
+	}
+	return inside
+}
+
+// ReentrantCallsSuppressed returns how many spans were entered by the
+// tracer's own sinks, from within a write (a logger wrapping traced code,
+// say), and were not traced. Tracing them would log more lines, whose
+// writes would trace more spans, and so on; there is no telling them
+// apart from spans entered by the writers for their own sake, so no span
+// entered while writing is traced, on that goroutine only.
+func (t *Tracer) ReentrantCallsSuppressed() uint64 {
+	return atomic.LoadUint64(&t.goroutines.reentrant)
+}
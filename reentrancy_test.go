@@ -0,0 +1,90 @@
+package tracey
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A writer wrapping traced code, as loggers over instrumented
+// infrastructure are
+type tracingWriter struct {
+	t   *Tracer
+	buf bytes.Buffer
+}
+
+func (w *tracingWriter) Write(p []byte) (int, error) {
+	defer w.t.Enter("%s", "$FN")()
+	return w.buf.Write(p)
+}
+
+func reenteredCall(t *Tracer) { defer t.Enter("%s", "$FN")() }
+
+func TestReentrantWriter(test *testing.T) {
+	w := &tracingWriter{}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: w}}})
+	w.t = t
+	reenteredCall(t)
+	assert.Equal(test, "[ 0]ENTER: =>go-tracey.reenteredCall\n"+
+		"[ 0]EXIT:  =>go-tracey.reenteredCall\n", RE_tidMarker.ReplaceAllString(w.buf.String(), "=>"))
+	assert.Equal(test, uint64(2), t.ReentrantCallsSuppressed())
+
+	// Through a logger as well, and its goroutine is traced as usual once
+	// the writes are over
+	logged := &tracingWriter{}
+	t = NewTracer(&Options{CustomLogger: log.New(logged, "", 0)})
+	logged.t = t
+	reenteredCall(t)
+	reenteredCall(t)
+	assert.Equal(test, 4, strings.Count(logged.buf.String(), "go-tracey.reenteredCall"))
+	assert.Equal(test, uint64(4), t.ReentrantCallsSuppressed())
+	assert.Empty(test, t.Snapshot())
+	assert.Equal(test, 0, t.goroutineCount())
+}
+
+// A writer which holds up the first write, for as long as the test wants
+type stallingWriter struct {
+	tracingWriter
+	mu              sync.Mutex
+	writes          int32
+	stalled, resume chan struct{}
+}
+
+func (w *stallingWriter) lockFree() {}
+
+func (w *stallingWriter) Write(p []byte) (int, error) {
+	if atomic.AddInt32(&w.writes, 1) == 1 {
+		reenteredCall(w.t)
+		close(w.stalled)
+		<-w.resume
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func TestReentrancyIsPerGoroutine(test *testing.T) {
+	w := &stallingWriter{stalled: make(chan struct{}), resume: make(chan struct{})}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: w}}})
+	w.t = t
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reenteredCall(t)
+	}()
+	<-w.stalled
+
+	// Another goroutine traces while the first one is writing
+	reenteredCall(t)
+	close(w.resume)
+	<-done
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	assert.Equal(test, 4, strings.Count(w.buf.String(), "go-tracey.reenteredCall"))
+	assert.Equal(test, uint64(1), t.ReentrantCallsSuppressed())
+}
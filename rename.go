@@ -0,0 +1,117 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Rename renames the span, such as "handleMessage" to "PurchaseEvent" once
+// the message is decoded. Its EXIT line and exit event bear the new name,
+// and so do its ENTER line if "TailSampling" still withholds it and the
+// copies "EscalateOnError" and "BundleOnError" keep of its enter. An ENTER
+// line already written keeps the old name, and the EXIT line then notes
+// it, as in "EXIT:  [tid:1]=>PurchaseEvent (né handleMessage)", for the
+// lines to stay matchable. The exit event has the name the span was
+// entered with in "OriginalName", and the span is counted in the
+// statistics under its last name. The budget, filters, templates and such
+// the span was matched to on enter stay as they were. Renaming an ended
+// span does nothing, but log a warning if "WarnLateRename" is set.
+func (s *Span) Rename(name string) {
+	if s.t == nil || s.late("Rename") {
+		return
+	}
+	old := s.ev.Name
+	if name == old {
+		return
+	}
+	if s.ev.OriginalName == "" {
+		s.ev.OriginalName = old
+	}
+	s.ev.Name = name
+	s.ev.Message = strings.Replace(s.ev.Message, old, name, 1)
+	s.ev.text = strings.Replace(s.ev.text, old, name, 1)
+	if !s.rewriteEnter() && !s.muted && s.ev.enteredAs == "" {
+		s.ev.enteredAs = old
+	}
+}
+
+// Amend replaces the message of the span, formatted with
+// `fmt.Sprintf(...)`, which its EXIT line shows, and its ENTER line too
+// where `Rename(...)` would rename it. Amending an ended span does
+// nothing, but log a warning if "WarnLateRename" is set.
+func (s *Span) Amend(msg string, args ...interface{}) {
+	if s.t == nil || s.late("Amend") {
+		return
+	}
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	s.ev.Message = s.t.capMessage(msg)
+	s.ev.text = lineText(s.ev.TID, s.ev.Message)
+	s.rewriteEnter()
+}
+
+// Returns true if the span has ended, warning about it if asked to
+func (s *Span) late(method string) bool {
+	if atomic.LoadUint32(&s.ended) == 0 {
+		return false
+	}
+	if s.t.options.WarnLateRename {
+		warning := "Warning: " + method + " of " + s.ev.Name + " after it ended, ignored\n"
+		if s.t.admitOutput(len(warning)) {
+			s.t.note(warning)
+		}
+	}
+	return true
+}
+
+// Gives the copies the tracer holds of the span's enter its name and
+// message. Returns true if its ENTER line is still withheld.
+func (s *Span) rewriteEnter() bool {
+	withheld := false
+	if tree := s.ev.tail; tree != nil {
+		tree.Lock()
+		if !tree.streaming && !tree.done {
+			withheld = s.rewriteHeld(tree.events)
+		}
+		tree.Unlock()
+	}
+	if tree := s.ev.bundle; tree != nil {
+		tree.Lock()
+		s.rewriteHeld(tree.events)
+		tree.Unlock()
+	}
+	if tree := s.tree; tree != nil {
+		tree.Lock()
+		for i := range tree.lines {
+			held := &tree.lines[i].ev
+			if held.Kind == EnterEvent && held.SpanID == s.ev.SpanID {
+				held.Name, held.Message, held.text = s.ev.Name, s.ev.Message, s.ev.text
+			}
+		}
+		tree.Unlock()
+	}
+	return withheld
+}
+
+// Renames the enter of the span among the events. Must be called with the
+// lock of their tree held.
+func (s *Span) rewriteHeld(events []Event) bool {
+	for i := range events {
+		if held := &events[i]; held.Kind == EnterEvent && held.SpanID == s.ev.SpanID {
+			held.Name, held.Message, held.text = s.ev.Name, s.ev.Message, s.ev.text
+			return true
+		}
+	}
+	return false
+}
+
+// Notes the name the ENTER line of a renamed span was written with, as in
+// " (né handleMessage)"
+func renderRenamed(buf *bytes.Buffer, ev *Event) {
+	buf.WriteString(" (né ")
+	buf.WriteString(ev.enteredAs)
+	buf.WriteByte(')')
+}
@@ -0,0 +1,68 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameStreaming(test *testing.T) {
+	var out, js lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}, {Writer: &js, Format: JSONFormat}}})
+	span := t.StartNamed("handleMessage", "%s", "$FN")
+	span.Rename("PurchaseEvent")
+	span.End()
+
+	assert.Equal(test, "[ 0]ENTER: =>handleMessage\n"+
+		"[ 0]EXIT:  =>PurchaseEvent (né handleMessage)\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	lines := strings.Split(strings.TrimSpace(js.String()), "\n")
+	exit, err := UnmarshalEvent([]byte(lines[1]))
+	assert.Nil(test, err)
+	assert.Equal(test, "PurchaseEvent", exit.Name)
+	assert.Equal(test, "handleMessage", exit.OriginalName)
+
+	calls := make(map[string]uint64)
+	for _, s := range t.Stats() {
+		calls[s.Name] = s.Calls
+	}
+	assert.Equal(test, uint64(1), calls["PurchaseEvent"])
+	assert.Equal(test, uint64(0), calls["handleMessage"])
+}
+
+func TestRenameBuffered(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, TailSampling: true, TailDecision: func(TreeSummary) bool { return true }})
+	span := t.StartNamed("handleMessage", "%s", "$FN")
+	child := t.StartNamed("decode", "%s", "$FN")
+	child.End()
+	span.Rename("PurchaseEvent")
+	span.Amend("purchase %d", 42)
+	span.End()
+
+	assert.Equal(test, "[ 0]ENTER: =>purchase 42\n"+
+		"[ 1]  ENTER: =>decode\n"+
+		"[ 1]  EXIT:  =>decode\n"+
+		"[ 0]EXIT:  =>purchase 42\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+}
+
+func TestRenameAfterEnd(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, WarnLateRename: true})
+	span := t.StartNamed("handleMessage", "%s", "$FN")
+	span.End()
+	span.Rename("PurchaseEvent")
+
+	assert.Equal(test, "[ 0]ENTER: =>handleMessage\n"+
+		"[ 0]EXIT:  =>handleMessage\n"+
+		"Warning: Rename of handleMessage after it ended, ignored\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	assert.Equal(test, "handleMessage", t.Stats()[0].Name)
+	assert.Equal(test, uint64(1), t.Stats()[0].Calls)
+}
+
+func TestRenderRenamed(test *testing.T) {
+	var buf bytes.Buffer
+	renderRenamed(&buf, &Event{enteredAs: "handleMessage"})
+	assert.Equal(test, " (né handleMessage)", buf.String())
+}
@@ -0,0 +1,173 @@
+package tracey
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A run of back-to-back calls to the same function, at the same depth and
+// on the same goroutine, which "CollapseRepeats" folds into one line.
+type repeatRun struct {
+	name  string
+	depth int
+	count int
+
+	total, min, max time.Duration
+
+	// The enter of what may turn out to be the next repeat, withheld
+	// until it is known whether anything else happens inside of it
+	held *Event
+}
+
+// The per-goroutine state needed to spot repeats
+type repeatState struct {
+	// The last event on the goroutine, if it was an enter
+	lastEnter *Event
+
+	run *repeatRun
+}
+
+type repeats struct {
+	sync.Mutex
+	g map[uint64]*repeatState
+}
+
+func (r *repeatRun) add(d time.Duration) {
+	if r.count == 0 || d < r.min {
+		r.min = d
+	}
+	if d > r.max {
+		r.max = d
+	}
+	r.total += d
+	r.count++
+}
+
+// Called with every event before it is emitted, returns true if the event
+// was swallowed as part of a run of repeats.
+func (t *Tracer) collapseRepeats(ev *Event) bool {
+	t.repeats.Lock()
+	defer t.repeats.Unlock()
+
+	state := t.repeats.g[ev.TID]
+	if state == nil {
+		state = &repeatState{}
+		t.repeats.g[ev.TID] = state
+	}
+
+	if run := state.run; run != nil {
+		sameFn := ev.Name == run.name && ev.Depth == run.depth
+		switch {
+		case run.held != nil && sameFn && ev.Kind == ExitEvent:
+			// A leaf call to the same function, one more repeat
+			run.add(ev.Duration)
+			run.held = nil
+			return true
+		case run.held == nil && sameFn && ev.Kind == EnterEvent:
+			held := *ev
+			held.emitter = 0
+			run.held = &held
+			return true
+		}
+		t.flushRun(state)
+	}
+
+	if ev.Kind == PointEvent {
+		// Something happened inside the last enter, so it is not a leaf
+		state.lastEnter = nil
+		if ev.Depth == 0 && state.run == nil {
+			delete(t.repeats.g, ev.TID)
+		}
+		return false
+	}
+	if ev.Kind == EnterEvent {
+		lastEnter := *ev
+		lastEnter.emitter = 0
+		state.lastEnter = &lastEnter
+		return false
+	}
+	if last := state.lastEnter; last != nil && last.Name == ev.Name && last.Depth == ev.Depth {
+		// A leaf call, which may be the first of a run
+		state.run = &repeatRun{name: ev.Name, depth: ev.Depth}
+		state.run.add(ev.Duration)
+	}
+	state.lastEnter = nil
+	if ev.Depth == 0 && state.run == nil {
+		delete(t.repeats.g, ev.TID)
+	}
+	return false
+}
+
+// Ends the goroutine's current run, logging its summary if it had any
+// repeats and then the withheld enter (if any). Must be called with the
+// lock held.
+func (t *Tracer) flushRun(state *repeatState) {
+	run := state.run
+	state.run = nil
+	if run.count > 1 {
+		buf := getBuffer()
+		t.renderIndent(buf, run.depth)
+		fmt.Fprintf(buf, "(×%d) %s — total %s, min %s, max %s, mean %s\n", run.count, run.name,
+			formatDuration(run.total), formatDuration(run.min), formatDuration(run.max),
+			formatDuration(run.total/time.Duration(run.count)))
+		if t.admitOutput(buf.Len()) {
+			t.note(buf.String())
+		}
+		putBuffer(buf)
+	}
+	if run.held != nil {
+		t.emit(run.held)
+		state.lastEnter = run.held
+	}
+}
+
+// Flush ends all pending runs of repeats and of unchanged calls (see
+// "SkipUnchanged"), logging their summaries, and then waits for the queues
+// of "Async" sinks and of the "EventHandler" to drain and the bundles of
+// "BundleOnError" to be written. Runs end by themselves as soon as anything
+// else is traced on their goroutine, and queues drain by themselves, so
+// this is only needed once tracing is over.
+func (t *Tracer) Flush() {
+	if t.options.CollapseRepeats {
+		t.repeats.Lock()
+		t.flushRuns()
+		t.repeats.Unlock()
+	}
+	if t.changes != nil {
+		t.changes.Lock()
+		streaks := t.changes.takeStreaks()
+		t.changes.Unlock()
+		for _, streak := range streaks {
+			t.summarizeUnchanged(streak)
+		}
+	}
+	t.flushAsync(0)
+	if t.handlers != nil {
+		t.handlers.flush()
+	}
+	t.bundles.pending.Wait()
+}
+
+// Ends the runs of every goroutine. Must be called with the lock held.
+func (t *Tracer) flushRuns() {
+	for tid, state := range t.repeats.g {
+		if state.run != nil {
+			t.flushRun(state)
+		}
+		delete(t.repeats.g, tid)
+	}
+}
+
+// Formats a duration with one decimal in its natural unit, as in "2.4ms"
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	case d >= time.Millisecond:
+		return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+	case d >= time.Microsecond:
+		return fmt.Sprintf("%.1fµs", float64(d)/float64(time.Microsecond))
+	}
+	return d.String()
+}
@@ -0,0 +1,98 @@
+package tracey
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var RE_tidMarker = regexp.MustCompile(`\[tid:\d+( - [^\]]*)?\]=>`)
+var RE_durations = regexp.MustCompile(`\d+(\.\d+)?(s|ms|µs|ns)`)
+
+// Returns what has been traced so far with the goroutine ids and
+// durations masked, so it can be compared against golden output
+func maskedTestBuffer() string {
+	return RE_durations.ReplaceAllString(RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"), "D")
+}
+
+// Helper functions - part of "TestCollapseRepeats*"
+func processItem(trace func(...interface{}) func(), i int, nested bool) {
+	defer trace("$FN(%d)", i)()
+	if nested {
+		validateItem(trace)
+	}
+}
+func validateItem(trace func(...interface{}) func()) {
+	defer trace("$FN%s", "")()
+}
+
+func TestCollapseRepeats(test *testing.T) {
+	ResetTestBuffer()
+	trace := New(&Options{CustomLogger: BufLogger, CollapseRepeats: true})
+	func() {
+		defer trace("%s", "loop")()
+		for i := 1; i <= 5; i++ {
+			processItem(trace, i, false)
+		}
+	}()
+
+	assert.Equal(test, `
+[ 0]ENTER: =>loop
+[ 1]  ENTER: =>go-tracey.processItem(1)
+[ 1]  EXIT:  =>go-tracey.processItem(1)
+[ 1]  (×5) go-tracey.processItem — total D, min D, max D, mean D
+[ 0]EXIT:  =>loop
+`, maskedTestBuffer())
+}
+
+func TestCollapseRepeatsBrokenByNestedChild(test *testing.T) {
+	ResetTestBuffer()
+	trace := New(&Options{CustomLogger: BufLogger, CollapseRepeats: true})
+	func() {
+		defer trace("%s", "loop")()
+		for i := 1; i <= 5; i++ {
+			processItem(trace, i, i == 3)
+		}
+	}()
+
+	assert.Equal(test, `
+[ 0]ENTER: =>loop
+[ 1]  ENTER: =>go-tracey.processItem(1)
+[ 1]  EXIT:  =>go-tracey.processItem(1)
+[ 1]  (×2) go-tracey.processItem — total D, min D, max D, mean D
+[ 1]  ENTER: =>go-tracey.processItem(3)
+[ 2]    ENTER: =>go-tracey.validateItem
+[ 2]    EXIT:  =>go-tracey.validateItem
+[ 1]  EXIT:  =>go-tracey.processItem(3)
+[ 1]  ENTER: =>go-tracey.processItem(4)
+[ 1]  EXIT:  =>go-tracey.processItem(4)
+[ 1]  (×2) go-tracey.processItem — total D, min D, max D, mean D
+[ 0]EXIT:  =>loop
+`, maskedTestBuffer())
+}
+
+func TestCollapseRepeatsFlush(test *testing.T) {
+	ResetTestBuffer()
+	tracer := NewTracer(&Options{CustomLogger: BufLogger, CollapseRepeats: true, DisableDepthValue: true})
+	for i := 1; i <= 3; i++ {
+		processItem(tracer.Enter, i, false)
+	}
+	assert.Equal(test, 2, strings.Count(GetTestBuffer(), "\n")-1)
+
+	tracer.Flush()
+	assert.Equal(test, `
+ENTER: =>go-tracey.processItem(1)
+EXIT:  =>go-tracey.processItem(1)
+(×3) go-tracey.processItem — total D, min D, max D, mean D
+`, maskedTestBuffer())
+}
+
+func TestFormatDuration(test *testing.T) {
+	assert.Equal(test, "1.2s", formatDuration(1234*time.Millisecond))
+	assert.Equal(test, "1.9ms", formatDuration(1900*time.Microsecond))
+	assert.Equal(test, "2.5µs", formatDuration(2500*time.Nanosecond))
+	assert.Equal(test, "500ns", formatDuration(500))
+}
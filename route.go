@@ -0,0 +1,58 @@
+package tracey
+
+import "fmt"
+
+// A SinkID picks a sink by its position in "Sinks", see "Router".
+type SinkID int
+
+// Where the events of a tree of spans go, decided once for the tree by
+// "Router". A nil "to" goes to every sink.
+type route struct {
+	to []bool
+}
+
+// Returns true if the route takes the event to the sink. Sinks with
+// "Audit" set receive every failed exit, whatever the route.
+func (r *route) takes(s *sinkState, ev *Event) bool {
+	return r == nil || r.to == nil || r.to[s.index] || (s.Audit && ev.Kind == ExitEvent && ev.Err != nil)
+}
+
+// Routes the span the way the span it is within is routed, or else runs
+// "Router" on its enter event, as the outermost span of its tree
+func (t *Tracer) enterRoute(s *Span, gid uint64, parent *Span) {
+	if within := t.enclosing(gid, parent); within != nil && within.ev.route != nil {
+		s.ev.route = within.ev.route
+		return
+	}
+	s.ev.route = t.route(&s.ev)
+}
+
+// Runs "Router" on the event, logging rather than propagating its panics,
+// and returns the route it picks
+func (t *Tracer) route(ev *Event) *route {
+	var ids []SinkID
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ids = nil
+				warning := fmt.Sprintf("Warning: tracey router panicked: %v\n", r)
+				if t.admitOutput(len(warning)) {
+					t.note(warning)
+				}
+			}
+		}()
+		ids = t.options.Router(*ev)
+	}()
+	if ids == nil {
+		if ids = t.options.DefaultRoute; ids == nil {
+			return &route{}
+		}
+	}
+	r := &route{to: make([]bool, len(t.sinks))}
+	for _, id := range ids {
+		if id >= 0 && int(id) < len(r.to) {
+			r.to[id] = true
+		}
+	}
+	return r
+}
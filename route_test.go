@@ -0,0 +1,98 @@
+package tracey
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type tenantRequest struct {
+	Tenant string `tracey:"tenant"`
+}
+
+// Routes the trees of each tenant to a sink of their own
+func routeTenant(ev Event) []SinkID {
+	for _, tag := range ev.Tags {
+		switch {
+		case tag.Key != "tenant":
+		case tag.Value == "acme":
+			return []SinkID{0}
+		case tag.Value == "globex":
+			return []SinkID{1}
+		case tag.Value == "panic":
+			panic("no such tenant")
+		}
+	}
+	return nil
+}
+
+func TestRouter(test *testing.T) {
+	var acme, globex, other, audit lockedBuffer
+	t := NewTracer(&Options{
+		Sinks:        []Sink{{Writer: &acme}, {Writer: &globex}, {Writer: &other}, {Writer: &audit, Audit: true}},
+		Router:       routeTenant,
+		DefaultRoute: []SinkID{2},
+	})
+
+	var wg sync.WaitGroup
+	for _, tenant := range []string{"acme", "globex"} {
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				request := t.Start("%s", "request", WithStructTags(tenantRequest{tenant}))
+				defer request.End()
+				func() {
+					defer t.Enter("%s", "query "+tenant)()
+					t.Event("rows of " + tenant)
+				}()
+				ref := request.Ref()
+				onGoroutine(func() {
+					t.EnterUnder(ref, "%s", "callback "+tenant)()
+				})
+				if i == 0 {
+					request.SetError(errors.New("declined " + tenant))
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	t.Event("standalone")
+
+	for tenant, out := range map[string]string{"acme": acme.String(), "globex": globex.String()} {
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		assert.Len(test, lines, 20*7)
+		for _, line := range lines {
+			if !strings.Contains(line, "=>request") {
+				assert.Contains(test, line, tenant)
+			}
+		}
+	}
+	assert.Equal(test, "[ 0]· standalone\n", other.String())
+
+	// The failed requests, whichever tenant they are of
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(audit.String(), "=>")), "\n")
+	assert.ElementsMatch(test, []string{
+		"[ 0]EXIT:  =>request {tenant=acme} (error: declined acme)",
+		"[ 0]EXIT:  =>request {tenant=globex} (error: declined globex)",
+	}, lines)
+}
+
+func TestRouterPanics(test *testing.T) {
+	var routed, other lockedBuffer
+	t := NewTracer(&Options{
+		Sinks:        []Sink{{Writer: &routed}, {Writer: &other}},
+		Router:       routeTenant,
+		DefaultRoute: []SinkID{1, 7},
+	})
+	assert.NotPanics(test, func() {
+		t.Enter("%s", "request", WithStructTags(tenantRequest{"panic"}))()
+	})
+	assert.Equal(test, "Warning: tracey router panicked: no such tenant\n", routed.String())
+	assert.Equal(test, "Warning: tracey router panicked: no such tenant\n"+
+		"[ 0]ENTER: =>request\n"+
+		"[ 0]EXIT:  =>request {tenant=panic}\n", RE_tidMarker.ReplaceAllString(other.String(), "=>"))
+}
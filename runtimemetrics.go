@@ -0,0 +1,168 @@
+package tracey
+
+import (
+	"math"
+	"runtime/metrics"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How the runtime changed while a span was open, see
+// "EnableRuntimeMetrics". Only set on exit events, when something did.
+type RuntimeDelta struct {
+	// The garbage collections which completed meanwhile, and roughly how
+	// long the world was stopped for them
+	GCCycles uint64
+	GCPause  time.Duration
+
+	// The number of live goroutines at the enter and at the exit
+	GoroutinesEnter, GoroutinesExit uint64
+}
+
+// Renders the delta, as in "gc ×1, pause 2.1ms; goroutines 420→610"
+func (d RuntimeDelta) String() string {
+	var s string
+	if d.GCCycles > 0 {
+		s = "gc ×" + strconv.FormatUint(d.GCCycles, 10) + ", pause " + formatDuration(d.GCPause)
+	}
+	if d.GoroutinesEnter != d.GoroutinesExit {
+		if s != "" {
+			s += "; "
+		}
+		s += "goroutines " + strconv.FormatUint(d.GoroutinesEnter, 10) + "→" + strconv.FormatUint(d.GoroutinesExit, 10)
+	}
+	return s
+}
+
+// The runtime/metrics read at the enter and exit of spans, the first of
+// each which the runtime has being used. Older runtimes only have the
+// deprecated name of the GC pauses.
+var (
+	gcCyclesMetrics   = []string{"/gc/cycles/total:gc-cycles"}
+	gcPausesMetrics   = []string{"/sched/pauses/total/gc:seconds", "/gc/pauses:seconds"}
+	goroutinesMetrics = []string{"/sched/goroutines:goroutines"}
+)
+
+// The values sampled at a point in time
+type runtimeSample struct {
+	gcCycles   uint64
+	gcPause    float64
+	goroutines uint64
+}
+
+// Samples the runtime's metrics, see "EnableRuntimeMetrics"
+type runtimeSampler struct {
+	// The metrics read, and the index in them of each value, -1 for
+	// those the runtime does not have
+	names                         []string
+	gcCycles, gcPause, goroutines int
+
+	// Of []metrics.Sample, so that reads do not allocate
+	samples sync.Pool
+}
+
+// Looks the metrics up in those the runtime has, returning nil if it has
+// none of them
+func newRuntimeSampler() *runtimeSampler {
+	kinds := make(map[string]metrics.ValueKind)
+	for _, d := range metrics.All() {
+		kinds[d.Name] = d.Kind
+	}
+	r := &runtimeSampler{}
+	find := func(names []string, kind metrics.ValueKind) int {
+		for _, name := range names {
+			if k, ok := kinds[name]; ok && k == kind {
+				r.names = append(r.names, name)
+				return len(r.names) - 1
+			}
+		}
+		return -1
+	}
+	r.gcCycles = find(gcCyclesMetrics, metrics.KindUint64)
+	r.gcPause = find(gcPausesMetrics, metrics.KindFloat64Histogram)
+	r.goroutines = find(goroutinesMetrics, metrics.KindUint64)
+	if len(r.names) == 0 {
+		return nil
+	}
+	r.samples.New = func() interface{} {
+		samples := make([]metrics.Sample, len(r.names))
+		for i, name := range r.names {
+			samples[i].Name = name
+		}
+		return &samples
+	}
+	return r
+}
+
+// Reads all the metrics at once
+func (r *runtimeSampler) sample() runtimeSample {
+	samples := r.samples.Get().(*[]metrics.Sample)
+	defer r.samples.Put(samples)
+	metrics.Read(*samples)
+
+	var s runtimeSample
+	if r.gcCycles >= 0 {
+		s.gcCycles = (*samples)[r.gcCycles].Value.Uint64()
+	}
+	if r.gcPause >= 0 {
+		s.gcPause = histogramSum((*samples)[r.gcPause].Value.Float64Histogram())
+	}
+	if r.goroutines >= 0 {
+		s.goroutines = (*samples)[r.goroutines].Value.Uint64()
+	}
+	return s
+}
+
+// Estimates the sum of the values of a histogram, taking each to be in
+// the middle of its bucket (or at the finite edge of unbounded buckets)
+func histogramSum(h *metrics.Float64Histogram) float64 {
+	var sum float64
+	for i, n := range h.Counts {
+		if n == 0 {
+			continue
+		}
+		lo, hi := h.Buckets[i], h.Buckets[i+1]
+		mid := (lo + hi) / 2
+		if math.IsInf(lo, -1) {
+			mid = hi
+		} else if math.IsInf(hi, 1) {
+			mid = lo
+		}
+		sum += float64(n) * mid
+	}
+	return sum
+}
+
+// Samples the runtime when an instrumented span is entered
+func (t *Tracer) enterRuntime(span *Span) {
+	instrument := t.options.EnableInstrumentation
+	if o := span.ev.overrides; o != nil && o.EnableInstrumentation != nil {
+		instrument = *o.EnableInstrumentation
+	}
+	if !instrument || span.muted || (t.options.RuntimeMetricsTopLevelOnly && span.ev.ParentID != "") {
+		return
+	}
+	span.runtimeAt, span.runtimeSampled = t.runtime.sample(), true
+}
+
+// Notes on the exit event how the runtime changed while the span was
+// open, if it did at all
+func (t *Tracer) exitRuntime(span *Span, ev *Event) {
+	if !span.runtimeSampled {
+		return
+	}
+	now := t.runtime.sample()
+	delta := RuntimeDelta{
+		GCCycles:        now.gcCycles - span.runtimeAt.gcCycles,
+		GCPause:         time.Duration((now.gcPause - span.runtimeAt.gcPause) * float64(time.Second)),
+		GoroutinesEnter: span.runtimeAt.goroutines,
+		GoroutinesExit:  now.goroutines,
+	}
+	if delta.GCPause < 0 {
+		delta.GCPause = 0
+	}
+	if delta.GCCycles > 0 || delta.GoroutinesEnter != delta.GoroutinesExit {
+		ev.Runtime = &delta
+	}
+}
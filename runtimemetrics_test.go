@@ -0,0 +1,63 @@
+package tracey
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeMetrics(test *testing.T) {
+	var js, text bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:                      []Sink{{Writer: &js, Format: JSONFormat}, {Writer: &text}},
+		EnableInstrumentation:      true,
+		EnableRuntimeMetrics:       true,
+		RuntimeMetricsTopLevelOnly: true,
+	})
+	span := t.Start("%s", "collecting")
+	t.Enter("%s", "nested")()
+	runtime.GC()
+	span.End()
+
+	var exits []Event
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		if ev.Kind == ExitEvent {
+			exits = append(exits, ev)
+		}
+	}
+	assert.Len(test, exits, 2)
+	// Only the top-level span is sampled
+	assert.Nil(test, exits[0].Runtime)
+	if assert.NotNil(test, exits[1].Runtime) {
+		assert.True(test, exits[1].Runtime.GCCycles >= 1, "%+v", *exits[1].Runtime)
+	}
+	assert.Regexp(test, `EXIT:  .*collecting .* in .* \(gc ×\d+, pause [^)]+\)\n$`, text.String())
+}
+
+func TestRuntimeDeltaString(test *testing.T) {
+	assert.Equal(test, "gc ×1, pause 2.1ms; goroutines 420→610",
+		RuntimeDelta{GCCycles: 1, GCPause: 2100 * time.Microsecond, GoroutinesEnter: 420, GoroutinesExit: 610}.String())
+	assert.Equal(test, "goroutines 3→2", RuntimeDelta{GoroutinesEnter: 3, GoroutinesExit: 2}.String())
+}
+
+func TestRuntimeMetricsUnknown(test *testing.T) {
+	defer func(names []string) { goroutinesMetrics = names }(goroutinesMetrics)
+	goroutinesMetrics = []string{"/no/such:metric"}
+	r := newRuntimeSampler()
+	assert.Equal(test, -1, r.goroutines)
+	assert.Equal(test, uint64(0), r.sample().goroutines)
+}
+
+func BenchmarkRuntimeMetrics(b *testing.B) {
+	r := newRuntimeSampler()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.sample()
+	}
+}
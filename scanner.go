@@ -0,0 +1,126 @@
+package tracey
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logs the heartbeats of "ProgressInterval" and the warnings of
+// "WarnAfter", ends the handoffs of "HandoffTimeout" and the spans of
+// "AbandonAfter", and drops the
+// goroutine records of "GoroutineStateTTL" and the lines of
+// "AttachPendingTimeout" once they expire. A single goroutine scans the
+// open spans and the records for all of them, and exits
+// whenever there are none left to scan (the next span entered or reporting
+// its progress starting it again) or the tracer is closed.
+type scanner struct {
+	mu      sync.Mutex
+	running uint32
+	closed  bool
+
+	// Stops the goroutine, which closes "done" once it has returned
+	stop, done chan struct{}
+
+	// The spans which reported progress, and when their last heartbeat
+	// was (or when they were entered, until the first one)
+	progress map[*Span]time.Time
+
+	// When a stack was last captured for a warning, in unix nanoseconds
+	lastStack int64
+}
+
+// Starts the goroutine unless it is running. Called once the span is
+// open on its goroutine, so that a goroutine about to exit still sees it.
+func (sc *scanner) start(t *Tracer) {
+	if atomic.LoadUint32(&sc.running) != 0 {
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed || !atomic.CompareAndSwapUint32(&sc.running, 0, 1) {
+		return
+	}
+	sc.stop, sc.done = make(chan struct{}), make(chan struct{})
+	go sc.run(t, sc.stop, sc.done)
+}
+
+// How often the goroutine checks whether heartbeats, warnings, handoffs or
+// expiries are due, for the shortest of the intervals
+func (sc *scanner) pollInterval(t *Tracer) time.Duration {
+	options := &t.options
+	interval := options.ProgressInterval
+	expiries := []time.Duration{options.WarnAfter, options.HandoffTimeout, options.GoroutineStateTTL, options.AbandonAfter}
+	if t.abandonAfter != nil {
+		expiries = append(expiries, t.abandonAfter.budgets...)
+	}
+	if atomic.LoadUint32(&t.goroutines.pendingUsed) != 0 {
+		expiries = append(expiries, t.goroutines.pendingTTL)
+	}
+	for _, d := range expiries {
+		if interval <= 0 || (d > 0 && d < interval) {
+			interval = d
+		}
+	}
+	return pollInterval(interval)
+}
+
+// Turns an interval into how often to check whether it is up
+func pollInterval(interval time.Duration) time.Duration {
+	poll := interval / 10
+	if poll < time.Millisecond {
+		poll = time.Millisecond
+	} else if poll > time.Second {
+		poll = time.Second
+	}
+	return poll
+}
+
+func (sc *scanner) run(t *Tracer, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(sc.pollInterval(t))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if sc.scan(t, t.options.Clock()) {
+			continue
+		}
+		// Spans entered (or reporting progress) from now on start another
+		// goroutine, and those from before are seen by the scan below
+		atomic.StoreUint32(&sc.running, 0)
+		if !sc.scan(t, t.options.Clock()) || !atomic.CompareAndSwapUint32(&sc.running, 0, 1) {
+			return
+		}
+	}
+}
+
+// Logs the heartbeats and warnings, ends the handoffs and the abandoned
+// spans, and drops the records, which are due. Returns false if there is nothing left to scan.
+func (sc *scanner) scan(t *Tracer, now time.Time) bool {
+	open := t.options.WarnAfter > 0 && sc.scanWarnings(t, now)
+	if t.abandonAfter != nil && sc.scanAbandoned(t, now) {
+		open = true
+	}
+	handedOff := t.options.HandoffTimeout > 0 && sc.scanHandoffs(t, now)
+	kept := t.goroutines.compacting() && t.goroutines.compact(now)
+	return sc.scanProgress(t, now) || open || handedOff || kept
+}
+
+// Stops the goroutine and waits for it, for good
+func (sc *scanner) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.progress = nil
+	stop, done := sc.stop, sc.done
+	sc.stop = nil
+	sc.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+		atomic.StoreUint32(&sc.running, 0)
+	}
+}
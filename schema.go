@@ -0,0 +1,332 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SchemaVersion is the version of the JSON output, written as the "v"
+// field of every line. Lines written before versioning have none, and are
+// version 0. Fields are only ever added, never renamed or repurposed, so
+// that parsers which skip unknown fields keep working; the version is only
+// bumped by changes they could not skip over.
+const SchemaVersion = 1
+
+const schemaVersionString = "1"
+
+// The names of the fields of the JSON output. They are frozen, new fields
+// get new names.
+const (
+	FieldVersion  = "v"
+	FieldKind     = "kind"
+	FieldTime     = "time"
+	FieldTID      = "tid"
+	FieldDepth    = "depth"
+	FieldTrace    = "trace"
+	FieldSpan     = "span"
+	FieldParent   = "parent"
+	FieldLevel    = "level"
+	FieldName     = "name"
+	FieldMsg      = "msg"
+	FieldDur      = "dur"
+	FieldTags     = "tags"
+	FieldErr      = "err"
+	FieldCtxErr   = "ctx_err"
+	FieldEvents   = "events"
+	FieldAt       = "at"
+	FieldInFlight = "inflight"
+	FieldCallers  = "callers"
+	FieldHidden   = "hidden"
+	FieldExtra    = "x"
+
+	FieldCheckpoints = "checkpoints"
+	FieldBlocked     = "blocked"
+	FieldAncestry    = "ancestry"
+	FieldProgress    = "progress"
+	FieldSession     = "session"
+	FieldReplayed    = "replayed"
+	FieldActive      = "active"
+	FieldSegments    = "segments"
+	FieldApprox      = "approx"
+	FieldStack       = "stack"
+	FieldRuntime     = "runtime"
+	FieldLogged      = "logged"
+	FieldOwners      = "owners"
+	FieldRestored    = "restored"
+	FieldPanic       = "panic"
+	FieldBudget      = "budget"
+	FieldInjected    = "injected"
+	FieldAttached    = "attached"
+	FieldCPU         = "cpu"
+	FieldCPUApprox   = "cpu_approx"
+	FieldBuildInfo   = "bi"
+	FieldPercent     = "pct"
+	FieldBaseline    = "baseline"
+	FieldSeq         = "seq"
+	FieldOrigName    = "orig_name"
+	FieldAbandoned   = "abandoned"
+	FieldOperation   = "op"
+	FieldPinned      = "pinned"
+)
+
+// Writes any value as JSON, falling back to a string should it not be
+// serializable
+func appendJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		appendJSONString(buf, fmt.Sprint(v))
+		return
+	}
+	buf.Write(b)
+}
+
+// UnmarshalEvent parses a line of JSON output, of any schema version up to
+// `SchemaVersion`, back into an Event. Fields missing from older versions
+// are left at their zero value, and unknown fields end up in ExtraFields
+// next to the ones which were written under "x". Errors are restored as
+// plain errors with the same message, and tag values as strings.
+func UnmarshalEvent(line []byte) (Event, error) {
+	var ev Event
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return ev, err
+	}
+
+	var version int
+	var kind, level, errMsg string
+	var ts string
+	var dur, at, blocked, active, cpu, baseline int64
+	var build *buildInfoJSON
+	var tags json.RawMessage
+	var events []struct {
+		At  int64  `json:"at"`
+		Msg string `json:"msg"`
+	}
+	var checkpoints []struct {
+		Name string `json:"name"`
+		At   int64  `json:"at"`
+		Dur  int64  `json:"dur"`
+	}
+	var ancestry []struct {
+		Name string          `json:"name"`
+		Msg  string          `json:"msg"`
+		Tags json.RawMessage `json:"tags"`
+	}
+	var segments []struct {
+		At  int64  `json:"at"`
+		Dur int64  `json:"dur"`
+		TID uint64 `json:"tid"`
+	}
+	var progress *struct {
+		Done  int64 `json:"done"`
+		Total int64 `json:"total"`
+	}
+	var logged struct {
+		Lines uint64 `json:"lines"`
+		Bytes uint64 `json:"bytes"`
+	}
+	var runtime *struct {
+		GC         uint64    `json:"gc"`
+		Pause      int64     `json:"pause"`
+		Goroutines [2]uint64 `json:"goroutines"`
+	}
+	var budget, injected *int64
+	var percent *int
+	var panicked *struct {
+		Value string `json:"value"`
+		Type  string `json:"type"`
+		Stack []struct {
+			Fn   string `json:"fn"`
+			File string `json:"file"`
+			Line int    `json:"line"`
+		} `json:"stack"`
+	}
+	known := map[string]interface{}{
+		FieldVersion:  &version,
+		FieldKind:     &kind,
+		FieldTime:     &ts,
+		FieldTID:      &ev.TID,
+		FieldDepth:    &ev.Depth,
+		FieldTrace:    &ev.TraceID,
+		FieldSpan:     &ev.SpanID,
+		FieldParent:   &ev.ParentID,
+		FieldSession:  &ev.Session,
+		FieldReplayed: &ev.Replayed,
+		FieldLevel:    &level,
+		FieldName:     &ev.Name,
+		FieldMsg:      &ev.Message,
+		FieldDur:      &dur,
+		FieldTags:     &tags,
+		FieldErr:      &errMsg,
+		FieldCtxErr:   &ev.CtxErr,
+		FieldEvents:   &events,
+		FieldAt:       &at,
+		FieldInFlight: &ev.InFlight,
+		FieldCallers:  &ev.Callers,
+		FieldHidden:   &ev.HiddenCalls,
+		FieldExtra:    &ev.ExtraFields,
+
+		FieldCheckpoints: &checkpoints,
+		FieldBlocked:     &blocked,
+		FieldActive:      &active,
+		FieldSegments:    &segments,
+		FieldApprox:      &ev.Approximate,
+		FieldStack:       &ev.Stack,
+		FieldAncestry:    &ancestry,
+		FieldProgress:    &progress,
+		FieldRuntime:     &runtime,
+		FieldLogged:      &logged,
+		FieldOwners:      &ev.Owners,
+		FieldRestored:    &ev.Restored,
+		FieldPanic:       &panicked,
+		FieldBudget:      &budget,
+		FieldInjected:    &injected,
+		FieldAttached:    &ev.Attached,
+		FieldCPU:         &cpu,
+		FieldCPUApprox:   &ev.CPUApprox,
+		FieldBuildInfo:   &build,
+		FieldPercent:     &percent,
+		FieldBaseline:    &baseline,
+		FieldSeq:         &ev.Seq,
+		FieldOrigName:    &ev.OriginalName,
+		FieldAbandoned:   &ev.Abandoned,
+		FieldOperation:   &ev.Operation,
+		FieldPinned:      &ev.Pinned,
+	}
+	for key, raw := range fields {
+		target, ok := known[key]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(raw, target); err != nil {
+			return ev, fmt.Errorf("bad %q field: %v", key, err)
+		}
+	}
+	if version > SchemaVersion {
+		return ev, fmt.Errorf("schema version %d is newer than %d", version, SchemaVersion)
+	}
+	for key, raw := range fields {
+		if _, ok := known[key]; !ok {
+			if ev.ExtraFields == nil {
+				ev.ExtraFields = make(map[string]interface{})
+			}
+			var v interface{}
+			json.Unmarshal(raw, &v)
+			ev.ExtraFields[key] = v
+		}
+	}
+
+	ev.Cancelled = ev.CtxErr != ""
+	switch kind {
+	case "enter":
+		ev.Kind = EnterEvent
+	case "exit":
+		ev.Kind = ExitEvent
+		ev.Duration = time.Duration(dur)
+		ev.BlockedApprox = time.Duration(blocked)
+		ev.CPUTime = time.Duration(cpu)
+		ev.Active = time.Duration(active)
+	case "event":
+		ev.Kind = PointEvent
+		ev.Duration = time.Duration(at)
+	case "session":
+		ev.Kind = SessionEvent
+	default:
+		return ev, fmt.Errorf("not an event: kind %q", kind)
+	}
+	if ts != "" {
+		var err error
+		if ev.Time, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return ev, fmt.Errorf("bad %q field: %v", FieldTime, err)
+		}
+	}
+	switch level {
+	case "debug":
+		ev.Level = Debug
+	case "info":
+		ev.Level = Info
+	}
+	if errMsg != "" {
+		ev.Err = errors.New(errMsg)
+	}
+	if len(tags) > 0 {
+		var err error
+		if ev.Tags, err = decodeTags(tags); err != nil {
+			return ev, fmt.Errorf("bad %q field: %v", FieldTags, err)
+		}
+	}
+	for _, e := range events {
+		ev.Events = append(ev.Events, SpanEvent{time.Duration(e.At), e.Msg})
+	}
+	if progress != nil {
+		ev.Progress = &Progress{progress.Done, progress.Total}
+	}
+	ev.LoggedLines, ev.LoggedBytes = logged.Lines, logged.Bytes
+	if runtime != nil {
+		ev.Runtime = &RuntimeDelta{runtime.GC, time.Duration(runtime.Pause), runtime.Goroutines[0], runtime.Goroutines[1]}
+	}
+	for _, a := range ancestry {
+		summary := SpanSummary{Name: a.Name, Message: a.Msg}
+		if len(a.Tags) > 0 {
+			var err error
+			if summary.Tags, err = decodeTags(a.Tags); err != nil {
+				return ev, fmt.Errorf("bad %q field: %v", FieldAncestry, err)
+			}
+		}
+		ev.Ancestry = append(ev.Ancestry, summary)
+	}
+	if budget != nil {
+		ev.Budget = &Budget{time.Duration(*budget)}
+	}
+	ev.Build = build.buildInfo()
+	if injected != nil {
+		ev.Injected = time.Duration(*injected)
+	}
+	ev.Baseline = time.Duration(baseline)
+	if _, ok := fields[FieldPercent]; ok {
+		// null for the top-level exit of a tree too large to tell
+		if percent != nil {
+			ev.Percent, ev.HasPercent = *percent, true
+		} else {
+			ev.PercentOmitted = true
+		}
+	}
+	if panicked != nil {
+		ev.PanicValue, ev.PanicType = panicked.Value, panicked.Type
+		for _, f := range panicked.Stack {
+			ev.PanicStack = append(ev.PanicStack, Frame{f.Fn, f.File, f.Line})
+		}
+	}
+	for _, seg := range segments {
+		ev.Segments = append(ev.Segments, Segment{time.Duration(seg.At), time.Duration(seg.Dur), seg.TID})
+	}
+	for _, cp := range checkpoints {
+		ev.Checkpoints = append(ev.Checkpoints, Checkpoint{cp.Name, time.Duration(cp.At), time.Duration(cp.Dur)})
+	}
+	return ev, nil
+}
+
+// Decodes the tags object, keeping the tags in the order they were
+// written in
+func decodeTags(raw json.RawMessage) ([]Tag, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	var tags []Tag
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value string
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		tags = append(tags, Tag{key.(string), value})
+	}
+	return tags, nil
+}
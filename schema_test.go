@@ -0,0 +1,72 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaVersionString(test *testing.T) {
+	assert.Equal(test, strconv.Itoa(SchemaVersion), schemaVersionString)
+}
+
+func TestUnmarshalEventRoundTrip(test *testing.T) {
+	events := []Event{
+		{
+			Kind: EnterEvent, Time: time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC), TID: 7, Depth: 0,
+			TraceID: "t1", SpanID: "s1", Level: Debug, Name: "main.run", Message: "run",
+			Callers: []string{"main.main"}, InFlight: 2,
+		},
+		{
+			Kind: ExitEvent, Time: time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC), TID: 7, Depth: 1,
+			TraceID: "t1", SpanID: "s2", ParentID: "s1", Name: "main.foo", Message: "foo",
+			Duration: 1250, Tags: []Tag{{"z", "1"}, {"a", "two"}}, Err: errors.New("timeout"),
+			Events:      []SpanEvent{{500, "cache miss"}},
+			ExtraFields: map[string]interface{}{"acme.shard": 3.0},
+		},
+		{Kind: PointEvent, Time: time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC), TID: 7, Depth: 2, Name: "main.foo", Message: "cache miss", Duration: 500},
+	}
+	for _, ev := range events {
+		var buf bytes.Buffer
+		renderJSON(&buf, &ev)
+		decoded, err := UnmarshalEvent(buf.Bytes())
+		assert.Nil(test, err)
+		assert.Equal(test, ev, decoded)
+	}
+}
+
+func TestUnmarshalEventOlderSchema(test *testing.T) {
+	// Written before versioning, ids and levels, with a field which the
+	// current schema does not know about
+	ev, err := UnmarshalEvent([]byte(`{"kind":"exit","time":"2020-01-02T03:04:05Z","tid":7,"depth":1,"name":"main.foo","msg":"foo","dur":1250,"host":"db-1"}`))
+	assert.Nil(test, err)
+	assert.Equal(test, Event{
+		Kind: ExitEvent, Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), TID: 7, Depth: 1,
+		Name: "main.foo", Message: "foo", Duration: 1250,
+		ExtraFields: map[string]interface{}{"host": "db-1"},
+	}, ev)
+}
+
+func TestUnmarshalEventErrors(test *testing.T) {
+	_, err := UnmarshalEvent([]byte(`{"v":2,"kind":"exit"}`))
+	assert.EqualError(test, err, "schema version 2 is newer than 1")
+	_, err = UnmarshalEvent([]byte(`{"v":1,"kind":"note","msg":"TRACE QUOTA REACHED"}`))
+	assert.EqualError(test, err, `not an event: kind "note"`)
+	_, err = UnmarshalEvent([]byte(`{"v":1,"kind":"exit","dur":"long"}`))
+	assert.NotNil(test, err)
+	_, err = UnmarshalEvent([]byte(`not json`))
+	assert.NotNil(test, err)
+}
+
+func TestSpanSetExtra(test *testing.T) {
+	var js bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &js, Format: JSONFormat}}})
+	span := t.Start("%s", "x")
+	span.SetExtra("acme.shard", 3)
+	span.End()
+	assert.Contains(test, js.String(), `,"x":{"acme.shard":3}}`)
+}
@@ -0,0 +1,138 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeq(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out, Format: JSONFormat}}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				t.StartNamed("work").End()
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]bool)
+	last := make(map[uint64]uint64)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		assert.False(test, seen[ev.Seq], "seq %d is not unique", ev.Seq)
+		seen[ev.Seq] = true
+		// In the order of the events of each goroutine
+		assert.Greater(test, ev.Seq, last[ev.TID])
+		last[ev.TID] = ev.Seq
+	}
+	assert.Len(test, seen, 8*50*2)
+	assert.True(test, seen[1])
+	assert.True(test, seen[8*50*2])
+}
+
+func TestSeqEncodings(test *testing.T) {
+	ev := Event{Kind: ExitEvent, Name: "f", Message: strings.Repeat("m", 300), Seq: 1 << 40}
+	var buf bytes.Buffer
+	renderJSON(&buf, &ev)
+	assert.Contains(test, buf.String(), `"seq":1099511627776`)
+	decoded, err := UnmarshalEvent(buf.Bytes())
+	assert.Nil(test, err)
+	assert.Equal(test, ev.Seq, decoded.Seq)
+
+	buf.Reset()
+	renderBinary(&buf, &ev)
+	decoded, ok := decodeBinary(buf.Bytes())
+	assert.True(test, ok)
+	assert.Equal(test, ev.Seq, decoded.Seq)
+
+	// Records without a number keep the room for the strings
+	ev.Seq = 0
+	buf.Reset()
+	renderBinary(&buf, &ev)
+	unnumbered, ok := decodeBinary(buf.Bytes())
+	assert.True(test, ok)
+	assert.Equal(test, uint64(0), unnumbered.Seq)
+	assert.Greater(test, len(unnumbered.Message), len(decoded.Message))
+}
+
+func TestReadSessionBySeq(test *testing.T) {
+	lines := []string{
+		`{"v":1,"kind":"exit","time":"2020-01-01T00:00:00Z","tid":1,"depth":0,"seq":2,"name":"a","msg":"a"}`,
+		`{"v":1,"kind":"enter","time":"2020-01-01T00:00:00Z","tid":1,"depth":0,"seq":1,"name":"a","msg":"a"}`,
+	}
+	events, err := readSession(strings.NewReader(strings.Join(lines, "\n")), "session")
+	assert.Nil(test, err)
+	assert.Equal(test, []EventKind{EnterEvent, ExitEvent}, []EventKind{events[0].Kind, events[1].Kind})
+
+	// Left as written unless every event is numbered
+	lines[1] = strings.Replace(lines[1], `"seq":1,`, "", 1)
+	events, err = readSession(strings.NewReader(strings.Join(lines, "\n")), "session")
+	assert.Nil(test, err)
+	assert.Equal(test, []EventKind{ExitEvent, EnterEvent}, []EventKind{events[0].Kind, events[1].Kind})
+}
+
+func TestHandlerEmission(test *testing.T) {
+	var seqs []uint64
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &lockedBuffer{}}}, EventHandler: func(ev Event) {
+		seqs = append(seqs, ev.Seq)
+	}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				t.StartNamed("work").End()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Called one at a time, in the order of the numbers
+	assert.Len(test, seqs, 8*50*2)
+	for i := 1; i < len(seqs); i++ {
+		assert.Greater(test, seqs[i], seqs[i-1])
+	}
+}
+
+func TestHandlerDelivery(test *testing.T) {
+	var mu sync.Mutex
+	last := make(map[uint64]uint64)
+	count, onTraced := 0, 0
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &lockedBuffer{}}}, HandlerOrdering: Delivery, EventHandler: func(ev Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		// In the order of the events of each goroutine
+		assert.Greater(test, ev.Seq, last[ev.TID])
+		last[ev.TID] = ev.Seq
+		count++
+		if getGID() == ev.TID {
+			onTraced++
+		}
+	}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				t.StartNamed("work").End()
+			}
+		}()
+	}
+	wg.Wait()
+	t.Flush()
+
+	assert.Equal(test, 8*50*2, count)
+	assert.Equal(test, 0, onTraced)
+}
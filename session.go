@@ -0,0 +1,277 @@
+package tracey
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A FuncDelta compares the calls to a single function in two sessions.
+type FuncDelta struct {
+	Name string
+
+	CallsA, CallsB uint64
+	TotalA, TotalB time.Duration
+
+	// Whether the durations of the calls are known on each side, which
+	// they are not when a session has no exit events for the function or
+	// was recorded without instrumentation
+	TimedA, TimedB bool
+}
+
+// Added returns true if the function was only called in the second session.
+func (d FuncDelta) Added() bool { return d.CallsA == 0 }
+
+// Removed returns true if the function was only called in the first session.
+func (d FuncDelta) Removed() bool { return d.CallsB == 0 }
+
+// Timed returns true if the durations of both sides are known.
+func (d FuncDelta) Timed() bool { return d.TimedA && d.TimedB && !d.Added() && !d.Removed() }
+
+// MeanA returns the average duration of the calls in the first session.
+func (d FuncDelta) MeanA() time.Duration { return mean(d.TotalA, d.CallsA) }
+
+// MeanB returns the average duration of the calls in the second session.
+func (d FuncDelta) MeanB() time.Duration { return mean(d.TotalB, d.CallsB) }
+
+// MeanChange returns how much slower (or faster if negative) the average
+// call got, and by what percentage of the first session's average.
+func (d FuncDelta) MeanChange() (time.Duration, float64) {
+	change := d.MeanB() - d.MeanA()
+	if d.MeanA() == 0 {
+		if change == 0 {
+			return 0, 0
+		}
+		return change, math.Inf(1)
+	}
+	return change, 100 * float64(change) / float64(d.MeanA())
+}
+
+func mean(total time.Duration, calls uint64) time.Duration {
+	if calls == 0 {
+		return 0
+	}
+	return total / time.Duration(calls)
+}
+
+// A SessionDiff compares two sessions, function by function.
+type SessionDiff struct {
+	// Sorted by name
+	Funcs []FuncDelta
+
+	// The builds the sessions come from, as their first session header
+	// tells, or nil if they have none or it is unavailable, see
+	// "SessionID"
+	BuildA, BuildB *BuildInfo
+}
+
+// CompareSessions compares the calls of two sessions, such as those
+// decoded by `UnmarshalEvent(...)` or `ReadMMapTrace(...)`, "a" being the
+// baseline. Functions are matched by name, without their package path.
+// Calls are counted from exit events, or from enter events for functions
+// which have none.
+func CompareSessions(a, b []Event) SessionDiff {
+	type side struct {
+		enters, exits uint64
+		total         time.Duration
+	}
+	tally := func(events []Event) map[string]*side {
+		sides := make(map[string]*side)
+		for i := range events {
+			ev := &events[i]
+			if ev.Kind == PointEvent || ev.Kind == SessionEvent {
+				continue
+			}
+			name := cleanFnName(ev.Name)
+			s := sides[name]
+			if s == nil {
+				s = &side{}
+				sides[name] = s
+			}
+			if ev.Kind == EnterEvent {
+				s.enters++
+			} else {
+				s.exits++
+				s.total += ev.Duration
+			}
+		}
+		return sides
+	}
+	sidesA, sidesB := tally(a), tally(b)
+
+	byName := make(map[string]*FuncDelta)
+	delta := func(name string) *FuncDelta {
+		d := byName[name]
+		if d == nil {
+			d = &FuncDelta{Name: name}
+			byName[name] = d
+		}
+		return d
+	}
+	for name, s := range sidesA {
+		d := delta(name)
+		d.CallsA, d.TotalA, d.TimedA = s.enters, s.total, s.exits > 0 && s.total > 0
+		if s.exits > 0 {
+			d.CallsA = s.exits
+		}
+	}
+	for name, s := range sidesB {
+		d := delta(name)
+		d.CallsB, d.TotalB, d.TimedB = s.enters, s.total, s.exits > 0 && s.total > 0
+		if s.exits > 0 {
+			d.CallsB = s.exits
+		}
+	}
+
+	diff := SessionDiff{BuildA: sessionBuild(a), BuildB: sessionBuild(b)}
+	for _, d := range byName {
+		diff.Funcs = append(diff.Funcs, *d)
+	}
+	sort.Slice(diff.Funcs, func(i, j int) bool { return diff.Funcs[i].Name < diff.Funcs[j].Name })
+	return diff
+}
+
+// Returns the build of the first session header of the events, if any
+func sessionBuild(events []Event) *BuildInfo {
+	for i := range events {
+		if events[i].Kind == SessionEvent {
+			return events[i].Build
+		}
+	}
+	return nil
+}
+
+// Strips the package path from a function name, as in "pkg.Func"
+func cleanFnName(name string) string {
+	name = strings.TrimSpace(name)
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// DiffOptions select which changes `WriteSessionDiff(...)` shows.
+type DiffOptions struct {
+	// Changes in the average call which are at least either of these are
+	// shown, the others are left out. When neither is set, every change
+	// is shown.
+	MinPercent float64
+	MinChange  time.Duration
+
+	// Setting "ShowAll" to "true" shows unchanged functions as well
+	ShowAll bool
+}
+
+// Returns true if the change passes either of the thresholds which are set
+func (o DiffOptions) significant(change time.Duration, percent float64) bool {
+	if change == 0 {
+		return false
+	}
+	if o.MinPercent <= 0 && o.MinChange <= 0 {
+		return true
+	}
+	return (o.MinPercent > 0 && math.Abs(percent) >= o.MinPercent) ||
+		(o.MinChange > 0 && (change >= o.MinChange || -change >= o.MinChange))
+}
+
+// WriteSessionDiff writes the diff as a table, regressions first (the
+// largest first), then improvements, then functions which only one side
+// called, and those only one side has durations of. The table follows the
+// builds of the sessions, as in "A: myapp v1.4.2 (rev 9f3ac1e) go1.22.1",
+// when either is known.
+func WriteSessionDiff(w io.Writer, d SessionDiff, opts DiffOptions) error {
+	type row struct {
+		delta   FuncDelta
+		group   int
+		percent float64
+		cells   string
+	}
+	var rows []row
+	for _, fd := range d.Funcs {
+		calls := countCell(fd.CallsA) + " → " + countCell(fd.CallsB)
+		switch {
+		case fd.Added():
+			rows = append(rows, row{fd, 2, 0, calls + "\t- → " + meanCell(fd.MeanB(), fd.TimedB) + "\tnew"})
+		case fd.Removed():
+			rows = append(rows, row{fd, 3, 0, calls + "\t" + meanCell(fd.MeanA(), fd.TimedA) + " → -\tgone"})
+		case !fd.Timed():
+			if fd.CallsA != fd.CallsB || opts.ShowAll {
+				rows = append(rows, row{fd, 4, 0, calls + "\t" + meanCell(fd.MeanA(), fd.TimedA) + " → " +
+					meanCell(fd.MeanB(), fd.TimedB) + "\tcalls only"})
+			}
+		default:
+			change, percent := fd.MeanChange()
+			significant := opts.significant(change, percent)
+			if !significant && !opts.ShowAll {
+				continue
+			}
+			verdict, group := "", 1
+			if change > 0 {
+				group = 0
+			}
+			if significant {
+				verdict = " faster"
+				if change > 0 {
+					verdict = " SLOWER"
+				}
+			}
+			sign := "+"
+			if change < 0 {
+				sign = "-"
+			}
+			rows = append(rows, row{fd, group, percent, calls + "\t" + formatDuration(fd.MeanA()) + " → " +
+				formatDuration(fd.MeanB()) + "\t" + sign + strconv.FormatFloat(math.Abs(percent), 'f', 1, 64) + "% (" +
+				sign + formatDuration(absDuration(change)) + ")" + verdict})
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].group != rows[j].group {
+			return rows[i].group < rows[j].group
+		}
+		if rows[i].group == 0 {
+			return rows[i].percent > rows[j].percent
+		}
+		if rows[i].group == 1 {
+			return rows[i].percent < rows[j].percent
+		}
+		return false
+	})
+
+	if d.BuildA != nil || d.BuildB != nil {
+		if _, err := fmt.Fprintf(w, "A: %s\nB: %s\n\n", d.BuildA, d.BuildB); err != nil {
+			return err
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FUNCTION\tCALLS\tMEAN\tCHANGE")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\n", r.delta.Name, r.cells)
+	}
+	return tw.Flush()
+}
+
+func countCell(n uint64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatUint(n, 10)
+}
+
+func meanCell(d time.Duration, timed bool) string {
+	if !timed {
+		return "?"
+	}
+	return formatDuration(d)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,105 @@
+package tracey
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Builds a session of "n" calls to the function, each taking "d"
+func sessionCalls(name string, n int, d time.Duration) []Event {
+	var events []Event
+	for i := 0; i < n; i++ {
+		events = append(events, Event{Kind: EnterEvent, Name: name}, Event{Kind: ExitEvent, Name: name, Duration: d})
+	}
+	return events
+}
+
+func concatSessions(sessions ...[]Event) []Event {
+	var events []Event
+	for _, s := range sessions {
+		events = append(events, s...)
+	}
+	return events
+}
+
+func TestCompareSessions(test *testing.T) {
+	enterOnly := func(name string, n int) []Event {
+		var events []Event
+		for i := 0; i < n; i++ {
+			events = append(events, Event{Kind: EnterEvent, Name: name})
+		}
+		return events
+	}
+	a := concatSessions(
+		sessionCalls("github.com/acme/app.slower", 10, time.Millisecond),
+		sessionCalls("app.faster", 4, 10*time.Millisecond),
+		sessionCalls("app.same", 3, time.Millisecond),
+		sessionCalls("app.tiny", 3, 100*time.Microsecond),
+		sessionCalls("app.gone", 2, time.Millisecond),
+		enterOnly("app.untimed", 5),
+		[]Event{{Kind: PointEvent, Name: "app.same", Message: "ignored"}},
+	)
+	b := concatSessions(
+		sessionCalls("app.slower", 5, 3*time.Millisecond),
+		sessionCalls("app.faster", 8, 2*time.Millisecond),
+		sessionCalls("app.same", 6, time.Millisecond),
+		sessionCalls("app.tiny", 3, 110*time.Microsecond),
+		sessionCalls("app.new", 1, time.Second),
+		enterOnly("app.untimed", 7),
+	)
+	diff := CompareSessions(a, b)
+
+	assert.Equal(test, []FuncDelta{
+		{Name: "app.faster", CallsA: 4, CallsB: 8, TotalA: 40 * time.Millisecond, TotalB: 16 * time.Millisecond, TimedA: true, TimedB: true},
+		{Name: "app.gone", CallsA: 2, TotalA: 2 * time.Millisecond, TimedA: true},
+		{Name: "app.new", CallsB: 1, TotalB: time.Second, TimedB: true},
+		{Name: "app.same", CallsA: 3, CallsB: 6, TotalA: 3 * time.Millisecond, TotalB: 6 * time.Millisecond, TimedA: true, TimedB: true},
+		{Name: "app.slower", CallsA: 10, CallsB: 5, TotalA: 10 * time.Millisecond, TotalB: 15 * time.Millisecond, TimedA: true, TimedB: true},
+		{Name: "app.tiny", CallsA: 3, CallsB: 3, TotalA: 300 * time.Microsecond, TotalB: 330 * time.Microsecond, TimedA: true, TimedB: true},
+		{Name: "app.untimed", CallsA: 5, CallsB: 7},
+	}, diff.Funcs)
+
+	change, percent := diff.Funcs[4].MeanChange()
+	assert.Equal(test, 2*time.Millisecond, change)
+	assert.Equal(test, 200.0, percent)
+	assert.True(test, diff.Funcs[2].Added())
+	assert.True(test, diff.Funcs[1].Removed())
+	assert.False(test, diff.Funcs[6].Timed())
+}
+
+func TestWriteSessionDiff(test *testing.T) {
+	a := concatSessions(
+		sessionCalls("app.slower", 10, time.Millisecond),
+		sessionCalls("app.muchSlower", 1, time.Millisecond),
+		sessionCalls("app.faster", 4, 10*time.Millisecond),
+		sessionCalls("app.same", 3, time.Millisecond),
+		sessionCalls("app.tiny", 3, 100*time.Microsecond),
+		sessionCalls("app.gone", 2, time.Millisecond),
+	)
+	b := concatSessions(
+		sessionCalls("app.slower", 5, 3*time.Millisecond),
+		sessionCalls("app.muchSlower", 1, 5*time.Millisecond),
+		sessionCalls("app.faster", 8, 2*time.Millisecond),
+		sessionCalls("app.same", 6, time.Millisecond),
+		sessionCalls("app.tiny", 3, 101*time.Microsecond),
+		sessionCalls("app.new", 1, time.Second),
+	)
+
+	var buf bytes.Buffer
+	assert.Nil(test, WriteSessionDiff(&buf, CompareSessions(a, b), DiffOptions{MinPercent: 5, MinChange: time.Millisecond}))
+	assert.Equal(test, `FUNCTION        CALLS   MEAN            CHANGE
+app.muchSlower  1 → 1   1.0ms → 5.0ms   +400.0% (+4.0ms) SLOWER
+app.slower      10 → 5  1.0ms → 3.0ms   +200.0% (+2.0ms) SLOWER
+app.faster      4 → 8   10.0ms → 2.0ms  -80.0% (-8.0ms) faster
+app.new         - → 1   - → 1.0s        new
+app.gone        2 → -   1.0ms → -       gone
+`, buf.String())
+
+	buf.Reset()
+	assert.Nil(test, WriteSessionDiff(&buf, CompareSessions(a, b), DiffOptions{MinPercent: 5, ShowAll: true}))
+	assert.Contains(test, buf.String(), "app.tiny        3 → 3   100.0µs → 101.0µs  +1.0% (+1.0µs)\n")
+	assert.Contains(test, buf.String(), "app.same        3 → 6   1.0ms → 1.0ms")
+}
@@ -0,0 +1,394 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Format selects how a sink renders events.
+type Format int
+
+const (
+	// The classic "[ 0]ENTER: ..." lines
+	TextFormat Format = iota
+
+	// One JSON object per line, see `renderJSON(...)`
+	JSONFormat
+
+	// Fixed-size binary records, see `MMapSink(...)`. Sinks in this format
+	// receive events only, never warnings and such.
+	BinaryFormat
+)
+
+func (f Format) String() string {
+	switch f {
+	case JSONFormat:
+		return "json"
+	case BinaryFormat:
+		return "binary"
+	}
+	return "text"
+}
+
+// A Sink is one destination for the tracer's output. Every event is built
+// once by the tracer, and then rendered and filtered by each sink on its
+// own, so that for instance developers get colored text on stderr while
+// JSON goes to a file.
+type Sink struct {
+
+	// Where the output goes. Exactly one of "Writer", "Logger" or "Open"
+	// should be set, writes to a "Writer" are serialized by tracey.
+	// Setting "Open" opens the writer on the first write rather than
+	// upfront, such as a file which may not be writable yet, a failure to
+	// open it counting as a failed write (see "SinkFailureThreshold") until
+	// it opens.
+	Writer io.Writer
+	Logger *log.Logger
+	Open   func() (io.Writer, error)
+
+	// How events are rendered, the default value is TextFormat.
+	Format Format
+
+	// Setting "MinDuration" will cause the sink to only receive exits of
+	// functions which took at least that long. Since an enter happens
+	// before its duration is known, such sinks never receive enters.
+	MinDuration time.Duration
+
+	// Setting "MinLevel" will cause the sink to only receive the calls of
+	// at least that level, on top of the tracer's "MinLevel", so that for
+	// instance debug calls go to a file but not to stderr. The default
+	// value of `Trace` lets every call through.
+	MinLevel Level
+
+	// Setting "Colorize" to "true" will color the enter and exit messages
+	// with ANSI escapes. It only applies to TextFormat.
+	Colorize bool
+
+	// Setting "Async" to "true" will cause the sink to be written to from
+	// a goroutine of its own, so that a slow writer does not hold up the
+	// traced code. Lines are queued per goroutine, up to "AsyncBufferBytes"
+	// in all (`DefaultAsyncBufferBytes` if 0), and the queues take turns
+	// so that a chatty goroutine cannot starve the others: once the buffer
+	// is full, the lines dropped are those of the goroutines which have
+	// more than their share of it queued. The lines of each goroutine are
+	// written in order, but lines of different goroutines may be written
+	// in another order than they were traced in. Setting "PriorityFunc"
+	// weighs the turns, a goroutine whose latest event has priority N
+	// getting N lines written per turn (1 at least). `Flush()` waits for
+	// the queues to drain, and logs the lines dropped per goroutine.
+	Async            bool
+	AsyncBufferBytes int
+	PriorityFunc     func(Event) int
+
+	// Setting "Audit" to "true" will cause the sink to receive the exits
+	// of every span which failed, whichever sinks "Router" routes them
+	// to, so that no error goes unrecorded.
+	Audit bool
+}
+
+// A SinkError summarizes the failed writes to a single sink.
+type SinkError struct {
+	Count uint64
+	Last  error
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("%d failed writes, last: %v", e.Count, e.Last)
+}
+
+func (e *SinkError) Unwrap() error {
+	return e.Last
+}
+
+// A sink along with its bookkeeping
+type sinkState struct {
+	Sink
+
+	sync.Mutex
+	lastErr error
+
+	// Counted atomically, see `SinkHealth()`
+	failed, fellBack, dropped uint64
+
+	// Set while the lines fall back, see "SinkFailureThreshold", along
+	// with the writes failed in a row, when to try the sink again and how
+	// many lines had fallen back before
+	fallingBack uint32
+	fallback    *sinkFallback
+	consecutive int32
+	retryAt     time.Time
+	fellBackAt  uint64
+
+	// Set if the writer serializes its writes by itself
+	lockFree bool
+
+	// Set for "Async" sinks
+	async *asyncQueue
+
+	// The position of the sink, that of its "MinDuration" and "MinLevel"
+	// in the mutable options
+	index int
+
+	// Set if the writer never calls back into tracey, and the records of
+	// the goroutines which writes are guarded in otherwise
+	safeWriter bool
+	guard      *goroutines
+}
+
+// Implemented by writers which are safe for concurrent use and would
+// rather not have their writes serialized
+type lockFreeWriter interface {
+	io.Writer
+	lockFree()
+}
+
+// Returns true if the sink wants to receive the event
+func (s *sinkState) accepts(ev *Event) bool {
+	minDuration, minLevel := s.MinDuration, s.MinLevel
+	if ev.config != nil {
+		minDuration, minLevel = ev.config.MinDurations[s.index], ev.config.MinLevels[s.index]
+	}
+	if ev.overrides != nil && ev.overrides.MinDuration != nil {
+		minDuration = *ev.overrides.MinDuration
+	}
+	if ev.overrides != nil && ev.overrides.MinLevel != nil {
+		minLevel = *ev.overrides.MinLevel
+	}
+	if ev.Level < minLevel {
+		return false
+	}
+	if ev.route != nil && !ev.route.takes(s, ev) {
+		return false
+	}
+	if minDuration > 0 {
+		return ev.Kind == ExitEvent && ev.Duration >= minDuration
+	}
+	return true
+}
+
+func (s *sinkState) render(t *Tracer, buf *bytes.Buffer, ev *Event) {
+	switch s.Format {
+	case JSONFormat:
+		renderJSON(buf, ev)
+	case BinaryFormat:
+		renderBinary(buf, ev)
+	default:
+		t.renderText(buf, ev, s.Colorize)
+	}
+}
+
+// Writes a rendered line, recording rather than returning any error so
+// that a failing sink does not affect the others. Unless the writer is
+// known not to, the spans it enters meanwhile are not traced: "gid" is
+// the id of the calling goroutine, or 0 if it is not known yet.
+func (s *sinkState) write(gid uint64, p []byte) {
+	if s.guard != nil && s.mayReenter() {
+		if gid == 0 {
+			gid = getGID()
+		}
+		defer s.guard.endOutput(gid, s.guard.beginOutput(gid))
+	}
+	if atomic.LoadUint32(&s.fallingBack) != 0 {
+		s.writeFallingBack(p)
+	} else if err := s.writeSink(p); err != nil {
+		s.writeFailed(err, p)
+	} else if atomic.LoadInt32(&s.consecutive) != 0 {
+		atomic.StoreInt32(&s.consecutive, 0)
+	}
+}
+
+// Writes a rendered line to the sink itself, opening it first if it is
+// opened lazily and was not yet
+func (s *sinkState) writeSink(p []byte) error {
+	if s.Logger != nil {
+		return s.Logger.Output(2, string(p))
+	}
+	if s.lockFree {
+		_, err := s.Writer.Write(p)
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.Writer == nil {
+		w, err := s.Open()
+		if err != nil {
+			return err
+		}
+		s.Writer = w
+	}
+	_, err := s.Writer.Write(p)
+	return err
+}
+
+// Builds the sinks of a tracer, which default to just the "CustomLogger"
+func newSinks(options *Options) []*sinkState {
+	fallback := newSinkFallback(options)
+	if len(options.Sinks) == 0 {
+		return []*sinkState{{Sink: Sink{Logger: options.CustomLogger}, fallback: fallback}}
+	}
+	sinks := make([]*sinkState, len(options.Sinks))
+	for i, sink := range options.Sinks {
+		sinks[i] = &sinkState{Sink: sink, index: i, safeWriter: tracesNothing(sink.Writer), fallback: fallback}
+		_, sinks[i].lockFree = sink.Writer.(lockFreeWriter)
+		if sink.Async {
+			sinks[i].async = newAsyncQueue(sinks[i])
+		}
+	}
+	return sinks
+}
+
+// Renders the event once for every sink which accepts it, and writes it
+// out to them provided the quota allows it.
+func (t *Tracer) emit(ev *Event) {
+	t.emitTo(ev, (*sinkState).accepts)
+	if atomic.LoadInt32(&t.streams.count) > 0 {
+		t.streams.publish(t, ev)
+	}
+	if t.timeline != nil {
+		t.timeline.append(ev)
+	}
+	if ev.adopted != nil {
+		ev.adopted.emit(ev)
+	}
+}
+
+// Emits the event to the sinks "accepts" returns true for
+func (t *Tracer) emitTo(ev *Event, accepts func(*sinkState, *Event) bool) {
+	if ev.Session == "" {
+		ev.Session = t.options.SessionID
+	}
+	if ev.Build == nil && t.options.BuildInfoPerEvent {
+		ev.Build = t.build
+	}
+	if ev.config == nil {
+		ev.config = t.config.Load()
+	}
+	var stack [4]*bytes.Buffer
+	bufs := stack[:0]
+	lines, total := 0, 0
+	for _, s := range t.sinks {
+		var buf *bytes.Buffer
+		if accepts(s, ev) {
+			buf = getBuffer()
+			s.render(t, buf, ev)
+			lines++
+			total += buf.Len()
+		}
+		bufs = append(bufs, buf)
+	}
+
+	if lines > 0 && t.admitLines(lines, total) {
+		if t.options.TrackOutputVolume {
+			t.countOutput(ev.TID, lines, total)
+		}
+		for i, buf := range bufs {
+			if buf == nil {
+				continue
+			}
+			if s := t.sinks[i]; s.async != nil {
+				s.async.enqueue(ev.TID, ev, buf.Bytes())
+			} else {
+				s.write(ev.emitter, buf.Bytes())
+			}
+		}
+	}
+	for _, buf := range bufs {
+		if buf != nil {
+			putBuffer(buf)
+		}
+	}
+}
+
+// Emits an enter, exit or point event, unless "DeltaMode" skips it, or
+// "TailSampling", "SkipUnchanged" or "CollapseRepeats" withhold it
+func (t *Tracer) emitTraced(ev *Event) {
+	t.sequence(ev)
+	if ev.bundle != nil {
+		t.holdBundle(ev)
+	}
+	if t.options.DeltaMode && !t.deltaChanged(ev) {
+		return
+	}
+	if ev.tail != nil && t.holdTail(ev) {
+		return
+	}
+	t.emitSampled(ev)
+}
+
+// Emits an event which "TailSampling" kept, or which was never held
+func (t *Tracer) emitSampled(ev *Event) {
+	if t.changes != nil && t.options.SkipUnchanged && t.holdUnchanged(ev) {
+		return
+	}
+	t.emitCollapsed(ev)
+}
+
+func (t *Tracer) emitCollapsed(ev *Event) {
+	if !t.options.CollapseRepeats || !t.collapseRepeats(ev) {
+		t.emit(ev)
+	}
+}
+
+// Writes a line which is not an event, such as a warning, to every sink.
+func (t *Tracer) note(line string) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var gid uint64
+	for _, s := range t.sinks {
+		if s.renderNote(buf, line) {
+			if s.async != nil {
+				// Queued after the lines of the goroutine it is about
+				if gid == 0 {
+					gid = getGID()
+				}
+				s.async.enqueue(gid, nil, buf.Bytes())
+			} else {
+				s.write(0, buf.Bytes())
+			}
+		}
+	}
+}
+
+// Writes a line which is not an event to the sink, bypassing its queue
+// if it has one
+func (s *sinkState) writeNote(line string) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if s.renderNote(buf, line) {
+		s.write(0, buf.Bytes())
+	}
+}
+
+// Renders a line which is not an event, returns false if the sink does
+// not take any
+func (s *sinkState) renderNote(buf *bytes.Buffer, line string) bool {
+	buf.Reset()
+	switch s.Format {
+	case BinaryFormat:
+		return false
+	case JSONFormat:
+		renderJSONNote(buf, line)
+	default:
+		buf.WriteString(line)
+	}
+	return true
+}
+
+// SinkErrors returns, for each sink in order, a *SinkError summarizing the
+// writes to it which failed, or nil if every write succeeded.
+func (t *Tracer) SinkErrors() []error {
+	errs := make([]error, len(t.sinks))
+	for i, s := range t.sinks {
+		s.Lock()
+		if failed := atomic.LoadUint64(&s.failed); failed > 0 {
+			errs[i] = &SinkError{failed, s.lastErr}
+		}
+		s.Unlock()
+	}
+	return errs
+}
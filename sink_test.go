@@ -0,0 +1,145 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A writer which fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestSinksTextAndJSON(test *testing.T) {
+	var text, js bytes.Buffer
+	trace := New(&Options{Sinks: []Sink{
+		{Logger: log.New(&text, "", 0)},
+		{Writer: &js, Format: JSONFormat},
+	}})
+	func() {
+		defer trace("$FN says %s", "hi")()
+	}()
+
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	assert.Equal(test, 2, len(lines))
+	assert.True(test, strings.HasPrefix(lines[0], "[ 0]ENTER: [tid:"))
+	assert.True(test, strings.HasSuffix(lines[0], "]=>go-tracey.TestSinksTextAndJSON.func1 says hi"))
+
+	var events []map[string]interface{}
+	decoder := json.NewDecoder(&js)
+	for decoder.More() {
+		var ev map[string]interface{}
+		assert.Nil(test, decoder.Decode(&ev))
+		events = append(events, ev)
+	}
+	assert.Equal(test, 2, len(events))
+	assert.Equal(test, "enter", events[0]["kind"])
+	assert.Equal(test, "exit", events[1]["kind"])
+	assert.Equal(test, "go-tracey.TestSinksTextAndJSON.func1", events[1]["name"])
+	assert.Equal(test, "go-tracey.TestSinksTextAndJSON.func1 says hi", events[1]["msg"])
+	assert.Contains(test, events[1], "dur")
+	assert.NotContains(test, events[0], "dur")
+}
+
+func TestSinkMinDuration(test *testing.T) {
+	var all, slow bytes.Buffer
+	trace := New(&Options{Sinks: []Sink{
+		{Writer: &all},
+		{Writer: &slow, MinDuration: 20 * time.Millisecond},
+	}})
+	fast := func() {
+		defer trace("%s", "fast")()
+	}
+	sleepy := func() {
+		defer trace("%s", "sleepy")()
+		time.Sleep(25 * time.Millisecond)
+	}
+	fast()
+	sleepy()
+
+	assert.Equal(test, 4, strings.Count(all.String(), "\n"))
+	assert.Contains(test, all.String(), "fast")
+	assert.NotContains(test, slow.String(), "fast")
+	assert.Equal(test, 1, strings.Count(slow.String(), "\n"))
+	assert.Contains(test, slow.String(), "EXIT:  [tid:")
+	assert.Contains(test, slow.String(), "sleepy")
+}
+
+func TestSinkMinLevel(test *testing.T) {
+	var all, info bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{
+		{Writer: &all},
+		{Writer: &info, MinLevel: Info},
+	}})
+	func() { defer t.Enter(Debug, "%s", "lookup")() }()
+	func() { defer t.Enter(Info, "%s", "request")() }()
+
+	assert.Equal(test, 4, strings.Count(all.String(), "\n"))
+	assert.Contains(test, all.String(), "DBG [tid:")
+	assert.NotContains(test, info.String(), "lookup")
+	assert.Equal(test, 2, strings.Count(info.String(), "\n"))
+	assert.Contains(test, info.String(), "request")
+
+	// Updated along with the other mutable options
+	assert.Nil(test, t.Update(func(o *MutableOptions) { o.MinLevels[1] = Trace }))
+	info.Reset()
+	func() { defer t.Enter(Debug, "%s", "lookup")() }()
+	assert.Equal(test, 2, strings.Count(info.String(), "\n"))
+	assert.Equal(test, []Level{Trace, Trace}, t.CurrentOptions().MinLevels)
+}
+
+func TestSinkErrors(test *testing.T) {
+	var good bytes.Buffer
+	tracer := NewTracer(&Options{Sinks: []Sink{
+		{Writer: failingWriter{}},
+		{Writer: &good},
+	}, SinkErrorHandler: func(error) {}})
+	func() {
+		defer tracer.Enter()()
+	}()
+
+	assert.Equal(test, 2, strings.Count(good.String(), "\n"))
+	errs := tracer.SinkErrors()
+	assert.Equal(test, 2, len(errs))
+	assert.Nil(test, errs[1])
+
+	var sinkErr *SinkError
+	assert.True(test, errors.As(errs[0], &sinkErr))
+	assert.Equal(test, uint64(2), sinkErr.Count)
+	assert.Equal(test, "2 failed writes, last: disk full", errs[0].Error())
+}
+
+func TestSinkColorize(test *testing.T) {
+	var buf bytes.Buffer
+	trace := New(&Options{Sinks: []Sink{{Writer: &buf, Colorize: true}}, DisableDepthValue: true})
+	func() {
+		defer trace()()
+	}()
+	lines := strings.Split(buf.String(), "\n")
+	assert.True(test, strings.HasPrefix(lines[0], "\x1b[32mENTER: \x1b[0m[tid:"))
+	assert.True(test, strings.HasPrefix(lines[1], "\x1b[36mEXIT:  \x1b[0m[tid:"))
+}
+
+func benchmarkSinks(b *testing.B, n int) {
+	sinks := make([]Sink, n)
+	for i := range sinks {
+		sinks[i] = Sink{Writer: io.Discard}
+	}
+	trace := New(&Options{Sinks: sinks})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trace("$FN %d", i)()
+	}
+}
+
+func BenchmarkOneSink(b *testing.B)    { benchmarkSinks(b, 1) }
+func BenchmarkThreeSinks(b *testing.B) { benchmarkSinks(b, 3) }
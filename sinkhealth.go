@@ -0,0 +1,223 @@
+package tracey
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSinkFailureThreshold is how many writes to a sink must fail in a
+// row for its lines to fall back to the "FallbackWriter", when
+// "SinkFailureThreshold" is 0.
+const DefaultSinkFailureThreshold = 25
+
+// DefaultSinkRetryInterval is how often a sink whose lines fall back is
+// tried again, when "SinkRetryInterval" is 0.
+const DefaultSinkRetryInterval = 30 * time.Second
+
+// How often the default "SinkErrorHandler" warns at most
+const sinkWarningInterval = time.Minute
+
+// The health of a single sink, see `Tracer.SinkHealth()`.
+type SinkHealth struct {
+	// The writes to the sink which failed, opening it included, and the
+	// last error
+	Failed uint64
+	Last   error
+
+	// The lines written to the "FallbackWriter" instead of the sink, and
+	// those lost because not even it took them (or they were binary
+	// records, or failed before the lines started falling back)
+	FellBack uint64
+	Dropped  uint64
+
+	// Whether the lines of the sink are falling back right now
+	FallingBack bool
+}
+
+// Summarizes the health, as in "30 failed writes, 5 lines fell back, 25
+// dropped (falling back)"
+func (h SinkHealth) String() string {
+	s := strconv.FormatUint(h.Failed, 10) + " failed writes, " + strconv.FormatUint(h.FellBack, 10) + " lines fell back, " + strconv.FormatUint(h.Dropped, 10) + " dropped"
+	if h.FallingBack {
+		s += " (falling back)"
+	}
+	return s
+}
+
+// SinkHealth returns, for each sink in order, how its writes fared. The
+// lines of a sink stop being lost once "SinkFailureThreshold" writes to it
+// in a row have failed, as they fall back to the "FallbackWriter" then.
+func (t *Tracer) SinkHealth() []SinkHealth {
+	health := make([]SinkHealth, len(t.sinks))
+	for i, s := range t.sinks {
+		health[i] = s.health()
+		s.Lock()
+		health[i].Last = s.lastErr
+		s.Unlock()
+	}
+	return health
+}
+
+// The counters of the health of the sink, which take no lock
+func (s *sinkState) health() SinkHealth {
+	return SinkHealth{
+		Failed:      atomic.LoadUint64(&s.failed),
+		FellBack:    atomic.LoadUint64(&s.fellBack),
+		Dropped:     atomic.LoadUint64(&s.dropped),
+		FallingBack: atomic.LoadUint32(&s.fallingBack) != 0,
+	}
+}
+
+// Where the lines of the failing sinks of a tracer go, see
+// "SinkFailureThreshold"
+type sinkFallback struct {
+	sync.Mutex
+	w    io.Writer
+	name string
+
+	threshold int
+	retry     time.Duration
+	clock     func() time.Time
+	handle    func(error)
+}
+
+func newSinkFallback(options *Options) *sinkFallback {
+	fb := &sinkFallback{
+		w:         options.FallbackWriter,
+		name:      "FallbackWriter",
+		threshold: options.SinkFailureThreshold,
+		retry:     options.SinkRetryInterval,
+		clock:     options.Clock,
+		handle:    options.SinkErrorHandler,
+	}
+	if fb.w == nil {
+		fb.w = os.Stderr
+	}
+	if fb.w == os.Stderr {
+		fb.name = "stderr"
+	}
+	if fb.threshold == 0 {
+		fb.threshold = DefaultSinkFailureThreshold
+	}
+	if fb.retry <= 0 {
+		fb.retry = DefaultSinkRetryInterval
+	}
+	if fb.handle == nil {
+		fb.handle = warnSinkErrors(os.Stderr)
+	}
+	return fb
+}
+
+// Returns the default "SinkErrorHandler", which writes the first error to
+// "w" and then at most one every `sinkWarningInterval`
+func warnSinkErrors(w io.Writer) func(error) {
+	var mu sync.Mutex
+	var next time.Time
+	var skipped int
+	return func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		if now.Before(next) {
+			skipped++
+			return
+		}
+		next = now.Add(sinkWarningInterval)
+		if skipped > 0 {
+			fmt.Fprintf(w, "tracey: %v (and %d more sink errors)\n", err, skipped)
+		} else {
+			fmt.Fprintf(w, "tracey: %v\n", err)
+		}
+		skipped = 0
+	}
+}
+
+// Writes a line to the fallback writer, or counts it as dropped
+func (fb *sinkFallback) write(s *sinkState, p []byte) {
+	if s.Format == BinaryFormat {
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+	fb.Lock()
+	_, err := fb.w.Write(p)
+	fb.Unlock()
+	if err != nil {
+		atomic.AddUint64(&s.dropped, 1)
+	} else {
+		atomic.AddUint64(&s.fellBack, 1)
+	}
+}
+
+// Counts a failed write of the line to the sink, and falls back once
+// enough writes failed in a row
+func (s *sinkState) writeFailed(err error, p []byte) {
+	fb := s.fallback
+	atomic.AddUint64(&s.failed, 1)
+	failures := atomic.AddInt32(&s.consecutive, 1)
+	s.Lock()
+	s.lastErr = err
+	trip := fb.threshold > 0 && int(failures) >= fb.threshold && atomic.CompareAndSwapUint32(&s.fallingBack, 0, 1)
+	if trip {
+		s.retryAt = fb.clock().Add(fb.retry)
+		s.fellBackAt = atomic.LoadUint64(&s.fellBack)
+	}
+	s.Unlock()
+	fb.handle(fmt.Errorf("writing to sink %d: %w", s.index, err))
+	if !trip {
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+	fb.Lock()
+	fmt.Fprintf(fb.w, "— output falling back to %s after %d write errors —\n", fb.name, failures)
+	fb.Unlock()
+	fb.write(s, p)
+}
+
+// Writes a line of a sink whose lines fall back, trying the sink again
+// once "SinkRetryInterval" has passed, and switching back to it if the
+// marker of the switch can be written to it
+func (s *sinkState) writeFallingBack(p []byte) {
+	fb := s.fallback
+	s.Lock()
+	now := fb.clock()
+	retry := !now.Before(s.retryAt)
+	if retry {
+		s.retryAt = now.Add(fb.retry)
+	}
+	fellBack := atomic.LoadUint64(&s.fellBack) - s.fellBackAt
+	s.Unlock()
+	if !retry {
+		fb.write(s, p)
+		return
+	}
+
+	// Binary sinks take no marker, the line itself is tried instead
+	buf := getBuffer()
+	defer putBuffer(buf)
+	marked := s.renderNote(buf, fmt.Sprintf("— output restored after %d lines fell back to %s —\n", fellBack, fb.name))
+	probe := p
+	if marked {
+		probe = buf.Bytes()
+	}
+	if err := s.writeSink(probe); err != nil {
+		atomic.AddUint64(&s.failed, 1)
+		s.Lock()
+		s.lastErr = err
+		s.Unlock()
+		fb.handle(fmt.Errorf("retrying sink %d: %w", s.index, err))
+		fb.write(s, p)
+		return
+	}
+	atomic.StoreInt32(&s.consecutive, 0)
+	atomic.StoreUint32(&s.fallingBack, 0)
+	if marked {
+		if err := s.writeSink(p); err != nil {
+			s.writeFailed(err, p)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Takes the first "ok" writes, then fails until healed
+type flakyWriter struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	ok     int
+	healed bool
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ok == 0 && !w.healed {
+		return 0, errors.New("disk full")
+	}
+	w.ok--
+	return w.buf.Write(p)
+}
+
+func (w *flakyWriter) heal() {
+	w.mu.Lock()
+	w.healed = true
+	w.mu.Unlock()
+}
+
+func (w *flakyWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestSinkFallback(test *testing.T) {
+	var fallback lockedBuffer
+	var errs []error
+	primary := &flakyWriter{ok: 2}
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:                []Sink{{Writer: primary}},
+		Clock:                clock.Now,
+		FallbackWriter:       &fallback,
+		SinkFailureThreshold: 3,
+		SinkRetryInterval:    time.Second,
+		SinkErrorHandler:     func(err error) { errs = append(errs, err) },
+	})
+	span := func() {
+		defer t.Enter("%s", "work")()
+	}
+
+	// Two lines make it, the next two are lost and the third failure
+	// switches to the fallback, which takes the last two
+	for i := 0; i < 3; i++ {
+		span()
+	}
+	assert.Equal(test, 2, strings.Count(primary.String(), "\n"))
+	assert.True(test, strings.HasPrefix(fallback.String(), "— output falling back to FallbackWriter after 3 write errors —\n"), fallback.String())
+	assert.Equal(test, 2, strings.Count(fallback.String(), "=>work"))
+	health := t.SinkHealth()[0]
+	assert.Equal(test, SinkHealth{Failed: 3, Last: health.Last, FellBack: 2, Dropped: 2, FallingBack: true}, health)
+	assert.EqualError(test, health.Last, "disk full")
+	assert.Len(test, errs, 3)
+	assert.EqualError(test, errs[0], "writing to sink 0: disk full")
+
+	// Retried once the interval has passed, in vain
+	clock.advance(time.Second)
+	span()
+	assert.Equal(test, 4, strings.Count(fallback.String(), "=>work"))
+	assert.Equal(test, uint64(4), t.SinkHealth()[0].Failed)
+	assert.EqualError(test, errs[3], "retrying sink 0: disk full")
+
+	// And switched back to once it takes the marker
+	primary.heal()
+	span()
+	clock.advance(time.Second)
+	span()
+	assert.Equal(test, 6, strings.Count(fallback.String(), "=>work"))
+	assert.Equal(test, "— output restored after 6 lines fell back to FallbackWriter —\n",
+		strings.SplitAfter(primary.String(), "\n")[2])
+	assert.Equal(test, 4, strings.Count(primary.String(), "=>work"))
+	health = t.SinkHealth()[0]
+	assert.False(test, health.FallingBack)
+	// Every line is accounted for: those of the six spans which were not
+	// written to the sink fell back or were dropped
+	assert.Equal(test, uint64(6*2-4), health.FellBack+health.Dropped)
+}
+
+func TestSinkOpenedLazily(test *testing.T) {
+	var out bytes.Buffer
+	opens := 0
+	t := NewTracer(&Options{
+		Sinks: []Sink{{Open: func() (io.Writer, error) {
+			opens++
+			if opens == 1 {
+				return nil, errors.New("no such directory")
+			}
+			return &out, nil
+		}}},
+		SinkErrorHandler: func(error) {},
+	})
+	assert.Equal(test, 0, opens)
+
+	func() {
+		defer t.Enter("%s", "work")()
+	}()
+	assert.Equal(test, 2, opens)
+	assert.Equal(test, 1, strings.Count(out.String(), "\n"))
+	health := t.SinkHealth()[0]
+	assert.Equal(test, uint64(1), health.Failed)
+	assert.Equal(test, uint64(1), health.Dropped)
+	assert.EqualError(test, health.Last, "no such directory")
+}
+
+func TestSinkErrorsWarnedSparingly(test *testing.T) {
+	var buf bytes.Buffer
+	warn := warnSinkErrors(&buf)
+	for i := 0; i < 3; i++ {
+		warn(errors.New("disk full"))
+	}
+	assert.Equal(test, "tracey: disk full\n", buf.String())
+}
+
+func TestSinkHealthInCrashReport(test *testing.T) {
+	var crash bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Writer: failingWriter{}}},
+		SinkErrorHandler: func(error) {},
+		FlushOnPanic:     true,
+		CrashWriter:      &crash,
+	})
+	assert.Panics(test, func() {
+		defer t.RecoverAndFlush()
+		defer t.Enter()()
+		panic("boom")
+	})
+	assert.Contains(test, crash.String(), "sink 0: 2 failed writes, 0 lines fell back, 2 dropped\n")
+}
@@ -0,0 +1,138 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// SpanSnapshotVersion is the version of the snapshots of `Span.Snapshot()`,
+// which `Tracer.Restore(...)` accepts snapshots of up to.
+const SpanSnapshotVersion = 1
+
+// ErrSnapshotUnavailable is returned by `Span.Snapshot()` for spans which
+// have ended, and for those of disabled tracers.
+var ErrSnapshotUnavailable = errors.New("tracey: span cannot be snapshotted")
+
+// What a snapshot holds of a span, see `Span.Snapshot()`
+type spanSnapshot struct {
+	Version  int    `json:"v"`
+	TraceID  string `json:"trace"`
+	SpanID   string `json:"span"`
+	ParentID string `json:"parent,omitempty"`
+	Level    Level  `json:"level,omitempty"`
+	Name     string `json:"name"`
+	Message  string `json:"msg,omitempty"`
+
+	// The time since the span was first entered, in nanoseconds
+	Elapsed int64 `json:"elapsed"`
+
+	Tags        []snapshotTag        `json:"tags,omitempty"`
+	Checkpoints []snapshotCheckpoint `json:"checkpoints,omitempty"`
+}
+
+type snapshotTag struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type snapshotCheckpoint struct {
+	Name  string `json:"name"`
+	At    int64  `json:"at"`
+	Delta int64  `json:"dur"`
+}
+
+// Snapshot serializes what identifies the span, and what it recorded so
+// far, for operations such as migrations which outlive the process: its
+// trace and span ids, name and message, the time since it was first
+// entered, its tags and its checkpoints. `Tracer.Restore(...)` reopens it
+// from the snapshot, in this process or another one. Tags are restored as
+// the JSON values they are written as. The span itself carries on as is,
+// and should be ended once it was snapshotted for good, as it is restored
+// as a span of its own. Returns `ErrSnapshotUnavailable` for spans which
+// have ended, and for those of disabled tracers.
+func (s *Span) Snapshot() ([]byte, error) {
+	t := s.t
+	if t == nil || atomic.LoadUint32(&s.ended) != 0 {
+		return nil, ErrSnapshotUnavailable
+	}
+	snap := spanSnapshot{
+		Version:  SpanSnapshotVersion,
+		TraceID:  s.ev.TraceID,
+		SpanID:   s.ev.SpanID,
+		ParentID: s.ev.ParentID,
+		Level:    s.ev.Level,
+		Name:     s.ev.Name,
+		Message:  s.ev.Message,
+		Elapsed:  int64(t.options.Clock().Sub(s.ev.Time) + s.carried),
+	}
+	for _, tag := range s.ev.Tags {
+		var buf bytes.Buffer
+		appendJSONValue(&buf, tag.Value)
+		snap.Tags = append(snap.Tags, snapshotTag{tag.Key, buf.Bytes()})
+	}
+	for _, cp := range s.ev.Checkpoints {
+		snap.Checkpoints = append(snap.Checkpoints, snapshotCheckpoint{cp.Name, int64(cp.Offset), int64(cp.Delta)})
+	}
+	return json.Marshal(snap)
+}
+
+// Restore reopens a span from its snapshot (see `Span.Snapshot()`) on the
+// calling goroutine, at depth 0 whatever is open on it, with the trace,
+// span and parent ids it had. Its duration carries on from the time it
+// was snapshotted at, and its events are flagged "Restored" (as in
+// "«restored» ENTER: ..." in text output). Snapshots which are not valid
+// JSON, lack the ids or name of the span, or are of a version newer than
+// `SpanSnapshotVersion` are rejected.
+func (t *Tracer) Restore(data []byte) (*Span, error) {
+	return t.RestoreUnder(SpanRef{}, data)
+}
+
+// RestoreUnder works like `Restore(...)`, but reopens the span within
+// "parent" the way `EnterUnder(...)` enters spans, in the parent's trace.
+// The zero SpanRef restores the span at depth 0.
+func (t *Tracer) RestoreUnder(parent SpanRef, data []byte) (*Span, error) {
+	var snap spanSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return noopSpan, fmt.Errorf("tracey: bad span snapshot: %v", err)
+	}
+	switch {
+	case snap.Version <= 0:
+		return noopSpan, errors.New("tracey: bad span snapshot: no version")
+	case snap.Version > SpanSnapshotVersion:
+		return noopSpan, fmt.Errorf("tracey: span snapshot version %d is newer than %d", snap.Version, SpanSnapshotVersion)
+	case snap.TraceID == "" || snap.SpanID == "" || snap.Name == "":
+		return noopSpan, errors.New("tracey: bad span snapshot: no trace id, span id or name")
+	}
+	if t.start == nil {
+		return noopSpan, nil
+	}
+
+	under := &Span{ev: Event{TraceID: snap.TraceID, SpanID: snap.ParentID, Depth: -1}, logical: true, restored: &snap}
+	if p := parent.span; p != nil && atomic.LoadUint32(&p.ended) == 0 {
+		under.ev = Event{TraceID: p.ev.TraceID, SpanID: p.ev.SpanID, Depth: p.ev.Depth, Pinned: p.ev.Pinned, overrides: p.ev.overrides, route: p.ev.route, tail: p.ev.tail, bundle: p.ev.bundle}
+		under.remote, under.suppressor, under.tree = p.remote, p.suppressor, p.tree
+	}
+	return t.start(under, snap.Name, nil, snap.Level), nil
+}
+
+// Carries the span on from its snapshot, see `Restore(...)`
+func (t *Tracer) enterRestored(s *Span, snap *spanSnapshot) {
+	ev := &s.ev
+	ev.SpanID, ev.Restored = snap.SpanID, true
+	if snap.Message != "" {
+		ev.Message = t.capMessage(snap.Message)
+	}
+	s.carried = time.Duration(snap.Elapsed)
+	for _, tag := range snap.Tags {
+		var value interface{}
+		json.Unmarshal(tag.Value, &value)
+		ev.Tags = append(ev.Tags, Tag{tag.Key, value})
+	}
+	for _, cp := range snap.Checkpoints {
+		ev.Checkpoints = append(ev.Checkpoints, Checkpoint{cp.Name, time.Duration(cp.At), time.Duration(cp.Delta)})
+	}
+}
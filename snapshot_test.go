@@ -0,0 +1,116 @@
+package tracey
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRestore(test *testing.T) {
+	var before lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &before, Format: JSONFormat}}, Clock: clock.Now})
+	job := t.Start("%s", "migrate")
+	job.Tag("rows", 3)
+	clock.advance(40 * time.Millisecond)
+	job.Checkpoint("schema")
+	clock.advance(10 * time.Millisecond)
+	data, err := job.Snapshot()
+	assert.Nil(test, err)
+	enter, err := UnmarshalEvent([]byte(strings.Split(before.String(), "\n")[0]))
+	assert.Nil(test, err)
+
+	// The process restarts, with a fresh tracer and clock
+	var text, js lockedBuffer
+	clock = &manualClock{now: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)}
+	t = NewTracer(&Options{
+		Sinks:                 []Sink{{Writer: &text}, {Writer: &js, Format: JSONFormat}},
+		Clock:                 clock.Now,
+		EnableInstrumentation: true,
+		CheckpointSummary:     true,
+	})
+	func() {
+		defer t.Enter("%s", "resume")()
+		restored, err := t.Restore(data)
+		assert.Nil(test, err)
+		clock.advance(25 * time.Millisecond)
+		restored.Checkpoint("rows")
+		restored.End()
+	}()
+
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(text.String(), "=>")), "\n")
+	assert.Equal(test, []string{
+		"[ 0]ENTER: =>resume",
+		"[ 0]«restored» ENTER: =>go-tracey.TestSnapshotRestore",
+		"[ 0]«restored» EXIT:  =>go-tracey.TestSnapshotRestore ... in 75ms {rows=3} [schema 40.0ms | rows 35.0ms]",
+		"[ 0]EXIT:  =>resume ... in 25ms",
+	}, lines)
+
+	events := strings.Split(strings.TrimSpace(js.String()), "\n")
+	exit, err := UnmarshalEvent([]byte(events[2]))
+	assert.Nil(test, err)
+	assert.True(test, exit.Restored)
+	assert.Equal(test, 75*time.Millisecond, exit.Duration)
+	assert.Equal(test, enter.TraceID, exit.TraceID)
+	assert.Equal(test, enter.SpanID, exit.SpanID)
+	assert.Equal(test, "", exit.ParentID)
+	assert.Equal(test, "migrate", exit.Message)
+	assert.Equal(test, []Checkpoint{{"schema", 40 * time.Millisecond, 40 * time.Millisecond}, {"rows", 75 * time.Millisecond, 35 * time.Millisecond}}, exit.Checkpoints)
+}
+
+func TestRestoreUnder(test *testing.T) {
+	var js lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &js, Format: JSONFormat}}})
+	original := t.Start("%s", "job")
+	data, err := original.Snapshot()
+	assert.Nil(test, err)
+	original.End()
+
+	js.Reset()
+	parent := t.Start("%s", "worker")
+	restored, err := t.RestoreUnder(parent.Ref(), data)
+	assert.Nil(test, err)
+	restored.End()
+	parent.End()
+	events := strings.Split(strings.TrimSpace(js.String()), "\n")
+	worker, _ := UnmarshalEvent([]byte(events[0]))
+	job, _ := UnmarshalEvent([]byte(events[1]))
+	assert.Equal(test, 1, job.Depth)
+	assert.Equal(test, worker.TraceID, job.TraceID)
+	assert.Equal(test, worker.SpanID, job.ParentID)
+	assert.Equal(test, "job", job.Message)
+	assert.Empty(test, t.Snapshot())
+}
+
+func TestRestoreRejects(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &lockedBuffer{}}}})
+	job := t.Start("%s", "job")
+	data, err := job.Snapshot()
+	assert.Nil(test, err)
+
+	for snapshot, message := range map[string]string{
+		string(data[:len(data)/2]):                     "tracey: bad span snapshot: unexpected end of JSON input",
+		"[1, 2]":                                       "tracey: bad span snapshot: json: cannot unmarshal array into Go value of type tracey.spanSnapshot",
+		`{"trace":"1","span":"2","name":"job"}`:        "tracey: bad span snapshot: no version",
+		`{"v":99,"trace":"1","span":"2","name":"job"}`: "tracey: span snapshot version 99 is newer than 1",
+		`{"v":1,"span":"2","name":"job"}`:              "tracey: bad span snapshot: no trace id, span id or name",
+	} {
+		span, err := t.Restore([]byte(snapshot))
+		if assert.NotNil(test, err) {
+			assert.Equal(test, message, err.Error())
+		}
+		assert.Equal(test, noopSpan, span)
+	}
+
+	job.End()
+	_, err = job.Snapshot()
+	assert.Equal(test, ErrSnapshotUnavailable, err)
+	disabled := NewTracer(&Options{DisableTracing: true})
+	_, err = disabled.Start().Snapshot()
+	assert.Equal(test, ErrSnapshotUnavailable, err)
+	span, err := disabled.Restore(data)
+	assert.Nil(test, err)
+	assert.Equal(test, noopSpan, span)
+}
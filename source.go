@@ -0,0 +1,250 @@
+package tracey
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// The signatures of the traced functions, read from their sources, see
+// "CaptureSource". Callsites are queued the first time they are traced,
+// and resolved one at a time by a goroutine started for as long as the
+// queue is not empty.
+type sourceIndex struct {
+	root string
+
+	mu      sync.Mutex
+	queue   []*callsite
+	sites   []*callsite
+	running bool
+	idle    *sync.Cond
+
+	// The files parsed so far, by path, only used by the resolving
+	// goroutine
+	files map[string]*sourceFile
+
+	// How many callsites had no signature found
+	missing uint64
+}
+
+// A parsed source file, as of its modification time
+type sourceFile struct {
+	modified time.Time
+	fset     *token.FileSet
+	file     *ast.File
+}
+
+func newSourceIndex(root string) *sourceIndex {
+	s := &sourceIndex{root: root, files: make(map[string]*sourceFile)}
+	s.idle = sync.NewCond(&s.mu)
+	return s
+}
+
+// Queues the callsite for its signature to be read
+func (s *sourceIndex) resolve(site *callsite) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sites = append(s.sites, site)
+	s.queue = append(s.queue, site)
+	if !s.running {
+		s.running = true
+		go s.work()
+	}
+}
+
+func (s *sourceIndex) work() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.running = false
+			s.idle.Broadcast()
+			s.mu.Unlock()
+			return
+		}
+		site := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		if signature, ok := s.signature(site.file, site.line); ok {
+			site.signature.Store(&signature)
+		} else {
+			atomic.AddUint64(&s.missing, 1)
+		}
+	}
+}
+
+// Returns the signature of the function declared around the line of the
+// file, and false if the file cannot be found or parsed, or has no
+// function there
+func (s *sourceIndex) signature(path string, line int) (string, bool) {
+	f := s.parse(path)
+	if f == nil {
+		return "", false
+	}
+	var found string
+	ast.Inspect(f.file, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		if f.fset.Position(n.Pos()).Line > line || f.fset.Position(n.End()).Line < line {
+			return false
+		}
+		// The innermost function wins, closures included
+		switch fn := n.(type) {
+		case *ast.FuncDecl:
+			found = renderSignature(fn.Recv, fn.Name.Name, fn.Type)
+		case *ast.FuncLit:
+			found = renderSignature(nil, "", fn.Type)
+		}
+		return true
+	})
+	return found, found != ""
+}
+
+// Returns the parsed file, from the cache unless it was modified since,
+// and nil if it cannot be found or parsed
+func (s *sourceIndex) parse(path string) *sourceFile {
+	path, info := s.locate(path)
+	if info == nil {
+		return nil
+	}
+	if f := s.files[path]; f != nil && f.modified.Equal(info.ModTime()) {
+		return f
+	}
+	f := &sourceFile{modified: info.ModTime(), fset: token.NewFileSet()}
+	// A file which does not parse in full still has the functions before
+	// the error
+	f.file, _ = parser.ParseFile(f.fset, path, nil, parser.SkipObjectResolution)
+	if f.file == nil {
+		return nil
+	}
+	s.files[path] = f
+	return f
+}
+
+// Finds the file the binary was built from: at its path, or else below
+// the root, at the longest trailing part of its path which is there, so
+// that the paths of a binary built elsewhere, or from a vendor directory,
+// are found in a checkout of the sources
+func (s *sourceIndex) locate(path string) (string, os.FileInfo) {
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		return path, info
+	}
+	if s.root == "" {
+		return "", nil
+	}
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i := range parts {
+		candidate := filepath.Join(s.root, filepath.FromSlash(strings.Join(parts[i:], "/")))
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, info
+		}
+	}
+	return "", nil
+}
+
+// Renders a function signature on one line, as in "func (s *Server)
+// handleOrder(ctx context.Context, id string) error"
+func renderSignature(recv *ast.FieldList, name string, typ *ast.FuncType) string {
+	var b strings.Builder
+	b.WriteString("func")
+	if recv != nil {
+		b.WriteString(" (" + renderFields(recv) + ")")
+	}
+	if name != "" {
+		b.WriteString(" " + name)
+	}
+	if typ.TypeParams != nil {
+		b.WriteString("[" + renderFields(typ.TypeParams) + "]")
+	}
+	b.WriteString("(" + renderFields(typ.Params) + ")")
+	if results := typ.Results; results != nil && len(results.List) > 0 {
+		if len(results.List) == 1 && len(results.List[0].Names) == 0 {
+			b.WriteString(" " + types.ExprString(results.List[0].Type))
+		} else {
+			b.WriteString(" (" + renderFields(results) + ")")
+		}
+	}
+	return b.String()
+}
+
+func renderFields(fields *ast.FieldList) string {
+	if fields == nil {
+		return ""
+	}
+	list := make([]string, 0, len(fields.List))
+	for _, field := range fields.List {
+		names := make([]string, len(field.Names))
+		for i, name := range field.Names {
+			names[i] = name.Name
+		}
+		if len(names) > 0 {
+			list = append(list, strings.Join(names, ", ")+" "+types.ExprString(field.Type))
+		} else {
+			list = append(list, types.ExprString(field.Type))
+		}
+	}
+	return strings.Join(list, ", ")
+}
+
+// Returns the signature of the callsite's function, "" until it was read
+func (site *callsite) sourceSignature() string {
+	if signature := site.signature.Load(); signature != nil {
+		return *signature
+	}
+	return ""
+}
+
+// WriteSourceIndex writes the callsites traced so far along with the
+// signatures of their functions, as in "main.(*Server).handleOrder
+// server.go:42 func (s *Server) handleOrder(ctx context.Context, id
+// string) error", once those read on the first trace of each are. The
+// signature is left out for those whose source was not found, see
+// `SourcesMissing()`. Writes nothing unless "CaptureSource" is set.
+func (t *Tracer) WriteSourceIndex(w io.Writer) error {
+	s := t.sources
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	for s.running {
+		s.idle.Wait()
+	}
+	sites := append([]*callsite(nil), s.sites...)
+	s.mu.Unlock()
+	sort.SliceStable(sites, func(i, j int) bool {
+		if sites[i].name != sites[j].name {
+			return sites[i].name < sites[j].name
+		}
+		return sites[i].line < sites[j].line
+	})
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FUNCTION\tSOURCE\tSIGNATURE")
+	for _, site := range sites {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", site.name, filepath.Base(site.file)+":"+strconv.Itoa(site.line), site.sourceSignature())
+	}
+	return tw.Flush()
+}
+
+// SourcesMissing returns how many callsites had no signature found with
+// "CaptureSource" set: those whose source file could not be found (a
+// binary built elsewhere, say, with no "SourceRoot" to find it below) or
+// parsed, or had no function at their line.
+func (t *Tracer) SourcesMissing() uint64 {
+	if t.sources == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.sources.missing)
+}
@@ -0,0 +1,105 @@
+package tracey
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the line of the fixture which ends in the comment
+func fixtureLine(test *testing.T, path, comment string) int {
+	f, err := os.Open(path)
+	assert.Nil(test, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.HasSuffix(scanner.Text(), "// "+comment) {
+			return line
+		}
+	}
+	test.Fatalf("no %q in %s", comment, path)
+	return 0
+}
+
+func TestSourceSignatures(test *testing.T) {
+	const path = "testdata/source/server.go"
+	s := newSourceIndex("")
+	for comment, expected := range map[string]string{
+		"method":     "func (s *Server) handleOrder(ctx context.Context, id string) error",
+		"generic":    "func Map[T, U any](in []T, f func(T) U) []U",
+		"multi-line": "func (s *Server) batch(ctx context.Context, ids []string, opts ...func(*Server)) (n int, err error)",
+		"closure":    "func(left int)",
+	} {
+		signature, ok := s.signature(path, fixtureLine(test, path, comment))
+		assert.True(test, ok, comment)
+		assert.Equal(test, expected, signature, comment)
+	}
+
+	_, ok := s.signature(path, fixtureLine(test, path, "no function"))
+	assert.False(test, ok)
+	_, ok = s.signature("testdata/source/missing.go", 12)
+	assert.False(test, ok)
+}
+
+func TestSourceRoot(test *testing.T) {
+	// As built elsewhere, or vendored
+	const path = "/build/vendor/example.com/fixture/source/server.go"
+	line := fixtureLine(test, "testdata/source/server.go", "method")
+
+	_, ok := newSourceIndex("").signature(path, line)
+	assert.False(test, ok)
+	signature, ok := newSourceIndex("testdata").signature(path, line)
+	assert.True(test, ok)
+	assert.Equal(test, "func (s *Server) handleOrder(ctx context.Context, id string) error", signature)
+}
+
+func traceOrder(t *Tracer, id string) error {
+	defer t.Enter("%s", "$FN")()
+	return nil
+}
+
+func TestCaptureSource(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Writer: &out}},
+		CaptureSource:    true,
+		MessageTemplates: map[string]string{`traceOrder$`: "$FN: $SIG"},
+	})
+
+	// The signature is read once the callsite was first traced
+	assert.Nil(test, traceOrder(t, "a"))
+	var index bytes.Buffer
+	assert.Nil(test, t.WriteSourceIndex(&index))
+	assert.Nil(test, traceOrder(t, "b"))
+
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal(test, "[ 0]ENTER: go-tracey.traceOrder: ", lines[0])
+	assert.Equal(test, "[ 0]ENTER: go-tracey.traceOrder: func traceOrder(t *Tracer, id string) error", lines[2])
+	assert.Equal(test, "[ 0]EXIT:  go-tracey.traceOrder: func traceOrder(t *Tracer, id string) error", lines[3])
+	assert.Regexp(test, `(?m)^FUNCTION +SOURCE +SIGNATURE\ngo-tracey.traceOrder +source_test.go:\d+ +func traceOrder\(t \*Tracer, id string\) error\n$`, index.String())
+	assert.Equal(test, uint64(0), t.SourcesMissing())
+}
+
+func TestCaptureSourceMissing(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, CaptureSource: true})
+	site := t.namedSite("fixture.gone")
+	site.file, site.line = "/nowhere/gone.go", 3
+	t.sources.resolve(site)
+
+	var index bytes.Buffer
+	assert.Nil(test, t.WriteSourceIndex(&index))
+	assert.Regexp(test, `(?m)^fixture.gone +gone.go:3 +$`, index.String())
+	assert.Equal(test, uint64(1), t.SourcesMissing())
+
+	// Nothing is captured unless asked for
+	off := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}})
+	index.Reset()
+	assert.Nil(test, off.WriteSourceIndex(&index))
+	assert.Empty(test, index.String())
+	assert.Nil(test, off.sources)
+}
@@ -0,0 +1,299 @@
+package tracey
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// A Span is a call which has been entered but not yet exited, as returned
+// by `Tracer.Start(...)`. Its methods are meant to be called from the
+// goroutine which started it, except for `End()` which may be called
+// from anywhere, any number of times.
+type Span struct {
+	t     *Tracer
+	ev    Event
+	ended uint32
+	gauge *gauge
+
+	// The record of the goroutine which started the span
+	record *goroutineRecord
+
+	// Set on the stand-ins of logical parents, see `EnterUnder(...)`, and
+	// on the spans within them, how far their depth is shifted from that
+	// of their goroutine
+	logical bool
+	shift   int
+
+	// How many spans were started within the span, see
+	// "CompressLinearChains"
+	children int32
+
+	// The span open on the same goroutine the span was entered within,
+	// and the time its own children there took in all, see `Audit()`
+	outer      *Span
+	childTime  int64
+	childCount int32
+
+	// Set if the span is below the tracer's "MinLevel" or in a suppressed
+	// subtree, in which case nothing about it is logged
+	muted bool
+
+	// The span whose subtree this span is in, if it is suppressed (see
+	// "SuppressSubtrees"), along with the number of spans it suppressed
+	suppressor *Span
+	hidden     uint64
+
+	// The trace context of the remote caller the span's trace came from,
+	// if any, see `StartRemote(...)`
+	remote *TraceParent
+
+	// The context the span was started with, see `StartContext(...)`
+	ctx context.Context
+
+	// The cycles the process had spent blocked when the span was entered,
+	// if sampled, see "EnableBlockProfiling"
+	blockedAt    int64
+	blockSampled bool
+
+	// The runtime's metrics when the span was entered, if sampled, see
+	// "EnableRuntimeMetrics"
+	runtimeAt      runtimeSample
+	runtimeSampled bool
+
+	// The thread the span was entered on and its CPU time then, if
+	// sampled, and the goroutine which locked itself to the thread, if
+	// any, see "EnableCPUTime"
+	cpuThread  int
+	cpuAt      time.Duration
+	cpuSampled bool
+	lockedBy   uint64
+
+	// The lines written while the span was open, see "TrackOutputVolume"
+	loggedLines, loggedBytes uint64
+
+	// The lines attached to the span, see `AttachLog(...)`
+	attached *attachments
+
+	// The progress last reported, see `SetProgress(...)`
+	progressDone  int64
+	progressTotal int64
+	progressSet   uint32
+
+	// Set if the span is muted only for being below the tracer's
+	// "MinLevel", rather than for being in a suppressed subtree
+	belowLevel bool
+
+	// The call tree the span belongs to, and whether it is its top-level
+	// span, if "EscalateOnError" is set
+	tree     *escalation
+	treeRoot bool
+
+	// Set on the top-level span of a tree buffered for "TailSampling", and
+	// for "BundleOnError"
+	tailRoot   bool
+	bundleRoot bool
+
+	// Set if the span is logged whatever else decides, see "ForceSample"
+	forced bool
+
+	// The budget the span runs within, if any, see `WithBudget(...)`
+	budget *spanBudget
+
+	// The snapshot the span is restored from, set on the stand-ins of the
+	// parents of restored spans, and the time restored spans were open
+	// for before, see `Restore(...)`
+	restored *spanSnapshot
+	carried  time.Duration
+
+	// The changes of the instruments while the span was open, see
+	// "AttributeMetricsToSpans"
+	metrics atomic.Pointer[spanMetrics]
+
+	// The histogram the span observed into last, see `Observe(...)`
+	observed atomic.Pointer[spanObservation]
+
+	// Set on the spans entered through a bridge, along with how long the
+	// plugin which entered them measured they took, see `Export()`
+	bridged  bool
+	reported time.Duration
+
+	// See `Suspend()` and `Transfer()`
+	pause   suspension
+	handoff handoff
+
+	// Set once the span was warned about, see "WarnAfter"
+	warned uint32
+
+	// Set on the spans force-closed on close, see "CloseTimeout"
+	forcedAtClose bool
+
+	// Set on the spans counted as open for the alerts, see `AddAlert(...)`
+	countedOpen bool
+
+	// Set on the top-level spans of pinned trees, see `Pin(...)`
+	pinRoot bool
+}
+
+// Returned by tracers with tracing disabled, all its methods are no-ops
+var noopSpan = &Span{}
+
+// A Tag is a key / value pair attached to a span, logged on its exit.
+type Tag struct {
+	Key   string
+	Value interface{}
+}
+
+// A SpanEvent is a milestone within a span, as recorded by `Span.Event(...)`.
+type SpanEvent struct {
+	// The time since the span was entered
+	Offset  time.Duration
+	Message string
+}
+
+// End logs the exit of the span. Only the first call has any effect, but
+// for a warning on that of a span which was abandoned, see "AbandonAfter".
+func (s *Span) End() {
+	if s.t == nil {
+		return
+	}
+	if atomic.CompareAndSwapUint32(&s.ended, 0, 1) {
+		s.t.end(s)
+	} else if atomic.LoadUint32(&s.ended) == endedAbandoned {
+		s.t.lateExit(s)
+	}
+}
+
+// SetError marks the span as failed, the error is logged on its exit. A
+// nil error clears it.
+func (s *Span) SetError(err error) {
+	if s.t != nil {
+		s.ev.Err = err
+	}
+}
+
+// Tag attaches a key / value pair to the span, replacing the value of an
+// existing tag with the same key.
+func (s *Span) Tag(key string, value interface{}) {
+	if s.t == nil {
+		return
+	}
+	for i := range s.ev.Tags {
+		if s.ev.Tags[i].Key == key {
+			s.ev.Tags[i].Value = value
+			return
+		}
+	}
+	s.ev.Tags = append(s.ev.Tags, Tag{key, value})
+}
+
+// SetExtra attaches data to the span, which JSON output renders under the
+// "x" key of its exit event. It is meant for integrations, which should
+// prefix their keys to avoid collisions.
+func (s *Span) SetExtra(key string, value interface{}) {
+	if s.t == nil {
+		return
+	}
+	if s.ev.ExtraFields == nil {
+		s.ev.ExtraFields = make(map[string]interface{})
+	}
+	s.ev.ExtraFields[key] = value
+}
+
+// Event logs a milestone within the span, such as "cache miss", as a line
+// indented one level deeper than the span itself. The message is formatted
+// with `fmt.Sprintf(...)`, and also listed in the span's exit event.
+func (s *Span) Event(msg string, args ...interface{}) {
+	if s.t == nil {
+		return
+	}
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	s.t.spanEvent(s, s.ev.TID, msg)
+}
+
+// Event works like `Span.Event(...)` on the innermost span open on the
+// calling goroutine. When no span is open, the milestone is logged as a
+// standalone line at depth 0.
+func (t *Tracer) Event(msg string, args ...interface{}) {
+	if t.start == nil {
+		return
+	}
+	if a := t.adopter.Load(); a != nil {
+		a.parent.Event(msg, args...)
+		return
+	}
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	gid := getGID()
+	t.spanEvent(t.goroutines.innermost(gid), gid, msg)
+}
+
+// Logs a milestone within the span, or a standalone one if the span is nil
+func (t *Tracer) spanEvent(s *Span, gid uint64, msg string) {
+	msg = t.capMessage(msg)
+	ev := Event{Kind: PointEvent, Time: t.options.Clock(), TID: gid, Message: msg}
+	if s != nil {
+		if s.muted {
+			return
+		}
+		t.within(&ev, s)
+		ev.adopted = s.ev.adopted
+		s.ev.Events = append(s.ev.Events, SpanEvent{ev.Duration, msg})
+		if t.shedding(s) {
+			return
+		}
+	} else if t.options.Router != nil {
+		ev.route = t.route(&ev)
+	}
+	t.emitPoint(&ev)
+}
+
+// Places a point event within the span
+func (t *Tracer) within(ev *Event, s *Span) {
+	ev.Level = s.ev.Level
+	ev.Name = s.ev.Name
+	ev.Depth = s.ev.Depth + 1
+	ev.collapsed = s.ev.collapsed
+	ev.route, ev.tail, ev.bundle = s.ev.route, s.ev.tail, s.ev.bundle
+	if t.options.DisableNesting {
+		ev.Depth = 0
+	}
+	ev.Duration = ev.Time.Sub(s.ev.Time) + s.carried
+}
+
+func (t *Tracer) emitPoint(ev *Event) {
+	t.emitTraced(ev)
+}
+
+// An OpenSpan describes a span which has been entered but not exited yet.
+type OpenSpan struct {
+	TraceID string
+	SpanID  string
+	Name    string
+	Message string
+
+	// How long ago the span was entered
+	Age time.Duration
+}
+
+// Snapshot returns the spans currently open on each goroutine, keyed by
+// goroutine id and outermost (hence oldest) first.
+func (t *Tracer) Snapshot() map[uint64][]OpenSpan {
+	snapshot := make(map[uint64][]OpenSpan)
+	if t.start == nil {
+		return snapshot
+	}
+	now := t.options.Clock()
+	t.goroutines.each(func(gid uint64, open []*Span) {
+		spans := make([]OpenSpan, len(open))
+		for i, s := range open {
+			spans[i] = OpenSpan{s.ev.TraceID, s.ev.SpanID, s.ev.Name, s.ev.Message, now.Sub(s.ev.Time)}
+		}
+		snapshot[gid] = spans
+	})
+	return snapshot
+}
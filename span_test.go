@@ -0,0 +1,109 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanTagsAndError(test *testing.T) {
+	var text, js bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{
+		{Logger: log.New(&text, "", 0)},
+		{Writer: &js, Format: JSONFormat},
+	}})
+
+	span := t.Start("%s", "fetch")
+	span.Tag("rows", 3)
+	span.Tag("table", "users")
+	span.Tag("rows", 4)
+	span.SetError(errors.New("timeout"))
+	span.End()
+
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(text.String(), "$1=>")), "\n")
+	assert.Equal(test, []string{
+		"[ 0]ENTER: =>fetch",
+		"[ 0]EXIT:  =>fetch {rows=4 table=users} (error: timeout)",
+	}, lines)
+	assert.Contains(test, js.String(), `,"tags":{"rows":"4","table":"users"},"err":"timeout"`)
+}
+
+func TestSpanEndIsIdempotent(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger})
+
+	span := t.Start("%s", "once")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			span.End()
+		}()
+	}
+	wg.Wait()
+	span.End()
+
+	// Ending from another goroutine still unwinds the starting goroutine
+	t.Enter("%s", "after")()
+	assert.Equal(test, "\n[ 0]ENTER: =>once\n[ 0]EXIT:  =>once\n[ 0]ENTER: =>after\n[ 0]EXIT:  =>after\n", maskedTestBuffer())
+}
+
+func TestNoopSpan(test *testing.T) {
+	span := NewTracer(&Options{DisableTracing: true}).Start("%s", "nothing")
+	span.Tag("k", "v")
+	span.SetError(errors.New("ignored"))
+	span.End()
+	assert.Equal(test, noopSpan, span)
+}
+
+// A clock which moves forward by "step" every time it is read
+func fakeClock(step time.Duration) func() time.Time {
+	var mu sync.Mutex
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(step)
+		return now
+	}
+}
+
+func TestSpanEvents(test *testing.T) {
+	ResetTestBuffer()
+	var js bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks: []Sink{{Logger: BufLogger}, {Writer: &js, Format: JSONFormat}},
+		Clock: fakeClock(1500 * time.Microsecond),
+	})
+
+	t.Event("starting")
+	func() {
+		outer := t.Start("%s", "outer")
+		defer outer.End()
+		func() {
+			defer t.Enter("%s", "inner")()
+			t.Event("cache %s", "miss")
+		}()
+		outer.Event("retry %d", 2)
+	}()
+
+	assert.Equal(test, `
+[ 0]· starting
+[ 0]ENTER: =>outer
+[ 1]  ENTER: =>inner
+[ 2]    · cache miss (at +1.5ms)
+[ 1]  EXIT:  =>inner
+[ 1]  · retry 2 (at +6.0ms)
+[ 0]EXIT:  =>outer
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+	assert.Contains(test, js.String(), `,"dur":3000000,"events":[{"at":1500000,"msg":"cache miss"}]`)
+	assert.Contains(test, js.String(), `,"dur":7500000,"events":[{"at":6000000,"msg":"retry 2"}]`)
+	assert.Contains(test, js.String(), `{"v":1,"kind":"event","time":"2020-01-01T00:00:00.0015Z"`)
+}
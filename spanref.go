@@ -0,0 +1,75 @@
+package tracey
+
+import "sync/atomic"
+
+// A SpanRef refers to a span, so that spans may be entered within it from
+// any goroutine, see `Tracer.EnterUnder(...)`. It is cheap to copy, and
+// stays valid once the span has ended. The zero SpanRef refers to no span.
+type SpanRef struct {
+	span *Span
+}
+
+// Ref returns a reference to the span, to enter spans within it from
+// callbacks which run on other goroutines.
+func (s *Span) Ref() SpanRef {
+	if s.t == nil {
+		return SpanRef{}
+	}
+	return SpanRef{s}
+}
+
+// EnterUnder enters a span the way `Enter(...)` does, but as a child of
+// "parent" rather than of the span open on the calling goroutine, for
+// the callbacks of event loops and such which run on a goroutine of their
+// own, within the span of whatever dispatches them. The span is one level
+// deeper than its parent, in the parent's trace, and the spans entered
+// within it nest within it as usual. Should the parent have ended already,
+// the span starts a trace of its own at depth 0, which it notes as
+// "detached from ended parent". The zero SpanRef enters the span the way
+// `Enter(...)` does.
+func (t *Tracer) EnterUnder(parent SpanRef, s ...interface{}) func() {
+	if t.start == nil {
+		return noopSpan.End
+	}
+	return t.startUnder(parent.span, "", s...).End
+}
+
+// Starts a span within "p" on the calling goroutine, see
+// `EnterUnder(...)`
+func (t *Tracer) startUnder(p *Span, name string, s ...interface{}) *Span {
+	if p == nil {
+		return t.start(nil, name, nil, s...)
+	}
+	if atomic.LoadUint32(&p.ended) != 0 {
+		span := t.start(&Span{logical: true, ev: Event{Depth: -1}}, name, nil, s...)
+		span.Event("detached from ended parent")
+		return span
+	}
+	return t.start(p.standIn(), name, nil, s...)
+}
+
+// Returns the stand-in of the span as the logical parent of spans entered
+// on other goroutines
+func (p *Span) standIn() *Span {
+	return &Span{
+		ev:         Event{TraceID: p.ev.TraceID, SpanID: p.ev.SpanID, Depth: p.ev.Depth, Pinned: p.ev.Pinned, overrides: p.ev.overrides, route: p.ev.route, tail: p.ev.tail, bundle: p.ev.bundle},
+		logical:    true,
+		remote:     p.remote,
+		suppressor: p.suppressor,
+		tree:       p.tree,
+		budget:     p.budget,
+	}
+}
+
+// Returns the span a span entered on the goroutine is within, which is
+// its logical parent if it has one, or else the innermost span open on the
+// goroutine, or else its parent on another goroutine (if any)
+func (t *Tracer) enclosing(gid uint64, parent *Span) *Span {
+	if parent != nil && parent.logical {
+		return parent
+	}
+	if within := t.goroutines.innermost(gid); within != nil {
+		return within
+	}
+	return parent
+}
@@ -0,0 +1,109 @@
+package tracey
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnterUnder(test *testing.T) {
+	var text, js lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &text}, {Writer: &js, Format: JSONFormat}}})
+
+	// A dispatcher goroutine runs the callbacks of two requests, one of
+	// which is nested already
+	callbacks := make(chan func())
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		defer t.Enter("%s", "dispatch")()
+		callbacks <- nil
+		for callback := range callbacks {
+			callback()
+		}
+		t.Enter("%s", "idle")()
+	}()
+	request := func(nested bool, name string) {
+		if nested {
+			defer t.Enter("%s", "outer")()
+		}
+		parent := t.Start("%s", name)
+		defer parent.End()
+		done := make(chan struct{})
+		ref := parent.Ref()
+		callbacks <- func() {
+			defer close(done)
+			defer t.EnterUnder(ref, "%s", "callback of "+name)()
+			t.Enter("%s", "within "+name)()
+		}
+		<-done
+	}
+	// Once the dispatcher's span is open
+	<-callbacks
+	request(false, "first")
+	request(true, "second")
+	close(callbacks)
+	<-dispatched
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(text.String()), "\n") {
+		if strings.Contains(line, "ENTER") {
+			lines = append(lines, RE_tidMarker.ReplaceAllString(line, "=>"))
+		}
+	}
+	assert.Equal(test, []string{
+		"[ 0]ENTER: =>dispatch",
+		"[ 0]ENTER: =>first",
+		"[ 1]  ENTER: =>callback of first",
+		"[ 2]    ENTER: =>within first",
+		"[ 0]ENTER: =>outer",
+		"[ 1]  ENTER: =>second",
+		"[ 2]    ENTER: =>callback of second",
+		"[ 3]      ENTER: =>within second",
+		"[ 1]  ENTER: =>idle",
+	}, lines)
+
+	// The callbacks are in the traces of their logical parents
+	byMessage := make(map[string]Event)
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		if ev.Kind == EnterEvent {
+			byMessage[ev.Message] = ev
+		}
+	}
+	for _, name := range []string{"first", "second"} {
+		parent, callback, within := byMessage[name], byMessage["callback of "+name], byMessage["within "+name]
+		assert.Equal(test, parent.TraceID, callback.TraceID)
+		assert.Equal(test, parent.SpanID, callback.ParentID)
+		assert.Equal(test, callback.SpanID, within.ParentID)
+		assert.Equal(test, parent.TraceID, within.TraceID)
+	}
+	assert.Equal(test, byMessage["dispatch"].SpanID, byMessage["idle"].ParentID)
+	assert.Empty(test, t.Snapshot())
+}
+
+func TestEnterUnderEndedParent(test *testing.T) {
+	var out lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}})
+	parent := t.Start("%s", "request")
+	ref := parent.Ref()
+	parent.End()
+
+	func() {
+		defer t.Enter("%s", "dispatch")()
+		t.EnterUnder(ref, "%s", "late")()
+		t.EnterUnder(SpanRef{}, "%s", "unrelated")()
+	}()
+	assert.Equal(test, "[ 0]ENTER: =>request\n"+
+		"[ 0]EXIT:  =>request\n"+
+		"[ 0]ENTER: =>dispatch\n"+
+		"[ 0]ENTER: =>late\n"+
+		"[ 1]  · detached from ended parent (at +…)\n"+
+		"[ 0]EXIT:  =>late\n"+
+		"[ 1]  ENTER: =>unrelated\n"+
+		"[ 1]  EXIT:  =>unrelated\n"+
+		"[ 0]EXIT:  =>dispatch\n", regexp.MustCompile(`\+[^)]+\)`).ReplaceAllString(RE_tidMarker.ReplaceAllString(out.String(), "=>"), "+…)"))
+}
@@ -0,0 +1,510 @@
+package tracey
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// A gauge counts the goroutines currently inside a function. Idle gauges
+// are swept from the tracer, see "InFlightIdleTimeout".
+type gauge struct {
+	n int64
+
+	// When "n" last dropped to 0, in unix nanoseconds
+	idleSince int64
+}
+
+// Stored in a gauge which has been swept, so that late enters notice
+const gaugeDead = -1 << 62
+
+// How many of the most recent calls to each function are kept, for
+// percentiles and `Tracer.StatsSince(...)`
+const statsSamples = 1024
+
+// A single call to a function
+type callSample struct {
+	seq      uint64
+	duration time.Duration
+	message  string
+	tags     []Tag
+}
+
+// The running totals of a single function
+type funcStats struct {
+	calls         uint64
+	total         int64
+	maxConcurrent int64
+	cancelled     uint64
+	failed        uint64
+	panics        uint64
+	injected      int64
+	approximate   uint64
+	loggedLines   uint64
+	loggedBytes   uint64
+	cpu           int64
+
+	// The calls which were force-closed, and how long they had been open,
+	// which the figures above leave out, see "AbandonAfter"
+	abandoned     uint64
+	abandonedTime int64
+
+	// The most recent calls, in a ring, and the slowest call ever
+	mu      sync.Mutex
+	samples []callSample
+	next    int
+	slowest callSample
+
+	// The first call, see "DetectCaching"
+	first callSample
+
+	// The failed calls by error class
+	errors map[string]*ErrorClassStats
+}
+
+// FuncStats summarizes the calls to a single function so far.
+type FuncStats struct {
+	Name  string
+	Calls uint64
+	Total time.Duration
+
+	// How many of the calls had their context cancelled or past its
+	// deadline by the time they exited, see `StartContext(...)`
+	Cancelled uint64
+
+	// How many of the calls failed, see `Tracer.ErrorBreakdown(...)` for
+	// why, and how many of them panicked, see `Call1(...)`
+	Failed uint64
+	Panics uint64
+
+	// The latency injected into the calls, which "Total" leaves out, see
+	// "LatencyInjection"
+	InjectedTime time.Duration
+
+	// How many of the calls were too short for the clock to measure, see
+	// "ClockResolutionFloor". Unless "ExcludeApproximateStats" is set they
+	// are counted at the floor.
+	Approximate uint64
+
+	// Set if the approximate calls are left out of "Total" and "Samples"
+	approximateExcluded bool
+
+	// The lines, and their bytes, written during the calls, see
+	// "TrackOutputVolume"
+	LoggedLines, LoggedBytes uint64
+
+	// The CPU time of the threads of the calls which measured it, apart
+	// from "Total", see "EnableCPUTime"
+	CPUTime time.Duration
+
+	// How many of the calls were force-closed for being open too long,
+	// and how long they had been open in all, which none of the other
+	// figures count, see "AbandonAfter"
+	Abandoned     uint64
+	AbandonedTime time.Duration
+
+	// How many goroutines are inside the function right now, and the most
+	// there ever were at once
+	InFlight      int64
+	MaxConcurrent int64
+
+	// The slowest call, with its message and tags
+	Max        time.Duration
+	MaxMessage string
+	MaxTags    []Tag
+
+	// How long the most recent calls took (up to 1024 of them), sorted
+	// from fastest to slowest, see `Percentile(...)`
+	Samples []time.Duration
+}
+
+// Mean returns the average duration of the calls, of those which were not
+// approximate if "ExcludeApproximateStats" is set.
+func (s FuncStats) Mean() time.Duration {
+	calls := s.Calls
+	if s.approximateExcluded {
+		calls -= s.Approximate
+	}
+	if calls == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(calls)
+}
+
+// Percentile returns the duration which "p" percent (between 0 and 100)
+// of the sampled calls took at most, or 0 if there are none.
+func (s FuncStats) Percentile(p float64) time.Duration {
+	n := len(s.Samples)
+	if n == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(n)))
+	if rank < 1 {
+		rank = 1
+	} else if rank > n {
+		rank = n
+	}
+	return s.Samples[rank-1]
+}
+
+// A StatsMark is a point in time to compute statistics from, see
+// `Tracer.Mark()`.
+type StatsMark struct {
+	seq    uint64
+	resets uint64
+	totals map[string]markTotals
+}
+
+type markTotals struct {
+	calls         uint64
+	total         int64
+	cancelled     uint64
+	failed        uint64
+	panics        uint64
+	injected      int64
+	approximate   uint64
+	loggedLines   uint64
+	loggedBytes   uint64
+	cpu           int64
+	abandoned     uint64
+	abandonedTime int64
+}
+
+// The per-function bookkeeping of a tracer
+type stats struct {
+	funcs     sync.Map // name -> *funcStats
+	gauges    sync.Map // name -> *gauge
+	pools     sync.Map // name -> *poolStats
+	ops       sync.Map // operation -> *funcStats
+	lastSweep int64
+
+	// The histograms of `Span.Observe(...)`, the metrics observed so far,
+	// and the values observed by ended spans
+	observed            sync.Map // function -> metric -> *histogram
+	metrics             sync.Map // metric -> *observedMetric
+	droppedObservations uint64
+
+	// Numbers every call, in the order they exit
+	seq uint64
+
+	// How many times the statistics were reset, see `ResetStats()`
+	resets uint64
+}
+
+func (t *Tracer) funcStats(name string) *funcStats {
+	return loadStats(&t.stats.funcs, name)
+}
+
+func loadStats(m *sync.Map, name string) *funcStats {
+	if fs, ok := m.Load(name); ok {
+		return fs.(*funcStats)
+	}
+	fs, _ := m.LoadOrStore(name, &funcStats{})
+	return fs.(*funcStats)
+}
+
+// Counts the calling goroutine in the function's gauge, and returns the
+// gauge along with how many goroutines are inside the function now.
+func (t *Tracer) enterGauge(name string) (*gauge, int64) {
+	for {
+		g, ok := t.stats.gauges.Load(name)
+		if !ok {
+			g, _ = t.stats.gauges.LoadOrStore(name, &gauge{})
+		}
+		n := atomic.AddInt64(&g.(*gauge).n, 1)
+		if n > 0 {
+			fs := t.funcStats(name)
+			for {
+				max := atomic.LoadInt64(&fs.maxConcurrent)
+				if n <= max || atomic.CompareAndSwapInt64(&fs.maxConcurrent, max, n) {
+					break
+				}
+			}
+			return g.(*gauge), n
+		}
+		// Swept from under us, a fresh gauge replaces it
+		t.stats.gauges.CompareAndSwap(name, g, &gauge{})
+	}
+}
+
+// Records a completed call, and sweeps the idle gauges every once in a
+// while. Only ever called once per span, since exits are idempotent.
+func (t *Tracer) exitStats(span *Span, ev *Event) {
+	fs := t.funcStats(ev.Name)
+	var op *funcStats
+	if ev.Operation != "" {
+		op = loadStats(&t.stats.ops, ev.Operation)
+	}
+	if ev.Abandoned {
+		atomic.AddUint64(&fs.abandoned, 1)
+		atomic.AddInt64(&fs.abandonedTime, int64(ev.Duration))
+		if op != nil {
+			atomic.AddUint64(&op.abandoned, 1)
+			atomic.AddInt64(&op.abandonedTime, int64(ev.Duration))
+		}
+	} else {
+		t.countCall(span, fs, ev)
+		if op != nil {
+			t.countCall(span, op, ev)
+		}
+	}
+
+	now := ev.Time.UnixNano()
+	if atomic.AddInt64(&span.gauge.n, -1) == 0 {
+		atomic.StoreInt64(&span.gauge.idleSince, now)
+	}
+
+	idle := int64(t.options.InFlightIdleTimeout)
+	last := atomic.LoadInt64(&t.stats.lastSweep)
+	if now-last < idle || !atomic.CompareAndSwapInt64(&t.stats.lastSweep, last, now) {
+		return
+	}
+	t.stats.gauges.Range(func(name, value interface{}) bool {
+		g := value.(*gauge)
+		if now-atomic.LoadInt64(&g.idleSince) >= idle && atomic.CompareAndSwapInt64(&g.n, 0, gaugeDead) {
+			t.stats.gauges.CompareAndDelete(name, g)
+		}
+		return true
+	})
+}
+
+// Counts a call which exited, unless it was abandoned
+func (t *Tracer) countCall(span *Span, fs *funcStats, ev *Event) {
+	atomic.AddUint64(&fs.calls, 1)
+	excluded := ev.Approximate && t.options.ExcludeApproximateStats
+	if ev.Approximate {
+		atomic.AddUint64(&fs.approximate, 1)
+	}
+	if !excluded {
+		atomic.AddInt64(&fs.total, int64(ev.Duration))
+	}
+	if ev.Cancelled {
+		atomic.AddUint64(&fs.cancelled, 1)
+	}
+	if ev.Err != nil {
+		atomic.AddUint64(&fs.failed, 1)
+	}
+	if ev.PanicType != "" {
+		atomic.AddUint64(&fs.panics, 1)
+	}
+	if ev.Injected > 0 {
+		atomic.AddInt64(&fs.injected, int64(ev.Injected))
+	}
+	if ev.CPUTime > 0 {
+		atomic.AddInt64(&fs.cpu, int64(ev.CPUTime))
+	}
+	if t.options.TrackOutputVolume {
+		atomic.AddUint64(&fs.loggedLines, atomic.LoadUint64(&span.loggedLines))
+		atomic.AddUint64(&fs.loggedBytes, atomic.LoadUint64(&span.loggedBytes))
+	}
+	fs.mu.Lock()
+	if ev.Err != nil {
+		class := PanicErrorClass
+		if ev.PanicType == "" {
+			class = t.classifyError(ev.Err)
+		}
+		t.recordError(fs, class, ev.Err)
+	}
+	if !excluded {
+		sample := callSample{atomic.AddUint64(&t.stats.seq, 1), ev.Duration, ev.Message, ev.Tags}
+		if len(fs.samples) < statsSamples {
+			fs.samples = append(fs.samples, sample)
+		} else {
+			fs.samples[fs.next] = sample
+			fs.next = (fs.next + 1) % statsSamples
+		}
+		if t.options.DetectCaching && fs.first.seq == 0 {
+			fs.first = sample
+		}
+		if fs.slowest.seq == 0 || sample.duration > fs.slowest.duration {
+			fs.slowest = sample
+		}
+	}
+	fs.mu.Unlock()
+}
+
+// Stats returns the statistics of every function traced so far, sorted
+// by name.
+func (t *Tracer) Stats() []FuncStats {
+	return t.collectStats(nil)
+}
+
+// Mark returns the current point in time, so that `StatsSince(...)` can
+// leave out everything traced before it.
+func (t *Tracer) Mark() *StatsMark {
+	mark := &StatsMark{seq: atomic.LoadUint64(&t.stats.seq), resets: atomic.LoadUint64(&t.stats.resets), totals: make(map[string]markTotals)}
+	t.stats.funcs.Range(func(name, value interface{}) bool {
+		fs := value.(*funcStats)
+		mark.totals[name.(string)] = markTotals{atomic.LoadUint64(&fs.calls), atomic.LoadInt64(&fs.total), atomic.LoadUint64(&fs.cancelled), atomic.LoadUint64(&fs.failed), atomic.LoadUint64(&fs.panics), atomic.LoadInt64(&fs.injected), atomic.LoadUint64(&fs.approximate),
+			atomic.LoadUint64(&fs.loggedLines), atomic.LoadUint64(&fs.loggedBytes), atomic.LoadInt64(&fs.cpu),
+			atomic.LoadUint64(&fs.abandoned), atomic.LoadInt64(&fs.abandonedTime)}
+		return true
+	})
+	return mark
+}
+
+// StatsSince returns the statistics of the calls which exited since the
+// mark, sorted by name. Functions which were not called since are left
+// out. The slowest call and the samples come from the most recent calls
+// to each function, so they may miss some of the calls if there were more
+// than 1024 since the mark. "InFlight" and "MaxConcurrent" are the same
+// as for `Stats()`.
+func (t *Tracer) StatsSince(mark *StatsMark) []FuncStats {
+	return t.collectStats(mark)
+}
+
+// ResetStats forgets the statistics of every function traced so far, as
+// if none had been called yet, the first calls of "DetectCaching" and the
+// observations among them. A mark taken before counts every call since the
+// reset.
+func (t *Tracer) ResetStats() {
+	for _, m := range []*sync.Map{&t.stats.funcs, &t.stats.ops, &t.stats.observed} {
+		m.Range(func(name, _ interface{}) bool {
+			m.Delete(name)
+			return true
+		})
+	}
+	atomic.AddUint64(&t.stats.resets, 1)
+}
+
+func (t *Tracer) collectStats(mark *StatsMark) []FuncStats {
+	return t.collect(&t.stats.funcs, mark)
+}
+
+// Summarizes the running totals of the map, of functions or operations
+func (t *Tracer) collect(m *sync.Map, mark *StatsMark) []FuncStats {
+	var all []FuncStats
+	functions := m == &t.stats.funcs
+	m.Range(func(name, value interface{}) bool {
+		fs := value.(*funcStats)
+		s := FuncStats{
+			Name:          name.(string),
+			Calls:         atomic.LoadUint64(&fs.calls),
+			Total:         time.Duration(atomic.LoadInt64(&fs.total)),
+			Cancelled:     atomic.LoadUint64(&fs.cancelled),
+			Failed:        atomic.LoadUint64(&fs.failed),
+			Panics:        atomic.LoadUint64(&fs.panics),
+			InjectedTime:  time.Duration(atomic.LoadInt64(&fs.injected)),
+			MaxConcurrent: atomic.LoadInt64(&fs.maxConcurrent),
+
+			Approximate:         atomic.LoadUint64(&fs.approximate),
+			approximateExcluded: t.options.ExcludeApproximateStats,
+
+			LoggedLines: atomic.LoadUint64(&fs.loggedLines),
+			LoggedBytes: atomic.LoadUint64(&fs.loggedBytes),
+			CPUTime:     time.Duration(atomic.LoadInt64(&fs.cpu)),
+
+			Abandoned:     atomic.LoadUint64(&fs.abandoned),
+			AbandonedTime: time.Duration(atomic.LoadInt64(&fs.abandonedTime)),
+		}
+		if mark != nil {
+			var before markTotals
+			if mark.resets == atomic.LoadUint64(&t.stats.resets) {
+				before = mark.totals[s.Name]
+			}
+			s.Calls -= before.calls
+			s.Total -= time.Duration(before.total)
+			s.Cancelled -= before.cancelled
+			s.Failed -= before.failed
+			s.Panics -= before.panics
+			s.InjectedTime -= time.Duration(before.injected)
+			s.Approximate -= before.approximate
+			s.LoggedLines -= before.loggedLines
+			s.LoggedBytes -= before.loggedBytes
+			s.CPUTime -= time.Duration(before.cpu)
+			s.Abandoned -= before.abandoned
+			s.AbandonedTime -= time.Duration(before.abandonedTime)
+			if s.Calls == 0 && s.Abandoned == 0 {
+				return true
+			}
+		}
+		if g, ok := t.stats.gauges.Load(name); ok && functions {
+			if n := atomic.LoadInt64(&g.(*gauge).n); n > 0 {
+				s.InFlight = n
+			}
+		}
+
+		fs.mu.Lock()
+		slowest := fs.slowest
+		if mark != nil {
+			slowest = callSample{}
+		}
+		for _, sample := range fs.samples {
+			if mark != nil {
+				if sample.seq <= mark.seq {
+					continue
+				}
+				if slowest.seq == 0 || sample.duration > slowest.duration {
+					slowest = sample
+				}
+			}
+			s.Samples = append(s.Samples, sample.duration)
+		}
+		fs.mu.Unlock()
+		sort.Slice(s.Samples, func(i, j int) bool { return s.Samples[i] < s.Samples[j] })
+		s.Max, s.MaxMessage, s.MaxTags = slowest.duration, slowest.message, slowest.tags
+
+		all = append(all, s)
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// DumpStats writes the statistics returned by `Stats()` as a table,
+// followed by the values of the counters and gauges, see `Counter(...)`,
+// the statistics of the pools (see `PoolStats()`) and of the operations
+// (see `OperationStats(...)`), the histograms of the observations (see
+// `Span.Observe(...)`), the functions which look cached, see
+// "DetectCaching", and the most frequent error classes of the functions
+// which had failed calls, see "TopErrorClasses". With "TrackOutputVolume" set, the
+// table also has what the calls logged, and with "AbandonAfter" or
+// "AbandonAfterFuncs" set how many were abandoned.
+func (t *Tracer) DumpStats(w io.Writer) error {
+	all := t.Stats()
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	header := "FUNCTION\tCALLS\tTOTAL\tMEAN\tIN FLIGHT\tMAX CONCURRENT"
+	if t.options.TrackOutputVolume {
+		header += "\tLOGGED"
+	}
+	abandons := t.abandonAfter != nil
+	if abandons {
+		header += "\tABANDONED"
+	}
+	fmt.Fprintln(tw, header)
+	for _, s := range all {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%d", s.Name, s.Calls,
+			formatDuration(s.Total), formatDuration(s.Mean()), s.InFlight, s.MaxConcurrent)
+		if t.options.TrackOutputVolume {
+			fmt.Fprintf(tw, "\t%d lines / %s", s.LoggedLines, formatBytes(s.LoggedBytes))
+		}
+		if abandons {
+			fmt.Fprintf(tw, "\t%d", s.Abandoned)
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if err := t.dumpInstruments(w); err != nil {
+		return err
+	}
+	if err := t.dumpPools(w); err != nil {
+		return err
+	}
+	if err := t.dumpOperations(w); err != nil {
+		return err
+	}
+	if err := t.dumpObservations(w); err != nil {
+		return err
+	}
+	if err := t.dumpCaching(w); err != nil {
+		return err
+	}
+	return t.dumpErrors(w, all)
+}
@@ -0,0 +1,151 @@
+package tracey
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the stats of the function, or the zero value if it is unknown
+func statsOf(t *Tracer, name string) FuncStats {
+	for _, s := range t.Stats() {
+		if s.Name == name {
+			return s
+		}
+	}
+	return FuncStats{}
+}
+
+func TestConcurrencyGauge(test *testing.T) {
+	t := NewTracer(&Options{CustomLogger: log.New(io.Discard, "", 0)})
+
+	var entered, done sync.WaitGroup
+	gate := make(chan struct{})
+	worker := func() {
+		defer done.Done()
+		defer t.Enter("%s", "worker")()
+		entered.Done()
+		<-gate
+	}
+	for i := 0; i < 50; i++ {
+		entered.Add(1)
+		done.Add(1)
+		go worker()
+	}
+	entered.Wait()
+
+	name := "go-tracey.TestConcurrencyGauge.func1"
+	assert.Equal(test, int64(50), statsOf(t, name).InFlight)
+	close(gate)
+	done.Wait()
+
+	s := statsOf(t, name)
+	assert.Equal(test, uint64(50), s.Calls)
+	assert.Equal(test, int64(50), s.MaxConcurrent)
+	assert.Equal(test, int64(0), s.InFlight)
+}
+
+func TestShowConcurrency(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, ShowConcurrency: true})
+
+	first := t.Start("%s", "same")
+	second := t.Start("%s", "same")
+	second.End()
+	first.End()
+
+	assert.Equal(test, `
+[ 0]ENTER: =>same [inflight=1]
+[ 1]  ENTER: =>same [inflight=2]
+[ 1]  EXIT:  =>same
+[ 0]EXIT:  =>same
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+}
+
+// Helper functions - part of "TestIdleGaugesAreSwept"
+func sweptA(t *Tracer) { defer t.Enter()() }
+func sweptB(t *Tracer) { defer t.Enter()() }
+
+func TestIdleGaugesAreSwept(test *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t := NewTracer(&Options{
+		CustomLogger:        log.New(io.Discard, "", 0),
+		Clock:               func() time.Time { return now },
+		InFlightIdleTimeout: time.Minute,
+	})
+	gauges := func() (names []string) {
+		t.stats.gauges.Range(func(name, _ interface{}) bool {
+			names = append(names, strings.TrimPrefix(name.(string), "go-tracey."))
+			return true
+		})
+		sort.Strings(names)
+		return names
+	}
+
+	sweptA(t)
+	held := t.Start()
+	assert.Equal(test, []string{"TestIdleGaugesAreSwept", "sweptA"}, gauges())
+
+	// Gauges of functions still being run survive the sweep
+	now = now.Add(2 * time.Minute)
+	sweptB(t)
+	assert.Equal(test, []string{"TestIdleGaugesAreSwept", "sweptB"}, gauges())
+
+	held.End()
+	now = now.Add(2 * time.Minute)
+	sweptA(t)
+	assert.Equal(test, []string{"sweptA"}, gauges())
+
+	// Stats outlive the gauges
+	assert.Equal(test, uint64(2), statsOf(t, "go-tracey.sweptA").Calls)
+	assert.Equal(test, uint64(1), statsOf(t, "go-tracey.sweptB").Calls)
+	assert.Equal(test, int64(1), statsOf(t, "go-tracey.TestIdleGaugesAreSwept").MaxConcurrent)
+}
+
+func TestDumpStats(test *testing.T) {
+	t := NewTracer(&Options{CustomLogger: log.New(io.Discard, "", 0)})
+	span := t.Start()
+	t.Start().End()
+	defer span.End()
+
+	var buf bytes.Buffer
+	assert.Nil(test, t.DumpStats(&buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(test, 2, len(lines))
+	assert.True(test, strings.HasPrefix(lines[0], "FUNCTION "))
+	assert.Equal(test, []string{"go-tracey.TestDumpStats", "1", "D", "D", "1", "2"}, strings.Fields(RE_durations.ReplaceAllString(lines[1], "D")))
+}
+
+func TestStatsSince(test *testing.T) {
+	t := NewTracer(&Options{CustomLogger: BufLogger, Clock: fakeClock(time.Millisecond)})
+	sweptA(t)
+	sweptA(t)
+	mark := t.Mark()
+	assert.Empty(test, t.StatsSince(mark))
+
+	sweptA(t)
+	sweptB(t)
+	since := t.StatsSince(mark)
+	if assert.Equal(test, 2, len(since)) {
+		assert.Equal(test, "go-tracey.sweptA", since[0].Name)
+		assert.Equal(test, uint64(1), since[0].Calls)
+		assert.Equal(test, []time.Duration{time.Millisecond}, since[0].Samples)
+	}
+	assert.Equal(test, uint64(3), statsOf(t, "go-tracey.sweptA").Calls)
+}
+
+func TestPercentile(test *testing.T) {
+	s := FuncStats{Samples: []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}}
+	assert.Equal(test, time.Duration(1), s.Percentile(0))
+	assert.Equal(test, time.Duration(5), s.Percentile(50))
+	assert.Equal(test, time.Duration(10), s.Percentile(95))
+	assert.Equal(test, time.Duration(10), s.Percentile(100))
+	assert.Equal(test, time.Duration(0), FuncStats{}.Percentile(95))
+}
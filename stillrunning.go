@@ -0,0 +1,122 @@
+package tracey
+
+import (
+	"bytes"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultWarnStackFrames is how many frames the stack excerpts of
+// "WarnWithStack" keep, when "WarnStackFrames" is 0.
+const DefaultWarnStackFrames = 8
+
+// DefaultWarnStackInterval is how often stacks are captured at most for
+// "WarnWithStack", when "WarnStackInterval" is 0.
+const DefaultWarnStackInterval = 10 * time.Second
+
+// Warns about the spans open for longer than "WarnAfter". Returns false if
+// there are no spans open at all.
+func (sc *scanner) scanWarnings(t *Tracer, now time.Time) bool {
+	var due []*Span
+	open := false
+	t.goroutines.each(func(gid uint64, spans []*Span) {
+		open = true
+		for _, s := range spans {
+			if !s.muted && atomic.LoadUint32(&s.warned) == 0 && now.Sub(s.ev.Time) >= t.options.WarnAfter {
+				due = append(due, s)
+			}
+		}
+	})
+	for _, s := range due {
+		if atomic.CompareAndSwapUint32(&s.warned, 0, 1) {
+			t.warnStillRunning(s, now)
+		}
+	}
+	return open
+}
+
+// Returns true if a stack may be captured at "now", and notes that it was
+func (sc *scanner) admitStack(now time.Time, interval time.Duration) bool {
+	last := atomic.LoadInt64(&sc.lastStack)
+	return (last == 0 || now.UnixNano()-last >= int64(interval)) &&
+		atomic.CompareAndSwapInt64(&sc.lastStack, last, now.UnixNano())
+}
+
+// The text of STILL RUNNING warnings whose stack was not captured
+const stackOmitted = "(stack omitted, rate-limited)"
+
+// Logs that a span is still running, as in
+// "⚠ STILL RUNNING main.work — running 30s [tid:7]", followed by what
+// its goroutine is doing if "WarnWithStack" is set
+func (t *Tracer) warnStillRunning(s *Span, now time.Time) {
+	if atomic.LoadUint32(&s.ended) != 0 {
+		return
+	}
+	ev := Event{Kind: PointEvent, Time: now, TID: s.ev.TID, Message: "STILL RUNNING", stillRunning: true}
+	t.within(&ev, s)
+	ev.Depth = s.ev.Depth
+	if t.options.WarnWithStack {
+		interval := t.options.WarnStackInterval
+		if interval <= 0 {
+			interval = DefaultWarnStackInterval
+		}
+		ev.Stack = stackOmitted
+		if t.scanner.admitStack(now, interval) {
+			frames := t.options.WarnStackFrames
+			if frames <= 0 {
+				frames = DefaultWarnStackFrames
+			}
+			ev.Stack = goroutineStack(ev.TID, frames)
+		}
+	}
+	t.emitPoint(&ev)
+}
+
+// Returns the state and the innermost "frames" frames of a goroutine,
+// outside of tracey, as in
+//
+//	goroutine 7 [chan receive]:
+//	main.work(...)
+//		/src/main.go:12 +0x1d
+//
+// or "" if the goroutine is gone.
+func goroutineStack(gid uint64, frames int) string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	header := []byte("goroutine " + strconv.FormatUint(gid, 10) + " [")
+	var block []byte
+	for _, b := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(b, header) {
+			block = b
+			break
+		}
+	}
+	if block == nil {
+		return ""
+	}
+
+	lines := strings.Split(strings.TrimRight(string(block), "\n"), "\n")
+	kept := []string{lines[0]}
+	for i := 1; i+1 < len(lines) && len(kept) < 1+2*frames; i += 2 {
+		file := strings.TrimSpace(lines[i+1])
+		if at := strings.LastIndexByte(file, ':'); at >= 0 {
+			file = file[:at]
+		}
+		if path.Dir(file) == traceyDir && !strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		kept = append(kept, lines[i], lines[i+1])
+	}
+	return strings.Join(kept, "\n")
+}
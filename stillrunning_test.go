@@ -0,0 +1,103 @@
+package tracey
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func blockOnChannel(t *Tracer, ready chan<- struct{}, release <-chan struct{}) {
+	defer t.Enter("%s", "wait")()
+	ready <- struct{}{}
+	<-release
+}
+
+func TestWarnWithStack(test *testing.T) {
+	var buf bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:             []Sink{{Logger: log.New(&buf, "", 0)}},
+		Clock:             clock.Now,
+		WarnAfter:         30 * time.Second,
+		WarnWithStack:     true,
+		WarnStackInterval: time.Hour,
+	})
+	// Warnings are triggered by hand below
+	t.Close()
+
+	ready, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	go blockOnChannel(t, ready, release)
+	<-ready
+	assert.True(test, t.scanner.scan(t, clock.advance(29*time.Second)))
+	assert.NotContains(test, buf.String(), "STILL RUNNING")
+
+	t.scanner.scan(t, clock.advance(time.Second))
+	lines := strings.Split(buf.String(), "\n")
+	assert.Regexp(test, `^\[ 0\]⚠ STILL RUNNING go-tracey.blockOnChannel — running 30s \[tid:\d+\]$`, lines[1])
+	assert.Regexp(test, `^        goroutine \d+ \[chan receive`, lines[2])
+	assert.Contains(test, buf.String(), "        github.com/sujitvp/go-tracey.blockOnChannel(")
+	assert.NotContains(test, buf.String(), "stillrunning.go")
+	assert.NotContains(test, buf.String(), "tracey.go:")
+
+	// The first span is only warned about once, the second one's stack is
+	// rate-limited
+	go blockOnChannel(t, ready, release)
+	<-ready
+	buf.Reset()
+	t.scanner.scan(t, clock.advance(time.Minute))
+	assert.Regexp(test, `^\[ 0\]⚠ STILL RUNNING go-tracey.blockOnChannel — running 1m0s \[tid:\d+\]\n`+
+		`        \(stack omitted, rate-limited\)\n$`, buf.String())
+}
+
+func TestWarnAfterJSON(test *testing.T) {
+	var buf bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &buf, Format: JSONFormat}}, Clock: clock.Now, WarnAfter: time.Minute})
+	t.Close()
+
+	span := t.Start("%s", "slow")
+	t.scanner.scan(t, clock.advance(2*time.Minute))
+	span.End()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(test, 3, len(lines))
+	ev, err := UnmarshalEvent([]byte(lines[1]))
+	assert.Nil(test, err)
+	assert.Equal(test, PointEvent, ev.Kind)
+	assert.Equal(test, "STILL RUNNING", ev.Message)
+	assert.Equal(test, 2*time.Minute, ev.Duration)
+	assert.Equal(test, "", ev.Stack)
+}
+
+func TestWarnAfterScanner(test *testing.T) {
+	var buf lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &buf}}, WarnAfter: 10 * time.Millisecond})
+	defer t.Close()
+
+	// The scanner goes away in between spans, and comes back for the next
+	for i := 0; i < 2; i++ {
+		span := t.Start("%s", "slow")
+		time.Sleep(50 * time.Millisecond)
+		span.End()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(test, 2, strings.Count(buf.String(), "STILL RUNNING"))
+}
+
+func TestWarnAfterWithHeartbeats(test *testing.T) {
+	var buf lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &buf}}, WarnAfter: 10 * time.Millisecond, ProgressInterval: 20 * time.Millisecond})
+	defer t.Close()
+
+	// Both from the one scanner goroutine
+	importRecords(t, func(span *Span) {
+		span.SetProgress(1, 2)
+		time.Sleep(50 * time.Millisecond)
+	})
+	assert.Equal(test, 1, strings.Count(buf.String(), "STILL RUNNING"))
+	assert.Contains(test, buf.String(), "⏳ go-tracey.importRecords 50% (1/2)")
+}
@@ -0,0 +1,315 @@
+package tracey
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultStreamBufferBytes is how many bytes of lines are queued for each
+// client of `ListenUnix(...)`, when "StreamBufferBytes" is 0.
+const DefaultStreamBufferBytes = 256 << 10
+
+// DefaultStreamDropReportInterval is how often the clients of
+// `ListenUnix(...)` are told how many lines they missed, when
+// "StreamDropReportInterval" is 0.
+const DefaultStreamDropReportInterval = time.Second
+
+// How long a client has to send its handshake line
+const streamHandshakeTimeout = 5 * time.Second
+
+// The listeners of `ListenUnix(...)`, and the clients connected to them
+type streamHub struct {
+	// The clients which sent their handshake, counted atomically so that
+	// events only cost a load while there are none
+	count int32
+
+	sync.Mutex
+	clients   map[*streamClient]struct{}
+	listeners map[*streamListener]struct{}
+}
+
+// A socket `ListenUnix(...)` listens on
+type streamListener struct {
+	path     string
+	listener net.Listener
+	done     chan struct{}
+	once     sync.Once
+}
+
+// A client of a stream, its lines queued as those of an "Async" sink
+type streamClient struct {
+	hub    *streamHub
+	conn   net.Conn
+	sink   *sinkState
+	closed uint32
+	stop   chan struct{}
+}
+
+// Writes a line to the client, dropping the client should it fail, so
+// that its queue just drains. Never fails, the client being gone.
+func (c *streamClient) Write(p []byte) (int, error) {
+	if atomic.LoadUint32(&c.closed) == 0 {
+		if _, err := c.conn.Write(p); err != nil {
+			c.hub.remove(c)
+		}
+	}
+	return len(p), nil
+}
+
+// ListenUnix has the tracer stream its events to the clients which
+// connect to the unix socket at "path", such as a viewer, or `nc -U`.
+// A client sends a line first, "text" or "json" (an empty line standing
+// for "text"), and is then sent every event rendered in that format (the
+// text without colors) from then on, whatever the sinks filter out. Each
+// client has a queue of its own, of "StreamBufferBytes", so that a slow
+// client only delays itself: once its queue is full the client misses
+// lines, and is told how many every "StreamDropReportInterval", as in "#
+// tracey: 120 lines dropped" (a note, in JSON). While no client is
+// connected, events only cost an atomic load. A socket left behind by a
+// process which is gone is removed, and so is the socket once the
+// returned function is called, or `Close()` is. The function disconnects
+// the clients as well. Calling it more than once has no further effect.
+func (t *Tracer) ListenUnix(path string) (stop func(), err error) {
+	if t.start == nil {
+		return func() {}, nil
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, fmt.Errorf("tracey: no permission to create the socket %s: %v", path, err)
+		}
+		return nil, fmt.Errorf("tracey: cannot listen on %s: %v", path, err)
+	}
+	l := &streamListener{path: path, listener: listener, done: make(chan struct{})}
+	t.streams.Lock()
+	if t.streams.listeners == nil {
+		t.streams.listeners = make(map[*streamListener]struct{})
+		t.streams.clients = make(map[*streamClient]struct{})
+	}
+	t.streams.listeners[l] = struct{}{}
+	t.streams.Unlock()
+	go t.accept(l)
+	return func() { t.streams.stop(l) }, nil
+}
+
+// Removes the socket at the path if no process listens on it anymore,
+// and fails if one does, or if something other than a socket is there
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("tracey: cannot check %s: %v", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("tracey: %s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("tracey: %s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("tracey: cannot remove the stale socket %s: %v", path, err)
+	}
+	return nil
+}
+
+func (t *Tracer) accept(l *streamListener) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			t.note("Warning: stopped streaming to " + l.path + ": " + err.Error() + "\n")
+			return
+		}
+		go t.serveStream(l, conn)
+	}
+}
+
+// Reads the handshake of the client, and streams to it until it leaves
+func (t *Tracer) serveStream(l *streamListener, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(streamHandshakeTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var format Format
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "", "text":
+		format = TextFormat
+	case "json":
+		format = JSONFormat
+	default:
+		fmt.Fprintf(conn, "# tracey: unknown format %q, want text or json\n", strings.TrimSpace(line))
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c := &streamClient{hub: &t.streams, conn: conn, stop: make(chan struct{})}
+	limit := t.options.StreamBufferBytes
+	if limit <= 0 {
+		limit = DefaultStreamBufferBytes
+	}
+	c.sink = &sinkState{Sink: Sink{Writer: c, Format: format, Async: true, AsyncBufferBytes: limit}, lockFree: true, safeWriter: true}
+	c.sink.async = newAsyncQueue(c.sink)
+	if !t.streams.add(l, c) {
+		conn.Close()
+		return
+	}
+	if t.options.SessionID != "" {
+		header := getBuffer()
+		c.sink.render(t, header, &Event{Kind: SessionEvent, Time: t.options.Clock(), Session: t.options.SessionID, Build: t.build})
+		c.sink.async.enqueue(0, nil, header.Bytes())
+		putBuffer(header)
+	}
+	go t.reportStreamDrops(c)
+
+	// Nothing more is expected from the client, but for it to leave
+	var discard [512]byte
+	for {
+		if _, err := r.Read(discard[:]); err != nil {
+			break
+		}
+	}
+	t.streams.remove(c)
+}
+
+// Tells the client how many lines it missed, every so often
+func (t *Tracer) reportStreamDrops(c *streamClient) {
+	interval := t.options.StreamDropReportInterval
+	if interval <= 0 {
+		interval = DefaultStreamDropReportInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		q := c.sink.async
+		q.Lock()
+		var dropped uint64
+		for tid, n := range q.dropped {
+			dropped += n
+			delete(q.dropped, tid)
+		}
+		q.Unlock()
+		if dropped == 0 {
+			continue
+		}
+		lines := " lines"
+		if dropped == 1 {
+			lines = " line"
+		}
+		buf := getBuffer()
+		if c.sink.renderNote(buf, "# tracey: "+strconv.FormatUint(dropped, 10)+lines+" dropped\n") {
+			q.enqueue(0, nil, buf.Bytes())
+		}
+		putBuffer(buf)
+	}
+}
+
+// Adds the client, unless its listener was stopped meanwhile
+func (h *streamHub) add(l *streamListener, c *streamClient) bool {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.listeners[l]; !ok {
+		return false
+	}
+	h.clients[c] = struct{}{}
+	atomic.AddInt32(&h.count, 1)
+	return true
+}
+
+// Disconnects the client, once
+func (h *streamHub) remove(c *streamClient) {
+	if !atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		return
+	}
+	h.Lock()
+	delete(h.clients, c)
+	atomic.AddInt32(&h.count, -1)
+	h.Unlock()
+	close(c.stop)
+	c.conn.Close()
+}
+
+// Stops the listener, disconnecting every client should it be the last
+// one, and removes its socket
+func (h *streamHub) stop(l *streamListener) {
+	l.once.Do(func() {
+		close(l.done)
+		l.listener.Close()
+		os.Remove(l.path)
+		h.Lock()
+		delete(h.listeners, l)
+		var clients []*streamClient
+		if len(h.listeners) == 0 {
+			for c := range h.clients {
+				clients = append(clients, c)
+			}
+		}
+		h.Unlock()
+		for _, c := range clients {
+			h.remove(c)
+		}
+	})
+}
+
+// Stops every listener, see `Close()`
+func (h *streamHub) close() {
+	h.Lock()
+	var listeners []*streamListener
+	for l := range h.listeners {
+		listeners = append(listeners, l)
+	}
+	h.Unlock()
+	for _, l := range listeners {
+		h.stop(l)
+	}
+}
+
+// Queues the event for every client, rendered once per format
+func (h *streamHub) publish(t *Tracer, ev *Event) {
+	h.Lock()
+	defer h.Unlock()
+	var text, json []byte
+	for c := range h.clients {
+		p := &text
+		if c.sink.Format == JSONFormat {
+			p = &json
+		}
+		if *p == nil {
+			buf := getBuffer()
+			c.sink.render(t, buf, ev)
+			*p = append([]byte(nil), buf.Bytes()...)
+			putBuffer(buf)
+		}
+		c.sink.async.enqueue(ev.TID, ev, *p)
+	}
+}
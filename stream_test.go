@@ -0,0 +1,208 @@
+package tracey
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A client of a stream, collecting the lines it is sent
+type streamReader struct {
+	conn  net.Conn
+	mu    sync.Mutex
+	lines []string
+	count int32
+	done  chan struct{}
+}
+
+// Connects to the socket with the handshake, and waits for the tracer to
+// count the client in. The lines are only read once "start" is closed.
+func connectStream(test *testing.T, t *Tracer, path, handshake string, start chan struct{}) *streamReader {
+	conn, err := net.Dial("unix", path)
+	if !assert.Nil(test, err) {
+		test.FailNow()
+	}
+	before := atomic.LoadInt32(&t.streams.count)
+	conn.Write([]byte(handshake + "\n"))
+	r := &streamReader{conn: conn, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		<-start
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			r.mu.Lock()
+			r.lines = append(r.lines, scanner.Text())
+			r.mu.Unlock()
+			atomic.AddInt32(&r.count, 1)
+		}
+	}()
+	waitFor(test, func() bool { return atomic.LoadInt32(&t.streams.count) > before })
+	return r
+}
+
+func (r *streamReader) read() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+func waitFor(test *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			test.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestListenUnix(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "trace.sock")
+	var text, js bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Writer: &text}, {Writer: &js, Format: JSONFormat}},
+		Clock:            fakeClock(time.Millisecond),
+		MessageTemplates: map[string]string{`.`: "$MSG"},
+	})
+	stop, err := t.ListenUnix(path)
+	assert.Nil(test, err)
+
+	// Nothing is streamed while nobody is connected
+	t.Start("%s", "unseen").End()
+
+	start := make(chan struct{})
+	close(start)
+	textClient := connectStream(test, t, path, "", start)
+	jsonClient := connectStream(test, t, path, "json", start)
+	text.Reset()
+	js.Reset()
+	func() {
+		defer t.Enter("%s", "outer")()
+		t.Start("%s", "inner").End()
+	}()
+	waitFor(test, func() bool {
+		return atomic.LoadInt32(&textClient.count) == 4 && atomic.LoadInt32(&jsonClient.count) == 4
+	})
+	assert.Equal(test, strings.Split(strings.TrimSpace(text.String()), "\n"), textClient.read())
+	assert.Equal(test, strings.Split(strings.TrimSpace(js.String()), "\n"), jsonClient.read())
+	for i, line := range jsonClient.read() {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		assert.Equal(test, []string{"outer", "inner", "inner", "outer"}[i], ev.Message)
+	}
+
+	// A client which leaves is forgotten
+	textClient.conn.Close()
+	waitFor(test, func() bool { return atomic.LoadInt32(&t.streams.count) == 1 })
+	t.Start("%s", "after").End()
+	waitFor(test, func() bool { return atomic.LoadInt32(&jsonClient.count) == 6 })
+
+	stop()
+	<-jsonClient.done
+	_, err = os.Lstat(path)
+	assert.True(test, os.IsNotExist(err))
+	assert.Equal(test, int32(0), atomic.LoadInt32(&t.streams.count))
+	stop()
+}
+
+func TestListenUnixSlowClient(test *testing.T) {
+	path := filepath.Join(test.TempDir(), "trace.sock")
+	t := NewTracer(&Options{
+		Sinks:                    []Sink{{Writer: &bytes.Buffer{}}},
+		MessageTemplates:         map[string]string{`.`: "$MSG"},
+		StreamBufferBytes:        4 << 10,
+		StreamDropReportInterval: 5 * time.Millisecond,
+	})
+	stop, err := t.ListenUnix(path)
+	assert.Nil(test, err)
+	defer stop()
+
+	running := make(chan struct{})
+	close(running)
+	fast := connectStream(test, t, path, "text", running)
+	stalled := make(chan struct{})
+	slow := connectStream(test, t, path, "text", stalled)
+
+	// Enough to fill the socket's buffers as well as the queue, in batches
+	// which the fast client keeps up with
+	const batches, perBatch = 1000, 10
+	for i := 0; i < batches; i++ {
+		for j := 0; j < perBatch; j++ {
+			t.Start("%s", strings.Repeat("x", 100)).End()
+		}
+		want := int32((i + 1) * perBatch * 2)
+		waitFor(test, func() bool { return atomic.LoadInt32(&fast.count) >= want })
+	}
+	close(stalled)
+
+	dropped := func(lines []string) bool {
+		for _, line := range lines {
+			if strings.HasPrefix(line, "# tracey: ") && strings.HasSuffix(line, " dropped") {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor(test, func() bool { return dropped(slow.read()) })
+	assert.Regexp(test, `^# tracey: [0-9]+ lines dropped$`, func() string {
+		for _, line := range slow.read() {
+			if strings.HasPrefix(line, "# tracey: ") {
+				return line
+			}
+		}
+		return ""
+	}())
+	time.Sleep(20 * time.Millisecond)
+	assert.False(test, dropped(fast.read()))
+	assert.Len(test, fast.read(), batches*perBatch*2)
+}
+
+func TestListenUnixSocketFile(test *testing.T) {
+	dir := test.TempDir()
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}})
+
+	// Left behind by a process which is gone
+	path := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", path)
+	assert.Nil(test, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	stop, err := t.ListenUnix(path)
+	assert.Nil(test, err)
+
+	// In use
+	_, err = NewTracer(&Options{}).ListenUnix(path)
+	assert.EqualError(test, err, "tracey: "+path+" is in use by another process")
+	stop()
+
+	// Not a socket
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0o600)
+	_, err = t.ListenUnix(file)
+	assert.EqualError(test, err, "tracey: "+file+" exists and is not a socket")
+
+	// A bad handshake
+	path = filepath.Join(dir, "trace.sock")
+	stop, err = t.ListenUnix(path)
+	assert.Nil(test, err)
+	conn, err := net.Dial("unix", path)
+	assert.Nil(test, err)
+	conn.Write([]byte("xml\n"))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	assert.Equal(test, "# tracey: unknown format \"xml\", want text or json\n", line)
+
+	// Removed on Close
+	t.Close()
+	_, err = os.Lstat(path)
+	assert.True(test, os.IsNotExist(err))
+	stop()
+}
@@ -0,0 +1,182 @@
+package tracey
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RedactedTagValue is what the fields marked "redact" are tagged with, see
+// `TagsFromStruct(...)`.
+const RedactedTagValue = "[redacted]"
+
+// TagsFromStruct returns the tags of the fields of a struct (or of a
+// pointer to one) which have a "tracey" struct tag, keyed by the name the
+// struct tag gives them, as in
+//
+//	type Request struct {
+//		OrderID  string   `tracey:"order_id"`
+//		Token    string   `tracey:"token,redact"`
+//		Customer Customer `tracey:"customer"`
+//		Internal string   `tracey:"-"`
+//	}
+//
+// Struct fields are followed one level deep, their own fields being keyed
+// as in "customer.id", which "depth=N" changes to N levels. Those of types
+// with no "tracey" struct tags (such as time.Time) are tagged with their
+// value, as are those past the depth. Fields marked
+// "redact" are tagged with `RedactedTagValue` whatever their value. Nil
+// pointers are left out, and so are unexported fields. The fields of each
+// type are only looked up once.
+func TagsFromStruct(v interface{}) map[string]interface{} {
+	tags := make(map[string]interface{})
+	for _, tag := range appendStructTags(nil, v) {
+		tags[tag.Key] = tag.Value
+	}
+	return tags
+}
+
+// WithStructTags tags the span it is passed to along with the message
+// arguments with the fields of "v", see `TagsFromStruct(...)`, as in
+//
+//	defer tracer.Enter("$FN(%d)", id, tracey.WithStructTags(req))()
+func WithStructTags(v interface{}) interface{} {
+	return structTags{v}
+}
+
+type structTags struct {
+	v interface{}
+}
+
+// Splits the `WithStructTags(...)` off of the arguments to an enter,
+// returning the tags they make
+func splitStructTags(s []interface{}) ([]Tag, []interface{}) {
+	var tags []Tag
+	var rest []interface{}
+	for i, arg := range s {
+		st, ok := arg.(structTags)
+		if !ok {
+			if rest != nil {
+				rest = append(rest, arg)
+			}
+			continue
+		}
+		if rest == nil {
+			rest = append(make([]interface{}, 0, len(s)-1), s[:i]...)
+		}
+		tags = appendStructTags(tags, st.v)
+	}
+	if rest == nil {
+		return nil, s
+	}
+	return tags, rest
+}
+
+// The tagged fields of a struct type, followed down to some depth
+type structPlan struct {
+	fields []plannedField
+}
+
+type plannedField struct {
+	index  int
+	key    string
+	redact bool
+
+	// Set for struct fields which are followed
+	nested *structPlan
+}
+
+type planKey struct {
+	t     reflect.Type
+	depth int
+	root  bool
+}
+
+var structPlans sync.Map // planKey -> *structPlan
+
+func appendStructTags(tags []Tag, v interface{}) []Tag {
+	value, ok := indirect(reflect.ValueOf(v))
+	if !ok || value.Kind() != reflect.Struct {
+		return tags
+	}
+	return planFor(value.Type(), 1, true).appendTags(tags, value, "")
+}
+
+// Follows pointers and interfaces, returning false if one of them is nil
+func indirect(value reflect.Value) (reflect.Value, bool) {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return value, false
+		}
+		value = value.Elem()
+	}
+	return value, value.IsValid()
+}
+
+func (p *structPlan) appendTags(tags []Tag, value reflect.Value, prefix string) []Tag {
+	for i := range p.fields {
+		f := &p.fields[i]
+		field, ok := indirect(value.Field(f.index))
+		if !ok {
+			continue
+		}
+		switch {
+		case f.redact:
+			tags = append(tags, Tag{prefix + f.key, RedactedTagValue})
+		case f.nested != nil && field.Kind() == reflect.Struct:
+			tags = f.nested.appendTags(tags, field, prefix+f.key+".")
+		default:
+			tags = append(tags, Tag{prefix + f.key, field.Interface()})
+		}
+	}
+	return tags
+}
+
+// Returns the plan of a struct type, following its struct fields down
+// "depth" levels. The "depth=N" of fields only applies to those of the
+// root struct, so that the plans of recursive types are finite.
+func planFor(t reflect.Type, depth int, root bool) *structPlan {
+	key := planKey{t, depth, root}
+	if found, ok := structPlans.Load(key); ok {
+		return found.(*structPlan)
+	}
+	plan := &structPlan{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		spec, ok := field.Tag.Lookup("tracey")
+		if !ok || spec == "-" || field.PkgPath != "" {
+			continue
+		}
+		parts := strings.Split(spec, ",")
+		planned := plannedField{index: i, key: parts[0]}
+		if planned.key == "" {
+			planned.key = field.Name
+		}
+		follow := depth
+		for _, option := range parts[1:] {
+			switch {
+			case option == "redact":
+				planned.redact = true
+			case root && strings.HasPrefix(option, "depth="):
+				if n, err := strconv.Atoi(option[len("depth="):]); err == nil {
+					follow = n
+				}
+			}
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if follow > 0 && fieldType.Kind() == reflect.Struct && !planned.redact {
+			// Structs with no tagged fields (such as time.Time) are tagged
+			// with their value instead
+			if nested := planFor(fieldType, follow-1, false); len(nested.fields) > 0 {
+				planned.nested = nested
+			}
+		}
+		plan.fields = append(plan.fields, planned)
+	}
+	found, _ := structPlans.LoadOrStore(key, plan)
+	return found.(*structPlan)
+}
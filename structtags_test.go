@@ -0,0 +1,95 @@
+package tracey
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testAddress struct {
+	City string `tracey:"city"`
+	Zip  string
+}
+
+type testCustomer struct {
+	ID      int          `tracey:"id"`
+	Tier    *string      `tracey:"tier"`
+	Address *testAddress `tracey:"address"`
+}
+
+type testRequest struct {
+	OrderID  string        `tracey:"order_id"`
+	Token    string        `tracey:"token,redact"`
+	Customer *testCustomer `tracey:"customer"`
+	Deep     testCustomer  `tracey:"deep,depth=2"`
+	Internal string        `tracey:"-"`
+	Untagged string
+	secret   string `tracey:"secret"`
+}
+
+func TestTagsFromStruct(test *testing.T) {
+	gold := "gold"
+	req := &testRequest{
+		OrderID:  "A-17",
+		Token:    "hunter2",
+		Customer: &testCustomer{ID: 9, Address: &testAddress{City: "Lyon"}},
+		Deep:     testCustomer{ID: 3, Tier: &gold, Address: &testAddress{City: "Oslo", Zip: "0150"}},
+		Internal: "x",
+		secret:   "y",
+	}
+	assert.Equal(test, map[string]interface{}{
+		"order_id":          "A-17",
+		"token":             RedactedTagValue,
+		"customer.id":       9,
+		"customer.address":  testAddress{City: "Lyon"},
+		"deep.id":           3,
+		"deep.tier":         "gold",
+		"deep.address.city": "Oslo",
+	}, TagsFromStruct(req))
+
+	assert.Empty(test, TagsFromStruct((*testRequest)(nil)))
+	assert.Empty(test, TagsFromStruct(42))
+	assert.Equal(test, map[string]interface{}{"order_id": "", "token": RedactedTagValue, "deep.id": 0},
+		TagsFromStruct(testRequest{}))
+
+	// The fields are only looked up the first time around
+	tag := func() { appendStructTags(make([]Tag, 0, 8), req) }
+	cached := testing.AllocsPerRun(100, tag)
+	uncached := testing.AllocsPerRun(100, func() {
+		structPlans.Range(func(key, _ interface{}) bool {
+			structPlans.Delete(key)
+			return true
+		})
+		tag()
+	})
+	assert.Less(test, 2*cached, uncached)
+}
+
+func TestTagsFromStructUntaggedStruct(test *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	v := struct {
+		Created  time.Time  `tracey:"created"`
+		Updated  *time.Time `tracey:"updated"`
+		Address  testAddress
+		Shipping testAddress `tracey:"shipping"`
+	}{Created: created, Updated: &created, Shipping: testAddress{City: "Nice"}}
+	assert.Equal(test, map[string]interface{}{
+		"created":       created,
+		"updated":       created,
+		"shipping.city": "Nice",
+	}, TagsFromStruct(v))
+}
+
+func TestWithStructTags(test *testing.T) {
+	var buf bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Logger: log.New(&buf, "", 0)}}})
+	func() {
+		defer t.Enter("lookup(%d)", 7, WithStructTags(&testRequest{OrderID: "A-17", Token: "hunter2"}))()
+	}()
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(buf.String(), "=>")), "\n")
+	assert.Equal(test, "[ 0]EXIT:  =>lookup(7) {order_id=A-17 token=[redacted] deep.id=0}", lines[1])
+}
@@ -0,0 +1,84 @@
+package tracey
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper functions - part of "TestSuppressSubtrees"
+func boringParse(t *Tracer) {
+	defer t.Enter("%s", "$FN")()
+	boringLeaf(t)
+	boringLeaf(t)
+	boringLexer(t)
+}
+func boringLexer(t *Tracer) {
+	defer t.Enter("%s", "$FN")()
+	boringLeaf(t)
+}
+func boringLeaf(t *Tracer) { defer t.Enter("%s", "$FN")() }
+
+func TestSuppressSubtrees(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{
+		CustomLogger:     BufLogger,
+		SuppressSubtrees: []string{`boringParse$`, `boringLexer$`},
+	})
+	func() {
+		defer t.Enter("%s", "$FN")()
+		boringLeaf(t)
+		boringParse(t)
+		boringLexer(t)
+	}()
+
+	// Only the outermost suppressor counts, and the same callee is traced
+	// as usual outside of it
+	assert.Equal(test, `
+[ 0]ENTER: =>go-tracey.TestSuppressSubtrees.func1
+[ 1]  ENTER: =>go-tracey.boringLeaf
+[ 1]  EXIT:  =>go-tracey.boringLeaf
+[ 1]  ENTER: =>go-tracey.boringParse
+[ 1]  EXIT:  =>go-tracey.boringParse (+4 nested calls hidden)
+[ 1]  ENTER: =>go-tracey.boringLexer
+[ 1]  EXIT:  =>go-tracey.boringLexer (+1 nested calls hidden)
+[ 0]EXIT:  =>go-tracey.TestSuppressSubtrees.func1
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+
+	// Hidden calls are still counted
+	assert.Equal(test, 5, int(statsOf(t, "go-tracey.boringLeaf").Calls))
+	assert.Equal(test, 2, int(statsOf(t, "go-tracey.boringLexer").Calls))
+}
+
+// Part of "TestSuppressSubtreesInGroups"
+func boringFanout(t *Tracer) {
+	defer t.Enter("%s", "$FN")()
+	g := t.Group()
+	g.Go("task", func() error { boringLeaf(t); return nil })
+	g.Wait()
+}
+
+func TestSuppressSubtreesInGroups(test *testing.T) {
+	js := &lockedBuffer{}
+	t := NewTracer(&Options{
+		Sinks:            []Sink{{Writer: js, Format: JSONFormat}},
+		SuppressSubtrees: []string{`boringFanout$`},
+	})
+	boringFanout(t)
+
+	// The group, its task and the task's call are all hidden
+	exits := jsonExits(test, js)
+	if assert.Equal(test, 1, len(exits)) {
+		assert.Equal(test, float64(3), exits[0]["hidden"])
+	}
+	ev, err := UnmarshalEvent(js.Bytes()[bytes.LastIndexByte(js.Bytes()[:js.Len()-1], '\n')+1:])
+	assert.Nil(test, err)
+	assert.Equal(test, uint64(3), ev.HiddenCalls)
+}
+
+func TestSuppressSubtreesValidate(test *testing.T) {
+	options := &Options{SuppressSubtrees: []string{`(`}}
+	assert.Error(test, options.Validate())
+	assert.Panics(test, func() { NewTracer(options) })
+}
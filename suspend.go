@@ -0,0 +1,225 @@
+package tracey
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrResumeTokenUsed is returned by `Tracer.Resume(...)` for a token which
+// was already resumed, or which no suspension returned.
+var ErrResumeTokenUsed = errors.New("tracey: resume token already used")
+
+// A ResumeToken resumes a suspended span, see `Span.Suspend()`.
+type ResumeToken struct {
+	span *Span
+
+	// Which of the span's suspensions the token is for
+	n uint32
+}
+
+// A Segment is a stretch of time a span was running for, between being
+// entered or resumed and being suspended or exited.
+type Segment struct {
+	// The time since the span was entered
+	Offset   time.Duration
+	Duration time.Duration
+
+	// The goroutine the span ran on
+	TID uint64
+}
+
+// The suspensions of a span, see `Span.Suspend()`
+type suspension struct {
+	sync.Mutex
+
+	// Set while the span is suspended, along with how many times it was
+	suspended bool
+	n         uint32
+
+	// The previous segments, and when the current one started (or the
+	// last one ended, while suspended)
+	segments []Segment
+	since    time.Time
+}
+
+// Suspend stops the span's clock and detaches it from the calling
+// goroutine, as for an iterator or any other operation which is put aside
+// and picked up later, on any goroutine, with `Tracer.Resume(...)`. The
+// spans within it should have ended by then, and spans entered on the
+// goroutine from then on are not within it. The exit of the
+// span reports the time it was running for as well as the time since it
+// was entered, along with the segments it ran in, see "ShowSuspensions"
+// for its intermediate lines. Spans which are never resumed nor ended are
+// listed by `Tracer.Suspended()`. Returns a zero token, which does not
+// resume anything, for spans which are suspended already or have ended.
+func (s *Span) Suspend() ResumeToken {
+	t := s.t
+	if t == nil {
+		return ResumeToken{}
+	}
+	s.pause.Lock()
+	defer s.pause.Unlock()
+	if s.pause.suspended || atomic.LoadUint32(&s.ended) != 0 {
+		return ResumeToken{}
+	}
+	now := t.options.Clock()
+	t.goroutines.exit(s, !t.options.DisableNesting)
+	start := s.pause.since
+	if start.IsZero() {
+		start = s.ev.Time
+	}
+	s.pause.segments = append(s.pause.segments, Segment{start.Sub(s.ev.Time), now.Sub(start), s.ev.TID})
+	s.pause.suspended, s.pause.since = true, now
+	s.pause.n++
+	t.suspensions.add(s)
+	if t.options.ShowSuspensions && !s.muted {
+		t.pauseLine(s, now, false, s.pause.active())
+	}
+	return ResumeToken{s, s.pause.n}
+}
+
+// Resume reattaches a suspended span to the calling goroutine, at its
+// current depth, and restarts the span's clock. Each token resumes the
+// span once, using it again returns `ErrResumeTokenUsed`. A span which
+// ended while suspended is left as is, with a warning.
+func (t *Tracer) Resume(token ResumeToken) error {
+	s := token.span
+	if s == nil || s.t != t {
+		return ErrResumeTokenUsed
+	}
+	s.pause.Lock()
+	defer s.pause.Unlock()
+	if atomic.LoadUint32(&s.ended) != 0 {
+		warning := "Warning: resuming a span which has ended in tracey.\n"
+		if t.admitOutput(len(warning)) {
+			t.note(warning)
+		}
+		return nil
+	}
+	if !s.pause.suspended || token.n != s.pause.n {
+		return ErrResumeTokenUsed
+	}
+	now := t.options.Clock()
+	idle := now.Sub(s.pause.since)
+	s.ev.TID = getGID()
+	t.goroutines.attach(s, !t.options.DisableNesting)
+	s.pause.suspended, s.pause.since = false, now
+	t.suspensions.remove(s)
+	if t.options.ShowSuspensions && !s.muted {
+		t.pauseLine(s, now, true, idle)
+	}
+	return nil
+}
+
+// The time the span ran for in its previous segments
+func (p *suspension) active() time.Duration {
+	var active time.Duration
+	for _, seg := range p.segments {
+		active += seg.Duration
+	}
+	return active
+}
+
+// Ends the span's last segment, if it was ever suspended, and fills in
+// the segments of its exit event. Must be called with the lock held.
+func (t *Tracer) exitSegments(s *Span, ev *Event, now time.Time) {
+	p := &s.pause
+	if p.n == 0 {
+		return
+	}
+	if p.suspended {
+		t.suspensions.remove(s)
+	} else {
+		p.segments = append(p.segments, Segment{p.since.Sub(s.ev.Time), now.Sub(p.since), s.ev.TID})
+	}
+	ev.Segments = p.segments
+	ev.Active = p.active()
+}
+
+// Logs a span being suspended or resumed, as in
+// "⏸ main.rows suspended (active 12.0ms)" or "▶ main.rows resumed (idle 3.0s)"
+func (t *Tracer) pauseLine(s *Span, now time.Time, resumed bool, d time.Duration) {
+	ev := Event{Kind: PointEvent, Time: now, TID: s.ev.TID, pause: &pauseMark{resumed, d}}
+	t.within(&ev, s)
+	ev.Depth = s.ev.Depth
+	t.emitPoint(&ev)
+}
+
+type pauseMark struct {
+	resumed bool
+	d       time.Duration
+}
+
+// The spans which are suspended, for `Tracer.Suspended()`
+type suspensions struct {
+	sync.Mutex
+	spans map[*Span]struct{}
+}
+
+func (p *suspensions) add(s *Span) {
+	p.Lock()
+	if p.spans == nil {
+		p.spans = make(map[*Span]struct{})
+	}
+	p.spans[s] = struct{}{}
+	p.Unlock()
+}
+
+func (p *suspensions) remove(s *Span) {
+	p.Lock()
+	delete(p.spans, s)
+	p.Unlock()
+}
+
+// Suspended returns the spans which are suspended (see `Span.Suspend()`),
+// oldest first, so that those which were never resumed nor ended can be
+// told apart. They are listed in crash reports as well.
+func (t *Tracer) Suspended() []OpenSpan {
+	if t.start == nil {
+		return []OpenSpan{}
+	}
+	t.suspensions.Lock()
+	spans := make([]*Span, 0, len(t.suspensions.spans))
+	for s := range t.suspensions.spans {
+		spans = append(spans, s)
+	}
+	t.suspensions.Unlock()
+	return t.describeSuspended(spans)
+}
+
+// Describes the suspended spans, the longest suspended first
+func (t *Tracer) describeSuspended(spans []*Span) []OpenSpan {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].ev.Time.Before(spans[j].ev.Time) })
+
+	now := t.options.Clock()
+	suspended := make([]OpenSpan, len(spans))
+	for i, s := range spans {
+		suspended[i] = OpenSpan{s.ev.TraceID, s.ev.SpanID, s.ev.Name, s.ev.Message, now.Sub(s.ev.Time)}
+	}
+	return suspended
+}
+
+// Reattaches a resumed (or accepted) span as the innermost one open on its (new)
+// goroutine, at the goroutine's depth
+func (g *goroutines) attach(s *Span, nesting bool) {
+	shard := g.shard(s.ev.TID)
+	shard.Lock()
+	defer shard.Unlock()
+	record := shard.g[s.ev.TID]
+	if record == nil {
+		record = &goroutineRecord{}
+		shard.g[s.ev.TID] = record
+	}
+	if len(record.open) == 0 && record.depth == 0 {
+		record.base = 0
+	}
+	s.record, s.shift = record, 0
+	s.ev.Depth = record.base + record.depth
+	if nesting {
+		record.depth++
+	}
+	record.open = append(record.open, s)
+}
@@ -0,0 +1,126 @@
+package tracey
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs "f" on a goroutine of its own, and waits for it
+func onGoroutine(f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	<-done
+}
+
+func TestSuspendResume(test *testing.T) {
+	var text, js bytes.Buffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:                 []Sink{{Logger: log.New(&text, "", 0)}, {Writer: &js, Format: JSONFormat}},
+		Clock:                 clock.Now,
+		EnableInstrumentation: true,
+		ShowSuspensions:       true,
+	})
+
+	rows := t.Start("%s", "rows")
+	clock.advance(10 * time.Millisecond)
+	token := rows.Suspend()
+	for i, d := range []time.Duration{20 * time.Millisecond, 30 * time.Millisecond} {
+		clock.advance(time.Duration(i+1) * 100 * time.Millisecond)
+		onGoroutine(func() {
+			defer t.Enter("%s", "consumer")()
+			assert.Nil(test, t.Resume(token))
+			clock.advance(d)
+			token = rows.Suspend()
+		})
+	}
+	clock.advance(300 * time.Millisecond)
+	onGoroutine(func() {
+		assert.Nil(test, t.Resume(token))
+		clock.advance(5 * time.Millisecond)
+		rows.End()
+	})
+
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(text.String(), "=>")), "\n")
+	assert.Equal(test, []string{
+		"[ 0]ENTER: =>rows",
+		"[ 0]⏸ go-tracey.TestSuspendResume suspended (active 10.0ms)",
+		"[ 0]ENTER: =>consumer",
+		"[ 1]  ▶ go-tracey.TestSuspendResume resumed (idle 100.0ms)",
+		"[ 1]  ⏸ go-tracey.TestSuspendResume suspended (active 30.0ms)",
+		"[ 0]EXIT:  =>consumer ... in 20ms",
+		"[ 0]ENTER: =>consumer",
+		"[ 1]  ▶ go-tracey.TestSuspendResume resumed (idle 200.0ms)",
+		"[ 1]  ⏸ go-tracey.TestSuspendResume suspended (active 60.0ms)",
+		"[ 0]EXIT:  =>consumer ... in 30ms",
+		"[ 0]▶ go-tracey.TestSuspendResume resumed (idle 300.0ms)",
+		"[ 0]EXIT:  =>rows ... in 665ms (active 65ms in 4 segments)",
+	}, lines)
+
+	var exit Event
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, err := UnmarshalEvent([]byte(line))
+		assert.Nil(test, err)
+		if ev.Kind == ExitEvent && ev.Message == "rows" {
+			exit = ev
+		}
+	}
+	assert.Equal(test, 665*time.Millisecond, exit.Duration)
+	assert.Equal(test, 65*time.Millisecond, exit.Active)
+	assert.Equal(test, 4, len(exit.Segments))
+	offsets, tids := []time.Duration{}, map[uint64]bool{}
+	for _, seg := range exit.Segments {
+		offsets = append(offsets, seg.Offset)
+		tids[seg.TID] = true
+	}
+	assert.Equal(test, []time.Duration{0, 110 * time.Millisecond, 330 * time.Millisecond, 660 * time.Millisecond}, offsets)
+	assert.Equal(test, 4, len(tids))
+	assert.Equal(test, 0, t.goroutineCount())
+}
+
+func TestResumeTokenMisuse(test *testing.T) {
+	var text bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Logger: log.New(&text, "", 0)}}})
+
+	assert.Equal(test, ErrResumeTokenUsed, t.Resume(ResumeToken{}))
+	span := t.Start("%s", "rows")
+	token := span.Suspend()
+	assert.Equal(test, ResumeToken{}, span.Suspend())
+	assert.Nil(test, t.Resume(token))
+	assert.Equal(test, ErrResumeTokenUsed, t.Resume(token))
+
+	// Ended while suspended, the span is no longer listed
+	token = span.Suspend()
+	assert.Equal(test, 1, len(t.Suspended()))
+	span.End()
+	assert.Empty(test, t.Suspended())
+	assert.Nil(test, t.Resume(token))
+	assert.Contains(test, text.String(), "Warning: resuming a span which has ended in tracey.")
+	assert.Equal(test, ResumeToken{}, span.Suspend())
+
+	// Never resumed, the span is listed rather than open
+	leaked := t.Start("%s", "leaked")
+	leaked.Suspend()
+	assert.Equal(test, "leaked", t.Suspended()[0].Message)
+	assert.Empty(test, t.Snapshot())
+	assert.Equal(test, 0, t.goroutineCount())
+}
+
+func TestSuspendedDisabled(test *testing.T) {
+	var crash bytes.Buffer
+	t := NewTracer(&Options{DisableTracing: true, FlushOnPanic: true, CrashWriter: &crash})
+	assert.Empty(test, t.Suspended())
+	assert.PanicsWithValue(test, "boom", func() {
+		defer t.RecoverAndFlush()
+		panic("boom")
+	})
+	assert.True(test, strings.HasPrefix(crash.String(), "PANIC: boom\n"), crash.String())
+}
@@ -0,0 +1,152 @@
+package tracey
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultTailBufferLines is how many events a tree buffers at most for
+// "TailSampling", unless "TailBufferLines" is set.
+const DefaultTailBufferLines = 1024
+
+// A TreeSummary describes a top-level call tree which has completed, for
+// "TailDecision" to decide whether it is kept.
+type TreeSummary struct {
+	TraceID string
+	Name    string
+	Message string
+
+	// The duration of the top-level span
+	Duration time.Duration
+
+	// The spans of the tree which exited, and those of them which failed
+	Spans  int
+	Failed int
+
+	// The events buffered
+	Lines int
+}
+
+// The events of a top-level call tree, buffered until it completes, see
+// "TailSampling". The spans of a tree share it, down to those of the
+// goroutines of a `Group()` started within it.
+type tailTree struct {
+	sync.Mutex
+	events []Event
+	spans  int
+	failed int
+
+	// Set once a span of the tree was to be logged whatever else decides,
+	// see "ForceSample"
+	forced bool
+
+	// Set once the tree overflowed its buffer, and streams its events
+	// since, or once it completed
+	streaming bool
+	done      bool
+}
+
+// Gives the span the tree it is buffered in, a new one if it is a
+// top-level span
+func (t *Tracer) joinTail(span *Span, parent *Span) {
+	if within := t.enclosing(span.ev.TID, parent); within != nil && within.ev.tail != nil {
+		span.ev.tail = within.ev.tail
+	} else {
+		span.ev.tail = &tailTree{}
+		span.tailRoot = true
+	}
+}
+
+// Buffers the event of a tree, unless the tree streams its events. Should
+// the buffer be full, what it holds is written out first, and the rest of
+// the tree streamed. Returns false if the event is to be written out.
+func (t *Tracer) holdTail(ev *Event) bool {
+	limit := t.tailLimit()
+	tree := ev.tail
+	tree.Lock()
+	if tree.streaming || tree.done {
+		tree.Unlock()
+		return false
+	}
+	if len(tree.events) < limit {
+		tree.events = append(tree.events, *ev)
+		tree.Unlock()
+		return true
+	}
+	held := tree.events
+	tree.events, tree.streaming = nil, true
+	tree.Unlock()
+
+	warning := "TRACE TAIL OVERFLOW — " + formatCount(uint64(len(held))) + " buffered lines written, streaming the rest of the call tree\n"
+	if t.admitOutput(len(warning)) {
+		t.note(warning)
+	}
+	for i := range held {
+		t.emitSampled(&held[i])
+	}
+	return false
+}
+
+// The events a tree buffers at most
+func (t *Tracer) tailLimit() int {
+	if t.options.TailBufferLines <= 0 {
+		return DefaultTailBufferLines
+	}
+	return t.options.TailBufferLines
+}
+
+// Counts the exit of a span of a tree. Returns true if it completes the
+// tree, which `endTail(...)` then decides the fate of.
+func (t *Tracer) exitTail(span *Span, ev *Event) bool {
+	tree := ev.tail
+	tree.Lock()
+	defer tree.Unlock()
+	tree.spans++
+	if ev.Err != nil {
+		tree.failed++
+	}
+	if span.forced {
+		tree.forced = true
+	}
+	if t.options.PercentOfRoot {
+		t.omitPercents(span, ev)
+	}
+	return span.tailRoot
+}
+
+// Writes out the events of a completed tree if "TailDecision" keeps it,
+// or else lets go of them. Under "PercentOfRoot" alone every tree is
+// kept, with the shares of the top-level span set on its exits.
+func (t *Tracer) endTail(ev *Event) {
+	tree := ev.tail
+	tree.Lock()
+	held := tree.events
+	summary := TreeSummary{ev.TraceID, ev.Name, ev.Message, ev.Duration, tree.spans, tree.failed, len(held)}
+	streamed, forced := tree.streaming, tree.forced
+	tree.events, tree.done = nil, true
+	tree.Unlock()
+	if streamed {
+		return
+	}
+
+	if t.options.PercentOfRoot {
+		percentOfRoot(held, ev)
+	}
+	decide := t.options.TailDecision
+	if decide == nil {
+		decide = t.keepTail
+	}
+	if !t.options.TailSampling || forced || decide(summary) {
+		for i := range held {
+			t.emitSampled(&held[i])
+		}
+	}
+}
+
+// Keeps the trees which failed, took at least "TailMinDuration", and a
+// "TailKeepRate" of the others
+func (t *Tracer) keepTail(tree TreeSummary) bool {
+	min := t.options.TailMinDuration
+	return tree.Failed > 0 || (min > 0 && tree.Duration >= min) || rand.Float64() < t.options.TailKeepRate
+}
@@ -0,0 +1,107 @@
+package tracey
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTailSampling(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{
+		Sinks:           []Sink{{Writer: &out}},
+		Clock:           clock.Now,
+		TailSampling:    true,
+		TailMinDuration: 100 * time.Millisecond,
+	})
+	tree := func(name string, d time.Duration, err error) {
+		root := t.Start("%s", name)
+		func() {
+			defer t.Enter("%s", "child of "+name)()
+			clock.advance(d)
+			t.Event("halfway")
+			if err != nil {
+				failing := t.Start("%s", "failing")
+				failing.SetError(err)
+				failing.End()
+			}
+		}()
+		assert.NotContains(test, out.String(), name, "written before the tree completed")
+		root.End()
+	}
+
+	tree("fast", time.Millisecond, nil)
+	assert.Equal(test, "", out.String())
+	tree("slow", 150*time.Millisecond, nil)
+	tree("failed", time.Millisecond, errors.New("declined"))
+
+	assert.Equal(test, "[ 0]ENTER: =>slow\n"+
+		"[ 1]  ENTER: =>child of slow\n"+
+		"[ 2]    · halfway (at +150.0ms)\n"+
+		"[ 1]  EXIT:  =>child of slow\n"+
+		"[ 0]EXIT:  =>slow\n"+
+		"[ 0]ENTER: =>failed\n"+
+		"[ 1]  ENTER: =>child of failed\n"+
+		"[ 2]    · halfway (at +1.0ms)\n"+
+		"[ 2]    ENTER: =>failing\n"+
+		"[ 2]    EXIT:  =>failing (error: declined)\n"+
+		"[ 1]  EXIT:  =>child of failed\n"+
+		"[ 0]EXIT:  =>failed\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	calls := uint64(0)
+	for _, s := range t.Stats() {
+		calls += s.Calls
+	}
+	assert.Equal(test, uint64(7), calls)
+}
+
+func TestTailDecision(test *testing.T) {
+	var out lockedBuffer
+	var summaries []TreeSummary
+	t := NewTracer(&Options{
+		Sinks:        []Sink{{Writer: &out}},
+		TailSampling: true,
+		TailDecision: func(tree TreeSummary) bool {
+			summaries = append(summaries, tree)
+			return tree.Message == "kept"
+		},
+	})
+	for _, name := range []string{"kept", "dropped"} {
+		func() {
+			defer t.Enter("%s", name)()
+			t.Enter("%s", "child")()
+		}()
+	}
+	assert.Equal(test, "[ 0]ENTER: =>kept\n"+
+		"[ 1]  ENTER: =>child\n"+
+		"[ 1]  EXIT:  =>child\n"+
+		"[ 0]EXIT:  =>kept\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+	assert.Len(test, summaries, 2)
+	assert.Equal(test, TreeSummary{summaries[1].TraceID, "go-tracey.TestTailDecision.func2", "dropped", summaries[1].Duration, 2, 0, 4}, summaries[1])
+}
+
+func TestTailOverflow(test *testing.T) {
+	var out lockedBuffer
+	clock := &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &out}}, Clock: clock.Now, TailSampling: true, TailBufferLines: 3})
+	root := t.Start("%s", "root")
+	t.Enter("%s", "child")()
+	assert.Equal(test, "", out.String())
+	t.Event("overflowing")
+	t.Enter("%s", "streamed")()
+	root.End()
+	lines := strings.Split(strings.TrimSpace(RE_tidMarker.ReplaceAllString(out.String(), "=>")), "\n")
+	assert.Equal(test, []string{
+		"TRACE TAIL OVERFLOW — 3 buffered lines written, streaming the rest of the call tree",
+		"[ 0]ENTER: =>root",
+		"[ 1]  ENTER: =>child",
+		"[ 1]  EXIT:  =>child",
+		"[ 1]  · overflowing (at +0s)",
+		"[ 1]  ENTER: =>streamed",
+		"[ 1]  EXIT:  =>streamed",
+		"[ 0]EXIT:  =>root",
+	}, lines)
+}
@@ -0,0 +1,201 @@
+package tracey
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// The tokens which may be used in "MessageTemplates"
+const (
+	tokenLiteral = iota
+	tokenFN
+	tokenTID
+	tokenDepth
+	tokenMsg
+	tokenDur
+	tokenSig
+)
+
+var templateTokens = map[string]int{
+	"$FN":    tokenFN,
+	"$TID":   tokenTID,
+	"$DEPTH": tokenDepth,
+	"$MSG":   tokenMsg,
+	"$DUR":   tokenDur,
+	"$SIG":   tokenSig,
+}
+
+var RE_templateToken = regexp.MustCompile(`\$[A-Z]+`)
+
+// A compiled message template, as a list of literals and tokens
+type messageTemplate struct {
+	parts  []templatePart
+	hasDur bool
+}
+
+type templatePart struct {
+	token   int
+	literal string
+}
+
+func compileTemplate(template string) (*messageTemplate, error) {
+	t := &messageTemplate{}
+	last := 0
+	for _, loc := range RE_templateToken.FindAllStringIndex(template, -1) {
+		token, ok := templateTokens[template[loc[0]:loc[1]]]
+		if !ok {
+			return nil, fmt.Errorf("unknown token %q in template %q", template[loc[0]:loc[1]], template)
+		}
+		if loc[0] > last {
+			t.parts = append(t.parts, templatePart{tokenLiteral, template[last:loc[0]]})
+		}
+		t.parts = append(t.parts, templatePart{token: token})
+		t.hasDur = t.hasDur || token == tokenDur
+		last = loc[1]
+	}
+	if last < len(template) {
+		t.parts = append(t.parts, templatePart{tokenLiteral, template[last:]})
+	}
+	return t, nil
+}
+
+func (t *messageTemplate) render(buf *bytes.Buffer, ev *Event) {
+	for _, part := range t.parts {
+		switch part.token {
+		case tokenLiteral:
+			buf.WriteString(part.literal)
+		case tokenFN:
+			buf.WriteString(ev.Name)
+		case tokenTID:
+			buf.WriteString(strconv.FormatUint(ev.TID, 10))
+		case tokenDepth:
+			buf.WriteString(strconv.Itoa(ev.Depth))
+		case tokenMsg:
+			buf.WriteString(ev.Message)
+		case tokenDur:
+			if ev.Kind == ExitEvent {
+				buf.WriteString(ev.Duration.String())
+			}
+		case tokenSig:
+			buf.WriteString(ev.signature)
+		}
+	}
+}
+
+// The "MessageTemplates" of a tracer, compiled, in the order they are
+// tried, along with the template found for every function name so far
+type templates struct {
+	patterns []*regexp.Regexp
+	compiled []*messageTemplate
+	byName   sync.Map // name -> *messageTemplate, nil if none matched
+}
+
+func compileTemplates(sources map[string]string) (*templates, error) {
+	keys := make([]string, 0, len(sources))
+	for key := range sources {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+
+	t := &templates{}
+	for _, key := range keys {
+		pattern, err := regexp.Compile(key)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern in MessageTemplates: %v", err)
+		}
+		compiled, err := compileTemplate(sources[key])
+		if err != nil {
+			return nil, fmt.Errorf("bad template in MessageTemplates: %v", err)
+		}
+		t.patterns = append(t.patterns, pattern)
+		t.compiled = append(t.compiled, compiled)
+	}
+	return t, nil
+}
+
+// Returns the template of the function, or nil if it has none
+func (t *templates) lookup(name string) *messageTemplate {
+	if found, ok := t.byName.Load(name); ok {
+		return found.(*messageTemplate)
+	}
+	var found *messageTemplate
+	for i, pattern := range t.patterns {
+		if pattern.MatchString(name) {
+			found = t.compiled[i]
+			break
+		}
+	}
+	t.byName.Store(name, found)
+	return found
+}
+
+// A set of regexes matched against function names, along with the result
+// for every name matched so far
+type nameMatcher struct {
+	patterns []*regexp.Regexp
+	byName   sync.Map // name -> bool
+}
+
+func newNameMatcher(sources []string) (*nameMatcher, error) {
+	m := &nameMatcher{}
+	for _, source := range sources {
+		pattern, err := regexp.Compile(source)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern in SuppressSubtrees: %v", err)
+		}
+		m.patterns = append(m.patterns, pattern)
+	}
+	return m, nil
+}
+
+func (m *nameMatcher) matches(name string) bool {
+	if found, ok := m.byName.Load(name); ok {
+		return found.(bool)
+	}
+	found := false
+	for _, pattern := range m.patterns {
+		if pattern.MatchString(name) {
+			found = true
+			break
+		}
+	}
+	m.byName.Store(name, found)
+	return found
+}
+
+// Validate checks the options for errors which `NewTracer(...)` would
+// otherwise panic on, such as an unknown token in "MessageTemplates".
+func (o *Options) Validate() error {
+	if _, err := compileTemplates(o.MessageTemplates); err != nil {
+		return err
+	}
+	if _, err := newNameMatcher(o.SuppressSubtrees); err != nil {
+		return err
+	}
+	if _, err := compileOperationMap(o.OperationMap); err != nil {
+		return err
+	}
+	if err := checkObservationBuckets(o.ObservationBuckets); err != nil {
+		return err
+	}
+	if _, err := compileBudgets(o.Budgets); err != nil {
+		return err
+	}
+	if _, err := compileDurations("AbandonAfterFuncs", o.AbandonAfterFuncs); err != nil {
+		return err
+	}
+	if _, err := compileFilterRules(o.FilterRules); err != nil {
+		return err
+	}
+	_, err := compileInjections(o.LatencyInjection)
+	return err
+}
@@ -0,0 +1,68 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper functions - part of "TestMessageTemplates"
+func handleGet(t *Tracer)   { defer t.Enter("%s", "/users")() }
+func handlePost(t *Tracer)  { defer t.Enter("%s", "/orders")() }
+func plainWorker(t *Tracer) { defer t.Enter("$FN on %s", "queue-1")() }
+
+func TestMessageTemplates(test *testing.T) {
+	ResetTestBuffer()
+	var js bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks: []Sink{{Logger: BufLogger}, {Writer: &js, Format: JSONFormat}},
+		MessageTemplates: map[string]string{
+			`handle`:       "$FN route=$MSG depth=$DEPTH",
+			`handlePost$`:  "post handler",
+			`plainWorkerX`: "never used",
+		},
+	})
+	handleGet(t)
+	handlePost(t)
+	plainWorker(t)
+
+	assert.Equal(test, `
+[ 0]ENTER: go-tracey.handleGet route=/users depth=0
+[ 0]EXIT:  go-tracey.handleGet route=/users depth=0
+[ 0]ENTER: post handler
+[ 0]EXIT:  post handler
+[ 0]ENTER: =>go-tracey.plainWorker on queue-1
+[ 0]EXIT:  =>go-tracey.plainWorker on queue-1
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+
+	// Templates only apply to text output
+	assert.Contains(test, js.String(), `"name":"go-tracey.handlePost","msg":"/orders"`)
+	assert.NotContains(test, js.String(), "post handler")
+}
+
+func TestMessageTemplateTokens(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{
+		CustomLogger:          BufLogger,
+		EnableInstrumentation: true,
+		DisableDepthValue:     true,
+		MessageTemplates:      map[string]string{`.`: "[$TID] $MSG took $DUR"},
+	})
+	t.Start("%s", "x").End()
+
+	lines := strings.Split(strings.TrimSpace(GetTestBuffer()), "\n")
+	assert.Regexp(test, `^ENTER: \[\d+\] x took $`, lines[0])
+	assert.Regexp(test, `^EXIT:  \[\d+\] x took \d+(\.\d+)?(ns|µs|ms|s)$`, lines[1])
+}
+
+func TestMessageTemplateErrors(test *testing.T) {
+	bad := &Options{MessageTemplates: map[string]string{`handle`: "$FN via $ROUTE"}}
+	assert.EqualError(test, bad.Validate(), `bad template in MessageTemplates: unknown token "$ROUTE" in template "$FN via $ROUTE"`)
+	assert.Panics(test, func() { NewTracer(bad) })
+
+	bad = &Options{MessageTemplates: map[string]string{`(`: "$FN"}}
+	assert.NotNil(test, bad.Validate())
+	assert.Nil(test, (&Options{}).Validate())
+}
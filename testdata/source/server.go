@@ -0,0 +1,40 @@
+package fixture
+
+import (
+	"context"
+	"sync"
+)
+
+type Server struct {
+	mu sync.Mutex
+}
+
+func (s *Server) handleOrder(ctx context.Context, id string) error {
+	s.mu.Lock() // method
+	defer s.mu.Unlock()
+	return nil
+}
+
+func Map[T, U any](in []T, f func(T) U) []U {
+	out := make([]U, 0, len(in)) // generic
+	for _, v := range in {
+		out = append(out, f(v))
+	}
+	return out
+}
+
+func (s *Server) batch(
+	ctx context.Context,
+	ids []string,
+	opts ...func(*Server),
+) (n int, err error) {
+	return len(ids), nil // multi-line
+}
+
+func retry(attempts int) {
+	go func(left int) {
+		_ = left // closure
+	}(attempts)
+}
+
+var top = 1 // no function
@@ -0,0 +1,205 @@
+package tracey
+
+import (
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// What `EventsBetween(...)`, `TreesBetween(...)` and `WriteTimeline(...)`
+// cover of the range they were asked for: whether events of the range may
+// have been evicted from the timeline already, and the time of the oldest
+// event it still holds.
+type TimelineCoverage struct {
+	Truncated bool
+	Earliest  time.Time
+}
+
+// A CallNode is a call reconstructed from the timeline, see
+// `TreesBetween(...)`. The exit is nil while the call is still running.
+type CallNode struct {
+	Enter    Event
+	Exit     *Event
+	Children []*CallNode
+}
+
+// The events of "TimelineBuffer", oldest first, in a ring
+type timeline struct {
+	sync.Mutex
+	maxEvents, maxBytes int
+
+	events []Event
+	sizes  []int
+	start  int
+	n      int
+	bytes  int
+
+	// Set once an event was evicted, with the time of the latest of them
+	evicted     bool
+	lastEvicted time.Time
+}
+
+func newTimeline(maxEvents, maxBytes int) *timeline {
+	return &timeline{maxEvents: maxEvents, maxBytes: maxBytes}
+}
+
+// The memory an event takes in the timeline, before its strings
+var eventSize = int(reflect.TypeOf(Event{}).Size())
+
+// Roughly the memory an event takes in the timeline
+func timelineSize(ev *Event) int {
+	size := eventSize + len(ev.Name) + len(ev.Message) + len(ev.text) + len(ev.TraceID) + len(ev.SpanID) + len(ev.ParentID)
+	for _, tag := range ev.Tags {
+		size += len(tag.Key) + 16
+	}
+	for _, value := range ev.tagValues {
+		size += len(value)
+	}
+	for _, line := range ev.Attached {
+		size += len(line) + 16
+	}
+	return size
+}
+
+func (tl *timeline) append(ev *Event) {
+	size := timelineSize(ev)
+	tl.Lock()
+	defer tl.Unlock()
+	for tl.n > 0 && ((tl.maxEvents > 0 && tl.n >= tl.maxEvents) || (tl.maxBytes > 0 && tl.bytes+size > tl.maxBytes)) {
+		tl.evict()
+	}
+	if tl.maxBytes > 0 && size > tl.maxBytes {
+		// It would not fit on its own
+		tl.evicted = true
+		if ev.Time.After(tl.lastEvicted) {
+			tl.lastEvicted = ev.Time
+		}
+		return
+	}
+	if tl.n == len(tl.events) {
+		tl.grow()
+	}
+	i := (tl.start + tl.n) % len(tl.events)
+	tl.events[i], tl.sizes[i] = *ev, size
+	tl.n++
+	tl.bytes += size
+}
+
+// Drops the oldest event. Must be called with the lock held.
+func (tl *timeline) evict() {
+	oldest := &tl.events[tl.start]
+	tl.evicted = true
+	if oldest.Time.After(tl.lastEvicted) {
+		tl.lastEvicted = oldest.Time
+	}
+	tl.bytes -= tl.sizes[tl.start]
+	*oldest = Event{}
+	tl.start = (tl.start + 1) % len(tl.events)
+	tl.n--
+}
+
+// Makes room for more events, in order. Must be called with the lock held.
+func (tl *timeline) grow() {
+	capacity := 2 * len(tl.events)
+	if capacity == 0 {
+		capacity = 64
+	}
+	if tl.maxEvents > 0 && capacity > tl.maxEvents {
+		capacity = tl.maxEvents
+	}
+	events, sizes := make([]Event, capacity), make([]int, capacity)
+	for i := 0; i < tl.n; i++ {
+		j := (tl.start + i) % len(tl.events)
+		events[i], sizes[i] = tl.events[j], tl.sizes[j]
+	}
+	tl.events, tl.sizes, tl.start = events, sizes, 0
+}
+
+// Copies out the events the timeline holds, sorted by time, along with
+// what they cover of the range starting at "from"
+func (tl *timeline) copy(from time.Time) ([]Event, TimelineCoverage) {
+	tl.Lock()
+	events := make([]Event, tl.n)
+	for i := range events {
+		events[i] = tl.events[(tl.start+i)%len(tl.events)]
+	}
+	coverage := TimelineCoverage{Truncated: tl.evicted && !from.After(tl.lastEvicted)}
+	tl.Unlock()
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	if len(events) > 0 {
+		coverage.Earliest = events[0].Time
+	}
+	return events, coverage
+}
+
+// EventsBetween returns the events of "TimelineBuffer" whose time is
+// within the range, bounds included, sorted by time. The coverage tells
+// whether events of the range may have been evicted already. It returns
+// nil unless "TimelineBuffer" or "TimelineBufferBytes" is set.
+func (t *Tracer) EventsBetween(from, to time.Time) ([]Event, TimelineCoverage) {
+	if t.timeline == nil {
+		return nil, TimelineCoverage{}
+	}
+	all, coverage := t.timeline.copy(from)
+	var events []Event
+	for _, ev := range all {
+		if !ev.Time.Before(from) && !ev.Time.After(to) {
+			events = append(events, ev)
+		}
+	}
+	return events, coverage
+}
+
+// TreesBetween returns the call trees of "TimelineBuffer" whose root was
+// entered within the range, bounds included, in the order they were
+// entered. The calls within them are those whose enter the timeline still
+// holds, whenever they were entered; the point events are left out. The
+// coverage tells whether trees of the range may have been evicted already.
+func (t *Tracer) TreesBetween(from, to time.Time) ([]*CallNode, TimelineCoverage) {
+	if t.timeline == nil {
+		return nil, TimelineCoverage{}
+	}
+	events, coverage := t.timeline.copy(from)
+	var roots []*CallNode
+	nodes := make(map[string]*CallNode)
+	for i := range events {
+		ev := &events[i]
+		switch ev.Kind {
+		case EnterEvent:
+			node := &CallNode{Enter: *ev}
+			nodes[ev.SpanID] = node
+			if parent := nodes[ev.ParentID]; ev.ParentID != "" && parent != nil {
+				parent.Children = append(parent.Children, node)
+			} else if ev.ParentID == "" && !ev.Time.Before(from) && !ev.Time.After(to) {
+				roots = append(roots, node)
+			}
+		case ExitEvent:
+			if node := nodes[ev.SpanID]; node != nil {
+				node.Exit = ev
+			}
+		}
+	}
+	return roots, coverage
+}
+
+// WriteTimeline writes the events of `EventsBetween(...)` as text lines,
+// the way a sink of TextFormat would, preceded by a line such as
+// "TIMELINE TRUNCATED: earliest event at 14:03:05.120" if history of the
+// range was evicted.
+func (t *Tracer) WriteTimeline(w io.Writer, from, to time.Time) error {
+	events, coverage := t.EventsBetween(from, to)
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if coverage.Truncated {
+		buf.WriteString("TIMELINE TRUNCATED: earliest event at ")
+		buf.WriteString(coverage.Earliest.Format("15:04:05.000"))
+		buf.WriteByte('\n')
+	}
+	for i := range events {
+		t.renderText(buf, &events[i], false)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
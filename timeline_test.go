@@ -0,0 +1,122 @@
+package tracey
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Traces a request with a query within it every second for a minute
+func traceMinute(t *Tracer, clock *manualClock) {
+	for i := 0; i < 60; i++ {
+		func() {
+			defer t.Enter("request %d", i)()
+			clock.advance(100 * time.Millisecond)
+			func() {
+				defer t.Enter("query %d", i)()
+				clock.advance(200 * time.Millisecond)
+			}()
+		}()
+		clock.advance(700 * time.Millisecond)
+	}
+}
+
+func TestTimelineBuffer(test *testing.T) {
+	start := time.Date(2020, 1, 1, 14, 3, 0, 0, time.UTC)
+	clock := &manualClock{now: start}
+	t := NewTracer(&Options{
+		Sinks:          []Sink{{Writer: &bytes.Buffer{}, MinDuration: time.Hour}},
+		Clock:          clock.Now,
+		TimelineBuffer: 100,
+	})
+	traceMinute(t, clock)
+	at := func(seconds float64) time.Time { return start.Add(time.Duration(seconds * float64(time.Second))) }
+
+	// The 240 events are down to the last 100, from the enter of the
+	// request of second 35 on
+	events, coverage := t.EventsBetween(at(40), at(41))
+	assert.Equal(test, TimelineCoverage{false, at(35)}, coverage)
+	var messages []string
+	for _, ev := range events {
+		messages = append(messages, ev.Kind.String()+" "+ev.Message)
+	}
+	assert.Equal(test, []string{"enter request 40", "enter query 40", "exit query 40", "exit request 40", "enter request 41"}, messages)
+
+	trees, _ := t.TreesBetween(at(40), at(42.5))
+	assert.Len(test, trees, 3)
+	assert.Equal(test, "request 41", trees[1].Enter.Message)
+	assert.Equal(test, 300*time.Millisecond, trees[1].Exit.Duration)
+	assert.Len(test, trees[1].Children, 1)
+	assert.Equal(test, "query 41", trees[1].Children[0].Enter.Message)
+	assert.Equal(test, 200*time.Millisecond, trees[1].Children[0].Exit.Duration)
+
+	// Part of the range was evicted
+	events, coverage = t.EventsBetween(at(30), at(35.2))
+	assert.Equal(test, TimelineCoverage{true, at(35)}, coverage)
+	assert.Len(test, events, 2)
+	trees, coverage = t.TreesBetween(at(10), at(20))
+	assert.Empty(test, trees)
+	assert.True(test, coverage.Truncated)
+
+	var out bytes.Buffer
+	assert.Nil(test, t.WriteTimeline(&out, at(34), at(35.5)))
+	assert.Equal(test, "TIMELINE TRUNCATED: earliest event at 14:03:35.000\n"+
+		"[ 0]ENTER: =>request 35\n"+
+		"[ 1]  ENTER: =>query 35\n"+
+		"[ 1]  EXIT:  =>query 35\n"+
+		"[ 0]EXIT:  =>request 35\n", RE_tidMarker.ReplaceAllString(out.String(), "=>"))
+
+	off := NewTracer(&Options{Sinks: []Sink{{Writer: &bytes.Buffer{}}}})
+	off.Enter()()
+	events, _ = off.EventsBetween(start, at(60))
+	assert.Nil(test, events)
+}
+
+func TestTimelineBufferBytes(test *testing.T) {
+	start := time.Date(2020, 1, 1, 14, 3, 0, 0, time.UTC)
+	clock := &manualClock{now: start}
+	t := NewTracer(&Options{
+		Sinks:               []Sink{{Writer: &bytes.Buffer{}}},
+		Clock:               clock.Now,
+		TimelineBufferBytes: 20 * eventSize,
+	})
+	traceMinute(t, clock)
+
+	events, coverage := t.EventsBetween(start, start.Add(time.Minute))
+	assert.True(test, len(events) > 10 && len(events) < 20, len(events))
+	assert.True(test, coverage.Truncated)
+	assert.Equal(test, events[0].Time, coverage.Earliest)
+	assert.Equal(test, "request 59", events[len(events)-1].Message)
+}
+
+func TestTimelineConcurrent(test *testing.T) {
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &lockedBuffer{}}}, TimelineBuffer: 50})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				t.Enter("%s", "work")()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				events, _ := t.EventsBetween(time.Time{}, time.Now())
+				for _, ev := range events {
+					assert.True(test, strings.HasSuffix(ev.Message, "work"))
+				}
+				t.TreesBetween(time.Time{}, time.Now())
+			}
+		}()
+	}
+	wg.Wait()
+	events, coverage := t.EventsBetween(time.Time{}, time.Now())
+	assert.Len(test, events, 50)
+	assert.True(test, coverage.Truncated)
+}
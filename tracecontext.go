@@ -0,0 +1,159 @@
+package tracey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// The W3C trace context headers, see https://www.w3.org/TR/trace-context/
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+// A TraceParent is the W3C trace context a remote caller sent along with
+// its request.
+type TraceParent struct {
+	// 32 and 16 lowercase hex digits
+	TraceID  string
+	ParentID string
+
+	// Whether the caller recorded its side of the trace
+	Sampled bool
+
+	// The "tracestate" header, which is passed on as is
+	State string
+}
+
+// ParseTraceParent parses the values of the "traceparent" and "tracestate"
+// headers. It returns false if "traceparent" is malformed, in which case
+// the request should start a trace of its own.
+func ParseTraceParent(traceparent, tracestate string) (TraceParent, bool) {
+	v := strings.TrimSpace(traceparent)
+	// Later versions may only add fields at the end
+	if len(v) < 55 || (len(v) > 55 && (v[:2] == "00" || v[55] != '-')) {
+		return TraceParent{}, false
+	}
+	if v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return TraceParent{}, false
+	}
+	version, traceID, parentID, flags := v[:2], v[3:35], v[36:52], v[53:55]
+	if !isLowerHex(version) || version == "ff" || !isLowerHex(flags) || !isTraceID(traceID) || !isTraceID(parentID) {
+		return TraceParent{}, false
+	}
+	flagBits, _ := hex.DecodeString(flags)
+	return TraceParent{
+		TraceID:  traceID,
+		ParentID: parentID,
+		Sampled:  flagBits[0]&1 != 0,
+		State:    strings.TrimSpace(tracestate),
+	}, true
+}
+
+// ExtractTraceParent parses the trace context headers of a request, see
+// `ParseTraceParent(...)`.
+func ExtractTraceParent(h http.Header) (TraceParent, bool) {
+	return ParseTraceParent(h.Get(TraceParentHeader), strings.Join(h.Values(TraceStateHeader), ","))
+}
+
+// Header returns the trace context as the value of a "traceparent" header.
+func (p TraceParent) Header() string {
+	flags := "00"
+	if p.Sampled {
+		flags = "01"
+	}
+	return "00-" + p.TraceID + "-" + p.ParentID + "-" + flags
+}
+
+// StartRemote starts a span the way `Start(...)` does, but as part of the
+// trace of a remote caller, on a goroutine which has no span open. The
+// span's trace id is the caller's, and its parent id is the caller's span.
+// A zero TraceParent (as when the headers were malformed) starts a trace
+// of its own.
+func (t *Tracer) StartRemote(parent TraceParent, s ...interface{}) *Span {
+	return t.startRemote(parent, nil, s...)
+}
+
+// StartRemoteNamed works like `StartRemote(...)`, but names the span
+// "name" the way `StartNamed(...)` does.
+func (t *Tracer) StartRemoteNamed(parent TraceParent, name string, s ...interface{}) *Span {
+	return t.startRemote(parent, t.namedSite(name), s...)
+}
+
+// Starts the span named after "site", or after the calling function if
+// it is nil
+func (t *Tracer) startRemote(parent TraceParent, site *callsite, s ...interface{}) *Span {
+	if t.options.DisableTracing {
+		return noopSpan
+	}
+	if parent.TraceID == "" {
+		return t.start(nil, "", site, s...)
+	}
+	remote := &Span{ev: Event{TraceID: parent.TraceID, SpanID: parent.ParentID, Depth: -1}, remote: &parent}
+	return t.start(remote, "", site, s...)
+}
+
+// TraceParent returns the trace context to send along with a request made
+// within the span, in which the span is the caller: its id is the parent
+// id, for the spans the request starts remotely to link back to it. Every
+// outgoing request gets a span id of its own when it is made within a span
+// of its own, as the clients of traceygrpc do. Ids which are not already
+// W3C-sized hex (such as those of the default IDGenerator) are mapped to
+// hex, the same id always mapping to the same hex. Calls which are part of
+// a remote trace keep its trace id, "tracestate" and sampled flag. Returns
+// a zero TraceParent for spans of disabled tracers.
+func (s *Span) TraceParent() TraceParent {
+	if s.ev.SpanID == "" {
+		return TraceParent{}
+	}
+	p := TraceParent{TraceID: hexID(s.ev.TraceID, 32), ParentID: hexID(s.ev.SpanID, 16), Sampled: true}
+	if s.remote != nil {
+		p.Sampled, p.State = s.remote.Sampled, s.remote.State
+	}
+	return p
+}
+
+// InjectTraceParent sets the trace context headers of a request made
+// within the span, see `TraceParent()`.
+func (s *Span) InjectTraceParent(h http.Header) {
+	p := s.TraceParent()
+	if p.TraceID == "" {
+		return
+	}
+	h.Set(TraceParentHeader, p.Header())
+	if p.State != "" {
+		h.Set(TraceStateHeader, p.State)
+	} else {
+		h.Del(TraceStateHeader)
+	}
+}
+
+// Maps an id to "n" lowercase hex digits, zero-padding ids which already
+// are hex and hashing the others
+func hexID(id string, n int) string {
+	if len(id) <= n && isLowerHex(id) {
+		padded := strings.Repeat("0", n-len(id)) + id
+		if isTraceID(padded) {
+			return padded
+		}
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:n/2])
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Trace and span ids are hex, and must not be all zeros
+func isTraceID(s string) bool {
+	return isLowerHex(s) && strings.Trim(s, "0") != ""
+}
@@ -0,0 +1,106 @@
+package tracey
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceParentRoundTrip(test *testing.T) {
+	h := http.Header{}
+	h.Set("Traceparent", testTraceParent)
+	h.Add("Tracestate", "congo=t61rcWkgMzE")
+	h.Add("Tracestate", "rojo=00f067aa0ba902b7")
+	parent, ok := ExtractTraceParent(h)
+	assert.True(test, ok)
+	assert.Equal(test, TraceParent{
+		TraceID:  "4bf92f3577b34da6a3ce929d0e0e4736",
+		ParentID: "00f067aa0ba902b7",
+		Sampled:  true,
+		State:    "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7",
+	}, parent)
+	assert.Equal(test, testTraceParent, parent.Header())
+
+	js := &lockedBuffer{}
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: js, Format: JSONFormat}}})
+	span := t.StartRemote(parent, "%s", "handler")
+	child := t.Start("%s", "client")
+	out := http.Header{}
+	child.InjectTraceParent(out)
+	child.End()
+	span.End()
+
+	// The trace id is kept, the client span being the parent
+	assert.Equal(test, "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000002-01", out.Get("traceparent"))
+	assert.Equal(test, parent.State, out.Get("tracestate"))
+	exits := jsonExits(test, js)
+	if assert.Equal(test, 2, len(exits)) {
+		assert.Equal(test, parent.TraceID, exits[1]["trace"])
+		assert.Equal(test, parent.ParentID, exits[1]["parent"])
+		assert.Equal(test, float64(0), exits[1]["depth"])
+		assert.Equal(test, "1", exits[0]["parent"])
+	}
+}
+
+func TestTraceParentMalformed(test *testing.T) {
+	for _, v := range []string{
+		"",
+		"garbage",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	} {
+		parent, ok := ParseTraceParent(v, "a=b")
+		assert.False(test, ok, v)
+		assert.Equal(test, TraceParent{}, parent)
+	}
+
+	// Later versions may add fields
+	parent, ok := ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-what-ever", "")
+	assert.True(test, ok)
+	assert.False(test, parent.Sampled)
+
+	// Which starts a fresh trace
+	t := NewTracer(&Options{CustomLogger: BufLogger})
+	span := t.StartRemote(parent)
+	assert.Equal(test, "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000001-00", span.TraceParent().Header())
+	span.End()
+	span = t.StartRemote(TraceParent{})
+	assert.Equal(test, "00-00000000000000000000000000000001-0000000000000002-01", span.TraceParent().Header())
+	span.End()
+}
+
+func TestTraceParentLinkage(test *testing.T) {
+	var client, server lockedBuffer
+	tc := NewTracer(&Options{Sinks: []Sink{{Writer: &client, Format: JSONFormat}}, IDGenerator: RandomHexIDs{}})
+	ts := NewTracer(&Options{Sinks: []Sink{{Writer: &server, Format: JSONFormat}}, IDGenerator: RandomHexIDs{}})
+	span := tc.StartNamed("fetch")
+	h := http.Header{}
+	span.InjectTraceParent(h)
+	span.End()
+	parent, ok := ExtractTraceParent(h)
+	assert.True(test, ok)
+	ts.StartRemoteNamed(parent, "serve").End()
+
+	// The span the request starts remotely is a child of the client span
+	sent, served := jsonExits(test, &client), jsonExits(test, &server)
+	if assert.Len(test, sent, 1) && assert.Len(test, served, 1) {
+		assert.Equal(test, sent[0]["trace"], served[0]["trace"])
+		assert.Equal(test, sent[0]["span"], served[0]["parent"])
+	}
+}
+
+func TestTraceParentIDMapping(test *testing.T) {
+	assert.Equal(test, "00000000000000ab", hexID("ab", 16))
+	assert.Equal(test, 16, len(hexID("not-hex", 16)))
+	assert.Equal(test, hexID("not-hex", 16), hexID("not-hex", 16))
+	assert.True(test, isTraceID(hexID("0", 16)))
+	assert.Equal(test, TraceParent{}, noopSpan.TraceParent())
+}
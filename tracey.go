@@ -3,16 +3,19 @@ package tracey
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"os"
 	"regexp"
 	"strconv"
-	"strings"
 
 	"reflect"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -47,47 +50,954 @@ type Options struct {
 	DisableNesting  bool
 	SpacesPerIndent int `default:"2"`
 
+	// Setting "MaxIndentWidth" to N > 0 will cause tracey to indent the
+	// lines of deeply nested spans by N characters at most, the last of
+	// which is a "»" to show that the indentation was cut short, as in
+	// "[60]         »ENTER: ...", while the depth value still tells the
+	// true depth. The default value of 0 indents every level in full.
+	MaxIndentWidth int
+
+	// Setting "CompressLinearChains" to "true" will cause tracey to write
+	// the lines of the first span started within another at the same
+	// indentation as those of the other, its enter line starting with
+	// "└→", so that chains of calls which each make a single call do not
+	// march off to the right. The spans which follow the first within the
+	// same span are indented one level deeper than it, the enter line of
+	// the second ending with "(chain expanded)". The depth value still
+	// tells the true depth, which is all the rest of tracey goes by. The
+	// default value of "false" indents every span by its depth.
+	CompressLinearChains bool
+
 	// Setting "EnterMessage" or "ExitMessage" will override the default
-	// value of "Enter: " and "EXIT:  " respectively.
+	// value of "Enter: " and "EXIT:  " respectively. The shorter of the two
+	// is padded with spaces to the width of the longer, so that what
+	// follows them lines up.
 	EnterMessage string `default:"ENTER: "`
 	ExitMessage  string `default:"EXIT:  "`
 
+	// Setting "WideCharAware" to "true" will cause tracey to count the
+	// width of text by the columns it takes in a terminal, wherever it
+	// lines text up: East Asian wide characters and emoji take two,
+	// combining marks none. The default value of "false" counts one column
+	// for every character.
+	WideCharAware bool
+
+	// Setting "MaxMessageLen" will cause tracey to cut the messages of
+	// spans and events, the values of tags and the messages of errors to
+	// that many bytes with `TruncateMessage(...)`, marker included, in
+	// every format. The default value of 0 leaves them whole.
+	MaxMessageLen int
+
+	// Setting "MaxArgs" will cause tracey to format no more than that many
+	// arguments of a message, the verbs of the others rendering "…" and
+	// the message ending with a note, as in "(+3 args omitted)". Setting
+	// "MaxFormatDepth" will cause tracey to render the structs, maps,
+	// slices and arrays of arguments and tag values itself, rather than
+	// with fmt, as "%v" (or "%+v") would whatever the verb, but showing
+	// those nested more than that many levels deep as "{…}", and following
+	// pointers all the way down, values which contain themselves showing
+	// "<cycle>" where they do. Setting "MaxElements" renders them the same
+	// way, showing no more than that many elements of each slice, array
+	// and map, as in "[1 2 3 …+9997]". These bounds apply before anything
+	// is formatted, unlike "MaxMessageLen". Values which render themselves
+	// (such as an error, a `fmt.Stringer` or a `TraceValuer`) do so as
+	// usual. The default value of 0 sets no bound, leaving every value to
+	// fmt.
+	MaxArgs        int
+	MaxFormatDepth int
+	MaxElements    int
+
 	// Enables per-method execution time instrumentation
 	EnableInstrumentation bool
+
+	// Setting "AlignDurations" to N > 0 will cause tracey to line up the
+	// durations of "EnableInstrumentation" in column N of text output, by
+	// extending shorter lines with dots, as in "EXIT:  main.foo ...... in
+	// 1ms". Lines which are already too long are left as is. Columns count
+	// runes from the start of the line, not counting any logger prefix.
+	AlignDurations int
+
+	// Setting "NameFormatter" will cause tracey to run every function
+	// name (traced functions and captured callers alike) through it
+	// before logging. The default value of nil logs names as-is.
+	NameFormatter func(string) string
+
+	// Setting "NameMap" will cause tracey to rename the traced functions
+	// it matches once they went through the "NameFormatter", such as
+	// generated wrappers given stable names read with `LoadNameMap(...)`.
+	// The options which match function names, down to "FilterRules",
+	// "MessageTemplates" and "Budgets", match the new names. Functions it
+	// does not match keep their names, and so do spans given theirs, as
+	// with `StartNamed(...)`. See `ReloadNameMap(...)` to change it later.
+	NameMap NameMap
+
+	// Setting "CaptureCallers" to N > 0 will cause tracey to append up to
+	// N non-traced callers to the ENTER message of depth-0 functions, as
+	// in "via main.run ← server.loop". Setting "CaptureCallersAll" to
+	// "true" does this for every enter, and not just the depth-0 ones.
+	// The default value of 0 skips the stack walk altogether.
+	CaptureCallers    int
+	CaptureCallersAll bool
+
+	// Setting "MaxLines" or "MaxBytes" caps the output of the tracer. Once
+	// either is reached, a final "TRACE QUOTA REACHED" line is logged and
+	// all further output is dropped, until `ResetQuota()` is called. Depth
+	// bookkeeping carries on regardless. Both count what is written to
+	// every sink: an event sent to two sinks uses up two lines, and the
+	// bytes of both renderings. The default value of 0 is unlimited.
+	MaxLines uint64
+	MaxBytes uint64
+
+	// Setting "Sinks" sends the output to each of the given sinks, every
+	// one with its own format and filters (see `Sink`), instead of to the
+	// "CustomLogger". The default value of nil logs to the "CustomLogger".
+	Sinks []Sink
+
+	// Setting "SinkErrorHandler" will cause tracey to pass it every failed
+	// write to a sink, rather than warning on stderr about the first one
+	// and then at most once a minute. Once "SinkFailureThreshold" writes
+	// to a sink have failed in a row (`DefaultSinkFailureThreshold` if 0,
+	// never if negative) its lines fall back to the "FallbackWriter"
+	// (stderr if nil) after a "— output falling back to stderr after 25
+	// write errors —" line, and the sink is tried again every
+	// "SinkRetryInterval" (`DefaultSinkRetryInterval` if 0), its lines
+	// switching back to it after a "— output restored ... —" line as soon
+	// as it takes one. See `SinkHealth()` for what was lost meanwhile.
+	SinkErrorHandler     func(error)
+	SinkFailureThreshold int
+	FallbackWriter       io.Writer
+	SinkRetryInterval    time.Duration
+
+	// Setting "StreamBufferBytes" bounds the lines queued for each client
+	// of `ListenUnix(...)`, beyond which the client misses lines rather
+	// than slowing down tracing (`DefaultStreamBufferBytes` if 0). A client
+	// which missed any is told how many every "StreamDropReportInterval"
+	// (`DefaultStreamDropReportInterval` if 0).
+	StreamBufferBytes        int
+	StreamDropReportInterval time.Duration
+
+	// Setting "CollapseRepeats" to "true" will cause tracey to fold runs
+	// of back-to-back calls to the same function (at the same depth, on
+	// the same goroutine, with nothing traced inside them) into a single
+	// "(×500) processItem — total 1.2s, min 1.9ms..." line logged once the
+	// run ends. The first call of a run is logged as usual.
+	CollapseRepeats bool
+
+	// Setting "Clock" overrides where tracey gets the time from, which is
+	// mostly useful to make durations predictable in tests. The default
+	// value of nil uses `time.Now()`.
+	Clock func() time.Time
+
+	// Setting "Sleep" overrides how tracey waits out the latency of
+	// "LatencyInjection", which goes along with "Clock" in tests. The
+	// default value of nil uses `time.Sleep(...)`.
+	Sleep func(time.Duration)
+
+	// Setting "ClockResolutionFloor" will cause tracey to treat durations
+	// below it as too short for the clock to measure: they are logged as
+	// "<" it, as in "in <1µs", and taken to be the floor itself, with the
+	// "Approximate" flag of their exit events set. They are counted apart
+	// in the statistics, see "ExcludeApproximateStats", and only pass the
+	// "MinDuration" of sinks which is at most the floor. Setting it to
+	// `DetectClockResolution` measures the resolution of the clock once,
+	// in `NewTracer(...)`, which takes up to a single tick of the clock.
+	// The default value of 0 takes durations as they are.
+	ClockResolutionFloor time.Duration
+
+	// Setting "ExcludeApproximateStats" to "true" will cause tracey to
+	// leave the calls shorter than "ClockResolutionFloor" out of the total
+	// and mean durations and the samples of the statistics. The default
+	// value of "false" counts them at the floor.
+	ExcludeApproximateStats bool
+
+	// Setting "DetectCaching" to "true" will cause tracey to look for the
+	// functions whose first call is much slower than the later ones, as
+	// with a function whose results are cached, which `DumpStats(...)`
+	// lists as in "likely cached (first 120.0ms, subsequent ~2.0ms ×340)",
+	// see `CachingCandidates()`. "CacheSpeedupFactor" sets how many times
+	// faster the later calls must be, the default being
+	// `DefaultCacheSpeedupFactor`. The default value of "false" looks for
+	// nothing.
+	DetectCaching      bool
+	CacheSpeedupFactor float64
+
+	// Setting "ShowConcurrency" to "true" will cause tracey to append the
+	// number of goroutines inside the entered function, itself included,
+	// to every ENTER message as in "[inflight=7]". The counts are kept
+	// regardless, see `Stats()`.
+	ShowConcurrency bool
+
+	// Setting "InFlightIdleTimeout" controls how long the in-flight count
+	// of a function no goroutine is inside of is kept around before being
+	// dropped. The default value is one minute.
+	InFlightIdleTimeout time.Duration
+
+	// Setting "CSVWriter" will cause tracey to also write one CSV row per
+	// completed span to it, after a header row, see `csvHeader`. Setting
+	// "TSV" to "true" writes tab separated values instead. Rows are not
+	// subject to the "MaxLines" / "MaxBytes" quota. The default value of
+	// nil writes no rows.
+	CSVWriter io.Writer
+	TSV       bool
+
+	// Setting "MinLevel" will cause tracey to not log calls below that
+	// level, which are selected by passing a Level as the first argument
+	// as in `trace(tracey.Debug, "$FN")`. Depth bookkeeping carries on
+	// regardless. The default value of Trace logs all calls.
+	MinLevel Level
+
+	// Setting "MessageTemplates" overrides how the enter and exit lines of
+	// the functions whose name matches a pattern (the key, a regex) are
+	// rendered after the marker, using the tokens $FN, $TID, $DEPTH, $MSG
+	// (the message passed to enter), $DUR (the duration, on exit only)
+	// and $SIG (the signature of the function, see "CaptureSource") as in
+	// "$FN on $MSG took $DUR". Patterns are tried from the longest
+	// to the shortest, the first match wins. Templates only apply to text
+	// output. `NewTracer(...)` panics on a bad pattern or template, see
+	// `Options.Validate()`.
+	MessageTemplates map[string]string
+
+	// Setting "FlushOnPanic" to "true" enables `RecoverAndFlush()`, which
+	// writes a crash report to the "CrashWriter" when the program panics.
+	// The default "CrashWriter" is os.Stderr.
+	FlushOnPanic bool
+	CrashWriter  io.Writer
+
+	// Setting "IDGenerator" overrides how trace and span ids are minted,
+	// see `RandomHexIDs` for ids which are unique across runs. The default
+	// value of nil counts traces and spans from 1.
+	IDGenerator IDGenerator
+
+	// Setting "ShowIDs" to "true" will cause tracey to append the trace and
+	// span ids to every enter and exit message, as in "[trace=1 span=2]".
+	ShowIDs bool
+
+	// Setting "PropagateTaskPanics" to "true" lets panics in the tasks of a
+	// `TraceGroup` crash the program as usual. The default value of
+	// "false" turns them into errors returned by `TraceGroup.Wait()`.
+	PropagateTaskPanics bool
+
+	// Setting "ValueRenderer" will cause tracey to render tag values and
+	// message arguments with it, rather than with "%v", whenever it returns
+	// true. Values it leaves to tracey are rendered by their `TraceValue()`
+	// if they are a `TraceValuer`, or else with "%v". Renderers which panic
+	// render "<render error>". The renderings are the same for all sinks
+	// and the CSV export.
+	ValueRenderer func(v interface{}) (string, bool)
+
+	// Setting "WatchCancellation" to "true" will cause tracey to log a
+	// milestone within the spans started with `StartContext(...)` as soon
+	// as their context is done, rather than only noting it on their exit.
+	// A single goroutine watches the contexts of all open spans.
+	WatchCancellation bool
+
+	// Setting "ShowCheckpoints" to "true" will cause tracey to log every
+	// `Span.Checkpoint(...)` as it happens, indented within its span as in
+	// "✓ parse done (+12.0ms)". Setting "CheckpointSummary" to "true"
+	// appends the time each phase took to the EXIT line of the span, as in
+	// "[parse 12.0ms | write 40.0ms]". Checkpoints are listed in exit
+	// events regardless. Setting "WarnLateCheckpoints" to "true" logs a
+	// warning for checkpoints of spans which already ended.
+	ShowCheckpoints     bool
+	CheckpointSummary   bool
+	WarnLateCheckpoints bool
+
+	// Setting "SuppressSubtrees" will cause tracey to hide every call made
+	// within the functions whose name matches one of these regexes, on the
+	// same goroutine or on goroutines carrying on from it (see `Group()`).
+	// The function itself is still logged, and its EXIT line ends in
+	// "(+N nested calls hidden)". Hidden calls are still counted in
+	// `Stats()`. `NewTracer(...)` panics on a bad regex, see
+	// `Options.Validate()`.
+	SuppressSubtrees []string
+
+	// Setting "FilterRules" will cause tracey to leave out the spans of
+	// the functions the first rule whose pattern matches their name
+	// excludes, in the order of the rules, as it does those below
+	// "MinLevel": the spans nested within them are traced all the same,
+	// unless excluded in turn, and the functions no rule matches are
+	// traced. The prefixes, suffixes and exact names are looked up in
+	// tries and a map, so that hundreds of rules cost little more than a
+	// few, and only the regexes are tried in turn. As with the other
+	// patterns, the decision is made once per callsite. The rules whose
+	// pattern starts with "op:", as in "op:send-email", match the
+	// operation of the span instead (see `WithOperation(...)`), and are
+	// looked up on every call. See `ExplainFilter(...)` to tell which rule
+	// decides for a function. `NewTracer(...)` panics on a bad rule. The
+	// default value of nil traces every function.
+	FilterRules []FilterRule
+
+	// Setting "EnableBlockProfiling" to "true" will cause tracey to turn on
+	// the runtime's block and mutex profiles, and to append to the EXIT line
+	// of instrumented spans which took at least "BlockProfileMinDuration"
+	// roughly how long was spent blocked on locks and channels meanwhile,
+	// as in "(~blocked 38.0ms)". The profiles are process-wide, so this is
+	// the blocking of every goroutine during the span, not of the span's
+	// goroutine alone: it tells waiting spans apart from computing ones in
+	// mostly serial code, and is a hint at best in busy servers. Sampling
+	// reads both profiles on every enter and exit. Call `Close()` to turn
+	// the profiles back off.
+	EnableBlockProfiling    bool
+	BlockProfileMinDuration time.Duration
+
+	// Setting "EnableRuntimeMetrics" to "true" will cause tracey to read a
+	// few of the runtime's metrics (the GC cycles and pauses, and the live
+	// goroutines) at the enter and exit of instrumented spans, and to
+	// append how they changed to the EXIT line, as in "(gc ×1, pause
+	// 2.1ms; goroutines 420→610)", when they did. Like the profiles of
+	// "EnableBlockProfiling" the metrics are process-wide. Metrics the
+	// runtime does not have are left out. Setting
+	// "RuntimeMetricsTopLevelOnly" as well only samples the spans which
+	// have no parent. The default value of "false" reads no metrics.
+	EnableRuntimeMetrics       bool
+	RuntimeMetricsTopLevelOnly bool
+
+	// Setting "EnableCPUTime" to "true" will cause tracey to read the CPU
+	// clock of the calling thread at the enter and exit of spans, and to
+	// append the CPU time spent in between to the EXIT line next to the
+	// wall time, as in "(cpu 8.1ms)", and to the statistics of the
+	// function. Goroutines move between threads, and threads run other
+	// goroutines while theirs waits, so this is the CPU time of the
+	// thread rather than of the span, marked as approximate as in "(~cpu
+	// 8.1ms)", and left out of spans whose goroutine ended them on another
+	// thread. Setting "LockThread" as well locks the goroutine to its
+	// thread from the enter of every span to its exit, which makes the
+	// time exact at the cost of a thread per goroutine with a span open. A
+	// span ended by another goroutine leaves its own locked to the thread
+	// until it exits. The CPU clock of threads is only read on Linux,
+	// elsewhere nothing is measured. The default value of "false" reads
+	// no clock.
+	EnableCPUTime bool
+	LockThread    bool
+
+	// Setting "TrackOutputVolume" to "true" will cause tracey to count
+	// the lines, and their bytes, written for each span and the spans
+	// nested within it on the same goroutine, and to append them to the
+	// EXIT line of spans which logged at least "OutputVolumeMinLines"
+	// lines (`DefaultOutputVolumeMinLines` if 0), as in "[logged 214 lines
+	// / 18.0KB]". Like "MaxLines" and "MaxBytes" they count what is
+	// written to every sink, a line sent to two sinks counting twice with
+	// the bytes of both renderings, and lines "Async" sinks queue count
+	// when queued. Lines the sinks filter out are not counted, nor is the
+	// span's own EXIT line. `Stats()` totals them per function either way.
+	TrackOutputVolume    bool
+	OutputVolumeMinLines int
+
+	// Setting "AttributeMetricsToSpans" to "true" will cause tracey to
+	// tag the EXIT line of spans with how much the counters and gauges
+	// (see `Counter(...)`) changed while the span was the innermost open
+	// on the goroutine which changed them, as in "{cache_hits=3}", the
+	// changes within a nested span counting for it alone. Every change
+	// then looks up the goroutine's id. The default value of "false" only
+	// keeps the values of the instruments.
+	AttributeMetricsToSpans bool
+
+	// Setting "HighlightChanges" to "true" will cause tracey to remember
+	// the tags of the last call to each function, and to mark on the EXIT
+	// lines of the next calls how they changed, as in "{rows=120→135
+	// +cached=true -retry}". Values are compared as rendered, see
+	// "ValueRenderer". The last calls of up to "ChangeMemorySize" functions
+	// are remembered (`DefaultChangeMemorySize` if 0), the least recently
+	// called being forgotten first. Setting "SkipUnchanged" to "true" as
+	// well skips the calls whose message and tags did not change at all,
+	// provided nothing was traced inside of them, and logs how many were
+	// skipped as in "(unchanged ×42) main.poll" once a call changes, every
+	// 100 skipped calls and on `Flush()`. Markers only apply to text output.
+	HighlightChanges bool
+	ChangeMemorySize int
+	SkipUnchanged    bool
+
+	// Setting "DeltaMode" to "true" will cause tracey to only log the
+	// exits of the spans whose duration deviates from the mean of their
+	// function in the baseline, see `LoadBaseline(...)`, by more than
+	// "DeltaThresholdPct" percents of it, or by more than
+	// "DeltaThresholdAbs" (`DefaultDeltaThresholdPct` if neither is set),
+	// as in "EXIT:  main.load ... in 48.0ms (baseline 12.0ms, +300%)".
+	// The spans of functions which the baseline does not have are logged
+	// whatever their duration, tagged "new=true". Enter lines and
+	// milestones are not logged, while every span is counted in `Stats()`
+	// as usual, so that the run can make the next baseline.
+	DeltaMode         bool
+	DeltaThresholdPct float64
+	DeltaThresholdAbs time.Duration
+
+	// Setting "ErrorClassifier" overrides how the errors of failed spans
+	// are classified in the statistics, see `ErrorBreakdown(...)`, for the
+	// errors it returns a non-empty class for. The others fall into the
+	// classes of `RegisterErrorClass(...)`, or are classified by their
+	// type. Setting "RedactError" overrides how the example message of each
+	// class is scrubbed, the default being `RedactErrorMessage`. Setting
+	// "TopErrorClasses" changes how many classes `DumpStats(...)` lists per
+	// function, the default being `DefaultTopErrorClasses`.
+	ErrorClassifier func(error) string
+	RedactError     func(string) string
+	TopErrorClasses int
+
+	// "MaxAttemptDetail" changes how many attempts the summary of an
+	// operation lists the durations of (see `Operation.Done()`), the
+	// default being `DefaultMaxAttemptDetail`.
+	MaxAttemptDetail int
+
+	// Setting "PropagateContextOnError" to "true" will cause tracey to
+	// append the spans open around a failed span on its goroutine to its
+	// EXIT line, outermost first, as in "within: handleRequest{route=/orders}
+	// ← processOrder{id=9912}", and to list them in the "Ancestry" of its
+	// exit event. Spans without tags are shown by their message. Tag values
+	// are rendered as on EXIT lines, so "ValueRenderer" and `TraceValuer`
+	// redact them, and messages and values are cut to 40 bytes. Up to
+	// "ErrorAncestryDepth" spans are listed, the nearest ones, the default
+	// being `DefaultErrorAncestryDepth`.
+	PropagateContextOnError bool
+	ErrorAncestryDepth      int
+
+	// Setting "ProgressInterval" will cause tracey to log a heartbeat line
+	// for each open span which reported its progress with
+	// `Span.SetProgress(...)`, at most once per interval, as in
+	// "⏳ main.importRecords 34% (3.4M/10M) — running 2m10s [tid:6]". The
+	// goroutine which scans the open spans for "WarnAfter" scans those
+	// spans too, until there are none left or `Close()` is called. The
+	// default value of 0 logs no heartbeats.
+	ProgressInterval time.Duration
+
+	// Setting "SessionID" will cause tracey to stamp it on every event, as
+	// the "session" field of JSON and binary output and as a short
+	// "[s:ab12]" tag at the start of text lines, so that the traces of
+	// several processes can be told apart and merged with
+	// `MergeSessions(...)`. A coordinator typically generates one with
+	// `NewSessionID()`, and passes it to the processes it starts. Every
+	// sink then starts with a session header giving the build of the
+	// binary (see `BuildInfo()`), as in "TRACEY SESSION s:ab12 — myapp
+	// v1.4.2 (rev 9f3ac1e, dirty) go1.22.1" in text, "build info
+	// unavailable" standing in for binaries which have none, and as a
+	// "session" event carrying a "bi" field in JSON and binary output.
+	// Setting "BuildInfoPerEvent" to "true" adds the "bi" field to every
+	// JSON event as well, the default value of "false" only has it in
+	// the header.
+	SessionID         string
+	BuildInfoPerEvent bool
+
+	// Setting "Prefix" will cause tracey to prepend it to the names of the
+	// tracer's spans once another tracer adopts it, as in "lib." for the
+	// tracer of a library, so that the adopting tracer's statistics tell
+	// them apart, see `Adopt(...)`. The default value of "" keeps the
+	// names as they are.
+	Prefix string
+
+	// Setting "EscalateOnError" to "true" will cause tracey to retain the
+	// lines of each top-level call tree which "MinLevel" or the sinks'
+	// "MinDuration" filtered out, and to log them as soon as any span of
+	// the tree fails, marked "«replayed»" and with their original times,
+	// so that the failure shows up along with what led to it. The lines
+	// are let go of once the top-level span exits. Up to
+	// "EscalationBufferLines" lines are retained per tree
+	// (`DefaultEscalationBufferLines` if 0), the oldest being dropped,
+	// which the replay notes. Spans below "MinLevel" then get their
+	// messages built, lazy arguments included, in case they are replayed.
+	EscalateOnError       bool
+	EscalationBufferLines int
+
+	// Setting "TailSampling" to "true" will cause tracey to buffer the
+	// events of each top-level call tree until it completes, and to only
+	// write them out if "TailDecision" keeps the tree, which by default
+	// keeps the trees with a failed span, those whose top-level span took
+	// at least "TailMinDuration", and a "TailKeepRate" (between 0 and 1)
+	// of the others at random. The trees which are not kept are only
+	// counted in `Stats()`. At most "TailBufferLines" events are buffered
+	// per tree (`DefaultTailBufferLines` if 0): a tree which logs more
+	// has its buffered events written out, noting it as in "TRACE TAIL
+	// OVERFLOW — 1,024 buffered lines written, streaming the rest of the
+	// call tree", and the rest of its events written out as they come.
+	TailSampling    bool
+	TailBufferLines int
+	TailMinDuration time.Duration
+	TailKeepRate    float64
+	TailDecision    func(TreeSummary) bool
+
+	// Setting "PercentOfRoot" to "true" will cause tracey to buffer each
+	// top-level call tree as "TailSampling" does, and to end the exit
+	// lines of its spans with the share of the top-level span they took,
+	// as in "(34% of root)", once it completes. The shares of siblings
+	// are rounded so that they never add up to more than that of their
+	// parent. A tree which logs more than "TailBufferLines" is written
+	// out as it comes, without shares, its top-level exit noting it.
+	PercentOfRoot bool
+
+	// Setting "BundleOnError" to a "Dir" will cause tracey to keep a copy
+	// of the events of each top-level call tree, and once a tree with a
+	// failed span completes, to write it out in the background to a
+	// directory of its own, as in
+	// "<Dir>/20240102T150405.000Z-<trace id>/", for sharing: "trace.txt"
+	// has its lines, "tree.txt" its spans with their durations and shares
+	// of the top-level span, "events.json" its events and "meta.json" the
+	// build, the session, the options set, and the spans open when the
+	// first span failed. "MaxPerHour", "MaxBytes" and "MaxEvents" bound
+	// what is written. Failed writes are passed to "SinkErrorHandler",
+	// see `BundleNow(...)` to write a bundle on demand. The default value
+	// of "" writes no bundle.
+	BundleOnError BundleConfig
+
+	// Setting "ShowSuspensions" to "true" will cause tracey to log a line
+	// whenever a span is suspended or resumed (see `Span.Suspend()`), as
+	// in "⏸ main.rows suspended (active 12.0ms)" and
+	// "▶ main.rows resumed (idle 3.0s)". The default value of "false" only
+	// logs the time the span was running for on its exit.
+	ShowSuspensions bool
+
+	// Setting "WarnAfter" will cause tracey to log a warning, once, for
+	// each span which is still open that long after it was entered, as in
+	// "⚠ STILL RUNNING main.work — running 30s [tid:7]". A single
+	// goroutine scans the open spans, for the heartbeats of
+	// "ProgressInterval" as well, until there are none left or `Close()`
+	// is called. The default value of 0 logs no warnings.
+	WarnAfter time.Duration
+
+	// Setting "WarnWithStack" to "true" will cause tracey to log what the
+	// goroutine of the span is doing under its STILL RUNNING warnings: its
+	// state and its innermost "WarnStackFrames" frames
+	// (`DefaultWarnStackFrames` if 0), tracey's own frames left out.
+	// Capturing the stack means capturing those of every goroutine, so it
+	// happens at most once per "WarnStackInterval" across all spans
+	// (`DefaultWarnStackInterval` if 0), the other warnings noting
+	// "(stack omitted, rate-limited)" instead.
+	WarnWithStack     bool
+	WarnStackFrames   int
+	WarnStackInterval time.Duration
+
+	// Setting "HandoffTimeout" will cause tracey to end the spans which
+	// were handed off (see `Span.Transfer()`) and not accepted within that
+	// long, noting it within them, as in "↷ handoff from tid 4 never
+	// accepted, ended". The scanning goroutine of "WarnAfter" checks for
+	// them. The default value of 0 leaves them open.
+	HandoffTimeout time.Duration
+
+	// Setting "Middleware" will cause tracey to run every span it enters
+	// and exits through each of them, see `SpanMiddleware`. Their
+	// "OnEnter" run in order once the message of the span is built and
+	// before "MessageTemplates" and "SuppressSubtrees" are matched against
+	// its name, so that renaming a span renames it for those too, and
+	// their "OnExit" run in reverse order once its duration is known and
+	// before it is counted in `Stats()` and written out. None of the
+	// tracer's locks are held meanwhile, and a middleware which panics is
+	// logged and skipped. The default value of nil runs none.
+	Middleware []SpanMiddleware
+
+	// Setting "MaxTraceLatency" will cause tracey to measure how long each
+	// enter and exit takes it, with the wall clock whatever "Clock" is,
+	// and to shed the rest of the goroutine's tree once one takes longer
+	// than that, or an "Async" sink drops lines as its queue is full: the
+	// events which remain in the tree are counted in `Stats()` but not
+	// written out, and a single "(shed N events due to overload)" line is
+	// logged once the outermost span of the tree exits, see
+	// `Tracer.OverloadStats()`. What the first spans would build lazily,
+	// such as the matchers of the regexes and the buffers lines are
+	// rendered into, is then built by `NewTracer(...)`. The default value
+	// of 0 sheds nothing.
+	MaxTraceLatency time.Duration
+
+	// Setting "Router" will cause tracey to write the events of each tree
+	// of spans only to the sinks it returns, by position in "Sinks", such
+	// as those of the tenant a tag of the outermost span names. It is
+	// called once per tree, with the enter event of its outermost span,
+	// and the spans within the tree (on any goroutine, see
+	// `EnterUnder(...)`), their milestones and their exits go wherever it
+	// went, as do the milestones logged outside of any span, which it is
+	// called for one by one. The warnings and such which are not events
+	// go to every sink. Returning nil routes to "DefaultRoute" (every sink
+	// if nil), and returning an empty slice to none but the sinks with
+	// "Audit" set, which receive every failed exit whatever the route. It
+	// is called outside of any lock, and should it panic this is logged
+	// and the event goes to the "DefaultRoute". The default value of nil
+	// writes every event to every sink.
+	Router       func(Event) []SinkID
+	DefaultRoute []SinkID
+
+	// Setting "AuditConfigChanges" to "true" will cause tracey to log a
+	// line whenever the mutable options change (see `Update(...)`), as in
+	// "OPTIONS CHANGED: MinLevel trace → debug". The default value of
+	// "false" changes them silently.
+	AuditConfigChanges bool
+
+	// Setting "Budgets" gives the spans of the functions whose name
+	// matches a pattern (the key, a regex) a latency budget, as
+	// `WithBudget(...)` does, unless they run within the budget of another
+	// span already, which they keep if it is tighter. Patterns are tried
+	// in lexical order, the first match wins. Those which start with
+	// "op:", as in "op:^send-email$", match the operation of the span
+	// instead, see `WithOperation(...)`. `NewTracer(...)` panics on a bad
+	// pattern. The default value of nil leaves spans without a budget.
+	Budgets map[string]time.Duration
+
+	// Setting "LatencyInjection" will cause tracey to delay the calls of
+	// the functions whose name matches a pattern (the key, a regex) as
+	// their spec says, for testing how the callers cope with latency.
+	// The enter of a delayed call waits once it has logged its line, as
+	// in "ENTER: =>fetch [injected +25ms]", and its exit logs the same
+	// after the duration of the call, which leaves the injected latency
+	// out, as do the statistics (which count it in "InjectedTime").
+	// Patterns are tried in lexical order, the first match wins, and
+	// "InjectionRand" draws the chances and the jitter, by default from
+	// the "math/rand" package. `NewTracer(...)` panics on a bad pattern.
+	// See also `DisableInjection()`, and the "tracey_noinject" build tag,
+	// which leaves the option out. The default value of nil injects
+	// nothing.
+	LatencyInjection map[string]InjectionSpec
+	InjectionRand    func() float64
+
+	// Setting "TimelineBuffer" or "TimelineBufferBytes" will cause tracey
+	// to keep the latest events it traced, up to that many events or
+	// about that many bytes of them, whatever the sinks wrote of them, so
+	// that what was traced at a given time can be looked at after the
+	// fact, see `EventsBetween(...)`, `TreesBetween(...)` and
+	// `WriteTimeline(...)`. The oldest events are evicted first. The
+	// default values of 0 keep no events.
+	TimelineBuffer      int
+	TimelineBufferBytes int
+
+	// The lines attached to a span with `AttachLog(...)` are kept up to
+	// "MaxAttachedLines" lines and "MaxAttachedBytes" bytes of them
+	// (`DefaultMaxAttachedLines` and `DefaultMaxAttachedBytes` if 0), the
+	// oldest being dropped first for a note of how many were, and listed
+	// in "Attached" on its exit event. Text output renders them under the
+	// EXIT line of failed spans, as in "  | dialing db-2", and setting
+	// "AlwaysRenderAttachments" to "true" under every EXIT line. Lines
+	// attached while the goroutine has no span open wait for the next
+	// span it enters for up to "AttachPendingTimeout"
+	// (`DefaultAttachPendingTimeout` if 0), and are dropped after that.
+	MaxAttachedLines        int
+	MaxAttachedBytes        int
+	AlwaysRenderAttachments bool
+	AttachPendingTimeout    time.Duration
+
+	// Setting "GoroutineStateTTL" will cause tracey to keep what it knows
+	// about a goroutine for that long once the goroutine has nothing open
+	// any more, rather than dropping it right away, for goroutines which
+	// trace in bursts not to build it afresh for every burst. The
+	// scanning goroutine of "WarnAfter" drops the records which expire,
+	// see `GoroutineStateCount()` and `CompactNow()`. The default value of
+	// 0 drops them as soon as the goroutine is back to depth 0 with no
+	// option overrides pushed nor lines waiting for a span.
+	GoroutineStateTTL time.Duration
+
+	// Setting "StrictAudit" to "true" will cause `Close()` to run
+	// `Audit()` once everything is flushed, and to return the violations
+	// it finds as an error, for tests to fail on. The default value of
+	// "false" audits nothing, and `Close()` always returns nil.
+	StrictAudit bool
+
+	// Setting "EventHandler" will cause tracey to hand it every event it
+	// traces, numbered (see `Event.Seq`), whatever the sinks filter out
+	// or "TailSampling" and such withhold, such as to forward the events
+	// to a message queue. "HandlerOrdering" says when it is called: with
+	// `Emission`, the default, by the traced goroutine one call at a time,
+	// in the order of "Seq", and with `Delivery` from a goroutine of its
+	// own, which spares the traced code the wait but only keeps the order
+	// of the events of each goroutine. The default value of nil hands the
+	// events to no one.
+	EventHandler    func(Event)
+	HandlerOrdering HandlerOrdering
+
+	// Setting "WarnLateRename" to "true" will cause tracey to log a
+	// warning whenever a span is renamed or amended after it ended, see
+	// `Span.Rename(...)`. The default value of "false" ignores it silently.
+	WarnLateRename bool
+
+	// Setting "AbandonAfter" will cause tracey to force-close the spans
+	// still open that long after they were entered, as for a goroutine
+	// which leaked, and "AbandonAfterFuncs" those of the functions whose
+	// name matches a pattern (the key, a regex) after their own deadline,
+	// patterns being tried in lexical order, the first match winning. The
+	// goroutine which scans the open spans for "WarnAfter" ends them on
+	// behalf of their goroutine, whose depth goes down, with an EXIT line
+	// as in "EXIT:  [tid:7]=>main.work ... in 10m0s (abandoned after
+	// 10m0s — forced close)", whose event has "Abandoned" set. Their
+	// statistics count them apart from the calls which exited, see
+	// `FuncStats.Abandoned`. Should the span be ended after all, that is
+	// ignored but for a warning, "late exit for abandoned span". Spans
+	// are exempt while suspended, see `Span.Suspend()`. `NewTracer(...)`
+	// panics on a bad pattern. The default values abandon no span.
+	AbandonAfter      time.Duration
+	AbandonAfterFuncs map[string]time.Duration
+
+	// Setting "LogOptionsAtStartup" to "true" will cause tracey to log
+	// the options it runs under once, the first thing after the session
+	// header, as in "TRACEY OPTIONS v1" followed by a line per option,
+	// see `EffectiveOptions()`. The default value of "false" logs none.
+	LogOptionsAtStartup bool
+
+	// Setting "PoolClose" to `CancelPending` will cause
+	// `TracePool.Close()` to drop the tasks still queued, their queued
+	// spans failing with `ErrPoolClosed`. The default value of
+	// `DrainPending` runs them before the workers stop.
+	PoolClose PoolClose
+
+	// Setting "PoolErrorHandler" will cause tracey to call it with the
+	// tasks of a `TracePool` which failed, whether they returned an error,
+	// panicked (as in "panicked: boom") or never ran, see
+	// `NewNamedPool(...)`. It is called from the goroutine which ran or
+	// dropped the task. The default value of nil reports them to no one,
+	// their spans failing all the same.
+	PoolErrorHandler func(pool, task string, err error)
+
+	// Setting "CloseTimeout" will cause `Close()` to wait that long at
+	// most for the trees of spans still open to finish, refusing new
+	// top-level spans meanwhile, before it force-closes what is left, see
+	// `CloseGraceful(...)`. The default value of 0 closes the tracer
+	// straight away, leaving the open spans as they are.
+	CloseTimeout time.Duration
+
+	// Setting "OperationMap" makes the spans of the functions whose name
+	// matches a pattern (the key, a regex) part of an operation (the
+	// value), as `WithOperation(...)` does, unless they were given one.
+	// Patterns are tried in lexical order, the first match wins.
+	// `NewTracer(...)` panics on a bad pattern. The default value of nil
+	// leaves spans out of any operation.
+	OperationMap map[string]string
+
+	// Setting "SilentAlerts" to "true" will cause tracey to only hand the
+	// alerts of `AddAlert(...)` to their sinks. The default value of
+	// "false" logs them as well, as in "*** ALERT: payment.Process error
+	// rate 12/min exceeds 10/min ***".
+	SilentAlerts bool
+
+	// Setting "CaptureSource" to "true" will cause tracey to read the
+	// signature of each traced function from its source, as in "func (s
+	// *Server) handleOrder(ctx context.Context, id string) error", for the
+	// "$SIG" token of "MessageTemplates" and for `WriteSourceIndex(...)`.
+	// Sources are read in the background the first time a callsite is
+	// traced, so that the signature shows from the next call on. Meant
+	// for development, the default value of "false" reads nothing.
+	CaptureSource bool
+
+	// Setting "SourceRoot" will cause tracey to look for the sources of
+	// "CaptureSource" below it when they are not at the paths the binary
+	// was built from, at the longest trailing part of those paths found
+	// there. The default value of "" only looks at the paths themselves.
+	SourceRoot string
+
+	// Setting "MaxPins" limits how many trace ids `Pin(...)` pins at once,
+	// the oldest being unpinned for new ones. The default value of 0 pins
+	// up to `DefaultMaxPins`.
+	MaxPins int
+
+	// Setting "BundlePinned" to "true" will cause tracey to write out the
+	// bundle of each pinned call tree (see `Pin(...)`) once it completes,
+	// as "BundleOnError" does for those which fail, whether or not they
+	// did. The default value of "false" bundles pinned trees only if they
+	// fail.
+	BundlePinned bool
+
+	// Setting "ObservationBuckets" sets the upper bounds of the buckets
+	// of the histograms of `Span.Observe(...)`, by metric, in increasing
+	// order, as in {"rows": {10, 100, 1000}}, the values above the last
+	// bound being counted in a bucket of their own. The default value of
+	// nil buckets every metric by powers of 2, from 1 to 2^30.
+	// `NewTracer(...)` panics on bounds which do not go up, see
+	// `Options.Validate()`.
+	ObservationBuckets map[string][]float64
 }
 
-// Private member, used to keep track of how many levels of nesting
-// the current trace functions have navigated.
-var currentDepth struct {
-	sync.RWMutex
-	d map[uint64]int
+// A Tracer holds the resolved options and the state of a single tracer.
+// Most users only need the enter function returned by `New(...)`, the
+// Tracer itself exposes accessors for the tracer's bookkeeping.
+type Tracer struct {
+	options Options
+	start   func(*Span, string, *callsite, ...interface{}) *Span
+	end     func(*Span)
+	sinks   []*sinkState
+	csv     *csvExport
+
+	// The mutable options in effect, and the lock serializing their
+	// updates, see `Update(...)`
+	config   atomic.Pointer[mutableConfig]
+	updating sync.Mutex
+
+	// The callsites spans were entered from, by program counter
+	callsites sync.Map
+
+	// The "NameMap" in effect, see `ReloadNameMap(...)`
+	nameMap atomic.Pointer[NameMap]
+
+	// The callsites of the labels, by name, see `Label(...)`
+	labels sync.Map
+
+	quota   quota
+	repeats repeats
+	stats   stats
+
+	// Numbers the events, see `Event.Seq`, and serializes the calls of
+	// the "EventHandler" in `Emission` order, or queues them in
+	// `Delivery` order
+	seq      uint64
+	handling sync.Mutex
+	handlers *handlerQueue
+
+	// The counters and gauges, by name, see `Counter(...)`
+	instruments sync.Map
+
+	// The depth and open spans of each goroutine
+	goroutines goroutines
+
+	// Set once any option overrides were pushed, see `WithOverrides(...)`
+	overridden uint32
+
+	// The compiled "OperationMap"
+	operations *operationMap
+
+	// Set if "CaptureSource" is
+	sources *sourceIndex
+
+	// The checked "ObservationBuckets"
+	observationBuckets map[string][]float64
+
+	// The compiled "Budgets", and set once any span was given a budget,
+	// see `WithBudget(...)`
+	budgets  *budgets
+	budgeted uint32
+
+	// The compiled "LatencyInjection"
+	injections *injections
+
+	// The compiled "AbandonAfterFuncs", set if any span may be abandoned
+	abandonAfter *budgets
+
+	// The compiled "FilterRules"
+	filters *filterRules
+
+	// Set if "TimelineBuffer" or "TimelineBufferBytes" is
+	timeline *timeline
+
+	// Watches the contexts of open spans, see "WatchCancellation"
+	watcher cancelWatcher
+
+	// Set if "EnableBlockProfiling" is
+	blocking *blockProfiler
+
+	// Set if "EnableRuntimeMetrics" is, and the runtime has the metrics
+	runtime *runtimeSampler
+
+	// Set if "EnableCPUTime" is, and the platform has a CPU clock per
+	// thread
+	cpuTime bool
+
+	// The build of the binary, nil if it has no build information
+	build *BuildInfo
+
+	// The baseline of "DeltaMode", see `LoadBaseline(...)`
+	baseline atomic.Pointer[baseline]
+
+	// Set if "HighlightChanges" is
+	changes *changeMemory
+
+	// Set while another tracer has adopted this one, see `Adopt(...)`
+	adopter atomic.Pointer[adoption]
+
+	// The clients of `ListenUnix(...)`
+	streams streamHub
+
+	// Logs the heartbeats of "ProgressInterval" and the warnings of
+	// "WarnAfter"
+	scanner scanner
+
+	// The spans which are suspended, see `Span.Suspend()`, and those which
+	// are handed off, see `Span.Transfer()`
+	suspensions suspensions
+	handoffs    suspensions
+
+	// The shedding of "MaxTraceLatency"
+	overload overload
+
+	// The variables published by `PublishExpvar(...)`
+	expvars expvars
+
+	// The violations found on exit, see `Audit()`
+	audit audit
+
+	// The bundles of "BundleOnError"
+	bundles bundles
+
+	// The draining of the open trees on close, see "CloseTimeout"
+	closer closer
+
+	// The rules of `AddAlert(...)`
+	alerts alerts
+
+	// The trace ids of `Pin(...)`
+	pins pins
+}
+
+// The buffers the goroutine ids are parsed from, reused since the stack
+// trace escapes
+var gidBufferPool = sync.Pool{
+	New: func() interface{} { return new([64]byte) },
 }
-var entryTime struct {
-	sync.RWMutex
-	t map[string]time.Time
+
+// Returns the id of the calling goroutine, as parsed from its stack trace
+func getGID() uint64 {
+	buf := gidBufferPool.Get().(*[64]byte)
+	defer gidBufferPool.Put(buf)
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	b = b[:bytes.IndexByte(b, ' ')]
+	n, _ := strconv.ParseUint(string(b), 10, 64)
+	return n
 }
 
 // New is the main entry-point for the tracey lib. Calling New with nil will
 // result in the default options being used.
 func New(opts *Options) func(...interface{}) func() {
-	var options Options
-	if opts != nil {
-		options = *opts
-	}
+	return NewTracer(opts).Enter
+}
 
-	// If tracing is not enabled, just return no-op functions
-	if options.DisableTracing {
-		return func(s ...interface{}) func() { return func() {} }
+// Enter logs the entry of the calling function and returns the function
+// which logs its exit, for use as `defer tracer.Enter(...)()`.
+func (t *Tracer) Enter(s ...interface{}) func() {
+	return t.Start(s...).End
+}
+
+// Start logs the entry of the calling function like `Enter(...)`, but
+// returns the Span itself so that it can be tagged or failed before it
+// is ended.
+func (t *Tracer) Start(s ...interface{}) *Span {
+	if t.start == nil {
+		return noopSpan
 	}
+	return t.start(nil, "", nil, s...)
+}
 
-	// Revert to stdout if no logger is defined
-	if options.CustomLogger == nil {
-		options.CustomLogger = log.New(os.Stdout, "", 0)
+// Close writes out everything the tracer is holding back (see `Flush()`),
+// stops its background work, and undoes the changes it made to the
+// runtime's settings. The goroutines logging the heartbeats of
+// "ProgressInterval" and the warnings of "WarnAfter" are stopped first, so
+// that none of their lines are left queued for "Async" sinks. For
+// "EnableBlockProfiling", the mutex profile fraction is restored, and the
+// block profile rate (which the runtime does not tell) is turned back off.
+// Spans carry on being traced, without heartbeats, warnings nor blocked
+// time. The sockets of `ListenUnix(...)` are removed, and their clients
+// disconnected. The variables of `PublishExpvar(...)` stay at their values
+// as of the first call. Only the first call stops anything. With
+// "CloseTimeout" set, the trees of spans still open are drained first,
+// see `CloseGraceful(...)`. The error is that of `Audit()` under
+// "StrictAudit", and nil otherwise.
+func (t *Tracer) Close() error {
+	t.drain(context.Background(), false)
+	t.scanner.close()
+	t.Flush()
+	t.streams.close()
+	if t.blocking != nil {
+		t.blocking.close()
 	}
+	t.freezeExpvars()
+	if t.options.StrictAudit {
+		return t.Audit().Err()
+	}
+	return nil
+}
 
+// Fills in the defaults of the options which the text lines depend on
+func textDefaults(options *Options) {
 	// Use reflect to deduce "default" values for the
 	// Enter and Exit messages (if they are not set)
-	reflectedType := reflect.TypeOf(options)
+	reflectedType := reflect.TypeOf(*options)
 	if options.EnterMessage == "" {
 		field, _ := reflectedType.FieldByName("EnterMessage")
 		options.EnterMessage = field.Tag.Get("default")
@@ -96,88 +1006,182 @@ func New(opts *Options) func(...interface{}) func() {
 		field, _ := reflectedType.FieldByName("ExitMessage")
 		options.ExitMessage = field.Tag.Get("default")
 	}
+	padMarkers(options)
 
 	// If nesting is enabled, and the spaces are not specified,
 	// use the "default" value
 	if options.DisableNesting {
 		options.SpacesPerIndent = 0
 	} else {
-		currentDepth.d = make(map[uint64]int, 20)
 		if options.SpacesPerIndent == 0 {
 			field, _ := reflectedType.FieldByName("SpacesPerIndent")
 			options.SpacesPerIndent, _ = strconv.Atoi(field.Tag.Get("default"))
 		}
 	}
+}
 
-	_getGID := func() uint64 {
-		b := make([]byte, 64)
-		b = b[:runtime.Stack(b, false)]
-		b = bytes.TrimPrefix(b, []byte("goroutine "))
-		b = b[:bytes.IndexByte(b, ' ')]
-		n, _ := strconv.ParseUint(string(b), 10, 64)
-		return n
+// NewTracer works like `New(...)`, but returns the Tracer itself rather
+// than just its enter function.
+func NewTracer(opts *Options) *Tracer {
+	t := &Tracer{}
+	if opts != nil {
+		t.options = *opts
 	}
+	options := &t.options
 
-	if options.EnableInstrumentation {
-		entryTime.t = make(map[string]time.Time, 20)
+	// If tracing is not enabled, just return no-op functions
+	if options.DisableTracing {
+		return t
 	}
 
-	//
-	// Define functions we will use and return to the caller
-	//
-	_spacify := func() string {
-		var spaces string
-		if !options.DisableNesting {
-			currentDepth.RLock()
-			d := currentDepth.d[_getGID()]
-			currentDepth.RUnlock()
-			spaces = strings.Repeat(" ", d*options.SpacesPerIndent)
-			if !options.DisableDepthValue {
-				return fmt.Sprintf("[%2d]%s", d, spaces)
-			}
+	// Revert to stdout if no logger is defined
+	if options.CustomLogger == nil {
+		options.CustomLogger = log.New(os.Stdout, "", 0)
+	}
+	if options.Clock == nil {
+		options.Clock = time.Now
+	}
+	if options.ClockResolutionFloor == DetectClockResolution {
+		options.ClockResolutionFloor = detectClockResolution(options.Clock)
+	}
+	if options.IDGenerator == nil {
+		options.IDGenerator = &counterIDs{}
+	}
+	if options.CrashWriter == nil {
+		options.CrashWriter = os.Stderr
+	}
+	if options.InFlightIdleTimeout <= 0 {
+		options.InFlightIdleTimeout = time.Minute
+	}
+	t.sinks = newSinks(options)
+	for _, s := range t.sinks {
+		s.guard = &t.goroutines
+		if s.async != nil {
+			s.async.overflows = &t.overload.overflows
 		}
-		return spaces
 	}
-
-	// Increment function to increase the current depth value
-	_incrementDepth := func() {
-		if !options.DisableNesting {
-			currentDepth.Lock()
-			currentDepth.d[_getGID()]++
-			currentDepth.Unlock()
+	mutable := MutableOptions{
+		MinLevel:         options.MinLevel,
+		MessageTemplates: options.MessageTemplates,
+		SuppressSubtrees: options.SuppressSubtrees,
+	}
+	for _, s := range t.sinks {
+		mutable.MinDurations = append(mutable.MinDurations, s.MinDuration)
+		mutable.MinLevels = append(mutable.MinLevels, s.MinLevel)
+	}
+	config, err := compileConfig(mutable.clone())
+	if err != nil {
+		panic("tracey: " + err.Error())
+	}
+	t.config.Store(config)
+	t.goroutines.init(options.GoroutineStateTTL, t.attachPendingTimeout(), options.Clock)
+	if options.CSVWriter != nil {
+		t.csv = newCSVExport(options.CSVWriter, options.TSV)
+	}
+	if options.CollapseRepeats {
+		t.repeats.g = make(map[uint64]*repeatState)
+	}
+	if options.EnableBlockProfiling {
+		t.blocking = newBlockProfiler()
+	}
+	if options.EnableRuntimeMetrics {
+		t.runtime = newRuntimeSampler()
+	}
+	if options.EnableCPUTime {
+		_, _, err := threadCPU()
+		t.cpuTime = err == nil
+	}
+	if options.HighlightChanges {
+		t.changes = newChangeMemory(options.ChangeMemorySize)
+	}
+	if options.NameMap.m != nil {
+		t.nameMap.Store(&options.NameMap)
+	}
+	if len(options.FilterRules) > 0 {
+		filters, err := compileFilterRules(options.FilterRules)
+		if err != nil {
+			panic("tracey: " + err.Error())
 		}
+		t.filters = filters
 	}
-
-	// Decrement function to decrement the current depth value
-	//  + panics if current depth value is < 0
-	_decrementDepth := func() {
-		if !options.DisableNesting {
-			gid := _getGID()
-			currentDepth.Lock()
-			currentDepth.d[gid]--
-			if currentDepth.d[gid] < 0 {
-				//panic("Depth is negative! Should never happen!")
-				//panic in function tracing does not make sense
-				// instead reset the depth, and log warning
-				options.CustomLogger.Println("Warning: depth became negative in tracey, when attempting to decrement.")
-				currentDepth.d[gid] = 0
-			}
-			currentDepth.Unlock()
+	if len(options.OperationMap) > 0 {
+		operations, err := compileOperationMap(options.OperationMap)
+		if err != nil {
+			panic("tracey: " + err.Error())
 		}
+		t.operations = operations
 	}
-
-	_getname := func(s ...interface{}) string {
-		// Figure out the name of the caller and use that
-		fnName := "<unknown>"
-		pc, fl, fi, ok := runtime.Caller(2)
-		if ok {
-			fnName = RE_stripFnPreamble.ReplaceAllString(runtime.FuncForPC(pc).Name(), "$1")
-			//fnName = runtime.FuncForPC(pc).Name()
+	if options.CaptureSource {
+		t.sources = newSourceIndex(options.SourceRoot)
+	}
+	if len(options.ObservationBuckets) > 0 {
+		if err := checkObservationBuckets(options.ObservationBuckets); err != nil {
+			panic("tracey: " + err.Error())
 		}
-
-		if fnName == "" {
-			fnName = fl + strconv.Itoa(fi)
+		t.observationBuckets = make(map[string][]float64, len(options.ObservationBuckets))
+		for metric, bounds := range options.ObservationBuckets {
+			t.observationBuckets[metric] = append([]float64(nil), bounds...)
+		}
+	}
+	if len(options.Budgets) > 0 {
+		budgets, err := compileBudgets(options.Budgets)
+		if err != nil {
+			panic("tracey: " + err.Error())
+		}
+		t.budgets = budgets
+	}
+	if options.AbandonAfter > 0 || len(options.AbandonAfterFuncs) > 0 {
+		abandonAfter, err := compileDurations("AbandonAfterFuncs", options.AbandonAfterFuncs)
+		if err != nil {
+			panic("tracey: " + err.Error())
+		}
+		t.abandonAfter = abandonAfter
+	}
+	if options.TimelineBuffer > 0 || options.TimelineBufferBytes > 0 {
+		t.timeline = newTimeline(options.TimelineBuffer, options.TimelineBufferBytes)
+	}
+	if options.EventHandler != nil && options.HandlerOrdering == Delivery {
+		t.handlers = &handlerQueue{handle: options.EventHandler}
+	}
+	if injectionBuilt && len(options.LatencyInjection) > 0 {
+		injections, err := compileInjections(options.LatencyInjection)
+		if err != nil {
+			panic("tracey: " + err.Error())
 		}
+		injections.rand = options.InjectionRand
+		if injections.rand == nil {
+			injections.rand = rand.Float64
+		}
+		t.injections = injections
+		if options.Sleep == nil {
+			options.Sleep = time.Sleep
+		}
+	}
+
+	textDefaults(options)
+
+	t.build = currentBuildInfo()
+	if options.SessionID != "" {
+		t.emitSessionHeader()
+	}
+	if options.LogOptionsAtStartup {
+		t.logOptions()
+	}
+
+	if options.MaxTraceLatency > 0 {
+		t.prewarm()
+	}
+
+	//
+	// Define functions we will use and return to the caller
+	//
+	nesting := !options.DisableNesting
+
+	// Returns the message of the traced function, and the function and
+	// message combined the way they are rendered in text output. Only
+	// called for spans which are logged, so that lazy arguments (see
+	// `Lazy(...)`) are not evaluated otherwise.
+	_getmessage := func(gid uint64, fnName string, s ...interface{}) (string, string) {
 		//		if len(args) > 0 {
 		//			if fmtStr, ok := args[0].(string); ok {
 		//				// We have a string leading args, assume its to be formatted
@@ -187,57 +1191,309 @@ func New(opts *Options) func(...interface{}) func() {
 
 		// "$FN" will be replaced by the name of the function (if present)
 		//		traceMessage = RE_detectFN.ReplaceAllString(traceMessage, fnName)
-		tid := "[tid:" + strconv.FormatUint(_getGID(), 10)
-		var traceMessage string
+		tid := "[tid:" + strconv.FormatUint(gid, 10)
+		var traceMessage, message string
 		if len(s) > 0 {
 			fmtStr, ok := s[0].(string)
 			if len(s) == 1 && ok {
-				tid = tid + " - " + s[0].(string)
+				message = t.capMessage(fmtStr)
+				tid = tid + " - " + message
 			} else if ok {
 				// We have a string leading args, assume its to be formatted
-				traceMessage = fmt.Sprintf(fmtStr, s[1:]...)
+				args, omitted := t.limitArgs(t.renderArgs(s[1:]))
+				formatted := fmt.Sprintf(fmtStr, args...)
+				if omitted > 0 {
+					formatted += argsOmitted(omitted)
+				}
+				traceMessage = t.capMessage(RE_detectFN.ReplaceAllString(formatted, fnName))
+				message = traceMessage
 			}
 		}
 
-		fnName = tid + "]=>" + RE_detectFN.ReplaceAllString(traceMessage, fnName)
-		return fnName
+		return message, tid + "]=>" + traceMessage
 	}
 
 	//	_instrument := func() uint64 {
 	//		return 0
 	//	}
 
-	// Exit function, invoked on function exit (usually deferred)
-	_exit := func() {
-		_decrementDepth()
-		fname := _getname()
-		if options.EnableInstrumentation {
-			entryTime.RLock()
-			fname = fname + " ... in " + time.Since(entryTime.t[fname]).String()
-			entryTime.RUnlock()
+	// Exit function, invoked on function exit (usually deferred) with the
+	// span which was started by the matching enter
+	_exit := func(span *Span) {
+		if options.MaxTraceLatency > 0 {
+			began, overflows := t.overloadStart()
+			defer t.overloadEnd(span, began, overflows, true)
+		}
+		// A span is on no goroutine while suspended
+		span.pause.Lock()
+		ev := span.ev
+		if options.PropagateContextOnError && ev.Err != nil && !span.muted {
+			ev.Ancestry = t.ancestry(span)
 		}
-		options.CustomLogger.Printf("%s%s%s\n", _spacify(), options.ExitMessage, fname)
-		if options.EnableInstrumentation {
-			entryTime.Lock()
-			delete(entryTime.t, fname)
-			entryTime.Unlock()
+		depth, ok := ev.Depth, true
+		if !span.pause.suspended && !span.handoff.pending {
+			depth, ok = t.goroutines.exit(span, nesting)
+		}
+		if !ok {
+			//panic("Depth is negative! Should never happen!")
+			//panic in function tracing does not make sense
+			// instead reset the depth, and log warning
+			warning := "Warning: depth became negative in tracey, when attempting to decrement.\n"
+			if t.admitOutput(len(warning)) {
+				t.note(warning)
+			}
+			t.audit.add(spanViolation(DepthMismatch, span, "depth went negative on exit"))
+		}
+		now := options.Clock()
+		t.exitSegments(span, &ev, now)
+		t.exitHandoffs(span, &ev)
+		span.pause.Unlock()
+		ev.Kind = ExitEvent
+		ev.Seq = 0
+		if atomic.LoadUint32(&span.ended) >= endedAbandoned {
+			t.exitAbandoned(span, &ev)
+		}
+		ev.config = t.config.Load()
+		ev.Duration = now.Sub(ev.Time) + span.carried
+		if span.bridged {
+			ev.Duration = span.reported
+		}
+		if ev.Injected > 0 {
+			ev.Duration -= ev.Injected
+			if ev.Duration < 0 {
+				ev.Duration = 0
+			}
+		}
+		t.floorDuration(&ev)
+		ev.Time = now
+		t.exitAudit(span, &ev)
+		ev.Depth = depth
+		ev.Callers = nil
+		ev.InFlight = 0
+		if span.ctx != nil {
+			t.exitContext(span, &ev)
+		}
+		if t.blocking != nil {
+			t.exitBlocking(span, &ev)
+		}
+		if t.runtime != nil {
+			t.exitRuntime(span, &ev)
+		}
+		if t.cpuTime {
+			t.exitCPUTime(span, &ev)
+		}
+		if ev.Progress = span.lastProgress(); ev.Progress != nil && options.ProgressInterval > 0 {
+			t.scanner.removeProgress(span)
+		}
+		if span.suppressor == span {
+			ev.HiddenCalls = atomic.LoadUint64(&span.hidden)
+		}
+		if options.TrackOutputVolume {
+			t.exitOutputVolume(span, &ev)
+		}
+		if span.attached != nil {
+			ev.Attached = span.attached.list()
+		}
+		if options.AttributeMetricsToSpans {
+			t.exitMetrics(span, &ev)
+		}
+		vetoed := len(options.Middleware) > 0 && t.exitMiddleware(span, &ev)
+		t.exitStats(span, &ev)
+		if atomic.LoadUint32(&t.alerts.counting) != 0 {
+			t.alertExit(span, &ev)
+		}
+		if span.pinRoot {
+			atomic.AddInt64(&t.pins.active, -1)
+		}
+		if ev.bundle != nil && t.exitBundle(span, &ev) {
+			defer t.endBundle(&ev)
+		}
+		if ev.tail != nil && t.exitTail(span, &ev) {
+			// Once the top-level exit is buffered, whatever happens to it
+			defer t.endTail(&ev)
+		}
+		if ev.Err != nil && options.MaxMessageLen > 0 {
+			ev.Err = truncateError(ev.Err, options.MaxMessageLen)
+		}
+		if vetoed || (span.muted && span.tree == nil) {
+			return
+		}
+		if len(ev.Tags) > 0 {
+			ev.tagValues = t.renderTags(ev.Tags)
+		}
+		if span.tree != nil {
+			t.escalateExit(span, &ev)
+			if span.muted {
+				return
+			}
+		}
+		if t.shedding(span) {
+			return
+		}
+		if t.changes != nil {
+			t.compareCall(&ev)
+		}
+		t.emitTraced(&ev)
+		if t.csv != nil {
+			t.csv.write(&ev)
 		}
 	}
 
-	// Enter function, invoked on function entry
-	_enter := func(s ...interface{}) func() {
-		defer _incrementDepth()
-
-		fname := _getname(s...)
-		if options.EnableInstrumentation {
-			entryTime.Lock()
-			entryTime.t[fname] = time.Now()
-			entryTime.Unlock()
+	// Enter function, invoked on function entry. The span may be given a
+	// parent on another goroutine, and a name rather than being named
+	// after the calling function, or the callsite of a label (see
+	// `Label(...)`) to be named after.
+	_enter := func(parent *Span, name string, site *callsite, s ...interface{}) *Span {
+		gid := getGID()
+		if t.goroutines.reentered(gid) || t.rejects(gid, parent) {
+			return noopSpan
+		}
+		if a := t.adopter.Load(); a != nil {
+			return a.start(parent, name, site, s...)
+		}
+		var began time.Time
+		var overflows uint64
+		if options.MaxTraceLatency > 0 {
+			began, overflows = t.overloadStart()
+		}
+		fields, s := splitFields(s)
+		level, s := splitLevel(s)
+		structTags, s := splitStructTags(s)
+		budget, s := splitBudget(s)
+		operation, s := splitOperation(s)
+		if name == "" && site == nil {
+			site = t.callerSite()
+		}
+		if name != "" {
+			operation = t.operationOf(operation, name)
+		} else {
+			operation = t.operationOf(operation, site.name)
+		}
+		overrides := t.overridesFor(gid, parent)
+		config := t.config.Load()
+		forced := false
+		if config.functions != nil {
+			overrides, forced = t.overrideFunction(config, site, name, overrides)
+		}
+		pinned, pinRoot := t.pinnedEnter(gid, parent)
+		if pinned {
+			overrides, forced = pinnedOverrides.over(overrides), true
+		}
+		minLevel := config.MinLevel
+		if overrides != nil && overrides.MinLevel != nil {
+			minLevel = *overrides.MinLevel
+		}
+		excluded := t.filters != nil && !forced && t.excludedByRules(config, site, name, operation)
+		span := &Span{t: t, muted: level < minLevel || excluded, belowLevel: level < minLevel && !excluded, forced: forced, pinRoot: pinRoot}
+		ev := &span.ev
+		*ev = Event{Kind: EnterEvent, Time: options.Clock(), TID: gid, Level: level, Tags: structTags, Operation: operation, Pinned: pinned, overrides: overrides, config: config}
+		if name != "" {
+			ev.Name, ev.Message = name, name
+			ev.text = lineText(gid, name)
+		} else {
+			ev.Name = site.name
+			if t.sources != nil {
+				ev.signature = site.sourceSignature()
+			}
+			if config.suppress != nil && !forced && (!span.muted || options.EscalateOnError) {
+				// Spans are muted within a suppressed subtree
+				if within := t.enclosing(gid, parent); within != nil && within.suppressor != nil {
+					span.muted, span.belowLevel = true, false
+				}
+			}
+			// Spans below "MinLevel" may be replayed, the fields of others
+			// are neither boxed into tags nor rendered
+			if fields != nil {
+				ev.Message = ev.Name
+				if !span.muted || (options.EscalateOnError && span.belowLevel) {
+					ev.Tags, ev.fields = append(fields.tags(), structTags...), len(fields)
+					ev.text = fields.text(t, gid, ev.Name)
+				}
+			} else if !span.muted || (options.EscalateOnError && span.belowLevel) {
+				ev.Message, ev.text = _getmessage(gid, ev.Name, s...)
+			}
+		}
+		if site != nil {
+			ev.adopted = site.adoption
+		}
+		ev.SpanID = options.IDGenerator.NewSpanID()
+		if parent != nil && parent.restored != nil {
+			t.enterRestored(span, parent.restored)
+		}
+		if len(options.Middleware) > 0 && t.enterMiddleware(span) {
+			// The callsite's decisions are for another name
+			site = nil
+		}
+		if options.Router != nil {
+			t.enterRoute(span, gid, parent)
+		}
+		if budget > 0 || t.budgets != nil || atomic.LoadUint32(&t.budgeted) != 0 {
+			t.enterBudget(span, gid, parent, budget)
+		}
+		if options.CompressLinearChains && nesting {
+			t.enterChain(span, gid, parent)
+		}
+		if t.injections != nil {
+			t.enterInjection(span)
+		}
+		var suppresses bool
+		ev.template, suppresses = t.matchName(config, site, ev.Name)
+		if options.EscalateOnError {
+			t.joinTree(span, parent)
+		}
+		if options.TailSampling || options.PercentOfRoot {
+			t.joinTail(span, parent)
+		}
+		if options.BundleOnError.Dir != "" {
+			t.joinBundle(span, parent)
+		}
+		t.goroutines.enter(span, parent, nesting, suppresses, options.IDGenerator)
+		if atomic.LoadUint32(&t.alerts.counting) != 0 {
+			t.alertEnter(span)
+		}
+		if (options.WarnAfter > 0 && !span.muted) || options.GoroutineStateTTL > 0 || t.abandonAfter != nil {
+			t.scanner.start(t)
+		}
+		maxCallers, allDepths := options.CaptureCallers, options.CaptureCallersAll
+		if overrides != nil && overrides.CaptureCallers != nil {
+			maxCallers, allDepths = *overrides.CaptureCallers, true
+		}
+		if maxCallers > 0 && (allDepths || ev.Depth == 0) {
+			ev.Callers = captureCallers(maxCallers, options.NameFormatter)
+		}
+		var inFlight int64
+		span.gauge, inFlight = t.enterGauge(ev.Name)
+		if options.ShowConcurrency {
+			ev.InFlight = inFlight
+		}
+		if !span.muted && !t.shedding(span) {
+			ev.emitter = gid
+			t.emitTraced(ev)
+			ev.emitter = 0
+		}
+		if span.tree != nil {
+			t.retain(span, ev)
+		}
+		if t.blocking != nil {
+			t.enterBlocking(span)
+		}
+		if t.runtime != nil {
+			t.enterRuntime(span)
+		}
+		if t.cpuTime {
+			t.enterCPUTime(span)
+		}
+		if !began.IsZero() {
+			t.overloadEnd(span, began, overflows, false)
+		}
+		if ev.Injected > 0 {
+			options.Sleep(ev.Injected)
 		}
-		options.CustomLogger.Printf("%s%s%s\n", _spacify(), options.EnterMessage, fname)
 		//		return traceMessage
-		return _exit
+		return span
 	}
 
-	return _enter
+	t.start = _enter
+	t.end = _exit
+	return t
 }
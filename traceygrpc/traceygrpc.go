@@ -0,0 +1,190 @@
+// Package traceygrpc provides gRPC interceptors which log every call as a
+// tracey span, on the client as well as on the server.
+//
+//	t := tracey.NewTracer(&tracey.Options{EnableInstrumentation: true})
+//	server := grpc.NewServer(
+//		grpc.UnaryInterceptor(traceygrpc.UnaryServerInterceptor(t)),
+//		grpc.StreamInterceptor(traceygrpc.StreamServerInterceptor(t)),
+//	)
+//
+// Spans are named after the full method (as in "/pkg.Service/Method"),
+// which is also their message, and are tagged on exit with the status
+// code of the call. Calls which do not end with codes.OK are marked as
+// failed with their error. Streams are also tagged with the number of
+// messages sent and received. Clients send the trace context along in the
+// "traceparent" and "tracestate" metadata, the same keys as the HTTP
+// headers of `Span.InjectTraceParent(...)`, so that the spans of servers
+// are part of their callers' traces.
+package traceygrpc
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sujitvp/go-tracey"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Adds the trace context of the span to the metadata of an outgoing call,
+// the span being the parent of those the call starts on the server
+func inject(ctx context.Context, span *tracey.Span) context.Context {
+	p := span.TraceParent()
+	if p.TraceID == "" {
+		return ctx
+	}
+	kv := []string{tracey.TraceParentHeader, p.Header()}
+	if p.State != "" {
+		kv = append(kv, tracey.TraceStateHeader, p.State)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// Returns the trace context of an incoming call, which is zero if it has
+// none
+func extract(ctx context.Context) tracey.TraceParent {
+	md, _ := metadata.FromIncomingContext(ctx)
+	traceparent := md.Get(tracey.TraceParentHeader)
+	if len(traceparent) == 0 {
+		return tracey.TraceParent{}
+	}
+	p, _ := tracey.ParseTraceParent(traceparent[0], strings.Join(md.Get(tracey.TraceStateHeader), ","))
+	return p
+}
+
+// Tags the span with the outcome of the call, and ends it
+func finish(span *tracey.Span, err error) {
+	code := status.Code(err)
+	span.Tag("code", code)
+	if code != codes.OK {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// UnaryServerInterceptor returns an interceptor tracing unary calls served
+// by the server.
+func UnaryServerInterceptor(t *tracey.Tracer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		span := t.StartRemoteNamed(extract(ctx), info.FullMethod, "%s", info.FullMethod)
+		resp, err := handler(ctx, req)
+		finish(span, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor returns an interceptor tracing streams served by
+// the server.
+func StreamServerInterceptor(t *tracey.Tracer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		span := t.StartRemoteNamed(extract(ss.Context()), info.FullMethod, "%s", info.FullMethod)
+		stream := &serverStream{ServerStream: ss}
+		err := handler(srv, stream)
+		stream.tag(span)
+		finish(span, err)
+		return err
+	}
+}
+
+// UnaryClientInterceptor returns an interceptor tracing unary calls made by
+// the client.
+func UnaryClientInterceptor(t *tracey.Tracer) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		span := t.StartNamed(method, "%s", method)
+		err := invoker(inject(ctx, span), method, req, reply, cc, opts...)
+		finish(span, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor returns an interceptor tracing streams opened by
+// the client. Their spans stay open until the stream is over, that is
+// until receiving from it fails (io.EOF included) or, for streams on which
+// the server only sends a single message, until that message is received.
+func StreamClientInterceptor(t *tracey.Tracer) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		span := t.StartNamed(method, "%s", method)
+		cs, err := streamer(inject(ctx, span), desc, cc, method, opts...)
+		if err != nil {
+			finish(span, err)
+			return nil, err
+		}
+		return &clientStream{ClientStream: cs, span: span, single: !desc.ServerStreams}, nil
+	}
+}
+
+// Counts the messages going through a stream
+type counters struct {
+	sent, received uint64
+}
+
+func (c *counters) tag(span *tracey.Span) {
+	span.Tag("sent", atomic.LoadUint64(&c.sent))
+	span.Tag("received", atomic.LoadUint64(&c.received))
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	counters
+}
+
+func (s *serverStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		atomic.AddUint64(&s.sent, 1)
+	}
+	return err
+}
+
+func (s *serverStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		atomic.AddUint64(&s.received, 1)
+	}
+	return err
+}
+
+type clientStream struct {
+	grpc.ClientStream
+	counters
+	span   *tracey.Span
+	single bool
+	once   sync.Once
+}
+
+func (s *clientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		atomic.AddUint64(&s.sent, 1)
+	}
+	return err
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == io.EOF:
+		s.end(nil)
+	case err != nil:
+		s.end(err)
+	default:
+		atomic.AddUint64(&s.received, 1)
+		if s.single {
+			s.end(nil)
+		}
+	}
+	return err
+}
+
+// Ends the span, only the first call has any effect
+func (s *clientStream) end(err error) {
+	s.once.Do(func() {
+		s.tag(s.span)
+		finish(s.span, err)
+	})
+}
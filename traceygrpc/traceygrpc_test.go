@@ -0,0 +1,221 @@
+package traceygrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sujitvp/go-tracey"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var RE_tid = regexp.MustCompile(`\[tid:\d+\]=>`)
+
+// A buffer safe for concurrent use, since server spans end on the
+// server's goroutines
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines() []string {
+	b.Lock()
+	defer b.Unlock()
+	return strings.Split(strings.TrimSuffix(RE_tid.ReplaceAllString(b.buf.String(), ""), "\n"), "\n")
+}
+
+func newTestTracer(showIDs bool) (*tracey.Tracer, *syncBuffer) {
+	buf := &syncBuffer{}
+	return tracey.NewTracer(&tracey.Options{CustomLogger: log.New(buf, "", 0), DisableDepthValue: true, ShowIDs: showIDs}), buf
+}
+
+// Serves the health service over a bufconn, with both ends traced, and
+// returns a client for it along with the server's health state
+func startHealth(test *testing.T, showIDs bool) (healthpb.HealthClient, *health.Server, *syncBuffer, *syncBuffer) {
+	serverTracer, serverBuf := newTestTracer(showIDs)
+	clientTracer, clientBuf := newTestTracer(showIDs)
+	client, hs := serveHealth(test, serverTracer, clientTracer)
+	return client, hs, serverBuf, clientBuf
+}
+
+// Serves the health service over a bufconn, traced by "serverTracer" and
+// called through "clientTracer"
+func serveHealth(test *testing.T, serverTracer, clientTracer *tracey.Tracer) (healthpb.HealthClient, *health.Server) {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(serverTracer)),
+		grpc.StreamInterceptor(StreamServerInterceptor(serverTracer)),
+	)
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(server, hs)
+	go server.Serve(lis)
+	test.Cleanup(server.Stop)
+
+	cc, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor(clientTracer)),
+		grpc.WithStreamInterceptor(StreamClientInterceptor(clientTracer)),
+	)
+	assert.Nil(test, err)
+	test.Cleanup(func() { cc.Close() })
+	return healthpb.NewHealthClient(cc), hs
+}
+
+func TestUnary(test *testing.T) {
+	client, hs, serverBuf, clientBuf := startHealth(test, false)
+	hs.SetServingStatus("up", healthpb.HealthCheckResponse_SERVING)
+
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "up"})
+	assert.Nil(test, err)
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "down"})
+	assert.Equal(test, codes.NotFound, status.Code(err))
+
+	expected := []string{
+		"ENTER: /grpc.health.v1.Health/Check",
+		"EXIT:  /grpc.health.v1.Health/Check {code=OK}",
+		"ENTER: /grpc.health.v1.Health/Check",
+		"EXIT:  /grpc.health.v1.Health/Check {code=NotFound} (error: rpc error: code = NotFound desc = unknown service)",
+	}
+	assert.Equal(test, expected, clientBuf.lines())
+	assert.Equal(test, expected, serverBuf.lines())
+}
+
+func TestServerStream(test *testing.T) {
+	client, hs, serverBuf, clientBuf := startHealth(test, false)
+	hs.SetServingStatus("up", healthpb.HealthCheckResponse_SERVING)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "up"})
+	assert.Nil(test, err)
+	resp, err := stream.Recv()
+	assert.Nil(test, err)
+	assert.Equal(test, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	// The span stays open until the stream is over
+	assert.Equal(test, []string{"ENTER: /grpc.health.v1.Health/Watch"}, clientBuf.lines())
+	cancel()
+	_, err = stream.Recv()
+	assert.Equal(test, codes.Canceled, status.Code(err))
+
+	assert.Equal(test, []string{
+		"ENTER: /grpc.health.v1.Health/Watch",
+		"EXIT:  /grpc.health.v1.Health/Watch {sent=1 received=1 code=Canceled} (error: rpc error: code = Canceled desc = context canceled)",
+	}, clientBuf.lines())
+
+	// The server finds out about the cancellation on its own time
+	assert.Eventually(test, func() bool { return len(serverBuf.lines()) == 2 }, time.Second, time.Millisecond)
+	lines := serverBuf.lines()
+	assert.Equal(test, "ENTER: /grpc.health.v1.Health/Watch", lines[0])
+	assert.True(test, strings.HasPrefix(lines[1], "EXIT:  /grpc.health.v1.Health/Watch {sent=1 received=1 code=Canceled} (error: "), lines[1])
+}
+
+var RE_ids = regexp.MustCompile(`\[trace=(\w+) span=\w+\]`)
+
+func TestTraceContextPropagation(test *testing.T) {
+	client, hs, serverBuf, clientBuf := startHealth(test, true)
+	hs.SetServingStatus("up", healthpb.HealthCheckResponse_SERVING)
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "up"})
+		assert.Nil(test, err)
+	}
+
+	// The client's counted trace ids, as sent in W3C hex
+	clientLines, serverLines := clientBuf.lines(), serverBuf.lines()
+	assert.Equal(test, 4, len(serverLines))
+	for i, line := range serverLines {
+		assert.True(test, strings.HasPrefix(line, "ENTER: /grpc.health.v1.Health/Check") || strings.HasPrefix(line, "EXIT:  /grpc.health.v1.Health/Check"), line)
+		sent := RE_ids.FindStringSubmatch(clientLines[i])[1]
+		assert.Equal(test, strings.Repeat("0", 32-len(sent))+sent, RE_ids.FindStringSubmatch(line)[1])
+	}
+	assert.NotEqual(test, RE_ids.FindStringSubmatch(serverLines[0])[1], RE_ids.FindStringSubmatch(serverLines[2])[1])
+
+	// The spans of the server are children of those of the client, whose
+	// W3C hex ids go along as they are
+	serverJS, clientJS := &syncBuffer{}, &syncBuffer{}
+	jsonTracer := func(buf *syncBuffer) *tracey.Tracer {
+		return tracey.NewTracer(&tracey.Options{Sinks: []tracey.Sink{{Writer: buf, Format: tracey.JSONFormat}}, IDGenerator: tracey.RandomHexIDs{}})
+	}
+	client, hs = serveHealth(test, jsonTracer(serverJS), jsonTracer(clientJS))
+	hs.SetServingStatus("up", healthpb.HealthCheckResponse_SERVING)
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "up"})
+	assert.Nil(test, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "up"})
+	assert.Nil(test, err)
+	_, err = stream.Recv()
+	assert.Nil(test, err)
+	cancel()
+	stream.Recv()
+	assert.Eventually(test, func() bool { return len(exits(test, serverJS)) == 2 }, time.Second, time.Millisecond)
+
+	sent, served := exits(test, clientJS), exits(test, serverJS)
+	for _, method := range []string{"/grpc.health.v1.Health/Check", "/grpc.health.v1.Health/Watch"} {
+		assert.Equal(test, sent[method].TraceID, served[method].TraceID, method)
+		assert.Equal(test, sent[method].SpanID, served[method].ParentID, method)
+		assert.NotEmpty(test, served[method].ParentID, method)
+	}
+}
+
+// Returns the exits logged as JSON to the buffer, by name
+func exits(test *testing.T, buf *syncBuffer) map[string]tracey.Event {
+	buf.Lock()
+	defer buf.Unlock()
+	byName := map[string]tracey.Event{}
+	decoder := json.NewDecoder(bytes.NewReader(buf.buf.Bytes()))
+	for decoder.More() {
+		var ev struct {
+			Kind   string `json:"kind"`
+			Name   string `json:"name"`
+			Trace  string `json:"trace"`
+			Span   string `json:"span"`
+			Parent string `json:"parent"`
+		}
+		assert.Nil(test, decoder.Decode(&ev))
+		if ev.Kind == "exit" {
+			byName[ev.Name] = tracey.Event{Name: ev.Name, TraceID: ev.Trace, SpanID: ev.Span, ParentID: ev.Parent}
+		}
+	}
+	return byName
+}
+
+func TestSpansNamedAfterMethod(test *testing.T) {
+	t, _ := newTestTracer(false)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	UnaryServerInterceptor(t)(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Service/Get"}, handler)
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		// The trace context goes along with the call
+		md, _ := metadata.FromOutgoingContext(ctx)
+		assert.Equal(test, 1, len(md.Get(tracey.TraceParentHeader)))
+		return nil
+	}
+	UnaryClientInterceptor(t)(context.Background(), "/pkg.Service/Put", nil, nil, nil, invoker)
+
+	var names []string
+	for _, s := range t.Stats() {
+		names = append(names, s.Name)
+	}
+	assert.ElementsMatch(test, []string{"/pkg.Service/Get", "/pkg.Service/Put"}, names)
+}
@@ -0,0 +1,218 @@
+package traceysql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+)
+
+// A connection which traces everything done through it. Optional driver
+// interfaces not implemented by the wrapped connection fall back the same
+// way database/sql itself would fall back.
+type conn struct {
+	driver.Conn
+	t *tracer
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	defer c.t.span("sql.Prepare", query)()
+	var s driver.Stmt
+	var err error
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		s, err = pc.PrepareContext(ctx, query)
+	} else {
+		s, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wrapStmt(s, query, c.t), nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	defer c.t.span("sql.Begin", "")()
+	var tx driver.Tx
+	var err error
+	if bc, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = bc.BeginTx(ctx, opts)
+	} else {
+		// Same restrictions database/sql applies to drivers without BeginTx
+		if opts.Isolation != 0 {
+			return nil, errors.New("sql: driver does not support non-default isolation level")
+		}
+		if opts.ReadOnly {
+			return nil, errors.New("sql: driver does not support read-only transactions")
+		}
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{tx, c.t}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	switch e := c.Conn.(type) {
+	case driver.ExecerContext:
+		defer c.t.span("sql.Exec", query)()
+		return e.ExecContext(ctx, query, args)
+	case driver.Execer:
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		defer c.t.span("sql.Exec", query)()
+		return e.Exec(query, values)
+	}
+	// database/sql will prepare the statement instead, which is traced
+	return nil, driver.ErrSkip
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	switch q := c.Conn.(type) {
+	case driver.QueryerContext:
+		defer c.t.span("sql.Query", query)()
+		return q.QueryContext(ctx, query, args)
+	case driver.Queryer:
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		defer c.t.span("sql.Query", query)()
+		return q.Query(query, values)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		defer c.t.span("sql.Ping", "")()
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *conn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// A prepared statement, which remembers its query so it can be logged
+// with each execution
+type stmt struct {
+	driver.Stmt
+	query string
+	t     *tracer
+}
+
+// The same, for statements which implement driver.ColumnConverter, which
+// unlike driver.NamedValueChecker has no way of deferring to the default
+type columnConverterStmt struct {
+	*stmt
+	cc driver.ColumnConverter
+}
+
+func (s *columnConverterStmt) ColumnConverter(idx int) driver.ValueConverter {
+	return s.cc.ColumnConverter(idx)
+}
+
+func wrapStmt(s driver.Stmt, query string, t *tracer) driver.Stmt {
+	ts := &stmt{s, query, t}
+	if cc, ok := s.(driver.ColumnConverter); ok {
+		return &columnConverterStmt{ts, cc}
+	}
+	return ts
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	defer s.t.span("sql.Exec", s.query)()
+	return s.Stmt.Exec(args)
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	defer s.t.span("sql.Query", s.query)()
+	return s.Stmt.Query(args)
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if ec, ok := s.Stmt.(driver.StmtExecContext); ok {
+		defer s.t.span("sql.Exec", s.query)()
+		return ec.ExecContext(ctx, args)
+	}
+	values, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Exec(values)
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if qc, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		defer s.t.span("sql.Query", s.query)()
+		return qc.QueryContext(ctx, args)
+	}
+	values, err := namedValuesToValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Query(values)
+}
+
+func (s *stmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type transaction struct {
+	driver.Tx
+	t *tracer
+}
+
+func (tx *transaction) Commit() error {
+	defer tx.t.span("sql.Commit", "")()
+	return tx.Tx.Commit()
+}
+
+func (tx *transaction) Rollback() error {
+	defer tx.t.span("sql.Rollback", "")()
+	return tx.Tx.Rollback()
+}
+
+// Converts arguments for drivers which only implement the non-context
+// interfaces, and so cannot take named arguments
+func namedValuesToValues(named []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[i] = nv.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,150 @@
+// Package traceysql wraps a database/sql driver so that every query,
+// statement and transaction it runs is logged as a tracey span.
+//
+//	t := tracey.NewTracer(&tracey.Options{EnableInstrumentation: true})
+//	sql.Register("traced-postgres", traceysql.Wrap(&pq.Driver{}, t, nil))
+//	db, err := sql.Open("traced-postgres", dsn)
+//
+// Spans are named after the operation ("sql.Query", "sql.Exec",
+// "sql.Prepare", "sql.Begin", "sql.Commit", "sql.Rollback"...) and carry
+// the redacted statement text as their message (see `Tracer.Label(...)`).
+// Since they are emitted on the goroutine calling into database/sql, they
+// nest under whatever span is open there.
+package traceysql
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+
+	"github.com/sujitvp/go-tracey"
+)
+
+// These options control how statements are rendered into span messages.
+// Passing nil to `Wrap(...)` uses the defaults.
+type Options struct {
+
+	// Setting "MaxStatementLen" caps the length of the statement text
+	// logged with each span, longer statements are cut with
+	// `tracey.TruncateMessage(...)`, ending in a marker of how much was.
+	// The default value is 200, a negative value disables the cap.
+	MaxStatementLen int `default:"200"`
+
+	// Setting "Redact" overrides how statements are scrubbed before being
+	// logged. The default replaces quoted strings and numeric literals with
+	// "?", arguments passed separately are never logged.
+	Redact func(string) string
+}
+
+// Define the regexes used by the default redaction
+var (
+	RE_quotedLiteral  = regexp.MustCompile(`'(?:[^']|'')*'`)
+	RE_numericLiteral = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+)
+
+// RedactStatement is the default "Redact" function, it replaces string and
+// numeric literals in the statement with "?".
+func RedactStatement(stmt string) string {
+	stmt = RE_quotedLiteral.ReplaceAllString(stmt, "?")
+	return RE_numericLiteral.ReplaceAllString(stmt, "?")
+}
+
+// Wrap returns a driver which traces everything done through the
+// connections it opens with "tracer". If the wrapped driver implements
+// driver.DriverContext, so does the returned one.
+func Wrap(d driver.Driver, tracer *tracey.Tracer, opts *Options) driver.Driver {
+	t := newTracer(tracer.Label, opts)
+	if dc, ok := d.(driver.DriverContext); ok {
+		return &contextDriver{tracedDriver{d, t}, dc}
+	}
+	return &tracedDriver{d, t}
+}
+
+// WrapConnector is the driver.Connector counterpart of `Wrap(...)`, for
+// use with `sql.OpenDB(...)`.
+func WrapConnector(c driver.Connector, tracer *tracey.Tracer, opts *Options) driver.Connector {
+	return &connector{c, newTracer(tracer.Label, opts)}
+}
+
+// The operations spans are named after
+var operations = []string{"sql.Prepare", "sql.Begin", "sql.Exec", "sql.Query", "sql.Ping", "sql.Commit", "sql.Rollback"}
+
+// Holds the enter function of each operation along with the resolved
+// options
+type tracer struct {
+	enter  map[string]tracey.TraceFunc
+	maxLen int
+	redact func(string) string
+}
+
+func newTracer(label func(string) tracey.TraceFunc, opts *Options) *tracer {
+	t := &tracer{enter: make(map[string]tracey.TraceFunc, len(operations)), maxLen: 200, redact: RedactStatement}
+	for _, op := range operations {
+		t.enter[op] = label(op)
+	}
+	if opts != nil {
+		if opts.MaxStatementLen != 0 {
+			t.maxLen = opts.MaxStatementLen
+		}
+		if opts.Redact != nil {
+			t.redact = opts.Redact
+		}
+	}
+	return t
+}
+
+// Opens a span named "op", with the statement (if any) as its message
+func (t *tracer) span(op, stmt string) func() {
+	enter := t.enter[op]
+	if stmt == "" {
+		return enter("%s", op)
+	}
+	stmt = t.redact(stmt)
+	if t.maxLen > 0 {
+		stmt = tracey.TruncateMessage(stmt, t.maxLen)
+	}
+	return enter("%s: %s", op, stmt)
+}
+
+type tracedDriver struct {
+	driver.Driver
+	t *tracer
+}
+
+func (d *tracedDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{c, d.t}, nil
+}
+
+type contextDriver struct {
+	tracedDriver
+	dc driver.DriverContext
+}
+
+func (d *contextDriver) OpenConnector(name string) (driver.Connector, error) {
+	c, err := d.dc.OpenConnector(name)
+	if err != nil {
+		return nil, err
+	}
+	return &connector{c, d.t}, nil
+}
+
+type connector struct {
+	driver.Connector
+	t *tracer
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	cn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{cn, c.t}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return &tracedDriver{c.Connector.Driver(), c.t}
+}
@@ -0,0 +1,253 @@
+package traceysql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sujitvp/go-tracey"
+)
+
+// A fake driver which records what it was asked to do. Exec of a
+// statement containing "FAIL" returns an error.
+type fakeDriver struct {
+	calls  []string
+	legacy bool
+}
+
+var errFake = errors.New("fake failure")
+
+func (d *fakeDriver) record(call string) { d.calls = append(d.calls, call) }
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	if d.legacy {
+		return &legacyConn{fakeBase{d}}, nil
+	}
+	return &fakeConn{fakeBase{d}}, nil
+}
+
+func (d *fakeDriver) Connect(ctx context.Context) (driver.Conn, error) { return d.Open("") }
+func (d *fakeDriver) Driver() driver.Driver                            { return d }
+
+// Implements only what every driver.Conn must implement
+type fakeBase struct{ d *fakeDriver }
+
+func (c *fakeBase) Prepare(query string) (driver.Stmt, error) {
+	c.d.record("prepare " + query)
+	return &fakeStmt{c.d, query}, nil
+}
+func (c *fakeBase) Close() error { return nil }
+func (c *fakeBase) Begin() (driver.Tx, error) {
+	c.d.record("begin")
+	return &fakeTx{c.d}, nil
+}
+func (c *fakeBase) exec(query string) (driver.Result, error) {
+	c.d.record("exec " + query)
+	if strings.Contains(query, "FAIL") {
+		return nil, errFake
+	}
+	return driver.RowsAffected(1), nil
+}
+func (c *fakeBase) query(query string) (driver.Rows, error) {
+	c.d.record("query " + query)
+	return &fakeRows{}, nil
+}
+
+// Implements the context interfaces only
+type fakeConn struct{ fakeBase }
+
+func (c *fakeConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Prepare(query)
+}
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Begin()
+}
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.exec(query)
+}
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.query(query)
+}
+
+// Implements the non-context interfaces only
+type legacyConn struct{ fakeBase }
+
+func (c *legacyConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return c.exec(query)
+}
+func (c *legacyConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return c.query(query)
+}
+
+var (
+	_ driver.ExecerContext = &fakeConn{}
+	_ driver.Execer        = &legacyConn{}
+)
+
+type fakeStmt struct {
+	d     *fakeDriver
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.record("stmt exec " + s.query)
+	return driver.RowsAffected(1), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.record("stmt query " + s.query)
+	return &fakeRows{}, nil
+}
+
+type converterStmt struct{ fakeStmt }
+
+func (s *converterStmt) ColumnConverter(idx int) driver.ValueConverter { return driver.NotNull{} }
+
+type fakeTx struct{ d *fakeDriver }
+
+func (tx *fakeTx) Commit() error   { tx.d.record("commit"); return nil }
+func (tx *fakeTx) Rollback() error { tx.d.record("rollback"); return nil }
+
+type fakeRows struct{}
+
+func (r *fakeRows) Columns() []string              { return []string{"id"} }
+func (r *fakeRows) Close() error                   { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error { return io.EOF }
+
+var RE_tid = regexp.MustCompile(`\[tid:\d+\]=>`)
+
+// Opens a database through the traced fake driver, and returns it along
+// with a function returning the trace lines logged so far
+func openTraced(fake *fakeDriver) (*sql.DB, *tracey.Tracer, func() []string) {
+	var buf bytes.Buffer
+	tracer := tracey.NewTracer(&tracey.Options{CustomLogger: log.New(&buf, "", 0), DisableDepthValue: true})
+	db := sql.OpenDB(WrapConnector(fake, tracer, nil))
+	db.SetMaxOpenConns(1)
+	return db, tracer, func() []string {
+		return strings.Split(strings.TrimSuffix(RE_tid.ReplaceAllString(buf.String(), ""), "\n"), "\n")
+	}
+}
+
+func TestQueryAndExec(test *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		fake := &fakeDriver{legacy: legacy}
+		db, tracer, lines := openTraced(fake)
+
+		_, err := db.Exec("INSERT INTO t VALUES ('secret', 42)")
+		assert.Nil(test, err)
+		rows, err := db.Query("SELECT id FROM t WHERE id > 7")
+		assert.Nil(test, err)
+		rows.Close()
+
+		assert.Equal(test, []string{
+			"ENTER: sql.Exec: INSERT INTO t VALUES (?, ?)",
+			"EXIT:  sql.Exec: INSERT INTO t VALUES (?, ?)",
+			"ENTER: sql.Query: SELECT id FROM t WHERE id > ?",
+			"EXIT:  sql.Query: SELECT id FROM t WHERE id > ?",
+		}, lines())
+		assert.Equal(test, []string{
+			"exec INSERT INTO t VALUES ('secret', 42)",
+			"query SELECT id FROM t WHERE id > 7",
+		}, fake.calls)
+
+		// Named after the operation, not the method of the wrapper
+		var names []string
+		for _, s := range tracer.Stats() {
+			names = append(names, s.Name)
+		}
+		assert.ElementsMatch(test, []string{"sql.Exec", "sql.Query"}, names)
+	}
+}
+
+func TestPreparedStatement(test *testing.T) {
+	fake := &fakeDriver{}
+	db, tracer, lines := openTraced(fake)
+
+	func() {
+		defer tracer.Enter("%s", "update")()
+		stmt, err := db.Prepare("UPDATE t SET x = ?")
+		assert.Nil(test, err)
+		_, err = stmt.Exec(1)
+		assert.Nil(test, err)
+		stmt.Close()
+	}()
+
+	assert.Equal(test, []string{
+		"ENTER: update",
+		"  ENTER: sql.Prepare: UPDATE t SET x = ?",
+		"  EXIT:  sql.Prepare: UPDATE t SET x = ?",
+		"  ENTER: sql.Exec: UPDATE t SET x = ?",
+		"  EXIT:  sql.Exec: UPDATE t SET x = ?",
+		"EXIT:  update",
+	}, lines())
+	assert.Equal(test, []string{"prepare UPDATE t SET x = ?", "stmt exec UPDATE t SET x = ?"}, fake.calls)
+}
+
+func TestTransactionRollbackOnError(test *testing.T) {
+	fake := &fakeDriver{}
+	db, _, lines := openTraced(fake)
+
+	tx, err := db.Begin()
+	assert.Nil(test, err)
+	_, err = tx.Exec("DELETE FROM t WHERE FAIL")
+	assert.Equal(test, errFake, err)
+	assert.Nil(test, tx.Rollback())
+
+	tx, err = db.Begin()
+	assert.Nil(test, err)
+	assert.Nil(test, tx.Commit())
+
+	assert.Equal(test, []string{
+		"ENTER: sql.Begin",
+		"EXIT:  sql.Begin",
+		"ENTER: sql.Exec: DELETE FROM t WHERE FAIL",
+		"EXIT:  sql.Exec: DELETE FROM t WHERE FAIL",
+		"ENTER: sql.Rollback",
+		"EXIT:  sql.Rollback",
+		"ENTER: sql.Begin",
+		"EXIT:  sql.Begin",
+		"ENTER: sql.Commit",
+		"EXIT:  sql.Commit",
+	}, lines())
+	assert.Equal(test, []string{"begin", "exec DELETE FROM t WHERE FAIL", "rollback", "begin", "commit"}, fake.calls)
+}
+
+func TestStatementLengthCap(test *testing.T) {
+	var messages []string
+	label := func(string) tracey.TraceFunc {
+		return func(s ...interface{}) func() {
+			messages = append(messages, s[len(s)-1].(string))
+			return func() {}
+		}
+	}
+	c := &conn{&fakeConn{fakeBase{&fakeDriver{}}}, newTracer(label, &Options{MaxStatementLen: 30})}
+	c.ExecContext(context.Background(), "SELECT "+strings.Repeat("x", 40), nil)
+	// "é" straddles the cap, and is cut as a whole
+	c.ExecContext(context.Background(), "SELECT xxxé"+strings.Repeat("y", 36), nil)
+
+	c.t = newTracer(label, &Options{Redact: strings.ToUpper})
+	c.ExecContext(context.Background(), "select 'x'", nil)
+	assert.Equal(test, []string{"SELECT xxxx…(+36B truncated)", "SELECT xxx…(+38B truncated)", "SELECT 'X'"}, messages)
+}
+
+func TestColumnConverterPassThrough(test *testing.T) {
+	t := newTracer(tracey.NewTracer(&tracey.Options{DisableTracing: true}).Label, nil)
+
+	_, ok := wrapStmt(&fakeStmt{}, "", t).(driver.ColumnConverter)
+	assert.False(test, ok)
+	_, ok = wrapStmt(&converterStmt{}, "", t).(driver.ColumnConverter)
+	assert.True(test, ok)
+
+	// Without a NamedValueChecker underneath, database/sql is told to use
+	// its default conversion
+	assert.Equal(test, driver.ErrSkip, wrapStmt(&fakeStmt{}, "", t).(driver.NamedValueChecker).CheckNamedValue(&driver.NamedValue{}))
+}
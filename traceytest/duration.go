@@ -0,0 +1,99 @@
+package traceytest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sujitvp/go-tracey"
+)
+
+// A DurationExpectation is what `AssertDuration(...)` expects of the
+// calls to a function. Limits left at 0 are not checked.
+type DurationExpectation struct {
+	// The most the average call, the 95th percentile of calls, and any
+	// single call may take
+	MaxMean   time.Duration
+	MaxP95    time.Duration
+	MaxSingle time.Duration
+
+	// The least number of calls there must be, so that an expectation is
+	// not met just because the function was (almost) never called
+	MinCalls uint64
+}
+
+// AssertDuration fails the test if, once it is over, the calls made since
+// AssertDuration was called to any function whose name matches
+// "fnPattern" (a regex) did not meet the expectation.
+//
+//	func TestSearch(t *testing.T) {
+//		traceytest.AssertDuration(t, tracer, `\.search$`, traceytest.DurationExpectation{
+//			MaxP95:   10 * time.Millisecond,
+//			MinCalls: 100,
+//		})
+//		...
+//	}
+//
+// The failure reports the observed values next to the expected ones, as
+// well as the slowest call's message and tags.
+func AssertDuration(t testing.TB, tracer *tracey.Tracer, fnPattern string, opts DurationExpectation) {
+	t.Helper()
+	pattern, err := regexp.Compile(fnPattern)
+	if err != nil {
+		t.Errorf("traceytest: bad function pattern: %v", err)
+		return
+	}
+	mark := tracer.Mark()
+	t.Cleanup(func() {
+		var matched []tracey.FuncStats
+		for _, s := range tracer.StatsSince(mark) {
+			if pattern.MatchString(s.Name) {
+				matched = append(matched, s)
+			}
+		}
+		if len(matched) == 0 && opts.MinCalls > 0 {
+			t.Errorf("traceytest: no calls to functions matching %q, expected at least %d", fnPattern, opts.MinCalls)
+		}
+		for _, s := range matched {
+			if report := checkDuration(s, opts); report != "" {
+				t.Errorf("%s", report)
+			}
+		}
+	})
+}
+
+// Describes how the calls to a function did not meet the expectation, or
+// returns "" if they did
+func checkDuration(s tracey.FuncStats, opts DurationExpectation) string {
+	var failed []string
+	if s.Calls < opts.MinCalls {
+		failed = append(failed, fmt.Sprintf("%d calls, expected at least %d", s.Calls, opts.MinCalls))
+	}
+	check := func(what string, observed, max time.Duration) {
+		if max > 0 && observed > max {
+			failed = append(failed, fmt.Sprintf("%s %s, expected at most %s", what, observed, max))
+		}
+	}
+	check("mean", s.Mean(), opts.MaxMean)
+	check("p95", s.Percentile(95), opts.MaxP95)
+	check("slowest call", s.Max, opts.MaxSingle)
+	if len(failed) == 0 {
+		return ""
+	}
+
+	slowest := s.MaxMessage
+	if slowest == "" {
+		slowest = s.Name
+	}
+	if len(s.MaxTags) > 0 {
+		tags := make([]string, len(s.MaxTags))
+		for i, tag := range s.MaxTags {
+			tags[i] = fmt.Sprintf("%s=%v", tag.Key, tag.Value)
+		}
+		slowest += " {" + strings.Join(tags, " ") + "}"
+	}
+	return fmt.Sprintf("traceytest: %s did not meet its expected duration over %d calls:\n\t%s\n\tslowest call (%s): %s",
+		s.Name, s.Calls, strings.Join(failed, "\n\t"), s.Max, slowest)
+}
@@ -0,0 +1,98 @@
+package traceytest
+
+import (
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sujitvp/go-tracey"
+)
+
+// A clock which only moves when told to
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) read() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func newClockedTracer() (*tracey.Tracer, *manualClock) {
+	clock := &manualClock{now: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+	return tracey.NewTracer(&tracey.Options{CustomLogger: log.New(io.Discard, "", 0), Clock: clock.read}), clock
+}
+
+// Part of "TestAssertDuration*", a call which takes "d" on the clock
+func search(tracer *tracey.Tracer, clock *manualClock, d time.Duration) {
+	span := tracer.Start("search for %v", d)
+	span.Tag("shard", 3)
+	clock.advance(d)
+	span.End()
+}
+
+func TestAssertDurationPasses(test *testing.T) {
+	tracer, clock := newClockedTracer()
+
+	// Calls before the assertion do not count
+	search(tracer, clock, time.Second)
+
+	r := &recorder{TB: test}
+	AssertDuration(r, tracer, `\.search$`, DurationExpectation{
+		MaxMean:   2 * time.Millisecond,
+		MaxP95:    3 * time.Millisecond,
+		MaxSingle: 3 * time.Millisecond,
+		MinCalls:  10,
+	})
+	for i := 0; i < 10; i++ {
+		search(tracer, clock, time.Millisecond)
+	}
+	r.finish()
+	assert.Empty(test, r.errors)
+}
+
+func TestAssertDurationFails(test *testing.T) {
+	tracer, clock := newClockedTracer()
+	r := &recorder{TB: test}
+	AssertDuration(r, tracer, `\.search$`, DurationExpectation{
+		MaxMean:   2 * time.Millisecond,
+		MaxP95:    3 * time.Millisecond,
+		MaxSingle: 5 * time.Millisecond,
+	})
+	for i := 0; i < 19; i++ {
+		search(tracer, clock, time.Millisecond)
+	}
+	search(tracer, clock, 81*time.Millisecond)
+	r.finish()
+
+	assert.Equal(test, []string{"traceytest: traceytest.search did not meet its expected duration over 20 calls:\n" +
+		"\tmean 5ms, expected at most 2ms\n" +
+		"\tslowest call 81ms, expected at most 5ms\n" +
+		"\tslowest call (81ms): search for 81ms {shard=3}"}, r.errors)
+}
+
+func TestAssertDurationInsufficientCalls(test *testing.T) {
+	tracer, clock := newClockedTracer()
+	r := &recorder{TB: test}
+	AssertDuration(r, tracer, `\.search$`, DurationExpectation{MaxMean: time.Second, MinCalls: 5})
+	search(tracer, clock, time.Millisecond)
+	r.finish()
+	assert.Equal(test, 1, len(r.errors))
+	assert.Contains(test, r.errors[0], "1 calls, expected at least 5")
+
+	r = &recorder{TB: test}
+	AssertDuration(r, tracer, `\.nothing$`, DurationExpectation{MinCalls: 1})
+	r.finish()
+	assert.Equal(test, []string{`traceytest: no calls to functions matching "\\.nothing$", expected at least 1`}, r.errors)
+}
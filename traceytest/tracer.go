@@ -0,0 +1,81 @@
+package traceytest
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sujitvp/go-tracey"
+)
+
+// Routes trace lines to a test's log, until the test is over
+type testWriter struct {
+	t    testing.TB
+	mu   sync.Mutex
+	done bool
+}
+
+func (w *testWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.done {
+		w.t.Logf("%s", strings.TrimSuffix(string(p), "\n"))
+	}
+	return len(p), nil
+}
+
+func (w *testWriter) close() {
+	w.mu.Lock()
+	w.done = true
+	w.mu.Unlock()
+}
+
+// A clock which starts at a fixed time and moves forward 1µs every time it
+// is read, so that durations do not change from run to run
+func stepClock() func() time.Time {
+	var mu sync.Mutex
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	return func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Microsecond)
+		return now
+	}
+}
+
+// NewForTest returns a tracer which logs through `t.Logf(...)`, so that its
+// output is shown along with the test's, only on failure or with -v. The
+// given options (nil for the defaults) are otherwise used as-is, except:
+//
+//   - the test's log is added to the "Sinks", and replaces the default
+//     "CustomLogger" sink
+//   - unless a "Clock" is given, a clock which moves forward 1µs with
+//     every reading, so that durations are the same on every run
+//
+// Once the test is over the tracer is flushed and closed (stopping its
+// background goroutines, see `Tracer.Close()`), the test failing if the
+// audit of "StrictAudit" found anything, and anything traced after
+// that (by goroutines which outlived the test) is dropped. Every call
+// returns a tracer of its own, so parallel tests do not share any state.
+func NewForTest(t testing.TB, opts *tracey.Options) *tracey.Tracer {
+	var options tracey.Options
+	if opts != nil {
+		options = *opts
+	}
+	w := &testWriter{t: t}
+	options.Sinks = append(append([]tracey.Sink(nil), options.Sinks...), tracey.Sink{Writer: w})
+	if options.Clock == nil {
+		options.Clock = stepClock()
+	}
+
+	tracer := tracey.NewTracer(&options)
+	t.Cleanup(func() {
+		tracer.Flush()
+		if err := tracer.Close(); err != nil {
+			t.Error(err)
+		}
+		w.close()
+	})
+	return tracer
+}
@@ -0,0 +1,66 @@
+// Package traceytest provides test helpers built on what a tracer knows
+// about the spans open on each goroutine, and the calls it traced.
+package traceytest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sujitvp/go-tracey"
+)
+
+// How often NoLeaks checks whether leaked spans have closed
+const pollInterval = 10 * time.Millisecond
+
+// NoLeaks fails the test if, once it is over, goroutines which did not
+// have any span open on the tracer when NoLeaks was called still do. Such
+// goroutines get up to "grace" to close their spans before the test is
+// failed with a list of them.
+//
+//	func TestServer(t *testing.T) {
+//		traceytest.NoLeaks(t, tracer, time.Second)
+//		...
+//	}
+//
+// Only spans of the given tracer are considered, so that tests running
+// in parallel on their own tracers do not see each other's goroutines.
+func NoLeaks(t testing.TB, tracer *tracey.Tracer, grace time.Duration) {
+	t.Helper()
+	before := tracer.Snapshot()
+	t.Cleanup(func() {
+		deadline := time.Now().Add(grace)
+		leaked := leaks(before, tracer.Snapshot())
+		for len(leaked) > 0 && time.Now().Before(deadline) {
+			time.Sleep(pollInterval)
+			leaked = leaks(before, tracer.Snapshot())
+		}
+		if len(leaked) > 0 {
+			t.Errorf("%d goroutine(s) leaked with open spans:\n%s", len(leaked), strings.Join(leaked, "\n"))
+		}
+	})
+}
+
+// Describes the goroutines in "after" which are not in "before", one per
+// line and sorted by id
+func leaks(before, after map[uint64][]tracey.OpenSpan) []string {
+	var gids []uint64
+	for gid := range after {
+		if _, ok := before[gid]; !ok {
+			gids = append(gids, gid)
+		}
+	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+
+	leaked := make([]string, len(gids))
+	for i, gid := range gids {
+		var names []string
+		for _, span := range after[gid] {
+			names = append(names, span.Name)
+		}
+		leaked[i] = fmt.Sprintf("\tgoroutine %d: %s (open for %s)", gid, strings.Join(names, " → "), after[gid][0].Age.Round(time.Millisecond))
+	}
+	return leaked
+}
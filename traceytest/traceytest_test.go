@@ -0,0 +1,151 @@
+package traceytest
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sujitvp/go-tracey"
+)
+
+// A testing.TB which records failures instead of failing, and runs the
+// cleanups when told to
+type recorder struct {
+	testing.TB
+	cleanups []func()
+	errors   []string
+	logs     []string
+}
+
+func (r *recorder) Helper()          {}
+func (r *recorder) Cleanup(f func()) { r.cleanups = append(r.cleanups, f) }
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) finish() {
+	for i := len(r.cleanups) - 1; i >= 0; i-- {
+		r.cleanups[i]()
+	}
+}
+
+func newTracer() *tracey.Tracer {
+	return tracey.NewTracer(&tracey.Options{CustomLogger: log.New(io.Discard, "", 0)})
+}
+
+// Helper functions - part of "TestNoLeaks*"
+func leakyWorker(tracer *tracey.Tracer, stop chan struct{}) {
+	defer tracer.Enter()()
+	<-stop
+}
+
+func TestNoLeaksReportsLeakedGoroutine(test *testing.T) {
+	tracer := newTracer()
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// Spans open before the check started are not leaks
+	outer := tracer.Start()
+	defer outer.End()
+
+	r := &recorder{TB: test}
+	NoLeaks(r, tracer, 20*time.Millisecond)
+	go leakyWorker(tracer, stop)
+	assert.Eventually(test, func() bool { return len(tracer.Snapshot()) == 2 }, time.Second, time.Millisecond)
+	r.finish()
+
+	assert.Equal(test, 1, len(r.errors))
+	assert.Contains(test, r.errors[0], "1 goroutine(s) leaked with open spans:")
+	assert.Regexp(test, `goroutine \d+: traceytest.leakyWorker \(open for \d+ms\)`, r.errors[0])
+}
+
+func TestNoLeaksWaitsForGrace(test *testing.T) {
+	tracer := newTracer()
+	stop := make(chan struct{})
+
+	r := &recorder{TB: test}
+	NoLeaks(r, tracer, time.Second)
+	go leakyWorker(tracer, stop)
+	assert.Eventually(test, func() bool { return len(tracer.Snapshot()) == 1 }, time.Second, time.Millisecond)
+	time.AfterFunc(30*time.Millisecond, func() { close(stop) })
+	r.finish()
+
+	assert.Empty(test, r.errors)
+}
+
+func TestNoLeaksInParallel(test *testing.T) {
+	for i := 0; i < 4; i++ {
+		test.Run(fmt.Sprint(i), func(test *testing.T) {
+			test.Parallel()
+			tracer := newTracer()
+			NoLeaks(test, tracer, time.Second)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer tracer.Enter()()
+				time.Sleep(5 * time.Millisecond)
+			}()
+			<-done
+		})
+	}
+}
+
+func (r *recorder) Logf(format string, args ...interface{}) {
+	r.logs = append(r.logs, fmt.Sprintf(format, args...))
+}
+
+func TestNewForTestRoutesToLog(test *testing.T) {
+	r := &recorder{TB: test}
+	tracer := NewForTest(r, &tracey.Options{DisableDepthValue: true, EnableInstrumentation: true})
+	func() {
+		defer tracer.Enter("%s", "outer")()
+		tracer.Start("%s", "inner").End()
+	}()
+
+	assert.Equal(test, 4, len(r.logs))
+	assert.Regexp(test, `^ENTER: \[tid:\d+\]=>outer$`, r.logs[0])
+	assert.Regexp(test, `^  EXIT:  \[tid:\d+\]=>inner \.\.\. in 1µs$`, r.logs[2])
+	assert.Regexp(test, `^EXIT:  \[tid:\d+\]=>outer \.\.\. in 3µs$`, r.logs[3])
+}
+
+func TestNewForTestCleanup(test *testing.T) {
+	r := &recorder{TB: test}
+	tracer := NewForTest(r, &tracey.Options{CollapseRepeats: true, DisableDepthValue: true})
+	for i := 0; i < 3; i++ {
+		tracer.Start("%s", "again").End()
+	}
+	assert.Equal(test, 2, len(r.logs))
+
+	// The pending repeats are flushed before the log is closed, and
+	// nothing gets through after that
+	r.finish()
+	assert.Equal(test, 3, len(r.logs))
+	assert.Contains(test, r.logs[2], "(×3) traceytest.TestNewForTestCleanup — total 3.0µs")
+	tracer.Start("%s", "stray").End()
+	assert.Equal(test, 3, len(r.logs))
+}
+
+func TestNewForTestInParallel(test *testing.T) {
+	for i := 0; i < 4; i++ {
+		test.Run(fmt.Sprint(i), func(test *testing.T) {
+			test.Parallel()
+			tracer := NewForTest(test, nil)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for j := 0; j < 10; j++ {
+					tracer.Start().End()
+				}
+			}()
+			<-done
+			// A goroutine outliving the test must not log into it
+			go func() {
+				time.Sleep(5 * time.Millisecond)
+				tracer.Start().End()
+			}()
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package tracey
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// The bare marker of truncated messages, when the full one does not fit
+const ellipsis = "…"
+
+// TruncateMessage cuts "s" to at most "max" bytes, marker included,
+// ending it with a marker of how much was cut, as in "…(+1.2KB
+// truncated)". The string is cut between runes, and before the combining
+// marks of the last rune kept along with it, so that valid UTF-8 stays
+// valid. If the marker leaves no room for any of "s" the string ends with
+// a bare "…" instead, and if not even that fits only "max" bytes of it are
+// kept. Strings of up to "max" bytes are returned as they are. This is how
+// tracey caps messages, tags and errors, see "MaxMessageLen".
+func TruncateMessage(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	if max < len(ellipsis) {
+		return s[:cutRunes(s, max)]
+	}
+	// The marker grows with the bytes cut, which grow with the marker
+	cut := len(s) - max
+	for {
+		marker := truncationMarker(cut)
+		if len(marker) >= max {
+			return s[:cutRunes(s, max-len(ellipsis))] + ellipsis
+		}
+		kept := cutRunes(s, max-len(marker))
+		if actual := truncationMarker(len(s) - kept); len(actual) <= len(marker) {
+			return s[:kept] + actual
+		}
+		cut = len(s) - kept
+	}
+}
+
+func truncationMarker(cut int) string {
+	return ellipsis + "(+" + formatBytes(uint64(cut)) + " truncated)"
+}
+
+// Returns the length of the longest prefix of "s" of at most "n" bytes
+// which ends neither within a rune nor before a combining mark
+func cutRunes(s string, n int) int {
+	for n > 0 {
+		if utf8.RuneStart(s[n]) {
+			r, _ := utf8.DecodeRuneInString(s[n:])
+			if !unicode.Is(unicode.M, r) {
+				break
+			}
+		}
+		n--
+	}
+	return n
+}
+
+// Cuts a message to "MaxMessageLen", if set
+func (t *Tracer) capMessage(s string) string {
+	if t.options.MaxMessageLen > 0 {
+		return TruncateMessage(s, t.options.MaxMessageLen)
+	}
+	return s
+}
+
+// An error whose message was cut, see "MaxMessageLen"
+type truncatedError struct {
+	error
+	msg string
+}
+
+func (e *truncatedError) Error() string { return e.msg }
+func (e *truncatedError) Unwrap() error { return e.error }
+
+// Returns the error with its message cut to "max" bytes, if it is longer
+func truncateError(err error, max int) error {
+	if msg := err.Error(); len(msg) > max {
+		return &truncatedError{err, TruncateMessage(msg, max)}
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package tracey
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateMessage(test *testing.T) {
+	assert.Equal(test, "short", TruncateMessage("short", 5))
+	assert.Equal(test, "xxxxxxxxx…(+1.2KB truncated)", TruncateMessage(strings.Repeat("x", 1234), 30))
+	// Too short for the full marker, or for any marker at all
+	assert.Equal(test, "xxxx…", TruncateMessage(strings.Repeat("x", 1234), 7))
+	assert.Equal(test, "…", TruncateMessage(strings.Repeat("x", 1234), 3))
+	assert.Equal(test, "xx", TruncateMessage(strings.Repeat("x", 1234), 2))
+	assert.Equal(test, "", TruncateMessage("日本", 2))
+
+	// Neither the rune straddling the cut nor the accent of the last rune
+	// kept are split off
+	assert.Equal(test, "abc…", TruncateMessage("abce\u0301xyz", 7))
+	assert.Equal(test, "ab…", TruncateMessage("abéxyz", 6))
+}
+
+func TestTruncateMessageProperties(test *testing.T) {
+	pieces := []string{"a", "Z", " ", "é", "é", "日本", "🙂", "👩‍👩‍👧", "̈", "%v", "\n"}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		var b strings.Builder
+		for n := rng.Intn(400); n > 0; n-- {
+			b.WriteString(pieces[rng.Intn(len(pieces))])
+		}
+		s, max := b.String(), rng.Intn(80)
+		cut := TruncateMessage(s, max)
+		assert.True(test, len(cut) <= max || cut == s, "%q cut to %d: %q", s, max, cut)
+		assert.True(test, utf8.ValidString(cut), "%q cut to %d: %q", s, max, cut)
+		if len(s) <= max {
+			assert.Equal(test, s, cut)
+		} else if kept := strings.IndexAny(cut, "…"); kept >= 0 {
+			assert.True(test, strings.HasPrefix(s, cut[:kept]), "%q cut to %d: %q", s, max, cut)
+		}
+	}
+}
+
+func TestMaxMessageLen(test *testing.T) {
+	var text, js bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &text}, {Writer: &js, Format: JSONFormat}}, MaxMessageLen: 24})
+	long := strings.Repeat("y", 100)
+	span := t.Start("%s", long)
+	span.Tag("key", long)
+	span.Event(long)
+	err := errors.New(long)
+	span.SetError(err)
+	span.End()
+
+	assert.Equal(test, 5, strings.Count(text.String(), "yyyyy…(+95B truncated)"), text.String())
+	for _, line := range strings.Split(strings.TrimSpace(js.String()), "\n") {
+		ev, e := UnmarshalEvent([]byte(line))
+		assert.Nil(test, e)
+		switch ev.Kind {
+		case EnterEvent, PointEvent:
+			assert.Equal(test, "yyyyy…(+95B truncated)", ev.Message)
+		case ExitEvent:
+			assert.Equal(test, "yyyyy…(+95B truncated)", ev.Tags[0].Value)
+			assert.Equal(test, "yyyyy…(+95B truncated)", ev.Err.Error())
+		}
+	}
+	// The cut error still wraps the original
+	assert.True(test, errors.Is(truncateError(err, 10), err))
+	assert.Equal(test, err, truncateError(err, 100))
+}
+
+func BenchmarkTruncateMessage(b *testing.B) {
+	s := strings.Repeat("日本語のテキスト", 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		io.WriteString(io.Discard, TruncateMessage(s, 200))
+	}
+}
@@ -0,0 +1,172 @@
+package tracey
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MutableOptions are the options which may be changed while the tracer
+// is in use, see `Tracer.Update(...)`. They start out as the tracer's
+// "Options".
+type MutableOptions struct {
+	MinLevel         Level
+	MessageTemplates map[string]string
+	SuppressSubtrees []string
+
+	// The "MinDuration" of each sink, in the order of "Sinks" (or that of
+	// the "CustomLogger" when there are none)
+	MinDurations []time.Duration
+
+	// The "MinLevel" of each sink, in the same order
+	MinLevels []Level
+
+	// The overrides of the spans of given functions, the first one which
+	// matches applying, see `WatchControlFile(...)`
+	FunctionOverrides []FunctionOverride
+}
+
+// Returns a copy of the options which shares nothing with them
+func (o MutableOptions) clone() MutableOptions {
+	if o.MessageTemplates != nil {
+		templates := make(map[string]string, len(o.MessageTemplates))
+		for pattern, template := range o.MessageTemplates {
+			templates[pattern] = template
+		}
+		o.MessageTemplates = templates
+	}
+	o.SuppressSubtrees = append([]string(nil), o.SuppressSubtrees...)
+	o.MinDurations = append([]time.Duration(nil), o.MinDurations...)
+	o.MinLevels = append([]Level(nil), o.MinLevels...)
+	o.FunctionOverrides = append([]FunctionOverride(nil), o.FunctionOverrides...)
+	return o
+}
+
+// The mutable options in effect, compiled. Never changed once swapped in,
+// so that a span which loads it once sees a consistent set.
+type mutableConfig struct {
+	MutableOptions
+	templates *templates
+	suppress  *nameMatcher
+	functions *functionOverrides
+}
+
+// Checks the options for values `NewTracer(...)` lets through, for a
+// tracer with "sinks" sinks
+func (o MutableOptions) checkRanges(sinks int) error {
+	if o.MinLevel < Trace || o.MinLevel > Info {
+		return fmt.Errorf("bad MinLevel %d", o.MinLevel)
+	}
+	if len(o.MinDurations) != sinks {
+		return fmt.Errorf("%d MinDurations for %d sinks", len(o.MinDurations), sinks)
+	}
+	for i, d := range o.MinDurations {
+		if d < 0 {
+			return fmt.Errorf("negative MinDuration %s for sink %d", d, i)
+		}
+	}
+	if len(o.MinLevels) != sinks {
+		return fmt.Errorf("%d MinLevels for %d sinks", len(o.MinLevels), sinks)
+	}
+	for i, level := range o.MinLevels {
+		if level < Trace || level > Info {
+			return fmt.Errorf("bad MinLevel %d for sink %d", level, i)
+		}
+	}
+	return checkFunctionOverrides(o.FunctionOverrides)
+}
+
+// Compiles the options, failing on bad patterns and templates
+func compileConfig(o MutableOptions) (*mutableConfig, error) {
+	config := &mutableConfig{MutableOptions: o}
+	if len(o.MessageTemplates) > 0 {
+		templates, err := compileTemplates(o.MessageTemplates)
+		if err != nil {
+			return nil, err
+		}
+		config.templates = templates
+	}
+	if len(o.SuppressSubtrees) > 0 {
+		suppress, err := newNameMatcher(o.SuppressSubtrees)
+		if err != nil {
+			return nil, err
+		}
+		config.suppress = suppress
+	}
+	if len(o.FunctionOverrides) > 0 {
+		functions, err := compileFunctionOverrides(o.FunctionOverrides)
+		if err != nil {
+			return nil, err
+		}
+		config.functions = functions
+	}
+	return config, nil
+}
+
+// Update changes several of the mutable options at once: "change" is
+// given a copy of those in effect to modify, which is then validated as a
+// whole and swapped in, so that every enter and exit sees either all of
+// the changes or none of them. Spans which are already open keep the fate
+// their enter decided, as with `SetMinLevel(...)`. If the options are not
+// valid (a bad regex, a negative duration...) nothing changes, and the
+// error is returned.
+//
+//	err := tracer.Update(func(o *tracey.MutableOptions) {
+//		o.MinLevel = tracey.Debug
+//		o.MinDurations[0] = 0
+//		o.SuppressSubtrees = append(o.SuppressSubtrees, `^vendor/`)
+//	})
+//
+// With "AuditConfigChanges" set, the changes are logged.
+func (t *Tracer) Update(change func(o *MutableOptions)) error {
+	if t.start == nil {
+		return nil
+	}
+	t.updating.Lock()
+	defer t.updating.Unlock()
+	old := t.config.Load()
+	o := old.clone()
+	change(&o)
+	err := o.checkRanges(len(t.sinks))
+	var config *mutableConfig
+	if err == nil {
+		// The options may still be changed by whoever held on to them
+		config, err = compileConfig(o.clone())
+	}
+	if err != nil {
+		return fmt.Errorf("tracey: %v", err)
+	}
+	t.config.Store(config)
+	if t.options.AuditConfigChanges {
+		if diffs := DiffSnapshots(t.snapshot(old), t.snapshot(config)); len(diffs) > 0 {
+			changes := make([]string, len(diffs))
+			for i, diff := range diffs {
+				changes[i] = diff.String()
+			}
+			line := "OPTIONS CHANGED: " + strings.Join(changes, ", ") + "\n"
+			if t.admitOutput(len(line)) {
+				t.note(line)
+			}
+		}
+	}
+	return nil
+}
+
+// CurrentOptions returns a copy of the mutable options in effect.
+func (t *Tracer) CurrentOptions() MutableOptions {
+	if t.start == nil {
+		return MutableOptions{MinLevel: t.options.MinLevel}
+	}
+	return t.config.Load().clone()
+}
+
+// Lists the templates by pattern, as in ["^a$: $FN"]
+func sortedTemplates(templates map[string]string) []string {
+	var sorted []string
+	for pattern, template := range templates {
+		sorted = append(sorted, pattern+": "+template)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,133 @@
+package tracey
+
+import (
+	"bytes"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func updatedCall(t *Tracer) { defer t.Enter(Debug, "%s", "$FN")() }
+
+func TestUpdate(test *testing.T) {
+	var buf, slow bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks: []Sink{
+			{Logger: log.New(&buf, "", 0)},
+			{Writer: &slow, MinDuration: time.Hour},
+		},
+		MinLevel:           Info,
+		AuditConfigChanges: true,
+	})
+
+	updatedCall(t)
+	assert.Nil(test, t.Update(func(o *MutableOptions) {
+		o.MinLevel = Debug
+		o.MinDurations[1] = 0
+		o.MessageTemplates = map[string]string{`updatedCall$`: "$FN (updated)"}
+	}))
+	updatedCall(t)
+
+	lines := strings.Split(RE_tidMarker.ReplaceAllString(buf.String(), "=>"), "\n")
+	assert.Equal(test, []string{
+		"OPTIONS CHANGED: MinLevel info → debug, MessageTemplates [] → [updatedCall$: $FN (updated)], MinDurations [0s 1h0m0s] → [0s 0s]",
+		"[ 0]ENTER: DBG go-tracey.updatedCall (updated)",
+		"[ 0]EXIT:  DBG go-tracey.updatedCall (updated)",
+		"",
+	}, lines)
+	assert.Equal(test, 3, strings.Count(slow.String(), "\n"))
+
+	// Nothing changes, nothing is logged
+	buf.Reset()
+	assert.Nil(test, t.Update(func(o *MutableOptions) {}))
+	assert.Equal(test, "", buf.String())
+
+	// Levels go through the mutable options as well
+	t.SetMinLevel(Info)
+	assert.Equal(test, Info, t.MinLevel())
+	assert.Equal(test, Info, t.CurrentOptions().MinLevel)
+}
+
+func TestUpdateInvalid(test *testing.T) {
+	var buf bytes.Buffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &buf}}, SuppressSubtrees: []string{`^a$`}, AuditConfigChanges: true})
+	before := t.CurrentOptions()
+
+	assert.EqualError(test, t.Update(func(o *MutableOptions) {
+		o.MinLevel = Debug
+		o.SuppressSubtrees = append(o.SuppressSubtrees, `(`)
+	}), "tracey: bad pattern in SuppressSubtrees: error parsing regexp: missing closing ): `(`")
+	assert.EqualError(test, t.Update(func(o *MutableOptions) { o.MinDurations = nil }), "tracey: 0 MinDurations for 1 sinks")
+	assert.EqualError(test, t.Update(func(o *MutableOptions) { o.MinDurations[0] = -time.Second }), "tracey: negative MinDuration -1s for sink 0")
+	assert.EqualError(test, t.Update(func(o *MutableOptions) { o.MinLevel = 7 }), "tracey: bad MinLevel 7")
+	assert.EqualError(test, t.Update(func(o *MutableOptions) { o.MinLevels = nil }), "tracey: 0 MinLevels for 1 sinks")
+	assert.EqualError(test, t.Update(func(o *MutableOptions) { o.MinLevels[0] = 7 }), "tracey: bad MinLevel 7 for sink 0")
+	assert.EqualError(test, t.Update(func(o *MutableOptions) {
+		o.MessageTemplates = map[string]string{"x": "$NOPE"}
+	}), `tracey: bad template in MessageTemplates: unknown token "$NOPE" in template "$NOPE"`)
+
+	assert.Equal(test, before, t.CurrentOptions())
+	assert.Equal(test, "", buf.String())
+
+	// Holding on to the options does not change them behind the tracer's back
+	var kept *MutableOptions
+	t.Update(func(o *MutableOptions) { kept = o })
+	kept.SuppressSubtrees[0] = `^b$`
+	assert.Equal(test, []string{`^a$`}, t.CurrentOptions().SuppressSubtrees)
+}
+
+func TestUpdateIsAtomic(test *testing.T) {
+	var buf lockedBuffer
+	t := NewTracer(&Options{Sinks: []Sink{{Writer: &buf}}})
+	// The call is only logged by the first set of options, any line using
+	// the template of the second means that the level of one was seen with
+	// the template of the other
+	first := func(o *MutableOptions) {
+		o.MinLevel = Trace
+		o.MessageTemplates = map[string]string{`updatedCall$`: "first $MSG"}
+	}
+	second := func(o *MutableOptions) {
+		o.MinLevel = Info
+		o.MessageTemplates = map[string]string{`updatedCall$`: "second $MSG"}
+	}
+
+	// Options change all along the calls
+	assert.Nil(test, t.Update(first))
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				assert.Nil(test, t.Update(first))
+				runtime.Gosched()
+				assert.Nil(test, t.Update(second))
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				updatedCall(t)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-stopped
+
+	out := buf.String()
+	assert.Contains(test, out, "ENTER: DBG first")
+	assert.NotContains(test, out, "second")
+	assert.Equal(test, strings.Count(out, "ENTER: DBG first"), strings.Count(out, "EXIT:  DBG first"))
+}
@@ -0,0 +1,94 @@
+package tracey
+
+import "fmt"
+
+// A TraceValuer is a value which knows how it should be traced, such as a
+// type holding secrets. Tag values and arguments implementing it are
+// rendered by their `TraceValue()` rather than with "%v".
+type TraceValuer interface {
+	TraceValue() string
+}
+
+// What a value is rendered as when its renderer panics
+const renderError = "<render error>"
+
+// Renders a value with the "ValueRenderer", or else as a TraceValuer, and
+// returns false if neither applies
+func (t *Tracer) customValue(v interface{}) (string, bool) {
+	if t.options.ValueRenderer == nil {
+		if _, ok := v.(TraceValuer); !ok {
+			return "", false
+		}
+	}
+	return t.renderCustom(v)
+}
+
+func (t *Tracer) renderCustom(v interface{}) (s string, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			s, ok = renderError, true
+		}
+	}()
+	if render := t.options.ValueRenderer; render != nil {
+		if s, ok := render(v); ok {
+			return s, true
+		}
+	}
+	if tv, ok := v.(TraceValuer); ok {
+		return tv.TraceValue(), true
+	}
+	return "", false
+}
+
+// Renders the values of the tags, once for all sinks
+func (t *Tracer) renderTags(tags []Tag) []string {
+	values := make([]string, len(tags))
+	for i, tag := range tags {
+		if s, ok := t.customValue(tag.Value); ok {
+			values[i] = s
+		} else if s, ok := tag.Value.(string); ok {
+			values[i] = s
+		} else if t.boundsValues() {
+			values[i] = fmt.Sprint(t.boundArg(tag.Value))
+		} else {
+			values[i] = fmt.Sprint(tag.Value)
+		}
+		values[i] = t.capMessage(values[i])
+	}
+	return values
+}
+
+// Returns the arguments of a message with those which have a custom
+// rendering replaced by it, or the arguments themselves if none do
+func (t *Tracer) renderArgs(args []interface{}) []interface{} {
+	var rendered []interface{}
+	for i, arg := range args {
+		s, ok := t.customValue(arg)
+		if !ok {
+			continue
+		}
+		if rendered == nil {
+			rendered = append([]interface{}(nil), args...)
+		}
+		rendered[i] = renderedValue(s)
+	}
+	if rendered == nil {
+		return args
+	}
+	return rendered
+}
+
+// A custom rendering, formatted the same whatever the verb
+type renderedValue string
+
+func (v renderedValue) Format(f fmt.State, verb rune) {
+	f.Write([]byte(v))
+}
+
+// Returns the rendering of the value of the i-th tag
+func (ev *Event) tagValue(i int) string {
+	if i < len(ev.tagValues) {
+		return ev.tagValues[i]
+	}
+	return fmt.Sprint(ev.Tags[i].Value)
+}
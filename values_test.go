@@ -0,0 +1,96 @@
+package tracey
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Part of "TestValueRenderer"
+type userID int
+
+type secret string
+
+func (secret) TraceValue() string { return "<redacted>" }
+
+type explosive struct{}
+
+func renderTestValues(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339), true
+	case []byte:
+		if len(v) > 16 {
+			return hex.EncodeToString(v[:16]) + "...", true
+		}
+		return hex.EncodeToString(v), true
+	case userID:
+		return "user-" + string(rune('A'+int(v))), true
+	case explosive:
+		panic("boom")
+	}
+	return "", false
+}
+
+func TestValueRenderer(test *testing.T) {
+	ResetTestBuffer()
+	js := &lockedBuffer{}
+	var rows bytes.Buffer
+	t := NewTracer(&Options{
+		Sinks:             []Sink{{Logger: BufLogger}, {Writer: js, Format: JSONFormat}},
+		CSVWriter:         &rows,
+		DisableDepthValue: true,
+		ValueRenderer:     renderTestValues,
+	})
+	span := t.Start("%s for %d (%v)", "lookup", userID(2), secret("hunter2"))
+	span.Tag("at", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	span.Tag("key", []byte("0123456789abcdefXYZ"))
+	span.Tag("user", userID(1))
+	span.Tag("password", secret("hunter2"))
+	span.Tag("bad", explosive{})
+	span.Tag("n", 42)
+	span.End()
+
+	tags := "at=2020-01-02T03:04:05Z key=30313233343536373839616263646566... user=user-B password=<redacted> bad=<render error> n=42"
+	assert.Equal(test, `
+ENTER: =>lookup for user-C (<redacted>)
+EXIT:  =>lookup for user-C (<redacted>) {`+tags+`}
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+
+	exits := jsonExits(test, js)
+	if assert.Equal(test, 1, len(exits)) {
+		assert.Equal(test, "lookup for user-C (<redacted>)", exits[0]["msg"])
+		assert.Equal(test, map[string]interface{}{
+			"at":       "2020-01-02T03:04:05Z",
+			"key":      "30313233343536373839616263646566...",
+			"user":     "user-B",
+			"password": "<redacted>",
+			"bad":      "<render error>",
+			"n":        "42",
+		}, exits[0]["tags"])
+	}
+
+	records, err := csv.NewReader(&rows).ReadAll()
+	assert.Nil(test, err)
+	if assert.Equal(test, 2, len(records)) {
+		assert.Equal(test, "lookup for user-C (<redacted>)", records[1][6])
+		assert.Equal(test, "at=2020-01-02T03:04:05Z;key=30313233343536373839616263646566...;user=user-B;"+
+			"password=<redacted>;bad=<render error>;n=42", records[1][9])
+	}
+}
+
+func TestTraceValuerWithoutRenderer(test *testing.T) {
+	ResetTestBuffer()
+	t := NewTracer(&Options{CustomLogger: BufLogger, DisableDepthValue: true})
+	span := t.Start("%s", secret("hunter2"))
+	span.Tag("password", secret("hunter2"))
+	span.End()
+	assert.Equal(test, `
+ENTER: =><redacted>
+EXIT:  =><redacted> {password=<redacted>}
+`, RE_tidMarker.ReplaceAllString(GetTestBuffer(), "$1=>"))
+}
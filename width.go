@@ -0,0 +1,123 @@
+package tracey
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+// The runes which take two columns in a terminal, East Asian wide and full
+// width characters and emoji, as sorted ranges
+var wideRunes = [][2]rune{
+	{0x1100, 0x115F},   // Hangul Jamo
+	{0x231A, 0x231B},   // watch, hourglass
+	{0x23E9, 0x23EC},   // media controls
+	{0x23F0, 0x23F0},   // alarm clock
+	{0x23F3, 0x23F3},   // hourglass
+	{0x25FD, 0x25FE},   // small squares
+	{0x2614, 0x2615},   // umbrella, hot beverage
+	{0x2648, 0x2653},   // zodiac
+	{0x267F, 0x267F},   // wheelchair
+	{0x2693, 0x2693},   // anchor
+	{0x26A1, 0x26A1},   // high voltage
+	{0x26AA, 0x26AB},   // circles
+	{0x26BD, 0x26BE},   // balls
+	{0x26C4, 0x26C5},   // snowman, sun
+	{0x26CE, 0x26CE},   // ophiuchus
+	{0x26D4, 0x26D4},   // no entry
+	{0x26EA, 0x26EA},   // church
+	{0x26F2, 0x26F3},   // fountain, golf
+	{0x26F5, 0x26F5},   // sailboat
+	{0x26FA, 0x26FA},   // tent
+	{0x26FD, 0x26FD},   // fuel pump
+	{0x2705, 0x2705},   // check mark
+	{0x270A, 0x270B},   // fists
+	{0x2728, 0x2728},   // sparkles
+	{0x274C, 0x274C},   // cross mark
+	{0x274E, 0x274E},   // squared cross mark
+	{0x2753, 0x2755},   // question marks
+	{0x2757, 0x2757},   // exclamation mark
+	{0x2795, 0x2797},   // plus, minus, division
+	{0x27B0, 0x27B0},   // curly loop
+	{0x27BF, 0x27BF},   // double curly loop
+	{0x2B1B, 0x2B1C},   // large squares
+	{0x2B50, 0x2B50},   // star
+	{0x2B55, 0x2B55},   // circle
+	{0x2E80, 0x303E},   // CJK radicals, symbols and punctuation
+	{0x3041, 0x33FF},   // kana, CJK compatibility
+	{0x3400, 0x4DBF},   // CJK extension A
+	{0x4E00, 0x9FFF},   // CJK unified ideographs
+	{0xA000, 0xA4CF},   // Yi
+	{0xA960, 0xA97F},   // Hangul Jamo extended A
+	{0xAC00, 0xD7A3},   // Hangul syllables
+	{0xF900, 0xFAFF},   // CJK compatibility ideographs
+	{0xFE10, 0xFE19},   // vertical forms
+	{0xFE30, 0xFE6F},   // CJK compatibility forms, small forms
+	{0xFF00, 0xFF60},   // full width forms
+	{0xFFE0, 0xFFE6},   // full width signs
+	{0x16FE0, 0x18AFF}, // Tangut
+	{0x1B000, 0x1B2FF}, // kana supplement and extensions
+	{0x1F004, 0x1F004}, // mahjong tile
+	{0x1F0CF, 0x1F0CF}, // playing card
+	{0x1F18E, 0x1F18E}, // AB button
+	{0x1F191, 0x1F19A}, // squared letters
+	{0x1F200, 0x1F251}, // enclosed ideographs
+	{0x1F300, 0x1F64F}, // pictographs, emoticons
+	{0x1F680, 0x1F6FF}, // transport and map symbols
+	{0x1F7E0, 0x1F7EB}, // colored circles and squares
+	{0x1F90C, 0x1F9FF}, // supplemental symbols and pictographs
+	{0x1FA70, 0x1FAFF}, // symbols and pictographs extended A
+	{0x20000, 0x3FFFD}, // CJK extensions B and on
+}
+
+// The runes which take no column, as they combine with the rune before
+var zeroWidthRunes = [][2]rune{
+	{0x0300, 0x036F},   // combining diacritical marks
+	{0x200B, 0x200F},   // zero width spaces and joiners, direction marks
+	{0x20D0, 0x20FF},   // combining marks for symbols
+	{0xFE00, 0xFE0F},   // variation selectors
+	{0xFE20, 0xFE2F},   // combining half marks
+	{0x1F3FB, 0x1F3FF}, // skin tone modifiers
+	{0xE0100, 0xE01EF}, // variation selectors supplement
+}
+
+func inRanges(ranges [][2]rune, r rune) bool {
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i][1] >= r })
+	return i < len(ranges) && ranges[i][0] <= r
+}
+
+// Returns how many columns the text takes: as many as its runes, unless
+// "wide" is set (see "WideCharAware") which counts two for the wide runes
+// and none for those which combine with the rune before
+func displayWidth(b []byte, wide bool) int {
+	if !wide {
+		return utf8.RuneCount(b)
+	}
+	width := 0
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		b = b[size:]
+		switch {
+		case r < 0x300:
+			width++
+		case inRanges(zeroWidthRunes, r):
+		case inRanges(wideRunes, r):
+			width += 2
+		default:
+			width++
+		}
+	}
+	return width
+}
+
+// Pads the shorter of the enter and exit messages with spaces, to the
+// width of the longer one, so that what follows them lines up
+func padMarkers(options *Options) {
+	enter := displayWidth([]byte(options.EnterMessage), options.WideCharAware)
+	exit := displayWidth([]byte(options.ExitMessage), options.WideCharAware)
+	for ; enter < exit; enter++ {
+		options.EnterMessage += " "
+	}
+	for ; exit < enter; exit++ {
+		options.ExitMessage += " "
+	}
+}
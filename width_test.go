@@ -0,0 +1,94 @@
+package tracey
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Traces spans named in several scripts, nested a level deeper each
+func traceScripts(t *Tracer) {
+	names := []string{"fetch orders", "注文を処理", "🚀 launch", "résumé"}
+	var spans []*Span
+	for _, name := range names {
+		spans = append(spans, t.Start("%s", name))
+	}
+	for i := len(spans) - 1; i >= 0; i-- {
+		spans[i].End()
+	}
+}
+
+func scriptsTracer(out *bytes.Buffer, o Options) *Tracer {
+	o.Sinks = []Sink{{Writer: out}}
+	o.EnableInstrumentation = true
+	o.AlignDurations = 40
+	o.Clock = fakeClock(time.Millisecond)
+	o.MessageTemplates = map[string]string{`.`: "$MSG"}
+	return NewTracer(&o)
+}
+
+func TestWideCharAlignment(test *testing.T) {
+	var out bytes.Buffer
+	traceScripts(scriptsTracer(&out, Options{}))
+	// Every character counts as a column
+	assert.Equal(test, "[ 0]ENTER: fetch orders\n"+
+		"[ 1]  ENTER: 注文を処理\n"+
+		"[ 2]    ENTER: 🚀 launch\n"+
+		"[ 3]      ENTER: résumé\n"+
+		"[ 3]      EXIT:  résumé ............... in 1ms\n"+
+		"[ 2]    EXIT:  🚀 launch ............... in 3ms\n"+
+		"[ 1]  EXIT:  注文を処理 .................... in 5ms\n"+
+		"[ 0]EXIT:  fetch orders ............... in 7ms\n", out.String())
+
+	out.Reset()
+	traceScripts(scriptsTracer(&out, Options{WideCharAware: true}))
+	// The ideographs and the emoji take two columns each
+	assert.Equal(test, "[ 0]ENTER: fetch orders\n"+
+		"[ 1]  ENTER: 注文を処理\n"+
+		"[ 2]    ENTER: 🚀 launch\n"+
+		"[ 3]      ENTER: résumé\n"+
+		"[ 3]      EXIT:  résumé ............... in 1ms\n"+
+		"[ 2]    EXIT:  🚀 launch .............. in 3ms\n"+
+		"[ 1]  EXIT:  注文を処理 ............... in 5ms\n"+
+		"[ 0]EXIT:  fetch orders ............... in 7ms\n", out.String())
+}
+
+func TestMarkerPadding(test *testing.T) {
+	for _, c := range []struct {
+		options     Options
+		enter, exit string
+	}{
+		{Options{}, "ENTER: ", "EXIT:  "},
+		{Options{EnterMessage: "> ", ExitMessage: "done: "}, ">     ", "done: "},
+		{Options{EnterMessage: "開始: "}, "開始:    ", "EXIT:  "},
+		{Options{EnterMessage: "開始: ", WideCharAware: true}, "開始:  ", "EXIT:  "},
+		{Options{EnterMessage: "入る ", ExitMessage: "出る ", WideCharAware: true}, "入る ", "出る "},
+		{Options{EnterMessage: "🟢 ", ExitMessage: "end ", WideCharAware: true}, "🟢  ", "end "},
+	} {
+		var out bytes.Buffer
+		c.options.Sinks = []Sink{{Writer: &out}}
+		c.options.MessageTemplates = map[string]string{`.`: "$MSG"}
+		t := NewTracer(&c.options)
+		t.Start("%s", "x").End()
+		assert.Equal(test, "[ 0]"+c.enter+"x\n[ 0]"+c.exit+"x\n", out.String())
+	}
+}
+
+func TestDisplayWidth(test *testing.T) {
+	for s, width := range map[string]int{
+		"fetch":     5,
+		"注文":        4,
+		"ｶﾀｶﾅ":      4,
+		"ＡＢ":        4,
+		"🚀":         2,
+		"👍🏽":        2,
+		"é":        1,
+		"한국어":       6,
+		"⚠ warning": 9,
+	} {
+		assert.Equal(test, width, displayWidth([]byte(s), true), s)
+	}
+	assert.Equal(test, 2, displayWidth([]byte("注文"), false))
+}